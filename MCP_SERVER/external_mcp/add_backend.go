@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// keyValueFlag collects repeated KEY=VALUE flags
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	return fmt.Sprint(map[string]string(f))
+}
+
+func (f keyValueFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected KEY=VALUE, got %q", value)
+	}
+	f[key] = val
+	return nil
+}
+
+// probeResult is what a server reported when add-backend probed it
+type probeResult struct {
+	serverName string
+	tools      []mcp.ToolRetType
+}
+
+// runAddBackend implements the add-backend command, probing a server given by URL or command and
+// adding an entry for it to the config
+func runAddBackend(configPath string, args []string) {
+	fs := flag.NewFlagSet("add-backend", flag.ExitOnError)
+	name := fs.String("name", "", "Name of the new entry; defaults to one suggested from the server's identity")
+	headers := keyValueFlag{}
+	fs.Var(headers, "header", "Header to send to a remote server as NAME=VALUE, repeatable")
+	env := keyValueFlag{}
+	fs.Var(env, "env", "Environment variable for a command as KEY=VALUE, repeatable")
+	dryRun := fs.Bool("dry-run", false, "Print the entry instead of adding it to the config")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: add-backend [flags] <url> | <command> [args...]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	entry := backendEntry(fs.Args(), headers, env)
+	// Backend start-up logging would drown the report
+	log.SetOutput(io.Discard)
+	probe, err := probeBackend(entry)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		log.Fatalf("Failed to probe %s: %v", strings.Join(fs.Args(), " "), err)
+	}
+
+	servers, err := readServerEntries(configPath)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", configPath, err)
+	}
+	if *name == "" {
+		*name = suggestBackendName(probe.serverName, entry, servers)
+	} else if _, exists := servers[*name]; exists {
+		log.Fatalf("%s already has a server named '%s'", configPath, *name)
+	}
+
+	fmt.Printf("Found %d tools on %s:\n", len(probe.tools), *name)
+	for _, tool := range probe.tools {
+		fmt.Printf("  %s\n", tool.Name)
+	}
+	if *dryRun {
+		out, _ := json.MarshalIndent(map[string]MCPStdIOConfig{*name: entry}, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	if err := addServerEntry(configPath, *name, entry); err != nil {
+		log.Fatalf("Failed to update %s: %v", configPath, err)
+	}
+	fmt.Printf("Added '%s' to %s\n", *name, configPath)
+}
+
+// backendEntry builds the config entry for a target given as a URL or as a command and its arguments
+func backendEntry(target []string, headers, env map[string]string) MCPStdIOConfig {
+	if u, err := url.Parse(target[0]); err == nil && len(target) == 1 {
+		switch u.Scheme {
+		case "http", "https", "ws", "wss":
+			entry := MCPStdIOConfig{URL: target[0]}
+			if len(headers) > 0 {
+				entry.Headers = headers
+			}
+			return entry
+		}
+	}
+	if env == nil {
+		env = map[string]string{}
+	}
+	return MCPStdIOConfig{Command: target[0], Args: target[1:], Env: env, WorkingDir: "."}
+}
+
+// probeBackend starts or connects to the server, negotiates initialize and lists its tools
+func probeBackend(entry MCPStdIOConfig) (probeResult, error) {
+	b, err := startBackend("probe", entry, mcp.ClientInfo{Name: "mcp-service", Version: "1.0.0"})
+	if err != nil {
+		return probeResult{}, err
+	}
+	defer stopBackend(b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	initialized, err := b.client.Initialize(ctx)
+	if err != nil {
+		return probeResult{}, fmt.Errorf("initialize failed: %v", err)
+	}
+	tools, err := b.refreshTools()
+	if err != nil {
+		return probeResult{}, fmt.Errorf("listing tools failed: %v", err)
+	}
+	return probeResult{serverName: initialized.ServerInfo.Name, tools: tools}, nil
+}
+
+var nonNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// suggestBackendName derives an entry name from the server's announced name, falling back to the
+// URL host or the command, that is not taken by an existing server
+func suggestBackendName(serverName string, entry MCPStdIOConfig, existing map[string]json.RawMessage) string {
+	candidate := serverName
+	if candidate == "" && entry.URL != "" {
+		if u, err := url.Parse(entry.URL); err == nil {
+			candidate = strings.Split(u.Hostname(), ".")[0]
+		}
+	}
+	if candidate == "" {
+		// Launchers such as npx name the package last
+		candidate = entry.Command
+		if len(entry.Args) > 0 {
+			candidate = entry.Args[len(entry.Args)-1]
+		}
+		candidate = filepath.Base(candidate)
+	}
+
+	candidate = nonNameChars.ReplaceAllString(strings.ToLower(candidate), "-")
+	for _, affix := range []string{"modelcontextprotocol-", "mcp-server-", "server-", "mcp-"} {
+		candidate = strings.TrimPrefix(candidate, affix)
+	}
+	candidate = strings.Trim(strings.TrimSuffix(strings.TrimSuffix(candidate, "-server"), "-mcp"), "-")
+	if candidate == "" {
+		candidate = "backend"
+	}
+
+	name := candidate
+	for i := 2; ; i++ {
+		if _, taken := existing[name]; !taken {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", candidate, i)
+	}
+}
+
+// readServerEntries returns the raw server entries of the config, or none when it doesn't exist
+func readServerEntries(path string) (map[string]json.RawMessage, error) {
+	doc, err := readConfigDocument(path)
+	if err != nil {
+		return nil, err
+	}
+	servers := map[string]json.RawMessage{}
+	if raw, ok := doc["MCPStdIOServers"]; ok {
+		if err := json.Unmarshal(raw, &servers); err != nil {
+			return nil, err
+		}
+	}
+	return servers, nil
+}
+
+// readConfigDocument reads the config's top-level fields without resolving any placeholders
+func readConfigDocument(path string) (map[string]json.RawMessage, error) {
+	doc := map[string]json.RawMessage{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return doc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if _, ok := doc["mcpServers"]; ok {
+		if _, ok := doc["MCPStdIOServers"]; !ok {
+			return nil, fmt.Errorf("it is a Claude Desktop config; convert it with import-claude-config first")
+		}
+	}
+	return doc, nil
+}
+
+// addServerEntry adds the entry to the config, keeping its other settings and placeholders as written
+func addServerEntry(path, name string, entry MCPStdIOConfig) error {
+	doc, err := readConfigDocument(path)
+	if err != nil {
+		return err
+	}
+	servers, err := readServerEntries(path)
+	if err != nil {
+		return err
+	}
+	if servers[name], err = json.Marshal(entry); err != nil {
+		return err
+	}
+	if doc["MCPStdIOServers"], err = json.Marshal(servers); err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(out, '\n'), 0o644)
+}
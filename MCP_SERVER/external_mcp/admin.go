@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+// adminServer serves operational endpoints on a listener separate from MCP traffic.
+// A nil admin server ignores registrations.
+type adminServer struct {
+	addr string
+	mux  *http.ServeMux
+}
+
+// newAdminServer returns an admin server for addr, or nil when no address is configured
+func newAdminServer(addr string) *adminServer {
+	if addr == "" {
+		return nil
+	}
+	return &adminServer{addr: addr, mux: http.NewServeMux()}
+}
+
+// handle registers an endpoint
+func (a *adminServer) handle(pattern string, handler http.Handler) {
+	if a == nil {
+		return
+	}
+	a.mux.Handle(pattern, handler)
+}
+
+// enablePprof exposes the runtime profiles under /debug/pprof/
+func (a *adminServer) enablePprof() {
+	a.handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
+	a.handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+	a.handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+	a.handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+	a.handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+}
+
+// start begins serving in the background
+func (a *adminServer) start() error {
+	if a == nil {
+		return nil
+	}
+	listener, err := listen(a.addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Printf("Serving admin endpoints on %s", listener.Addr())
+		if err := http.Serve(listener, a.mux); err != nil {
+			log.Printf("Admin server error: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// defaultCharsPerToken approximates how many characters of English text or code make up a token
+const defaultCharsPerToken = 4
+
+// SizeAnnotationConfig adds the size of every tool result to its _meta, as sizeBytes, lines and
+// estimatedTokens, so agent frameworks can decide whether to summarize it before adding it to the
+// context window
+type SizeAnnotationConfig struct {
+	// CharsPerToken is the number of characters counted as one token; defaults to 4
+	CharsPerToken float64 `json:"CharsPerToken,omitempty"`
+}
+
+// resultSize describes the size of a tool result
+type resultSize struct {
+	SizeBytes       int `json:"sizeBytes"`
+	Lines           int `json:"lines"`
+	EstimatedTokens int `json:"estimatedTokens"`
+}
+
+// sizeAnnotator decorates the downstream transport to add the size of tool results to their _meta
+type sizeAnnotator struct {
+	transport.Transport
+	charsPerToken float64
+
+	mu sync.Mutex
+	// calls holds the ids of tools/call requests waiting for their result
+	calls map[transport.RequestId]bool
+}
+
+// newSizeAnnotator returns inner annotating tool results, or inner itself if cfg is nil
+func newSizeAnnotator(inner transport.Transport, cfg *SizeAnnotationConfig) transport.Transport {
+	if cfg == nil {
+		return inner
+	}
+	a := &sizeAnnotator{Transport: inner, charsPerToken: cfg.CharsPerToken, calls: make(map[transport.RequestId]bool)}
+	if a.charsPerToken <= 0 {
+		a.charsPerToken = defaultCharsPerToken
+	}
+	return a
+}
+
+// SetMessageHandler remembers tools/call requests and hands every message to handler
+func (a *sizeAnnotator) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	a.Transport.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		if message.Type == transport.BaseMessageTypeJSONRPCRequestType && message.JsonRpcRequest.Method == "tools/call" {
+			a.mu.Lock()
+			a.calls[message.JsonRpcRequest.Id] = true
+			a.mu.Unlock()
+		}
+		handler(ctx, message)
+	})
+}
+
+// Send annotates the results of tool calls
+func (a *sizeAnnotator) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	var id transport.RequestId
+	switch message.Type {
+	case transport.BaseMessageTypeJSONRPCResponseType:
+		id = message.JsonRpcResponse.Id
+	case transport.BaseMessageTypeJSONRPCErrorType:
+		id = message.JsonRpcError.Id
+	default:
+		return a.Transport.Send(ctx, message)
+	}
+	a.mu.Lock()
+	call := a.calls[id]
+	delete(a.calls, id)
+	a.mu.Unlock()
+	if call && message.Type == transport.BaseMessageTypeJSONRPCResponseType {
+		message.JsonRpcResponse.Result = a.annotate(message.JsonRpcResponse.Result)
+	}
+	return a.Transport.Send(ctx, message)
+}
+
+// measure returns the size of a tool result; lines and tokens count its text and embedded text resources
+func (a *sizeAnnotator) measure(result json.RawMessage) resultSize {
+	var decoded struct {
+		Content []struct {
+			Text     string `json:"text"`
+			Resource struct {
+				Text string `json:"text"`
+			} `json:"resource"`
+		} `json:"content"`
+	}
+	_ = json.Unmarshal(result, &decoded)
+
+	size := resultSize{SizeBytes: len(result)}
+	chars := 0
+	for _, content := range decoded.Content {
+		for _, text := range []string{content.Text, content.Resource.Text} {
+			if text == "" {
+				continue
+			}
+			size.Lines += strings.Count(strings.TrimSuffix(text, "\n"), "\n") + 1
+			chars += utf8.RuneCountInString(text)
+		}
+	}
+	size.EstimatedTokens = int(math.Ceil(float64(chars) / a.charsPerToken))
+	return size
+}
+
+// annotate adds the size of a tool result to its _meta. The size is spliced into results without a
+// _meta of their own, so a relayed result keeps its bytes.
+func (a *sizeAnnotator) annotate(result json.RawMessage) json.RawMessage {
+	size := a.measure(result)
+	trimmed := bytes.TrimSpace(result)
+	if !bytes.Contains(trimmed, []byte(`"_meta"`)) && bytes.HasPrefix(trimmed, []byte("{")) {
+		meta, _ := json.Marshal(map[string]resultSize{"_meta": size})
+		// Join {"_meta":{...}} and {...} into {"_meta":{...},...}
+		annotated := append(meta[:len(meta)-1:len(meta)-1], ',')
+		if rest := bytes.TrimSpace(trimmed[1:]); bytes.HasPrefix(rest, []byte("}")) {
+			annotated = annotated[:len(annotated)-1]
+		}
+		return append(annotated, trimmed[1:]...)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(result, &decoded); err != nil {
+		return result
+	}
+	meta, _ := decoded["_meta"].(map[string]interface{})
+	if meta == nil {
+		meta = make(map[string]interface{})
+	}
+	meta["sizeBytes"], meta["lines"], meta["estimatedTokens"] = size.SizeBytes, size.Lines, size.EstimatedTokens
+	decoded["_meta"] = meta
+	annotated, err := json.Marshal(decoded)
+	if err != nil {
+		return result
+	}
+	return annotated
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pendingApproval is a call waiting for an operator's decision
+type pendingApproval struct {
+	ID       string      `json:"id"`
+	Time     time.Time   `json:"time"`
+	Input    policyInput `json:"input"`
+	Reason   string      `json:"reason,omitempty"`
+	decision chan bool
+}
+
+// approvalQueue holds the calls waiting for an operator to approve or deny them through the admin
+// endpoint, whether the policy or a spend limit asked for the approval
+type approvalQueue struct {
+	mu      sync.Mutex
+	pending map[string]*pendingApproval
+}
+
+func newApprovalQueue() *approvalQueue {
+	return &approvalQueue{pending: make(map[string]*pendingApproval)}
+}
+
+// await holds the call until an operator approves or denies it, or the approval times out
+func (q *approvalQueue) await(ctx context.Context, input policyInput, reason string, timeout time.Duration) error {
+	id, err := randomID()
+	if err != nil {
+		return err
+	}
+	approval := &pendingApproval{ID: id, Time: input.Time, Input: input, Reason: reason, decision: make(chan bool, 1)}
+	q.mu.Lock()
+	q.pending[id] = approval
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.pending, id)
+		q.mu.Unlock()
+	}()
+	logf(ctx, "Call to '%s' by '%s' awaits approval %s", input.Tool, input.Identity, id)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case approved := <-approval.decision:
+		if approved {
+			logf(ctx, "Approval %s granted", id)
+			return nil
+		}
+		logf(ctx, "Approval %s refused", id)
+		return fmt.Errorf("permission denied: call to '%s' was not approved", input.Tool)
+	case <-timer.C:
+		logf(ctx, "Approval %s timed out", id)
+		return fmt.Errorf("permission denied: call to '%s' was not approved within %s", input.Tool, timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// decide approves or refuses a pending call, reporting whether it was still waiting
+func (q *approvalQueue) decide(id string, approved bool) bool {
+	q.mu.Lock()
+	approval, ok := q.pending[id]
+	if ok {
+		delete(q.pending, id)
+	}
+	q.mu.Unlock()
+	if ok {
+		approval.decision <- approved
+	}
+	return ok
+}
+
+// ServeHTTP lists the calls awaiting approval on GET /approvals, oldest first, and decides one on
+// POST /approvals/<id>/approve or /approvals/<id>/deny
+func (q *approvalQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/approvals"), "/")
+	if rest == "" && r.Method == http.MethodGet {
+		q.mu.Lock()
+		pending := make([]*pendingApproval, 0, len(q.pending))
+		for _, approval := range q.pending {
+			pending = append(pending, approval)
+		}
+		q.mu.Unlock()
+		sort.Slice(pending, func(i, j int) bool { return pending[i].Time.Before(pending[j].Time) })
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(pending)
+		return
+	}
+
+	id, action, ok := strings.Cut(rest, "/")
+	if !ok || r.Method != http.MethodPost || (action != "approve" && action != "deny") {
+		http.Error(w, "expected GET /approvals or POST /approvals/<id>/approve|deny", http.StatusBadRequest)
+		return
+	}
+	if !q.decide(id, action == "approve") {
+		http.Error(w, fmt.Sprintf("no call awaits approval %s", id), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// Defaults for the artifact store
+const (
+	defaultArtifactTTL     = time.Hour
+	artifactSummaryLength  = 1000
+	artifactResourcePrefix = "resource://artifacts/"
+)
+
+// ArtifactsConfig offloads large tool responses to resources so they don't exceed downstream message limits
+type ArtifactsConfig struct {
+	// Threshold is the encoded response size in bytes above which the response is stored as an artifact
+	Threshold int `json:"Threshold"`
+	// TTL removes artifacts this long after they were stored
+	TTL Duration `json:"TTL,omitempty"`
+}
+
+// artifactStore registers oversized responses as resources and replaces them with a summary.
+// A nil store leaves responses untouched.
+type artifactStore struct {
+	server    *mcp.Server
+	threshold int
+	ttl       time.Duration
+}
+
+func newArtifactStore(server *mcp.Server, cfg *ArtifactsConfig) *artifactStore {
+	if cfg == nil || cfg.Threshold <= 0 {
+		return nil
+	}
+	ttl := time.Duration(cfg.TTL)
+	if ttl <= 0 {
+		ttl = defaultArtifactTTL
+	}
+	return &artifactStore{server: server, threshold: cfg.Threshold, ttl: ttl}
+}
+
+// offload stores resp as an artifact when it exceeds the threshold and returns the summary pointing to it
+func (s *artifactStore) offload(tool string, resp *mcp.ToolResponse) *mcp.ToolResponse {
+	if s == nil || resp == nil {
+		return resp
+	}
+	data, err := json.Marshal(resp.Content)
+	if err != nil || len(data) <= s.threshold {
+		return resp
+	}
+
+	uri, size, err := s.store(tool, resp.Content)
+	if err != nil {
+		log.Printf("Failed to store artifact for '%s': %v", tool, err)
+		return resp
+	}
+
+	text, _ := contentText(resp.Content)
+	summary, limit := text, min(artifactSummaryLength, s.threshold)
+	if len(summary) > limit {
+		summary = strings.ToValidUTF8(summary[:limit], "")
+	}
+	return mcp.NewToolResponse(mcp.NewTextContent(fmt.Sprintf(
+		"%s\n\n[Output truncated: the full %d-byte response of %s is available as resource %s for %s]",
+		summary, size, tool, uri, s.ttl)))
+}
+
+// store registers content as an artifact resource for the store's TTL and returns its URI and size
+func (s *artifactStore) store(tool string, content []*mcp.Content) (string, int, error) {
+	id, err := randomID()
+	if err != nil {
+		return "", 0, err
+	}
+	uri := artifactResourcePrefix + id
+
+	// Plain text responses are served as text, anything else as the JSON-encoded content list
+	text, isText := contentText(content)
+	payload, mimeType := text, "text/plain"
+	if !isText {
+		data, err := json.Marshal(content)
+		if err != nil {
+			return "", 0, err
+		}
+		payload, mimeType = string(data), "application/json"
+	}
+
+	description := fmt.Sprintf("Full output of %s (%d bytes)", tool, len(payload))
+	handler := func() (*mcp.ResourceResponse, error) {
+		return mcp.NewResourceResponse(mcp.NewTextEmbeddedResource(uri, payload, mimeType)), nil
+	}
+	if err := s.server.RegisterResource(uri, "artifact "+id, description, mimeType, handler); err != nil {
+		log.Printf("Failed to announce artifact '%s': %v", uri, err)
+	}
+	time.AfterFunc(s.ttl, func() {
+		_ = s.server.DeregisterResource(uri)
+	})
+	return uri, len(payload), nil
+}
+
+// limit returns the largest response size that is passed on without offloading, 0 meaning unlimited
+func (s *artifactStore) limit() int {
+	if s == nil {
+		return 0
+	}
+	return s.threshold
+}
+
+// contentText joins the text of all text items and reports whether the content was text only
+func contentText(content []*mcp.Content) (string, bool) {
+	var texts []string
+	isText := true
+	for _, item := range content {
+		if item != nil && item.TextContent != nil {
+			texts = append(texts, item.TextContent.Text)
+		} else {
+			isText = false
+		}
+	}
+	return strings.Join(texts, "\n"), isText
+}
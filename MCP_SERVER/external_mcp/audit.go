@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord describes the outcome of a single tool call
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity"`
+	Tool     string    `json:"tool"`
+	Decision string    `json:"decision"`
+	Error    string    `json:"error,omitempty"`
+	// CorrelationID ties the record to the log lines of the same call
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+// auditLogger appends audit records as JSON lines to a file, or to the log when no file is configured,
+// and hands them to the exporters
+type auditLogger struct {
+	mu      sync.Mutex
+	file    *os.File
+	exports *recordExports
+}
+
+// newAuditLogger opens the audit log at filePath; an empty path logs records through the standard logger
+func newAuditLogger(filePath string, exports *recordExports) (*auditLogger, error) {
+	if filePath == "" {
+		return &auditLogger{exports: exports}, nil
+	}
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{file: file, exports: exports}, nil
+}
+
+// record writes a single audit record
+func (a *auditLogger) record(rec auditRecord) {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	a.exports.audit(rec)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Failed to marshal audit record: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		log.Printf("audit: %s", data)
+		return
+	}
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write audit record: %v", err)
+	}
+}
+
+// close closes the underlying audit file
+func (a *auditLogger) close() {
+	if a.file != nil {
+		_ = a.file.Close()
+	}
+}
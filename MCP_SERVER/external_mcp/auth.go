@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// AuthConfig represents the authentication and role configuration
+type AuthConfig struct {
+	Tokens []TokenConfig         `json:"Tokens"`
+	Roles  map[string]RoleConfig `json:"Roles"`
+	// OIDC also accepts tokens issued by an OpenID Connect provider, mapping their claims to roles
+	OIDC *OIDCConfig `json:"OIDC,omitempty"`
+}
+
+// TokenConfig maps a bearer token to the identity presenting it and the roles it holds
+type TokenConfig struct {
+	Token    string   `json:"Token"`
+	Identity string   `json:"Identity"`
+	Roles    []string `json:"Roles"`
+	// Tenant is the tenant the identity belongs to, which decides the instances of per-tenant servers it reaches
+	Tenant string `json:"Tenant,omitempty"`
+}
+
+// RoleConfig grants access to the tools matching any of the given name patterns, e.g. "read_*" or "*"
+type RoleConfig struct {
+	Tools []string `json:"Tools"`
+}
+
+// identity is the authenticated caller of a request
+type identity struct {
+	Name   string
+	Roles  []string
+	Tenant string
+}
+
+// anonymous is the identity used when authentication is disabled
+var anonymous = identity{Name: "anonymous"}
+
+type identityKey struct{}
+
+// contextWithIdentity returns a copy of ctx carrying the caller's identity
+func contextWithIdentity(ctx context.Context, id identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFromContext returns the caller's identity, or anonymous if none was attached
+func identityFromContext(ctx context.Context) identity {
+	if id, ok := ctx.Value(identityKey{}).(identity); ok {
+		return id
+	}
+	return anonymous
+}
+
+// authorizer authenticates tokens and decides which tools an identity may call.
+// A nil authorizer allows everything.
+type authorizer struct {
+	tokens []TokenConfig
+	roles  map[string]RoleConfig
+	oidc   *oidcVerifier
+}
+
+func newAuthorizer(cfg *AuthConfig) *authorizer {
+	if cfg == nil {
+		return nil
+	}
+	for _, token := range cfg.Tokens {
+		for _, role := range token.Roles {
+			if _, ok := cfg.Roles[role]; !ok {
+				log.Printf("Warning: identity '%s' references undefined role '%s'", token.Identity, role)
+			}
+		}
+	}
+	return &authorizer{tokens: cfg.Tokens, roles: cfg.Roles, oidc: newOIDCVerifier(cfg.OIDC, systemClock{})}
+}
+
+// authenticate returns the identity owning token
+func (a *authorizer) authenticate(token string) (identity, bool) {
+	if a == nil {
+		return anonymous, true
+	}
+	for _, candidate := range a.tokens {
+		if candidate.Token != "" && subtle.ConstantTimeCompare([]byte(candidate.Token), []byte(token)) == 1 {
+			return identity{Name: candidate.Identity, Roles: candidate.Roles, Tenant: candidate.Tenant}, true
+		}
+	}
+	if a.oidc != nil && token != "" {
+		id, err := a.oidc.verify(token)
+		if err == nil {
+			return id, true
+		}
+		log.Printf("Rejected OIDC token: %v", err)
+	}
+	return identity{}, false
+}
+
+// allowed reports whether id holds a role granting access to the named tool
+func (a *authorizer) allowed(id identity, tool string) bool {
+	if a == nil {
+		return true
+	}
+	for _, role := range id.Roles {
+		for _, pattern := range a.roles[role].Tools {
+			if matched, _ := path.Match(pattern, tool); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorize returns a permission-denied error unless the caller in ctx may call the named tool
+func (a *authorizer) authorize(ctx context.Context, tool string) error {
+	id := identityFromContext(ctx)
+	if a.allowed(id, tool) {
+		return nil
+	}
+	return fmt.Errorf("permission denied: '%s' may not call tool '%s'", id.Name, tool)
+}
+
+// middleware rejects HTTP requests without a valid bearer token and attaches the caller's identity
+func (a *authorizer) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		id, ok := a.authenticate(token)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(contextWithIdentity(r.Context(), id)))
+	})
+}
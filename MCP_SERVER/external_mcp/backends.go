@@ -0,0 +1,689 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// backend is a running MCP StdIO server, or a connection to a remote one, together with the client
+// connected to it
+type backend struct {
+	name      string
+	config    MCPStdIOConfig
+	client    *mcp.Client
+	transport transport.Transport
+	// upstream sends the server the requests the client has no method for
+	upstream *upstreamTransport
+	// cmd and stderr are nil for remote servers
+	cmd    *exec.Cmd
+	stderr io.Closer
+	// exited is closed once the process has exited and its pipes are released, or once the
+	// connection to a remote server is lost
+	exited chan struct{}
+
+	mu    sync.RWMutex
+	tools []mcp.ToolRetType
+	// initialized is set once the client has initialized and listed the tools
+	initialized bool
+
+	limiterOnce sync.Once
+	limiter     *concurrencyLimiter
+	// active counts the calls in flight
+	active atomic.Int64
+}
+
+// concurrency returns the limiter of the backend's calls, created from its config on first use
+func (b *backend) concurrency() *concurrencyLimiter {
+	b.limiterOnce.Do(func() { b.limiter = newConcurrencyLimiter(b.config.Concurrency) })
+	return b.limiter
+}
+
+// hasTool reports whether the backend advertised the named tool when it was last listed
+func (b *backend) hasTool(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, tool := range b.tools {
+		if tool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// backendRegistry tracks the running backends so they can be replaced when the configuration changes
+type backendRegistry struct {
+	mu         sync.RWMutex
+	applyMu    sync.Mutex
+	clientInfo mcp.ClientInfo
+	backends   map[string]*backend
+	stateful   *statefulInstances
+	tenants    *statefulInstances
+	// servers are the configured servers, including those that failed to start
+	servers map[string]MCPStdIOConfig
+	// config is the configuration applied last, re-applied when the discovered servers change
+	config Config
+	// discovered are the servers found through service discovery; configured servers take precedence
+	discovered map[string]MCPStdIOConfig
+	// lastReload is the outcome of the last config reload
+	lastReload *reloadStatus
+	// started, if set, is called with every backend once it is running
+	started func(b *backend)
+	// reverse holds the connections of the servers that dial in
+	reverse *reverseHub
+	// disabledTags holds the tags whose servers were disabled through the admin API
+	disabledTags map[string]bool
+	// degraded maps the servers failing probes to why each of their failing probes failed
+	degraded map[string]map[string]string
+	// failed maps the servers given up on for crash-looping to why, until they are started again
+	failed map[string]string
+	// unreachable maps the remote servers that failed their preflight to the check they failed and why
+	unreachable map[string]string
+}
+
+func newBackendRegistry(clientInfo mcp.ClientInfo) *backendRegistry {
+	r := &backendRegistry{
+		clientInfo: clientInfo,
+		backends:   make(map[string]*backend),
+		stateful:   newStatefulInstances(clientInfo, "session", systemClock{}),
+		tenants:    newStatefulInstances(clientInfo, "tenant", systemClock{}),
+	}
+	r.reverse = newReverseHub(r)
+	return r
+}
+
+// list returns all running backends ordered by name
+func (r *backendRegistry) list() []*backend {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.backends))
+	for name := range r.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	backends := make([]*backend, 0, len(names))
+	for _, name := range names {
+		backends = append(backends, r.backends[name])
+	}
+	return backends
+}
+
+// clients returns the clients of all running backends ordered by backend name. Per-tenant backends
+// are left out, since their shared instance must not serve calls, and so are shadows.
+func (r *backendRegistry) clients() []*mcp.Client {
+	backends := r.list()
+	clients := make([]*mcp.Client, 0, len(backends))
+	for _, b := range backends {
+		if !b.config.PerTenant && b.config.ShadowOf == "" {
+			clients = append(clients, b.client)
+		}
+	}
+	return clients
+}
+
+// shared returns the running backends serving every caller, which the proxy's own requests go to.
+// Shadows are left out.
+func (r *backendRegistry) shared() []*backend {
+	var shared []*backend
+	for _, b := range r.list() {
+		if !b.config.PerTenant && b.config.ShadowOf == "" && b.upstream != nil {
+			shared = append(shared, b)
+		}
+	}
+	return shared
+}
+
+// owner returns the backend advertising the named tool, or nil if no backend is known to have it.
+// Shadows never own a tool.
+func (r *backendRegistry) owner(tool string) *backend {
+	for _, b := range r.list() {
+		if b.config.ShadowOf == "" && b.hasTool(tool) {
+			return b
+		}
+	}
+	return nil
+}
+
+// named returns the running backend with the given name, or nil
+func (r *backendRegistry) named(name string) *backend {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.backends[name]
+}
+
+// configured returns the configuration of the named server, whether or not it is running
+func (r *backendRegistry) configured(name string) (MCPStdIOConfig, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	config, ok := r.servers[name]
+	return config, ok
+}
+
+// clientFor returns the client that should serve a call to b from the given caller and downstream
+// session: the shared client, the tenant's own instance for per-tenant backends or the session's
+// own instance for stateful backends
+func (r *backendRegistry) clientFor(caller identity, sessionID string, b *backend) (*mcp.Client, error) {
+	switch {
+	case b.config.PerTenant:
+		config, err := tenantServerConfig(b.name, b.config, caller.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		return r.tenants.getWith(caller.Tenant, b, config)
+	case b.config.Stateful:
+		return r.stateful.get(sessionID, b)
+	}
+	return b.client, nil
+}
+
+// apply brings the running backends in line with cfg: removed or changed servers are stopped
+// and new or changed servers are started. Servers that fail to start are reported in the returned error.
+func (r *backendRegistry) apply(cfg Config) error {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	return r.applyLocked(cfg)
+}
+
+// applyLocked applies cfg while the caller holds applyMu
+func (r *backendRegistry) applyLocked(cfg Config) error {
+	servers, order, errs, err := r.planLocked(cfg)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.config = cfg
+	r.servers = servers
+	r.mu.Unlock()
+
+	// Stop backends that were removed or whose configuration changed
+	r.mu.Lock()
+	var stale []*backend
+	for name, b := range r.backends {
+		if config, ok := servers[name]; ok && reflect.DeepEqual(config, b.config) {
+			continue
+		}
+		stale = append(stale, b)
+		delete(r.backends, name)
+	}
+	r.mu.Unlock()
+
+	for _, b := range stale {
+		log.Printf("Stopping StdIO client '%s'", b.name)
+		r.stopInstances(b)
+	}
+
+	// Start backends that are not running yet, after the backends they depend on
+	for _, name := range order {
+		config, ok := servers[name]
+		if !ok {
+			continue
+		}
+		r.mu.RLock()
+		_, running := r.backends[name]
+		var down []string
+		for _, dependency := range config.DependsOn {
+			if _, up := r.backends[dependency]; !up {
+				down = append(down, dependency)
+			}
+		}
+		r.mu.RUnlock()
+		if running {
+			continue
+		}
+		if len(down) > 0 {
+			errs = append(errs, fmt.Errorf("not starting '%s': its dependencies %s are not running", name, strings.Join(down, ", ")))
+			continue
+		}
+		b, err := r.startServer(name, config)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if b != nil {
+			r.addBackend(b)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// planLocked resolves the servers cfg runs, with the discovered ones, and the order they start in,
+// while the caller holds applyMu. It fails for a config that must be rejected before anything
+// changes; errs are the servers refused individually.
+func (r *backendRegistry) planLocked(cfg Config) (servers map[string]MCPStdIOConfig, order []string, errs []error, err error) {
+	r.mu.RLock()
+	discovered := r.discovered
+	r.mu.RUnlock()
+
+	servers = serverConfigs(cfg)
+	for name, config := range discovered {
+		if _, ok := servers[name]; !ok {
+			if config.MaxFrameSize == 0 {
+				config.MaxFrameSize = cfg.MaxFrameSize
+			}
+			servers[name] = config
+		}
+	}
+	if order, err = startOrder(servers); err != nil {
+		return nil, nil, nil, err
+	}
+	for name, config := range servers {
+		if err := checkMaintenance(config.Maintenance); err != nil {
+			return nil, nil, nil, fmt.Errorf("server '%s': %v", name, err)
+		}
+	}
+
+	if cfg.RemoteOnly {
+		for name, config := range servers {
+			if config.URL == "" {
+				errs = append(errs, fmt.Errorf("refusing to start '%s': remote-only mode requires a URL", name))
+				delete(servers, name)
+			}
+		}
+	}
+	r.mu.RLock()
+	for name, config := range servers {
+		if r.disabledLocked(config) {
+			delete(servers, name)
+		}
+	}
+	r.mu.RUnlock()
+	return servers, order, errs, nil
+}
+
+// startServer starts and initializes the named server without registering it. It returns a nil
+// backend without an error for a remote server that is unreachable, a reverse server that has not
+// dialed in yet and a process that exited during initialization.
+func (r *backendRegistry) startServer(name string, config MCPStdIOConfig) (*backend, error) {
+	// Remote servers are checked first, so they are reported unreachable instead of failing calls
+	remote := config.URL != "" && config.ReverseToken == ""
+	if remote {
+		ctx, cancel := context.WithTimeout(context.Background(), remoteDialTimeout)
+		err := preflightRemote(ctx, config)
+		cancel()
+		if err != nil {
+			r.markUnreachable(name, err)
+			return nil, nil
+		}
+	}
+
+	var b *backend
+	if config.ReverseToken != "" {
+		if b = r.reverse.accept(name, config, r.clientInfo); b == nil {
+			log.Printf("Waiting for '%s' to dial in", name)
+			return nil, nil
+		}
+	} else {
+		var err error
+		if b, err = startBackend(name, config, r.clientInfo); err != nil {
+			return nil, err
+		}
+	}
+	if err := initializeBackend(b); err != nil {
+		// A remote server has no process to keep managed
+		if remote {
+			stopBackend(b)
+			r.markUnreachable(name, &preflightError{preflightInitialize, err})
+			return nil, nil
+		}
+		// Keep backends that fail to initialize while their process is still running, so it stays managed
+		if b.hasExited(time.Second) {
+			log.Printf("StdIO client '%s' exited during initialization", name)
+			stopBackend(b)
+			return nil, nil
+		}
+	}
+	return b, nil
+}
+
+// addBackend registers a started backend, replacing any backend of the same name
+func (r *backendRegistry) addBackend(b *backend) {
+	r.mu.Lock()
+	r.backends[b.name] = b
+	delete(r.failed, b.name)
+	delete(r.unreachable, b.name)
+	r.mu.Unlock()
+	if r.started != nil {
+		r.started(b)
+	}
+	if b.config.SSH != nil {
+		go r.reconnect(b)
+	}
+}
+
+// stopInstances stops b along with its per-session and per-tenant instances
+func (r *backendRegistry) stopInstances(b *backend) {
+	r.stateful.stopBackend(b.name)
+	r.tenants.stopBackend(b.name)
+	stopBackend(b)
+}
+
+// restart stops the named backend and starts it again with its current configuration
+func (r *backendRegistry) restart(name string) error {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	r.mu.Lock()
+	b, running := r.backends[name]
+	_, configured := r.servers[name]
+	delete(r.backends, name)
+	cfg := r.config
+	r.mu.Unlock()
+	if !running && !configured {
+		return fmt.Errorf("unknown server '%s'", name)
+	}
+
+	if running {
+		log.Printf("Restarting StdIO client '%s'", name)
+		r.stopInstances(b)
+	}
+	return r.applyLocked(cfg)
+}
+
+// applied returns the configuration applied last
+func (r *backendRegistry) applied() Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config
+}
+
+// setDiscovered replaces the servers found through service discovery and applies the change
+func (r *backendRegistry) setDiscovered(servers map[string]MCPStdIOConfig) error {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	r.mu.Lock()
+	if reflect.DeepEqual(servers, r.discovered) {
+		r.mu.Unlock()
+		return nil
+	}
+	r.discovered = servers
+	cfg := r.config
+	r.mu.Unlock()
+
+	log.Printf("Discovered %d servers", len(servers))
+	return r.applyLocked(cfg)
+}
+
+// unready returns the required servers that are not running with an initialized client, ordered by name
+func (r *backendRegistry) unready() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var names []string
+	for name, config := range r.servers {
+		if !config.Required {
+			continue
+		}
+		if b, ok := r.backends[name]; !ok || !b.isInitialized() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isInitialized reports whether the backend's client has initialized
+func (b *backend) isInitialized() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.initialized
+}
+
+// serverConfigs returns the configured servers with global defaults filled in
+func serverConfigs(cfg Config) map[string]MCPStdIOConfig {
+	servers := make(map[string]MCPStdIOConfig, len(cfg.MCPStdIOServers))
+	for name, config := range cfg.MCPStdIOServers {
+		if config.MaxFrameSize == 0 {
+			config.MaxFrameSize = cfg.MaxFrameSize
+		}
+		servers[name] = config
+	}
+	return servers
+}
+
+// shutdown gracefully shuts down all running backends
+func (r *backendRegistry) shutdown() {
+	r.mu.Lock()
+	backends := r.backends
+	r.backends = make(map[string]*backend)
+	r.mu.Unlock()
+
+	log.Println("Shutting down MCP clients...")
+	r.stateful.stopAll()
+	r.tenants.stopAll()
+	for _, b := range backends {
+		stopBackend(b)
+	}
+}
+
+// startBackend launches the external process for a StdIO server and connects a client to it, or
+// connects to the server at the configured URL
+func startBackend(name string, config MCPStdIOConfig, clientInfo mcp.ClientInfo) (*backend, error) {
+	if config.URL != "" {
+		return connectBackend(name, config, clientInfo)
+	}
+	if config.ReverseToken != "" {
+		return nil, fmt.Errorf("'%s' dials in to the aggregator and cannot be started per session or tenant", name)
+	}
+
+	log.Printf("Initializing StdIO client '%s' with command: %s", name, config.Command)
+	if err := verifyBackend(name, config); err != nil {
+		return nil, err
+	}
+
+	// Start the external process, or ssh running it remotely with the environment it needs to log in
+	var cmd *exec.Cmd
+	if config.SSH != nil {
+		command, args := sshCommand(config)
+		cmd = exec.Command(command, args...)
+	} else {
+		cmd = exec.Command(config.Command, config.Args...)
+		cmd.Dir = config.WorkingDir
+		for key, value := range config.Env {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+
+	// Set up pipes for communication
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe for '%s': %v", name, err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe for '%s': %v", name, err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stderr pipe for '%s': %v", name, err)
+	}
+
+	// Start the external command
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start command '%s': %v", name, err)
+	}
+
+	// Log any error output from the command
+	stderrDone := make(chan struct{})
+	go drainStderr(name, stderr, stderrDone)
+
+	// Create an StdIO MCP client
+	tr := newStdioTransport(name, stdout, stdin, config.MaxFrameSize)
+	tr.strict = config.StrictStdout
+	client, upstream := newBackendClient(tr, config, clientInfo)
+
+	// Reap the process once it exits. Wait closes the pipes, so stderr is drained first; it reaches
+	// EOF when the process and any children sharing the pipe have exited.
+	exited := make(chan struct{})
+	go func() {
+		<-stderrDone
+		_ = cmd.Wait()
+		_ = tr.Close()
+		close(exited)
+	}()
+
+	return &backend{
+		name:      name,
+		config:    config,
+		client:    client,
+		transport: tr,
+		upstream:  upstream,
+		cmd:       cmd,
+		stderr:    stderr,
+		exited:    exited,
+	}, nil
+}
+
+// connectBackend connects a client to a remote server; the connection is made when the client initializes
+func connectBackend(name string, config MCPStdIOConfig, clientInfo mcp.ClientInfo) (*backend, error) {
+	log.Printf("Initializing remote client '%s' at %s", name, config.URL)
+	tr, err := newRemoteTransport(name, config.URL, config.Headers, config.Network, config.MaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	client, upstream := newBackendClient(tr, config, clientInfo)
+	return &backend{
+		name:      name,
+		config:    config,
+		client:    client,
+		transport: tr,
+		upstream:  upstream,
+		exited:    tr.done,
+	}, nil
+}
+
+// newBackendClient creates a client over tr announcing the backend's own client identity, if it has one,
+// and returns it with the transport wrapping tr
+func newBackendClient(tr transport.Transport, config MCPStdIOConfig, clientInfo mcp.ClientInfo) (*mcp.Client, *upstreamTransport) {
+	var clientMetadata map[string]interface{}
+	if config.ClientInfo != nil {
+		if config.ClientInfo.Name != "" {
+			clientInfo.Name = config.ClientInfo.Name
+		}
+		if config.ClientInfo.Version != "" {
+			clientInfo.Version = config.ClientInfo.Version
+		}
+		clientMetadata = config.ClientInfo.Metadata
+	}
+	upstream := newUpstreamTransport(tr, clientMetadata)
+	return mcp.NewClientWithInfo(upstream, clientInfo), upstream
+}
+
+// initializeBackend initializes the backend's client and logs its available tools
+func initializeBackend(b *backend) error {
+	log.Printf("Initializing MCP client '%s'...", b.name)
+
+	// Initialize the client
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	_, err := b.client.Initialize(ctx)
+	cancel()
+
+	if err != nil {
+		log.Printf("Failed to initialize client '%s': %v", b.name, err)
+		return err
+	}
+
+	log.Printf("Fetching tools for client '%s'...", b.name)
+	tools, err := b.refreshTools()
+	if err != nil {
+		log.Printf("Failed to fetch tools for client '%s': %v", b.name, err)
+		return err
+	}
+	b.mu.Lock()
+	b.initialized = true
+	b.mu.Unlock()
+
+	// Print tools
+	log.Printf("Client '%s' Tools:", b.name)
+	for _, tool := range tools {
+		log.Printf("- %v", tool)
+	}
+	return nil
+}
+
+// refreshTools lists the backend's tools again and remembers them for routing
+func (b *backend) refreshTools() ([]mcp.ToolRetType, error) {
+	// Fetch tools with empty string cursor instead of nil
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	cursor := "" // Use empty string instead of nil
+	toolsResponse, err := b.client.ListTools(ctx, &cursor)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.tools = toolsResponse.Tools
+	b.mu.Unlock()
+	return toolsResponse.Tools, nil
+}
+
+// listedTools returns the tools the backend advertised when it was last listed
+func (b *backend) listedTools() []mcp.ToolRetType {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.tools
+}
+
+// hasExited reports whether the backend's process exited within the grace period
+func (b *backend) hasExited(grace time.Duration) bool {
+	// Checked first, as a select would pick at random between an exit and an elapsed zero grace
+	select {
+	case <-b.exited:
+		return true
+	default:
+	}
+	select {
+	case <-b.exited:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
+
+// stopBackend gracefully shuts down the backend's client, kills its process and releases its pipes.
+// Remote backends are disconnected.
+func stopBackend(b *backend) {
+	if b.cmd == nil {
+		_ = b.transport.Close()
+		return
+	}
+
+	if !b.hasExited(0) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := b.client.Ping(ctx) // Only as an example of cleanup logic
+		cancel()
+		if err != nil {
+			log.Printf("Failed to ping MCP client '%s': %v", b.name, err)
+		}
+
+		if err := b.cmd.Process.Kill(); err != nil {
+			log.Printf("Failed to kill StdIO command '%s': %v", b.name, err)
+		}
+	}
+
+	// Children of the backend may keep stderr open after it exits, so stop waiting for them
+	if !b.hasExited(5 * time.Second) {
+		log.Printf("StdIO client '%s' stderr still open after kill", b.name)
+		_ = b.stderr.Close()
+		<-b.exited
+	}
+	_ = b.transport.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// maxBatchCalls bounds the calls of a single batch
+const maxBatchCalls = 100
+
+// maxParallelBatchCalls bounds how many calls of a parallel batch run at once
+const maxParallelBatchCalls = 8
+
+type CallBatchRequest struct {
+	Calls    []CallToolRequest `json:"calls" jsonschema:"required,description=Tool calls to execute, each with a name and arguments"`
+	Parallel bool              `json:"parallel" jsonschema:"description=Run the calls concurrently instead of one after another"`
+	FailFast bool              `json:"failFast" jsonschema:"description=Stop at the first failing call and skip the rest"`
+}
+
+// batchResult is the outcome of a single call within a batch
+type batchResult struct {
+	Name    string         `json:"name"`
+	Content []*mcp.Content `json:"content,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Skipped bool           `json:"skipped,omitempty"`
+}
+
+func handleCallBatch(rt *router) interface{} {
+	return func(ctx context.Context, args CallBatchRequest) (*mcp.ToolResponse, error) {
+		if len(args.Calls) == 0 {
+			return nil, fmt.Errorf("no calls provided")
+		}
+		if len(args.Calls) > maxBatchCalls {
+			return nil, fmt.Errorf("too many calls: a batch holds at most %d", maxBatchCalls)
+		}
+
+		results := make([]batchResult, len(args.Calls))
+		for i, call := range args.Calls {
+			results[i] = batchResult{Name: call.Name, Skipped: true}
+		}
+
+		// Calls left when the caller's deadline passes are skipped
+		ctx, stop := withBudgetDeadline(ctx, rt.reserve)
+		defer stop()
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		run := func(i int) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			resp, err := rt.call(contextWithMeta(ctx, args.Calls[i].Meta), args.Calls[i].Name, args.Calls[i].Arguments)
+			result := batchResult{Name: args.Calls[i].Name}
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Content = contentOf(resp)
+			}
+			results[i] = result
+			return err == nil
+		}
+
+		if args.Parallel {
+			// A fixed number of workers takes the calls in order
+			calls := make(chan int)
+			var wg sync.WaitGroup
+			for w := 0; w < min(len(args.Calls), maxParallelBatchCalls); w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range calls {
+						func() {
+							defer recoverPanic(ctx, "the batched call to '"+args.Calls[i].Name+"'", nil)
+							if !run(i) && args.FailFast {
+								cancel()
+							}
+						}()
+					}
+				}()
+			}
+			for i := range args.Calls {
+				calls <- i
+			}
+			close(calls)
+			wg.Wait()
+		} else {
+			for i := range args.Calls {
+				if !run(i) && args.FailFast {
+					break
+				}
+			}
+		}
+
+		resultsJSON, err := json.Marshal(map[string]interface{}{
+			"results": results,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal batch results: %v", err)
+		}
+		return mcp.NewToolResponse(mcp.NewTextContent(string(resultsJSON))), nil
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ToolBudgetConfig restricts expensive tools to hours of the day and to daily call budgets shared
+// by every caller, e.g. visit_page at most 500 times a day
+type ToolBudgetConfig struct {
+	// File persists the day's counts across restarts; empty keeps them in memory
+	File  string           `json:"File,omitempty"`
+	Rules []ToolBudgetRule `json:"Rules"`
+}
+
+// ToolBudgetRule limits the calls to the tools matching its patterns
+type ToolBudgetRule struct {
+	// Name identifies the rule's count; defaults to its tool patterns
+	Name  string   `json:"Name,omitempty"`
+	Tools []string `json:"Tools"`
+	// Hours is the time of day the tools may be called, e.g. "09:00-18:00" or "22:00-06:00"
+	Hours string `json:"Hours,omitempty"`
+	// Daily is how many calls the matching tools may take together per day
+	Daily int `json:"Daily,omitempty"`
+	// TimeZone is the IANA time zone of Hours and of the day's start; defaults to UTC
+	TimeZone string `json:"TimeZone,omitempty"`
+}
+
+// toolBudgetRule is a validated rule
+type toolBudgetRule struct {
+	ToolBudgetRule
+	location *time.Location
+	// from and to are the minutes of the day the allowed hours start and end at
+	from, to int
+	hours    bool
+}
+
+// toolBudgets enforces the rules and counts the calls against their daily budgets. A nil tracker allows everything.
+type toolBudgets struct {
+	cfg   ToolBudgetConfig
+	rules []toolBudgetRule
+	now   func() time.Time
+
+	mu sync.Mutex
+	// days maps each rule to its day, formatted "2006-01-02" in its time zone, and the calls made that day
+	days   map[string]budgetDay
+	dirty  bool
+	done   chan struct{}
+	closed sync.WaitGroup
+}
+
+// budgetDay is the calls a rule counted on a day
+type budgetDay struct {
+	Day   string `json:"day"`
+	Calls int    `json:"calls"`
+}
+
+// openToolBudgets validates cfg and loads the day's counts from its file, or returns nil when no budgets are configured
+func openToolBudgets(cfg *ToolBudgetConfig) (*toolBudgets, error) {
+	if cfg == nil || len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	b := &toolBudgets{cfg: *cfg, now: time.Now, days: make(map[string]budgetDay), done: make(chan struct{})}
+	for i, rule := range cfg.Rules {
+		parsed := toolBudgetRule{ToolBudgetRule: rule}
+		if len(rule.Tools) == 0 || (rule.Hours == "" && rule.Daily <= 0) {
+			return nil, fmt.Errorf("budget rule %d needs Tools and either Hours or a positive Daily", i+1)
+		}
+		if parsed.Name == "" {
+			parsed.Name = strings.Join(rule.Tools, ",")
+		}
+		location, err := time.LoadLocation(rule.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("budget rule '%s': %v", parsed.Name, err)
+		}
+		parsed.location = location
+		if rule.Hours != "" {
+			if parsed.from, parsed.to, err = parseHours(rule.Hours); err != nil {
+				return nil, fmt.Errorf("budget rule '%s': %v", parsed.Name, err)
+			}
+			parsed.hours = true
+		}
+		b.rules = append(b.rules, parsed)
+	}
+
+	if cfg.File != "" {
+		data, err := os.ReadFile(cfg.File)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &b.days); err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %v", cfg.File, err)
+			}
+		}
+		b.closed.Add(1)
+		go b.run()
+	}
+	return b, nil
+}
+
+// parseHours parses a "15:04-15:04" range into the minutes of the day it starts and ends at
+func parseHours(hours string) (int, int, error) {
+	from, to, ok := strings.Cut(hours, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Hours '%s': expected a range such as 09:00-18:00", hours)
+	}
+	var minutes [2]int
+	for i, clock := range []string{from, to} {
+		t, err := time.Parse("15:04", strings.TrimSpace(clock))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Hours '%s': %v", hours, err)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	if minutes[0] == minutes[1] {
+		return 0, 0, fmt.Errorf("invalid Hours '%s': the range is empty", hours)
+	}
+	return minutes[0], minutes[1], nil
+}
+
+// charge counts a call to the tool against the budgets of the rules matching it, or returns why the
+// call is refused: outside the rule's hours, naming when they start, or over its daily budget, naming
+// when it resets. Calls are counted when they are forwarded, whatever their outcome; the returned
+// refund takes back the count of a call refused by a later check.
+func (b *toolBudgets) charge(tool string) (func(), error) {
+	if b == nil {
+		return func() {}, nil
+	}
+	now := b.now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var matched []*toolBudgetRule
+	for i := range b.rules {
+		rule := &b.rules[i]
+		if !matchesAny(rule.Tools, tool, false) {
+			continue
+		}
+		local := now.In(rule.location)
+		if rule.hours && !rule.open(local) {
+			return nil, fmt.Errorf("outside hours: '%s' may only be called %s %s, next from %s",
+				tool, rule.Hours, rule.location, rule.opens(local).Format(time.RFC3339))
+		}
+		if rule.Daily > 0 {
+			day := local.Format("2006-01-02")
+			if count := b.days[rule.Name]; count.Day == day && count.Calls >= rule.Daily {
+				midnight := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, rule.location)
+				return nil, fmt.Errorf("budget exhausted: '%s' has used all %d of its calls for %s, the budget resets at %s",
+					tool, rule.Daily, day, midnight.Format(time.RFC3339))
+			}
+			matched = append(matched, rule)
+		}
+	}
+
+	// Count the call only once every rule allows it
+	for _, rule := range matched {
+		day := now.In(rule.location).Format("2006-01-02")
+		count := b.days[rule.Name]
+		if count.Day != day {
+			count = budgetDay{Day: day}
+		}
+		count.Calls++
+		b.days[rule.Name] = count
+		b.dirty = true
+	}
+	return func() { b.refund(now, matched) }, nil
+}
+
+// refund takes back a call counted at now against the rules, unless their day has passed since
+func (b *toolBudgets) refund(now time.Time, rules []*toolBudgetRule) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, rule := range rules {
+		count := b.days[rule.Name]
+		if count.Day != now.In(rule.location).Format("2006-01-02") || count.Calls == 0 {
+			continue
+		}
+		count.Calls--
+		b.days[rule.Name] = count
+		b.dirty = true
+	}
+}
+
+// open reports whether the rule's hours include the local time
+func (r *toolBudgetRule) open(local time.Time) bool {
+	minute := local.Hour()*60 + local.Minute()
+	if r.from < r.to {
+		return minute >= r.from && minute < r.to
+	}
+	// The hours span midnight
+	return minute >= r.from || minute < r.to
+}
+
+// opens returns when the rule's hours next start after the local time
+func (r *toolBudgetRule) opens(local time.Time) time.Time {
+	start := time.Date(local.Year(), local.Month(), local.Day(), r.from/60, r.from%60, 0, 0, r.location)
+	if !start.After(local) {
+		start = start.AddDate(0, 0, 1)
+	}
+	return start
+}
+
+func (b *toolBudgets) run() {
+	defer b.closed.Done()
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flush()
+		case <-b.done:
+			b.flush()
+			return
+		}
+	}
+}
+
+// flush writes changed counts to the budget file
+func (b *toolBudgets) flush() {
+	b.mu.Lock()
+	if !b.dirty {
+		b.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(b.days)
+	b.dirty = false
+	b.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to encode tool budgets: %v", err)
+		return
+	}
+
+	if err := writeFileAtomic(b.cfg.File, data); err != nil {
+		log.Printf("Failed to save tool budgets: %v", err)
+		// Retry on the next flush
+		b.mu.Lock()
+		b.dirty = true
+		b.mu.Unlock()
+	}
+}
+
+// close saves the counts not yet written
+func (b *toolBudgets) close() {
+	if b == nil || b.cfg.File == "" {
+		return
+	}
+	close(b.done)
+	b.closed.Wait()
+}
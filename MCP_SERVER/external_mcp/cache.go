@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// maxMemoryCacheEntries bounds the in-memory cache; entries are not added while it is full of live ones
+const maxMemoryCacheEntries = 10000
+
+// CacheConfig caches tool results and the servers' tool lists. With the disk or redis backend,
+// replicas of the aggregator behind a load balancer share what they cached.
+type CacheConfig struct {
+	// Backend is memory (the default), disk or redis
+	Backend string `json:"Backend,omitempty"`
+	// Dir holds the entries of the disk backend
+	Dir   string       `json:"Dir,omitempty"`
+	Redis *RedisConfig `json:"Redis,omitempty"`
+	// ToolListTTL reuses a server's tool list for this long instead of listing it on every request
+	ToolListTTL Duration `json:"ToolListTTL,omitempty"`
+	// Results caches the successful results of the matching tools, per caller and arguments
+	Results []ResultCacheRule `json:"Results,omitempty"`
+}
+
+// ResultCacheRule caches the results of the tools matching Tools for TTL
+type ResultCacheRule struct {
+	Tools []string `json:"Tools"`
+	TTL   Duration `json:"TTL"`
+}
+
+// cacheStore keeps cached values until they expire
+type cacheStore interface {
+	// get returns the value stored under key, and false if there is none or it expired
+	get(key string) ([]byte, bool, error)
+	set(key string, value []byte, ttl time.Duration) error
+}
+
+// openCacheStore returns the cache backend described by cfg
+func openCacheStore(cfg *CacheConfig, clock clock) (cacheStore, error) {
+	switch cfg.Backend {
+	case "", "memory":
+		return newMemoryCache(clock), nil
+	case "disk":
+		if cfg.Dir == "" {
+			return nil, fmt.Errorf("the disk cache needs a Dir")
+		}
+		return newDiskCache(cfg.Dir, clock)
+	case "redis":
+		if cfg.Redis == nil || cfg.Redis.Address == "" {
+			return nil, fmt.Errorf("the redis cache needs an Address")
+		}
+		return &redisCache{client: newRedisClient(*cfg.Redis)}, nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend '%s'", cfg.Backend)
+	}
+}
+
+type cacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryCache keeps entries in the aggregator's memory
+type memoryCache struct {
+	clock clock
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newMemoryCache(clock clock) *memoryCache {
+	return &memoryCache{clock: clock, entries: make(map[string]cacheEntry)}
+}
+
+func (c *memoryCache) get(key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if c.clock.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (c *memoryCache) set(key string, value []byte, ttl time.Duration) error {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxMemoryCacheEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxMemoryCacheEntries {
+			return fmt.Errorf("the cache is full")
+		}
+	}
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(ttl)}
+	return nil
+}
+
+// diskCache keeps each entry as a JSON file named after its key's hash, so replicas sharing the
+// directory share the entries
+type diskCache struct {
+	dir   string
+	clock clock
+}
+
+type diskCacheEntry struct {
+	Expires time.Time `json:"expires"`
+	Value   []byte    `json:"value"`
+}
+
+func newDiskCache(dir string, clock clock) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	return &diskCache{dir: dir, clock: clock}, nil
+}
+
+func (c *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *diskCache) get(key string) ([]byte, bool, error) {
+	data, err := os.ReadFile(c.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var entry diskCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false, fmt.Errorf("invalid cache entry: %v", err)
+	}
+	if c.clock.Now().After(entry.Expires) {
+		_ = os.Remove(c.path(key))
+		return nil, false, nil
+	}
+	return entry.Value, true, nil
+}
+
+// set writes the entry to a temporary file and renames it into place so readers never see partial entries
+func (c *diskCache) set(key string, value []byte, ttl time.Duration) error {
+	data, err := json.Marshal(diskCacheEntry{Expires: c.clock.Now().Add(ttl), Value: value})
+	if err != nil {
+		return err
+	}
+	path := c.path(key)
+	tmp, err := os.CreateTemp(c.dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// toolCache caches tool results and tool lists in a cache store. A nil cache caches nothing.
+type toolCache struct {
+	store   cacheStore
+	lists   time.Duration
+	results []ResultCacheRule
+}
+
+// newToolCache returns the cache described by cfg, expiring entries by clock, or nil if cfg is nil
+func newToolCache(cfg *CacheConfig, clock clock) (*toolCache, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	store, err := openCacheStore(cfg, clock)
+	if err != nil {
+		return nil, err
+	}
+	return &toolCache{store: store, lists: time.Duration(cfg.ToolListTTL), results: cfg.Results}, nil
+}
+
+// resultTTL returns how long the results of tool are cached, 0 meaning they are not
+func (c *toolCache) resultTTL(tool string) time.Duration {
+	if c == nil {
+		return 0
+	}
+	for _, rule := range c.results {
+		if matchesAny(rule.Tools, tool, false) {
+			return time.Duration(rule.TTL)
+		}
+	}
+	return 0
+}
+
+// caches reports whether the results of tool are cached
+func (c *toolCache) caches(tool string) bool {
+	return c.resultTTL(tool) > 0
+}
+
+// resultKey identifies the result of a call by the server, the tool, the caller and the arguments
+func resultKey(server, tool, caller string, arguments interface{}) (string, error) {
+	data, err := json.Marshal(arguments)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(caller+"\x00"), data...))
+	return "result/" + server + "/" + tool + "/" + hex.EncodeToString(sum[:]), nil
+}
+
+// result returns the cached result of a call, or nil if there is none
+func (c *toolCache) result(ctx context.Context, server, tool string, arguments interface{}) *mcp.ToolResponse {
+	if !c.caches(tool) {
+		return nil
+	}
+	key, err := resultKey(server, tool, identityFromContext(ctx).Name, arguments)
+	if err != nil {
+		return nil
+	}
+	data, ok, err := c.store.get(key)
+	if err != nil {
+		log.Printf("Failed to read the cached result of '%s': %v", tool, err)
+	}
+	if !ok {
+		return nil
+	}
+	var resp mcp.ToolResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		log.Printf("Invalid cached result of '%s': %v", tool, err)
+		return nil
+	}
+	return &resp
+}
+
+// storeResult caches the result of a call if the tool's results are cached
+func (c *toolCache) storeResult(ctx context.Context, server, tool string, arguments interface{}, resp *mcp.ToolResponse) {
+	ttl := c.resultTTL(tool)
+	if ttl <= 0 || resp == nil {
+		return
+	}
+	key, err := resultKey(server, tool, identityFromContext(ctx).Name, arguments)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err == nil {
+		err = c.store.set(key, data, ttl)
+	}
+	if err != nil {
+		log.Printf("Failed to cache the result of '%s': %v", tool, err)
+	}
+}
+
+// listTools returns b's tools at cursor, from the cache while its tool list is fresh
+func (c *toolCache) listTools(ctx context.Context, b *backend, cursor string) (*mcp.ToolsResponse, error) {
+	if c == nil || c.lists <= 0 {
+		return b.client.ListTools(ctx, &cursor)
+	}
+	key := "tools/" + b.name + "/" + cursor
+	if data, ok, err := c.store.get(key); err != nil {
+		log.Printf("Failed to read the cached tools of '%s': %v", b.name, err)
+	} else if ok {
+		var tools mcp.ToolsResponse
+		if err := json.Unmarshal(data, &tools); err == nil {
+			return &tools, nil
+		}
+	}
+
+	tools, err := b.client.ListTools(ctx, &cursor)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(tools)
+	if err == nil {
+		err = c.store.set(key, data, c.lists)
+	}
+	if err != nil {
+		log.Printf("Failed to cache the tools of '%s': %v", b.name, err)
+	}
+	return tools, nil
+}
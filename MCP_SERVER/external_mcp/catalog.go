@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// catalogChange describes how the tools of one backend changed between two refreshes
+type catalogChange struct {
+	Backend string   `json:"backend"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+// toolCatalog tracks the aggregated tool catalog across refreshes. Every refresh that finds
+// upstream drift bumps the catalog version and tells the downstream host that the tool list changed.
+type toolCatalog struct {
+	registry *backendRegistry
+	notify   transport.Transport
+	metrics  *metrics
+	// snapshots records the catalog whenever it changes
+	snapshots *snapshotStore
+
+	mu      sync.Mutex
+	version int
+	// snapshot maps each backend to the encoded definitions of its tools by name
+	snapshot map[string]map[string]string
+}
+
+// newToolCatalog starts from the tools the backends advertised when they were initialized
+func newToolCatalog(registry *backendRegistry, notify transport.Transport, metrics *metrics) *toolCatalog {
+	c := &toolCatalog{registry: registry, notify: notify, metrics: metrics, version: 1}
+	c.snapshot = make(map[string]map[string]string)
+	for _, b := range registry.list() {
+		c.snapshot[b.name] = encodeTools(b.listedTools())
+	}
+	metrics.setGauge("mcp_tool_catalog_version", "Version of the aggregated tool catalog, bumped whenever upstream tools change", float64(c.version))
+	return c
+}
+
+// watch refreshes the catalog every interval
+func (c *toolCatalog) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.refresh()
+	}
+}
+
+// refresh lists the tools of every backend again and reports what changed since the last refresh
+func (c *toolCatalog) refresh() []catalogChange {
+	current := make(map[string]map[string]string)
+	for _, b := range c.registry.list() {
+		tools, err := b.refreshTools()
+		if err != nil {
+			log.Printf("Failed to refresh tools for client '%s': %v", b.name, err)
+			tools = b.listedTools()
+		}
+		current[b.name] = encodeTools(tools)
+	}
+
+	c.mu.Lock()
+	changes := diffCatalogs(c.snapshot, current)
+	c.snapshot = current
+	if len(changes) > 0 {
+		c.version++
+	}
+	version := c.version
+	c.mu.Unlock()
+
+	if len(changes) == 0 {
+		return nil
+	}
+	if _, err := c.snapshots.capture(c.registry); err != nil {
+		log.Printf("Failed to snapshot tool catalog: %v", err)
+	}
+	for _, change := range changes {
+		entry, _ := json.Marshal(change)
+		log.Printf("Tool catalog changed (version %d): %s", version, entry)
+	}
+	c.metrics.setGauge("mcp_tool_catalog_version", "Version of the aggregated tool catalog, bumped whenever upstream tools change", float64(version))
+
+	notification := transport.NewBaseMessageNotification(&transport.BaseJSONRPCNotification{
+		Jsonrpc: "2.0",
+		Method:  "notifications/tools/list_changed",
+	})
+	if err := c.notify.Send(context.Background(), notification); err != nil {
+		log.Printf("Failed to notify host of tool list change: %v", err)
+	}
+	return changes
+}
+
+// encodeTools maps tool names to their encoded definitions so any change to a tool can be detected
+func encodeTools(tools []mcp.ToolRetType) map[string]string {
+	encoded := make(map[string]string, len(tools))
+	for _, tool := range tools {
+		definition, _ := json.Marshal(tool)
+		encoded[tool.Name] = string(definition)
+	}
+	return encoded
+}
+
+// diffCatalogs compares two catalog snapshots, returning the changes ordered by backend name
+func diffCatalogs(previous, current map[string]map[string]string) []catalogChange {
+	backends := make(map[string]bool)
+	for name := range previous {
+		backends[name] = true
+	}
+	for name := range current {
+		backends[name] = true
+	}
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var changes []catalogChange
+	for _, name := range names {
+		before, after := previous[name], current[name]
+		change := catalogChange{Backend: name}
+		for tool, definition := range after {
+			if old, ok := before[tool]; !ok {
+				change.Added = append(change.Added, tool)
+			} else if old != definition {
+				change.Changed = append(change.Changed, tool)
+			}
+		}
+		for tool := range before {
+			if _, ok := after[tool]; !ok {
+				change.Removed = append(change.Removed, tool)
+			}
+		}
+		if len(change.Added)+len(change.Removed)+len(change.Changed) == 0 {
+			continue
+		}
+		sort.Strings(change.Added)
+		sort.Strings(change.Removed)
+		sort.Strings(change.Changed)
+		changes = append(changes, change)
+	}
+	return changes
+}
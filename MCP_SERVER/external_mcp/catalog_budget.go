@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// CatalogBudgetConfig caps the number of tools advertised by tools/list. Tools are kept in order of
+// pinning, then backend priority, then how often they were called; tools left out of the catalog
+// can still be called by name.
+type CatalogBudgetConfig struct {
+	MaxTools int `json:"MaxTools"`
+	// Pinned tools are always advertised
+	Pinned []string `json:"Pinned,omitempty"`
+	// Priority ranks backends by name, higher first; unlisted backends have priority 0
+	Priority map[string]int `json:"Priority,omitempty"`
+}
+
+// catalogTool is a tool together with the backend advertising it
+type catalogTool struct {
+	backend string
+	tool    mcp.ToolRetType
+}
+
+// toolUsage counts the calls made to each tool since start-up
+type toolUsage struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newToolUsage() *toolUsage {
+	return &toolUsage{counts: make(map[string]int)}
+}
+
+// record counts a call to the named tool
+func (u *toolUsage) record(name string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.counts[name]++
+}
+
+// count returns the number of calls made to the named tool
+func (u *toolUsage) count(name string) int {
+	if u == nil {
+		return 0
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.counts[name]
+}
+
+// applyBudget returns the tools to advertise under the budget, in their original order, along with
+// the number of tools left out
+func applyBudget(tools []catalogTool, budget *CatalogBudgetConfig, usage *toolUsage) ([]mcp.ToolRetType, int) {
+	keep := len(tools)
+	if budget != nil && budget.MaxTools > 0 && budget.MaxTools < keep {
+		keep = budget.MaxTools
+	}
+
+	ranked := make([]int, len(tools))
+	for i := range ranked {
+		ranked[i] = i
+	}
+	if keep < len(tools) {
+		pinned := make(map[string]bool, len(budget.Pinned))
+		for _, name := range budget.Pinned {
+			pinned[name] = true
+		}
+		sort.SliceStable(ranked, func(i, j int) bool {
+			a, b := tools[ranked[i]], tools[ranked[j]]
+			if pinned[a.tool.Name] != pinned[b.tool.Name] {
+				return pinned[a.tool.Name]
+			}
+			if budget.Priority[a.backend] != budget.Priority[b.backend] {
+				return budget.Priority[a.backend] > budget.Priority[b.backend]
+			}
+			return usage.count(a.tool.Name) > usage.count(b.tool.Name)
+		})
+		ranked = ranked[:keep]
+		sort.Ints(ranked)
+	}
+
+	advertised := make([]mcp.ToolRetType, 0, keep)
+	for _, i := range ranked {
+		advertised = append(advertised, tools[i].tool)
+	}
+	return advertised, len(tools) - keep
+}
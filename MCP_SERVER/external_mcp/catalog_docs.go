@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// documentedTool is a tool as the catalog documentation describes it
+type documentedTool struct {
+	Name        string
+	Backend     string
+	Description string
+	Schema      string
+	// Policies describe, in prose, the configured rules that apply to calls of the tool
+	Policies []string
+}
+
+// runCatalogDocs implements the catalog-docs command, starting the configured servers and writing
+// their merged tool catalog as a markdown or HTML document
+func runCatalogDocs(configPath string, profile string, args []string) {
+	fs := flag.NewFlagSet("catalog-docs", flag.ExitOnError)
+	format := fs.String("format", "markdown", "Output format, markdown or html")
+	output := fs.String("o", "", "File to write the document to; empty writes to stdout")
+	title := fs.String("title", "Tool catalog", "Title of the document")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if *format != "markdown" && *format != "html" {
+		log.Fatalf("Unknown format '%s', expected markdown or html", *format)
+	}
+
+	cfg := loadConfig(configPath)
+	cfg, err := applyProfile(cfg, profile)
+	if err != nil {
+		log.Fatalf("Failed to apply profile: %v", err)
+	}
+
+	// Backend logging would drown the document
+	log.SetOutput(io.Discard)
+	registry := newBackendRegistry(mcp.ClientInfo{Name: "mcp-service", Version: "1.0.0"})
+	applyErr := registry.apply(cfg)
+	tools := documentCatalog(registry, cfg)
+	registry.shutdown()
+	log.SetOutput(os.Stderr)
+	if applyErr != nil {
+		log.Printf("Warning: some servers failed to start and are missing from the catalog: %v", applyErr)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if *format == "html" {
+		err = writeCatalogHTML(out, *title, tools)
+	} else {
+		err = writeCatalogMarkdown(out, *title, tools)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write catalog: %v", err)
+	}
+}
+
+// documentCatalog describes every tool of the registry's backends, ordered by backend and name
+func documentCatalog(registry *backendRegistry, cfg Config) []documentedTool {
+	var tools []documentedTool
+	for _, b := range registry.list() {
+		for _, tool := range b.listedTools() {
+			doc := documentedTool{Name: tool.Name, Backend: b.name, Policies: toolPolicies(cfg, tool.Name)}
+			if tool.Description != nil {
+				doc.Description = *tool.Description
+			}
+			if schema, err := json.MarshalIndent(tool.InputSchema, "", "  "); err == nil {
+				doc.Schema = string(schema)
+			}
+			tools = append(tools, doc)
+		}
+	}
+	sort.Slice(tools, func(i, j int) bool {
+		if tools[i].Backend != tools[j].Backend {
+			return tools[i].Backend < tools[j].Backend
+		}
+		return tools[i].Name < tools[j].Name
+	})
+	return tools
+}
+
+// toolPolicies describes the configured rules that apply to calls of the tool
+func toolPolicies(cfg Config, tool string) []string {
+	var policies []string
+	if cfg.Auth != nil {
+		var roles []string
+		for name, role := range cfg.Auth.Roles {
+			if matchesAny(role.Tools, tool, false) {
+				roles = append(roles, name)
+			}
+		}
+		sort.Strings(roles)
+		if len(roles) == 0 {
+			policies = append(policies, "Not granted to any role")
+		} else {
+			policies = append(policies, "Callable by roles: "+strings.Join(roles, ", "))
+		}
+	}
+	if cfg.Policy != nil {
+		policies = append(policies, "Authorized per call by the OPA policy at "+cfg.Policy.URL)
+	}
+	var hidden []string
+	for _, profile := range cfg.HostProfiles {
+		if !profile.exposes(tool) {
+			hidden = append(hidden, profile.Name)
+		}
+	}
+	if len(hidden) > 0 {
+		policies = append(policies, "Hidden from host profiles: "+strings.Join(hidden, ", "))
+	}
+	for _, s := range cfg.Sanitizers {
+		if !matchesAny(s.Tools, tool, true) {
+			continue
+		}
+		policy := fmt.Sprintf("Arguments %s are checked as %ss", strings.Join(s.Arguments, ", "), s.Type)
+		if s.Type == "path" && len(s.Roots) > 0 {
+			policy += " within " + strings.Join(s.Roots, ", ")
+		}
+		if s.Type == "url" && len(s.Hosts) > 0 {
+			policy += " on hosts " + strings.Join(s.Hosts, ", ")
+		}
+		policies = append(policies, policy)
+	}
+	for _, injection := range cfg.ContextInjection {
+		if matchesAny(injection.Tools, tool, true) {
+			fields := make([]string, 0, len(injection.Fields))
+			for field := range injection.Fields {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			policies = append(policies, "Session context fills arguments "+strings.Join(fields, ", "))
+		}
+	}
+	if _, ok := cfg.OutputExpectations[tool]; ok {
+		policies = append(policies, "Responses are validated against declared output expectations")
+	}
+	if cfg.Quotas != nil {
+		weight := (&quotaTracker{cfg: *cfg.Quotas}).weight(tool)
+		policies = append(policies, fmt.Sprintf("Each call costs %g quota units", weight))
+	}
+	for _, s := range cfg.Scripts {
+		if matchesAny(s.Tools, tool, true) {
+			policies = append(policies, "Script "+s.Path+" runs on calls")
+		}
+	}
+	for _, m := range cfg.Middleware {
+		policies = append(policies, fmt.Sprintf("Middleware %s (%s) runs on calls", m.Path, m.Type))
+	}
+	return policies
+}
+
+// writeCatalogMarkdown writes the catalog as markdown: a summary table, then a section per tool
+func writeCatalogMarkdown(w io.Writer, title string, tools []documentedTool) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n%d tools from %d backends.\n\n", title, len(tools), countBackends(tools))
+	b.WriteString("| Tool | Backend | Description |\n|---|---|---|\n")
+	for _, tool := range tools {
+		fmt.Fprintf(&b, "| [`%s`](#%s) | %s | %s |\n", tool.Name, anchor(tool), tool.Backend, markdownCell(firstLine(tool.Description)))
+	}
+
+	backend := ""
+	for _, tool := range tools {
+		if tool.Backend != backend {
+			backend = tool.Backend
+			fmt.Fprintf(&b, "\n## %s\n", backend)
+		}
+		fmt.Fprintf(&b, "\n<a id=\"%s\"></a>\n### `%s`\n\n", anchor(tool), tool.Name)
+		if tool.Description != "" {
+			b.WriteString(tool.Description + "\n\n")
+		}
+		if len(tool.Policies) > 0 {
+			b.WriteString("**Policies**\n\n")
+			for _, policy := range tool.Policies {
+				b.WriteString("- " + policy + "\n")
+			}
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "**Input schema**\n\n```json\n%s\n```\n", tool.Schema)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var catalogHTML = template.Must(template.New("catalog").Funcs(template.FuncMap{"anchor": anchor, "firstLine": firstLine}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+  body { font: 15px system-ui, sans-serif; max-width: 60em; margin: 2em auto; color: #222; }
+  table { border-collapse: collapse; width: 100%; }
+  th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; vertical-align: top; }
+  pre { background: #f6f6f6; padding: 1em; overflow: auto; }
+  .backend { color: #777; font-weight: normal; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{len .Tools}} tools from {{.Backends}} backends.</p>
+<table>
+<tr><th>Tool</th><th>Backend</th><th>Description</th></tr>
+{{range .Tools}}<tr><td><a href="#{{anchor .}}"><code>{{.Name}}</code></a></td><td>{{.Backend}}</td><td>{{firstLine .Description}}</td></tr>
+{{end}}</table>
+{{range .Tools}}
+<h2 id="{{anchor .}}"><code>{{.Name}}</code> <span class="backend">{{.Backend}}</span></h2>
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+{{if .Policies}}<h3>Policies</h3>
+<ul>{{range .Policies}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<h3>Input schema</h3>
+<pre>{{.Schema}}</pre>
+{{end}}
+</body>
+</html>
+`))
+
+// writeCatalogHTML writes the catalog as a standalone HTML page
+func writeCatalogHTML(w io.Writer, title string, tools []documentedTool) error {
+	return catalogHTML.Execute(w, map[string]interface{}{"Title": title, "Tools": tools, "Backends": countBackends(tools)})
+}
+
+func countBackends(tools []documentedTool) int {
+	backends := make(map[string]bool)
+	for _, tool := range tools {
+		backends[tool.Backend] = true
+	}
+	return len(backends)
+}
+
+// anchor is the link target of a tool's section
+func anchor(tool documentedTool) string {
+	return nonNameChars.ReplaceAllString(strings.ToLower(tool.Backend+"-"+tool.Name), "-")
+}
+
+// markdownCell escapes text for a markdown table cell
+func markdownCell(s string) string {
+	return strings.ReplaceAll(s, "|", "\\|")
+}
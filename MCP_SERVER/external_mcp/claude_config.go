@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// ClaudeDesktopConfig represents the parts of Claude Desktop's claude_desktop_config.json we understand
+type ClaudeDesktopConfig struct {
+	MCPServers map[string]ClaudeDesktopServer `json:"mcpServers"`
+}
+
+// ClaudeDesktopServer represents a single entry in the Claude Desktop mcpServers map
+type ClaudeDesktopServer struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env"`
+}
+
+// toConfig converts the Claude Desktop servers into our own configuration format
+func (c ClaudeDesktopConfig) toConfig() Config {
+	cfg := Config{MCPStdIOServers: make(map[string]MCPStdIOConfig, len(c.MCPServers))}
+	for name, server := range c.MCPServers {
+		env := server.Env
+		if env == nil {
+			env = map[string]string{}
+		}
+		cfg.MCPStdIOServers[name] = MCPStdIOConfig{
+			Command:    server.Command,
+			Args:       server.Args,
+			Env:        env,
+			WorkingDir: ".",
+		}
+	}
+	return cfg
+}
+
+// defaultClaudeConfigPath returns the location Claude Desktop stores its configuration on this platform
+func defaultClaudeConfigPath() string {
+	switch runtime.GOOS {
+	case "darwin":
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, "Library", "Application Support", "Claude", "claude_desktop_config.json")
+	case "windows":
+		return filepath.Join(os.Getenv("APPDATA"), "Claude", "claude_desktop_config.json")
+	default:
+		dir, _ := os.UserConfigDir()
+		return filepath.Join(dir, "Claude", "claude_desktop_config.json")
+	}
+}
+
+// runImportClaudeConfig implements the import-claude-config command, writing an mcp.json
+// equivalent of an existing Claude Desktop configuration
+func runImportClaudeConfig(args []string) {
+	fs := flag.NewFlagSet("import-claude-config", flag.ExitOnError)
+	src := fs.String("from", defaultClaudeConfigPath(), "Path to claude_desktop_config.json")
+	dst := fs.String("to", "mcp.json", "Path of the mcp.json to write")
+	force := fs.Bool("force", false, "Overwrite the destination if it already exists")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	data, err := os.ReadFile(*src)
+	if err != nil {
+		log.Fatalf("Failed to read Claude Desktop config: %v", err)
+	}
+
+	var claudeCfg ClaudeDesktopConfig
+	if err := json.Unmarshal(data, &claudeCfg); err != nil {
+		log.Fatalf("Failed to parse Claude Desktop config: %v", err)
+	}
+	if len(claudeCfg.MCPServers) == 0 {
+		log.Fatalf("No mcpServers found in %s", *src)
+	}
+
+	if _, err := os.Stat(*dst); err == nil && !*force {
+		log.Fatalf("%s already exists, use -force to overwrite it", *dst)
+	}
+
+	out, err := json.MarshalIndent(claudeCfg.toConfig(), "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to marshal config: %v", err)
+	}
+	if err := os.WriteFile(*dst, out, 0o644); err != nil {
+		log.Fatalf("Failed to write config: %v", err)
+	}
+
+	fmt.Printf("Imported %d servers from %s into %s\n", len(claudeCfg.MCPServers), *src, *dst)
+}
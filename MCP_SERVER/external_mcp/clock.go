@@ -0,0 +1,23 @@
+package main
+
+import "time"
+
+// clock tells the time and waits for it to pass. Subsystems whose behavior depends on time, such as
+// cache expiry, schedules, the liveness heartbeat and idle reaping, take one so tests can drive
+// them with a fake clock instead of sleeping.
+type clock interface {
+	Now() time.Time
+	// After sends the time on the returned channel once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the wall clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Defaults for clustering
+const (
+	defaultClusterSessionTTL = time.Hour
+	// clusterForwardedHeader marks requests forwarded by another instance, which are never forwarded again
+	clusterForwardedHeader = "Mcp-Cluster-Forwarded"
+	// quotaRetention keeps shared monthly usage past the end of its month
+	quotaRetention = 40 * 24 * time.Hour
+)
+
+// ClusterConfig lets several instances serve MCP over HTTP behind a load balancer. They share, in
+// Redis, which instance serves each session, the quota usage of every identity and the async jobs.
+type ClusterConfig struct {
+	Redis RedisConfig `json:"Redis"`
+	// Advertise is the URL the other instances reach this one at, e.g. http://10.0.0.5:8080
+	Advertise string `json:"Advertise"`
+	// SessionTTL forgets which instance serves a session after this long without requests; defaults to 1h
+	SessionTTL Duration `json:"SessionTTL,omitempty"`
+}
+
+// cluster is the state an instance shares with the other instances of its cluster. A nil cluster
+// shares nothing.
+type cluster struct {
+	redis     *redisClient
+	advertise string
+	ttl       time.Duration
+}
+
+// newCluster returns the cluster described by cfg, or nil if cfg is nil
+func newCluster(cfg *ClusterConfig) (*cluster, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Redis.Address == "" {
+		return nil, fmt.Errorf("the cluster needs a Redis address")
+	}
+	if u, err := url.Parse(cfg.Advertise); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("the cluster needs the URL this instance is reachable at, got '%s'", cfg.Advertise)
+	}
+	c := &cluster{redis: newRedisClient(cfg.Redis), advertise: cfg.Advertise, ttl: time.Duration(cfg.SessionTTL)}
+	if c.ttl <= 0 {
+		c.ttl = defaultClusterSessionTTL
+	}
+	return c, nil
+}
+
+// instance returns the URL of this instance, or "" outside a cluster
+func (c *cluster) instance() string {
+	if c == nil {
+		return ""
+	}
+	return c.advertise
+}
+
+// claim records this instance as serving the session unless another instance already does, and
+// returns the URL of the instance serving it
+func (c *cluster) claim(session string) (string, error) {
+	key, ttl := c.redis.key("session/"+session), strconv.FormatInt(c.ttl.Milliseconds(), 10)
+	claimed, err := c.redis.value("SET", key, c.advertise, "NX", "PX", ttl)
+	if err != nil || claimed != nil {
+		return c.advertise, err
+	}
+	owner, err := c.redis.value("GET", key)
+	if err != nil {
+		return "", err
+	}
+	if owner == nil || string(owner) == c.advertise {
+		// The claim expired in between, or the session is ours: keep it alive
+		_, err = c.redis.do("SET", key, c.advertise, "PX", ttl)
+		return c.advertise, err
+	}
+	return string(owner), nil
+}
+
+// takeOver records this instance as serving a session whose instance no longer answers
+func (c *cluster) takeOver(session string) {
+	_, err := c.redis.do("SET", c.redis.key("session/"+session), c.advertise, "PX", strconv.FormatInt(c.ttl.Milliseconds(), 10))
+	if err != nil {
+		log.Printf("Failed to take over session '%s': %v", session, err)
+	}
+}
+
+// middleware forwards the requests of sessions served by another instance to it, so each session
+// keeps its context, stateful servers and subscriptions on one instance. Sessions whose instance
+// is gone are taken over.
+func (c *cluster) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := r.Header.Get("Mcp-Session-Id")
+		if session == "" || r.Header.Get(clusterForwardedHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		owner, err := c.claim(session)
+		if err != nil {
+			log.Printf("Failed to look up the instance serving session '%s', serving it here: %v", session, err)
+		}
+		if err != nil || owner == c.advertise {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target, err := url.Parse(owner)
+		if err != nil {
+			c.takeOver(session)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Keep the body so the request can be served here if the owner does not answer
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxHTTPBodySize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+			log.Printf("Instance %s serving session '%s' did not answer, taking the session over: %v", owner, session, err)
+			c.takeOver(session)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		}
+		forwarded := r.Clone(r.Context())
+		forwarded.Body = io.NopCloser(bytes.NewReader(body))
+		forwarded.Header.Set(clusterForwardedHeader, c.advertise)
+		proxy.ServeHTTP(w, forwarded)
+	})
+}
+
+// spend adds cost to what the identity spent in the month across the cluster, unless it would take
+// the identity over its limit. It returns false if the shared usage could not be reached.
+func (c *cluster) spend(month, identity string, cost, limit float64, limited bool) (bool, error) {
+	key := c.redis.key("quota/" + month + "/" + identity)
+	reply, err := c.redis.value("INCRBYFLOAT", key, strconv.FormatFloat(cost, 'f', -1, 64))
+	if err != nil {
+		log.Printf("Failed to charge the shared quota of '%s', charging it on this instance: %v", identity, err)
+		return false, nil
+	}
+	_, _ = c.redis.do("PEXPIRE", key, strconv.FormatInt(quotaRetention.Milliseconds(), 10))
+	spent, err := strconv.ParseFloat(string(reply), 64)
+	if err != nil {
+		return true, fmt.Errorf("invalid shared quota usage %q", reply)
+	}
+	if limited && spent > limit {
+		_, _ = c.redis.do("INCRBYFLOAT", key, strconv.FormatFloat(-cost, 'f', -1, 64))
+		return true, fmt.Errorf("quota exceeded: '%s' has used %g of its monthly quota of %g", identity, spent-cost, limit)
+	}
+	return true, nil
+}
+
+// refund takes back cost the identity spent in the month across the cluster
+func (c *cluster) refund(month, identity string, cost float64) {
+	key := c.redis.key("quota/" + month + "/" + identity)
+	if _, err := c.redis.do("INCRBYFLOAT", key, strconv.FormatFloat(-cost, 'f', -1, 64)); err != nil {
+		log.Printf("Failed to refund the shared quota of '%s': %v", identity, err)
+	}
+}
+
+// redisJobStore keeps jobs in a Redis hash, so any instance can report on the jobs of any other
+type redisJobStore struct {
+	redis *redisClient
+	key   string
+}
+
+func (c *cluster) jobStore() *redisJobStore {
+	return &redisJobStore{redis: c.redis, key: c.redis.key("jobs")}
+}
+
+func (s *redisJobStore) put(j job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	_, err = s.redis.do("HSET", s.key, j.ID, string(data))
+	return err
+}
+
+func (s *redisJobStore) get(id string) (job, bool, error) {
+	data, err := s.redis.value("HGET", s.key, id)
+	if err != nil || data == nil {
+		return job{}, false, err
+	}
+	var j job
+	if err := json.Unmarshal(data, &j); err != nil {
+		return job{}, false, fmt.Errorf("invalid job '%s': %v", id, err)
+	}
+	return j, true, nil
+}
+
+func (s *redisJobStore) list() ([]job, error) {
+	fields, err := s.redis.values("HGETALL", s.key)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]job, 0, len(fields)/2)
+	for i := 1; i < len(fields); i += 2 {
+		var j job
+		if err := json.Unmarshal(fields[i], &j); err != nil {
+			log.Printf("Skipping invalid job '%s': %v", fields[i-1], err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func (s *redisJobStore) remove(id string) error {
+	_, err := s.redis.do("HDEL", s.key, id)
+	return err
+}
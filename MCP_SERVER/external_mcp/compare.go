@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// maxDifferences bounds the differences a comparison reports, so wholly different responses stay readable
+const maxDifferences = 100
+
+type CompareBackendsRequest struct {
+	Name      string      `json:"name" jsonschema:"required,description=Tool to call on both servers"`
+	Arguments interface{} `json:"arguments" jsonschema:"description=Arguments passed unchanged to both calls"`
+	Baseline  string      `json:"baseline" jsonschema:"required,description=Server whose response is the reference, e.g. the one being migrated from"`
+	Candidate string      `json:"candidate" jsonschema:"required,description=Server compared against the baseline"`
+}
+
+// comparedCall is the outcome of the tool call on one of the compared servers
+type comparedCall struct {
+	Backend  string          `json:"backend"`
+	Duration string          `json:"duration"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	elapsed  time.Duration
+}
+
+// responseDifference is a value that differs between the two responses, addressed by its JSON path
+type responseDifference struct {
+	Path      string      `json:"path"`
+	Baseline  interface{} `json:"baseline"`
+	Candidate interface{} `json:"candidate"`
+}
+
+// handleCompareBackends calls a tool on two named servers with the same arguments and reports how
+// their responses and latencies differ
+func handleCompareBackends(rt *router) interface{} {
+	return func(ctx context.Context, args CompareBackendsRequest) (*mcp.ToolResponse, error) {
+		if args.Name == "" || args.Baseline == "" || args.Candidate == "" {
+			return nil, fmt.Errorf("name, baseline and candidate are required")
+		}
+		calls, err := rt.compare(ctx, args.Name, args.Arguments, args.Baseline, args.Candidate)
+		if err != nil {
+			return nil, err
+		}
+
+		differences := diffResponses(calls[0], calls[1])
+		comparison := map[string]interface{}{
+			"tool":         args.Name,
+			"identical":    len(differences) == 0,
+			"baseline":     calls[0],
+			"candidate":    calls[1],
+			"latencyDelta": (calls[1].elapsed - calls[0].elapsed).Round(time.Microsecond).String(),
+			"differences":  differences,
+		}
+		comparisonJSON, err := json.Marshal(comparison)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal comparison: %v", err)
+		}
+		return mcp.NewToolResponse(mcp.NewTextContent(string(comparisonJSON))), nil
+	}
+}
+
+// compare calls the tool on each of the named servers concurrently, after the same authorization and
+// argument checks as a routed call
+func (rt *router) compare(ctx context.Context, name string, arguments interface{}, backends ...string) ([]comparedCall, error) {
+	caller := identityFromContext(ctx)
+	correlationID := correlationIDFromContext(ctx)
+	err := rt.authz.authorize(ctx, name)
+	if err == nil {
+		err = rt.authorizeHost(ctx, name)
+	}
+	if err == nil {
+		arguments, err = rt.sanitizers.sanitize(name, arguments)
+	}
+	if err == nil {
+		policy, _ := rt.policies()
+		err = policy.authorize(ctx, name, arguments)
+	}
+	targets := make([]*backend, len(backends))
+	for i, backendName := range backends {
+		if err == nil {
+			if targets[i] = rt.registry.named(backendName); targets[i] == nil {
+				err = fmt.Errorf("unknown server '%s'", backendName)
+			}
+		}
+	}
+	// The servers are known before the call is charged
+	if err == nil {
+		_, err = rt.quotas.charge(caller.Name, name)
+	}
+	if err != nil {
+		rt.audit.record(auditRecord{CorrelationID: correlationID, Identity: caller.Name, Tool: name, Decision: "denied", Error: err.Error()})
+		return nil, err
+	}
+	rt.audit.record(auditRecord{CorrelationID: correlationID, Identity: caller.Name, Tool: name, Decision: "allowed"})
+
+	// Both responses are decoded to be compared
+	ctx = withoutPassthrough(ctx)
+	calls := make([]comparedCall, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target *backend) {
+			defer wg.Done()
+			calls[i].Backend = target.name
+			start := time.Now()
+			client, err := rt.registry.clientFor(caller, sessionScope(ctx), target)
+			var resp *mcp.ToolResponse
+			if err == nil {
+				resp, err = callTool(ctx, client, name, arguments)
+			}
+			calls[i].elapsed = time.Since(start)
+			calls[i].Duration = calls[i].elapsed.Round(time.Microsecond).String()
+			calls[i].Result, calls[i].Error = shadowResult(resp, err)
+		}(i, target)
+	}
+	wg.Wait()
+	return calls, nil
+}
+
+// diffResponses lists the values that differ between two call outcomes
+func diffResponses(baseline, candidate comparedCall) []responseDifference {
+	var differences []responseDifference
+	if baseline.Error != candidate.Error {
+		differences = append(differences, responseDifference{Path: "error", Baseline: baseline.Error, Candidate: candidate.Error})
+	}
+	var a, b interface{}
+	_ = json.Unmarshal(baseline.Result, &a)
+	_ = json.Unmarshal(candidate.Result, &b)
+	return diffValues("result", a, b, differences)
+}
+
+// diffValues appends the differences between two decoded JSON values. Text holding JSON, as many
+// tools return, is compared structurally.
+func diffValues(path string, a, b interface{}, differences []responseDifference) []responseDifference {
+	if len(differences) >= maxDifferences {
+		return differences
+	}
+	a, b = decodeJSONText(a), decodeJSONText(b)
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			keys := make(map[string]bool, len(a)+len(b))
+			for key := range a {
+				keys[key] = true
+			}
+			for key := range b {
+				keys[key] = true
+			}
+			sorted := make([]string, 0, len(keys))
+			for key := range keys {
+				sorted = append(sorted, key)
+			}
+			sort.Strings(sorted)
+			for _, key := range sorted {
+				differences = diffValues(path+"."+key, a[key], b[key], differences)
+			}
+			return differences
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok {
+			for i := 0; i < len(a) || i < len(b); i++ {
+				var x, y interface{}
+				if i < len(a) {
+					x = a[i]
+				}
+				if i < len(b) {
+					y = b[i]
+				}
+				differences = diffValues(path+"["+strconv.Itoa(i)+"]", x, y, differences)
+			}
+			return differences
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		differences = append(differences, responseDifference{Path: path, Baseline: a, Candidate: b})
+	}
+	return differences
+}
+
+// decodeJSONText returns the object or array a string holds, or the value itself
+func decodeJSONText(value interface{}) interface{} {
+	text, ok := value.(string)
+	if !ok || len(text) == 0 || (text[0] != '{' && text[0] != '[') {
+		return value
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(text), &decoded); err != nil {
+		return value
+	}
+	return decoded
+}
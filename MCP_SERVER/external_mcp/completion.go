@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// completionTimeout bounds how long a host waits for argument suggestions, which it asks for as
+// the user types
+const completionTimeout = 5 * time.Second
+
+// maxCompletionValues is the most suggestions a completion result may hold
+const maxCompletionValues = 100
+
+// CompleteRequest asks for suggestions for an argument of a prompt or resource template
+type CompleteRequest struct {
+	Ref struct {
+		// Type is "ref/prompt" or "ref/resource"
+		Type string `json:"type"`
+		Name string `json:"name,omitempty"`
+		URI  string `json:"uri,omitempty"`
+	} `json:"ref"`
+	Argument struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"argument"`
+}
+
+// completion holds the suggestions of a completion/complete result
+type completion struct {
+	Values  []string `json:"values"`
+	Total   int      `json:"total,omitempty"`
+	HasMore bool     `json:"hasMore,omitempty"`
+}
+
+// complete answers a completion/complete request. A resource template is completed by the server
+// owning it; a prompt by every server, as prompts are not namespaced. Servers that do not know the
+// prompt fail and are left out, and the suggestions of the others are merged in server order.
+func (rt *router) complete(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var request CompleteRequest
+	if err := json.Unmarshal(params, &request); err != nil {
+		return nil, fmt.Errorf("invalid completion request: %v", err)
+	}
+	completers := rt.registry.shared()
+	if request.Ref.Type == "ref/resource" {
+		b, uri := rt.resourceOwner(request.Ref.URI)
+		if b == nil {
+			return nil, fmt.Errorf("unknown resource template '%s'", request.Ref.URI)
+		}
+		forwarded, err := withRefURI(params, uri)
+		if err != nil {
+			return nil, err
+		}
+		completers, params = []*backend{b}, forwarded
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, completionTimeout)
+	defer cancel()
+	results := make([]*completion, len(completers))
+	errs := make([]error, len(completers))
+	var wg sync.WaitGroup
+	for i, b := range completers {
+		wg.Add(1)
+		go func(i int, b *backend) {
+			defer wg.Done()
+			raw, err := b.upstream.request(ctx, "completion/complete", params)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %v", b.name, err)
+				return
+			}
+			var result struct {
+				Completion completion `json:"completion"`
+			}
+			if err := json.Unmarshal(raw, &result); err != nil {
+				errs[i] = fmt.Errorf("%s: invalid completion result: %v", b.name, err)
+				return
+			}
+			results[i] = &result.Completion
+		}(i, b)
+	}
+	wg.Wait()
+
+	merged, answered := mergeCompletions(results)
+	if !answered {
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("no server could complete '%s': %v", request.Argument.Name, err)
+			}
+		}
+	}
+	return map[string]interface{}{"completion": merged}, nil
+}
+
+// withRefURI replaces the URI of the template a completion request refers to
+func withRefURI(params json.RawMessage, uri string) (json.RawMessage, error) {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(params, &decoded); err != nil {
+		return nil, fmt.Errorf("invalid completion request: %v", err)
+	}
+	ref, _ := decoded["ref"].(map[string]interface{})
+	if ref == nil {
+		return nil, fmt.Errorf("invalid completion request: no ref")
+	}
+	ref["uri"] = uri
+	return json.Marshal(decoded)
+}
+
+// mergeCompletions merges the suggestions of several servers, dropping duplicates and keeping at
+// most maxCompletionValues. It reports whether any server answered.
+func mergeCompletions(results []*completion) (completion, bool) {
+	merged := completion{Values: []string{}}
+	seen := make(map[string]bool)
+	answered := false
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		answered = true
+		merged.HasMore = merged.HasMore || result.HasMore
+		for _, value := range result.Values {
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+			if len(merged.Values) == maxCompletionValues {
+				merged.HasMore = true
+				continue
+			}
+			merged.Values = append(merged.Values, value)
+		}
+	}
+	merged.Total = len(seen)
+	if merged.HasMore {
+		// The servers left some suggestions out, so the total is unknown
+		merged.Total = 0
+	}
+	return merged, answered
+}
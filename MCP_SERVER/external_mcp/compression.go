@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressSize is the smallest response body worth compressing
+const minCompressSize = 1024
+
+// compressionMiddleware decompresses gzip or deflate request bodies and compresses responses larger
+// than minCompressSize with the best encoding the client accepts
+func compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+		case "":
+		case "gzip":
+			body, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "Invalid gzip request body", http.StatusBadRequest)
+				return
+			}
+			defer body.Close()
+			r.Body = body
+		case "deflate":
+			// HTTP's deflate is the zlib format, not a raw deflate stream
+			body, err := zlib.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "Invalid deflate request body", http.StatusBadRequest)
+				return
+			}
+			defer body.Close()
+			r.Body = body
+		default:
+			http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+		r.Header.Del("Content-Encoding")
+
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffered := &bufferedResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(buffered, r)
+		buffered.flush(encoding)
+	})
+}
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header, preferring gzip
+func acceptedEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	switch {
+	case accepted["gzip"] || accepted["*"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// bufferedResponseWriter holds the response back so it can be compressed once its size is known
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+// flush writes the buffered response, compressed with encoding when it is large enough
+func (w *bufferedResponseWriter) flush(encoding string) {
+	header := w.ResponseWriter.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if w.body.Len() < minCompressSize || header.Get("Content-Encoding") != "" {
+		w.ResponseWriter.WriteHeader(w.status)
+		_, _ = w.ResponseWriter.Write(w.body.Bytes())
+		return
+	}
+
+	var compressed bytes.Buffer
+	var encoder io.WriteCloser
+	if encoding == "gzip" {
+		encoder = gzip.NewWriter(&compressed)
+	} else {
+		encoder = zlib.NewWriter(&compressed)
+	}
+	_, _ = encoder.Write(w.body.Bytes())
+	_ = encoder.Close()
+
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	_, _ = w.ResponseWriter.Write(compressed.Bytes())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultConcurrencyLimit is the in-flight limit a backend starts from when none is configured
+	defaultConcurrencyLimit = 10
+	// concurrencyBackoff scales an adaptive limit down when the backend shows it is overloaded
+	concurrencyBackoff = 0.9
+)
+
+// ConcurrencyConfig bounds the calls in flight to a server. The limit is fixed unless Adaptive is set,
+// in which case it is raised while calls succeed quickly and lowered when they fail or slow down.
+type ConcurrencyConfig struct {
+	// Limit is the fixed limit, or where an adaptive limit starts; defaults to 10
+	Limit int `json:"Limit,omitempty"`
+	// Adaptive adds one to the limit for every limit's worth of calls that succeed within
+	// LatencyTarget, and scales it by 0.9 on each call that fails or is slower
+	Adaptive bool `json:"Adaptive,omitempty"`
+	// MinLimit and MaxLimit bound an adaptive limit; they default to 1 and 100
+	MinLimit int `json:"MinLimit,omitempty"`
+	MaxLimit int `json:"MaxLimit,omitempty"`
+	// LatencyTarget is the call latency above which the server counts as overloaded; without it
+	// only failures lower the limit
+	LatencyTarget Duration `json:"LatencyTarget,omitempty"`
+}
+
+// concurrencyLimiter holds back calls beyond a backend's in-flight limit until others finish.
+// A nil limiter lets every call through.
+type concurrencyLimiter struct {
+	cfg ConcurrencyConfig
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	// released is closed and replaced whenever a slot frees up or the limit rises
+	released chan struct{}
+}
+
+// newConcurrencyLimiter returns a limiter for cfg, or nil when the server's calls are not limited
+func newConcurrencyLimiter(cfg *ConcurrencyConfig) *concurrencyLimiter {
+	if cfg == nil {
+		return nil
+	}
+	l := &concurrencyLimiter{cfg: *cfg, released: make(chan struct{})}
+	if l.cfg.Limit <= 0 {
+		l.cfg.Limit = defaultConcurrencyLimit
+	}
+	if l.cfg.MinLimit <= 0 {
+		l.cfg.MinLimit = 1
+	}
+	if l.cfg.MaxLimit <= 0 {
+		l.cfg.MaxLimit = 100
+	}
+	l.limit = float64(l.cfg.Limit)
+	return l
+}
+
+// acquire waits for a free slot, returning a function that releases it with the call's outcome
+func (l *concurrencyLimiter) acquire(ctx context.Context) (func(latency time.Duration, err error), error) {
+	if l == nil {
+		return func(time.Duration, error) {}, nil
+	}
+	for {
+		l.mu.Lock()
+		if l.inFlight < int(l.limit) {
+			l.inFlight++
+			l.mu.Unlock()
+			return l.release, nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release frees a slot and, for an adaptive limiter, adjusts the limit to the call's outcome
+func (l *concurrencyLimiter) release(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if l.cfg.Adaptive {
+		overloaded := err != nil || (l.cfg.LatencyTarget > 0 && latency > time.Duration(l.cfg.LatencyTarget))
+		if overloaded {
+			l.limit = math.Max(float64(l.cfg.MinLimit), l.limit*concurrencyBackoff)
+		} else {
+			l.limit = math.Min(float64(l.cfg.MaxLimit), l.limit+1/l.limit)
+		}
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// observeConcurrency exports the in-flight limit of a limited backend
+func (rt *router) observeConcurrency(b *backend) {
+	if l := b.concurrency(); l != nil {
+		limit, _ := l.current()
+		rt.metrics.setGauge("mcp_backend_concurrency_limit", "Calls a server may have in flight", float64(limit), "backend", b.name)
+	}
+}
+
+// current returns the limit and the calls in flight
+func (l *concurrencyLimiter) current() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit), l.inFlight
+}
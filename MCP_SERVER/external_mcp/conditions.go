@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// ServerCondition limits a server to the machines it can run on, so one config can be shared by
+// teammates on different platforms. Every listed requirement must hold.
+type ServerCondition struct {
+	// OS lists the operating systems the server runs on, as Go names them: "darwin", "linux", "windows"
+	OS []string `json:"OS,omitempty"`
+	// Arch lists the architectures the server runs on, e.g. "amd64" or "arm64"
+	Arch []string `json:"Arch,omitempty"`
+	// Env lists environment variables that must be set
+	Env []string `json:"Env,omitempty"`
+	// Executables lists programs that must be found on the PATH, such as the server's launcher
+	Executables []string `json:"Executables,omitempty"`
+}
+
+// unmet describes the first requirement of the condition this machine does not meet, or returns ""
+func (c *ServerCondition) unmet() string {
+	if c == nil {
+		return ""
+	}
+	if len(c.OS) > 0 && !containsString(c.OS, runtime.GOOS) {
+		return fmt.Sprintf("requires OS %s, running on %s", strings.Join(c.OS, " or "), runtime.GOOS)
+	}
+	if len(c.Arch) > 0 && !containsString(c.Arch, runtime.GOARCH) {
+		return fmt.Sprintf("requires architecture %s, running on %s", strings.Join(c.Arch, " or "), runtime.GOARCH)
+	}
+	for _, name := range c.Env {
+		if os.Getenv(name) == "" {
+			return fmt.Sprintf("requires environment variable %s", name)
+		}
+	}
+	for _, name := range c.Executables {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Sprintf("requires %s on the PATH", name)
+		}
+	}
+	return ""
+}
+
+// skipUnmetServers removes the servers whose conditions this machine does not meet, before their
+// placeholders are resolved since those may only be set where the server runs
+func skipUnmetServers(cfg *Config) {
+	names := make([]string, 0, len(cfg.MCPStdIOServers))
+	for name := range cfg.MCPStdIOServers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		reason := cfg.MCPStdIOServers[name].When.unmet()
+		if reason == "" {
+			continue
+		}
+		log.Printf("Skipping server '%s': %s", name, reason)
+		if cfg.skipped == nil {
+			cfg.skipped = make(map[string]string)
+		}
+		cfg.skipped[name] = reason
+		delete(cfg.MCPStdIOServers, name)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configDir returns the directory of server files merged into the config at location, e.g. mcp.d
+// next to mcp.json
+func configDir(location string) string {
+	return strings.TrimSuffix(location, filepath.Ext(location)) + ".d"
+}
+
+// mergeConfigDir adds the servers defined in dir, one per <name>.json file holding the server's
+// settings, to the config. Files are merged in name order, and a server defined twice is refused
+// rather than one definition silently winning. Hidden files and other extensions are ignored.
+func mergeConfigDir(data []byte, dir string) ([]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && filepath.Ext(name) == ".json" && !strings.HasPrefix(name, ".") {
+			files = append(files, name)
+		}
+	}
+	if len(files) == 0 {
+		return data, nil
+	}
+	sort.Strings(files)
+
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if document["MCPStdIOServers"] == nil && document["mcpServers"] != nil {
+		return nil, fmt.Errorf("the servers in %s cannot be merged into a Claude Desktop config", dir)
+	}
+	servers := make(map[string]json.RawMessage)
+	if raw := document["MCPStdIOServers"]; raw != nil {
+		if err := json.Unmarshal(raw, &servers); err != nil {
+			return nil, fmt.Errorf("invalid MCPStdIOServers: %v", err)
+		}
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(file, ".json")
+		if _, ok := servers[name]; ok {
+			return nil, fmt.Errorf("server '%s' in %s is already defined", name, filepath.Join(dir, file))
+		}
+		server, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		var settings map[string]json.RawMessage
+		if err := json.Unmarshal(server, &settings); err != nil {
+			return nil, fmt.Errorf("invalid server in %s: %v", filepath.Join(dir, file), err)
+		}
+		servers[name] = server
+	}
+
+	merged, err := json.Marshal(servers)
+	if err != nil {
+		return nil, err
+	}
+	document["MCPStdIOServers"] = merged
+	return json.Marshal(document)
+}
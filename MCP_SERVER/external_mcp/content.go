@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// contentOf returns the content items of a response, dropping missing items. A nil response has none.
+func contentOf(resp *mcp.ToolResponse) []*mcp.Content {
+	if resp == nil {
+		return []*mcp.Content{}
+	}
+	content := make([]*mcp.Content, 0, len(resp.Content))
+	for _, item := range resp.Content {
+		if item != nil {
+			content = append(content, item)
+		}
+	}
+	return content
+}
+
+// responseText joins the text of a response's text items, or returns "" for a nil response
+func responseText(resp *mcp.ToolResponse) string {
+	return textOf(contentOf(resp))
+}
+
+// firstText returns the text of a response's first content item, or an error saying why it has none:
+// the response is missing, has no content or starts with an item that is not text
+func firstText(resp *mcp.ToolResponse) (string, error) {
+	content := contentOf(resp)
+	switch {
+	case resp == nil:
+		return "", fmt.Errorf("no response")
+	case len(content) == 0:
+		return "", fmt.Errorf("the response has no content")
+	case content[0].TextContent == nil:
+		return "", fmt.Errorf("the response starts with %s content instead of text", contentKind(content[0]))
+	}
+	return content[0].TextContent.Text, nil
+}
+
+// contentKind names the type of a content item for messages
+func contentKind(item *mcp.Content) string {
+	if item.Type == "" {
+		return "untyped"
+	}
+	return string(item.Type)
+}
+
+// repairToolResult makes a tools/call result the client library can decode without failing on
+// missing pieces: a missing content list becomes empty, null items are dropped and text items
+// without text get an empty one. Items of other types are left for the library to reject with an
+// error. A result that is not a JSON object is returned unchanged.
+func repairToolResult(result json.RawMessage) json.RawMessage {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(result, &decoded); err != nil || decoded == nil {
+		return result
+	}
+	items, _ := decoded["content"].([]interface{})
+	content := make([]interface{}, 0, len(items))
+	repaired := decoded["content"] == nil
+	for _, item := range items {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			repaired = true
+			continue
+		}
+		if fields["type"] == "text" {
+			if _, ok := fields["text"].(string); !ok {
+				fields["text"] = ""
+				repaired = true
+			}
+		}
+		content = append(content, fields)
+	}
+	if !repaired {
+		return result
+	}
+	decoded["content"] = content
+	encoded, err := json.Marshal(decoded)
+	if err != nil {
+		return result
+	}
+	return encoded
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// correlationMetaKey is the _meta key carrying the correlation id to and from other MCP servers
+const correlationMetaKey = "correlationId"
+
+type correlationKey struct{}
+
+// newCorrelationID returns a random correlation id
+func newCorrelationID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// contextWithCorrelationID returns a copy of ctx carrying the correlation id, which is also added
+// to the _meta forwarded with upstream calls
+func contextWithCorrelationID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, correlationKey{}, id)
+	return contextWithMeta(ctx, map[string]interface{}{correlationMetaKey: id})
+}
+
+// correlationIDFromContext returns the correlation id of the request ctx belongs to, or ""
+func correlationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// observeCorrelation gives every incoming request a correlation id: the one the caller passed in
+// _meta, so a call keeps its id across chained proxies, or a new one. It decorates the downstream transport.
+func observeCorrelation(ctx context.Context, message *transport.BaseJsonRpcMessage) context.Context {
+	if message.Type != transport.BaseMessageTypeJSONRPCRequestType {
+		return ctx
+	}
+	var params struct {
+		Meta map[string]interface{} `json:"_meta"`
+	}
+	_ = json.Unmarshal(message.JsonRpcRequest.Params, &params)
+	id, _ := params.Meta[correlationMetaKey].(string)
+	if id == "" {
+		id = newCorrelationID()
+	}
+	return contextWithCorrelationID(ctx, id)
+}
+
+// logf logs like log.Printf, prefixing the line with the correlation id carried by ctx
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := correlationIDFromContext(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, args...)
+}
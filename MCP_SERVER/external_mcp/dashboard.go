@@ -0,0 +1,241 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// callHistorySize is how many recent calls the dashboard shows
+const callHistorySize = 200
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// callHistory keeps the most recent tool calls. A nil history keeps nothing.
+type callHistory struct {
+	mu     sync.Mutex
+	events []toolCallEvent
+	next   int
+}
+
+func newCallHistory() *callHistory {
+	return &callHistory{events: make([]toolCallEvent, 0, callHistorySize)}
+}
+
+// add records a finished call, evicting the oldest once the history is full
+func (h *callHistory) add(event toolCallEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.events) < callHistorySize {
+		h.events = append(h.events, event)
+		return
+	}
+	h.events[h.next] = event
+	h.next = (h.next + 1) % callHistorySize
+}
+
+// reset forgets the recorded calls
+func (h *callHistory) reset() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events, h.next = make([]toolCallEvent, 0, callHistorySize), 0
+}
+
+// recent returns the recorded calls, newest first
+func (h *callHistory) recent() []toolCallEvent {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := make([]toolCallEvent, 0, len(h.events))
+	for i := len(h.events) - 1; i >= 0; i-- {
+		events = append(events, h.events[(h.next+i)%len(h.events)])
+	}
+	return events
+}
+
+// backendStatus describes a configured server for the dashboard
+type backendStatus struct {
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	URL         string `json:"url,omitempty"`
+	PID         int    `json:"pid,omitempty"`
+	Tools       int    `json:"tools"`
+	Required    bool   `json:"required,omitempty"`
+	PerTenant   bool   `json:"perTenant,omitempty"`
+	Stateful    bool   `json:"stateful,omitempty"`
+	Initialized bool   `json:"initialized"`
+	// Tags label the server for group operations
+	Tags []string `json:"tags,omitempty"`
+	// Degraded lists the failing probes of the server and why they failed
+	Degraded []string `json:"degraded,omitempty"`
+	// Failed says why the server was given up on for crash-looping
+	Failed string `json:"failed,omitempty"`
+	// Unreachable says which preflight check a remote server failed and why, e.g. "tls: ..."
+	Unreachable string `json:"unreachable,omitempty"`
+}
+
+// catalogEntry is a tool in the dashboard's catalog
+type catalogEntry struct {
+	Name        string `json:"name"`
+	Backend     string `json:"backend"`
+	Description string `json:"description,omitempty"`
+}
+
+// status describes every configured server, ordered by name: "running", "initializing", "exited",
+// "failed", "unreachable" or "stopped"
+func (r *backendRegistry) status() []backendStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	statuses := make([]backendStatus, 0, len(r.servers))
+	for name, config := range r.servers {
+		status := backendStatus{Name: name, State: "stopped", URL: config.URL, Required: config.Required, PerTenant: config.PerTenant, Stateful: config.Stateful, Tags: config.Tags, Degraded: r.degradedLocked(name)}
+		if b, ok := r.backends[name]; ok {
+			b.mu.RLock()
+			status.Tools = len(b.tools)
+			status.Initialized = b.initialized
+			b.mu.RUnlock()
+			if b.cmd != nil && b.cmd.Process != nil {
+				status.PID = b.cmd.Process.Pid
+			}
+			switch {
+			case b.hasExited(0):
+				status.State = "exited"
+			case status.Initialized:
+				status.State = "running"
+			default:
+				status.State = "initializing"
+			}
+		}
+		if reason, ok := r.unreachable[name]; ok && status.State == "stopped" {
+			status.State, status.Unreachable = "unreachable", reason
+		}
+		if reason, ok := r.failed[name]; ok {
+			status.State, status.Failed = "failed", reason
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// routes maps each tool to the backend its calls are routed to
+func (r *backendRegistry) routes() map[string]string {
+	routes := make(map[string]string)
+	for _, b := range r.list() {
+		if b.config.ShadowOf != "" {
+			continue
+		}
+		b.mu.RLock()
+		for _, tool := range b.tools {
+			// The first backend listing a tool owns it
+			if _, ok := routes[tool.Name]; !ok {
+				routes[tool.Name] = b.name
+			}
+		}
+		b.mu.RUnlock()
+	}
+	return routes
+}
+
+// dashboard serves the embedded web UI and the API behind it on the admin listener
+type dashboard struct {
+	registry *backendRegistry
+	history  *callHistory
+	// reload re-reads and applies the config
+	reload func() error
+}
+
+// dashboardStatus is everything the dashboard shows
+type dashboardStatus struct {
+	Backends []backendStatus `json:"backends"`
+	Catalog  []catalogEntry  `json:"catalog"`
+	Calls    []toolCallEvent `json:"calls"`
+	Errors   []toolCallEvent `json:"errors"`
+	// Reload is the outcome of the last config reload, showing why a rejected config was rolled back
+	Reload *reloadStatus `json:"reload,omitempty"`
+	// DisabledTags are the tags whose servers were disabled
+	DisabledTags []string `json:"disabledTags,omitempty"`
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/dashboard")
+	switch {
+	case path == "":
+		// The page fetches its API relative to itself, which only resolves under /dashboard/
+		http.Redirect(w, r, "/dashboard/", http.StatusMovedPermanently)
+	case path == "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(dashboardHTML)
+	case path == "/api/status" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(d.status())
+	case path == "/api/reload":
+		if d.checkAction(w, r) {
+			d.respond(w, d.reload())
+		}
+	case strings.HasPrefix(path, "/api/tags/") && (strings.HasSuffix(path, "/enable") || strings.HasSuffix(path, "/disable")):
+		if d.checkAction(w, r) {
+			tag, action, _ := strings.Cut(strings.TrimPrefix(path, "/api/tags/"), "/")
+			d.respond(w, d.registry.setTagEnabled(tag, action == "enable"))
+		}
+	case strings.HasPrefix(path, "/api/backends/") && strings.HasSuffix(path, "/restart"):
+		if d.checkAction(w, r) {
+			name := strings.TrimSuffix(strings.TrimPrefix(path, "/api/backends/"), "/restart")
+			d.respond(w, d.registry.restart(name))
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// checkAction accepts only POST requests sent by the dashboard's own script, which sets a custom
+// header that cross-site forms cannot, and reports whether the request was accepted
+func (d *dashboard) checkAction(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost || r.Header.Get("X-MCP-Dashboard") == "" {
+		http.Error(w, "actions must be POSTed by the dashboard", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (d *dashboard) respond(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *dashboard) status() dashboardStatus {
+	status := dashboardStatus{Backends: d.registry.status(), Calls: d.history.recent(), Reload: d.registry.reloadStatus(), DisabledTags: d.registry.disabledTagList()}
+	for _, b := range d.registry.list() {
+		b.mu.RLock()
+		for _, tool := range b.tools {
+			entry := catalogEntry{Name: tool.Name, Backend: b.name}
+			if tool.Description != nil {
+				entry.Description = *tool.Description
+			}
+			status.Catalog = append(status.Catalog, entry)
+		}
+		b.mu.RUnlock()
+	}
+	for _, call := range status.Calls {
+		if call.Event == "failure" {
+			status.Errors = append(status.Errors, call)
+		}
+	}
+	return status
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// DataHandlingConfig controls what the aggregator keeps of the payloads of calls: the arguments and
+// responses recorded by the job store, the slow call log and the shadow log
+type DataHandlingConfig struct {
+	// DropArguments keeps call arguments out of the records; async jobs then cannot be resumed after a restart
+	DropArguments bool `json:"DropArguments,omitempty"`
+	// DropResponses keeps tool responses out of the records; the results of async jobs then live only
+	// in the memory of the instance that ran them, and tool results are not cached
+	DropResponses bool `json:"DropResponses,omitempty"`
+	// Retention deletes the records older than this, and finished jobs and cached tool results sooner
+	// than their own retention; 0 keeps them
+	Retention Duration `json:"Retention,omitempty"`
+}
+
+// dropsArguments reports whether call arguments are kept out of the records. A nil config keeps them.
+func (c *DataHandlingConfig) dropsArguments() bool {
+	return c != nil && c.DropArguments
+}
+
+// dropsResponses reports whether tool responses are kept out of the records. A nil config keeps them.
+func (c *DataHandlingConfig) dropsResponses() bool {
+	return c != nil && c.DropResponses
+}
+
+// retain shortens retention to the configured data retention when that is shorter
+func (c *DataHandlingConfig) retain(retention time.Duration) time.Duration {
+	if c == nil || c.Retention <= 0 || time.Duration(c.Retention) > retention {
+		return retention
+	}
+	return time.Duration(c.Retention)
+}
+
+// filterResultCache returns cfg without the result caching cfg drops: none under DropResponses, and
+// none for longer than the retention. Cached results cannot be purged, so they must not outlive it.
+func filterResultCache(cfg *CacheConfig, data *DataHandlingConfig) *CacheConfig {
+	if cfg == nil || data == nil || len(cfg.Results) == 0 {
+		return cfg
+	}
+	filtered := *cfg
+	if data.dropsResponses() {
+		filtered.Results = nil
+		return &filtered
+	}
+	filtered.Results = make([]ResultCacheRule, len(cfg.Results))
+	for i, rule := range cfg.Results {
+		rule.TTL = Duration(data.retain(time.Duration(rule.TTL)))
+		filtered.Results[i] = rule
+	}
+	return &filtered
+}
+
+// recordLog appends records to a file as JSON lines and can delete them again
+type recordLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openRecordLog(path string) (*recordLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &recordLog{path: path, file: file}, nil
+}
+
+// write appends a record
+func (l *recordLog) write(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("%s is closed", l.path)
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+// recordSubject identifies whose call a record describes and when it was made
+type recordSubject struct {
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity"`
+	Session  string    `json:"session"`
+}
+
+// purge rewrites the log without the records drop matches and returns how many it deleted.
+// Lines that cannot be parsed are kept.
+func (l *recordLog) purge(drop func(recordSubject) bool) (int, error) {
+	if l == nil {
+		return 0, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return 0, fmt.Errorf("%s is closed", l.path)
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return 0, err
+	}
+	var kept bytes.Buffer
+	removed := 0
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		var subject recordSubject
+		if len(bytes.TrimSpace(line)) > 0 && json.Unmarshal(line, &subject) == nil && drop(subject) {
+			removed++
+			continue
+		}
+		kept.Write(line)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	// The file is replaced, so appends must go to the new one
+	if err := writeFileAtomic(l.path, kept.Bytes()); err != nil {
+		return 0, err
+	}
+	_ = l.file.Close()
+	if l.file, err = os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600); err != nil {
+		return removed, err
+	}
+	return removed, nil
+}
+
+func (l *recordLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		_ = l.file.Close()
+		l.file = nil
+	}
+}
+
+// jobPayload is what a payloadFilterStore keeps of a job in memory
+type jobPayload struct {
+	arguments interface{}
+	content   []*mcp.Content
+}
+
+// payloadFilterStore keeps the arguments or responses of jobs out of the store it wraps, holding
+// them in memory instead, so they go with the process rather than to disk or the cluster
+type payloadFilterStore struct {
+	jobStore
+	dropArguments, dropResponses bool
+
+	mu       sync.Mutex
+	payloads map[string]jobPayload
+}
+
+// filterJobPayloads wraps store so it keeps no payloads cfg drops, or returns store when cfg drops none
+func filterJobPayloads(store jobStore, cfg *DataHandlingConfig) jobStore {
+	if !cfg.dropsArguments() && !cfg.dropsResponses() {
+		return store
+	}
+	return &payloadFilterStore{jobStore: store, dropArguments: cfg.dropsArguments(), dropResponses: cfg.dropsResponses(), payloads: make(map[string]jobPayload)}
+}
+
+func (s *payloadFilterStore) put(j job) error {
+	s.mu.Lock()
+	payload := s.payloads[j.ID]
+	if s.dropArguments {
+		payload.arguments = j.Arguments
+		j.Arguments, j.ArgumentsDropped = nil, true
+	}
+	if s.dropResponses && j.State == jobSucceeded {
+		payload.content = j.Content
+		j.Content, j.ResultDropped = nil, true
+	}
+	s.payloads[j.ID] = payload
+	s.mu.Unlock()
+	return s.jobStore.put(j)
+}
+
+func (s *payloadFilterStore) get(id string) (job, bool, error) {
+	j, ok, err := s.jobStore.get(id)
+	if ok {
+		j = s.restore(j)
+	}
+	return j, ok, err
+}
+
+func (s *payloadFilterStore) list() ([]job, error) {
+	jobs, err := s.jobStore.list()
+	for i := range jobs {
+		jobs[i] = s.restore(jobs[i])
+	}
+	return jobs, err
+}
+
+func (s *payloadFilterStore) remove(id string) error {
+	s.mu.Lock()
+	delete(s.payloads, id)
+	s.mu.Unlock()
+	return s.jobStore.remove(id)
+}
+
+// restore puts back the payloads of a job this process still holds
+func (s *payloadFilterStore) restore(j job) job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, ok := s.payloads[j.ID]
+	if !ok {
+		return j
+	}
+	if j.ArgumentsDropped {
+		j.Arguments, j.ArgumentsDropped = payload.arguments, false
+	}
+	if j.ResultDropped {
+		j.Content, j.ResultDropped = payload.content, false
+	}
+	return j
+}
+
+// purgeReport counts the records a purge deleted. Running jobs are left to finish and need purging again.
+type purgeReport struct {
+	Jobs          int `json:"jobs"`
+	RunningJobs   int `json:"runningJobs,omitempty"`
+	SlowCalls     int `json:"slowCalls"`
+	ShadowRecords int `json:"shadowRecords"`
+}
+
+// dataHandler deletes recorded calls on request and once they outlive the retention
+type dataHandler struct {
+	retention time.Duration
+	jobs      jobStore
+	slowCalls *recordLog
+	shadows   *recordLog
+}
+
+func newDataHandler(cfg *DataHandlingConfig, jobs jobStore, slow *slowCallLogger, shadows *shadowMirror) *dataHandler {
+	d := &dataHandler{jobs: jobs, slowCalls: slow.records(), shadows: shadows.records()}
+	if cfg != nil {
+		d.retention = time.Duration(cfg.Retention)
+	}
+	return d
+}
+
+// purge deletes the jobs and logged calls of the identity, the session, or the session of the
+// identity when both are given
+func (d *dataHandler) purge(identity, session string) (purgeReport, error) {
+	var report purgeReport
+	if identity == "" && session == "" {
+		return report, fmt.Errorf("an identity or a session is required")
+	}
+	matches := func(subject recordSubject) bool {
+		return (identity == "" || subject.Identity == identity) && (session == "" || subject.Session == session)
+	}
+
+	jobs, err := d.jobs.list()
+	if err != nil {
+		return report, fmt.Errorf("failed to list jobs: %v", err)
+	}
+	for _, j := range jobs {
+		if !matches(recordSubject{Identity: j.Identity, Session: j.Session}) {
+			continue
+		}
+		if j.State == jobRunning {
+			report.RunningJobs++
+			continue
+		}
+		if err := d.jobs.remove(j.ID); err != nil {
+			return report, fmt.Errorf("failed to remove job '%s': %v", j.ID, err)
+		}
+		report.Jobs++
+	}
+	if report.SlowCalls, err = d.slowCalls.purge(matches); err != nil {
+		return report, fmt.Errorf("failed to purge slow calls: %v", err)
+	}
+	if report.ShadowRecords, err = d.shadows.purge(matches); err != nil {
+		return report, fmt.Errorf("failed to purge shadow records: %v", err)
+	}
+	return report, nil
+}
+
+// expire deletes the logged calls made before cutoff; jobs expire through pruneJobs
+func (d *dataHandler) expire(cutoff time.Time) (int, error) {
+	older := func(subject recordSubject) bool { return subject.Time.Before(cutoff) }
+	slow, err := d.slowCalls.purge(older)
+	if err != nil {
+		return slow, err
+	}
+	shadows, err := d.shadows.purge(older)
+	return slow + shadows, err
+}
+
+// run expires logged calls as they outlive the retention, if one is configured
+func (d *dataHandler) run() {
+	if d.retention <= 0 {
+		return
+	}
+	interval := min(max(d.retention/4, time.Second), time.Hour)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		removed, err := d.expire(time.Now().Add(-d.retention))
+		if err != nil {
+			log.Printf("Failed to expire recorded calls: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("Expired %d recorded calls", removed)
+		}
+	}
+}
+
+// purgeHeader must be set on purge requests. Cross-site forms cannot set custom headers, so a page
+// open in an operator's browser cannot purge through the admin listener.
+const purgeHeader = "X-MCP-Purge"
+
+// ServeHTTP purges the records of the identity and session query parameters on POST /purge
+func (d *dataHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get(purgeHeader) == "" {
+		http.Error(w, "purges must set the "+purgeHeader+" header", http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+	report, err := d.purge(query.Get("identity"), query.Get("session"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Purged the records of identity '%s' session '%s': %+v", query.Get("identity"), query.Get("session"), report)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// runPurge implements the purge subcommand, which deletes the recorded calls of an identity or
+// session from a running aggregator
+func runPurge(adminAddr string, args []string) {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	addr := fs.String("admin", adminAddr, "Admin address of the running aggregator, e.g. 127.0.0.1:9090 or unix:/run/mcp-admin.sock")
+	identity := fs.String("identity", "", "Delete the records of calls made by this identity")
+	session := fs.String("session", "", "Delete the records of calls made in this session")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if *identity == "" && *session == "" {
+		log.Fatalf("purge needs -identity, -session or both")
+	}
+	client, base, err := listenerClient(*addr)
+	if err != nil {
+		log.Fatalf("Failed to connect to the admin listener: %v", err)
+	}
+	query := url.Values{}
+	if *identity != "" {
+		query.Set("identity", *identity)
+	}
+	if *session != "" {
+		query.Set("session", *session)
+	}
+	req, err := http.NewRequest(http.MethodPost, base+"/purge?"+query.Encode(), nil)
+	if err != nil {
+		log.Fatalf("Failed to purge: %v", err)
+	}
+	req.Header.Set(purgeHeader, "1")
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalf("Failed to purge: %v", err)
+	}
+	defer resp.Body.Close()
+	var body bytes.Buffer
+	_, _ = body.ReadFrom(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Failed to purge: %s: %s", resp.Status, bytes.TrimSpace(body.Bytes()))
+	}
+	fmt.Print(body.String())
+}
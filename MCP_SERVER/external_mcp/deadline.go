@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// budgetMetaKey is the _meta field through which a host gives a call a time budget in milliseconds.
+// The budget left after queueing and the aggregator's own overhead is passed upstream in the same field.
+const budgetMetaKey = "budgetMs"
+
+// defaultDeadlineReserve is kept back from a caller's budget, when DeadlineReserve is not configured,
+// for the aggregator to relay the response
+const defaultDeadlineReserve = 20 * time.Millisecond
+
+type budgetKey struct{}
+
+// contextWithBudget records the deadline of a call given budget, the _meta value a host passed,
+// counted from now, when the request arrived. Values that are not positive numbers are ignored.
+func contextWithBudget(ctx context.Context, budget interface{}) context.Context {
+	ms, ok := budget.(float64)
+	if !ok || ms <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, budgetKey{}, time.Now().Add(time.Duration(ms*float64(time.Millisecond))))
+}
+
+// withBudgetDeadline bounds ctx by the caller's deadline less reserve, so a call given a budget is
+// abandoned when the caller would no longer wait for it. Without a budget, ctx is returned unchanged.
+func withBudgetDeadline(ctx context.Context, reserve time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Value(budgetKey{}).(time.Time)
+	if !ok {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, deadline.Add(-reserve))
+}
+
+// withoutBudget returns a copy of ctx without the caller's budget, for work that outlives the call
+func withoutBudget(ctx context.Context) context.Context {
+	return context.WithValue(ctx, budgetKey{}, nil)
+}
+
+// forwardedMeta returns the _meta to send with an upstream call on ctx: the host's, with the budget
+// replaced by what is left of it when the call is sent
+func forwardedMeta(ctx context.Context) (map[string]interface{}, error) {
+	meta := metaFromContext(ctx)
+	budget, ok := ctx.Value(budgetKey{}).(time.Time)
+	if _, passed := meta[budgetMetaKey]; !ok && !passed {
+		return meta, nil
+	}
+	forwarded := make(map[string]interface{}, len(meta))
+	for key, value := range meta {
+		if key != budgetMetaKey {
+			forwarded[key] = value
+		}
+	}
+	if !ok {
+		return forwarded, nil
+	}
+	if deadline, bounded := ctx.Deadline(); bounded && deadline.Before(budget) {
+		budget = deadline
+	}
+	remaining := time.Until(budget).Milliseconds()
+	if remaining <= 0 {
+		return nil, fmt.Errorf("deadline budget exhausted before the call was forwarded")
+	}
+	forwarded[budgetMetaKey] = remaining
+	return forwarded, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// startOrder orders servers so each starts after the servers it depends on, in ascending phase and
+// then by name where dependencies leave a choice. It fails on unknown dependencies and on cycles.
+func startOrder(servers map[string]MCPStdIOConfig) ([]string, error) {
+	waiting := make(map[string]int, len(servers))
+	dependents := make(map[string][]string)
+	for name, config := range servers {
+		for _, dependency := range config.DependsOn {
+			if _, ok := servers[dependency]; !ok {
+				return nil, fmt.Errorf("server '%s' depends on unknown server '%s'", name, dependency)
+			}
+			waiting[name]++
+			dependents[dependency] = append(dependents[dependency], name)
+		}
+	}
+
+	var ready, order []string
+	for name := range servers {
+		if waiting[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			if servers[ready[i]].Phase != servers[ready[j]].Phase {
+				return servers[ready[i]].Phase < servers[ready[j]].Phase
+			}
+			return ready[i] < ready[j]
+		})
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, name)
+		for _, dependent := range dependents[name] {
+			if waiting[dependent]--; waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(order) < len(servers) {
+		var cycle []string
+		for name := range servers {
+			if waiting[name] > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("servers depend on each other in a cycle: %s", strings.Join(cycle, ", "))
+	}
+	return order, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+)
+
+// diagnostics describes the aggregator's state for operators: the backends, the routing table, the
+// calls in flight and the goroutines. It is logged on SIGUSR1.
+type diagnostics struct {
+	registry *backendRegistry
+	// drain counts the requests from the host in flight
+	drain *drainTransport
+}
+
+// dump returns the state as lines for the log
+func (d *diagnostics) dump() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Diagnostics of pid %d\n", os.Getpid())
+
+	b.WriteString("Backends:\n")
+	active := make(map[string]int64)
+	for _, backend := range d.registry.list() {
+		active[backend.name] = backend.active.Load()
+	}
+	for _, status := range d.registry.status() {
+		fmt.Fprintf(&b, "  %s: %s, pid %d, %d tools, %d calls in flight", status.Name, status.State, status.PID, status.Tools, active[status.Name])
+		if len(status.Degraded) > 0 {
+			fmt.Fprintf(&b, ", degraded: %s", strings.Join(status.Degraded, "; "))
+		}
+		b.WriteString("\n")
+	}
+
+	routes := d.registry.routes()
+	tools := make([]string, 0, len(routes))
+	for tool := range routes {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+	b.WriteString("Routes:\n")
+	for _, tool := range tools {
+		fmt.Fprintf(&b, "  %s -> %s\n", tool, routes[tool])
+	}
+
+	fmt.Fprintf(&b, "Requests in flight: %d\n", d.drain.inFlight())
+	fmt.Fprintf(&b, "Goroutines (%d):\n", runtime.NumGoroutine())
+	if err := pprof.Lookup("goroutine").WriteTo(&b, 2); err != nil {
+		fmt.Fprintf(&b, "  failed to dump: %v\n", err)
+	}
+	return b.String()
+}
+
+// reloadOnSignal applies the config re-read by reload, logging the outcome
+func reloadOnSignal(reload func() error) {
+	log.Println("Reloading the config on SIGHUP")
+	if err := reload(); err != nil {
+		log.Printf("Failed to reload the config: %v", err)
+		return
+	}
+	log.Println("Reloaded the config")
+}
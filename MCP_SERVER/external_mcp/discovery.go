@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// endpointEnvPrefix names environment variables addressing a server by URL, e.g.
+// MCP_ENDPOINT_GITHUB_TOOLS=http://github-tools.mcp.svc:8080/sse for the server "github-tools"
+const endpointEnvPrefix = "MCP_ENDPOINT_"
+
+// discoverEndpoints addresses servers by the URLs found in the endpoints file and in MCP_ENDPOINT_*
+// environment variables, the latter taking precedence. Servers discovered this way that are not in
+// the config are added, so a Deployment can front backend Services without listing them twice.
+func discoverEndpoints(cfg *Config) error {
+	endpoints := make(map[string]string)
+	if cfg.Endpoints != "" {
+		data, err := os.ReadFile(cfg.Endpoints)
+		if err != nil {
+			return fmt.Errorf("failed to read endpoints: %v", err)
+		}
+		if err := json.Unmarshal(data, &endpoints); err != nil {
+			return fmt.Errorf("failed to parse endpoints %s: %v", cfg.Endpoints, err)
+		}
+	}
+
+	envNames := make(map[string]string, len(cfg.MCPStdIOServers))
+	for name := range cfg.MCPStdIOServers {
+		envNames[endpointEnvName(name)] = name
+	}
+	for name := range endpoints {
+		envNames[endpointEnvName(name)] = name
+	}
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(key, endpointEnvPrefix) || value == "" {
+			continue
+		}
+		name, ok := envNames[key]
+		if !ok {
+			// Servers only known from the environment are named after the variable
+			name = strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(key, endpointEnvPrefix), "_", "-"))
+		}
+		endpoints[name] = value
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	servers := make(map[string]MCPStdIOConfig, len(cfg.MCPStdIOServers)+len(endpoints))
+	for name, server := range cfg.MCPStdIOServers {
+		servers[name] = server
+	}
+	for name, endpoint := range endpoints {
+		server := servers[name]
+		server.URL = endpoint
+		servers[name] = server
+	}
+	cfg.MCPStdIOServers = servers
+	return nil
+}
+
+// endpointEnvName is the environment variable addressing the named server
+func endpointEnvName(server string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, server)
+	return endpointEnvPrefix + name
+}
+
+// defaultDiscoveryInterval is how often backends are discovered when no interval is configured
+const defaultDiscoveryInterval = 30 * time.Second
+
+// DiscoveryConfig selects a service registry where backends register themselves, so they join and
+// leave the routing table without config edits
+type DiscoveryConfig struct {
+	// Provider is "consul" or "etcd"
+	Provider string `json:"Provider"`
+	// Address is the registry's HTTP API, e.g. http://consul:8500 or http://etcd:2379
+	Address string `json:"Address"`
+	// Namespace only discovers backends registered in this namespace
+	Namespace string `json:"Namespace,omitempty"`
+	// Tag marks Consul services that are MCP backends; defaults to "mcp"
+	Tag string `json:"Tag,omitempty"`
+	// Prefix is the etcd key prefix backends register under; defaults to "/mcp/backends/"
+	Prefix   string   `json:"Prefix,omitempty"`
+	Token    string   `json:"Token,omitempty"`
+	Interval Duration `json:"Interval,omitempty"`
+}
+
+// discoveredBackend is a backend that registered itself with a service registry
+type discoveredBackend struct {
+	Name      string   `json:"Name"`
+	URL       string   `json:"URL"`
+	Namespace string   `json:"Namespace,omitempty"`
+	Tags      []string `json:"Tags,omitempty"`
+}
+
+// discoveryProvider lists the backends currently registered with a service registry
+type discoveryProvider interface {
+	discover(ctx context.Context) ([]discoveredBackend, error)
+}
+
+// newDiscoveryProvider returns the provider selected by cfg, or nil when discovery is not configured
+func newDiscoveryProvider(cfg *DiscoveryConfig) (discoveryProvider, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	address := strings.TrimSuffix(cfg.Address, "/")
+	switch cfg.Provider {
+	case "consul":
+		tag := cfg.Tag
+		if tag == "" {
+			tag = "mcp"
+		}
+		return &consulDiscovery{address: address, namespace: cfg.Namespace, tag: tag, token: cfg.Token}, nil
+	case "etcd":
+		prefix := cfg.Prefix
+		if prefix == "" {
+			prefix = "/mcp/backends/"
+		}
+		return &etcdDiscovery{address: address, namespace: cfg.Namespace, prefix: prefix, token: cfg.Token}, nil
+	}
+	return nil, fmt.Errorf("unknown discovery provider '%s', expected consul or etcd", cfg.Provider)
+}
+
+// watchDiscovery keeps the registry's discovered backends in line with the service registry. When
+// the registry cannot be reached the backends discovered last are kept.
+func watchDiscovery(provider discoveryProvider, interval time.Duration, registry *backendRegistry) {
+	if interval <= 0 {
+		interval = defaultDiscoveryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		discovered, err := provider.discover(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to discover backends: %v", err)
+		} else if err := registry.setDiscovered(discoveredServers(discovered)); err != nil {
+			log.Printf("Failed to apply discovered backends: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// discoveredServers turns discovered backends into server configs; the first registration of a name wins
+func discoveredServers(discovered []discoveredBackend) map[string]MCPStdIOConfig {
+	servers := make(map[string]MCPStdIOConfig, len(discovered))
+	for _, d := range discovered {
+		if _, ok := servers[d.Name]; ok || d.Name == "" || d.URL == "" {
+			continue
+		}
+		servers[d.Name] = MCPStdIOConfig{URL: d.URL, Tags: d.Tags}
+	}
+	return servers
+}
+
+// consulDiscovery finds backends as healthy Consul services carrying the discovery tag. The URL is
+// taken from the "mcp-url" service meta, or built from the address, port and the "mcp-scheme" and
+// "mcp-path" meta, which default to http and /sse. The service's other tags become the backend's tags.
+type consulDiscovery struct {
+	address   string
+	namespace string
+	tag       string
+	token     string
+}
+
+// consulServiceEntry is an entry of Consul's /v1/health/service response
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Service   string            `json:"Service"`
+		Address   string            `json:"Address"`
+		Port      int               `json:"Port"`
+		Tags      []string          `json:"Tags"`
+		Meta      map[string]string `json:"Meta"`
+		Namespace string            `json:"Namespace"`
+	} `json:"Service"`
+}
+
+func (c *consulDiscovery) discover(ctx context.Context) ([]discoveredBackend, error) {
+	var services map[string][]string
+	if err := c.get(ctx, "/v1/catalog/services", &services); err != nil {
+		return nil, err
+	}
+
+	var discovered []discoveredBackend
+	for name, tags := range services {
+		if !containsString(tags, c.tag) {
+			continue
+		}
+		var entries []consulServiceEntry
+		if err := c.get(ctx, "/v1/health/service/"+url.PathEscape(name)+"?passing=true", &entries); err != nil {
+			return nil, err
+		}
+		// Any healthy instance will do; balancing between instances is left to the network
+		for _, entry := range entries {
+			if c.namespace != "" && entry.Service.Namespace != "" && entry.Service.Namespace != c.namespace {
+				continue
+			}
+			discovered = append(discovered, discoveredBackend{
+				Name:      name,
+				URL:       consulServiceURL(entry),
+				Namespace: entry.Service.Namespace,
+				Tags:      withoutString(entry.Service.Tags, c.tag),
+			})
+			break
+		}
+	}
+	return discovered, nil
+}
+
+// consulServiceURL returns the MCP endpoint of a Consul service instance
+func consulServiceURL(entry consulServiceEntry) string {
+	if endpoint := entry.Service.Meta["mcp-url"]; endpoint != "" {
+		return endpoint
+	}
+	scheme, path := entry.Service.Meta["mcp-scheme"], entry.Service.Meta["mcp-path"]
+	if scheme == "" {
+		scheme = "http"
+	}
+	if path == "" {
+		path = "/sse"
+	}
+	host := entry.Service.Address
+	if host == "" {
+		host = entry.Node.Address
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)) + path
+}
+
+// get decodes a Consul API response, scoped to the configured namespace
+func (c *consulDiscovery) get(ctx context.Context, path string, v interface{}) error {
+	endpoint := c.address + path
+	if c.namespace != "" {
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		endpoint += separator + "ns=" + url.QueryEscape(c.namespace)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	return doDiscoveryRequest(req, v)
+}
+
+// etcdDiscovery finds backends registered as JSON values under a key prefix through etcd's v3 HTTP
+// gateway, e.g. /mcp/backends/search = {"URL": "http://search:8080/sse", "Tags": ["web"]}. A value
+// without a Name is named after the rest of its key.
+type etcdDiscovery struct {
+	address   string
+	namespace string
+	prefix    string
+	token     string
+}
+
+func (e *etcdDiscovery) discover(ctx context.Context) ([]discoveredBackend, error) {
+	body, err := json.Marshal(map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(e.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixRangeEnd(e.prefix)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.address+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.token != "" {
+		req.Header.Set("Authorization", e.token)
+	}
+
+	var resp struct {
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := doDiscoveryRequest(req, &resp); err != nil {
+		return nil, err
+	}
+
+	var discovered []discoveredBackend
+	for _, kv := range resp.Kvs {
+		var d discoveredBackend
+		if err := json.Unmarshal(kv.Value, &d); err != nil {
+			log.Printf("Ignoring invalid registration at %s: %v", kv.Key, err)
+			continue
+		}
+		if d.Name == "" {
+			d.Name = strings.TrimPrefix(string(kv.Key), e.prefix)
+		}
+		if e.namespace != "" && d.Namespace != e.namespace {
+			continue
+		}
+		discovered = append(discovered, d)
+	}
+	return discovered, nil
+}
+
+// prefixRangeEnd returns the etcd range end matching every key with the given prefix
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// doDiscoveryRequest sends a request to a service registry and decodes its JSON response into v
+func doDiscoveryRequest(req *http.Request, v interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutString returns values without any occurrence of value
+func withoutString(values []string, value string) []string {
+	var kept []string
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// defaultDrainTimeout is how long the requests in flight may take to finish on shutdown when
+// DrainTimeout is not configured
+const defaultDrainTimeout = 30 * time.Second
+
+// drainingErrorCode is the JSON-RPC code of the error rejecting a request that arrives while the
+// aggregator drains. The request was not handled, so the host can retry it on another instance.
+const drainingErrorCode = -32001
+
+// drainTransport decorates the downstream transport to count the requests in flight, so shutdown
+// can wait for them to be answered, and to reject new requests once draining began
+type drainTransport struct {
+	transport.Transport
+
+	mu       sync.Mutex
+	draining bool
+	// inflight counts the requests waiting for their response by id; ids of separate HTTP sessions may collide
+	inflight map[transport.RequestId]int
+	pending  int
+	// idle is closed once draining with no request in flight
+	idle chan struct{}
+}
+
+func newDrainTransport(inner transport.Transport) *drainTransport {
+	return &drainTransport{Transport: inner, inflight: make(map[transport.RequestId]int), idle: make(chan struct{})}
+}
+
+// SetMessageHandler hands every message to handler, answering requests arriving while draining
+// with a retriable error instead
+func (t *drainTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.Transport.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		if message.Type != transport.BaseMessageTypeJSONRPCRequestType {
+			handler(ctx, message)
+			return
+		}
+		id := message.JsonRpcRequest.Id
+		t.mu.Lock()
+		draining := t.draining
+		if !draining {
+			t.inflight[id]++
+			t.pending++
+		}
+		t.mu.Unlock()
+		if draining {
+			if err := t.Transport.Send(ctx, drainingError(id)); err != nil {
+				logf(ctx, "Failed to reject request %d: %v", id, err)
+			}
+			return
+		}
+		handler(ctx, message)
+	})
+}
+
+// Send counts a request answered once its response is sent
+func (t *drainTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	var id transport.RequestId
+	switch message.Type {
+	case transport.BaseMessageTypeJSONRPCResponseType:
+		id = message.JsonRpcResponse.Id
+	case transport.BaseMessageTypeJSONRPCErrorType:
+		id = message.JsonRpcError.Id
+	default:
+		return t.Transport.Send(ctx, message)
+	}
+	defer t.answered(id)
+	return t.Transport.Send(ctx, message)
+}
+
+func (t *drainTransport) answered(id transport.RequestId) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inflight[id] == 0 {
+		return
+	}
+	if t.inflight[id]--; t.inflight[id] == 0 {
+		delete(t.inflight, id)
+	}
+	t.pending--
+	t.settle()
+}
+
+// settle closes idle once draining with nothing in flight. t.mu must be held.
+func (t *drainTransport) settle() {
+	if !t.draining || t.pending > 0 {
+		return
+	}
+	select {
+	case <-t.idle:
+	default:
+		close(t.idle)
+	}
+}
+
+// drain rejects new requests from now on and waits for the ones in flight to be answered or for
+// ctx to be done, returning how many were left unanswered
+func (t *drainTransport) drain(ctx context.Context) int {
+	t.mu.Lock()
+	t.draining = true
+	t.settle()
+	t.mu.Unlock()
+
+	select {
+	case <-t.idle:
+	case <-ctx.Done():
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pending
+}
+
+// inFlight returns how many requests wait for their response
+func (t *drainTransport) inFlight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pending
+}
+
+func drainingError(id transport.RequestId) *transport.BaseJsonRpcMessage {
+	return transport.NewBaseMessageError(&transport.BaseJSONRPCError{
+		Jsonrpc: "2.0",
+		Id:      id,
+		Error: transport.BaseJSONRPCErrorInner{
+			Code:    drainingErrorCode,
+			Message: "the server is shutting down, retry the request",
+			Data:    map[string]interface{}{"retriable": true},
+		},
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// elicitationTimeout bounds how long a server's question waits for the user to answer
+const elicitationTimeout = 10 * time.Minute
+
+type hostRelayKey struct{}
+
+// hostRelay decorates the downstream transport to send the host requests, such as elicitation
+// questions from servers, and pick out the host's answers
+type hostRelay struct {
+	transport.Transport
+	// pushes is false when the transport cannot deliver requests to the host, as over plain HTTP
+	pushes    bool
+	questions *pendingRequests
+
+	mu sync.Mutex
+	// capabilities holds the client capabilities the host declared when it initialized
+	capabilities map[string]bool
+}
+
+func newHostRelay(inner transport.Transport, pushes bool) *hostRelay {
+	return &hostRelay{Transport: inner, pushes: pushes, questions: newPendingRequests()}
+}
+
+// SetMessageHandler hands answers to the questions in flight to their askers, and every other
+// message to handler with the relay in its context, so the calls it makes can ask the host
+func (r *hostRelay) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	r.Transport.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		if r.questions.answer(message) {
+			return
+		}
+		if message.Type == transport.BaseMessageTypeJSONRPCRequestType && message.JsonRpcRequest.Method == "initialize" {
+			var params struct {
+				Capabilities map[string]json.RawMessage `json:"capabilities"`
+			}
+			_ = json.Unmarshal(message.JsonRpcRequest.Params, &params)
+			capabilities := make(map[string]bool)
+			for name := range params.Capabilities {
+				capabilities[name] = true
+			}
+			r.mu.Lock()
+			r.capabilities = capabilities
+			r.mu.Unlock()
+		}
+		handler(context.WithValue(ctx, hostRelayKey{}, r), message)
+	})
+}
+
+// elicit asks the host an elicitation/create question and returns its result
+func (r *hostRelay) elicit(ctx context.Context, params json.RawMessage) (json.RawMessage, error) {
+	return r.ask(ctx, "elicitation/create", "elicitation", params, elicitationTimeout)
+}
+
+// ask sends the host a request needing the client capability it declared and waits up to timeout
+// for its result
+func (r *hostRelay) ask(ctx context.Context, method, capability string, params json.RawMessage, timeout time.Duration) (json.RawMessage, error) {
+	r.mu.Lock()
+	supported := r.capabilities[capability]
+	r.mu.Unlock()
+	if !r.pushes {
+		return nil, fmt.Errorf("the host cannot be sent requests over plain HTTP")
+	}
+	if !supported {
+		return nil, fmt.Errorf("the host does not support %s", capability)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	result, err := r.questions.send(ctx, r.Transport, method, params)
+	if err != nil {
+		return nil, fmt.Errorf("no answer from the host: %v", err)
+	}
+	return result, nil
+}
+
+// relayElicitation asks the host of a call in flight a server's elicitation question and sends the
+// answer, or the reason there is none, back to the server
+func (t *upstreamTransport) relayElicitation(request *transport.BaseJSONRPCRequest) {
+	ctx := context.Background()
+	var result json.RawMessage
+	err := fmt.Errorf("no call from a host is waiting on this server")
+	if relay := t.caller(); relay != nil {
+		result, err = relay.elicit(ctx, request.Params)
+	}
+
+	response := transport.NewBaseMessageResponse(&transport.BaseJSONRPCResponse{Jsonrpc: "2.0", Id: request.Id, Result: result})
+	if err != nil {
+		response = transport.NewBaseMessageError(&transport.BaseJSONRPCError{
+			Jsonrpc: "2.0",
+			Id:      request.Id,
+			Error:   transport.BaseJSONRPCErrorInner{Code: -32603, Message: err.Error()},
+		})
+	}
+	_ = t.Transport.Send(ctx, response)
+}
+
+// caller returns the relay of a host with a call in flight on the transport, or nil if there is none
+func (t *upstreamTransport) caller() *hostRelay {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, relay := range t.callers {
+		return relay
+	}
+	return nil
+}
+
+// forgetCaller drops the host of a tool call that has been answered
+func (t *upstreamTransport) forgetCaller(id transport.RequestId) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.callers, id)
+}
+
+// withElicitationCapability declares in initialize params that the client answers elicitation
+// requests, which it does by asking the host
+func withElicitationCapability(params json.RawMessage) (json.RawMessage, error) {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(params, &decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode initialize params: %v", err)
+	}
+	capabilities, _ := decoded["capabilities"].(map[string]interface{})
+	if capabilities == nil {
+		capabilities = make(map[string]interface{})
+	}
+	if _, ok := capabilities["elicitation"]; !ok {
+		capabilities["elicitation"] = map[string]interface{}{}
+	}
+	decoded["capabilities"] = capabilities
+	return json.Marshal(decoded)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exportQueueSize bounds the records waiting for each exporter; further records are dropped
+const exportQueueSize = 1024
+
+const (
+	defaultExportBatchSize     = 100
+	defaultExportFlushInterval = time.Second
+)
+
+// Kinds of exported records
+const (
+	exportAudit = "audit"
+	exportUsage = "usage"
+)
+
+// ExporterConfig pushes audit and usage records into an external data pipeline
+type ExporterConfig struct {
+	// Type is jsonl, sqlite or http
+	Type string `json:"Type"`
+	// Records selects the audit and usage records exported; empty exports both
+	Records []string `json:"Records,omitempty"`
+	// Path is the file records are appended to for jsonl, or the database for sqlite
+	Path string `json:"Path,omitempty"`
+	// Command is the SQLite shell the sqlite exporter writes through; defaults to sqlite3
+	Command string `json:"Command,omitempty"`
+	// URL receives the records of each batch as a JSON array for http
+	URL     string            `json:"URL,omitempty"`
+	Headers map[string]string `json:"Headers,omitempty"`
+	Retries int               `json:"Retries,omitempty"`
+	Timeout Duration          `json:"Timeout,omitempty"`
+	// BatchSize is the most records written at once; defaults to 100
+	BatchSize int `json:"BatchSize,omitempty"`
+	// FlushInterval is the longest a record waits for its batch to fill; defaults to 1s
+	FlushInterval Duration `json:"FlushInterval,omitempty"`
+}
+
+// exportRecord is an audit record, or the usage of a call that reached a backend, in the form
+// every exporter serializes
+type exportRecord struct {
+	Kind          string    `json:"kind"`
+	Time          time.Time `json:"time"`
+	Identity      string    `json:"identity"`
+	Tool          string    `json:"tool"`
+	Backend       string    `json:"backend,omitempty"`
+	Decision      string    `json:"decision,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	// DurationSeconds is how long a call took, for usage records
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+}
+
+// recordExporter writes records to one destination
+type recordExporter interface {
+	// write exports a batch of records, oldest first
+	write(records []exportRecord) error
+	close() error
+}
+
+// exportPipeline batches the records for one exporter and writes them in the background
+type exportPipeline struct {
+	config   ExporterConfig
+	exporter recordExporter
+	queue    chan exportRecord
+}
+
+// recordExports fans audit and usage records out to the configured exporters without blocking
+// the calls they describe. A nil recordExports exports nothing.
+type recordExports struct {
+	pipelines []*exportPipeline
+	done      chan struct{}
+	closed    sync.WaitGroup
+}
+
+// openExporters starts the exporters described by configs, or returns nil when there are none
+func openExporters(configs []ExporterConfig) (*recordExports, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	e := &recordExports{done: make(chan struct{})}
+	for i, config := range configs {
+		for _, kind := range config.Records {
+			if kind != exportAudit && kind != exportUsage {
+				e.closeExporters()
+				return nil, fmt.Errorf("exporter %d: unknown record kind '%s', want audit or usage", i, kind)
+			}
+		}
+		exporter, err := newRecordExporter(config)
+		if err != nil {
+			e.closeExporters()
+			return nil, fmt.Errorf("exporter %d: %v", i, err)
+		}
+		e.pipelines = append(e.pipelines, &exportPipeline{config: config, exporter: exporter, queue: make(chan exportRecord, exportQueueSize)})
+	}
+	for _, p := range e.pipelines {
+		e.closed.Add(1)
+		go e.run(p)
+	}
+	return e, nil
+}
+
+func newRecordExporter(config ExporterConfig) (recordExporter, error) {
+	switch config.Type {
+	case "jsonl":
+		return newJSONLExporter(config)
+	case "sqlite":
+		return newSQLiteExporter(config)
+	case "http":
+		return newHTTPExporter(config)
+	default:
+		return nil, fmt.Errorf("unknown type '%s', want jsonl, sqlite or http", config.Type)
+	}
+}
+
+// audit exports an audit record
+func (e *recordExports) audit(rec auditRecord) {
+	if e == nil {
+		return
+	}
+	e.export(exportRecord{
+		Kind:          exportAudit,
+		Time:          rec.Time,
+		Identity:      rec.Identity,
+		Tool:          rec.Tool,
+		Decision:      rec.Decision,
+		Error:         rec.Error,
+		CorrelationID: rec.CorrelationID,
+	})
+}
+
+// usage exports the usage of a call that started at start and took duration on backend
+func (e *recordExports) usage(identity, tool, backend, correlationID string, start time.Time, duration time.Duration) {
+	if e == nil {
+		return
+	}
+	e.export(exportRecord{
+		Kind:            exportUsage,
+		Time:            start.UTC(),
+		Identity:        identity,
+		Tool:            tool,
+		Backend:         backend,
+		CorrelationID:   correlationID,
+		DurationSeconds: duration.Seconds(),
+	})
+}
+
+func (e *recordExports) export(rec exportRecord) {
+	for _, p := range e.pipelines {
+		if !matchesAny(p.config.Records, rec.Kind, true) {
+			continue
+		}
+		select {
+		case p.queue <- rec:
+		default:
+			log.Printf("Export queue of %s exporter full, dropping %s record for tool '%s'", p.config.Type, rec.Kind, rec.Tool)
+		}
+	}
+}
+
+// run writes the pipeline's records in batches until the exports are closed, then writes the
+// records still queued
+func (e *recordExports) run(p *exportPipeline) {
+	defer e.closed.Done()
+	size := p.config.BatchSize
+	if size <= 0 {
+		size = defaultExportBatchSize
+	}
+	interval := time.Duration(p.config.FlushInterval)
+	if interval <= 0 {
+		interval = defaultExportFlushInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []exportRecord
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := p.exporter.write(batch); err != nil {
+			log.Printf("Failed to export %d records to %s exporter: %v", len(batch), p.config.Type, err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case rec := <-p.queue:
+			batch = append(batch, rec)
+			if len(batch) >= size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.done:
+			for {
+				select {
+				case rec := <-p.queue:
+					batch = append(batch, rec)
+					if len(batch) >= size {
+						flush()
+					}
+				default:
+					flush()
+					if err := p.exporter.close(); err != nil {
+						log.Printf("Failed to close %s exporter: %v", p.config.Type, err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// close writes the queued records and closes the exporters
+func (e *recordExports) close() {
+	if e == nil {
+		return
+	}
+	close(e.done)
+	e.closed.Wait()
+}
+
+// closeExporters closes the exporters opened before a later one failed to open
+func (e *recordExports) closeExporters() {
+	for _, p := range e.pipelines {
+		_ = p.exporter.close()
+	}
+}
+
+// jsonlExporter appends records as JSON lines to a file
+type jsonlExporter struct {
+	file *os.File
+}
+
+func newJSONLExporter(config ExporterConfig) (*jsonlExporter, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("jsonl exporter needs a Path")
+	}
+	file, err := os.OpenFile(config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlExporter{file: file}, nil
+}
+
+func (x *jsonlExporter) write(records []exportRecord) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := encoder.Encode(rec); err != nil {
+			return err
+		}
+	}
+	_, err := x.file.Write(buf.Bytes())
+	return err
+}
+
+func (x *jsonlExporter) close() error {
+	return x.file.Close()
+}
+
+// sqliteSchema creates the table the sqlite exporter inserts records into
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS call_records (
+  kind TEXT NOT NULL,
+  time TEXT NOT NULL,
+  identity TEXT,
+  tool TEXT,
+  backend TEXT,
+  decision TEXT,
+  error TEXT,
+  correlation_id TEXT,
+  duration_seconds REAL
+);
+`
+
+// sqliteExporter inserts records into a SQLite database through the SQLite shell, which keeps the
+// aggregator free of a cgo driver. Each batch is one transaction.
+type sqliteExporter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	in    *bufio.Writer
+}
+
+func newSQLiteExporter(config ExporterConfig) (*sqliteExporter, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("sqlite exporter needs a Path")
+	}
+	command := config.Command
+	if command == "" {
+		command = "sqlite3"
+	}
+	cmd := exec.Command(command, "-batch", config.Path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", command, err)
+	}
+	x := &sqliteExporter{cmd: cmd, stdin: stdin, in: bufio.NewWriter(stdin)}
+	if _, err := x.in.WriteString(sqliteSchema); err == nil {
+		err = x.in.Flush()
+	}
+	if err != nil {
+		_ = x.close()
+		return nil, fmt.Errorf("failed to create the call_records table: %v", err)
+	}
+	return x, nil
+}
+
+func (x *sqliteExporter) write(records []exportRecord) error {
+	x.in.WriteString("BEGIN;\n")
+	for _, rec := range records {
+		fmt.Fprintf(x.in, "INSERT INTO call_records VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s);\n",
+			sqlString(rec.Kind), sqlString(rec.Time.UTC().Format(time.RFC3339Nano)), sqlString(rec.Identity),
+			sqlString(rec.Tool), sqlString(rec.Backend), sqlString(rec.Decision), sqlString(rec.Error),
+			sqlString(rec.CorrelationID), strconv.FormatFloat(rec.DurationSeconds, 'g', -1, 64))
+	}
+	x.in.WriteString("COMMIT;\n")
+	return x.in.Flush()
+}
+
+func (x *sqliteExporter) close() error {
+	_ = x.stdin.Close()
+	return x.cmd.Wait()
+}
+
+// sqlString quotes s as a SQL string literal. NUL bytes, which would end the statement in the
+// shell, are dropped.
+func sqlString(s string) string {
+	s = strings.ReplaceAll(s, "\x00", "")
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// httpExporter posts each batch of records as a JSON array
+type httpExporter struct {
+	config ExporterConfig
+	client *http.Client
+}
+
+func newHTTPExporter(config ExporterConfig) (*httpExporter, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("http exporter needs a URL")
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	if config.Timeout > 0 {
+		client.Timeout = time.Duration(config.Timeout)
+	}
+	return &httpExporter{config: config, client: client}, nil
+}
+
+// write posts the batch, retrying with exponential backoff on transport errors and non-2xx responses
+func (x *httpExporter) write(records []exportRecord) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = x.post(body)
+		if err == nil || attempt >= x.config.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (x *httpExporter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, x.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range x.config.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (x *httpExporter) close() error {
+	return nil
+}
@@ -1,126 +1,5881 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	mcp "github.com/metoro-io/mcp-golang"
+	"github.com/metoro-io/mcp-golang/transport"
 	"github.com/metoro-io/mcp-golang/transport/stdio"
+	"go.uber.org/goleak"
 )
 
-func TestBasicTools(t *testing.T) {
-	// Start the server process
-	cmd := exec.Command("./externalmcp")
-	time.Sleep(5 * time.Second)
+// testBackendEnv makes the test binary act as a backend MCP server instead of running the tests:
+// "serve" serves an echo tool, "exit" exits before answering initialize
+const testBackendEnv = "EXTERNALMCP_TEST_BACKEND"
 
-	stdin, err := cmd.StdinPipe()
+type testGetenvArgs struct {
+	Name string `json:"name"`
+}
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(testBackendEnv) {
+	case "serve":
+		server := mcp.NewServer(newStdioTransport("stdin", os.Stdin, os.Stdout, 0))
+		err := server.RegisterTool("echo", "Echo the message", func(args BenchEchoArgs) (*mcp.ToolResponse, error) {
+			return mcp.NewToolResponse(mcp.NewTextContent(args.Message)), nil
+		})
+		if err == nil {
+			err = server.RegisterTool("getenv", "Return an environment variable", func(args testGetenvArgs) (*mcp.ToolResponse, error) {
+				return mcp.NewToolResponse(mcp.NewTextContent(os.Getenv(args.Name))), nil
+			})
+		}
+		if err == nil {
+			err = server.Serve()
+		}
+		if err != nil {
+			log.Fatalf("Test backend failed: %v", err)
+		}
+		select {}
+	case "exit":
+		os.Exit(1)
+	case "middleware":
+		// Speak the WASM middleware protocol: veto "forbidden" messages and shout the rest
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			var request wasmRequest
+			_ = json.Unmarshal(scanner.Bytes(), &request)
+			response := map[string]interface{}{}
+			if request.Hook == "start" {
+				if request.Arguments["message"] == "forbidden" {
+					response["error"] = "forbidden message"
+				} else {
+					response["arguments"] = map[string]interface{}{"message": strings.ToUpper(request.Arguments["message"].(string))}
+				}
+			}
+			data, _ := json.Marshal(response)
+			fmt.Println(string(data))
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestParseClaudeDesktopConfig(t *testing.T) {
+	data := []byte(`{
+		"mcpServers": {
+			"filesystem": {
+				"command": "npx",
+				"args": ["-y", "@modelcontextprotocol/server-filesystem", "~"],
+				"env": {"DEBUG": "1"}
+			}
+		}
+	}`)
+
+	cfg, err := parseConfig(data)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	server, ok := cfg.MCPStdIOServers["filesystem"]
+	if !ok {
+		t.Fatalf("Expected filesystem server, got %+v", cfg.MCPStdIOServers)
+	}
+	if server.Command != "npx" || len(server.Args) != 3 || server.Env["DEBUG"] != "1" {
+		t.Errorf("Unexpected server config: %+v", server)
+	}
+}
+
+func TestConfigTemplates(t *testing.T) {
+	data := []byte(`{
+		"Templates": {
+			"fs": {"Command": "npx", "Args": ["-y", "@modelcontextprotocol/server-filesystem"], "Env": {"DEBUG": "1", "LEVEL": "info"}, "MaxFrameSize": 1048576},
+			"fs-readonly": {"Extends": "fs", "Env": {"READONLY": "1"}}
+		},
+		"MCPStdIOServers": {
+			"docs": {"Extends": "fs-readonly", "Args": ["-y", "@modelcontextprotocol/server-filesystem", "/srv/docs"], "Env": {"LEVEL": "debug", "DEBUG": null}},
+			"plain": {"Command": "memory"}
+		}
+	}`)
+	cfg, err := parseConfig(data)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	docs := cfg.MCPStdIOServers["docs"]
+	if docs.Command != "npx" || len(docs.Args) != 3 || docs.MaxFrameSize != 1048576 {
+		t.Errorf("Expected the template's settings to be inherited, got %+v", docs)
+	}
+	if !reflect.DeepEqual(docs.Env, map[string]string{"LEVEL": "debug", "READONLY": "1"}) {
+		t.Errorf("Expected env to be merged key by key, got %v", docs.Env)
+	}
+	if plain := cfg.MCPStdIOServers["plain"]; plain.Command != "memory" || plain.Env != nil {
+		t.Errorf("Expected servers without a template to be untouched, got %+v", plain)
+	}
+
+	for _, broken := range []string{
+		`{"Templates": {"a": {"Extends": "b"}, "b": {"Extends": "a"}}, "MCPStdIOServers": {"s": {"Extends": "a"}}}`,
+		`{"Templates": {}, "MCPStdIOServers": {"s": {"Extends": "missing"}}}`,
+	} {
+		if _, err := parseConfig([]byte(broken)); err == nil {
+			t.Errorf("Expected %s to be refused", broken)
+		}
+	}
+}
+
+func TestConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	location := filepath.Join(dir, "mcp.json")
+	files := map[string]string{
+		"mcp.json":          `{"Templates": {"fs": {"Command": "npx"}}, "MCPStdIOServers": {"memory": {"Command": "memory"}}}`,
+		"mcp.d/docs.json":   `{"Extends": "fs", "Args": ["/srv/docs"]}`,
+		"mcp.d/.draft.json": `{"Command": "ignored"}`,
+		"mcp.d/README.md":   "not a server",
+	}
+	if err := os.Mkdir(configDir(location), 0o755); err != nil {
+		t.Fatalf("Failed to create config dir: %v", err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	cfg, err := resolveConfig(location)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if len(cfg.MCPStdIOServers) != 2 || cfg.MCPStdIOServers["docs"].Command != "npx" || cfg.MCPStdIOServers["memory"].Command != "memory" {
+		t.Errorf("Expected the servers of mcp.d to be merged and expanded, got %+v", cfg.MCPStdIOServers)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "mcp.d", "memory.json"), []byte(`{"Command": "other"}`), 0o644); err != nil {
+		t.Fatalf("Failed to write server: %v", err)
+	}
+	if _, err := resolveConfig(location); err == nil {
+		t.Error("Expected a server defined twice to be refused")
+	}
+}
+
+func TestConfigIncludes(t *testing.T) {
+	org := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"MaxFrameSize": 4, "MCPStdIOServers": {"search": {"Command": "search", "Env": {"REGION": "eu", "LEVEL": "info"}}}}`))
+	}))
+	defer org.Close()
+	dir := t.TempDir()
+	files := map[string]string{
+		"mcp.json":         `{"Include": ["base/team.json", "` + org.URL + `/org.json"], "MCPStdIOServers": {"search": {"Env": {"LEVEL": "debug"}}, "notes": {"Command": "notes"}}}`,
+		"base/team.json":   `{"Include": "shared.json", "MCPStdIOServers": {"memory": {"Command": "memory"}}}`,
+		"base/shared.json": `{"MaxFrameSize": 2}`,
+		"loop/a.json":      `{"Include": "b.json"}`,
+		"loop/b.json":      `{"Include": ["../loop/a.json"]}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	cfg, err := resolveConfig(filepath.Join(dir, "mcp.json"))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if len(cfg.MCPStdIOServers) != 3 || cfg.MCPStdIOServers["memory"].Command != "memory" {
+		t.Errorf("Expected the servers of every fragment, got %+v", cfg.MCPStdIOServers)
+	}
+	if search := cfg.MCPStdIOServers["search"]; search.Command != "search" || !reflect.DeepEqual(search.Env, map[string]string{"REGION": "eu", "LEVEL": "debug"}) {
+		t.Errorf("Expected the including config to override its includes, got %+v", search)
+	}
+	if cfg.MaxFrameSize != 4 {
+		t.Errorf("Expected later includes to override earlier ones, got %d", cfg.MaxFrameSize)
+	}
+	if _, err := resolveConfig(filepath.Join(dir, "loop", "a.json")); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Expected an include cycle to be refused, got %v", err)
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	strict := true
+	cfg := Config{
+		MCPStdIOServers: map[string]MCPStdIOConfig{
+			"memory":     {Command: "npx"},
+			"filesystem": {Command: "npx"},
+		},
+		Profiles: map[string]Profile{
+			"minimal": {Servers: []string{"memory"}, Policy: &PolicyConfig{URL: "http://opa"}, StrictRouting: &strict},
+			"broken":  {Servers: []string{"missing"}},
+		},
+		Policy: &PolicyConfig{URL: "http://default-opa"},
+	}
+
+	minimal, err := applyProfile(cfg, "minimal")
+	if err != nil {
+		t.Fatalf("Failed to apply profile: %v", err)
+	}
+	if _, ok := minimal.MCPStdIOServers["memory"]; !ok || len(minimal.MCPStdIOServers) != 1 {
+		t.Errorf("Unexpected servers for minimal profile: %+v", minimal.MCPStdIOServers)
+	}
+	if minimal.Policy.URL != "http://opa" || !minimal.StrictRouting {
+		t.Errorf("Expected the profile's policies, got %+v and strict %v", minimal.Policy, minimal.StrictRouting)
+	}
+
+	if _, err := applyProfile(cfg, "broken"); err == nil {
+		t.Error("Expected error for profile referencing an unknown server")
+	}
+
+	all, err := applyProfile(cfg, "")
+	if err != nil || len(all.MCPStdIOServers) != 2 {
+		t.Errorf("Expected all servers without a profile, got %+v (%v)", all.MCPStdIOServers, err)
+	}
+	if all.Policy.URL != "http://default-opa" || all.StrictRouting {
+		t.Errorf("Expected the config's policies without a profile, got %+v and strict %v", all.Policy, all.StrictRouting)
+	}
+}
+
+func TestProfileSwitch(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query struct {
+			Input policyInput `json:"input"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&query)
+		fmt.Fprintf(w, `{"result": %v}`, query.Input.Tool != "getenv" && r.Header.Get("Authorization") == "Bearer opa-token")
+	}))
+	defer opa.Close()
+
+	// The placeholders of a profile's policy are resolved like the config's own
+	t.Setenv("TEST_OPA_AUTHORIZATION", "Bearer opa-token")
+	strict := true
+	serve := MCPStdIOConfig{Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve"}}
+	file := Config{
+		MCPStdIOServers: map[string]MCPStdIOConfig{"tools": serve, "extra": serve},
+		Profiles: map[string]Profile{
+			"dev":    {Servers: []string{"tools", "extra"}},
+			"prod":   {Servers: []string{"tools"}, Policy: &PolicyConfig{URL: opa.URL, Headers: map[string]string{"Authorization": "${TEST_OPA_AUTHORIZATION}"}}, StrictRouting: &strict},
+			"broken": {Servers: []string{"missing"}},
+		},
+		DefaultProfile: "dev",
+	}
+	data, _ := json.Marshal(file)
+	path := filepath.Join(t.TempDir(), "mcp.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := loadProfileConfig(path, "")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	rt := newBenchRouter(t, 0)
+	defer rt.registry.shutdown()
+	if err := rt.registry.apply(cfg); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	rt.profiles = newProfileSwitch(path, "", rt.registry, newApprovalQueue())
+	post := func(query string, header bool) int {
+		req := httptest.NewRequest(http.MethodPost, "/profile?"+query, nil)
+		if header {
+			req.Header.Set(profileHeader, "1")
+		}
+		w := httptest.NewRecorder()
+		rt.profiles.ServeHTTP(w, req)
+		return w.Code
+	}
+	getenv := map[string]interface{}{"name": "HOME"}
+	if _, err := rt.call(context.Background(), "getenv", getenv); err != nil {
+		t.Fatalf("Expected the dev profile to allow getenv, got %v", err)
+	}
+
+	if code := post("name=prod", false); code != http.StatusForbidden {
+		t.Errorf("Expected a switch without the header to be refused, got %d", code)
+	}
+	if code := post("name=prod", true); code != http.StatusNoContent {
+		t.Fatalf("Expected the switch to prod to succeed, got %d", code)
+	}
+	if rt.registry.named("extra") != nil || rt.registry.named("tools") == nil {
+		t.Error("Expected only the servers of prod to run")
+	}
+	if _, err := rt.call(context.Background(), "getenv", getenv); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Expected the policy of prod to deny getenv, got %v", err)
+	}
+	if _, err := rt.call(context.Background(), "echo", map[string]interface{}{"message": "hi"}); err != nil {
+		t.Errorf("Expected the policy of prod to allow echo with its resolved header, got %v", err)
+	}
+	if _, err := rt.call(context.Background(), "missing", nil); err == nil || !strings.Contains(err.Error(), "unknown tool") {
+		t.Errorf("Expected prod to route strictly, got %v", err)
+	}
+
+	// A profile that cannot be applied leaves the selected one in place
+	if code := post("name=broken", true); code != http.StatusConflict {
+		t.Errorf("Expected the switch to a broken profile to fail, got %d", code)
+	}
+	w := httptest.NewRecorder()
+	rt.profiles.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/profile", nil))
+	var status profileStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil || status.Profile != "prod" || !reflect.DeepEqual(status.Profiles, []string{"broken", "dev", "prod"}) {
+		t.Errorf("Expected prod to stay selected, got %+v (%v)", status, err)
+	}
+
+	// Reloads keep the profile switched to
+	if err := rt.profiles.reload(); err != nil || rt.registry.named("extra") != nil {
+		t.Errorf("Expected a reload to keep prod, got %v", err)
+	}
+	if code := post("name=dev", true); code != http.StatusNoContent || rt.registry.named("extra") == nil {
+		t.Errorf("Expected the switch back to dev to start its servers, got %d", code)
+	}
+	if _, err := rt.call(context.Background(), "getenv", getenv); err != nil {
+		t.Errorf("Expected dev to allow getenv again, got %v", err)
+	}
+
+	// Policies changed in the config reach the router when it is polled
+	current, _ := loadProfileConfig(path, "dev")
+	file.Profiles["dev"] = Profile{Servers: []string{"tools", "extra"}, StrictRouting: &strict}
+	data, _ = json.Marshal(file)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if refreshed := refreshConfig(rt.profiles, current); !refreshed.StrictRouting {
+		t.Error("Expected the changed config to be returned")
+	}
+	if _, err := rt.call(context.Background(), "missing", nil); err == nil || !strings.Contains(err.Error(), "unknown tool") {
+		t.Errorf("Expected the polled config to turn on strict routing, got %v", err)
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "api_key")
+	if err := os.WriteFile(secretFile, []byte("file-secret\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" || r.URL.Path != "/v1/secret/data/mcp" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data": {"data": {"api_key": "vault-secret"}, "metadata": {"version": 1}}}`))
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "test-token")
+
+	cfg := Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"search": {Env: map[string]string{
+			"FILE_KEY":  "${secret:file:" + secretFile + "}",
+			"VAULT_KEY": "${secret:vault:secret/data/mcp#api_key}",
+		}},
+	}}
+	if err := resolveEnvVariables(&cfg); err != nil {
+		t.Fatalf("Failed to resolve secrets: %v", err)
+	}
+
+	env := cfg.MCPStdIOServers["search"].Env
+	if env["FILE_KEY"] != "file-secret" || env["VAULT_KEY"] != "vault-secret" {
+		t.Errorf("Unexpected resolved env: %+v", env)
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	authz := newAuthorizer(&AuthConfig{
+		Tokens: []TokenConfig{{Token: "reader-token", Identity: "reader", Roles: []string{"read"}}},
+		Roles:  map[string]RoleConfig{"read": {Tools: []string{"read_*", "list_directory"}}},
+	})
+
+	reader, ok := authz.authenticate("reader-token")
+	if !ok || reader.Name != "reader" {
+		t.Fatalf("Expected reader identity, got %+v (%v)", reader, ok)
+	}
+	if _, ok := authz.authenticate("wrong-token"); ok {
+		t.Error("Expected unknown token to be rejected")
+	}
+
+	ctx := contextWithIdentity(context.Background(), reader)
+	if err := authz.authorize(ctx, "read_file"); err != nil {
+		t.Errorf("Expected read_file to be allowed: %v", err)
+	}
+	if err := authz.authorize(ctx, "write_file"); err == nil {
+		t.Error("Expected write_file to be denied")
+	}
+
+	var nilAuthz *authorizer
+	if err := nilAuthz.authorize(context.Background(), "write_file"); err != nil {
+		t.Errorf("Expected everything to be allowed without auth config: %v", err)
+	}
+}
+
+func TestHMACVerifier(t *testing.T) {
+	verifier := newHMACVerifier(&HMACConfig{Callers: map[string]string{"gateway": "shared-secret"}})
+	now := time.Now()
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+
+	signedRequest := func(nonce string, at time.Time, payload []byte) *http.Request {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("X-MCP-Caller", "gateway")
+		r.Header.Set("X-MCP-Timestamp", timestamp)
+		r.Header.Set("X-MCP-Nonce", nonce)
+		r.Header.Set("X-MCP-Signature", hex.EncodeToString(verifier.signature([]byte("shared-secret"), timestamp, nonce, payload)))
+		return r
+	}
+
+	if reason := verifier.verify(signedRequest("n1", now, body), body, now); reason != "" {
+		t.Errorf("Expected valid signature, got %q", reason)
+	}
+	if reason := verifier.verify(signedRequest("n1", now, body), body, now); reason != "replayed nonce" {
+		t.Errorf("Expected replay to be rejected, got %q", reason)
+	}
+	if reason := verifier.verify(signedRequest("n2", now, body), []byte(`{"tampered":true}`), now); reason != "invalid signature" {
+		t.Errorf("Expected tampered body to be rejected, got %q", reason)
+	}
+	if reason := verifier.verify(signedRequest("n3", now.Add(-time.Hour), body), body, now); reason != "timestamp outside the allowed window" {
+		t.Errorf("Expected stale timestamp to be rejected, got %q", reason)
+	}
+}
+
+func TestSessionContextInjection(t *testing.T) {
+	sessions := newSessionStore()
+	sessions.set("alice", map[string]string{"workspace_root": "/home/alice/project"})
+	injections := []ContextInjection{{Tools: []string{"list_*"}, Fields: map[string]string{"path": "workspace_root"}}}
+
+	args := sessions.inject("alice", "list_directory", map[string]interface{}{}, injections)
+	if got := args.(map[string]interface{})["path"]; got != "/home/alice/project" {
+		t.Errorf("Expected injected path, got %v", got)
+	}
+
+	args = sessions.inject("alice", "list_directory", map[string]interface{}{"path": "/tmp"}, injections)
+	if got := args.(map[string]interface{})["path"]; got != "/tmp" {
+		t.Errorf("Expected caller-provided path to be kept, got %v", got)
+	}
+
+	args = sessions.inject("alice", "read_file", map[string]interface{}{}, injections)
+	if _, ok := args.(map[string]interface{})["path"]; ok {
+		t.Error("Expected no injection for tools outside the configured patterns")
+	}
+
+	args = sessions.inject("bob", "list_directory", map[string]interface{}{}, injections)
+	if _, ok := args.(map[string]interface{})["path"]; ok {
+		t.Error("Expected no injection for a session without context")
+	}
+
+	// Another identity presenting the same session id, or the identity's name, sees none of it
+	rt := newBenchRouter(t, 0)
+	alice := contextWithSession(contextWithIdentity(context.Background(), identity{Name: "alice"}), "s1")
+	setContext := handleSetContext(rt).(func(context.Context, SetContextRequest) (*mcp.ToolResponse, error))
+	if _, err := setContext(alice, SetContextRequest{Context: map[string]string{"workspace_root": "/home/alice"}}); err != nil {
+		t.Fatalf("Set context failed: %v", err)
+	}
+	bob := contextWithIdentity(context.Background(), identity{Name: "bob"})
+	for _, ctx := range []context.Context{contextWithSession(bob, "s1"), contextWithSession(bob, "alice")} {
+		args, _ := rt.sessions.inject(sessionScope(ctx), "list_directory", nil, injections).(map[string]interface{})
+		if path, ok := args["path"]; ok {
+			t.Errorf("Expected bob not to see alice's context, got %v", path)
+		}
+		if _, err := setContext(ctx, SetContextRequest{Context: map[string]string{"workspace_root": "/home/bob"}}); err != nil {
+			t.Fatalf("Set context failed: %v", err)
+		}
+	}
+	if got := rt.sessions.inject(sessionScope(alice), "list_directory", nil, injections).(map[string]interface{})["path"]; got != "/home/alice" {
+		t.Errorf("Expected alice's context to be left alone, got %v", got)
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2024, time.January, 31, 22, 17, 30, 0, time.UTC)
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.January, 31, 22, 18, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2024, time.January, 31, 23, 0, 0, 0, time.UTC)},
+		{"*/15 9-17 * * 1-5", time.Date(2024, time.February, 1, 9, 0, 0, 0, time.UTC)},
+		{"30 6 1 * *", time.Date(2024, time.February, 1, 6, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		cron, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("Failed to parse '%s': %v", c.expr, err)
+		}
+		if got := cron.next(from); !got.Equal(c.want) {
+			t.Errorf("next('%s') = %v, want %v", c.expr, got, c.want)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("Expected error for '%s'", expr)
+		}
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	received := make(chan string, 4)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- r.Header.Get("X-Team") + " " + string(body)
+	}))
+	defer server.Close()
+
+	webhooks, err := newWebhookDispatcher([]WebhookConfig{{
+		URL:      server.URL,
+		Tools:    []string{"write_*"},
+		Events:   []string{"failure"},
+		Headers:  map[string]string{"X-Team": "ops"},
+		Template: `{"text": {{json .Tool}}, "error": {{json .Error}}}`,
+		Retries:  1,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create dispatcher: %v", err)
+	}
+
+	webhooks.fire(toolCallEvent{Event: "failure", Tool: "read_file", Error: "ignored"})
+	webhooks.fire(toolCallEvent{Event: "success", Tool: "write_file"})
+	webhooks.fire(toolCallEvent{Event: "failure", Tool: "write_file", Error: `disk "full"`})
+
+	select {
+	case got := <-received:
+		want := `ops {"text": "write_file", "error": "disk \"full\""}`
+		if got != want {
+			t.Errorf("Unexpected webhook delivery %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook delivery")
+	}
+	if attempts != 2 {
+		t.Errorf("Expected one retry, got %d attempts", attempts)
+	}
+}
+
+func TestAsyncJobs(t *testing.T) {
+	rt := &router{
+		registry: newBackendRegistry(mcp.ClientInfo{Name: "test", Version: "1.0.0"}),
+		audit:    &auditLogger{},
+		sessions: newSessionStore(),
+		jobs:     newMemoryJobStore(),
+	}
+	alice := contextWithIdentity(context.Background(), identity{Name: "alice"})
+
+	started, err := rt.startJob(alice, "missing_tool", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("Failed to start job: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j, err := rt.lookupJob(alice, started.ID)
+		if err != nil {
+			t.Fatalf("Failed to look up job: %v", err)
+		}
+		if j.State == jobSucceeded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Job did not finish, state %s", j.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bob := contextWithIdentity(context.Background(), identity{Name: "bob"})
+	if _, err := rt.lookupJob(bob, started.ID); err == nil {
+		t.Error("Expected jobs to be hidden from other identities")
+	}
+}
+
+func TestFileJobStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileJobStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to open job store: %v", err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	jobs := []job{
+		{ID: "aa01", Tool: "echo", Identity: "alice", State: jobSucceeded, Finished: old},
+		{ID: "bb02", Tool: "echo", Identity: "alice", State: jobFailed, Finished: time.Now()},
+		{ID: "cc03", Tool: "echo", Identity: "alice", State: jobRunning},
+	}
+	for _, j := range jobs {
+		if err := store.put(j); err != nil {
+			t.Fatalf("Failed to store job: %v", err)
+		}
+	}
+
+	// Reopen the directory as a restarted process would
+	reopened, err := newFileJobStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen job store: %v", err)
+	}
+	if j, ok, err := reopened.get("cc03"); err != nil || !ok || j.State != jobRunning {
+		t.Errorf("Expected running job to survive reopening, got %+v %v %v", j, ok, err)
+	}
+	if _, ok, _ := reopened.get("../etc/passwd"); ok {
+		t.Error("Expected job ids outside the store to be rejected")
+	}
+
+	removed, err := pruneFinishedJobs(reopened, time.Now().Add(-24*time.Hour))
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected one pruned job, got %d (%v)", removed, err)
+	}
+	remaining, _ := reopened.list()
+	if len(remaining) != 2 {
+		t.Errorf("Expected 2 remaining jobs, got %d", len(remaining))
+	}
+}
+
+func TestArtifactOffload(t *testing.T) {
+	server := mcp.NewServer(stdio.NewStdioServerTransport())
+	artifacts := newArtifactStore(server, &ArtifactsConfig{Threshold: 64})
+
+	small := mcp.NewToolResponse(mcp.NewTextContent("short"))
+	if got := artifacts.offload("echo", small); got != small {
+		t.Error("Expected small responses to pass through")
+	}
+
+	large := mcp.NewToolResponse(mcp.NewTextContent(strings.Repeat("x", 500)))
+	summary := responseText(artifacts.offload("echo", large))
+	start := strings.Index(summary, artifactResourcePrefix)
+	if start < 0 {
+		t.Fatalf("Expected summary to reference an artifact, got %q", summary)
+	}
+	uri := strings.Fields(summary[start:])[0]
+	if !server.CheckResourceRegistered(uri) {
+		t.Errorf("Expected artifact %s to be registered", uri)
+	}
+	if strings.Count(summary, "x") > 64 {
+		t.Errorf("Expected summary to be cut to the threshold, got %d bytes", len(summary))
+	}
+}
+
+func TestSummarizer(t *testing.T) {
+	server := mcp.NewServer(stdio.NewStdioServerTransport())
+	rt := newBenchRouter(t, 1)
+	rt.summarizer = newSummarizer(&SummarizerConfig{Threshold: 10, Command: "sh", Args: []string{"-c", "tr x y | head -c 5"}}, server, nil)
+
+	short, err := rt.call(context.Background(), "echo_b0", map[string]interface{}{"message": "hi"})
+	if err != nil || responseText(short) != "hi" {
+		t.Fatalf("Expected short outputs to pass through, got %+v (%v)", short, err)
+	}
+
+	resp, err := rt.call(context.Background(), "echo_b0", map[string]interface{}{"message": strings.Repeat("x", 200)})
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	summary := responseText(resp)
+	if !strings.HasPrefix(summary, "yyyyy\n\n[Summarized:") {
+		t.Fatalf("Expected the command's summary, got %q", summary)
+	}
+	start := strings.Index(summary, artifactResourcePrefix)
+	if start < 0 {
+		t.Fatalf("Expected summary to reference the full output, got %q", summary)
+	}
+	if uri := strings.Fields(summary[start:])[0]; !server.CheckResourceRegistered(uri) {
+		t.Errorf("Expected the full output to be registered as %s", uri)
+	}
+
+	// Without a host to sample from, the full output is returned
+	sampling := newSummarizer(&SummarizerConfig{Threshold: 10}, server, nil)
+	large := mcp.NewToolResponse(mcp.NewTextContent(strings.Repeat("x", 200)))
+	if got := sampling.summarize(context.Background(), "echo", large); got != large {
+		t.Errorf("Expected the output to pass through when no host can summarize it, got %+v", got)
+	}
+}
+
+// serveFakeRedis answers the commands the aggregator sends Redis from in-memory maps, ignoring expiry
+func serveFakeRedis(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	values := make(map[string]string)
+	hashes := make(map[string]map[string]string)
+	var mu sync.Mutex
+	bulk := func(value string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value) }
+	answer := func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "SET":
+			if len(args) > 3 && args[3] == "NX" {
+				if _, ok := values[args[1]]; ok {
+					return "$-1\r\n"
+				}
+			}
+			values[args[1]] = args[2]
+			return "+OK\r\n"
+		case "GET":
+			if value, ok := values[args[1]]; ok {
+				return bulk(value)
+			}
+			return "$-1\r\n"
+		case "INCRBYFLOAT":
+			current, _ := strconv.ParseFloat(values[args[1]], 64)
+			by, _ := strconv.ParseFloat(args[2], 64)
+			values[args[1]] = strconv.FormatFloat(current+by, 'f', -1, 64)
+			return bulk(values[args[1]])
+		case "PEXPIRE":
+			return ":1\r\n"
+		case "HSET":
+			if hashes[args[1]] == nil {
+				hashes[args[1]] = make(map[string]string)
+			}
+			hashes[args[1]][args[2]] = args[3]
+			return ":1\r\n"
+		case "HGET":
+			if value, ok := hashes[args[1]][args[2]]; ok {
+				return bulk(value)
+			}
+			return "$-1\r\n"
+		case "HGETALL":
+			reply := fmt.Sprintf("*%d\r\n", 2*len(hashes[args[1]]))
+			for field, value := range hashes[args[1]] {
+				reply += bulk(field) + bulk(value)
+			}
+			return reply
+		case "HDEL":
+			delete(hashes[args[1]], args[2])
+			return ":1\r\n"
+		default:
+			return "-ERR unknown command\r\n"
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					header, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					count, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+					args := make([]string, count)
+					for i := range args {
+						sizeLine, _ := reader.ReadString('\n')
+						size, _ := strconv.Atoi(strings.TrimSpace(sizeLine[1:]))
+						arg := make([]byte, size+2)
+						_, _ = io.ReadFull(reader, arg)
+						args[i] = string(arg[:size])
+					}
+					_, _ = conn.Write([]byte(answer(args)))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestCache(t *testing.T) {
+	disk, err := newDiskCache(t.TempDir(), systemClock{})
+	if err != nil {
+		t.Fatalf("Failed to open disk cache: %v", err)
+	}
+	stores := map[string]cacheStore{
+		"memory": newMemoryCache(systemClock{}),
+		"disk":   disk,
+		"redis":  &redisCache{client: newRedisClient(RedisConfig{Address: serveFakeRedis(t)})},
+	}
+	for name, store := range stores {
+		if _, ok, err := store.get("missing"); ok || err != nil {
+			t.Errorf("%s: expected a miss for an unknown key, got %v (%v)", name, ok, err)
+		}
+		if err := store.set("key", []byte("value\r\nwith a line break"), time.Minute); err != nil {
+			t.Fatalf("%s: failed to set: %v", name, err)
+		}
+		if value, ok, err := store.get("key"); !ok || err != nil || string(value) != "value\r\nwith a line break" {
+			t.Errorf("%s: expected the stored value, got %q %v (%v)", name, value, ok, err)
+		}
+	}
+	for _, store := range []cacheStore{newMemoryCache(systemClock{}), disk} {
+		_ = store.set("expired", []byte("old"), -time.Second)
+		if _, ok, _ := store.get("expired"); ok {
+			t.Error("Expected expired entries to be missed")
+		}
+	}
+	if _, err := openCacheStore(&CacheConfig{Backend: "memcached"}, systemClock{}); err == nil {
+		t.Error("Expected unknown backends to be rejected")
+	}
+
+	// Results of cached tools are answered from the cache, per caller
+	rt := newBenchRouter(t, 1)
+	rt.cache, _ = newToolCache(&CacheConfig{Results: []ResultCacheRule{{Tools: []string{"echo_*"}, TTL: Duration(time.Minute)}}}, systemClock{})
+	args := map[string]interface{}{"message": "hello"}
+	if _, err := rt.call(context.Background(), "echo_b0", args); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	cached := rt.cache.result(context.Background(), "b0", "echo_b0", args)
+	if cached == nil || responseText(cached) != "hello" {
+		t.Fatalf("Expected the result to be cached, got %+v", cached)
+	}
+	rt.cache.storeResult(context.Background(), "b0", "echo_b0", args, mcp.NewToolResponse(mcp.NewTextContent("from cache")))
+	resp, err := rt.call(context.Background(), "echo_b0", args)
+	if err != nil || responseText(resp) != "from cache" {
+		t.Errorf("Expected the call to be answered from the cache, got %+v (%v)", resp, err)
+	}
+	other := contextWithIdentity(context.Background(), identity{Name: "other"})
+	if resp, _ := rt.call(other, "echo_b0", args); resp == nil || responseText(resp) != "hello" {
+		t.Errorf("Expected other callers not to share the cached result, got %+v", resp)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	redis := RedisConfig{Address: serveFakeRedis(t)}
+	serving := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			_, _ = fmt.Fprintf(w, "%s:%s", name, body)
+		})
+	}
+	var b *cluster
+	serverB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.middleware(serving("b")).ServeHTTP(w, r)
+	}))
+	a, err := newCluster(&ClusterConfig{Redis: redis, Advertise: "http://a.example:8080"})
+	if err != nil {
+		t.Fatalf("Failed to set up cluster: %v", err)
+	}
+	if b, err = newCluster(&ClusterConfig{Redis: redis, Advertise: serverB.URL}); err != nil {
+		t.Fatalf("Failed to set up cluster: %v", err)
+	}
+	if _, err := newCluster(&ClusterConfig{Redis: redis}); err == nil {
+		t.Error("Expected clusters without an advertised URL to be rejected")
+	}
+
+	post := func(session string) string {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("ping"))
+		if session != "" {
+			req.Header.Set("Mcp-Session-Id", session)
+		}
+		w := httptest.NewRecorder()
+		a.middleware(serving("a")).ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	if _, err := b.claim("s1"); err != nil {
+		t.Fatalf("Failed to claim session: %v", err)
+	}
+	if got := post("s1"); got != "b:ping" {
+		t.Errorf("Expected the session to be forwarded to its instance, got %q", got)
+	}
+	if got := post("s2"); got != "a:ping" {
+		t.Errorf("Expected a new session to be served where it arrived, got %q", got)
+	}
+	if got := post(""); got != "a:ping" {
+		t.Errorf("Expected requests without a session to be served where they arrived, got %q", got)
+	}
+	serverB.Close()
+	if got := post("s1"); got != "a:ping" {
+		t.Errorf("Expected the session of a stopped instance to be taken over, got %q", got)
+	}
+	if owner, _ := b.claim("s1"); owner != a.advertise {
+		t.Errorf("Expected the session to now be served by %s, got %s", a.advertise, owner)
+	}
+
+	// Quotas are charged against the usage of every instance
+	for _, c := range []*cluster{a, b} {
+		if charged, err := c.spend("2026-01", "alice", 1, 2, true); !charged || err != nil {
+			t.Errorf("Expected the call to be charged, got %v (%v)", charged, err)
+		}
+	}
+	if _, err := a.spend("2026-01", "alice", 1, 2, true); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Errorf("Expected the shared quota to be exceeded, got %v", err)
+	}
+
+	// Jobs started on one instance can be looked up on another
+	if err := a.jobStore().put(job{ID: "j1", Tool: "echo", State: jobRunning, Instance: a.instance()}); err != nil {
+		t.Fatalf("Failed to store job: %v", err)
+	}
+	if j, ok, err := b.jobStore().get("j1"); !ok || err != nil || j.Instance != a.advertise {
+		t.Errorf("Expected the job of the other instance, got %+v %v (%v)", j, ok, err)
+	}
+	if jobs, err := b.jobStore().list(); err != nil || len(jobs) != 1 {
+		t.Errorf("Expected one job, got %+v (%v)", jobs, err)
+	}
+	_ = b.jobStore().remove("j1")
+	if _, ok, _ := a.jobStore().get("j1"); ok {
+		t.Error("Expected the job to be removed")
+	}
+}
+
+func TestBusBridge(t *testing.T) {
+	if _, err := startBusBridge(nil, &BusConfig{URL: "amqp://localhost", Subject: "calls"}); err == nil {
+		t.Error("Expected AMQP URLs to be rejected")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	rt := newBenchRouter(t, 1)
+	bus, err := startBusBridge(rt, &BusConfig{URL: "nats://secret@" + listener.Addr().String(), Subject: "calls", Responses: "results"})
+	if err != nil {
+		t.Fatalf("Failed to start bridge: %v", err)
+	}
+	defer bus.close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	_, _ = conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+	var greeting []string
+	for len(greeting) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read the client's greeting: %v", err)
+		}
+		greeting = append(greeting, strings.TrimSpace(line))
+	}
+	if !strings.Contains(greeting[0], `"auth_token":"secret"`) || greeting[1] != "SUB calls mcp-aggregator 1" || greeting[2] != "PING" {
+		t.Fatalf("Unexpected greeting %q", greeting)
+	}
+
+	read := func() (string, string) {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		fields := strings.Fields(header)
+		size, _ := strconv.Atoi(fields[len(fields)-1])
+		payload := make([]byte, size+2)
+		_, _ = io.ReadFull(reader, payload)
+		return fields[1], string(payload[:size])
+	}
+	request := `{"id":"1","tool":"echo_b0","arguments":{"message":"hi"}}`
+	_, _ = fmt.Fprintf(conn, "PING\r\nMSG calls 1 inbox.1 %d\r\n%s\r\n", len(request), request)
+	if pong, _ := reader.ReadString('\n'); pong != "PONG\r\n" {
+		t.Errorf("Expected the client to answer pings, got %q", pong)
+	}
+	subject, payload := read()
+	if subject != "inbox.1" || !strings.Contains(payload, `"id":"1"`) || !strings.Contains(payload, `"text":"hi"`) {
+		t.Errorf("Expected the response on the reply subject, got %s %s", subject, payload)
+	}
+
+	_, _ = fmt.Fprintf(conn, "MSG calls 1 %d\r\nnot json\r\n", len("not json"))
+	subject, payload = read()
+	if subject != "results" || !strings.Contains(payload, "invalid request") {
+		t.Errorf("Expected invalid requests to be answered on the responses subject, got %s %s", subject, payload)
+	}
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	large := strings.Repeat(`{"text":"directory listing"}`, 100)
+	handler := compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "ping" {
+			t.Errorf("Expected decompressed request body, got %q", body)
+		}
+		_, _ = w.Write([]byte(large))
+	}))
+
+	var request bytes.Buffer
+	zw := gzip.NewWriter(&request)
+	_, _ = zw.Write([]byte("ping"))
+	_ = zw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/", &request)
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "br;q=1.0, gzip;q=0.8")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip response, got headers %v", rec.Header())
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Invalid gzip response: %v", err)
+	}
+	body, _ := io.ReadAll(zr)
+	if string(body) != large {
+		t.Error("Decompressed response does not match")
+	}
+
+	if got := acceptedEncoding("gzip;q=0, deflate"); got != "deflate" {
+		t.Errorf("Expected deflate when gzip is refused, got %q", got)
+	}
+
+	// deflate is zlib-wrapped both ways
+	request.Reset()
+	zlw := zlib.NewWriter(&request)
+	_, _ = zlw.Write([]byte("ping"))
+	_ = zlw.Close()
+	req = httptest.NewRequest(http.MethodPost, "/", &request)
+	req.Header.Set("Content-Encoding", "deflate")
+	req.Header.Set("Accept-Encoding", "deflate")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "deflate" {
+		t.Fatalf("Expected deflate response, got headers %v", rec.Header())
+	}
+	zlr, err := zlib.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Invalid deflate response: %v", err)
+	}
+	if body, _ := io.ReadAll(zlr); string(body) != large {
+		t.Error("Decompressed deflate response does not match")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("raw flate"))
+	req.Header.Set("Content-Encoding", "deflate")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a deflate body without a zlib header to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestStdioTransportFraming(t *testing.T) {
+	in, writer := io.Pipe()
+	var out bytes.Buffer
+	tr := newStdioTransport("test", in, &out, 1024)
+	received := make(chan *transport.BaseJsonRpcMessage, 4)
+	tr.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		received <- message
+	})
+	if err := tr.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+
+	// Messages spanning several reads arrive intact
+	text := strings.Repeat("abcdefghij", 90)
+	go func() {
+		_, _ = writer.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"text":"` + text + `"}}` + "\n"))
+		_, _ = writer.Write([]byte(`{"jsonrpc":"2.0","id":2,"result":{"text":"` + text + text + `"}}` + "\n"))
+		_, _ = writer.Write([]byte(`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"text":"` + text + text + `"}}` + "\n"))
+		_, _ = writer.Write([]byte(`{"jsonrpc":"2.0","method":"notifications/initialized"}` + "\n"))
+	}()
+
+	first := <-received
+	if first.Type != transport.BaseMessageTypeJSONRPCResponseType || !strings.Contains(string(first.JsonRpcResponse.Result), text) {
+		t.Fatalf("Expected intact response, got %+v", first)
+	}
+
+	// An oversized response is replaced by an error for its id
+	second := <-received
+	if second.Type != transport.BaseMessageTypeJSONRPCErrorType || second.JsonRpcError.Id != 2 {
+		t.Fatalf("Expected error response for id 2, got %+v", second)
+	}
+
+	// An oversized request is answered directly and the stream continues
+	third := <-received
+	if third.Type != transport.BaseMessageTypeJSONRPCNotificationType {
+		t.Fatalf("Expected notification after oversized request, got %+v", third)
+	}
+	if !strings.Contains(out.String(), `"id":3`) || !strings.Contains(out.String(), "exceeds the maximum frame size") {
+		t.Errorf("Expected error reply for oversized request, got %q", out.String())
+	}
+}
+
+func TestStdoutNoise(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	read := func(strict bool, lines ...string) []*transport.BaseJsonRpcMessage {
+		tr := newStdioTransport("noisy", strings.NewReader(strings.Join(lines, "\n")+"\n"), io.Discard, 0)
+		tr.strict = strict
+		var received []*transport.BaseJsonRpcMessage
+		closed := make(chan struct{})
+		tr.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+			received = append(received, message)
+		})
+		tr.SetCloseHandler(func() { close(closed) })
+		if err := tr.Start(context.Background()); err != nil {
+			t.Fatalf("Failed to start transport: %v", err)
+		}
+		<-closed
+		return received
+	}
+
+	// Stray prints are skipped, and a message printed right after one on the same line is kept
+	received := read(false,
+		"Starting server v1.2...",
+		`{"jsonrpc":"2.0","id":1,"result":{}}`,
+		`debug: ready{"jsonrpc":"2.0","id":2,"result":{}}`,
+		`{"not":"a message"}`,
+		`{"jsonrpc":"2.0","id":3,"result":{}}`,
+	)
+	if len(received) != 3 || received[1].JsonRpcResponse.Id != 2 || received[2].JsonRpcResponse.Id != 3 {
+		t.Fatalf("Expected the three responses around the noise, got %d messages", len(received))
+	}
+	if !strings.Contains(logs.String(), `Ignored output of noisy that is not a protocol message: "Starting server v1.2..."`) ||
+		!strings.Contains(logs.String(), `"debug: ready"`) {
+		t.Errorf("Expected the noise to be logged, got %s", logs.String())
+	}
+
+	// In strict mode the first stray line ends the connection
+	received = read(true,
+		`{"jsonrpc":"2.0","id":1,"result":{}}`,
+		"Starting server v1.2...",
+		`{"jsonrpc":"2.0","id":2,"result":{}}`,
+	)
+	if len(received) != 1 {
+		t.Errorf("Expected the connection closed at the noise, got %d messages", len(received))
+	}
+	if !strings.Contains(logs.String(), "Closing connection to noisy") {
+		t.Errorf("Expected the closing to be logged, got %s", logs.String())
+	}
+}
+
+func TestTextNormalization(t *testing.T) {
+	n := &TextNormalization{}
+	if got := n.normalize("\ufeffcaf\xe9 \x1b[31mred\x1b[0m\tok\r\n"); got != "caf\ufffd \\x1b[31mred\\x1b[0m\tok\r\n" {
+		t.Errorf("Unexpected normalized text %q", got)
+	}
+	kept := &TextNormalization{KeepBOM: true, KeepControlCharacters: true}
+	if got := kept.normalize("\ufeff\x1b[0m"); got != "\ufeff\x1b[0m" {
+		t.Errorf("Expected the BOM and control characters kept, got %q", got)
+	}
+
+	// Results of a normalizing server are decoded rather than relayed as they are
+	rt := newBenchRouter(t, 1)
+	rt.registry.backends["b0"].config.Normalize = n
+	ctx := contextWithPassthrough(context.Background(), rt.raw, 0)
+	resp, err := rt.call(ctx, "echo_b0", map[string]interface{}{"message": "\ufeff\x1b[1mbold"})
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if got := responseText(resp); got != `\x1b[1mbold` {
+		t.Errorf("Expected the normalized text, got %q", got)
+	}
+}
+
+func TestSizeAnnotations(t *testing.T) {
+	in := strings.NewReader(`{"jsonrpc":"2.0","id":4,"method":"tools/call","params":{"name":"echo","arguments":{}}}` + "\n")
+	var out bytes.Buffer
+	annotator := newSizeAnnotator(newStdioTransport("host", in, &out, 0), &SizeAnnotationConfig{}).(*sizeAnnotator)
+	called := make(chan struct{})
+	annotator.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) { close(called) })
+	if err := annotator.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	<-called
+
+	// Results are annotated as they are sent, without decoding them
+	result := json.RawMessage(`{"content":[{"type":"text","text":"first line\nsecond line\n"}],"isError":false}`)
+	for _, id := range []transport.RequestId{4, 5} {
+		response := transport.NewBaseMessageResponse(&transport.BaseJSONRPCResponse{Jsonrpc: "2.0", Id: id, Result: result})
+		if err := annotator.Send(context.Background(), response); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	sent := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := `{"id":4,"jsonrpc":"2.0","result":{"_meta":{"sizeBytes":80,"lines":2,"estimatedTokens":6},"content":[{"type":"text","text":"first line\nsecond line\n"}],"isError":false}}`
+	if len(sent) != 2 || sent[0] != want {
+		t.Errorf("Expected the call result annotated\n%s, got\n%s", want, sent[0])
+	}
+	if strings.Contains(sent[1], "_meta") {
+		t.Errorf("Expected responses to other requests left alone, got %s", sent[1])
+	}
+
+	if got := string(annotator.annotate(json.RawMessage(`{}`))); got != `{"_meta":{"sizeBytes":2,"lines":0,"estimatedTokens":0}}` {
+		t.Errorf("Unexpected annotation of an empty result: %s", got)
+	}
+	if got := string(annotator.annotate(json.RawMessage(`{"_meta":{"traceId":"t"},"content":[]}`))); got != `{"_meta":{"estimatedTokens":0,"lines":0,"sizeBytes":38,"traceId":"t"},"content":[]}` {
+		t.Errorf("Expected the size merged into the result's _meta, got %s", got)
+	}
+}
+
+func TestPassthroughRelay(t *testing.T) {
+	results := newRawResults()
+	raw := json.RawMessage(`{"content":[{"type":"text","text":"large upstream payload"}],"isError":false}`)
+
+	placeholder := results.placeholder(raw)
+	encoded, err := json.Marshal(placeholder)
+	if err != nil {
+		t.Fatalf("Failed to marshal placeholder: %v", err)
+	}
+
+	var out bytes.Buffer
+	tr := &passthroughTransport{Transport: newStdioTransport("test", strings.NewReader(""), &out, 0), results: results}
+	response := transport.NewBaseMessageResponse(&transport.BaseJSONRPCResponse{Jsonrpc: "2.0", Id: 7, Result: encoded})
+	if err := tr.Send(context.Background(), response); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if !strings.Contains(out.String(), "large upstream payload") {
+		t.Errorf("Expected raw result to be relayed, got %s", out.String())
+	}
+
+	if _, ok := results.take(encoded); ok {
+		t.Error("Expected raw results to be relayed only once")
+	}
+}
+
+func TestClientIdentityMetadata(t *testing.T) {
+	var out bytes.Buffer
+	metadata := map[string]interface{}{"tenant": "acme", "name": "ignored"}
+	tr := newUpstreamTransport(newStdioTransport("test", strings.NewReader(""), &out, 0), metadata)
+	request := transport.NewBaseMessageRequest(&transport.BaseJSONRPCRequest{
+		Jsonrpc: "2.0",
+		Id:      1,
+		Method:  "initialize",
+		Params:  json.RawMessage(`{"protocolVersion":"1.0","capabilities":{},"clientInfo":{"name":"custom-client","version":"2.0.0"}}`),
+	})
+	if err := tr.Send(context.Background(), request); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	var sent struct {
+		Params struct {
+			ClientInfo map[string]interface{} `json:"clientInfo"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &sent); err != nil {
+		t.Fatalf("Failed to decode sent request: %v", err)
+	}
+	info := sent.Params.ClientInfo
+	if info["name"] != "custom-client" || info["version"] != "2.0.0" || info["tenant"] != "acme" {
+		t.Errorf("Unexpected clientInfo: %v", info)
+	}
+}
+
+func TestToolCatalogRefresh(t *testing.T) {
+	rt := newBenchRouter(t, 2)
+	var out bytes.Buffer
+	metrics := newMetrics()
+	catalog := newToolCatalog(rt.registry, newStdioTransport("test", strings.NewReader(""), &out, 0), metrics)
+
+	if changes := catalog.refresh(); len(changes) != 0 {
+		t.Errorf("Expected no changes without upstream drift, got %v", changes)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected no notification without upstream drift, got %s", out.String())
+	}
+
+	// Pretend b1 advertised a different tool set at the previous refresh
+	catalog.snapshot["b1"] = map[string]string{"echo_b1": "{}", "retired": "{}"}
+	changes := catalog.refresh()
+	if len(changes) != 1 || changes[0].Backend != "b1" || len(changes[0].Changed) != 1 || len(changes[0].Removed) != 1 || len(changes[0].Added) != 0 {
+		t.Errorf("Unexpected changes: %+v", changes)
+	}
+	if !strings.Contains(out.String(), "notifications/tools/list_changed") {
+		t.Errorf("Expected a list_changed notification, got %s", out.String())
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), "mcp_tool_catalog_version 2") {
+		t.Errorf("Expected catalog version 2 in metrics, got %s", recorder.Body.String())
+	}
+}
+
+func TestVerifyBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("Failed to write server: %v", err)
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		t.Fatalf("Failed to checksum server: %v", err)
+	}
+	if err := verifyBackend("pinned", MCPStdIOConfig{Command: path, SHA256: strings.ToUpper(sum)}); err != nil {
+		t.Errorf("Expected matching checksum to pass: %v", err)
+	}
+	if err := verifyBackend("tampered", MCPStdIOConfig{Command: path, SHA256: strings.Repeat("0", 64)}); err == nil {
+		t.Error("Expected mismatching checksum to be refused")
+	}
+
+	tests := []struct {
+		command string
+		args    []string
+		version string
+	}{
+		{"npx", []string{"-y", "@modelcontextprotocol/server-memory@1.2.0"}, "1.2.0"},
+		{"npx", []string{"--package=server-foo@2.0.0", "foo"}, "2.0.0"},
+		{"npx", []string{"-y", "@modelcontextprotocol/server-memory"}, ""},
+		{"uvx", []string{"mcp-server-git==0.6.2"}, "0.6.2"},
+		{"uvx", []string{"--from", "mcp-server-fetch@1.0.0", "mcp-server-fetch"}, "1.0.0"},
+	}
+	for _, test := range tests {
+		_, version, err := launcherPackage(test.command, test.args)
+		if err != nil || version != test.version {
+			t.Errorf("%s %v: expected version '%s', got '%s' (%v)", test.command, test.args, test.version, version, err)
+		}
+	}
+	if err := verifyBackend("floating", MCPStdIOConfig{Command: "npx", Args: []string{"-y", "server-foo@latest"}, PackageVersion: "1.0.0"}); err == nil {
+		t.Error("Expected unpinned package to be refused")
+	}
+	if _, _, err := launcherPackage("node", []string{"server.js"}); err == nil {
+		t.Error("Expected PackageVersion to be rejected for other commands")
+	}
+}
+
+func TestInitWizard(t *testing.T) {
+	var out bytes.Buffer
+	w := &wizard{
+		in:  bufio.NewReader(strings.NewReader("y\n/srv/data\nn\nyes\n")),
+		out: &out,
+		lookPath: func(file string) (string, error) {
+			if file == "uvx" {
+				return "", exec.ErrNotFound
+			}
+			return "/usr/bin/" + file, nil
+		},
+	}
+	cfg, err := w.run()
+	if err != nil {
+		t.Fatalf("Wizard failed: %v", err)
+	}
+
+	if len(cfg.MCPStdIOServers) != 2 {
+		t.Fatalf("Expected filesystem and memory servers, got %v", cfg.MCPStdIOServers)
+	}
+	filesystem := cfg.MCPStdIOServers["filesystem"]
+	if filesystem.Command != "npx" || filesystem.Args[len(filesystem.Args)-1] != "/srv/data" {
+		t.Errorf("Unexpected filesystem server: %+v", filesystem)
+	}
+	if _, ok := cfg.MCPStdIOServers["memory"]; !ok {
+		t.Error("Expected memory server to be enabled")
+	}
+	if !strings.Contains(out.String(), "uvx not found") {
+		t.Errorf("Expected missing uvx to be reported, got %s", out.String())
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	schema := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"path":  map[string]interface{}{"type": "string", "minLength": float64(8)},
+			"mode":  map[string]interface{}{"type": "string", "enum": []interface{}{"read", "write"}},
+			"count": map[string]interface{}{"type": "integer", "minimum": float64(1)},
+			"force": map[string]interface{}{"type": "boolean"},
+		},
+		"required": []interface{}{"path", "mode", "count"},
+	}
+	arguments := syntheticArguments(schema)
+	if arguments["path"] != "tttttttt" || arguments["mode"] != "read" || arguments["count"] != float64(1) {
+		t.Errorf("Unexpected synthetic arguments: %v", arguments)
+	}
+	if _, ok := arguments["force"]; ok {
+		t.Error("Expected optional properties to be left out")
+	}
+
+	rt := newBenchRouter(t, 2)
+	results := selfTest(rt.registry, &SelfTestConfig{
+		Fixtures: map[string]interface{}{"echo_b0": map[string]interface{}{"message": "hello"}},
+		Skip:     []string{"echo_b1"},
+	}, 5*time.Second)
+	if len(results) != 2 || results[0].status != "PASS" || results[1].status != "SKIP" {
+		t.Errorf("Unexpected self-test results: %+v", results)
+	}
+}
+
+func TestSearchTools(t *testing.T) {
+	describe := func(text string) *string { return &text }
+	tools := []mcp.ToolRetType{
+		{Name: "read_file", Description: describe("Read the contents of a file from disk")},
+		{Name: "get_weather", Description: describe("Get the weather forecast for a city")},
+		{Name: "listDirectory", Description: describe("List files in a directory")},
+	}
+
+	hits := (*toolSearch)(nil).rank(context.Background(), "show me the weather in Paris", tools)
+	if len(hits) != 1 || hits[0].Name != "get_weather" {
+		t.Errorf("Expected only get_weather to match, got %+v", hits)
+	}
+	hits = (*toolSearch)(nil).rank(context.Background(), "read files", tools)
+	if len(hits) != 2 || hits[0].Name != "read_file" {
+		t.Errorf("Expected read_file to rank first, got %+v", hits)
+	}
+
+	// Embeddings: the query points the same way as the listDirectory document
+	embeddings := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var data []map[string]interface{}
+		for i, text := range req.Input {
+			vector := []float64{1, 0}
+			if strings.Contains(text, "directory") || strings.Contains(text, "folder") {
+				vector = []float64{0, 1}
+			}
+			data = append(data, map[string]interface{}{"index": i, "embedding": vector})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer embeddings.Close()
+
+	search := newToolSearch(&ToolSearchConfig{EmbeddingsURL: embeddings.URL, Model: "test"})
+	hits = search.rank(context.Background(), "what is in this folder", tools)
+	if len(hits) != 1 || hits[0].Name != "listDirectory" {
+		t.Errorf("Expected listDirectory to match by embedding, got %+v", hits)
+	}
+}
+
+func TestCatalogBudget(t *testing.T) {
+	tools := []catalogTool{
+		{backend: "files", tool: mcp.ToolRetType{Name: "read_file"}},
+		{backend: "files", tool: mcp.ToolRetType{Name: "write_file"}},
+		{backend: "web", tool: mcp.ToolRetType{Name: "fetch"}},
+		{backend: "web", tool: mcp.ToolRetType{Name: "search"}},
+		{backend: "misc", tool: mcp.ToolRetType{Name: "echo"}},
+	}
+	usage := newToolUsage()
+	usage.record("write_file")
+	budget := &CatalogBudgetConfig{MaxTools: 3, Pinned: []string{"echo"}, Priority: map[string]int{"web": 1}}
+
+	advertised, omitted := applyBudget(tools, budget, usage)
+	var names []string
+	for _, tool := range advertised {
+		names = append(names, tool.Name)
+	}
+	if strings.Join(names, ",") != "fetch,search,echo" || omitted != 2 {
+		t.Errorf("Expected pinned and priority tools in original order, got %v with %d omitted", names, omitted)
+	}
+
+	budget.Priority = nil
+	advertised, _ = applyBudget(tools, budget, usage)
+	if len(advertised) != 3 || advertised[0].Name != "read_file" || advertised[1].Name != "write_file" {
+		t.Errorf("Expected frequently used tools to be kept, got %v", advertised)
+	}
+
+	if advertised, omitted := applyBudget(tools, nil, usage); len(advertised) != len(tools) || omitted != 0 {
+		t.Errorf("Expected every tool without a budget, got %d", len(advertised))
+	}
+}
+
+func TestHostProfiles(t *testing.T) {
+	rt := newBenchRouter(t, 2)
+	rt.hosts = newHostProfiles([]HostProfile{
+		{Name: "desktop", ClientNames: []string{"claude-*"}, Tools: []string{"echo_b0"}},
+		{Name: "agents", Identities: []string{"agent"}, Tools: []string{"echo_b1"}},
+	})
+
+	desktop := contextWithSession(context.Background(), "desktop-session")
+	initialize := transport.NewBaseMessageRequest(&transport.BaseJSONRPCRequest{
+		Jsonrpc: "2.0",
+		Id:      1,
+		Method:  "initialize",
+		Params:  json.RawMessage(`{"clientInfo":{"name":"claude-ai","version":"0.1.0"}}`),
+	})
+	rt.hosts.observe(desktop, initialize)
+
+	args := map[string]interface{}{"message": "hello"}
+	if _, err := rt.call(desktop, "echo_b0", args); err != nil {
+		t.Errorf("Expected desktop host to call echo_b0: %v", err)
+	}
+	if _, err := rt.call(desktop, "echo_b1", args); err == nil || !strings.Contains(err.Error(), "desktop") {
+		t.Errorf("Expected desktop host to be denied echo_b1, got %v", err)
+	}
+
+	agent := contextWithIdentity(context.Background(), identity{Name: "agent"})
+	if !rt.exposed(agent, "echo_b1") || rt.exposed(agent, "echo_b0") {
+		t.Error("Expected the agent identity to see only echo_b1")
+	}
+	if other := context.Background(); !rt.exposed(other, "echo_b0") || !rt.exposed(other, "echo_b1") {
+		t.Error("Expected unmatched hosts to see every tool")
+	}
+
+	rt.hosts.forget(sessionScope(desktop))
+	if rt.hosts.profile(desktop) != nil {
+		t.Error("Expected the profile to be forgotten with the session")
+	}
+}
+
+func TestLocalizedDescriptions(t *testing.T) {
+	rt := newBenchRouter(t, 2)
+	rt.locales = newLocalizer(&LocalizationConfig{
+		Descriptions: map[string]map[string]string{
+			"de":    {"echo_b0": "Gibt die Nachricht zurück", "echo_b1": "Gibt die Nachricht zurück (b1)"},
+			"de-AT": {"echo_b0": "Gibt die Nachricht retour"},
+		},
+	})
+	initialize := func(session, params string) context.Context {
+		ctx := contextWithSession(context.Background(), session)
+		rt.locales.observe(ctx, transport.NewBaseMessageRequest(&transport.BaseJSONRPCRequest{
+			Jsonrpc: "2.0",
+			Id:      1,
+			Method:  "initialize",
+			Params:  json.RawMessage(params),
+		}))
+		return ctx
+	}
+	descriptions := func(ctx context.Context) []string {
+		tools, _ := rt.catalog(ctx, "")
+		var descriptions []string
+		for _, tool := range tools {
+			descriptions = append(descriptions, *tool.Description)
+		}
+		return descriptions
+	}
+
+	austrian := initialize("at", `{"clientInfo":{"name":"agent","version":"1.0","locale":"de_AT"}}`)
+	if want := []string{"Gibt die Nachricht retour", "Gibt die Nachricht zurück (b1)"}; !reflect.DeepEqual(descriptions(austrian), want) {
+		t.Errorf("Expected regional then language descriptions %v, got %v", want, descriptions(austrian))
+	}
+	english := initialize("en", `{"clientInfo":{"name":"agent","version":"1.0"},"_meta":{"locale":"en-US"}}`)
+	if got := descriptions(english); got[0] != "Echo the message" {
+		t.Errorf("Expected the server's descriptions for locales without overrides, got %v", got)
+	}
+
+	rt.locales.defaultLocale = "de"
+	if got := descriptions(context.Background()); got[0] != "Gibt die Nachricht zurück" {
+		t.Errorf("Expected the default locale for hosts announcing none, got %v", got)
+	}
+	rt.locales.forget(sessionScope(austrian))
+	if got := descriptions(austrian); got[0] != "Gibt die Nachricht zurück" {
+		t.Errorf("Expected the locale to be forgotten with the session, got %v", got)
+	}
+}
+
+func TestElicitation(t *testing.T) {
+	// The host answers every elicitation request it is sent
+	hostIn, hostWriter := io.Pipe()
+	hostReader, hostOut := io.Pipe()
+	t.Cleanup(func() {
+		_ = hostWriter.Close()
+		_ = hostOut.Close()
+	})
+	relay := newHostRelay(newStdioTransport("host", hostIn, hostOut, 0), true)
+	initialized := make(chan context.Context, 1)
+	relay.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		initialized <- ctx
+	})
+	if err := relay.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start the host transport: %v", err)
+	}
+	go func() {
+		lines := bufio.NewScanner(hostReader)
+		for lines.Scan() {
+			var request transport.BaseJSONRPCRequest
+			if json.Unmarshal(lines.Bytes(), &request) != nil || request.Method != "elicitation/create" {
+				continue
+			}
+			fmt.Fprintf(hostWriter, `{"jsonrpc":"2.0","id":%d,"result":{"action":"accept","content":{"city":"Oslo"}}}`+"\n", request.Id)
+		}
+	}()
+	fmt.Fprintln(hostWriter, `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"capabilities":{"elicitation":{}}}}`)
+	ctx := <-initialized
+
+	// The server asks the host for the city while the call waits, then answers with it
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	t.Cleanup(func() {
+		_ = clientOut.Close()
+		_ = serverOut.Close()
+	})
+	go func() {
+		lines := bufio.NewScanner(serverIn)
+		for lines.Scan() {
+			var message map[string]json.RawMessage
+			_ = json.Unmarshal(lines.Bytes(), &message)
+			switch {
+			case string(message["method"]) == `"tools/call"`:
+				fmt.Fprintf(serverOut, `{"jsonrpc":"2.0","id":7,"method":"elicitation/create","params":{"message":"Which city?"}}`+"\n")
+				lines.Scan()
+				var answer struct {
+					Result struct {
+						Content struct {
+							City string `json:"city"`
+						} `json:"content"`
+					} `json:"result"`
+				}
+				_ = json.Unmarshal(lines.Bytes(), &answer)
+				fmt.Fprintf(serverOut, `{"jsonrpc":"2.0","id":%s,"result":{"content":[{"type":"text","text":%q}]}}`+"\n", message["id"], answer.Result.Content.City)
+			}
+		}
+	}()
+	upstream := newUpstreamTransport(newStdioTransport("server", clientIn, clientOut, 0), nil)
+	responses := make(chan *transport.BaseJsonRpcMessage, 1)
+	upstream.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		responses <- message
+	})
+	if err := upstream.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start the server transport: %v", err)
+	}
+
+	err := upstream.Send(ctx, transport.NewBaseMessageRequest(&transport.BaseJSONRPCRequest{
+		Jsonrpc: "2.0",
+		Id:      3,
+		Method:  "tools/call",
+		Params:  json.RawMessage(`{"name":"weather","arguments":{}}`),
+	}))
+	if err != nil {
+		t.Fatalf("Failed to send the call: %v", err)
+	}
+	select {
+	case response := <-responses:
+		if !strings.Contains(string(response.JsonRpcResponse.Result), "Oslo") {
+			t.Errorf("Expected the host's answer in the result, got %s", response.JsonRpcResponse.Result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the call to be answered")
+	}
+	if upstream.caller() != nil {
+		t.Error("Expected the caller to be forgotten once the call was answered")
+	}
+
+	// Hosts that cannot answer are not asked
+	if _, err := newHostRelay(relay.Transport, false).elicit(ctx, nil); err == nil {
+		t.Error("Expected elicitation to fail over a transport that cannot push requests")
+	}
+	relay.capabilities = map[string]bool{"sampling": true}
+	if _, err := relay.elicit(ctx, nil); err == nil {
+		t.Error("Expected elicitation to fail for hosts without the capability")
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	rt := newBenchRouter(t, 1)
+	// Servers that complete the city argument of their prompt with the given values
+	completer := func(name string, values ...string) *backend {
+		return newScriptedBackend(t, name, func(method string, params json.RawMessage) interface{} {
+			return map[string]interface{}{"completion": map[string]interface{}{"values": values}}
+		})
+	}
+	rt.registry.backends["c1"] = completer("c1", "Oslo", "Ottawa")
+	rt.registry.backends["c2"] = completer("c2", "Ottawa", "Osaka")
+
+	params := json.RawMessage(`{"ref":{"type":"ref/prompt","name":"forecast"},"argument":{"name":"city","value":"O"}}`)
+	result, err := rt.complete(context.Background(), params)
+	if err != nil {
+		t.Fatalf("Completion failed: %v", err)
+	}
+	// b0 does not support completion and is left out
+	want := completion{Values: []string{"Oslo", "Ottawa", "Osaka"}, Total: 3}
+	if got := result.(map[string]interface{})["completion"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected merged suggestions %+v, got %+v", want, got)
+	}
+
+	delete(rt.registry.backends, "c1")
+	delete(rt.registry.backends, "c2")
+	if _, err := rt.complete(context.Background(), params); err == nil {
+		t.Error("Expected an error when no server can complete")
+	}
+
+	many := make([]string, maxCompletionValues+1)
+	for i := range many {
+		many[i] = strconv.Itoa(i)
+	}
+	if merged, _ := mergeCompletions([]*completion{{Values: many}}); len(merged.Values) != maxCompletionValues || !merged.HasMore || merged.Total != 0 {
+		t.Errorf("Expected suggestions capped at %d with more left, got %d, hasMore %v", maxCompletionValues, len(merged.Values), merged.HasMore)
+	}
+
+	declared := withCapabilities(json.RawMessage(`{"capabilities":{"tools":{}}}`), map[string]map[string]interface{}{"completions": {}})
+	if string(declared) != `{"capabilities":{"completions":{},"tools":{}}}` {
+		t.Errorf("Expected the completions capability to be declared, got %s", declared)
+	}
+}
+
+func TestResourceTemplates(t *testing.T) {
+	rt := newBenchRouter(t, 1)
+	var completed json.RawMessage
+	rt.registry.backends["fs"] = newScriptedBackend(t, "fs", func(method string, params json.RawMessage) interface{} {
+		switch method {
+		case "resources/templates/list":
+			return map[string]interface{}{"resourceTemplates": []map[string]string{{"uriTemplate": "file:///{path}", "name": "file"}}}
+		case "resources/read":
+			var request struct {
+				URI string `json:"uri"`
+			}
+			_ = json.Unmarshal(params, &request)
+			return map[string]interface{}{"contents": []map[string]string{{"uri": request.URI, "text": "hello"}}}
+		case "completion/complete":
+			completed = params
+			return map[string]interface{}{"completion": map[string]interface{}{"values": []string{"etc/hosts"}}}
+		}
+		return nil
+	})
+
+	// b0 has no templates and is left out
+	listed, err := rt.resourceTemplates(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Listing templates failed: %v", err)
+	}
+	want := []resourceTemplate{{URITemplate: "fs+file:///{path}", Name: "fs/file"}}
+	if got := listed.(map[string]interface{})["resourceTemplates"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected namespaced templates %+v, got %+v", want, got)
+	}
+
+	if rt.ownsResource(json.RawMessage(`{"uri":"artifact://1"}`)) || rt.ownsResource(json.RawMessage(`{"uri":"nope+file:///x"}`)) {
+		t.Error("Expected reads of the server's own and unknown resources to be left to the server")
+	}
+	read := json.RawMessage(`{"uri":"fs+file:///etc/hosts"}`)
+	if !rt.ownsResource(read) {
+		t.Fatal("Expected reads of namespaced resources to be routed")
+	}
+	result, err := rt.readResource(context.Background(), read)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	encoded, _ := json.Marshal(result)
+	if string(encoded) != `{"contents":[{"text":"hello","uri":"fs+file:///etc/hosts"}]}` {
+		t.Errorf("Expected the resource with its namespaced URI, got %s", encoded)
+	}
+
+	_, err = rt.complete(context.Background(), json.RawMessage(`{"ref":{"type":"ref/resource","uri":"fs+file:///{path}"},"argument":{"name":"path","value":"etc"}}`))
+	if err != nil {
+		t.Fatalf("Completion failed: %v", err)
+	}
+	if !strings.Contains(string(completed), `"uri":"file:///{path}"`) {
+		t.Errorf("Expected the template completed by its owner under its own URI, got %s", completed)
+	}
+}
+
+func TestResourceSubscriptions(t *testing.T) {
+	rt := newBenchRouter(t, 0)
+	requests := make(chan string, 10)
+	fs := newScriptedBackend(t, "fs", func(method string, params json.RawMessage) interface{} {
+		requests <- method + " " + string(params)
+		return struct{}{}
+	})
+	fs.exited = make(chan struct{})
+	rt.registry.backends["fs"] = fs
+	var out bytes.Buffer
+	rt.resources = newResourceSubscriptions(newStdioTransport("test", strings.NewReader(""), &out, 0))
+
+	alice := contextWithSession(context.Background(), "alice")
+	bob := contextWithSession(context.Background(), "bob")
+	params := json.RawMessage(`{"uri":"fs+file:///log"}`)
+	for _, ctx := range []context.Context{alice, bob} {
+		if _, err := rt.subscribeResource(ctx, params); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+	if got := <-requests; got != `resources/subscribe {"uri":"file:///log"}` {
+		t.Errorf("Expected one upstream subscription, got %s", got)
+	}
+
+	rt.resources.updated(fs, json.RawMessage(`{"uri":"file:///other"}`))
+	rt.resources.updated(fs, json.RawMessage(`{"uri":"file:///log"}`))
+	if got := strings.TrimSpace(out.String()); got != `{"jsonrpc":"2.0","method":"notifications/resources/updated","params":{"uri":"fs+file:///log"}}` {
+		t.Errorf("Expected only the subscribed update forwarded under its namespaced URI, got %s", got)
+	}
+
+	if _, err := rt.unsubscribeResource(alice, params); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
+	rt.resources.forget(sessionScope(bob))
+	if got := <-requests; got != `resources/unsubscribe {"uri":"file:///log"}` {
+		t.Errorf("Expected the upstream subscription dropped with its last session, got %s", got)
+	}
+
+	if _, err := rt.subscribeResource(alice, params); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	<-requests
+	close(fs.exited)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rt.resources.mu.Lock()
+		released := len(rt.resources.sessions) == 0
+		rt.resources.mu.Unlock()
+		if released {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected subscriptions dropped once the server exited")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChangeNotifier(t *testing.T) {
+	hostIn, out := io.Pipe()
+	t.Cleanup(func() { _ = out.Close() })
+	notifier := newChangeNotifier(newStdioTransport("host", strings.NewReader(""), out, 0), &NotificationsConfig{
+		Debounce: Duration(50 * time.Millisecond),
+		MaxDelay: Duration(time.Second),
+	})
+	lines := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(hostIn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	notify := func(method, params string) {
+		var raw json.RawMessage
+		if params != "" {
+			raw = json.RawMessage(params)
+		}
+		message := transport.NewBaseMessageNotification(&transport.BaseJSONRPCNotification{Jsonrpc: "2.0", Method: method, Params: raw})
+		if err := notifier.Send(context.Background(), message); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	// A burst, as from a server restarting, reaches the host once it ends with each notification once
+	b := newScriptedBackend(t, "fs", func(string, json.RawMessage) interface{} { return nil })
+	notifier.relay(b)
+	for i := 0; i < 3; i++ {
+		b.upstream.watchers["notifications/resources/list_changed"](nil)
+		notify("notifications/tools/list_changed", "")
+		notify("notifications/resources/updated", `{"uri":"fs+file:///a"}`)
+	}
+	notify("notifications/resources/updated", `{"uri":"fs+file:///b"}`)
+	notify("notifications/message", `{"level":"info","data":"now"}`)
+
+	var got []string
+	for len(got) < 5 {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for notifications, got %v", got)
+		}
+	}
+	want := []string{
+		`{"jsonrpc":"2.0","method":"notifications/message","params":{"level":"info","data":"now"}}`,
+		`{"jsonrpc":"2.0","method":"notifications/resources/list_changed"}`,
+		`{"jsonrpc":"2.0","method":"notifications/tools/list_changed"}`,
+		`{"jsonrpc":"2.0","method":"notifications/resources/updated","params":{"uri":"fs+file:///a"}}`,
+		`{"jsonrpc":"2.0","method":"notifications/resources/updated","params":{"uri":"fs+file:///b"}}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected other messages at once and the burst coalesced\n%v, got\n%v", want, got)
+	}
+	select {
+	case line := <-lines:
+		t.Errorf("Expected nothing more, got %s", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMetaPropagation(t *testing.T) {
+	incoming := transport.NewBaseMessageRequest(&transport.BaseJSONRPCRequest{
+		Jsonrpc: "2.0",
+		Id:      1,
+		Method:  "tools/call",
+		Params:  json.RawMessage(`{"name":"tools/call","arguments":{},"_meta":{"progressToken":"p-1","traceId":"outer"}}`),
+	})
+	ctx := observeMeta(context.Background(), incoming)
+	ctx = contextWithMeta(ctx, map[string]interface{}{"traceId": "inner"})
+
+	var out bytes.Buffer
+	tr := newUpstreamTransport(newStdioTransport("test", strings.NewReader(""), &out, 0), nil)
+	outgoing := transport.NewBaseMessageRequest(&transport.BaseJSONRPCRequest{
+		Jsonrpc: "2.0",
+		Id:      2,
+		Method:  "tools/call",
+		Params:  json.RawMessage(`{"name":"echo","arguments":{"message":"hi"},"_meta":{"custom":true}}`),
+	})
+	if err := tr.Send(ctx, outgoing); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	var sent struct {
+		Params struct {
+			Meta map[string]interface{} `json:"_meta"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &sent); err != nil {
+		t.Fatalf("Failed to decode sent request: %v", err)
+	}
+	meta := sent.Params.Meta
+	if meta["progressToken"] != "p-1" || meta["traceId"] != "inner" || meta["custom"] != true {
+		t.Errorf("Unexpected upstream _meta: %v", meta)
+	}
+}
+
+func TestDeadlineBudget(t *testing.T) {
+	observe := func(meta string) context.Context {
+		return observeMeta(context.Background(), transport.NewBaseMessageRequest(&transport.BaseJSONRPCRequest{
+			Jsonrpc: "2.0",
+			Id:      1,
+			Method:  "tools/call",
+			Params:  json.RawMessage(`{"name":"echo","arguments":{},"_meta":` + meta + `}`),
+		}))
+	}
+	send := func(ctx context.Context) (map[string]interface{}, error) {
+		var out bytes.Buffer
+		tr := newUpstreamTransport(newStdioTransport("test", strings.NewReader(""), &out, 0), nil)
+		err := tr.Send(ctx, transport.NewBaseMessageRequest(&transport.BaseJSONRPCRequest{
+			Jsonrpc: "2.0",
+			Id:      2,
+			Method:  "tools/call",
+			Params:  json.RawMessage(`{"name":"echo","arguments":{}}`),
+		}))
+		var sent struct {
+			Params struct {
+				Meta map[string]interface{} `json:"_meta"`
+			} `json:"params"`
+		}
+		_ = json.Unmarshal(out.Bytes(), &sent)
+		return sent.Params.Meta, err
+	}
+
+	// The upstream gets what is left after the reserve
+	ctx, cancel := withBudgetDeadline(observe(`{"budgetMs":5000,"traceId":"t"}`), time.Second)
+	defer cancel()
+	meta, err := send(ctx)
+	if budget, _ := meta["budgetMs"].(float64); err != nil || budget <= 3500 || budget > 4000 || meta["traceId"] != "t" {
+		t.Errorf("Expected about 4000ms to be forwarded, got %v: %v", meta, err)
+	}
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > 4*time.Second {
+		t.Errorf("Expected the call to be bounded by the budget, got %v", deadline)
+	}
+
+	// Detached work carries no budget
+	if meta, err := send(withoutBudget(ctx)); err != nil || meta["budgetMs"] != nil || meta["traceId"] != "t" {
+		t.Errorf("Expected the budget to be dropped, got %v: %v", meta, err)
+	}
+
+	// A call whose budget ran out while queued is not forwarded
+	rt := newBenchRouter(t, 1)
+	rt.reserve = defaultDeadlineReserve
+	if _, err := rt.call(observe(`{"budgetMs":5}`), "echo_b0", map[string]interface{}{"message": "late"}); err == nil || !strings.Contains(err.Error(), "budget exhausted") {
+		t.Errorf("Expected the exhausted budget to fail the call, got %v", err)
+	}
+	if resp, err := rt.call(observe(`{"budgetMs":5000}`), "echo_b0", map[string]interface{}{"message": "on time"}); err != nil || responseText(resp) != "on time" {
+		t.Errorf("Expected the call to succeed within its budget, got %+v: %v", resp, err)
+	}
+
+	// Middleware sees the caller's deadline
+	recorder := &recordingMiddleware{}
+	rt.middleware = middlewareChain{recorder}
+	if _, err := rt.call(observe(`{"budgetMs":5000}`), "echo_b0", map[string]interface{}{"message": "bounded"}); err != nil || !recorder.bounded {
+		t.Errorf("Expected the middleware to see a deadline, got %v: %v", recorder.bounded, err)
+	}
+	if _, err := rt.call(observe(`{"budgetMs":5}`), "echo_b0", map[string]interface{}{"message": "late"}); err == nil || !strings.Contains(err.Error(), "abandoned") {
+		t.Errorf("Expected the exhausted budget to stop the call before the middleware, got %v", err)
+	}
+	rt.middleware = nil
+
+	// A batch skips the calls left once the caller's deadline passes
+	batch := handleCallBatch(rt).(func(context.Context, CallBatchRequest) (*mcp.ToolResponse, error))
+	resp, err := batch(observe(`{"budgetMs":5}`), CallBatchRequest{Calls: []CallToolRequest{{Name: "echo_b0", Arguments: map[string]interface{}{"message": "late"}}}})
+	if err != nil || !strings.Contains(responseText(resp), `"skipped":true`) {
+		t.Errorf("Expected the late batch to be skipped, got %s: %v", responseText(resp), err)
+	}
+}
+
+// batchMiddleware records the order calls start in and how many echo calls run at once, holding
+// each echo call for a moment so parallel calls overlap
+type batchMiddleware struct {
+	mu       sync.Mutex
+	started  []string
+	inFlight int
+	peak     int
+}
+
+func (m *batchMiddleware) OnCallStart(ctx context.Context, info map[string]string, arguments map[string]interface{}) (map[string]interface{}, error) {
+	m.mu.Lock()
+	m.started = append(m.started, info["tool"])
+	m.inFlight++
+	m.peak = max(m.peak, m.inFlight)
+	m.mu.Unlock()
+	if strings.HasPrefix(info["tool"], "echo") {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return arguments, nil
+}
+
+func (m *batchMiddleware) Transform(ctx context.Context, info map[string]string, result json.RawMessage) (json.RawMessage, error) {
+	return result, nil
+}
+
+func (m *batchMiddleware) OnCallEnd(ctx context.Context, info map[string]string, duration time.Duration, err error) {
+	m.mu.Lock()
+	m.inFlight--
+	m.mu.Unlock()
+}
+
+func TestCallBatch(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 3)
+	batch := handleCallBatch(rt).(func(context.Context, CallBatchRequest) (*mcp.ToolResponse, error))
+	run := func(request CallBatchRequest) ([]batchResult, *batchMiddleware) {
+		t.Helper()
+		recorder := &batchMiddleware{}
+		rt.middleware = middlewareChain{recorder}
+		resp, err := batch(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Batch failed: %v", err)
+		}
+		var results struct {
+			Results []batchResult `json:"results"`
+		}
+		if err := json.Unmarshal([]byte(responseText(resp)), &results); err != nil {
+			t.Fatalf("Invalid batch results %s: %v", responseText(resp), err)
+		}
+		return results.Results, recorder
+	}
+	echo := func(tool, message string) CallToolRequest {
+		return CallToolRequest{Name: tool, Arguments: map[string]interface{}{"message": message}}
+	}
+	text := func(result batchResult) string {
+		if len(result.Content) == 0 || result.Content[0].TextContent == nil {
+			return ""
+		}
+		return result.Content[0].TextContent.Text
+	}
+
+	// Sequential calls run one after another in the order given
+	results, recorder := run(CallBatchRequest{Calls: []CallToolRequest{echo("echo_b2", "first"), echo("echo_b0", "second"), echo("echo_b1", "third")}})
+	if want := []string{"echo_b2", "echo_b0", "echo_b1"}; !reflect.DeepEqual(recorder.started, want) || recorder.peak != 1 {
+		t.Errorf("Expected the calls to run one at a time in order %v, got %v with %d at once", want, recorder.started, recorder.peak)
+	}
+	for i, want := range []string{"first", "second", "third"} {
+		if text(results[i]) != want {
+			t.Errorf("Expected result %d to be %q, got %+v", i, want, results[i])
+		}
+	}
+
+	// Parallel results come back in the order of the calls, with a bounded number running at once
+	var calls []CallToolRequest
+	for i := 0; i < 2*maxParallelBatchCalls; i++ {
+		calls = append(calls, echo("echo_b"+strconv.Itoa(i%3), "call "+strconv.Itoa(i)))
+	}
+	results, recorder = run(CallBatchRequest{Calls: calls, Parallel: true})
+	for i, result := range results {
+		if want := "call " + strconv.Itoa(i); text(result) != want {
+			t.Errorf("Expected result %d to be %q, got %+v", i, want, result)
+		}
+	}
+	if recorder.peak < 2 || recorder.peak > maxParallelBatchCalls {
+		t.Errorf("Expected between 2 and %d calls at once, got %d", maxParallelBatchCalls, recorder.peak)
+	}
+
+	// FailFast skips the calls after the first failure
+	rt.strict = true
+	results, recorder = run(CallBatchRequest{Calls: []CallToolRequest{echo("echo_b0", "ok"), echo("missing", "fails"), echo("echo_b1", "skipped")}, FailFast: true})
+	if results[0].Error != "" || results[1].Error == "" || !results[2].Skipped || len(recorder.started) != 2 {
+		t.Errorf("Expected the sequential batch to stop at the failure, got %+v", results)
+	}
+	calls = append([]CallToolRequest{echo("missing", "fails")}, calls...)
+	results, _ = run(CallBatchRequest{Calls: calls, Parallel: true, FailFast: true})
+	if results[0].Error == "" || !results[len(results)-1].Skipped {
+		t.Errorf("Expected the parallel batch to skip the calls after the failure, got %+v", results)
+	}
+
+	rt.middleware = nil
+	calls = make([]CallToolRequest, maxBatchCalls+1)
+	if _, err := batch(context.Background(), CallBatchRequest{Calls: calls, Parallel: true}); err == nil || !strings.Contains(err.Error(), "too many calls") {
+		t.Errorf("Expected an oversized batch to be refused, got %v", err)
+	}
+}
+
+func TestNativeTools(t *testing.T) {
+	rt := newBenchRouter(t, 2)
+	requests := `{"jsonrpc":"2.0","id":1,"method":"tools/list","params":{}}` + "\n" +
+		`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"echo_b1","arguments":{"message":"native"}}}` + "\n"
+	outR, outW := io.Pipe()
+	defer outR.Close()
+	downstream := &passthroughTransport{Transport: newStdioTransport("test", strings.NewReader(requests), outW, 0), results: rt.raw}
+	native := newNativeToolsTransport(downstream, func(name string) bool { return name == "tools/call" })
+	native.rt = rt
+
+	passed := make(chan *transport.BaseJsonRpcMessage, 2)
+	native.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) { passed <- message })
+	if err := native.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+
+	// The server answers tools/list with its own tools; the aggregated ones are appended
+	listing := <-passed
+	if listing.JsonRpcRequest.Method != "tools/list" {
+		t.Fatalf("Expected tools/list to reach the server, got %s", listing.JsonRpcRequest.Method)
+	}
+	reader := bufio.NewReader(outR)
+	var responses []string
+	go func() {
+		response := transport.NewBaseMessageResponse(&transport.BaseJSONRPCResponse{Jsonrpc: "2.0", Id: 1, Result: json.RawMessage(`{"tools":[{"name":"tools/call","inputSchema":{}}]}`)})
+		_ = native.Send(context.Background(), response)
+	}()
+	for len(responses) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		responses = append(responses, line)
+	}
+
+	joined := strings.Join(responses, "")
+	for _, want := range []string{`"tools/call"`, `"echo_b0"`, `"echo_b1"`, `"text":"native"`} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("Expected %s in responses, got %s", want, joined)
+		}
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// A panicking tool handler fails the call with an internal error and the server keeps serving
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	defer inW.Close()
+	defer outR.Close()
+	server := mcp.NewServer(newRecoveryTransport(newStdioTransport("test", inR, outW, 0)))
+	var missing map[string]*mcp.ToolResponse
+	err := server.RegisterTool("boom", "Panic", recoverHandler("boom", func(ctx context.Context, args BenchEchoArgs) (*mcp.ToolResponse, error) {
+		return mcp.NewToolResponse(missing[args.Message].Content...), nil
+	}))
+	if err != nil {
+		t.Fatalf("Failed to register tool: %v", err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatalf("Failed to serve: %v", err)
+	}
+	reader := bufio.NewReader(outR)
+	for id := 1; id <= 2; id++ {
+		request := fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"tools/call","params":{"name":"boom","arguments":{"message":"x"}}}`+"\n", id)
+		if _, err := io.WriteString(inW, request); err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if !strings.Contains(line, `"code":-32603`) || !strings.Contains(line, "the boom tool panicked") {
+			t.Errorf("Expected an internal error, got %s", line)
+		}
+	}
+
+	// So does a message handler panicking before the request is handed over
+	requests := `{"jsonrpc":"2.0","id":7,"method":"ping"}` + "\n"
+	errR, errW := io.Pipe()
+	defer errR.Close()
+	recovery := newRecoveryTransport(newStdioTransport("test", strings.NewReader(requests), errW, 0))
+	recovery.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		var request *transport.BaseJSONRPCRequest
+		_ = message.JsonRpcRequest.Method + request.Method
+	})
+	if err := recovery.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+	line, err := bufio.NewReader(errR).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if !strings.Contains(line, `"id":7`) || !strings.Contains(line, `"code":-32603`) {
+		t.Errorf("Expected an internal error, got %s", line)
+	}
+}
+
+func TestGracefulDrain(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	defer inW.Close()
+	defer outR.Close()
+	drain := newDrainTransport(newStdioTransport("test", inR, outW, 0))
+	server := mcp.NewServer(drain)
+	release := make(chan struct{})
+	err := server.RegisterTool("slow", "Wait", func(ctx context.Context, args BenchEchoArgs) (*mcp.ToolResponse, error) {
+		<-release
+		return mcp.NewToolResponse(mcp.NewTextContent(args.Message)), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to register tool: %v", err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatalf("Failed to serve: %v", err)
+	}
+	lines := make(chan string, 4)
+	go func() {
+		reader := bufio.NewReader(outR)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	call := func(id int) {
+		request := fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"tools/call","params":{"name":"slow","arguments":{"message":"call %d"}}}`+"\n", id, id)
+		if _, err := io.WriteString(inW, request); err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+	}
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a response")
+			return ""
+		}
+	}
+	until := func(what string, condition func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+		}
+	}
+
+	// A call in flight holds the drain until it is answered
+	call(1)
+	until("the call to be in flight", func() bool {
+		drain.mu.Lock()
+		defer drain.mu.Unlock()
+		return drain.pending == 1
+	})
+	drained := make(chan int, 1)
+	go func() { drained <- drain.drain(context.Background()) }()
+	until("the drain to begin", func() bool {
+		drain.mu.Lock()
+		defer drain.mu.Unlock()
+		return drain.draining
+	})
+
+	// Calls arriving meanwhile are rejected as retriable
+	call(2)
+	if line := next(); !strings.Contains(line, `"id":2`) || !strings.Contains(line, `"code":-32001`) || !strings.Contains(line, `"retriable":true`) {
+		t.Errorf("Expected a retriable rejection, got %s", line)
+	}
+	select {
+	case left := <-drained:
+		t.Fatalf("Expected the drain to wait for the call in flight, it ended with %d left", left)
+	default:
+	}
+	close(release)
+	if line := next(); !strings.Contains(line, `"id":1`) || !strings.Contains(line, "call 1") {
+		t.Errorf("Expected the call in flight to finish, got %s", line)
+	}
+	select {
+	case left := <-drained:
+		if left != 0 {
+			t.Errorf("Expected nothing left in flight, got %d", left)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the drain to end once the call was answered")
+	}
+
+	// The drain window bounds the wait for calls that do not finish
+	stuck := newDrainTransport(newStdioTransport("test", strings.NewReader(""), io.Discard, 0))
+	stuck.inflight[9], stuck.pending = 1, 1
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if left := stuck.drain(ctx); left != 1 {
+		t.Errorf("Expected the stuck call to be left in flight, got %d", left)
+	}
+
+	// Readiness is withdrawn while draining
+	probes := newHealth(nil, systemClock{})
+	probes.markServing()
+	probes.markDraining()
+	recorder := httptest.NewRecorder()
+	probes.ready(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "draining") {
+		t.Errorf("Expected draining to fail readiness, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestOperatorSignals(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// The diagnostics name the backends, the routes, the calls in flight and the goroutines
+	rt := newBenchRouter(t, 2)
+	rt.registry.servers = map[string]MCPStdIOConfig{"b0": {}, "b1": {}}
+	dump := (&diagnostics{registry: rt.registry, drain: newDrainTransport(nil)}).dump()
+	for _, want := range []string{"b0: running", "b1: running", "echo_b0 -> b0", "echo_b1 -> b1", "0 calls in flight", "Requests in flight: 0", "Goroutines ("} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("Expected %q in the diagnostics, got:\n%s", want, dump)
+		}
+	}
+
+	// SIGHUP reloads the config
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		return
+	}
+	// Subscribing first keeps a signal sent before the watcher subscribed from ending the test
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("Failed to find the test process: %v", err)
+	}
+	reloads := make(chan struct{}, 1)
+	go watchSignals(func() error {
+		reloads <- struct{}{}
+		return nil
+	}, nil)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		// The signal is sent until the watcher, which may not have subscribed yet, sees it
+		if err := self.Signal(syscall.SIGHUP); err != nil {
+			t.Fatalf("Failed to signal: %v", err)
+		}
+		select {
+		case <-reloads:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected SIGHUP to reload the config")
+		}
+	}
+}
+
+func TestSupervision(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	events := make(chan toolCallEvent, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event toolCallEvent
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer hook.Close()
+	webhooks, err := newWebhookDispatcher([]WebhookConfig{{URL: hook.URL, Events: []string{"crashloop"}}})
+	if err != nil {
+		t.Fatalf("Failed to set up webhooks: %v", err)
+	}
+
+	rt := newBenchRouter(t, 0)
+	metrics := newMetrics()
+	clock := newFakeClock()
+	supervisor := newSupervisor(&SupervisionConfig{MaxRestarts: 2, Window: Duration(time.Hour)}, rt.registry, metrics, webhooks, clock)
+	rt.registry.started = func(b *backend) { go supervisor.watch(b) }
+	err = rt.registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"crashy": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve"}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	defer rt.registry.shutdown()
+	state := func() backendStatus {
+		return rt.registry.status()[0]
+	}
+	crash := func() *backend {
+		b := rt.registry.named("crashy")
+		if err := b.cmd.Process.Kill(); err != nil {
+			t.Fatalf("Failed to kill the backend: %v", err)
+		}
+		return b
+	}
+
+	// A crashed backend is restarted after the backoff while within its budget
+	for restart := 1; restart <= 2; restart++ {
+		crashed := crash()
+		clock.blockUntil(t, 1)
+		clock.advance(defaultRestartBackoff)
+		for deadline := time.Now().Add(5 * time.Second); rt.registry.named("crashy") == crashed || state().State != "running"; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected restart %d to bring the backend back, got %+v", restart, state())
+			}
+		}
+	}
+
+	// A third crash within the window spends the budget: the backend is given up on
+	crash()
+	for deadline := time.Now().Add(5 * time.Second); state().State != "failed"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the crash-looping backend to be marked failed, got %+v", state())
+		}
+	}
+	if !strings.Contains(state().Failed, "restarted 2 times") {
+		t.Errorf("Expected the reason for giving up, got %q", state().Failed)
+	}
+	select {
+	case event := <-events:
+		if event.Event != "crashloop" || event.Backend != "crashy" {
+			t.Errorf("Expected a crashloop event for the backend, got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected a crashloop webhook")
+	}
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{`mcp_backend_crash_looping{backend="crashy"} 1`, `mcp_backend_restarts_total{backend="crashy"} 2`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s in the metrics, got %s", want, w.Body.String())
+		}
+	}
+
+	// Restarting it by hand starts it again with a fresh budget
+	if err := rt.registry.restart("crashy"); err != nil {
+		t.Fatalf("Failed to restart: %v", err)
+	}
+	if status := state(); status.State != "running" || status.Failed != "" {
+		t.Errorf("Expected the restarted backend to run, got %+v", status)
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.4.0", "abc123", "2026-01-02T03:04:05Z"
+
+	// Values set at build time win over the stamped VCS information
+	info := currentBuild(nil)
+	if info.Version != "1.4.0" || info.Commit != "abc123" || info.BuildDate != "2026-01-02T03:04:05Z" {
+		t.Fatalf("build info = %+v, want the ldflags values", info)
+	}
+	if info.Features != nil {
+		t.Errorf("features without a config = %v, want none", info.Features)
+	}
+	if got := strings.Contains(strings.Join(info.Capabilities, " "), "syslog"); got != syslogSupported {
+		t.Errorf("capabilities = %v, syslog supported = %v", info.Capabilities, syslogSupported)
+	}
+	banner := info.banner()
+	if !strings.HasPrefix(banner, "mcp-aggregator 1.4.0, commit abc123, built 2026-01-02T03:04:05Z") {
+		t.Errorf("banner = %q", banner)
+	}
+
+	// The tool reports the features of the config applied last
+	rt := newBenchRouter(t, 1)
+	rt.registry.config = Config{Cache: &CacheConfig{}, Webhooks: []WebhookConfig{{URL: "http://hooks"}}, StrictRouting: true}
+	handler := handleServerInfo(rt).(func(context.Context, ServerInfoRequest) (*mcp.ToolResponse, error))
+	resp, err := handler(context.Background(), ServerInfoRequest{})
+	if err != nil {
+		t.Fatalf("server/info failed: %v", err)
+	}
+	var reported buildInfo
+	if err := json.Unmarshal([]byte(resp.Content[0].TextContent.Text), &reported); err != nil {
+		t.Fatalf("server/info returned invalid JSON: %v", err)
+	}
+	if reported.Name != serverName || reported.Version != "1.4.0" || reported.GoVersion == "" {
+		t.Errorf("reported = %+v", reported)
+	}
+	if want := []string{"async-jobs", "cache", "strict-routing", "webhooks"}; !reflect.DeepEqual(reported.Features, want) {
+		t.Errorf("features = %v, want %v", reported.Features, want)
+	}
+	if !strings.Contains(reported.banner(), "features: async-jobs cache strict-routing webhooks") {
+		t.Errorf("banner = %q", reported.banner())
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	cfg, err := parseConfig([]byte(`{"MCPStdIOServers": {}, "Features": {"FuzzyMatching": true, "AsyncJobs": false}}`))
+	if err != nil {
+		t.Fatalf("parseConfig failed: %v", err)
+	}
+	if err := cfg.Features.check(); err != nil {
+		t.Errorf("known flags rejected: %v", err)
+	}
+	if err := (FeatureFlags{"ResultCahce": true}).check(); err == nil || !strings.Contains(err.Error(), "ResultCahce") {
+		t.Errorf("misspelt flag error = %v", err)
+	}
+	// Unset flags take their defaults: shipped subsystems on, experimental ones dark
+	if !cfg.Features.enabled(featureFuzzyMatching) || cfg.Features.enabled(featureAsyncJobs) || !cfg.Features.enabled(featureResultCache) {
+		t.Errorf("flags = %v", cfg.Features)
+	}
+	var unset FeatureFlags
+	if !unset.enabled(featureAsyncJobs) || unset.enabled(featureFuzzyMatching) {
+		t.Error("defaults not applied without a Features block")
+	}
+
+	if got := closestTool("Echo-B0", []string{"echo_b0", "echo_b1"}); got != "echo_b0" {
+		t.Errorf("closestTool(Echo-B0) = %q, want echo_b0", got)
+	}
+	if got := closestTool("get_wether", []string{"get_weather", "get_alerts"}); got != "get_weather" {
+		t.Errorf("closestTool(get_wether) = %q, want get_weather", got)
+	}
+	if got := closestTool("echo_b", []string{"echo_b0", "echo_b1"}); got != "" {
+		t.Errorf("closestTool of an ambiguous name = %q, want none", got)
+	}
+	if got := closestTool("delete_all", []string{"echo_b0"}); got != "" {
+		t.Errorf("closestTool of a distant name = %q, want none", got)
+	}
+
+	// Fuzzy matching routes calls to misspelt tools only when it is on
+	rt := newBenchRouter(t, 2)
+	rt.strict = true
+	if _, err := rt.call(context.Background(), "Echo-B1", map[string]interface{}{"message": "hi"}); err == nil {
+		t.Error("misspelt tool routed with fuzzy matching off")
+	}
+	rt.features = FeatureFlags{featureFuzzyMatching: true}
+	resp, err := rt.call(context.Background(), "Echo-B1", map[string]interface{}{"message": "hi"})
+	if err != nil {
+		t.Fatalf("misspelt tool not routed: %v", err)
+	}
+	if text := resp.Content[0].TextContent.Text; text != "hi" {
+		t.Errorf("response = %q, want hi", text)
+	}
+	if _, err := rt.call(context.Background(), "echo_b", map[string]interface{}{"message": "hi"}); err == nil {
+		t.Error("ambiguous tool name routed")
+	}
+
+	// Async calls are refused when their flag is off
+	rt.features[featureAsyncJobs] = false
+	call := handleCallTool(rt).(func(context.Context, CallToolRequest) (*mcp.ToolResponse, error))
+	if _, err := call(context.Background(), CallToolRequest{Name: "echo_b0", Async: true}); err == nil || !strings.Contains(err.Error(), featureAsyncJobs) {
+		t.Errorf("async call with the flag off: %v", err)
+	}
+}
+
+func TestExporters(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	dir := t.TempDir()
+
+	for _, configs := range [][]ExporterConfig{
+		{{Type: "kafka"}},
+		{{Type: "jsonl"}},
+		{{Type: "http"}},
+		{{Type: "jsonl", Path: filepath.Join(dir, "x.jsonl"), Records: []string{"billing"}}},
+	} {
+		if _, err := openExporters(configs); err == nil {
+			t.Errorf("openExporters(%+v) succeeded", configs)
+		}
+	}
+
+	// Calls routed through the router are exported as audit and usage records
+	var mu sync.Mutex
+	var batches [][]exportRecord
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []exportRecord
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil || r.Header.Get("X-Pipeline") != "calls" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		batches = append(batches, batch)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	auditFile := filepath.Join(dir, "audit.jsonl")
+	configs := []ExporterConfig{
+		{Type: "jsonl", Path: auditFile, Records: []string{"audit"}},
+		{Type: "http", URL: server.URL, Headers: map[string]string{"X-Pipeline": "calls"}, BatchSize: 2},
+	}
+	database := filepath.Join(dir, "calls.db")
+	_, sqliteErr := exec.LookPath("sqlite3")
+	if sqliteErr == nil {
+		configs = append(configs, ExporterConfig{Type: "sqlite", Path: database})
+	}
+	exports, err := openExporters(configs)
+	if err != nil {
+		t.Fatalf("openExporters failed: %v", err)
+	}
+	rt := newBenchRouter(t, 1)
+	rt.exports = exports
+	rt.audit = &auditLogger{exports: exports}
+	if _, err := rt.call(context.Background(), "echo_b0", map[string]interface{}{"message": "hi"}); err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	rt.audit.record(auditRecord{Identity: "o'brien", Tool: "drop_table", Decision: "denied", Error: "it's not allowed"})
+	exports.close()
+
+	data, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatalf("failed to read the jsonl export: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("jsonl export = %q, want the two audit records only", data)
+	}
+	var first exportRecord
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil || first.Kind != "audit" || first.Tool != "echo_b0" || first.Decision != "allowed" || first.Time.IsZero() {
+		t.Errorf("first jsonl record = %+v, %v", first, err)
+	}
+
+	var kinds []string
+	mu.Lock()
+	for _, batch := range batches {
+		if len(batch) > 2 {
+			t.Errorf("batch of %d records exceeds the batch size", len(batch))
+		}
+		for _, rec := range batch {
+			kinds = append(kinds, rec.Kind+":"+rec.Tool)
+			if rec.Kind == "usage" && (rec.Backend != "b0" || rec.DurationSeconds <= 0) {
+				t.Errorf("usage record = %+v", rec)
+			}
+		}
+	}
+	mu.Unlock()
+	sort.Strings(kinds)
+	if want := []string{"audit:drop_table", "audit:echo_b0", "usage:echo_b0"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("posted records = %v, want %v", kinds, want)
+	}
+
+	if sqliteErr != nil {
+		t.Skip("sqlite3 not installed")
+	}
+	out, err := exec.Command("sqlite3", database, "SELECT kind, identity, error FROM call_records ORDER BY kind, tool").CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to query the sqlite export: %v: %s", err, out)
+	}
+	if want := "audit|o'brien|it's not allowed\naudit|anonymous|\nusage|anonymous|\n"; string(out) != want {
+		t.Errorf("sqlite rows = %q, want %q", out, want)
+	}
+}
+
+func TestDataHandling(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	dir := t.TempDir()
+	data := &DataHandlingConfig{DropArguments: true, DropResponses: true, Retention: Duration(time.Hour)}
+	if got := data.retain(24 * time.Hour); got != time.Hour {
+		t.Errorf("retain(24h) = %s, want the 1h data retention", got)
+	}
+	if got := data.retain(time.Minute); got != time.Minute {
+		t.Errorf("retain(1m) = %s, want the shorter job retention", got)
+	}
+
+	// Dropped payloads stay out of the slow call log, which records whose calls it holds
+	path := filepath.Join(dir, "slow.jsonl")
+	rt := newBenchRouter(t, 1)
+	var err error
+	if rt.slow, err = newSlowCallLogger(&SlowCallConfig{Threshold: Duration(time.Nanosecond), Log: path}, data); err != nil {
+		t.Fatalf("Failed to create slow call logger: %v", err)
+	}
+	defer rt.slow.log.close()
+	for _, caller := range []struct{ name, session string }{{"alice", "s1"}, {"bob", "s2"}, {"alice", "s3"}} {
+		ctx := contextWithSession(contextWithIdentity(context.Background(), identity{Name: caller.name}), caller.session)
+		if _, err := rt.call(ctx, "echo_b0", map[string]interface{}{"message": "secret-" + caller.name}); err != nil {
+			t.Fatalf("call failed: %v", err)
+		}
+	}
+	logged, _ := os.ReadFile(path)
+	if strings.Contains(string(logged), "secret-") || !strings.Contains(string(logged), `"session":"s2"`) {
+		t.Errorf("slow call log = %s", logged)
+	}
+
+	// Jobs keep their payloads in memory only, so a restarted process knows they were dropped
+	store, err := newFileJobStore(filepath.Join(dir, "jobs"))
+	if err != nil {
+		t.Fatalf("newFileJobStore failed: %v", err)
+	}
+	jobs := filterJobPayloads(store, data)
+	finished := job{ID: "aa", Tool: "echo_b0", Identity: "alice", Session: "s1", Arguments: map[string]interface{}{"message": "secret-job"}, State: jobSucceeded, Content: contentOf(mcp.NewToolResponse(mcp.NewTextContent("secret-result")))}
+	running := job{ID: "bb", Tool: "echo_b0", Identity: "alice", Session: "s1", State: jobRunning}
+	for _, j := range []job{finished, running} {
+		if err := jobs.put(j); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	onDisk, _ := os.ReadFile(filepath.Join(dir, "jobs", "aa.json"))
+	if strings.Contains(string(onDisk), "secret-") {
+		t.Errorf("job on disk = %s", onDisk)
+	}
+	if j, _, _ := jobs.get("aa"); j.Content == nil || j.Arguments == nil || j.ResultDropped {
+		t.Errorf("job in this process = %+v, want its payloads back", j)
+	}
+	rt.jobs = store
+	result := handleJobResult(rt).(func(context.Context, JobRequest) (*mcp.ToolResponse, error))
+	if _, err := result(contextWithIdentity(context.Background(), identity{Name: "alice"}), JobRequest{JobID: "aa"}); err == nil || !strings.Contains(err.Error(), "not persisted") {
+		t.Errorf("result after a restart: %v", err)
+	}
+
+	// Purging deletes the matching records and finished jobs, and later calls are still logged
+	handler := newDataHandler(data, jobs, rt.slow, nil)
+	report, err := handler.purge("alice", "")
+	if err != nil {
+		t.Fatalf("purge failed: %v", err)
+	}
+	if report != (purgeReport{Jobs: 1, RunningJobs: 1, SlowCalls: 2}) {
+		t.Errorf("purge report = %+v", report)
+	}
+	if _, ok, _ := jobs.get("aa"); ok {
+		t.Error("finished job survived the purge")
+	}
+	if logged, _ := os.ReadFile(path); strings.Contains(string(logged), "alice") || !strings.Contains(string(logged), "bob") {
+		t.Errorf("slow call log after purge = %s", logged)
+	}
+	if _, err := rt.call(context.Background(), "echo_b0", map[string]interface{}{"message": "hi"}); err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	if logged, _ := os.ReadFile(path); strings.Count(string(logged), "\n") != 2 {
+		t.Errorf("slow call log after a later call = %s", logged)
+	}
+	if removed, err := handler.expire(time.Now().Add(time.Minute)); err != nil || removed != 2 {
+		t.Errorf("expire = %d, %v, want both records", removed, err)
+	}
+
+	for _, tc := range []struct {
+		method, query string
+		header        bool
+		status        int
+	}{
+		{http.MethodGet, "identity=bob", true, http.StatusMethodNotAllowed},
+		{http.MethodPost, "session=s2", false, http.StatusForbidden},
+		{http.MethodPost, "", true, http.StatusBadRequest},
+		{http.MethodPost, "session=s2", true, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, "/purge?"+tc.query, nil)
+		if tc.header {
+			req.Header.Set(purgeHeader, "1")
+		}
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s /purge?%s (header %v) = %d, want %d", tc.method, tc.query, tc.header, w.Code, tc.status)
+		}
+	}
+
+	// Results are cached no longer than they may be retained, and not at all when responses are dropped
+	cacheCfg := &CacheConfig{Backend: "disk", Results: []ResultCacheRule{{Tools: []string{"echo_*"}, TTL: Duration(time.Hour)}}}
+	if filtered := filterResultCache(cacheCfg, &DataHandlingConfig{Retention: Duration(time.Minute)}); filtered.Results[0].TTL != Duration(time.Minute) {
+		t.Errorf("Expected the cached results to expire with the retention, got %v", filtered.Results[0].TTL)
+	}
+	if filtered := filterResultCache(cacheCfg, &DataHandlingConfig{DropResponses: true}); len(filtered.Results) != 0 || filtered.Backend != "disk" {
+		t.Errorf("Expected no results to be cached when responses are dropped, got %+v", filtered)
+	}
+	if cacheCfg.Results[0].TTL != Duration(time.Hour) || filterResultCache(cacheCfg, nil) != cacheCfg {
+		t.Error("Expected the cache config to be left as configured")
+	}
+}
+
+// signJWT signs claims as a JWT with key, an *rsa.PrivateKey for RS256 or an *ecdsa.PrivateKey for ES256
+func signJWT(tb testing.TB, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		tb.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDC(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks := []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}
+	var mu sync.Mutex
+	fetches := 0
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{"issuer": provider.URL, "jwks_uri": provider.URL + "/keys"})
+		case "/keys":
+			mu.Lock()
+			fetches++
+			keys := jwks
+			mu.Unlock()
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer provider.Close()
+
+	clock := newFakeClock()
+	authz := newAuthorizer(&AuthConfig{
+		Tokens: []TokenConfig{{Token: "static", Identity: "ci", Roles: []string{"reader"}}},
+		Roles:  map[string]RoleConfig{"reader": {Tools: []string{"get_*"}}, "admin": {Tools: []string{"*"}}},
+		OIDC: &OIDCConfig{
+			Issuer:        provider.URL,
+			Audience:      "mcp-aggregator",
+			IdentityClaim: "email",
+			RolesClaim:    "realm_access.roles",
+			RoleMappings:  map[string][]string{"platform-admins": {"admin"}, "staff": {"reader"}},
+			TenantClaim:   "org",
+		},
+	})
+	authz.oidc.clock = clock
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":          provider.URL,
+			"aud":          []string{"account", "mcp-aggregator"},
+			"sub":          "u-1",
+			"email":        "ada@example.com",
+			"org":          "acme",
+			"exp":          clock.Now().Add(time.Hour).Unix(),
+			"realm_access": map[string]interface{}{"roles": []string{"staff", "offline_access"}},
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	id, ok := authz.authenticate(signJWT(t, "rsa-1", rsaKey, claims(nil)))
+	if !ok || id.Name != "ada@example.com" || id.Tenant != "acme" || !reflect.DeepEqual(id.Roles, []string{"reader"}) {
+		t.Fatalf("authenticate = %+v, %v", id, ok)
+	}
+	if !authz.allowed(id, "get_weather") || authz.allowed(id, "delete_all") {
+		t.Error("mapped roles not applied by the RBAC layer")
+	}
+	if id, ok := authz.authenticate("static"); !ok || id.Name != "ci" {
+		t.Errorf("static token = %+v, %v", id, ok)
+	}
+
+	valid := signJWT(t, "rsa-1", rsaKey, claims(nil))
+	parts := strings.Split(valid, ".")
+	forged := parts[0] + "." + encode([]byte(`{"iss":"`+provider.URL+`","aud":"mcp-aggregator","email":"eve","exp":9999999999}`)) + "." + parts[2]
+	unsigned := encode([]byte(`{"alg":"none","kid":"rsa-1"}`)) + "." + parts[1] + "."
+	for name, token := range map[string]string{
+		"wrong audience": signJWT(t, "rsa-1", rsaKey, claims(map[string]interface{}{"aud": "other"})),
+		"wrong issuer":   signJWT(t, "rsa-1", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example"})),
+		"expired":        signJWT(t, "rsa-1", rsaKey, claims(map[string]interface{}{"exp": clock.Now().Add(-2 * time.Minute).Unix()})),
+		"not yet valid":  signJWT(t, "rsa-1", rsaKey, claims(map[string]interface{}{"nbf": clock.Now().Add(2 * time.Minute).Unix()})),
+		"no expiry":      signJWT(t, "rsa-1", rsaKey, claims(map[string]interface{}{"exp": nil})),
+		"no identity":    signJWT(t, "rsa-1", rsaKey, claims(map[string]interface{}{"email": nil})),
+		"forged claims":  forged,
+		"unsigned":       unsigned,
+		"garbage":        "not-a-token",
+	} {
+		if id, ok := authz.authenticate(token); ok {
+			t.Errorf("%s token accepted as %+v", name, id)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("keys fetched %d times, want once", fetches)
+	}
+
+	// A token signed with a rotated-in key fetches the keys again, though not more than once a minute
+	mu.Lock()
+	jwks = append(jwks, map[string]string{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))})
+	mu.Unlock()
+	rotated := signJWT(t, "ec-1", ecKey, claims(nil))
+	if _, ok := authz.authenticate(rotated); ok {
+		t.Error("token signed with a new key accepted before the keys could be refreshed")
+	}
+	clock.advance(minJWKSRefresh)
+	if id, ok := authz.authenticate(rotated); !ok || id.Name != "ada@example.com" {
+		t.Errorf("token signed with the rotated-in key = %+v, %v", id, ok)
+	}
+	if fetches != 2 {
+		t.Errorf("keys fetched %d times, want twice", fetches)
+	}
+
+	// The HTTP transport attaches the identity of the token to the request
+	var seen identity
+	handler := authz.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = identityFromContext(r.Context())
+	}))
+	for token, status := range map[string]int{valid: http.StatusOK, forged: http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodPost, "/mcp", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("request status = %d, want %d", w.Code, status)
+		}
+	}
+	if seen.Name != "ada@example.com" {
+		t.Errorf("identity attached to the request = %+v", seen)
+	}
+}
+
+func TestUpstreamNetwork(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "upstream")
+	}))
+	defer backend.Close()
+
+	var connects int
+	var mu sync.Mutex
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		mu.Lock()
+		connects++
+		mu.Unlock()
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(target, buffered)
+			target.Close()
+		}()
+		_, _ = io.Copy(conn, target)
+		conn.Close()
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("user", "pass")
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// HTTP requests go through the proxy and trust the CA bundle
+	network, err := newUpstreamNetwork(&NetworkConfig{Proxy: proxyURL.String(), CAFile: caFile})
+	if err != nil {
+		t.Fatalf("newUpstreamNetwork failed: %v", err)
+	}
+	resp, err := network.httpClient().Get(backend.URL)
+	if err != nil {
+		t.Fatalf("GET through the proxy failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "upstream" {
+		t.Errorf("expected the upstream response, got %q", body)
+	}
+
+	// WebSocket connections are tunneled the same way
+	target, _ := url.Parse(strings.Replace(backend.URL, "https://", "wss://", 1))
+	conn, err := network.dial(context.Background(), target)
+	if err != nil {
+		t.Fatalf("dial through the proxy failed: %v", err)
+	}
+	tlsConn := tls.Client(conn, network.tlsConfig(target.Hostname()))
+	if err := tlsConn.Handshake(); err != nil {
+		t.Errorf("handshake with the CA bundle failed: %v", err)
+	}
+	tlsConn.Close()
+	mu.Lock()
+	if connects != 2 {
+		t.Errorf("expected 2 tunnels through the proxy, got %d", connects)
+	}
+	mu.Unlock()
+
+	// Without the CA bundle the certificate is not trusted
+	untrusted, _ := newUpstreamNetwork(&NetworkConfig{Proxy: proxyURL.String()})
+	if _, err := untrusted.httpClient().Get(backend.URL); err == nil {
+		t.Error("expected the certificate to be rejected without the CA bundle")
+	}
+
+	// Wrong proxy credentials are reported
+	proxyURL.User = url.UserPassword("user", "wrong")
+	refused, _ := newUpstreamNetwork(&NetworkConfig{Proxy: proxyURL.String()})
+	if _, err := refused.dial(context.Background(), target); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("expected the proxy to refuse the tunnel, got %v", err)
+	}
+
+	// NoProxy entries bypass the proxy
+	bypassing, _ := newUpstreamNetwork(&NetworkConfig{
+		Proxy:   "http://proxy:3128",
+		NoProxy: []string{"internal.example", "10.0.0.0/8", "api.example:8443"},
+	})
+	for rawURL, direct := range map[string]bool{
+		"https://internal.example/sse":    true,
+		"wss://mcp.internal.example/ws":   true,
+		"http://10.1.2.3:8080/sse":        true,
+		"https://api.example:8443/sse":    true,
+		"https://api.example/sse":         false,
+		"https://notinternal.example/sse": false,
+		"http://192.168.1.1/sse":          false,
+	} {
+		target, _ := url.Parse(rawURL)
+		proxy, err := bypassing.proxyFor(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (proxy == nil) != direct {
+			t.Errorf("%s: expected direct=%v, got proxy %v", rawURL, direct, proxy)
+		}
+	}
+	everything, _ := newUpstreamNetwork(&NetworkConfig{Proxy: "http://proxy:3128", NoProxy: []string{"*"}})
+	if proxy, _ := everything.proxyFor(target); proxy != nil {
+		t.Errorf("expected * to bypass the proxy, got %v", proxy)
+	}
+
+	// Invalid settings are rejected when the transport is created
+	for _, cfg := range []*NetworkConfig{
+		{Proxy: "socks5://proxy:1080"},
+		{NoProxy: []string{"10.0.0.0/33"}},
+		{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		{CAFile: os.Args[0]},
+	} {
+		if _, err := newRemoteTransport("remote", backend.URL, nil, cfg, 0); err == nil {
+			t.Errorf("expected %+v to be rejected", *cfg)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	backend := httptest.NewTLSServer(http.NotFoundHandler())
+	defer backend.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	refusedURL := "http://" + closed.Addr().String() + "/sse"
+	closed.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, tc := range []struct {
+		config MCPStdIOConfig
+		check  string
+	}{
+		{MCPStdIOConfig{URL: "http://mcp.invalid/sse"}, preflightDNS},
+		{MCPStdIOConfig{URL: refusedURL}, preflightConnect},
+		{MCPStdIOConfig{URL: backend.URL + "/sse"}, preflightTLS},
+		{MCPStdIOConfig{URL: backend.URL + "/sse", Network: &NetworkConfig{CAFile: caFile}}, ""},
+		{MCPStdIOConfig{URL: strings.Replace(backend.URL, "https://", "wss://", 1), Network: &NetworkConfig{CAFile: caFile}}, ""},
+	} {
+		err := preflightRemote(ctx, tc.config)
+		var failed *preflightError
+		switch {
+		case tc.check == "" && err != nil:
+			t.Errorf("%s: expected the preflight to pass, got %v", tc.config.URL, err)
+		case tc.check != "" && (!errors.As(err, &failed) || failed.check != tc.check):
+			t.Errorf("%s: expected the %s check to fail, got %v", tc.config.URL, tc.check, err)
+		}
+	}
+
+	// Servers failing their preflight are not started and report why in their status
+	registry := newBackendRegistry(mcp.ClientInfo{Name: "test", Version: "1.0.0"})
+	defer registry.shutdown()
+	err := registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"refused":   {URL: refusedURL},
+		"untrusted": {URL: backend.URL + "/sse"},
+		// Reachable, but not an MCP server
+		"notfound": {URL: backend.URL + "/sse", Network: &NetworkConfig{CAFile: caFile}},
+	}})
+	if err != nil {
+		t.Fatalf("Expected unreachable servers not to fail the apply, got %v", err)
+	}
+	want := map[string]string{"notfound": preflightInitialize, "refused": preflightConnect, "untrusted": preflightTLS}
+	for _, status := range registry.status() {
+		if status.State != "unreachable" || !strings.HasPrefix(status.Unreachable, want[status.Name]+": ") {
+			t.Errorf("%s: expected to be unreachable at the %s check, got %s %q", status.Name, want[status.Name], status.State, status.Unreachable)
+		}
+		if registry.named(status.Name) != nil {
+			t.Errorf("%s: expected no backend to be registered", status.Name)
+		}
+	}
+}
+
+func TestSessionScope(t *testing.T) {
+	alice := contextWithIdentity(context.Background(), identity{Name: "alice"})
+	bob := contextWithIdentity(context.Background(), identity{Name: "bob"})
+
+	scopes := map[string]string{
+		"alice":                 sessionScope(alice),
+		"alice session s1":      sessionScope(contextWithSession(alice, "s1")),
+		"bob session s1":        sessionScope(contextWithSession(bob, "s1")),
+		"bob session alice":     sessionScope(contextWithSession(bob, "alice")),
+		"bob session \"alice\"": sessionScope(contextWithSession(bob, `"alice"`)),
+	}
+	seen := make(map[string]string)
+	for caller, scope := range scopes {
+		if other, ok := seen[scope]; ok {
+			t.Errorf("Expected %s and %s to get their own scopes, both got %s", caller, other, scope)
+		}
+		seen[scope] = caller
+	}
+	if sessionScope(contextWithSession(alice, "s1")) != scopes["alice session s1"] {
+		t.Error("Expected a session to keep its scope across calls")
+	}
+}
+
+func TestRemoteConfig(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	serve := MCPStdIOConfig{Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve"}}
+	var mu sync.Mutex
+	document, _ := json.Marshal(Config{MCPStdIOServers: map[string]MCPStdIOConfig{"tools": serve}})
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, basic := r.BasicAuth()
+		if r.Header.Get("Authorization") != "Bearer config-token" && !(basic && user == "ops" && password == "hunter2") {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		_, _ = w.Write(document)
+	}))
+	defer server.Close()
+
+	if !isRemoteConfig(server.URL+"/mcp.json") || !isRemoteConfig("https://config.example.com/mcp.json") || isRemoteConfig("/etc/mcp/mcp.json") {
+		t.Error("Expected only http and https locations to be remote")
+	}
+
+	// Requests carry the bearer token, or the credentials embedded in the URL
+	if _, err := fetchRemoteConfig(server.URL + "/mcp.json"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected a fetch without credentials to be refused, got %v", err)
+	}
+	withCredentials := strings.Replace(server.URL, "http://", "http://ops:hunter2@", 1) + "/mcp.json"
+	if data, err := fetchRemoteConfig(withCredentials); err != nil || !bytes.Equal(data, document) {
+		t.Errorf("Expected basic auth from the URL, got %s (%v)", data, err)
+	}
+	t.Setenv("MCP_CONFIG_TOKEN", "config-token")
+	if data, err := fetchRemoteConfig(server.URL + "/mcp.json"); err != nil || !bytes.Equal(data, document) {
+		t.Errorf("Expected the bearer token to be sent, got %s (%v)", data, err)
+	}
+	mu.Lock()
+	status = http.StatusServiceUnavailable
+	mu.Unlock()
+	if _, err := fetchRemoteConfig(server.URL + "/mcp.json"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected a non-200 response to fail the fetch, got %v", err)
+	}
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+
+	// Polling applies a changed document once
+	registry := newBackendRegistry(mcp.ClientInfo{Name: "test", Version: "1.0.0"})
+	defer registry.shutdown()
+	profiles := newProfileSwitch(server.URL+"/mcp.json", "", registry, newApprovalQueue())
+	current, err := loadProfileConfig(profiles.location, "")
+	if err != nil {
+		t.Fatalf("Failed to load the remote config: %v", err)
+	}
+	if err := registry.apply(current); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	if current = refreshConfig(profiles, current); registry.reloadStatus() != nil {
+		t.Error("Expected an unchanged document not to be reloaded")
+	}
+	mu.Lock()
+	document, _ = json.Marshal(Config{MCPStdIOServers: map[string]MCPStdIOConfig{"tools": serve, "more": serve}})
+	mu.Unlock()
+	current = refreshConfig(profiles, current)
+	reloaded := registry.reloadStatus()
+	if reloaded == nil || !reloaded.Applied || registry.named("more") == nil {
+		t.Fatalf("Expected the changed document to be applied, got %+v", reloaded)
+	}
+	if refreshConfig(profiles, current); registry.reloadStatus() != reloaded {
+		t.Error("Expected the changed document to be applied only once")
+	}
+}
+
+func TestResponseAccessors(t *testing.T) {
+	if text, err := firstText(nil); text != "" || err == nil {
+		t.Errorf("Expected an error for a missing response, got %q, %v", text, err)
+	}
+	if _, err := firstText(mcp.NewToolResponse()); err == nil || !strings.Contains(err.Error(), "no content") {
+		t.Errorf("Expected an error for a response without content, got %v", err)
+	}
+	image := &mcp.ToolResponse{Content: []*mcp.Content{nil, {Type: mcp.ContentTypeImage}}}
+	if _, err := firstText(image); err == nil || !strings.Contains(err.Error(), "image content") {
+		t.Errorf("Expected an error naming the image content, got %v", err)
+	}
+	mixed := &mcp.ToolResponse{Content: []*mcp.Content{nil, mcp.NewTextContent("a"), {Type: mcp.ContentTypeImage}, mcp.NewTextContent("b")}}
+	if text, err := firstText(mixed); text != "a" || err != nil {
+		t.Errorf("Expected the first text, got %q, %v", text, err)
+	}
+	if text := responseText(mixed); text != "a\nb" {
+		t.Errorf("Expected the joined text, got %q", text)
+	}
+	if content := contentOf(nil); content == nil || len(content) != 0 {
+		t.Errorf("Expected no content for a missing response, got %v", content)
+	}
+
+	// Results the client library would fail or panic on are repaired before it decodes them
+	for raw, want := range map[string]string{
+		`{"content":[null,{"type":"text"},{"type":"text","text":"ok"}]}`: "\nok",
+		`{"content":null,"isError":false}`:                               "",
+		`{}`:                                                             "",
+	} {
+		var resp mcp.ToolResponse
+		if err := json.Unmarshal(repairToolResult(json.RawMessage(raw)), &resp); err != nil {
+			t.Errorf("Failed to decode the repaired %s: %v", raw, err)
+			continue
+		}
+		if text := responseText(&resp); text != want {
+			t.Errorf("Expected %q from %s, got %q", want, raw, text)
+		}
+	}
+	if repaired := repairToolResult(json.RawMessage(`{"content":[]}`)); string(repaired) != `{"content":[]}` {
+		t.Errorf("Expected a sound result to be left alone, got %s", repaired)
+	}
+}
+
+// fakeClock is a clock whose time moves only when a test advances it
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeClockWaiter
+}
+
+type fakeClockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeClockWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// advance moves the time forward by d, waking the waits that are due
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			waiting = append(waiting, waiter)
+			continue
+		}
+		waiter.ch <- c.now
+	}
+	c.waiters = waiting
+}
+
+// blockUntil waits for n waits on the clock, so a test advances it only once the goroutines under
+// test are parked on it
+func (c *fakeClock) blockUntil(tb testing.TB, n int) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiters)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("Expected %d waits on the clock, got %d", n, waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClock(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Cached entries expire by the cache's clock
+	clock := newFakeClock()
+	disk, err := newDiskCache(t.TempDir(), clock)
+	if err != nil {
+		t.Fatalf("Failed to open disk cache: %v", err)
+	}
+	stores := map[string]cacheStore{"memory": newMemoryCache(clock), "disk": disk}
+	for name, store := range stores {
+		if err := store.set("key", []byte("value"), time.Minute); err != nil {
+			t.Fatalf("%s: failed to set: %v", name, err)
+		}
+	}
+	clock.advance(59 * time.Second)
+	for name, store := range stores {
+		if _, ok, _ := store.get("key"); !ok {
+			t.Errorf("%s: expected a hit before the TTL passed", name)
+		}
+	}
+	clock.advance(2 * time.Second)
+	for name, store := range stores {
+		if _, ok, _ := store.get("key"); ok {
+			t.Errorf("%s: expected a miss once the TTL passed", name)
+		}
+	}
+
+	// The heartbeat ticks by the clock and liveness measures its age by it
+	clock = newFakeClock()
+	probes := newHealth(nil, clock)
+	clock.blockUntil(t, 1)
+	clock.advance(heartbeatInterval)
+	clock.blockUntil(t, 1)
+	if age := probes.heartbeatAge(); age != 0 || !probes.alive() {
+		t.Errorf("Expected a fresh heartbeat after the tick, got an age of %s", age)
+	}
+	probes.heartbeat.Store(clock.Now().Add(-maxHeartbeatAge - time.Second).UnixNano())
+	if probes.alive() {
+		t.Error("Expected a stalled heartbeat to fail liveness")
+	}
+
+	// Schedules run when the clock reaches their next time
+	clock = newFakeClock()
+	s := newScheduler(newBenchRouter(t, 1), clock)
+	schedule := ScheduleConfig{Name: "tick", Tool: "echo_b0", Arguments: map[string]interface{}{"message": "tick"}, Interval: Duration(time.Hour)}
+	next, err := scheduleFunc(schedule)
+	if err != nil {
+		t.Fatalf("Invalid schedule: %v", err)
+	}
+	go s.run(schedule, next)
+	clock.blockUntil(t, 1)
+	clock.advance(59 * time.Minute)
+	latest := func() (scheduleResult, bool) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		result, ok := s.results["tick"]
+		return result, ok
+	}
+	if _, ok := latest(); ok {
+		t.Error("Expected the schedule not to run before its interval passed")
+	}
+	clock.advance(time.Minute)
+	clock.blockUntil(t, 1)
+	result, ok := latest()
+	if !ok || !result.Time.Equal(clock.Now()) || textOf(result.Content) != "tick" {
+		t.Errorf("Expected a run at %s, got %+v", clock.Now(), result)
+	}
+
+	// Stateful instances are reaped once idle for the timeout by the clock
+	clock = newFakeClock()
+	instances := newStatefulInstances(mcp.ClientInfo{}, "session", clock)
+	ready := make(chan struct{})
+	close(ready)
+	instances.instances["idle"] = map[string]*sessionInstance{"b0": {ready: ready, err: fmt.Errorf("not started"), lastUsed: clock.Now()}}
+	go instances.reapIdle(time.Minute)
+	reaped := func() bool {
+		instances.mu.Lock()
+		defer instances.mu.Unlock()
+		return instances.instances["idle"] == nil
+	}
+	for i := 0; i < 3; i++ {
+		clock.blockUntil(t, 1)
+		clock.advance(15 * time.Second)
+	}
+	clock.blockUntil(t, 1)
+	if reaped() {
+		t.Error("Expected the instance to be kept before its idle timeout")
+	}
+	clock.advance(15 * time.Second)
+	clock.blockUntil(t, 1)
+	if !reaped() {
+		t.Error("Expected the instance to be reaped after its idle timeout")
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	rt := newBenchRouter(t, 1)
+	rt.registry.servers = map[string]MCPStdIOConfig{"b0": {Required: true}, "optional": {}}
+	probes := newHealth(rt.registry, systemClock{})
+
+	probe := func(handler http.HandlerFunc) (int, string) {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	if code, _ := probe(probes.live); code != http.StatusOK {
+		t.Errorf("Expected live process, got %d", code)
+	}
+	if code, body := probe(probes.ready); code != http.StatusServiceUnavailable || !strings.Contains(body, "starting") {
+		t.Errorf("Expected not ready before serving, got %d %s", code, body)
+	}
+
+	probes.markServing()
+	if code, body := probe(probes.ready); code != http.StatusOK {
+		t.Errorf("Expected ready with the required backend initialized, got %d %s", code, body)
+	}
+
+	rt.registry.servers["missing"] = MCPStdIOConfig{Required: true}
+	if code, body := probe(probes.ready); code != http.StatusServiceUnavailable || !strings.Contains(body, "missing") {
+		t.Errorf("Expected a missing required backend to fail readiness, got %d %s", code, body)
+	}
+
+	probes.heartbeat.Store(time.Now().Add(-time.Minute).UnixNano())
+	if code, _ := probe(probes.live); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a stalled heartbeat to fail liveness, got %d", code)
+	}
+}
+
+func TestRemoteBackends(t *testing.T) {
+	// newRemoteServer serves an echo tool whose messages are relayed by the test's SSE or WebSocket handler
+	newRemoteServer := func(t *testing.T) (io.WriteCloser, io.ReadCloser) {
+		serverIn, toServer := io.Pipe()
+		fromServer, serverOut := io.Pipe()
+		t.Cleanup(func() {
+			_ = toServer.Close()
+			_ = serverOut.Close()
+		})
+		server := mcp.NewServer(newStdioTransport("remote server", serverIn, serverOut, 0))
+		err := server.RegisterTool("echo_remote", "Echo the message", func(args BenchEchoArgs) (*mcp.ToolResponse, error) {
+			return mcp.NewToolResponse(mcp.NewTextContent(args.Message)), nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to register tool: %v", err)
+		}
+		if err := server.Serve(); err != nil {
+			t.Fatalf("Failed to serve: %v", err)
+		}
+		return toServer, fromServer
+	}
+
+	sse := http.NewServeMux()
+	var sseIn io.Writer
+	sse.HandleFunc("/sse", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer remote" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		toServer, fromServer := newRemoteServer(t)
+		sseIn = toServer
+		defer context.AfterFunc(r.Context(), func() { _ = fromServer.Close() })()
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: endpoint\ndata: /messages?sessionId=1\n\n")
+		w.(http.Flusher).Flush()
+		for messages := bufio.NewScanner(fromServer); messages.Scan(); {
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", messages.Text())
+			w.(http.Flusher).Flush()
+		}
+	})
+	sse.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = sseIn.Write(append(body, '\n'))
+		w.WriteHeader(http.StatusAccepted)
+	})
+	sseServer := httptest.NewServer(sse)
+	defer sseServer.Close()
+
+	wsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Failed to hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(r.Header.Get("Sec-WebSocket-Key")))
+		ws := &wsConn{conn: conn, reader: buffered.Reader, maxMessageSize: defaultMaxFrameSize}
+		toServer, fromServer := newRemoteServer(t)
+		defer fromServer.Close()
+		go func() {
+			for messages := bufio.NewScanner(fromServer); messages.Scan(); {
+				_ = ws.write(context.Background(), messages.Bytes())
+			}
+		}()
+		for {
+			message, err := ws.read()
+			if err != nil {
+				return
+			}
+			_, _ = toServer.Write(append(message, '\n'))
+		}
+	}))
+	defer wsServer.Close()
+
+	servers := map[string]MCPStdIOConfig{
+		"sse": {URL: sseServer.URL + "/sse", Headers: map[string]string{"Authorization": "Bearer remote"}},
+		"ws":  {URL: "ws" + strings.TrimPrefix(wsServer.URL, "http")},
+	}
+	for name, config := range servers {
+		b, err := startBackend(name, config, mcp.ClientInfo{Name: "test", Version: "1.0.0"})
+		if err != nil {
+			t.Fatalf("Failed to start %s backend: %v", name, err)
+		}
+		if err := initializeBackend(b); err != nil {
+			t.Fatalf("Failed to initialize %s backend: %v", name, err)
+		}
+		if !b.hasTool("echo_remote") {
+			t.Errorf("Expected %s backend to list echo_remote, got %v", name, b.listedTools())
+		}
+		resp, err := b.client.CallTool(context.Background(), "echo_remote", BenchEchoArgs{Message: "hello " + name})
+		if err != nil || responseText(resp) != "hello "+name {
+			t.Errorf("Expected %s backend to echo, got %v %v", name, resp, err)
+		}
+		stopBackend(b)
+		if !b.hasExited(time.Second) {
+			t.Errorf("Expected %s backend to disconnect", name)
+		}
+	}
+
+	// Unreachable servers fail initialization and count as exited
+	b, err := startBackend("down", MCPStdIOConfig{URL: "http://127.0.0.1:1/sse"}, mcp.ClientInfo{Name: "test", Version: "1.0.0"})
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+	if err := initializeBackend(b); err == nil || !b.hasExited(time.Second) {
+		t.Errorf("Expected an unreachable server to fail, got %v", err)
+	}
+	if _, err := startBackend("bad", MCPStdIOConfig{URL: "ftp://example.com"}, mcp.ClientInfo{}); err == nil {
+		t.Error("Expected an unsupported scheme to be rejected")
+	}
+}
+
+func TestDiscoverEndpoints(t *testing.T) {
+	endpoints := filepath.Join(t.TempDir(), "endpoints.json")
+	if err := os.WriteFile(endpoints, []byte(`{"search": "http://search.mcp.svc:8080/sse", "files": "ws://files:9000/mcp"}`), 0o600); err != nil {
+		t.Fatalf("Failed to write endpoints: %v", err)
+	}
+	t.Setenv("MCP_ENDPOINT_FILES", "ws://files.mcp.svc:9000/mcp")
+	t.Setenv("MCP_ENDPOINT_GITHUB_TOOLS", "http://github-tools:8080/sse")
+
+	cfg := Config{
+		Endpoints: endpoints,
+		MCPStdIOServers: map[string]MCPStdIOConfig{
+			"search": {Required: true},
+			"local":  {Command: "hello"},
+		},
+	}
+	if err := discoverEndpoints(&cfg); err != nil {
+		t.Fatalf("Failed to discover endpoints: %v", err)
+	}
+	expected := map[string]string{
+		"search":       "http://search.mcp.svc:8080/sse",
+		"files":        "ws://files.mcp.svc:9000/mcp",
+		"github-tools": "http://github-tools:8080/sse",
+		"local":        "",
+	}
+	if len(cfg.MCPStdIOServers) != len(expected) {
+		t.Errorf("Expected %d servers, got %v", len(expected), cfg.MCPStdIOServers)
+	}
+	for name, url := range expected {
+		if cfg.MCPStdIOServers[name].URL != url {
+			t.Errorf("Expected %s at '%s', got '%s'", name, url, cfg.MCPStdIOServers[name].URL)
+		}
+	}
+	if !cfg.MCPStdIOServers["search"].Required {
+		t.Error("Expected discovery to keep the configured settings")
+	}
+
+	// Remote-only mode refuses to spawn the local server
+	registry := newBackendRegistry(mcp.ClientInfo{Name: "test", Version: "1.0.0"})
+	err := registry.apply(Config{RemoteOnly: true, MCPStdIOServers: map[string]MCPStdIOConfig{"local": {Command: "hello"}}})
+	if err == nil || !strings.Contains(err.Error(), "remote-only") {
+		t.Errorf("Expected remote-only mode to reject a local server, got %v", err)
+	}
+	if len(registry.list()) != 0 {
+		t.Error("Expected no backends to start")
+	}
+}
+
+func TestDiscoveryProviders(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "secret" || r.URL.Query().Get("ns") != "tools" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			fmt.Fprint(w, `{"consul": [], "search": ["mcp", "web"], "files": ["mcp"]}`)
+		case "/v1/health/service/search":
+			fmt.Fprint(w, `[{"Node": {"Address": "10.0.0.1"}, "Service": {"Port": 8080, "Tags": ["mcp", "web"], "Namespace": "tools"}}]`)
+		case "/v1/health/service/files":
+			fmt.Fprint(w, `[{"Service": {"Meta": {"mcp-url": "ws://files:9000/mcp"}, "Namespace": "tools"}}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer consul.Close()
+
+	etcd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || string(req.Key) != "/mcp/backends/" || string(req.RangeEnd) != "/mcp/backends0" {
+			http.Error(w, "bad range", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"kvs": []map[string][]byte{
+			{"key": []byte("/mcp/backends/search"), "value": []byte(`{"URL": "http://search:8080/sse", "Namespace": "tools", "Tags": ["web"]}`)},
+			{"key": []byte("/mcp/backends/other"), "value": []byte(`{"URL": "http://other:8080/sse", "Namespace": "team-b"}`)},
+			{"key": []byte("/mcp/backends/broken"), "value": []byte(`not json`)},
+		}})
+	}))
+	defer etcd.Close()
+
+	providers := map[string]*DiscoveryConfig{
+		"consul": {Provider: "consul", Address: consul.URL, Namespace: "tools", Token: "secret"},
+		"etcd":   {Provider: "etcd", Address: etcd.URL, Namespace: "tools"},
+	}
+	expected := map[string]map[string]MCPStdIOConfig{
+		"consul": {
+			"search": {URL: "http://10.0.0.1:8080/sse", Tags: []string{"web"}},
+			"files":  {URL: "ws://files:9000/mcp"},
+		},
+		"etcd": {
+			"search": {URL: "http://search:8080/sse", Tags: []string{"web"}},
+		},
+	}
+	for name, cfg := range providers {
+		provider, err := newDiscoveryProvider(cfg)
+		if err != nil {
+			t.Fatalf("Failed to create %s provider: %v", name, err)
+		}
+		discovered, err := provider.discover(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to discover through %s: %v", name, err)
+		}
+		if servers := discoveredServers(discovered); !reflect.DeepEqual(servers, expected[name]) {
+			t.Errorf("Expected %s to discover %v, got %v", name, expected[name], servers)
+		}
+	}
+	if _, err := newDiscoveryProvider(&DiscoveryConfig{Provider: "zookeeper"}); err == nil {
+		t.Error("Expected an unknown provider to be rejected")
+	}
+
+	// Discovered servers join the configured ones, which take precedence
+	registry := newBackendRegistry(mcp.ClientInfo{Name: "test", Version: "1.0.0"})
+	defer registry.shutdown()
+	if err := registry.apply(Config{RemoteOnly: true, MCPStdIOServers: map[string]MCPStdIOConfig{"search": {URL: "http://127.0.0.1:1/sse", Required: true}}}); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	if err := registry.setDiscovered(map[string]MCPStdIOConfig{"search": {URL: "http://search:8080/sse"}, "files": {URL: "http://127.0.0.1:1/sse"}}); err != nil {
+		t.Fatalf("Failed to apply discovered servers: %v", err)
+	}
+	if len(registry.servers) != 2 || !registry.servers["search"].Required {
+		t.Errorf("Expected the configured search server and the discovered files server, got %v", registry.servers)
+	}
+}
+
+func TestSystemdIntegration(t *testing.T) {
+	dir := t.TempDir()
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "notify"), Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen for notifications: %v", err)
+	}
+	defer notify.Close()
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(dir, "notify"))
+
+	sdNotify("READY=1")
+	buf := make([]byte, 64)
+	_ = notify.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := notify.Read(buf); err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("Expected READY=1, got '%s' %v", buf[:n], err)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "4000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval := watchdogInterval(); interval != 2*time.Second {
+		t.Errorf("Expected the watchdog to be pinged every 2s, got %v", interval)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if interval := watchdogInterval(); interval != 0 {
+		t.Errorf("Expected the watchdog of another process to be ignored, got %v", interval)
+	}
+
+	// A stale unix socket from an earlier run is replaced
+	socket := filepath.Join(dir, "mcp.sock")
+	for i := 0; i < 2; i++ {
+		listener, err := listen("unix:" + socket)
+		if err != nil {
+			t.Fatalf("Failed to listen on unix socket: %v", err)
+		}
+		if i == 0 {
+			// Leave the socket file behind, as a crashed process would
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		}
+		listener.Close()
+	}
+
+	if _, err := listen("systemd:mcp"); err == nil {
+		t.Error("Expected no activated socket outside systemd")
+	}
+}
+
+func TestLogSinks(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Authorization") != "Bearer logs" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		var payload map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer collector.Close()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen for syslog: %v", err)
+	}
+	defer udp.Close()
+
+	sinks, err := newLogSinks([]LogSinkConfig{
+		{Type: "otlp", Endpoint: collector.URL, Headers: map[string]string{"Authorization": "Bearer logs"}, ServiceName: "aggregator"},
+		{Type: "syslog", Address: "udp://" + udp.LocalAddr().String(), Tag: "mcp"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create sinks: %v", err)
+	}
+	var stderr bytes.Buffer
+	logger := log.New(sinks.writer(&stderr), "", log.LstdFlags)
+	logger.Printf("StdIO client 'search' stderr: warming up")
+	sinks.close()
+
+	if !strings.Contains(stderr.String(), "warming up") {
+		t.Errorf("Expected the line on stderr, got %q", stderr.String())
+	}
+
+	buf := make([]byte, 1024)
+	_ = udp.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := udp.ReadFrom(buf)
+	if err != nil || !strings.Contains(string(buf[:n]), "mcp") || !strings.HasSuffix(strings.TrimSpace(string(buf[:n])), "StdIO client 'search' stderr: warming up") {
+		t.Errorf("Expected a syslog message without the log timestamp, got %q %v", buf[:n], err)
+	}
+
+	select {
+	case payload := <-received:
+		encoded, _ := json.Marshal(payload)
+		for _, expected := range []string{`"stringValue":"aggregator"`, `"stringValue":"StdIO client 'search' stderr: warming up"`, `"key":"mcp.backend","value":{"stringValue":"search"}`} {
+			if !strings.Contains(string(encoded), expected) {
+				t.Errorf("Expected %s in OTLP payload %s", expected, encoded)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the OTLP sink to ship the record on close")
+	}
+
+	if _, err := newLogSinks([]LogSinkConfig{{Type: "kafka"}}); err == nil {
+		t.Error("Expected an unknown sink type to be rejected")
+	}
+}
+
+func TestCorrelationIDs(t *testing.T) {
+	request := func(meta string) *transport.BaseJsonRpcMessage {
+		return transport.NewBaseMessageRequest(&transport.BaseJSONRPCRequest{
+			Jsonrpc: "2.0",
+			Method:  "tools/call",
+			Params:  json.RawMessage(`{"name": "echo_b0", "arguments": {"message": "hi"}` + meta + `}`),
+		})
+	}
+
+	// A caller's correlation id is kept, otherwise a new one is generated
+	ctx := observeCorrelation(context.Background(), request(`, "_meta": {"correlationId": "host-1"}`))
+	if id := correlationIDFromContext(ctx); id != "host-1" {
+		t.Errorf("Expected the caller's correlation id, got '%s'", id)
+	}
+	generated := correlationIDFromContext(observeCorrelation(context.Background(), request("")))
+	if len(generated) != 16 {
+		t.Errorf("Expected a generated correlation id, got '%s'", generated)
+	}
+	if metaFromContext(ctx)[correlationMetaKey] != "host-1" {
+		t.Errorf("Expected the correlation id in the forwarded _meta, got %v", metaFromContext(ctx))
+	}
+
+	// The id appears in the call's log lines, audit record and metric exemplar
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 1)
+	rt.metrics = newMetrics()
+	if _, err := rt.call(ctx, "echo_b0", map[string]interface{}{"message": "hi"}); err != nil {
+		t.Fatalf("Failed to call tool: %v", err)
+	}
+	log.SetOutput(os.Stderr)
+	if !strings.Contains(logs.String(), "[host-1] Tool 'echo_b0' succeeded") {
+		t.Errorf("Expected a log line with the correlation id, got %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), `"correlationId":"host-1"`) {
+		t.Errorf("Expected an audit record with the correlation id, got %s", logs.String())
+	}
+
+	recorder := httptest.NewRecorder()
+	scrape := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	scrape.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rt.metrics.ServeHTTP(recorder, scrape)
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"# TYPE mcp_tool_calls counter",
+		`mcp_tool_calls_total{tool="echo_b0",outcome="success"} 1 # {correlation_id="host-1"} 1`,
+		"# EOF",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %s in OpenMetrics output:\n%s", expected, body)
+		}
+	}
+}
+
+func TestSlowCalls(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.jsonl")
+	rt := newBenchRouter(t, 1)
+	var err error
+	if rt.slow, err = newSlowCallLogger(&SlowCallConfig{Threshold: Duration(time.Nanosecond), Log: path}, nil); err != nil {
+		t.Fatalf("Failed to create slow call logger: %v", err)
+	}
+	defer rt.slow.log.close()
+	ctx := contextWithCorrelationID(context.Background(), "slow-1")
+	args := map[string]interface{}{"message": "hi", "auth": map[string]interface{}{"Token": "hunter2"}}
+	if _, err := rt.call(ctx, "echo_b0", args); err != nil {
+		t.Fatalf("Failed to call tool: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read slow call log: %v", err)
+	}
+	var record slowCallRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("Failed to decode slow call %s: %v", data, err)
+	}
+	if record.Tool != "echo_b0" || record.Backend != "b0" || record.CorrelationID != "slow-1" {
+		t.Errorf("Expected the call's tool, backend and correlation id, got %s", data)
+	}
+	if record.Timing.Upstream == "0s" || record.Timing.Transport == "0s" {
+		t.Errorf("Expected a transport and upstream breakdown, got %+v", record.Timing)
+	}
+	if strings.Contains(string(data), "hunter2") || !strings.Contains(string(data), `"Token":"[REDACTED]"`) {
+		t.Errorf("Expected the token to be redacted, got %s", data)
+	}
+	if len(record.Response) != 1 || record.Response[0].TextContent.Text != "hi" {
+		t.Errorf("Expected the response to be captured, got %s", data)
+	}
+	if args["auth"].(map[string]interface{})["Token"] != "hunter2" {
+		t.Error("Expected redaction to leave the forwarded arguments untouched")
+	}
+
+	// Calls under the threshold are not captured
+	rt.slow.threshold = time.Hour
+	if _, err := rt.call(ctx, "echo_b0", args); err != nil {
+		t.Fatalf("Failed to call tool: %v", err)
+	}
+	if again, _ := os.ReadFile(path); len(again) != len(data) {
+		t.Errorf("Expected a fast call not to be captured, got %s", again)
+	}
+}
+
+func TestOutputValidation(t *testing.T) {
+	rt := newBenchRouter(t, 1)
+	var schema map[string]interface{}
+	_ = json.Unmarshal([]byte(`{"type": "object", "required": ["temperature"], "properties": {"temperature": {"type": "number", "maximum": 60}, "unit": {"enum": ["C", "F"]}}}`), &schema)
+	rt.outputs = newOutputValidator(map[string]OutputExpectation{"echo_b0": {ContentTypes: []string{"text"}, Schema: schema}}, nil)
+	// Validated results are decoded even when the host asked for them to be relayed raw
+	ctx := contextWithPassthrough(context.Background(), rt.raw, 0)
+
+	resp, err := rt.call(ctx, "echo_b0", map[string]interface{}{"message": `{"temperature": 21.5, "unit": "C"}`})
+	if err != nil || len(resp.Content) != 1 || !strings.Contains(responseText(resp), "21.5") {
+		t.Fatalf("Expected a valid response to pass through unchanged, got %+v, %v", resp, err)
+	}
+
+	for message, want := range map[string]string{
+		`{"temperature": 99, "unit": "K"}`: "$.temperature: 99 is greater than 60; $.unit: \"K\" is not one of the allowed values",
+		`{"unit": "C"}`:                    "missing required property 'temperature'",
+		`sunny`:                            "output is not JSON",
+		``:                                 "no content",
+	} {
+		_, err := rt.call(ctx, "echo_b0", map[string]interface{}{"message": message})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q to be rejected with %q, got %v", message, want, err)
+		}
+	}
+
+	// Repair replaces an empty response with an explanation instead of failing the call
+	rt.outputs.expectations["echo_b0"] = OutputExpectation{Repair: true}
+	resp, err = rt.call(ctx, "echo_b0", map[string]interface{}{"message": " "})
+	if err != nil || len(resp.Content) != 1 || responseText(resp) != "tool 'echo_b0' returned no content" {
+		t.Errorf("Expected the empty response to be repaired, got %+v, %v", resp, err)
+	}
+}
+
+func TestStrictRouting(t *testing.T) {
+	rt := newBenchRouter(t, 2)
+	// Without strict routing an unknown name is tried on every backend
+	resp, err := rt.call(context.Background(), "shutdown", nil)
+	if err != nil || responseText(resp) != "method not found" {
+		t.Fatalf("Expected the unknown tool to be tried on the backends, got %+v, %v", resp, err)
+	}
+
+	rt.strict = true
+	if _, err := rt.call(context.Background(), "shutdown", nil); err == nil || err.Error() != "unknown tool 'shutdown'" {
+		t.Errorf("Expected strict routing to reject the unknown tool, got %v", err)
+	}
+	if _, err := rt.call(context.Background(), "echo_b1", map[string]interface{}{"message": "hi"}); err != nil {
+		t.Errorf("Expected strict routing to forward an advertised tool, got %v", err)
+	}
+}
+
+func TestArgumentSanitizers(t *testing.T) {
+	sanitizers, err := newArgumentSanitizers([]ArgumentSanitizer{
+		{Tools: []string{"fs_*"}, Arguments: []string{"path", "paths"}, Type: "path", Roots: []string{"/srv/data"}},
+		{Arguments: []string{"url"}, Type: "url", Hosts: []string{"*.example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create sanitizers: %v", err)
+	}
+
+	for _, tc := range []struct {
+		tool      string
+		arguments map[string]interface{}
+		want      string
+	}{
+		{"fs_read", map[string]interface{}{"path": "/srv/data/a/../../../etc/passwd"}, "contains '..'"},
+		{"fs_read", map[string]interface{}{"path": "/srv/database"}, "outside the allowed roots"},
+		{"fs_read", map[string]interface{}{"path": "notes.txt"}, "not absolute"},
+		{"fs_read", map[string]interface{}{"paths": []interface{}{"/srv/data/a", "/etc"}}, "outside the allowed roots"},
+		{"browse", map[string]interface{}{"url": "file:///etc/passwd"}, "scheme 'file' is not allowed"},
+		{"browse", map[string]interface{}{"url": "http://169.254.169.254/latest"}, "host '169.254.169.254' is not allowed"},
+	} {
+		if _, err := sanitizers.sanitize(tc.tool, tc.arguments); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Expected %v to be rejected with %q, got %v", tc.arguments, tc.want, err)
+		}
+	}
+
+	args := map[string]interface{}{"path": "/srv/data//reports/./q1.csv", "url": "https://docs.example.com/x"}
+	checked, err := sanitizers.sanitize("fs_read", args)
+	if err != nil {
+		t.Fatalf("Expected the arguments to pass, got %v", err)
+	}
+	if checked.(map[string]interface{})["path"] != "/srv/data/reports/q1.csv" || args["path"] != "/srv/data//reports/./q1.csv" {
+		t.Errorf("Expected a cleaned copy of the path, got %v", checked)
+	}
+	// Rules only apply to the tools they match
+	if _, err := sanitizers.sanitize("other", map[string]interface{}{"path": "/etc/passwd"}); err != nil {
+		t.Errorf("Expected the path rule not to apply to other tools, got %v", err)
+	}
+
+	if _, err := newArgumentSanitizers([]ArgumentSanitizer{{Arguments: []string{"path"}, Type: "path", Roots: []string{"data"}}}); err == nil {
+		t.Error("Expected a relative root to be rejected")
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "quota.json")
+	cfg := &QuotaConfig{File: file, Weights: map[string]float64{"echo_*": 2, "echo_b1": 5}, Monthly: map[string]float64{"*": 6, "admin": 100}}
+	quotas, err := openQuotaTracker(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open quotas: %v", err)
+	}
+	month := time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC)
+	quotas.now = func() time.Time { return month }
+	rt := newBenchRouter(t, 2)
+	rt.quotas = quotas
+	alice := contextWithIdentity(context.Background(), identity{Name: "alice"})
+	args := map[string]interface{}{"message": "hi"}
+
+	for i := 0; i < 3; i++ {
+		if _, err := rt.call(alice, "echo_b0", args); err != nil {
+			t.Fatalf("Expected call %d to fit the quota, got %v", i, err)
+		}
+	}
+	if _, err := rt.call(alice, "echo_b0", args); err == nil || !strings.Contains(err.Error(), "quota exceeded: 'alice' has used 6 of its monthly quota of 6") {
+		t.Errorf("Expected the quota to be exhausted, got %v", err)
+	}
+	// The most specific weight applies, and identities with their own quota are not affected
+	admin := contextWithIdentity(context.Background(), identity{Name: "admin"})
+	if _, err := rt.call(admin, "echo_b1", args); err != nil {
+		t.Errorf("Expected admin to have quota left, got %v", err)
+	}
+	if usage := quotas.usage("2026-03", "admin"); usage.Cost != 5 || usage.Calls["echo_b1"] != 1 {
+		t.Errorf("Expected echo_b1 to cost 5, got %+v", usage)
+	}
+
+	// Usage survives a restart
+	quotas.close()
+	reopened, err := openQuotaTracker(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen quotas: %v", err)
+	}
+	defer reopened.close()
+	reopened.now = func() time.Time { return month }
+	if _, err := reopened.charge("alice", "echo_b0"); err == nil {
+		t.Error("Expected the persisted usage to keep alice over quota")
+	}
+	if usage := reopened.usage("2026-03", "alice"); usage.Cost != 6 || usage.Calls["echo_b0"] != 3 {
+		t.Errorf("Expected alice's usage to be restored, got %+v", usage)
+	}
+	// A new month starts with a fresh quota
+	reopened.now = func() time.Time { return month.Add(time.Hour) }
+	if _, err := reopened.charge("alice", "echo_b0"); err != nil {
+		t.Errorf("Expected the quota to reset in April, got %v", err)
+	}
+}
+
+func TestToolBudgets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "budgets.json")
+	cfg := &ToolBudgetConfig{File: file, Rules: []ToolBudgetRule{
+		{Tools: []string{"echo_b0"}, Daily: 2},
+		{Name: "night", Tools: []string{"echo_b1"}, Hours: "22:00-06:00", TimeZone: "Europe/Berlin"},
+	}}
+	budgets, err := openToolBudgets(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open budgets: %v", err)
+	}
+	day := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	budgets.now = func() time.Time { return day }
+	rt := newBenchRouter(t, 2)
+	rt.budgets = budgets
+	rt.quotas, _ = openQuotaTracker(&QuotaConfig{Monthly: map[string]float64{"*": 100}})
+	rt.quotas.now = func() time.Time { return day }
+	args := map[string]interface{}{"message": "hi"}
+
+	for i := 0; i < 2; i++ {
+		if _, err := rt.call(context.Background(), "echo_b0", args); err != nil {
+			t.Fatalf("Expected call %d to fit the budget, got %v", i, err)
+		}
+	}
+	if _, err := rt.call(context.Background(), "echo_b0", args); err == nil || !strings.Contains(err.Error(), "budget exhausted: 'echo_b0' has used all 2 of its calls for 2026-03-31, the budget resets at 2026-04-01T00:00:00Z") {
+		t.Errorf("Expected the budget to be exhausted, got %v", err)
+	}
+	if _, err := rt.call(context.Background(), "echo_b1", args); err == nil || !strings.Contains(err.Error(), "next from 2026-03-31T22:00:00+02:00") {
+		t.Errorf("Expected echo_b1 to be refused outside its hours, got %v", err)
+	}
+	if usage := rt.quotas.usage("2026-03", "anonymous"); usage.Cost != 2 || usage.Calls["echo_b1"] != 0 {
+		t.Errorf("Expected the calls refused by the budgets to get their quota back, got %+v", usage)
+	}
+	budgets.now = func() time.Time { return day.Add(11 * time.Hour) }
+	if _, err := rt.call(context.Background(), "echo_b1", args); err != nil {
+		t.Errorf("Expected echo_b1 to be allowed at night, got %v", err)
+	}
+	if _, err := openToolBudgets(&ToolBudgetConfig{Rules: []ToolBudgetRule{{Tools: []string{"x"}, Hours: "9-18"}}}); err == nil {
+		t.Error("Expected invalid hours to be refused")
+	}
+
+	// Counts survive a restart, and a new day starts with a fresh budget
+	budgets.close()
+	reopened, err := openToolBudgets(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen budgets: %v", err)
+	}
+	defer reopened.close()
+	reopened.now = func() time.Time { return day }
+	if _, err := reopened.charge("echo_b0"); err == nil {
+		t.Error("Expected the persisted count to keep echo_b0 over budget")
+	}
+	reopened.now = func() time.Time { return day.Add(12 * time.Hour) }
+	if _, err := reopened.charge("echo_b0"); err != nil {
+		t.Errorf("Expected the budget to reset the next day, got %v", err)
+	}
+}
+
+func TestSpendGuard(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "spend.json")
+	approvals := newApprovalQueue()
+	cfg := &SpendConfig{
+		File:            file,
+		Costs:           map[string]float64{"echo_*": 1, "echo_b1": 0},
+		Daily:           map[string]SpendLimit{"*": {Approve: 2, Block: 3}},
+		ApprovalTimeout: Duration(5 * time.Second),
+	}
+	spend, err := openSpendGuard(cfg, approvals)
+	if err != nil {
+		t.Fatalf("Failed to open spend: %v", err)
+	}
+	day := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	spend.now = func() time.Time { return day }
+	rt := newBenchRouter(t, 2)
+	rt.spend = spend
+	rt.quotas, _ = openQuotaTracker(&QuotaConfig{Monthly: map[string]float64{"*": 100}})
+	rt.quotas.now = func() time.Time { return day }
+	rt.budgets, _ = openToolBudgets(&ToolBudgetConfig{Rules: []ToolBudgetRule{{Name: "echo", Tools: []string{"echo_b0"}, Daily: 100}}})
+	rt.budgets.now = func() time.Time { return day }
+	alice := contextWithIdentity(context.Background(), identity{Name: "alice"})
+	args := map[string]interface{}{"message": "hi"}
+
+	for i := 0; i < 2; i++ {
+		if _, err := rt.call(alice, "echo_b0", args); err != nil {
+			t.Fatalf("Expected call %d to be under the approval threshold, got %v", i, err)
+		}
+	}
+	// Free tools are never held
+	if _, err := rt.call(alice, "echo_b1", args); err != nil {
+		t.Errorf("Expected a free tool to be called, got %v", err)
+	}
+
+	// Past the threshold, calls wait for an operator
+	result := make(chan error, 1)
+	go func() {
+		_, err := rt.call(alice, "echo_b0", args)
+		result <- err
+	}()
+	var pending []*pendingApproval
+	for deadline := time.Now().Add(5 * time.Second); len(pending) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		approvals.mu.Lock()
+		for _, approval := range approvals.pending {
+			pending = append(pending, approval)
+		}
+		approvals.mu.Unlock()
+	}
+	if len(pending) != 1 || !strings.Contains(pending[0].Reason, "over its approval threshold of 2.00") {
+		t.Fatalf("Expected the call to await approval, got %+v", pending)
+	}
+	approvals.decide(pending[0].ID, true)
+	if err := <-result; err != nil {
+		t.Errorf("Expected the approved call to go through, got %v", err)
+	}
+	if _, err := rt.call(alice, "echo_b0", args); err == nil || !strings.Contains(err.Error(), "spend limit reached: 'alice' has spent 3.00 of its daily limit of 3.00 USD") {
+		t.Errorf("Expected the limit to block the call, got %v", err)
+	}
+	// Blocked calls get their quota and budget back
+	if usage := rt.quotas.usage("2026-03", "alice"); usage.Calls["echo_b0"] != 3 {
+		t.Errorf("Expected the blocked call not to be charged to the quota, got %+v", usage)
+	}
+	if count := rt.budgets.days["echo"]; count.Calls != 3 {
+		t.Errorf("Expected the blocked call not to be counted against the budget, got %+v", count)
+	}
+
+	tools, _ := rt.catalog(context.Background(), "")
+	for _, tool := range tools {
+		priced := tool.Description != nil && strings.HasSuffix(*tool.Description, "(Costs 1 USD per call)")
+		if priced != (tool.Name == "echo_b0") {
+			t.Errorf("Expected only echo_b0 to show its price, got %s: %v", tool.Name, tool.Description)
+		}
+	}
+
+	// Spend survives a restart, and a new day starts afresh
+	spend.close()
+	reopened, err := openSpendGuard(cfg, approvals)
+	if err != nil {
+		t.Fatalf("Failed to reopen spend: %v", err)
+	}
+	defer reopened.close()
+	if spent := reopened.spent("2026-03-31", "alice"); spent != 3 {
+		t.Errorf("Expected alice's spend to be restored, got %g", spent)
+	}
+	reopened.now = func() time.Time { return day.Add(24 * time.Hour) }
+	if err := reopened.charge(alice, "echo_b0", args); err != nil {
+		t.Errorf("Expected the spend to reset the next day, got %v", err)
+	}
+}
+
+func TestUsageExport(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+	ledger, err := openUsageLedger(&UsageConfig{File: file})
+	if err != nil {
+		t.Fatalf("Failed to open usage ledger: %v", err)
+	}
+	rt := newBenchRouter(t, 2)
+	rt.ledger = ledger
+	alice := contextWithIdentity(context.Background(), identity{Name: "alice"})
+	args := map[string]interface{}{"message": "hi"}
+	for _, tool := range []string{"echo_b0", "echo_b0", "echo_b1"} {
+		if _, err := rt.call(alice, tool, args); err != nil {
+			t.Fatalf("Failed to call %s: %v", tool, err)
+		}
+	}
+	// Old buckets fall outside the range
+	ledger.record("bob", "echo_b0", "b0", time.Now().Add(-48*time.Hour), time.Second)
+
+	server := httptest.NewServer(ledger)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "?format=csv&from=" + time.Now().Add(-time.Hour).Format(time.RFC3339))
+	if err != nil {
+		t.Fatalf("Failed to export usage: %v", err)
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV export: %v", err)
+	}
+	if len(rows) != 3 || strings.Join(rows[0], ",") != "bucket,identity,tool,backend,count,duration_seconds" {
+		t.Fatalf("Expected a header and two records, got %v", rows)
+	}
+	if rows[1][1] != "alice" || rows[1][2] != "echo_b0" || rows[1][3] != "b0" || rows[1][4] != "2" || rows[2][2] != "echo_b1" {
+		t.Errorf("Expected alice's calls aggregated per tool and backend, got %v", rows)
+	}
+	if resp, err := http.Get(server.URL + "?format=xml"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown format to be rejected, got %v, %v", resp, err)
+	}
+
+	// Records are saved for the usage-export command
+	ledger.close()
+	records, err := readUsageFile(file)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("Expected three saved records, got %+v, %v", records, err)
+	}
+	var out bytes.Buffer
+	if err := writeUsage(&out, filterUsage(records, time.Time{}, time.Now().Add(-24*time.Hour)), "json"); err != nil {
+		t.Fatalf("Failed to write JSON export: %v", err)
+	}
+	var exported []usageRecord
+	if err := json.Unmarshal(out.Bytes(), &exported); err != nil || len(exported) != 1 || exported[0].Identity != "bob" || exported[0].DurationSeconds != 1 {
+		t.Errorf("Expected only bob's old record before yesterday, got %s", out.String())
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 0)
+	acmeDir := t.TempDir()
+	err := rt.registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"files": {
+			Command:   os.Args[0],
+			Env:       map[string]string{testBackendEnv: "serve", "API_KEY": "shared"},
+			PerTenant: true,
+			Tenants: map[string]TenantConfig{
+				"acme":   {Env: map[string]string{"API_KEY": "acme-key"}, WorkingDir: acmeDir},
+				"globex": {Env: map[string]string{"API_KEY": "globex-key"}},
+			},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	defer rt.registry.shutdown()
+
+	args := map[string]interface{}{"name": "API_KEY"}
+	for _, caller := range []identity{{Name: "alice", Tenant: "acme"}, {Name: "bob", Tenant: "globex"}, {Name: "carol", Tenant: "acme"}} {
+		resp, err := rt.call(contextWithIdentity(context.Background(), caller), "getenv", args)
+		if err != nil {
+			t.Fatalf("Failed to call tool as %s: %v", caller.Name, err)
+		}
+		if want := caller.Tenant + "-key"; responseText(resp) != want {
+			t.Errorf("Expected %s to reach the %s instance, got %q", caller.Name, caller.Tenant, responseText(resp))
+		}
+	}
+	if instances := len(rt.registry.tenants.instances); instances != 2 {
+		t.Errorf("Expected one instance per tenant, got %d", instances)
+	}
+	rt.registry.tenants.mu.Lock()
+	for tenant, want := range map[string]string{"acme": acmeDir, "globex": ""} {
+		if dir := rt.registry.tenants.instances[tenant]["files"].backend.cmd.Dir; dir != want {
+			t.Errorf("Expected the %s instance to run in %q, got %q", tenant, want, dir)
+		}
+	}
+	rt.registry.tenants.mu.Unlock()
+
+	// Callers outside the configured tenants never reach the shared instance
+	for _, caller := range []identity{{Name: "dave"}, {Name: "eve", Tenant: "initech"}} {
+		if _, err := rt.call(contextWithIdentity(context.Background(), caller), "getenv", args); err == nil {
+			t.Errorf("Expected %s to be refused", caller.Name)
+		}
+	}
+	if clients := rt.registry.clients(); len(clients) != 0 {
+		t.Errorf("Expected the shared instance to be left out of fallback routing, got %d clients", len(clients))
+	}
+}
+
+// recordingMiddleware appends a suffix to results and records the hooks it saw
+type recordingMiddleware struct {
+	mu    sync.Mutex
+	hooks []string
+	// bounded records whether the last call started with a deadline
+	bounded bool
+}
+
+func (m *recordingMiddleware) OnCallStart(ctx context.Context, info map[string]string, arguments map[string]interface{}) (map[string]interface{}, error) {
+	m.record("start " + info["tool"] + " " + info["identity"])
+	_, bounded := ctx.Deadline()
+	m.mu.Lock()
+	m.bounded = bounded
+	m.mu.Unlock()
+	return arguments, nil
+}
+
+func (m *recordingMiddleware) Transform(ctx context.Context, info map[string]string, result json.RawMessage) (json.RawMessage, error) {
+	m.record("transform")
+	return bytes.Replace(result, []byte(`"text":"`), []byte(`"text":"checked: `), 1), nil
+}
+
+func (m *recordingMiddleware) OnCallEnd(ctx context.Context, info map[string]string, duration time.Duration, err error) {
+	m.record(fmt.Sprintf("end %v", err))
+}
+
+func (m *recordingMiddleware) record(hook string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, hook)
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Setenv(testBackendEnv, "middleware")
+	chain, err := loadMiddleware([]MiddlewareConfig{{Type: "wasm", Path: "policy.wasm", Runtime: []string{os.Args[0]}}})
+	if err != nil {
+		t.Fatalf("Failed to start WASM middleware: %v", err)
+	}
+	defer chain.close()
+	recorder := &recordingMiddleware{}
+	rt := newBenchRouter(t, 1)
+	rt.middleware = append(chain, recorder)
+	ctx := contextWithIdentity(context.Background(), identity{Name: "alice"})
+
+	resp, err := rt.call(ctx, "echo_b0", map[string]interface{}{"message": "hello"})
+	if err != nil {
+		t.Fatalf("Failed to call tool: %v", err)
+	}
+	if text := responseText(resp); text != "checked: HELLO" {
+		t.Errorf("Expected the arguments and result to be rewritten, got %q", text)
+	}
+	if want := []string{"start echo_b0 alice", "transform", "end <nil>"}; !reflect.DeepEqual(recorder.hooks, want) {
+		t.Errorf("Expected hooks %v, got %v", want, recorder.hooks)
+	}
+
+	if _, err := rt.call(ctx, "echo_b0", map[string]interface{}{"message": "forbidden"}); err == nil || !strings.Contains(err.Error(), "call to 'echo_b0' vetoed: forbidden message") {
+		t.Errorf("Expected the WASM module to veto the call, got %v", err)
+	}
+	if len(recorder.hooks) != 3 {
+		t.Errorf("Expected a vetoed call not to reach later middleware, got %v", recorder.hooks)
+	}
+
+	if _, err := loadMiddleware([]MiddlewareConfig{{Type: "lua", Path: "x"}}); err == nil {
+		t.Error("Expected an unknown middleware type to be rejected")
+	}
+}
+
+func TestScriptHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.star")
+	src := `
+def pre_route(call):
+    if call["arguments"].get("message") == "secret":
+        fail("secrets stay home")
+    if call["identity"] == "canary":
+        return {"backend": "b1"}
+    if call["identity"] == "lost":
+        return {"backend": "nowhere"}
+
+def pre_forward(call):
+    if call["identity"] == "spinner":
+        for i in range(10000000):
+            pass
+    args = dict(call["arguments"])
+    args["message"] = args["message"] + " via " + call["backend"]
+    return {"arguments": args}
+
+def post_response(call, result):
+    result["content"][0]["text"] = result["content"][0]["text"].upper()
+    return result
+`
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	scripts, err := loadScripts([]ScriptConfig{{Path: path, Tools: []string{"echo_*"}}})
+	if err != nil {
+		t.Fatalf("Failed to load script: %v", err)
+	}
+	rt := newBenchRouter(t, 2)
+	rt.scripts = scripts
+	as := func(name string) context.Context {
+		return contextWithIdentity(context.Background(), identity{Name: name})
+	}
+
+	resp, err := rt.call(as("alice"), "echo_b0", map[string]interface{}{"message": "hi"})
+	if err != nil || responseText(resp) != "HI VIA B0" {
+		t.Fatalf("Expected the arguments and result to be rewritten, got %+v, %v", resp, err)
+	}
+	if _, err := rt.call(as("alice"), "echo_b0", map[string]interface{}{"message": "secret"}); err == nil || !strings.Contains(err.Error(), "vetoed by script") || !strings.Contains(err.Error(), "secrets stay home") {
+		t.Errorf("Expected the script to veto the call, got %v", err)
+	}
+	// The canary is sent to b1, which does not serve echo_b0
+	if _, err := rt.call(as("canary"), "echo_b0", map[string]interface{}{"message": "hi"}); err == nil || !strings.Contains(err.Error(), "failed on 'b1'") {
+		t.Errorf("Expected the script to route the call to b1, got %v", err)
+	}
+	if _, err := rt.call(as("lost"), "echo_b0", map[string]interface{}{"message": "hi"}); err == nil || !strings.Contains(err.Error(), "unknown server 'nowhere'") {
+		t.Errorf("Expected routing to an unknown server to fail, got %v", err)
+	}
+	if _, err := rt.call(as("spinner"), "echo_b0", map[string]interface{}{"message": "hi"}); err == nil || !strings.Contains(err.Error(), "too many steps") {
+		t.Errorf("Expected a runaway script to be stopped, got %v", err)
+	}
+}
+
+func TestPolicyEngine(t *testing.T) {
+	var inputs []policyInput
+	var mu sync.Mutex
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input policyInput `json:"input"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		inputs = append(inputs, body.Input)
+		mu.Unlock()
+		switch body.Input.Identity {
+		case "alice":
+			fmt.Fprint(w, `{"result": {"decision": "allow"}}`)
+		case "bob":
+			fmt.Fprint(w, `{"result": {"decision": "deny", "reason": "contractors may not echo"}}`)
+		case "carol", "dave":
+			fmt.Fprint(w, `{"result": {"decision": "approve", "reason": "after hours"}}`)
+		case "erin":
+			fmt.Fprint(w, `{"result": false}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer opa.Close()
+	policy, err := newPolicyEngine(&PolicyConfig{URL: opa.URL, ApprovalTimeout: Duration(5 * time.Second)}, newApprovalQueue())
+	if err != nil {
+		t.Fatalf("Failed to create policy engine: %v", err)
+	}
+	rt := newBenchRouter(t, 1)
+	rt.policy = policy
+	as := func(name string) context.Context {
+		return contextWithIdentity(context.Background(), identity{Name: name, Roles: []string{"dev"}})
+	}
+	args := map[string]interface{}{"message": "hi"}
+
+	if _, err := rt.call(as("alice"), "echo_b0", args); err != nil {
+		t.Errorf("Expected alice to be allowed, got %v", err)
+	}
+	if len(inputs) != 1 || inputs[0].Tool != "echo_b0" || inputs[0].Roles[0] != "dev" || inputs[0].Arguments.(map[string]interface{})["message"] != "hi" {
+		t.Errorf("Expected the identity, tool and arguments in the policy input, got %+v", inputs)
+	}
+	for name, want := range map[string]string{
+		"bob":     "permission denied by policy: contractors may not echo",
+		"erin":    "permission denied by policy",
+		"mallory": "permission denied by policy: no policy decision",
+	} {
+		if _, err := rt.call(as(name), "echo_b0", args); err == nil || err.Error() != want {
+			t.Errorf("Expected %s to be denied with %q, got %v", name, want, err)
+		}
+	}
+
+	// Calls needing approval wait for an operator
+	admin := httptest.NewServer(policy)
+	defer admin.Close()
+	results := make(chan error, 2)
+	for _, name := range []string{"carol", "dave"} {
+		go func(name string) {
+			_, err := rt.call(as(name), "echo_b0", args)
+			results <- err
+		}(name)
+	}
+	var pending []pendingApproval
+	for deadline := time.Now().Add(5 * time.Second); len(pending) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(admin.URL + "/approvals")
+		if err != nil {
+			t.Fatalf("Failed to list approvals: %v", err)
+		}
+		pending = nil
+		_ = json.NewDecoder(resp.Body).Decode(&pending)
+		resp.Body.Close()
+	}
+	if len(pending) != 2 {
+		t.Fatalf("Expected two calls awaiting approval, got %+v", pending)
+	}
+	for _, approval := range pending {
+		action := "deny"
+		if approval.Input.Identity == "carol" {
+			action = "approve"
+		}
+		resp, err := http.Post(admin.URL+"/approvals/"+approval.ID+"/"+action, "", nil)
+		if err != nil || resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Failed to %s %s: %v, %v", action, approval.ID, resp, err)
+		}
+	}
+	errs := []error{<-results, <-results}
+	if (errs[0] == nil) == (errs[1] == nil) {
+		t.Errorf("Expected one approved and one refused call, got %v", errs)
+	}
+	if resp, _ := http.Post(admin.URL+"/approvals/"+pending[0].ID+"/approve", "", nil); resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected a decided approval to be gone")
+	}
+
+	// Calls are denied when the policy cannot be evaluated
+	opa.Close()
+	if _, err := rt.call(as("alice"), "echo_b0", args); err == nil || !strings.Contains(err.Error(), "could not be evaluated") {
+		t.Errorf("Expected the call to be denied while OPA is down, got %v", err)
+	}
+}
+
+func TestSSHBackend(t *testing.T) {
+	config := MCPStdIOConfig{
+		Command:    "/opt/mcp/server",
+		Args:       []string{"--name", "it's"},
+		Env:        map[string]string{"B": "2", "A": "1"},
+		WorkingDir: "/srv/data",
+		SSH:        &SSHConfig{Host: "gpu", User: "ops", Port: 2222, IdentityFile: "/keys/id", JumpHost: "bastion", Options: map[string]string{"StrictHostKeyChecking": "accept-new"}},
+	}
+	command, args := sshCommand(config)
+	want := []string{"-T", "-o", "BatchMode=yes", "-o", "ServerAliveInterval=15", "-o", "ServerAliveCountMax=3", "-p", "2222",
+		"-i", "/keys/id", "-o", "IdentitiesOnly=yes", "-J", "bastion", "-o", "StrictHostKeyChecking=accept-new", "ops@gpu", "--",
+		`cd '/srv/data' && exec env 'A=1' 'B=2' '/opt/mcp/server' '--name' 'it'\''s'`}
+	if command != "ssh" || !reflect.DeepEqual(args, want) {
+		t.Errorf("Unexpected ssh command %s %q", command, args)
+	}
+	config.SHA256 = "abc"
+	if err := verifyBackend("remote", config); err == nil {
+		t.Error("Expected pinned checksums of remote commands to be refused")
+	}
+
+	// An ssh that runs the remote command locally
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte("#!/bin/sh\nfor last; do :; done\nexec sh -c \"$last\"\n"), 0o755); err != nil {
+		t.Fatalf("Failed to write fake ssh: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 0)
+	err := rt.registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"gpu": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve", "REGION": "remote"}, SSH: &SSHConfig{Host: "gpu"}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	defer rt.registry.shutdown()
+	resp, err := rt.call(context.Background(), "getenv", map[string]interface{}{"name": "REGION"})
+	if err != nil || responseText(resp) != "remote" {
+		t.Fatalf("Expected the environment to reach the remote server, got %+v (%v)", resp, err)
+	}
+
+	// A lost connection is reconnected
+	first := rt.registry.named("gpu")
+	_ = first.cmd.Process.Kill()
+	deadline := time.Now().Add(10 * time.Second)
+	for rt.registry.named("gpu") == first || rt.registry.named("gpu") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the server to reconnect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := rt.call(context.Background(), "echo", map[string]interface{}{"message": "back"}); err != nil {
+		t.Errorf("Expected calls to succeed once reconnected: %v", err)
+	}
+}
+
+func TestReverseConnection(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 0)
+	err := rt.registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"natted": {ReverseToken: "secret"},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	defer rt.registry.shutdown()
+	if rt.registry.named("natted") != nil {
+		t.Fatal("Expected no backend before the server dials in")
+	}
+	hub := httptest.NewServer(rt.registry.reverse)
+	defer hub.Close()
+	target, _ := url.Parse("ws" + strings.TrimPrefix(hub.URL, "http") + "/reverse?server=natted")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := dialWebSocket(ctx, nil, target, map[string]string{"Authorization": "Bearer wrong"}, defaultMaxFrameSize); err == nil {
+		t.Error("Expected a wrong token to be refused")
+	}
+
+	// The server's side runs the server next to it and relays its messages
+	t.Setenv(testBackendEnv, "serve")
+	go func() { _ = connectOnce(target, "secret", []string{os.Args[0]}) }()
+	deadline := time.Now().Add(10 * time.Second)
+	for rt.registry.named("natted") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the server to dial in")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	resp, err := rt.call(context.Background(), "echo", map[string]interface{}{"message": "through the firewall"})
+	if err != nil || responseText(resp) != "through the firewall" {
+		t.Fatalf("Expected the call to reach the server over its connection, got %+v (%v)", resp, err)
+	}
+
+	// A server that is already connected cannot dial in twice
+	if _, err := dialWebSocket(ctx, nil, target, map[string]string{"Authorization": "Bearer secret"}, defaultMaxFrameSize); err == nil {
+		t.Error("Expected a second connection to be refused")
+	}
+	if _, err := startBackend("natted", MCPStdIOConfig{ReverseToken: "secret"}, mcp.ClientInfo{}); err == nil {
+		t.Error("Expected servers dialing in not to be started per session")
+	}
+}
+
+func TestReverseReload(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 0)
+	defer rt.registry.shutdown()
+	if err := rt.registry.apply(Config{}); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+
+	// A reload adding a server that dials in succeeds before the server has dialed in
+	natted := MCPStdIOConfig{ReverseToken: "secret"}
+	if err := rt.registry.reload(Config{MCPStdIOServers: map[string]MCPStdIOConfig{"natted": natted}}); err != nil {
+		t.Fatalf("Expected the reload to wait for the server to dial in, got %v", err)
+	}
+	hub := httptest.NewServer(rt.registry.reverse)
+	defer hub.Close()
+	target, _ := url.Parse("ws" + strings.TrimPrefix(hub.URL, "http") + "/reverse?server=natted")
+	t.Setenv(testBackendEnv, "serve")
+	go func() { _ = connectOnce(target, "secret", []string{os.Args[0]}) }()
+	deadline := time.Now().Add(10 * time.Second)
+	for rt.registry.named("natted") == nil || !rt.registry.named("natted").isInitialized() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the server to dial in")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Changing the config of the connected server keeps its connection
+	connected := rt.registry.named("natted")
+	natted.Tags = []string{"edge"}
+	if err := rt.registry.reload(Config{MCPStdIOServers: map[string]MCPStdIOConfig{"natted": natted}}); err != nil {
+		t.Fatalf("Expected the reload of the connected server to apply, got %v", err)
+	}
+	carried := rt.registry.named("natted")
+	if carried == nil || !reflect.DeepEqual(carried.config, natted) || connected.hasExited(0) {
+		t.Fatal("Expected the connection to be carried over to the new config")
+	}
+	resp, err := rt.call(context.Background(), "echo", map[string]interface{}{"message": "still here"})
+	if err != nil || responseText(resp) != "still here" {
+		t.Errorf("Expected calls to keep reaching the server, got %+v (%v)", resp, err)
+	}
+}
+
+func TestTags(t *testing.T) {
+	cfg, err := parseConfig([]byte(`{
+		"TagPolicies": {"prod": {"Required": true, "Env": {"LEVEL": "warn"}}},
+		"MCPStdIOServers": {
+			"files": {"Command": "` + os.Args[0] + `", "Env": {"` + testBackendEnv + `": "serve"}, "Tags": ["fs"]},
+			"search": {"Command": "` + os.Args[0] + `", "Env": {"` + testBackendEnv + `": "serve", "LEVEL": "info"}, "Tags": ["prod"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if search := cfg.MCPStdIOServers["search"]; !search.Required || search.Env["LEVEL"] != "info" || cfg.MCPStdIOServers["files"].Required {
+		t.Errorf("Expected tag policies to apply under the settings of tagged servers only, got %+v", cfg.MCPStdIOServers)
+	}
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 0)
+	if err := rt.registry.apply(cfg); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	defer rt.registry.shutdown()
+
+	listed := func(ctx context.Context) int {
+		tools, _ := rt.catalog(ctx, "")
+		return len(tools)
+	}
+	all := listed(context.Background())
+	if fs := listed(contextWithTagFilter(context.Background(), []string{"fs"})); all == 0 || fs*2 != all {
+		t.Errorf("Expected the tag filter to list the tools of one server, got %d of %d", fs, all)
+	}
+
+	ui := &dashboard{registry: rt.registry, history: newCallHistory()}
+	action := func(path string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("X-MCP-Dashboard", "1")
+		w := httptest.NewRecorder()
+		ui.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := action("/dashboard/api/tags/prod/disable"); code != http.StatusNoContent {
+		t.Fatalf("Expected the tag to be disabled, got %d", code)
+	}
+	if rt.registry.named("search") != nil || rt.registry.named("files") == nil {
+		t.Error("Expected only the servers tagged prod to be stopped")
+	}
+	// Disabled servers stay stopped across reloads
+	if err := rt.registry.reload(cfg); err != nil || rt.registry.named("search") != nil {
+		t.Errorf("Expected a reload to keep the disabled servers stopped (%v)", err)
+	}
+	if tags := ui.status().DisabledTags; !reflect.DeepEqual(tags, []string{"prod"}) {
+		t.Errorf("Expected the disabled tags in the status, got %v", tags)
+	}
+	if code := action("/dashboard/api/tags/prod/enable"); code != http.StatusNoContent || rt.registry.named("search") == nil {
+		t.Errorf("Expected the tag to be enabled again, got %d", code)
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	now := time.Date(2026, 11, 1, 2, 30, 0, 0, time.UTC)
+	windows := []MaintenanceWindow{
+		{Cron: "0 2 * * 0", Duration: Duration(time.Hour), TimeZone: "UTC", Reason: "weekly upgrade"},
+		{Start: now.Add(-time.Minute), End: now.Add(2 * time.Hour)},
+	}
+	if err := inMaintenance("db", windows[:1], now); err == nil || !err.until.Equal(now.Add(30*time.Minute)) || err.reason != "weekly upgrade" {
+		t.Errorf("Expected the recurring window to be in progress until 03:00, got %v", err)
+	}
+	if err := inMaintenance("db", windows, now); err == nil || !err.until.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("Expected the latest end of the windows in progress, got %v", err)
+	}
+	if err := inMaintenance("db", windows[:1], now.Add(time.Hour)); err != nil {
+		t.Errorf("Expected the recurring window to be over, got %v", err)
+	}
+	if err := checkMaintenance([]MaintenanceWindow{{Cron: "0 2 * * 0"}}); err == nil {
+		t.Error("Expected a recurring window without a Duration to be refused")
+	}
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 0)
+	err := rt.registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"db": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve"}, Maintenance: []MaintenanceWindow{
+			{Start: time.Now().Add(-time.Minute), End: time.Now().Add(time.Hour), Reason: "migration"},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	defer rt.registry.shutdown()
+	rt.quotas, _ = openQuotaTracker(&QuotaConfig{Monthly: map[string]float64{"*": 10}})
+	var maintenance *maintenanceError
+	if _, err := rt.call(context.Background(), "echo", map[string]interface{}{"message": "hi"}); !errors.As(err, &maintenance) || maintenance.reason != "migration" {
+		t.Errorf("Expected a maintenance error, got %v", err)
+	}
+	// Tools no backend advertises are not tried on servers in maintenance
+	if _, err := rt.call(context.Background(), "unlisted", nil); !errors.As(err, &maintenance) {
+		t.Errorf("Expected a maintenance error when only servers in maintenance are left to try, got %v", err)
+	}
+	if usage := rt.quotas.usage(time.Now().UTC().Format("2006-01"), "anonymous"); usage.Cost != 0 {
+		t.Errorf("Expected a call refused for maintenance not to be charged, got %+v", usage)
+	}
+	tools, _ := rt.catalog(context.Background(), "")
+	if len(tools) == 0 || tools[0].Description == nil || !strings.HasPrefix(*tools[0].Description, "[Temporarily unavailable until ") {
+		t.Errorf("Expected the tools to be listed as unavailable, got %+v", tools)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 1)
+
+	probe := ProbeConfig{Name: "echo", Tool: "echo_b0", Arguments: map[string]interface{}{"message": `{"ok":true}`}, Timeout: Duration(time.Second)}
+	if backend, err := checkProbe(rt, probe); backend != "b0" || err != nil {
+		t.Errorf("Expected the probe of b0 to pass, got %q, %v", backend, err)
+	}
+	probe.Expect = "pong"
+	if _, err := checkProbe(rt, probe); err == nil {
+		t.Error("Expected a probe missing its expected text to fail")
+	}
+	probe.Expect = ""
+	probe.Schema = map[string]interface{}{"type": "object", "required": []interface{}{"status"}}
+	if _, err := checkProbe(rt, probe); err == nil || !strings.Contains(err.Error(), "schema") {
+		t.Errorf("Expected a probe violating its schema to fail, got %v", err)
+	}
+	if err := startProbes(rt, []ProbeConfig{{Tool: "echo_b0"}}); err == nil {
+		t.Error("Expected a probe without a Name to be refused")
+	}
+
+	if err := startProbes(rt, []ProbeConfig{{Name: "broken", Tool: "echo_b0", Expect: "pong", Interval: Duration(time.Hour)}}); err != nil {
+		t.Fatalf("Failed to start probes: %v", err)
+	}
+	degraded := func() []string {
+		rt.registry.mu.RLock()
+		defer rt.registry.mu.RUnlock()
+		return rt.registry.degradedLocked("b0")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(degraded()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reasons := degraded(); len(reasons) != 1 || !strings.HasPrefix(reasons[0], "broken: ") {
+		t.Errorf("Expected b0 to be degraded by the failing probe, got %v", reasons)
+	}
+
+	rt.registry.setProbe("b0", "broken", "")
+	rt.registry.setProbe("b0", "other", "timeout")
+	rt.registry.setProbe("b0", "other", "")
+	if reasons := degraded(); len(reasons) > 1 {
+		t.Errorf("Expected passing probes to clear the mark, got %v", reasons)
+	}
+}
+
+func TestPostmortem(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	if _, err := newPostmortem(&PostmortemConfig{}); err == nil {
+		t.Error("Expected postmortem bundles without a Dir to be refused")
+	}
+	dir := t.TempDir()
+	postmortem, err := newPostmortem(&PostmortemConfig{Dir: dir, LogLines: 2})
+	if err != nil {
+		t.Fatalf("Failed to set up postmortem bundles: %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		_, _ = postmortem.Write([]byte(line))
+	}
+	if logs := postmortem.recentLogs(); logs != "second\nthird\n" {
+		t.Errorf("Expected the last 2 log lines, got %q", logs)
+	}
+
+	rt := newBenchRouter(t, 0)
+	postmortem.registry = rt.registry
+	rt.registry.started = func(b *backend) { go postmortem.watch(b) }
+	err = rt.registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"weather": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve", "API_KEY": "hunter2"}},
+	}, Auth: &AuthConfig{Tokens: []TokenConfig{{Token: "s3cr3t", Identity: "alice"}}}})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	defer rt.registry.shutdown()
+
+	bundle, err := postmortem.write("test", time.Now())
+	if err != nil {
+		t.Fatalf("Failed to write bundle: %v", err)
+	}
+	for _, name := range []string{"reason.txt", "logs.txt", "routes.json", "config.json", "goroutines.txt"} {
+		if _, err := os.Stat(filepath.Join(bundle, name)); err != nil {
+			t.Errorf("Expected %s in the bundle: %v", name, err)
+		}
+	}
+	config, _ := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if strings.Contains(string(config), "hunter2") || strings.Contains(string(config), "s3cr3t") || !strings.Contains(string(config), os.Args[0]) {
+		t.Errorf("Expected the config with its secrets redacted, got %s", config)
+	}
+	routes, _ := os.ReadFile(filepath.Join(bundle, "routes.json"))
+	if !strings.Contains(string(routes), `"echo": "weather"`) {
+		t.Errorf("Expected the routing table, got %s", routes)
+	}
+
+	// A backend crashing writes a bundle of its own
+	if err := rt.registry.named("weather").cmd.Process.Kill(); err != nil {
+		t.Fatalf("Failed to kill the backend: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if bundles, _ := os.ReadDir(dir); len(bundles) == 2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected a bundle for the crashed backend")
+}
+
+func TestDashboard(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 0)
+	rt.history = newCallHistory()
+	rt.strict = true
+	err := rt.registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"tools": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve"}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	defer rt.registry.shutdown()
+	if _, err := rt.call(context.Background(), "echo", map[string]interface{}{"message": "hi"}); err != nil {
+		t.Fatalf("Failed to call tool: %v", err)
+	}
+	_, _ = rt.call(context.Background(), "missing", map[string]interface{}{})
+
+	ui := &dashboard{registry: rt.registry, history: rt.history}
+	status := func() dashboardStatus {
+		w := httptest.NewRecorder()
+		ui.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard/api/status", nil))
+		var status dashboardStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatalf("Failed to decode status: %v", err)
+		}
+		return status
+	}
+	before := status()
+	if len(before.Backends) != 1 || before.Backends[0].State != "running" || before.Backends[0].Tools != 2 {
+		t.Fatalf("Unexpected backends: %+v", before.Backends)
+	}
+	if len(before.Catalog) != 2 {
+		t.Errorf("Expected both tools in the catalog, got %+v", before.Catalog)
+	}
+	if len(before.Calls) != 2 || before.Calls[1].Tool != "echo" || before.Calls[1].Backend != "tools" {
+		t.Errorf("Expected the calls newest first with their backend, got %+v", before.Calls)
+	}
+	if len(before.Errors) != 1 || before.Errors[0].Tool != "missing" {
+		t.Errorf("Expected the failed call in the error feed, got %+v", before.Errors)
+	}
+
+	w := httptest.NewRecorder()
+	ui.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard/", nil))
+	if !strings.Contains(w.Body.String(), "<html") {
+		t.Errorf("Expected the dashboard page, got %q", w.Body.String())
+	}
+	// Server names may be self-registered, so they must not end up inside inline script
+	if strings.Contains(w.Body.String(), "onclick=\"restart(") || !strings.Contains(w.Body.String(), "data-restart=") {
+		t.Error("Expected restart buttons to carry the server name in a data attribute")
+	}
+	w = httptest.NewRecorder()
+	ui.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/dashboard/" {
+		t.Errorf("Expected /dashboard to redirect to /dashboard/, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// Actions need the dashboard's header so other sites cannot trigger them
+	w = httptest.NewRecorder()
+	ui.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/dashboard/api/backends/tools/restart", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a restart without the header to be forbidden, got %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/dashboard/api/backends/tools/restart", nil)
+	r.Header.Set("X-MCP-Dashboard", "1")
+	w = httptest.NewRecorder()
+	ui.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Failed to restart backend: %d %s", w.Code, w.Body.String())
+	}
+	if after := status(); len(after.Backends) != 1 || after.Backends[0].PID == before.Backends[0].PID {
+		t.Errorf("Expected a new process after the restart, got %+v", after.Backends)
+	}
+}
+
+func TestTopView(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	model := &topModel{now: func() time.Time { return now }, height: 14}
+	status := dashboardStatus{
+		Backends: []backendStatus{{Name: "files", State: "running", Tools: 3}, {Name: "search", State: "exited"}},
+		Calls: []toolCallEvent{
+			{Tool: "read", Backend: "files", Time: now.Add(-time.Second), Duration: "40ms"},
+			{Tool: "read", Backend: "files", Time: now.Add(-2 * time.Minute), Duration: "10ms"},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		status.Errors = append(status.Errors, toolCallEvent{Tool: "find", Backend: "search", Time: now, Error: fmt.Sprintf("error %d", i)})
+	}
+	model.update(status)
+
+	view := model.view()
+	for _, want := range []string{"1 of 2 backends running", "files", "exited", "40ms", "▂█", "ERRORS (10)", "error 0"} {
+		if !strings.Contains(view, want) {
+			t.Errorf("Expected the view to contain %q, got:\n%s", want, view)
+		}
+	}
+	if strings.Contains(view, "error 9") {
+		t.Errorf("Expected the errors pane to fit the screen, got:\n%s", view)
+	}
+	// Only the call in the last minute counts towards the rate
+	if !strings.Contains(view, "        1") {
+		t.Errorf("Expected one call per minute for files, got:\n%s", view)
+	}
+
+	model.update(topKey("j"))
+	model.update(topKey("\x1b[B"))
+	if view := model.view(); strings.Contains(view, "error 1") || !strings.Contains(view, "error 2") {
+		t.Errorf("Expected the errors pane to scroll, got:\n%s", view)
+	}
+	if !model.update(topKey("q")) {
+		t.Error("Expected q to quit")
+	}
+}
+
+func TestREPL(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	defer clientOut.Close()
+	defer serverOut.Close()
+	rt := newBenchRouter(t, 1)
+	server := mcp.NewServer(&passthroughTransport{Transport: newStdioTransport("aggregator", serverIn, serverOut, 0), results: rt.raw})
+	registerTools(server, rt)
+	if err := server.Serve(); err != nil {
+		t.Fatalf("Failed to serve: %v", err)
+	}
+	client := mcp.NewClientWithInfo(newStdioTransport("repl", clientIn, clientOut, 0), mcp.ClientInfo{Name: "test", Version: "1.0.0"})
+	if _, err := client.Initialize(context.Background()); err != nil {
+		t.Fatalf("Failed to initialize: %v", err)
+	}
+
+	// Call once with prompted arguments and once with JSON ones
+	var output bytes.Buffer
+	input := strings.NewReader("tools\recho_b0\rprompted\recho_b0 {\"message\": \"inline\"}\rnope\rquit\r")
+	r := newREPL(client, struct {
+		io.Reader
+		io.Writer
+	}{input, &output}, time.Minute)
+	r.run()
+	for _, want := range []string{"1 tools available", "echo_b0", "message (string) [optional]: ", "prompted", "inline", "Unknown tool or command 'nope'"} {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("Expected the output to contain %q, got:\n%s", want, output.String())
+		}
+	}
+
+	for line, want := range map[string]string{"ec": "echo_b0 ", "describe e": "describe echo_b0 ", "re": "reload "} {
+		if got, _, ok := r.complete(line, len(line), '\t'); !ok || got != want {
+			t.Errorf("Expected %q to complete to %q, got %q", line, want, got)
+		}
+	}
+	if _, _, ok := r.complete("echo_b0 x", 9, '\t'); ok {
+		t.Error("Expected no completion of arguments")
+	}
+}
+
+func TestAddBackend(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	entry := backendEntry([]string{os.Args[0]}, nil, map[string]string{testBackendEnv: "serve"})
+	probe, err := probeBackend(entry)
+	if err != nil {
+		t.Fatalf("Failed to probe backend: %v", err)
+	}
+	if len(probe.tools) != 2 {
+		t.Errorf("Expected the probe to list both tools, got %+v", probe.tools)
+	}
+
+	path := filepath.Join(t.TempDir(), "mcp.json")
+	existing := `{"MCPStdIOServers": {"memory": {"Command": "npx", "Env": {"TOKEN": "${TOKEN}"}}}, "StrictRouting": true}`
+	if err := os.WriteFile(path, []byte(existing), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	servers, err := readServerEntries(path)
+	if err != nil {
+		t.Fatalf("Failed to read servers: %v", err)
+	}
+	for _, tc := range []struct {
+		serverName string
+		entry      MCPStdIOConfig
+		want       string
+	}{
+		{"mcp-server-github", MCPStdIOConfig{Command: "npx"}, "github"},
+		{"", MCPStdIOConfig{URL: "https://search.example.com/sse"}, "search"},
+		{"", MCPStdIOConfig{Command: "npx", Args: []string{"-y", "@modelcontextprotocol/server-memory"}}, "memory-2"},
+	} {
+		if got := suggestBackendName(tc.serverName, tc.entry, servers); got != tc.want {
+			t.Errorf("Expected %q to be suggested, got %q", tc.want, got)
+		}
+	}
+
+	if err := addServerEntry(path, "tools", entry); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "${TOKEN}") || !strings.Contains(string(data), `"StrictRouting": true`) {
+		t.Errorf("Expected the rest of the config to be kept as written, got %s", data)
+	}
+	cfg, err := parseConfig(data)
+	if err != nil {
+		t.Fatalf("Failed to parse updated config: %v", err)
+	}
+	if len(cfg.MCPStdIOServers) != 2 || cfg.MCPStdIOServers["tools"].Command != os.Args[0] {
+		t.Errorf("Expected the new entry next to the existing one, got %+v", cfg.MCPStdIOServers)
+	}
+}
+
+func TestCatalogDocs(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	cfg := Config{
+		Auth: &AuthConfig{Roles: map[string]RoleConfig{
+			"reader": {Tools: []string{"echo_*"}},
+			"admin":  {Tools: []string{"*"}},
+		}},
+		Sanitizers:   []ArgumentSanitizer{{Tools: []string{"echo_*"}, Arguments: []string{"message"}, Type: "path", Roots: []string{"/srv"}}},
+		HostProfiles: []HostProfile{{Name: "desktop", Tools: []string{"search_*"}}},
+		Quotas:       &QuotaConfig{Weights: map[string]float64{"echo_*": 5}},
+	}
+	rt := newBenchRouter(t, 2)
+	tools := documentCatalog(rt.registry, cfg)
+	if len(tools) != 2 || tools[0].Name != "echo_b0" || tools[0].Backend != "b0" {
+		t.Fatalf("Expected the tools ordered by backend, got %+v", tools)
+	}
+	want := []string{
+		"Callable by roles: admin, reader",
+		"Hidden from host profiles: desktop",
+		"Arguments message are checked as paths within /srv",
+		"Each call costs 5 quota units",
+	}
+	if !reflect.DeepEqual(tools[0].Policies, want) {
+		t.Errorf("Expected policies %q, got %q", want, tools[0].Policies)
+	}
+
+	var markdown bytes.Buffer
+	if err := writeCatalogMarkdown(&markdown, "Catalog", tools); err != nil {
+		t.Fatalf("Failed to write markdown: %v", err)
+	}
+	for _, want := range []string{"# Catalog", "2 tools from 2 backends", "| [`echo_b1`](#b1-echo-b1) | b1 | Echo the message |", "## b0", "- Callable by roles", "```json"} {
+		if !strings.Contains(markdown.String(), want) {
+			t.Errorf("Expected the markdown to contain %q, got:\n%s", want, markdown.String())
+		}
+	}
+
+	var page bytes.Buffer
+	if err := writeCatalogHTML(&page, "Catalog", tools); err != nil {
+		t.Fatalf("Failed to write HTML: %v", err)
+	}
+	for _, want := range []string{"<h1>Catalog</h1>", `<h2 id="b0-echo-b0">`, "<li>Each call costs 5 quota units</li>", "&#34;message&#34;"} {
+		if !strings.Contains(page.String(), want) {
+			t.Errorf("Expected the HTML to contain %q, got:\n%s", want, page.String())
+		}
+	}
+}
+
+func TestCatalogSnapshots(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	dir := t.TempDir()
+	rt := newBenchRouter(t, 3)
+	store, err := newSnapshotStore(&SnapshotConfig{Dir: dir, Keep: 2})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	first, err := store.capture(rt.registry)
+	if err != nil || first != "20250601T120000Z" {
+		t.Fatalf("Expected a first snapshot, got %q: %v", first, err)
+	}
+	if id, _ := store.capture(rt.registry); id != "" {
+		t.Errorf("Expected an unchanged catalog not to be snapshotted, got %s", id)
+	}
+
+	// An upstream update drops a backend
+	delete(rt.registry.backends, "b2")
+	now = now.Add(time.Hour)
+	second, _ := store.capture(rt.registry)
+	from, _ := store.load(first)
+	to, _ := store.load(second)
+	var diff bytes.Buffer
+	writeSnapshotDiff(&diff, from, to)
+	if want := "From 20250601T120000Z to 20250601T130000Z\n- tool b2/echo_b2\n"; diff.String() != want {
+		t.Errorf("Expected diff %q, got %q", want, diff.String())
+	}
+
+	delete(rt.registry.backends, "b1")
+	now = now.Add(time.Hour)
+	_, _ = store.capture(rt.registry)
+	if ids, _ := store.list(); len(ids) != 2 || ids[0] != second {
+		t.Errorf("Expected only the two latest snapshots to be kept, got %v", ids)
+	}
+
+	// Pinning advertises the tools of the older snapshot again
+	pinned, err := newSnapshotStore(&SnapshotConfig{Dir: dir, Pin: second})
+	if err != nil {
+		t.Fatalf("Failed to pin snapshot: %v", err)
+	}
+	rt.snapshots = pinned
+	tools, _ := rt.catalog(context.Background(), "")
+	if len(tools) != 2 || tools[1].Name != "echo_b1" {
+		t.Errorf("Expected the pinned catalog, got %+v", tools)
+	}
+	if _, err := newSnapshotStore(&SnapshotConfig{Dir: dir, Pin: first}); err == nil {
+		t.Error("Expected pinning a pruned snapshot to fail")
+	}
+}
+
+func TestShadowTraffic(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 0)
+	rt.strict = true
+	err := rt.registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"primary":   {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve", "REGION": "eu"}},
+		"candidate": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve", "REGION": "us"}, ShadowOf: "primary"},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	defer rt.registry.shutdown()
+	path := filepath.Join(t.TempDir(), "shadow.jsonl")
+	rt.shadows, err = newShadowMirror(path, rt.registry, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+
+	tools, _ := rt.catalog(context.Background(), "")
+	if len(tools) != 2 {
+		t.Errorf("Expected only the primary's tools to be advertised, got %+v", tools)
+	}
+	if owner := rt.registry.owner("echo"); owner == nil || owner.name != "primary" {
+		t.Errorf("Expected the primary to own echo, got %+v", owner)
+	}
+	resp, err := rt.call(context.Background(), "getenv", map[string]interface{}{"name": "REGION"})
+	if err != nil || responseText(resp) != "eu" {
+		t.Fatalf("Expected the primary's response, got %+v: %v", resp, err)
+	}
+	if _, err := rt.call(context.Background(), "echo", map[string]interface{}{"message": "hi"}); err != nil {
+		t.Fatalf("Failed to call echo: %v", err)
+	}
+	rt.shadows.close()
+
+	data, err := os.ReadFile(path)
 	if err != nil {
-		t.Fatalf("Failed to create stdin pipe: %v", err)
+		t.Fatalf("Failed to read shadow log: %v", err)
+	}
+	outcomes := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record shadowRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Invalid shadow record %q: %v", line, err)
+		}
+		if record.Primary != "primary" || record.Shadow != "candidate" {
+			t.Errorf("Unexpected servers in %+v", record)
+		}
+		outcomes[record.Tool] = record.Outcome
 	}
-	stdout, err := cmd.StdoutPipe()
+	if outcomes["getenv"] != "mismatch" || outcomes["echo"] != "match" {
+		t.Errorf("Expected getenv to differ and echo to match, got %v", outcomes)
+	}
+}
+
+func TestCompareBackends(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 0)
+	err := rt.registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"old": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve", "REGION": "eu"}},
+		"new": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve", "REGION": "us"}},
+	}})
 	if err != nil {
-		t.Fatalf("Failed to create stdout pipe: %v", err)
+		t.Fatalf("Failed to apply config: %v", err)
 	}
+	defer rt.registry.shutdown()
 
-	if err := cmd.Start(); err != nil {
-		t.Fatalf("Failed to start server: %v", err)
+	compare := handleCompareBackends(rt).(func(context.Context, CompareBackendsRequest) (*mcp.ToolResponse, error))
+	var comparison struct {
+		Identical   bool                 `json:"identical"`
+		Baseline    comparedCall         `json:"baseline"`
+		Candidate   comparedCall         `json:"candidate"`
+		Differences []responseDifference `json:"differences"`
 	}
-	defer func(Process *os.Process) {
-		err := Process.Kill()
+	run := func(tool string, arguments map[string]interface{}) {
+		resp, err := compare(context.Background(), CompareBackendsRequest{Name: tool, Arguments: arguments, Baseline: "old", Candidate: "new"})
 		if err != nil {
-			return
+			t.Fatalf("Failed to compare %s: %v", tool, err)
+		}
+		comparison.Differences = nil
+		if err := json.Unmarshal([]byte(responseText(resp)), &comparison); err != nil {
+			t.Fatalf("Failed to decode comparison: %v", err)
+		}
+	}
+
+	run("echo", map[string]interface{}{"message": "hi"})
+	if !comparison.Identical || comparison.Baseline.Backend != "old" || comparison.Candidate.Duration == "" {
+		t.Errorf("Expected identical echo responses, got %+v", comparison)
+	}
+	run("getenv", map[string]interface{}{"name": "REGION"})
+	want := []responseDifference{{Path: "result.content[0].text", Baseline: "eu", Candidate: "us"}}
+	if comparison.Identical || !reflect.DeepEqual(comparison.Differences, want) {
+		t.Errorf("Expected the region to differ, got %+v", comparison.Differences)
+	}
+
+	// Text holding JSON is compared field by field
+	differences := diffValues("result", `{"temp": 20, "unit": "C"}`, `{"temp": 20, "unit": "F", "wind": 3}`, nil)
+	if len(differences) != 2 || differences[0].Path != "result.unit" || differences[1].Path != "result.wind" || differences[1].Baseline != nil {
+		t.Errorf("Unexpected differences %+v", differences)
+	}
+	if _, err := compare(context.Background(), CompareBackendsRequest{Name: "echo", Baseline: "old", Candidate: "missing"}); err == nil {
+		t.Error("Expected comparing with an unknown server to fail")
+	}
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	fixed := newConcurrencyLimiter(&ConcurrencyConfig{Limit: 2})
+	release, _ := fixed.acquire(context.Background())
+	_, _ = fixed.acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := fixed.acquire(ctx); err == nil {
+		t.Fatal("Expected a third call to wait for a free slot")
+	}
+	acquired := make(chan struct{})
+	go func() {
+		_, _ = fixed.acquire(context.Background())
+		close(acquired)
+	}()
+	release(time.Millisecond, io.EOF)
+	<-acquired
+	if limit, inFlight := fixed.current(); limit != 2 || inFlight != 2 {
+		t.Errorf("Expected a fixed limit of 2 with 2 calls in flight, got %d and %d", limit, inFlight)
+	}
+
+	adaptive := newConcurrencyLimiter(&ConcurrencyConfig{Limit: 4, Adaptive: true, MaxLimit: 5, LatencyTarget: Duration(100 * time.Millisecond)})
+	for i := 0; i < 40; i++ {
+		release, _ := adaptive.acquire(context.Background())
+		release(time.Millisecond, nil)
+	}
+	if limit, _ := adaptive.current(); limit != 5 {
+		t.Errorf("Expected fast calls to raise the limit to its maximum, got %d", limit)
+	}
+	for i := 0; i < 3; i++ {
+		release, _ := adaptive.acquire(context.Background())
+		release(time.Second, nil)
+	}
+	if limit, _ := adaptive.current(); limit != 3 {
+		t.Errorf("Expected slow calls to lower the limit, got %d", limit)
+	}
+
+	// Routed calls go through the backend's limiter and export its limit
+	rt := newBenchRouter(t, 1)
+	rt.metrics = newMetrics()
+	rt.registry.backends["b0"].config.Concurrency = &ConcurrencyConfig{Limit: 3, Adaptive: true}
+	if _, err := rt.call(context.Background(), "echo_b0", map[string]interface{}{"message": "hi"}); err != nil {
+		t.Fatalf("Failed to call: %v", err)
+	}
+	w := httptest.NewRecorder()
+	rt.metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `mcp_backend_concurrency_limit{backend="b0"} 3`) {
+		t.Errorf("Expected the limit to be exported, got %s", w.Body.String())
+	}
+}
+
+func TestMemoryWatchdog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(t, 0)
+	rt.history = newCallHistory()
+	err := rt.registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"light": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve"}},
+		"heavy": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve", "ROLE": "heavy"}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	defer rt.registry.shutdown()
+	rt.memory = newMemoryWatchdog(&MemoryWatchdogConfig{MaxRSSMB: 100, LowPriorityTools: []string{"getenv"}}, rt.registry, rt.history, nil)
+	heavyMB := uint64(10)
+	rt.memory.residentMemory = func(pid int) (uint64, error) {
+		if heavy := rt.registry.named("heavy"); heavy != nil && heavy.cmd.Process.Pid == pid {
+			return heavyMB << 20, nil
 		}
-	}(cmd.Process)
+		return 20 << 20, nil
+	}
+
+	rt.memory.check()
+	if _, err := rt.call(context.Background(), "getenv", map[string]interface{}{"name": "ROLE"}); err != nil {
+		t.Fatalf("Expected low-priority calls while memory is low, got %v", err)
+	}
+
+	// Over the limit, low-priority calls are shed and caches dropped
+	heavyMB = 200
+	rt.memory.check()
+	if len(rt.history.recent()) != 0 {
+		t.Error("Expected the call history to be dropped")
+	}
+	if _, err := rt.call(context.Background(), "getenv", map[string]interface{}{"name": "ROLE"}); err == nil || !strings.Contains(err.Error(), "low on memory") {
+		t.Errorf("Expected the low-priority call to be shed, got %v", err)
+	}
+	if _, err := rt.call(context.Background(), "echo", map[string]interface{}{"message": "hi"}); err != nil {
+		t.Errorf("Expected other calls to go through, got %v", err)
+	}
+
+	// Still over, the heaviest idle server is restarted
+	pid := rt.registry.named("heavy").cmd.Process.Pid
+	rt.memory.check()
+	if heavy := rt.registry.named("heavy"); heavy == nil || heavy.cmd.Process.Pid == pid {
+		t.Error("Expected the heavy server to be restarted")
+	}
+	heavyMB = 10
+	rt.memory.check()
+	if _, err := rt.call(context.Background(), "getenv", map[string]interface{}{"name": "ROLE"}); err != nil {
+		t.Errorf("Expected shedding to stop once memory is back under its limit, got %v", err)
+	}
+}
+
+func TestConfigRollback(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	registry := newBackendRegistry(mcp.ClientInfo{Name: "test", Version: "1.0.0"})
+	defer registry.shutdown()
+	good := MCPStdIOConfig{Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve"}}
+	if err := registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{"tools": good}}); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	running := registry.named("tools")
+
+	// A reload whose new server cannot start keeps the previous config in full, without restarting
+	// the servers it changes
+	changed := good
+	changed.Env = map[string]string{testBackendEnv: "serve", "ROLE": "changed"}
+	err := registry.reload(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"tools":  changed,
+		"broken": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "exit"}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("Expected the reload to fail on the broken server, got %v", err)
+	}
+	if _, ok := registry.servers["broken"]; ok || len(registry.config.MCPStdIOServers) != 1 {
+		t.Errorf("Expected the previous config to be restored, got %v", registry.config.MCPStdIOServers)
+	}
+	if registry.named("tools") != running || running.hasExited(0) {
+		t.Error("Expected the running server to be left alone")
+	}
+	ui := &dashboard{registry: registry}
+	if status := ui.status().Reload; status == nil || status.Applied || !strings.Contains(status.Error, "broken") {
+		t.Errorf("Expected the failed reload in the admin status, got %+v", status)
+	}
+
+	more := good
+	more.Env = map[string]string{testBackendEnv: "serve", "ROLE": "more"}
+	if err := registry.reload(Config{MCPStdIOServers: map[string]MCPStdIOConfig{"tools": good, "more": more}}); err != nil {
+		t.Fatalf("Expected a valid reload to apply, got %v", err)
+	}
+	if registry.named("more") == nil || !registry.reloadStatus().Applied {
+		t.Error("Expected the new server to be started")
+	}
+
+	// A changed server is replaced once its new instance has started
+	if err := registry.reload(Config{MCPStdIOServers: map[string]MCPStdIOConfig{"tools": changed, "more": more}}); err != nil {
+		t.Fatalf("Expected a valid reload to apply, got %v", err)
+	}
+	if replaced := registry.named("tools"); replaced == running || !reflect.DeepEqual(replaced.config, changed) || !running.hasExited(0) {
+		t.Error("Expected the changed server to be replaced and its old instance stopped")
+	}
+}
 
-	// Create client with stdio transport
-	client := mcp.NewClientWithInfo(
-		stdio.NewStdioServerTransportWithIO(stdout, stdin),
-		mcp.ClientInfo{
-			Name:    "test-client",
-			Version: "1.0.0",
+func TestStartOrder(t *testing.T) {
+	order, err := startOrder(map[string]MCPStdIOConfig{
+		"app":     {DependsOn: []string{"proxy", "db"}},
+		"proxy":   {Phase: 1},
+		"db":      {},
+		"metrics": {Phase: -1},
+		"extra":   {Phase: 2},
+	})
+	if want := []string{"metrics", "db", "proxy", "app", "extra"}; err != nil || !reflect.DeepEqual(order, want) {
+		t.Errorf("Expected order %v, got %v: %v", want, order, err)
+	}
+	if _, err := startOrder(map[string]MCPStdIOConfig{"a": {DependsOn: []string{"b"}}, "b": {DependsOn: []string{"a"}}, "c": {}}); err == nil || !strings.Contains(err.Error(), "cycle: a, b") {
+		t.Errorf("Expected a cycle to be rejected, got %v", err)
+	}
+	if _, err := startOrder(map[string]MCPStdIOConfig{"a": {DependsOn: []string{"missing"}}}); err == nil {
+		t.Error("Expected an unknown dependency to be rejected")
+	}
+
+	// A server is not started when its dependency is down, and a cyclic config changes nothing
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	registry := newBackendRegistry(mcp.ClientInfo{Name: "test", Version: "1.0.0"})
+	defer registry.shutdown()
+	err = registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"proxy": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "exit"}},
+		"app":   {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve"}, DependsOn: []string{"proxy"}},
+		"other": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve"}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "not starting 'app'") || registry.named("app") != nil || registry.named("other") == nil {
+		t.Errorf("Expected only the independent server to start, got %v", err)
+	}
+	if err := registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{"x": {DependsOn: []string{"x"}}}}); err == nil || registry.named("other") == nil {
+		t.Errorf("Expected the cyclic config to be rejected without stopping servers, got %v", err)
+	}
+}
+
+func TestServerConditions(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	t.Setenv("CONDITION_TOKEN", "set")
+	path := filepath.Join(t.TempDir(), "mcp.json")
+	config := `{
+		"MCPStdIOServers": {
+			"everywhere": {"Command": "echo"},
+			"here": {"Command": "echo", "When": {"OS": ["` + runtime.GOOS + `"], "Env": ["CONDITION_TOKEN"], "Executables": ["go"]}},
+			"elsewhere": {"Command": "notepad.exe", "Env": {"KEY": "${CONDITION_UNSET}"}, "When": {"OS": ["plan9"]}},
+			"unconfigured": {"Command": "echo", "When": {"Env": ["CONDITION_UNSET"]}},
+			"uninstalled": {"Command": "echo", "When": {"Executables": ["no-such-launcher"]}}
 		},
-	)
+		"Profiles": {"dev": {"Servers": ["everywhere", "elsewhere"]}}
+	}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skipped servers' placeholders are not resolved, so they need not be set
+	cfg, err := resolveConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to resolve config: %v", err)
+	}
+	var names []string
+	for name := range cfg.MCPStdIOServers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{"everywhere", "here"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected servers %v, got %v", want, names)
+	}
+	if reason := cfg.skipped["uninstalled"]; reason != "requires no-such-launcher on the PATH" {
+		t.Errorf("Unexpected reason %q", reason)
+	}
+
+	// Profiles may list servers skipped on this machine
+	profiled, err := applyProfile(cfg, "dev")
+	if err != nil || len(profiled.MCPStdIOServers) != 1 {
+		t.Errorf("Expected the profile to keep only the server that runs here, got %v: %v", profiled.MCPStdIOServers, err)
+	}
+}
 
-	// Wait for server to initialize
-	time.Sleep(2 * time.Second)
+// BenchEchoArgs are the arguments of the echo tool served by in-process benchmark backends
+type BenchEchoArgs struct {
+	Message string `json:"message"`
+}
+
+// newPipeBackend connects a client to an in-process MCP server over pipes, so benchmarks measure the
+// proxy path without process start-up noise
+func newPipeBackend(tb testing.TB, name string) *backend {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	tb.Cleanup(func() {
+		_ = clientOut.Close()
+		_ = serverOut.Close()
+	})
 
-	// Initialize client
-	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
-	_, err = client.Initialize(ctx)
-	cancel()
+	server := mcp.NewServer(newStdioTransport(name+" server", serverIn, serverOut, 0))
+	err := server.RegisterTool("echo_"+name, "Echo the message", func(args BenchEchoArgs) (*mcp.ToolResponse, error) {
+		return mcp.NewToolResponse(mcp.NewTextContent(args.Message)), nil
+	})
 	if err != nil {
-		t.Fatalf("Failed to initialize client: %v", err)
+		tb.Fatalf("Failed to register tool: %v", err)
+	}
+	if err := server.Serve(); err != nil {
+		tb.Fatalf("Failed to serve: %v", err)
 	}
 
-	t.Run("FileSystem", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-		defer cancel()
+	upstream := newUpstreamTransport(newStdioTransport(name, clientIn, clientOut, 0), nil)
+	b := &backend{
+		name:     name,
+		client:   mcp.NewClientWithInfo(upstream, mcp.ClientInfo{Name: "bench", Version: "1.0.0"}),
+		upstream: upstream,
+	}
+	if err := initializeBackend(b); err != nil {
+		tb.Fatalf("Failed to initialize backend: %v", err)
+	}
+	return b
+}
 
-		resp, err := client.CallTool(ctx, "tools/call", map[string]interface{}{
-			"name": "list_directory",
-			"arguments": map[string]interface{}{
-				"path": ".",
-			},
-		})
-		if err != nil {
-			t.Errorf("List directory failed: %v", err)
-		} else {
-			t.Logf("Directory listing: %s", resp.Content[0].TextContent.Text)
+// newScriptedBackend returns a backend whose server answers the proxy's own requests with the
+// results of answer, or with a method not found error where answer returns nil
+func newScriptedBackend(tb testing.TB, name string, answer func(method string, params json.RawMessage) interface{}) *backend {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	tb.Cleanup(func() {
+		_ = clientOut.Close()
+		_ = serverOut.Close()
+	})
+	go func() {
+		lines := bufio.NewScanner(serverIn)
+		for lines.Scan() {
+			var request transport.BaseJSONRPCRequest
+			_ = json.Unmarshal(lines.Bytes(), &request)
+			result, _ := json.Marshal(answer(request.Method, request.Params))
+			if string(result) == "null" {
+				fmt.Fprintf(serverOut, `{"jsonrpc":"2.0","id":%d,"error":{"code":-32601,"message":"method not found"}}`+"\n", request.Id)
+				continue
+			}
+			fmt.Fprintf(serverOut, `{"jsonrpc":"2.0","id":%d,"result":%s}`+"\n", request.Id, result)
+		}
+	}()
+
+	upstream := newUpstreamTransport(newStdioTransport(name, clientIn, clientOut, 0), nil)
+	upstream.SetMessageHandler(func(context.Context, *transport.BaseJsonRpcMessage) {})
+	if err := upstream.Start(context.Background()); err != nil {
+		tb.Fatalf("Failed to start transport: %v", err)
+	}
+	return &backend{name: name, upstream: upstream}
+}
+
+// newBenchRouter returns a router over the given number of in-process backends
+func newBenchRouter(tb testing.TB, backends int) *router {
+	registry := newBackendRegistry(mcp.ClientInfo{Name: "bench", Version: "1.0.0"})
+	for i := 0; i < backends; i++ {
+		name := "b" + strconv.Itoa(i)
+		registry.backends[name] = newPipeBackend(tb, name)
+	}
+	return &router{
+		registry: registry,
+		audit:    &auditLogger{},
+		sessions: newSessionStore(),
+		jobs:     newMemoryJobStore(),
+		raw:      newRawResults(),
+	}
+}
+
+func BenchmarkRouterCall(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(b, 5)
+	args := map[string]interface{}{"message": "hello"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := rt.call(context.Background(), "echo_b4", args); err != nil {
+				b.Fatalf("Call failed: %v", err)
+			}
 		}
 	})
+}
 
-	t.Run("DirectoryTree", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-		defer cancel()
+func BenchmarkListToolsAggregation(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rt := newBenchRouter(b, 10)
+	handler := handleListTools(rt).(func(context.Context, ListToolsRequest) (*mcp.ToolResponse, error))
 
-		resp, err := client.CallTool(ctx, "tools/call", map[string]interface{}{
-			"name": "directory_tree",
-			"arguments": map[string]interface{}{
-				"path": ".",
-			},
-		})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := handler(context.Background(), ListToolsRequest{}); err != nil {
+			b.Fatalf("List failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkBackendMemory(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		newPipeBackend(b, "b"+strconv.Itoa(i))
+	}
+}
+
+func TestDrainStderr(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	var stderr strings.Builder
+	stderr.WriteString("starting\n")
+	stderr.WriteString(strings.Repeat("x", maxStderrLine+10) + "\n")
+	for i := 0; i < maxStderrLinesPerSecond+5; i++ {
+		stderr.WriteString("chatty\n")
+	}
+	stderr.WriteString("no trailing newline")
+
+	done := make(chan struct{})
+	drainStderr("test", strings.NewReader(stderr.String()), done)
+	<-done
+
+	output := logs.String()
+	if !strings.Contains(output, "stderr: starting\n") {
+		t.Errorf("Expected first line to be logged, got %q", output[:min(len(output), 200)])
+	}
+	if !strings.Contains(output, "... [truncated 10 bytes]") {
+		t.Error("Expected overlong line to be truncated")
+	}
+	if !strings.Contains(output, "suppressed 8 lines") {
+		t.Errorf("Expected lines beyond the rate limit to be suppressed, got %q", output[len(output)-200:])
+	}
+}
+
+// openFDs counts the file descriptors open in this process
+func openFDs(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("file descriptor accounting needs /proc")
+	}
+	return len(entries)
+}
+
+func TestBackendLifecycleLeaks(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	fds := openFDs(t)
+
+	registry := newBackendRegistry(mcp.ClientInfo{Name: "test", Version: "1.0.0"})
+	err := registry.apply(Config{MCPStdIOServers: map[string]MCPStdIOConfig{
+		"healthy":  {Command: os.Args[0], Env: map[string]string{testBackendEnv: "serve"}},
+		"crashing": {Command: os.Args[0], Env: map[string]string{testBackendEnv: "exit"}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	if owner := registry.owner("echo"); owner == nil || owner.name != "healthy" {
+		t.Errorf("Expected healthy backend to serve echo, got %v", owner)
+	}
+	if backends := registry.list(); len(backends) != 1 {
+		t.Errorf("Expected the backend that exited during initialization to be dropped, got %d backends", len(backends))
+	}
+
+	registry.shutdown()
+	if after := openFDs(t); after != fds {
+		t.Errorf("Leaked %d file descriptors", after-fds)
+	}
+}
+
+// deeplyNested returns JSON arrays nested depth times around value
+func deeplyNested(depth int, value string) string {
+	return strings.Repeat("[", depth) + value + strings.Repeat("]", depth)
+}
+
+func FuzzParseConfig(f *testing.F) {
+	log.SetOutput(io.Discard)
+	f.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, seed := range []string{
+		`{"MCPStdIOServers":{"a":{"Command":"x","Args":["-v"],"Env":{"K":"${HOME}"}}}}`,
+		`{"mcpServers":{"a":{"command":"x","args":["y"]}}}`,
+		`{"Templates":{"base":{"Args":["-v"]}},"MCPStdIOServers":{"a":{"Command":"x","Extends":"base"}}}`,
+		`{"Templates":{"a":{"Extends":"b"},"b":{"Extends":"a"}},"MCPStdIOServers":{"s":{"Extends":"a"}}}`,
+		`{"TagPolicies":{"t":{"Required":true}},"MCPStdIOServers":{"s":{"Command":"x","Tags":["t"]}}}`,
+		`{"MCPStdIOServers":{"s":{"Command":"x","Maintenance":[{"Cron":"0 2 * * 0","Duration":"1h"}]}}}`,
+		`{"MCPStdIOServers":{"":{}}}`,
+		`{"MCPStdIOServers":null,"Templates":[]}`,
+		`{"MCPStdIOServers":{"s":` + deeplyNested(2000, "1") + `}}`,
+		`null`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cfg, err := parseConfig(data)
 		if err != nil {
-			t.Errorf("Directory tree failed: %v", err)
-		} else {
-			t.Logf("Directory tree: %s", resp.Content[0].TextContent.Text)
+			return
+		}
+		// A config that parses is written back as one that parses to the same servers
+		encoded, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatalf("Failed to encode the parsed config: %v", err)
+		}
+		reparsed, err := parseConfig(encoded)
+		if err != nil {
+			t.Fatalf("Failed to parse the encoded config %s: %v", encoded, err)
+		}
+		if len(reparsed.MCPStdIOServers) != len(cfg.MCPStdIOServers) {
+			t.Errorf("Expected %d servers after a round trip, got %d", len(cfg.MCPStdIOServers), len(reparsed.MCPStdIOServers))
 		}
 	})
+}
 
-	t.Run("VisitPage", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
+func FuzzValidateSchema(f *testing.F) {
+	for _, seed := range [][2]string{
+		{`{"type":"object","required":["a"],"properties":{"a":{"type":"string","minLength":2}}}`, `{"a":"x"}`},
+		{`{"type":"array","items":{"type":"integer","minimum":0},"maxItems":2}`, `[1,-2,3]`},
+		{`{"enum":[1,"a",null]}`, `"b"`},
+		{`{"properties":{"a":{"properties":{"b":{"type":"number"}}}},"additionalProperties":false}`, `{"a":{"b":"c"},"d":1}`},
+		{`{"type":["string","null"],"maxLength":-1}`, `"` + strings.Repeat("x", 1<<16) + `"`},
+		{`{"items":{"items":{"items":{}}}}`, deeplyNested(5000, "0")},
+		{`{"type":7,"required":"a","properties":[]}`, `{}`},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+	f.Fuzz(func(t *testing.T, schemaJSON, valueJSON string) {
+		var schema map[string]interface{}
+		var value interface{}
+		if json.Unmarshal([]byte(schemaJSON), &schema) != nil || json.Unmarshal([]byte(valueJSON), &value) != nil {
+			return
+		}
+		validateSchema(schema, value, "$")
+		// Any value satisfies the empty schema
+		if violations := validateSchema(map[string]interface{}{}, value, "$"); len(violations) > 0 {
+			t.Errorf("Expected the empty schema to accept %s, got %v", valueJSON, violations)
+		}
+	})
+}
 
-		resp, err := client.CallTool(ctx, "tools/call", map[string]interface{}{
-			"name": "visit_page",
-			"arguments": map[string]interface{}{
-				"url":            "https://www.krakend.io/docs/overview/playground/",
-				"takeScreenshot": true,
-			},
-		})
+func FuzzSanitizeArguments(f *testing.F) {
+	sanitizers, err := newArgumentSanitizers([]ArgumentSanitizer{
+		{Arguments: []string{"path"}, Type: "path", Roots: []string{"/srv/data"}},
+		{Arguments: []string{"url"}, Type: "url", Hosts: []string{"*.example.com"}},
+	})
+	if err != nil {
+		f.Fatalf("Failed to set up sanitizers: %v", err)
+	}
+	for _, seed := range [][2]string{
+		{"/srv/data/report.txt", "https://docs.example.com/a"},
+		{"/srv/data/../../etc/passwd", "file:///etc/passwd"},
+		{"/srv/data\\..\\secret", "http://example.com.evil.org/"},
+		{"/srv/database", "https://user@docs.example.com:443/"},
+		{"/srv/data/\x00", "http://[::1"},
+		{"//srv//data//./x", "HTTPS://DOCS.EXAMPLE.COM"},
+		{strings.Repeat("/srv/data/a", 1<<12), "https://" + strings.Repeat("a.", 1<<12) + "example.com"},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+	f.Fuzz(func(t *testing.T, path, rawURL string) {
+		sanitized, err := sanitizers.sanitize("read", map[string]interface{}{"path": path, "url": rawURL})
 		if err != nil {
-			t.Errorf("Visit Page failed: %v", err)
-		} else {
-			t.Logf("Visit Page : %s", resp.Content[0].TextContent.Text)
+			return
+		}
+		// Accepted paths are cleaned into the root and accepted URLs reach an allowed host
+		checked := sanitized.(map[string]interface{})["path"].(string)
+		if checked != "/srv/data" && !strings.HasPrefix(checked, "/srv/data/") {
+			t.Errorf("Path %q was accepted as %q, outside the root", path, checked)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || !strings.HasSuffix(strings.ToLower(u.Hostname()), ".example.com") {
+			t.Errorf("URL %q was accepted for host %q", rawURL, u.Hostname())
 		}
 	})
+}
 
-	t.Run("ToolsList", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+func FuzzRouterCall(f *testing.F) {
+	log.SetOutput(io.Discard)
+	f.Cleanup(func() { log.SetOutput(os.Stderr) })
+	rt := newBenchRouter(f, 1)
+	for _, seed := range []struct {
+		name      string
+		arguments string
+	}{
+		{"echo_b0", `{"message":"hello"}`},
+		{"echo_b0", `{"message":"` + strings.Repeat("x", 1<<20) + `"}`},
+		{"echo_b0", `{"message":"nested","extra":` + deeplyNested(1000, `{"a":null}`) + `}`},
+		{"echo_b0", deeplyNested(20000, "1")},
+		{"echo_b0", `"not an object"`},
+		{"echo_b0", `{"message":7}`},
+		{"missing", `{}`},
+		{"", `null`},
+		{"../../echo_b0", `{"message":"x"}`},
+		{"echo_b0\x00", `{"message":"x"}`},
+		{"tools/call", `{"name":"echo_b0","arguments":{"message":"x"}}`},
+		{strings.Repeat("n", 1<<16), `{}`},
+	} {
+		f.Add(seed.name, []byte(seed.arguments))
+	}
+	f.Fuzz(func(t *testing.T, name string, data []byte) {
+		var arguments interface{}
+		if err := json.Unmarshal(data, &arguments); err != nil {
+			arguments = string(data)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-
-		resp, err := client.CallTool(ctx, "tools/list", map[string]interface{}{
-			"name": "tools/list",
-			"arguments": map[string]interface{}{
-				"cursor": "",
-			},
-		})
-		if err != nil {
-			t.Errorf("List tools failed: %v", err)
-		} else {
-			t.Logf("Tools response: %s", resp.Content[0].TextContent.Text)
+		resp, err := rt.call(ctx, name, arguments)
+		if name != "echo_b0" || err != nil {
+			return
+		}
+		// Well-formed calls to the echo tool get their message back
+		if args, ok := arguments.(map[string]interface{}); ok {
+			if message, ok := args["message"].(string); ok && utf8.ValidString(message) && responseText(resp) != message {
+				t.Errorf("Expected the echoed message, got %q", responseText(resp))
+			}
 		}
 	})
 }
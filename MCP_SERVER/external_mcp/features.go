@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Feature flags gating experimental subsystems
+const (
+	// featureAsyncJobs lets tools/call run a call in the background and return a job id
+	featureAsyncJobs = "AsyncJobs"
+	// featureFuzzyMatching routes calls to unknown tools to the one tool whose name is close enough
+	featureFuzzyMatching = "FuzzyMatching"
+	// featureResultCache caches the results of the tools matched by Cache.Results
+	featureResultCache = "ResultCache"
+)
+
+// defaultFeatures are the flags' values when a deployment does not set them. Subsystems ship dark
+// until they are proven, so new ones default to off.
+var defaultFeatures = map[string]bool{
+	featureAsyncJobs:     true,
+	featureFuzzyMatching: false,
+	featureResultCache:   true,
+}
+
+// maxFuzzyDistance is the most edits a tool name may be from the tool a call is routed to
+const maxFuzzyDistance = 2
+
+// FeatureFlags turns experimental subsystems on or off for a deployment, by flag name
+type FeatureFlags map[string]bool
+
+// check rejects flags this build does not know, which are most likely typos
+func (f FeatureFlags) check() error {
+	var unknown []string
+	for name := range f {
+		if _, ok := defaultFeatures[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown feature flags: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// enabled reports whether the named subsystem is on, falling back to its default
+func (f FeatureFlags) enabled(name string) bool {
+	if on, ok := f[name]; ok {
+		return on
+	}
+	return defaultFeatures[name]
+}
+
+// resolveTool returns the name of the tool a call to name is routed to: name itself when a backend
+// advertises it, otherwise the closest advertised name when fuzzy matching is on and exactly one
+// is close enough
+func (rt *router) resolveTool(ctx context.Context, name string) string {
+	if !rt.features.enabled(featureFuzzyMatching) || rt.registry.owner(name) != nil {
+		return name
+	}
+	routes := rt.registry.routes()
+	tools := make([]string, 0, len(routes))
+	for tool := range routes {
+		tools = append(tools, tool)
+	}
+	if match := closestTool(name, tools); match != "" {
+		logf(ctx, "Routing call to unknown tool '%s' to '%s'", name, match)
+		return match
+	}
+	return name
+}
+
+// closestTool returns the tool whose name matches name once case and separators are ignored, or
+// failing that the one nearest to it within maxFuzzyDistance edits. Ties match nothing.
+func closestTool(name string, tools []string) string {
+	key := fuzzyKey(name)
+	best, bestDistance, tied := "", maxFuzzyDistance+1, false
+	for _, tool := range tools {
+		distance := 0
+		if candidate := fuzzyKey(tool); candidate != key {
+			distance = editDistance(key, candidate)
+		}
+		switch {
+		case distance < bestDistance:
+			best, bestDistance, tied = tool, distance, false
+		case distance == bestDistance:
+			tied = true
+		}
+	}
+	if tied {
+		return ""
+	}
+	return best
+}
+
+// fuzzyKey lowercases name and drops the separators hosts and models tend to get wrong
+func fuzzyKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', '_', '.', ' ', '/':
+			return -1
+		}
+		return r
+	}, strings.ToLower(name))
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
@@ -2,12 +2,18 @@ module weather
 
 go 1.24.3
 
-require github.com/metoro-io/mcp-golang v0.12.0
+require (
+	github.com/metoro-io/mcp-golang v0.12.0
+	go.starlark.net v0.0.0-20250417143717-f57e51f710eb
+	go.uber.org/goleak v1.3.0
+	golang.org/x/term v0.32.0
+)
 
 require (
 	github.com/bahlo/generic-list-go v0.2.0 // indirect
 	github.com/buger/jsonparser v1.1.1 // indirect
 	github.com/invopop/jsonschema v0.12.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
 	github.com/mailru/easyjson v0.7.7 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/tidwall/gjson v1.18.0 // indirect
@@ -15,5 +21,6 @@ require (
 	github.com/tidwall/pretty v1.2.1 // indirect
 	github.com/tidwall/sjson v1.2.5 // indirect
 	github.com/wk8/go-ordered-map/v2 v2.1.8 // indirect
+	golang.org/x/sys v0.33.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
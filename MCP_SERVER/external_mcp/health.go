@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// heartbeatInterval is how often the liveness heartbeat ticks
+	heartbeatInterval = time.Second
+	// maxHeartbeatAge is how stale the heartbeat may get before the process is reported dead
+	maxHeartbeatAge = 10 * time.Second
+)
+
+// health serves the liveness and readiness probes used by orchestrators such as Kubernetes
+type health struct {
+	registry *backendRegistry
+	clock    clock
+	// heartbeat is the time the heartbeat goroutine last ran, in Unix nanoseconds
+	heartbeat atomic.Int64
+	serving   atomic.Bool
+	draining  atomic.Bool
+}
+
+// newHealth starts the heartbeat that liveness is judged by
+func newHealth(registry *backendRegistry, clock clock) *health {
+	h := &health{registry: registry, clock: clock}
+	h.heartbeat.Store(clock.Now().UnixNano())
+	go func() {
+		for {
+			now := <-clock.After(heartbeatInterval)
+			h.heartbeat.Store(now.UnixNano())
+		}
+	}()
+	return h
+}
+
+// markServing reports the aggregator ready once required backends are up too
+func (h *health) markServing() {
+	h.serving.Store(true)
+}
+
+// markDraining withdraws readiness so load balancers stop sending traffic while the calls in flight finish
+func (h *health) markDraining() {
+	h.draining.Store(true)
+}
+
+// alive reports whether the heartbeat is recent: the process is live while its scheduler keeps
+// running goroutines
+func (h *health) alive() bool {
+	return h.heartbeatAge() <= maxHeartbeatAge
+}
+
+func (h *health) heartbeatAge() time.Duration {
+	return h.clock.Now().Sub(time.Unix(0, h.heartbeat.Load()))
+}
+
+// live answers /healthz
+func (h *health) live(w http.ResponseWriter, r *http.Request) {
+	if !h.alive() {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "stalled", "heartbeatAge": h.heartbeatAge().String()})
+		return
+	}
+	writeHealth(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+// ready answers /readyz: traffic is accepted once the server is serving and every required backend
+// has initialized, until the server starts draining
+func (h *health) ready(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "draining"})
+		return
+	}
+	if !h.serving.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "starting"})
+		return
+	}
+	if unready := h.registry.unready(); len(unready) > 0 {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "unready": unready})
+		return
+	}
+	writeHealth(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+func writeHealth(w http.ResponseWriter, status int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HMACConfig represents the request signing configuration for deployments where a gateway fronts the aggregator.
+//
+// Callers sign each request as hex(HMAC-SHA256(secret, timestamp + "\n" + nonce + "\n" + body)) and send
+// X-MCP-Caller, X-MCP-Timestamp (unix seconds), X-MCP-Nonce and X-MCP-Signature headers.
+type HMACConfig struct {
+	Callers map[string]string `json:"Callers"`
+	Window  Duration          `json:"Window,omitempty"`
+}
+
+// hmacVerifier checks request signatures and rejects replayed nonces within the timestamp window
+type hmacVerifier struct {
+	callers map[string][]byte
+	window  time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func newHMACVerifier(cfg *HMACConfig) *hmacVerifier {
+	window := time.Duration(cfg.Window)
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	callers := make(map[string][]byte, len(cfg.Callers))
+	for caller, secret := range cfg.Callers {
+		callers[caller] = []byte(secret)
+	}
+	return &hmacVerifier{
+		callers: callers,
+		window:  window,
+		nonces:  make(map[string]time.Time),
+	}
+}
+
+// signature computes the expected signature of a request
+func (v *hmacVerifier) signature(secret []byte, timestamp, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// verify reports why a request fails verification, or "" if it is valid
+func (v *hmacVerifier) verify(r *http.Request, body []byte, now time.Time) string {
+	secret, ok := v.callers[r.Header.Get("X-MCP-Caller")]
+	if !ok {
+		return "unknown caller"
+	}
+
+	timestamp := r.Header.Get("X-MCP-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "invalid timestamp"
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > v.window || skew < -v.window {
+		return "timestamp outside the allowed window"
+	}
+
+	nonce := r.Header.Get("X-MCP-Nonce")
+	if nonce == "" {
+		return "missing nonce"
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get("X-MCP-Signature"))
+	if err != nil || !hmac.Equal(signature, v.signature(secret, timestamp, nonce, body)) {
+		return "invalid signature"
+	}
+
+	// Only remember nonces of correctly signed requests so forged traffic can't fill the cache
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for seen, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, seen)
+		}
+	}
+	key := r.Header.Get("X-MCP-Caller") + "/" + nonce
+	if _, replayed := v.nonces[key]; replayed {
+		return "replayed nonce"
+	}
+	v.nonces[key] = now.Add(2 * v.window)
+	return ""
+}
+
+// middleware rejects HTTP requests whose signature doesn't verify
+func (v *hmacVerifier) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxHTTPBodySize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if reason := v.verify(r, body, time.Now()); reason != "" {
+			http.Error(w, "Signature verification failed: "+reason, http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sync"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// HostProfile tailors the tools exposed to a downstream host. A host is matched by the client name
+// it announced in initialize or by its authenticated identity; the first matching profile applies.
+type HostProfile struct {
+	Name string `json:"Name"`
+	// ClientNames are patterns matched against the clientInfo name, e.g. "claude-ai" or "agent-*"
+	ClientNames []string `json:"ClientNames,omitempty"`
+	// Identities are authenticated identities the profile applies to
+	Identities []string `json:"Identities,omitempty"`
+	// Tools are patterns of the tools advertised to and callable by the host; empty exposes every tool
+	Tools []string `json:"Tools,omitempty"`
+	// CatalogBudget replaces the global catalog budget for the host
+	CatalogBudget *CatalogBudgetConfig `json:"CatalogBudget,omitempty"`
+}
+
+// hostProfiles remembers the client each downstream session announced and picks its profile.
+// A nil set of host profiles exposes every tool to every host.
+type hostProfiles struct {
+	profiles []HostProfile
+
+	mu      sync.Mutex
+	clients map[string]string
+}
+
+func newHostProfiles(profiles []HostProfile) *hostProfiles {
+	if len(profiles) == 0 {
+		return nil
+	}
+	return &hostProfiles{profiles: profiles, clients: make(map[string]string)}
+}
+
+// observe records the client name from initialize requests; it decorates the downstream transport
+func (h *hostProfiles) observe(ctx context.Context, message *transport.BaseJsonRpcMessage) context.Context {
+	if h == nil || message.Type != transport.BaseMessageTypeJSONRPCRequestType || message.JsonRpcRequest.Method != "initialize" {
+		return ctx
+	}
+
+	var params struct {
+		ClientInfo struct {
+			Name string `json:"name"`
+		} `json:"clientInfo"`
+	}
+	if err := json.Unmarshal(message.JsonRpcRequest.Params, &params); err != nil {
+		return ctx
+	}
+	sessionID := sessionScope(ctx)
+	h.mu.Lock()
+	h.clients[sessionID] = params.ClientInfo.Name
+	h.mu.Unlock()
+
+	if profile := h.match(params.ClientInfo.Name, identityFromContext(ctx)); profile != nil {
+		log.Printf("Host '%s' uses profile '%s'", params.ClientInfo.Name, profile.Name)
+	}
+	return ctx
+}
+
+// forget drops what is known about a session's client
+func (h *hostProfiles) forget(sessionID string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, sessionID)
+}
+
+// profile returns the profile of the host behind ctx, or nil when no profile applies
+func (h *hostProfiles) profile(ctx context.Context) *HostProfile {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	client := h.clients[sessionScope(ctx)]
+	h.mu.Unlock()
+	return h.match(client, identityFromContext(ctx))
+}
+
+func (h *hostProfiles) match(client string, id identity) *HostProfile {
+	for i, profile := range h.profiles {
+		for _, pattern := range profile.ClientNames {
+			if matched, _ := path.Match(pattern, client); matched && client != "" {
+				return &h.profiles[i]
+			}
+		}
+		for _, name := range profile.Identities {
+			if name == id.Name {
+				return &h.profiles[i]
+			}
+		}
+	}
+	return nil
+}
+
+// exposes reports whether the profile lets its host see and call the named tool
+func (p *HostProfile) exposes(tool string) bool {
+	if p == nil || len(p.Tools) == 0 {
+		return true
+	}
+	for _, pattern := range p.Tools {
+		if matched, _ := path.Match(pattern, tool); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// exposed reports whether the caller in ctx may see and call the named tool, both by role and by host profile
+func (rt *router) exposed(ctx context.Context, tool string) bool {
+	return rt.authz.allowed(identityFromContext(ctx), tool) && rt.hosts.profile(ctx).exposes(tool)
+}
+
+// catalogBudget returns the catalog budget for the host behind ctx
+func (rt *router) catalogBudget(ctx context.Context) *CatalogBudgetConfig {
+	if profile := rt.hosts.profile(ctx); profile != nil && profile.CatalogBudget != nil {
+		return profile.CatalogBudget
+	}
+	return rt.budget
+}
+
+// authorizeHost returns an error unless the host behind ctx is exposed to the named tool
+func (rt *router) authorizeHost(ctx context.Context, tool string) error {
+	if profile := rt.hosts.profile(ctx); !profile.exposes(tool) {
+		return fmt.Errorf("permission denied: tool '%s' is not exposed to host profile '%s'", tool, profile.Name)
+	}
+	return nil
+}
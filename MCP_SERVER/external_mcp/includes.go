@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// includeConfigs merges the fragments the config at location Includes under the config itself, so
+// an org-wide base can be combined with personal additions. Later fragments override earlier ones
+// and the including config overrides them all, merging objects key by key like templates do.
+// Relative includes are resolved against the including config, and fragments can include others.
+func includeConfigs(data []byte, location string, seen []string) ([]byte, error) {
+	var document map[string]interface{}
+	if err := decodeJSONNumbers(data, &document); err != nil || document["Include"] == nil {
+		// Not ours to expand; parseConfig reports malformed configs
+		return data, nil
+	}
+	var includes []string
+	switch include := document["Include"].(type) {
+	case string:
+		includes = []string{include}
+	case []interface{}:
+		for _, entry := range include {
+			path, ok := entry.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid Include in %s: expected paths or URLs", location)
+			}
+			includes = append(includes, path)
+		}
+	default:
+		return nil, fmt.Errorf("invalid Include in %s: expected paths or URLs", location)
+	}
+	delete(document, "Include")
+
+	// Compare local configs by absolute path, so a cycle is found however the includes spell it
+	if !isRemoteConfig(location) {
+		if abs, err := filepath.Abs(location); err == nil {
+			location = abs
+		}
+	}
+	seen = append(seen, location)
+	var merged interface{} = map[string]interface{}{}
+	for _, include := range includes {
+		target, err := includeLocation(location, include)
+		if err != nil {
+			return nil, err
+		}
+		for _, ancestor := range seen {
+			if ancestor == target {
+				return nil, fmt.Errorf("configs include each other in a cycle: %s -> %s", strings.Join(seen, " -> "), target)
+			}
+		}
+		fragment, err := readConfigFragment(target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to include %s: %v", target, err)
+		}
+		if fragment, err = includeConfigs(fragment, target, seen); err != nil {
+			return nil, err
+		}
+		var decoded map[string]interface{}
+		if err := decodeJSONNumbers(fragment, &decoded); err != nil {
+			return nil, fmt.Errorf("invalid config in %s: %v", target, err)
+		}
+		merged = mergeJSON(merged, decoded)
+	}
+	return json.Marshal(mergeJSON(merged, document))
+}
+
+// includeLocation resolves an include relative to the config including it
+func includeLocation(location string, include string) (string, error) {
+	if isRemoteConfig(include) {
+		return include, nil
+	}
+	if isRemoteConfig(location) {
+		base, err := url.Parse(location)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(include)
+		if err != nil {
+			return "", fmt.Errorf("invalid include '%s': %v", include, err)
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+	if filepath.IsAbs(include) {
+		return filepath.Clean(include), nil
+	}
+	return filepath.Join(filepath.Dir(location), include), nil
+}
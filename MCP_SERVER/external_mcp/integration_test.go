@@ -0,0 +1,292 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+	"github.com/metoro-io/mcp-golang/transport/stdio"
+)
+
+// integrationTimeout bounds pulling the backend images and waiting for the backends to come up
+const integrationTimeout = 5 * time.Minute
+
+// integrationHarness runs the aggregator binary against community servers in containers and the
+// hello_mcp server, talking MCP to it over stdio and reading its state from the admin listener
+type integrationHarness struct {
+	client *mcp.Client
+	admin  string
+}
+
+// TestIntegration exercises listing, calls and the recovery of a crashed backend end to end. It
+// needs Docker with the compose plugin and runs with go test -tags=integration.
+func TestIntegration(t *testing.T) {
+	h := startIntegrationHarness(t)
+
+	t.Run("List", func(t *testing.T) {
+		text := h.call(t, "tools/list", ListToolsRequest{})
+		for _, tool := range []string{`"list_directory"`, `"fetch"`, `"reverse"`} {
+			if !strings.Contains(text, tool) {
+				t.Errorf("Expected %s in the tool list, got %s", tool, text)
+			}
+		}
+	})
+
+	t.Run("Filesystem", func(t *testing.T) {
+		if text := h.call(t, "list_directory", map[string]interface{}{"path": "/projects"}); !strings.Contains(text, "hello.txt") {
+			t.Errorf("Expected the fixture in the listing, got %s", text)
+		}
+	})
+
+	t.Run("Fetch", func(t *testing.T) {
+		// The page is served on every interface so the container reaches it through the host gateway
+		listener, err := net.Listen("tcp", "0.0.0.0:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		page := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/robots.txt" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = io.WriteString(w, "<html><body><h1>Integration page</h1></body></html>")
+		})}
+		go func() { _ = page.Serve(listener) }()
+		defer page.Close()
+
+		url := fmt.Sprintf("http://host.docker.internal:%d/", listener.Addr().(*net.TCPAddr).Port)
+		if text := h.call(t, "fetch", map[string]interface{}{"url": url}); !strings.Contains(text, "Integration page") {
+			t.Errorf("Expected the fetched page, got %s", text)
+		}
+	})
+
+	t.Run("Hello", func(t *testing.T) {
+		if text := h.call(t, "reverse", map[string]interface{}{"text": "aggregator"}); text != "rotagergga" {
+			t.Errorf("Expected the reversed text, got %q", text)
+		}
+	})
+
+	t.Run("Failover", func(t *testing.T) {
+		// Kill the filesystem backend behind the aggregator's back, then restart it from the dashboard
+		pid := h.backend(t, "filesystem").PID
+		if process, err := os.FindProcess(pid); err != nil || process.Kill() != nil {
+			t.Fatalf("Failed to kill the filesystem backend %d: %v", pid, err)
+		}
+		h.waitFor(t, "the filesystem backend to exit", func() bool { return h.backend(t, "filesystem").State == "exited" })
+
+		h.post(t, "/dashboard/api/backends/filesystem/restart")
+		h.waitFor(t, "the filesystem backend to run again", func() bool { return h.backend(t, "filesystem").State == "running" })
+		if text := h.call(t, "list_directory", map[string]interface{}{"path": "/projects"}); !strings.Contains(text, "hello.txt") {
+			t.Errorf("Expected the restarted backend to serve the listing, got %s", text)
+		}
+	})
+}
+
+// startIntegrationHarness builds the binaries, pulls the backend images and starts the aggregator,
+// returning once every backend is ready. It skips the test when Docker is not available.
+func startIntegrationHarness(t *testing.T) *integrationHarness {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("Docker is not available")
+	}
+	binaries := buildIntegrationBinaries(t)
+	dir := t.TempDir()
+
+	composeFile, err := filepath.Abs(filepath.Join("testdata", "integration", "compose.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to locate the compose file: %v", err)
+	}
+	compose := []string{"compose", "-f", composeFile, "-p", fmt.Sprintf("mcpintegration%d", os.Getpid())}
+	docker := func(args ...string) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), integrationTimeout)
+		defer cancel()
+		return exec.CommandContext(ctx, "docker", append(compose, args...)...).CombinedOutput()
+	}
+	if output, err := docker("pull"); err != nil {
+		t.Fatalf("Failed to pull the backend images: %v\n%s", err, output)
+	}
+	t.Cleanup(func() { _, _ = docker("down", "--remove-orphans") })
+
+	container := func(service string) map[string]interface{} {
+		return map[string]interface{}{
+			"Command":  "docker",
+			"Args":     append(append([]string{}, compose...), "run", "--rm", "-i", "-T", service),
+			"Required": true,
+		}
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"MCPStdIOServers": map[string]interface{}{
+			"filesystem": container("filesystem"),
+			"fetch":      container("fetch"),
+			"hello":      map[string]interface{}{"Command": binaries["hellomcp"], "Required": true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode the config: %v", err)
+	}
+	configPath := filepath.Join(dir, "mcp.json")
+	if err := os.WriteFile(configPath, config, 0o600); err != nil {
+		t.Fatalf("Failed to write the config: %v", err)
+	}
+
+	// The aggregator's log is shown only when the test fails
+	logPath := filepath.Join(dir, "externalmcp.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		t.Fatalf("Failed to create the log: %v", err)
+	}
+	h := &integrationHarness{admin: freeIntegrationAddr(t)}
+	cmd := exec.Command(binaries["externalmcp"], "-config", configPath, "-admin", h.admin)
+	cmd.Stderr = logFile
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("Failed to create stdin pipe: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Failed to create stdout pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start the aggregator: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(30 * time.Second):
+			_ = cmd.Process.Kill()
+			<-exited
+		}
+		logFile.Close()
+		if t.Failed() {
+			if logs, err := os.ReadFile(logPath); err == nil {
+				t.Logf("Aggregator log:\n%s", logs)
+			}
+		}
+	})
+
+	// The aggregator reports ready once it serves and every required backend has initialized
+	h.waitFor(t, "the aggregator to be ready", func() bool {
+		select {
+		case <-exited:
+			t.Fatal("The aggregator exited during startup")
+		default:
+		}
+		resp, err := http.Get("http://" + h.admin + "/readyz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+
+	h.client = mcp.NewClientWithInfo(stdio.NewStdioServerTransportWithIO(stdout, stdin), mcp.ClientInfo{Name: "integration", Version: "1.0.0"})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := h.client.Initialize(ctx); err != nil {
+		t.Fatalf("Failed to initialize the client: %v", err)
+	}
+	return h
+}
+
+// buildIntegrationBinaries builds the binaries of every server in the repository, returning their paths by name
+func buildIntegrationBinaries(t *testing.T) map[string]string {
+	dir := t.TempDir()
+	binaries := make(map[string]string)
+	for name, source := range map[string]string{"externalmcp": ".", "hellomcp": "../hello_mcp", "intermediatemcp": "../intermediate_mcp"} {
+		binaries[name] = filepath.Join(dir, name)
+		cmd := exec.Command("go", "build", "-o", binaries[name], ".")
+		cmd.Dir = source
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Failed to build %s: %v\n%s", name, err, output)
+		}
+	}
+	return binaries
+}
+
+// freeIntegrationAddr returns a local address nothing listens on
+func freeIntegrationAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// call calls a tool through the aggregator and returns the text of its result
+func (h *integrationHarness) call(t *testing.T, tool string, arguments interface{}) string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	resp, err := h.client.CallTool(ctx, tool, arguments)
+	if err != nil {
+		t.Fatalf("Call to %s failed: %v", tool, err)
+	}
+	return responseText(resp)
+}
+
+// backend returns the dashboard's status of the named backend
+func (h *integrationHarness) backend(t *testing.T, name string) backendStatus {
+	resp, err := http.Get("http://" + h.admin + "/dashboard/api/status")
+	if err != nil {
+		t.Fatalf("Failed to read the status: %v", err)
+	}
+	defer resp.Body.Close()
+	var status struct {
+		Backends []backendStatus `json:"backends"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode the status: %v", err)
+	}
+	for _, backend := range status.Backends {
+		if backend.Name == name {
+			return backend
+		}
+	}
+	t.Fatalf("No backend '%s' in the status", name)
+	return backendStatus{}
+}
+
+// post runs a dashboard action
+func (h *integrationHarness) post(t *testing.T, path string) {
+	request, _ := http.NewRequest(http.MethodPost, "http://"+h.admin+path, nil)
+	request.Header.Set("X-MCP-Dashboard", "1")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("POST %s failed: %s %s", path, resp.Status, body)
+	}
+}
+
+// waitFor polls condition until it holds, failing the test once integrationTimeout passes
+func (h *integrationHarness) waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(integrationTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
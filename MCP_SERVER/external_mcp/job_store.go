@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultJobRetention is how long finished jobs are kept when no retention is configured
+const defaultJobRetention = 24 * time.Hour
+
+// JobsConfig configures where async jobs are kept and for how long
+type JobsConfig struct {
+	// Dir persists jobs as files so they survive restarts; empty keeps them in memory
+	Dir string `json:"Dir,omitempty"`
+	// Retention removes finished jobs this long after they finish
+	Retention Duration `json:"Retention,omitempty"`
+}
+
+// openJobStore returns the job store described by cfg, in memory when no directory is configured.
+// The instances of a cluster keep their jobs in the cluster's store.
+func openJobStore(cfg *JobsConfig, shared *cluster) (jobStore, error) {
+	if shared != nil {
+		return shared.jobStore(), nil
+	}
+	if cfg == nil || cfg.Dir == "" {
+		return newMemoryJobStore(), nil
+	}
+	return newFileJobStore(cfg.Dir)
+}
+
+// jobRetention returns the configured retention for finished jobs
+func jobRetention(cfg *JobsConfig) time.Duration {
+	if cfg == nil || cfg.Retention <= 0 {
+		return defaultJobRetention
+	}
+	return time.Duration(cfg.Retention)
+}
+
+// fileJobStore keeps each job as a JSON file named after its id
+type fileJobStore struct {
+	dir string
+}
+
+func newFileJobStore(dir string) (*fileJobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create job directory: %v", err)
+	}
+	return &fileJobStore{dir: dir}, nil
+}
+
+func (s *fileJobStore) path(id string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return "", fmt.Errorf("invalid job id '%s'", id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// put writes the job to a temporary file and renames it into place so readers never see partial jobs
+func (s *fileJobStore) put(j job) error {
+	path, err := s.path(j.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *fileJobStore) get(id string) (job, bool, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return job{}, false, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return job{}, false, nil
+	}
+	if err != nil {
+		return job{}, false, err
+	}
+
+	var j job
+	if err := json.Unmarshal(data, &j); err != nil {
+		return job{}, false, fmt.Errorf("corrupt job '%s': %v", id, err)
+	}
+	return j, true, nil
+}
+
+func (s *fileJobStore) list() ([]job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []job
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		j, found, err := s.get(id)
+		if err != nil {
+			log.Printf("Skipping job file '%s': %v", entry.Name(), err)
+			continue
+		}
+		if found {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
+
+func (s *fileJobStore) remove(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pruneJobs removes finished jobs older than retention from the store, checking periodically
+func pruneJobs(store jobStore, retention time.Duration) {
+	interval := retention / 4
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		removed, err := pruneFinishedJobs(store, time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Failed to prune jobs: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("Pruned %d finished jobs", removed)
+		}
+	}
+}
+
+// pruneFinishedJobs removes the jobs that finished before cutoff and returns how many were removed
+func pruneFinishedJobs(store jobStore, cutoff time.Time) (int, error) {
+	jobs, err := store.list()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, j := range jobs {
+		if j.State == jobRunning || j.Finished.After(cutoff) {
+			continue
+		}
+		if err := store.remove(j.ID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
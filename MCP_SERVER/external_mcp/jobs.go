@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// Job states
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// job is a tool call running in the background on behalf of a caller
+type job struct {
+	ID        string         `json:"id"`
+	Tool      string         `json:"tool"`
+	Identity  string         `json:"identity"`
+	Roles     []string       `json:"roles,omitempty"`
+	Arguments interface{}    `json:"arguments,omitempty"`
+	State     string         `json:"state"`
+	Created   time.Time      `json:"created"`
+	Finished  time.Time      `json:"finished,omitempty"`
+	Content   []*mcp.Content `json:"content,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	// Instance is the URL of the cluster instance running the job
+	Instance string `json:"instance,omitempty"`
+	// Session is the session the job was started in
+	Session string `json:"session,omitempty"`
+	// ArgumentsDropped and ResultDropped mark the payloads the data handling config kept out of the store
+	ArgumentsDropped bool `json:"argumentsDropped,omitempty"`
+	ResultDropped    bool `json:"resultDropped,omitempty"`
+}
+
+// jobStore keeps the state of async jobs
+type jobStore interface {
+	put(j job) error
+	get(id string) (job, bool, error)
+	list() ([]job, error)
+	remove(id string) error
+}
+
+// memoryJobStore keeps jobs in memory for the lifetime of the process
+type memoryJobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]job
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{jobs: make(map[string]job)}
+}
+
+func (s *memoryJobStore) put(j job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.ID] = j
+	return nil
+}
+
+func (s *memoryJobStore) get(id string) (job, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j, ok := s.jobs[id]
+	return j, ok, nil
+}
+
+func (s *memoryJobStore) list() ([]job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	jobs := make([]job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func (s *memoryJobStore) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	return nil
+}
+
+// startJob runs the tool call in the background and returns the job tracking it. The call keeps the
+// caller's identity and session but outlives the request that started it.
+func (rt *router) startJob(ctx context.Context, name string, arguments interface{}) (job, error) {
+	id, err := randomID()
+	if err != nil {
+		return job{}, err
+	}
+	caller := identityFromContext(ctx)
+	j := job{
+		ID:        id,
+		Tool:      name,
+		Identity:  caller.Name,
+		Roles:     caller.Roles,
+		Arguments: arguments,
+		State:     jobRunning,
+		Created:   time.Now().UTC(),
+		Instance:  rt.instance,
+		Session:   sessionIDFromContext(ctx),
+	}
+	if err := rt.jobs.put(j); err != nil {
+		return job{}, fmt.Errorf("failed to store job: %v", err)
+	}
+
+	go rt.runJob(withoutBudget(context.WithoutCancel(ctx)), j)
+	return j, nil
+}
+
+// runJob calls the job's tool and stores the outcome
+func (rt *router) runJob(ctx context.Context, j job) {
+	resp, err := func() (resp *mcp.ToolResponse, err error) {
+		defer recoverPanic(ctx, "job '"+j.ID+"'", &err)
+		return rt.call(ctx, j.Tool, j.Arguments)
+	}()
+	j.Finished = time.Now().UTC()
+	if err != nil {
+		j.State = jobFailed
+		j.Error = err.Error()
+	} else {
+		j.State = jobSucceeded
+		j.Content = contentOf(resp)
+	}
+	if err := rt.jobs.put(j); err != nil {
+		log.Printf("Failed to store result of job '%s': %v", j.ID, err)
+	}
+}
+
+// resumeJobs restarts the jobs that were still running when the previous process stopped
+func (rt *router) resumeJobs() {
+	jobs, err := rt.jobs.list()
+	if err != nil {
+		log.Printf("Failed to list jobs: %v", err)
+		return
+	}
+	for _, j := range jobs {
+		// Jobs of the other instances of a cluster are theirs to resume
+		if j.State != jobRunning || j.Instance != rt.instance {
+			continue
+		}
+		if j.ArgumentsDropped {
+			j.State, j.Error, j.Finished = jobFailed, "its arguments were not persisted, so it could not be resumed", time.Now().UTC()
+			if err := rt.jobs.put(j); err != nil {
+				log.Printf("Failed to store job '%s': %v", j.ID, err)
+			}
+			continue
+		}
+		log.Printf("Resuming job '%s' calling tool '%s'", j.ID, j.Tool)
+		ctx := contextWithIdentity(context.Background(), identity{Name: j.Identity, Roles: j.Roles})
+		go rt.runJob(ctx, j)
+	}
+}
+
+// lookupJob returns the job with the given id if it belongs to the caller in ctx
+func (rt *router) lookupJob(ctx context.Context, id string) (job, error) {
+	j, ok, err := rt.jobs.get(id)
+	if err != nil {
+		return job{}, fmt.Errorf("failed to load job: %v", err)
+	}
+	if !ok || j.Identity != identityFromContext(ctx).Name {
+		return job{}, fmt.Errorf("job '%s' not found", id)
+	}
+	return j, nil
+}
+
+// randomID returns a random hex identifier for jobs and artifacts
+func randomID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate id: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+type JobRequest struct {
+	JobID string `json:"jobId" jsonschema:"required,description=Job id returned by an async tools/call"`
+}
+
+func handleJobStatus(rt *router) interface{} {
+	return func(ctx context.Context, args JobRequest) (*mcp.ToolResponse, error) {
+		j, err := rt.lookupJob(ctx, args.JobID)
+		if err != nil {
+			return nil, err
+		}
+
+		status := map[string]interface{}{
+			"jobId":   j.ID,
+			"tool":    j.Tool,
+			"state":   j.State,
+			"created": j.Created,
+		}
+		if j.State == jobRunning {
+			status["elapsed"] = time.Since(j.Created).Round(time.Millisecond).String()
+		} else {
+			status["finished"] = j.Finished
+			status["elapsed"] = j.Finished.Sub(j.Created).Round(time.Millisecond).String()
+		}
+
+		statusJSON, err := json.Marshal(status)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal job status: %v", err)
+		}
+		return mcp.NewToolResponse(mcp.NewTextContent(string(statusJSON))), nil
+	}
+}
+
+func handleJobResult(rt *router) interface{} {
+	return func(ctx context.Context, args JobRequest) (*mcp.ToolResponse, error) {
+		j, err := rt.lookupJob(ctx, args.JobID)
+		if err != nil {
+			return nil, err
+		}
+
+		switch j.State {
+		case jobSucceeded:
+			if j.ResultDropped {
+				return nil, fmt.Errorf("the result of job '%s' was not persisted", j.ID)
+			}
+			return &mcp.ToolResponse{Content: j.Content}, nil
+		case jobFailed:
+			return nil, fmt.Errorf("job '%s' failed: %s", j.ID, j.Error)
+		default:
+			return nil, fmt.Errorf("job '%s' is still %s", j.ID, j.State)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	mcp "github.com/metoro-io/mcp-golang"
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// LocalizationConfig translates tool descriptions for hosts whose agents are prompted in other languages
+type LocalizationConfig struct {
+	// Descriptions maps a locale, e.g. "de" or "pt-BR", to tool descriptions by tool name. A host
+	// asking for "pt-BR" falls back to "pt" for tools without a "pt-BR" description.
+	Descriptions map[string]map[string]string `json:"Descriptions"`
+	// DefaultLocale applies to hosts that announce no locale; empty keeps the servers' descriptions
+	DefaultLocale string `json:"DefaultLocale,omitempty"`
+}
+
+// localizer remembers the locale each downstream session announced and translates its catalog.
+// A nil localizer keeps every description as the servers wrote it.
+type localizer struct {
+	descriptions  map[string]map[string]string
+	defaultLocale string
+
+	mu      sync.Mutex
+	locales map[string]string
+}
+
+func newLocalizer(cfg *LocalizationConfig) *localizer {
+	if cfg == nil || len(cfg.Descriptions) == 0 {
+		return nil
+	}
+	l := &localizer{descriptions: make(map[string]map[string]string), defaultLocale: normalizeLocale(cfg.DefaultLocale), locales: make(map[string]string)}
+	for locale, descriptions := range cfg.Descriptions {
+		l.descriptions[normalizeLocale(locale)] = descriptions
+	}
+	return l
+}
+
+// observe records the locale a host announced in initialize, as clientInfo.locale or _meta.locale;
+// it decorates the downstream transport
+func (l *localizer) observe(ctx context.Context, message *transport.BaseJsonRpcMessage) context.Context {
+	if l == nil || message.Type != transport.BaseMessageTypeJSONRPCRequestType || message.JsonRpcRequest.Method != "initialize" {
+		return ctx
+	}
+	var params struct {
+		ClientInfo struct {
+			Locale string `json:"locale"`
+		} `json:"clientInfo"`
+		Meta struct {
+			Locale string `json:"locale"`
+		} `json:"_meta"`
+	}
+	if err := json.Unmarshal(message.JsonRpcRequest.Params, &params); err != nil {
+		return ctx
+	}
+	locale := params.Meta.Locale
+	if locale == "" {
+		locale = params.ClientInfo.Locale
+	}
+	if locale != "" {
+		l.mu.Lock()
+		l.locales[sessionScope(ctx)] = normalizeLocale(locale)
+		l.mu.Unlock()
+	}
+	return ctx
+}
+
+// forget drops the locale of a session
+func (l *localizer) forget(sessionID string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.locales, sessionID)
+}
+
+// localize returns the tools with their descriptions in the locale of the host behind ctx
+func (l *localizer) localize(ctx context.Context, tools []mcp.ToolRetType) []mcp.ToolRetType {
+	if l == nil {
+		return tools
+	}
+	l.mu.Lock()
+	locale, ok := l.locales[sessionScope(ctx)]
+	l.mu.Unlock()
+	if !ok {
+		locale = l.defaultLocale
+	}
+	if locale == "" {
+		return tools
+	}
+	language, _, _ := strings.Cut(locale, "-")
+
+	localized := make([]mcp.ToolRetType, len(tools))
+	for i, tool := range tools {
+		description, ok := l.descriptions[locale][tool.Name]
+		if !ok {
+			description, ok = l.descriptions[language][tool.Name]
+		}
+		if ok {
+			tool.Description = &description
+		}
+		localized[i] = tool
+	}
+	return localized
+}
+
+// normalizeLocale writes locales alike however hosts spell them: "pt_br" and "pt-BR" become "pt-br"
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// otlpBatchSize is the most log records shipped in one OTLP request
+	otlpBatchSize = 100
+	// otlpFlushInterval is how long records wait before a partial batch is shipped
+	otlpFlushInterval = time.Second
+	// otlpQueueSize bounds the records waiting to be shipped; records beyond it are dropped
+	otlpQueueSize = 10000
+)
+
+// LogSinkConfig ships log records, including backend stderr, to centralized logging in addition to stderr
+type LogSinkConfig struct {
+	// Type is "syslog" or "otlp"
+	Type string `json:"Type"`
+	// Address is the syslog server, e.g. "udp://logs:514"; empty uses the local syslog daemon
+	Address string `json:"Address,omitempty"`
+	// Tag is the syslog tag; defaults to "mcp-aggregator"
+	Tag string `json:"Tag,omitempty"`
+	// Endpoint is the OTLP/HTTP collector, e.g. http://otel-collector:4318
+	Endpoint    string            `json:"Endpoint,omitempty"`
+	Headers     map[string]string `json:"Headers,omitempty"`
+	ServiceName string            `json:"ServiceName,omitempty"`
+}
+
+// logSink receives every log line. Sinks never fail a write, so one unreachable sink does not
+// keep the others from receiving the line.
+type logSink interface {
+	io.Writer
+	close()
+}
+
+// logSinks are the configured sinks. A nil value has no sinks.
+type logSinks []logSink
+
+// newLogSinks connects the configured sinks
+func newLogSinks(configs []LogSinkConfig) (logSinks, error) {
+	var sinks logSinks
+	for _, cfg := range configs {
+		var sink logSink
+		var err error
+		switch cfg.Type {
+		case "syslog":
+			sink, err = newSyslogSink(cfg)
+		case "otlp":
+			sink, err = newOTLPLogSink(cfg)
+		default:
+			err = fmt.Errorf("unknown log sink type '%s', expected syslog or otlp", cfg.Type)
+		}
+		if err != nil {
+			sinks.close()
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// writer returns a writer sending every line to out and all sinks
+func (s logSinks) writer(out io.Writer) io.Writer {
+	writers := []io.Writer{out}
+	for _, sink := range s {
+		writers = append(writers, sink)
+	}
+	return io.MultiWriter(writers...)
+}
+
+// close flushes and disconnects every sink
+func (s logSinks) close() {
+	for _, sink := range s {
+		sink.close()
+	}
+}
+
+// trimLogPrefix strips the date and time the standard logger puts in front of a line
+func trimLogPrefix(line string) string {
+	line = strings.TrimSuffix(line, "\n")
+	if len(line) >= 20 && line[4] == '/' && line[7] == '/' && line[10] == ' ' && line[19] == ' ' {
+		return line[20:]
+	}
+	return line
+}
+
+// backendOfLine returns the backend a line of relayed stderr came from, or "" for the aggregator's own lines
+func backendOfLine(line string) string {
+	rest, ok := strings.CutPrefix(line, "StdIO client '")
+	if !ok {
+		return ""
+	}
+	name, rest, ok := strings.Cut(rest, "'")
+	if !ok || !strings.HasPrefix(rest, " stderr:") {
+		return ""
+	}
+	return name
+}
+
+// otlpLogSink ships lines as OTLP log records over HTTP/JSON in batches. Records queue up while
+// the collector is slow and are dropped once the queue is full, so logging never blocks.
+type otlpLogSink struct {
+	url         string
+	headers     map[string]string
+	serviceName string
+	records     chan otlpLogRecord
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+type otlpLogRecord struct {
+	time time.Time
+	body string
+}
+
+func newOTLPLogSink(cfg LogSinkConfig) (*otlpLogSink, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("otlp log sink requires an Endpoint")
+	}
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "mcp-aggregator"
+	}
+	s := &otlpLogSink{
+		url:         strings.TrimSuffix(cfg.Endpoint, "/") + "/v1/logs",
+		headers:     cfg.Headers,
+		serviceName: serviceName,
+		records:     make(chan otlpLogRecord, otlpQueueSize),
+		done:        make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *otlpLogSink) Write(p []byte) (int, error) {
+	select {
+	case s.records <- otlpLogRecord{time: time.Now(), body: trimLogPrefix(string(p))}:
+	default:
+	}
+	return len(p), nil
+}
+
+// close ships the records still queued
+func (s *otlpLogSink) close() {
+	s.closeOnce.Do(func() { close(s.records) })
+	<-s.done
+}
+
+func (s *otlpLogSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []otlpLogRecord
+	for {
+		select {
+		case record, ok := <-s.records:
+			if !ok {
+				s.ship(batch)
+				return
+			}
+			if batch = append(batch, record); len(batch) >= otlpBatchSize {
+				s.ship(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			s.ship(batch)
+			batch = nil
+		}
+	}
+}
+
+// ship posts a batch to the collector. Failures are reported on stderr only, since logging them
+// would feed them back into the sink.
+func (s *otlpLogSink) ship(batch []otlpLogRecord) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(s.payload(batch))
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.headers {
+		req.Header.Set(key, value)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to ship %d log records: %v\n", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		fmt.Fprintf(os.Stderr, "Failed to ship %d log records: %s\n", len(batch), resp.Status)
+	}
+}
+
+// payload encodes a batch as an OTLP ExportLogsServiceRequest
+func (s *otlpLogSink) payload(batch []otlpLogRecord) map[string]interface{} {
+	records := make([]map[string]interface{}, 0, len(batch))
+	for _, record := range batch {
+		entry := map[string]interface{}{
+			"timeUnixNano": strconv.FormatInt(record.time.UnixNano(), 10),
+			"severityText": "INFO",
+			"body":         otlpString(record.body),
+		}
+		if backend := backendOfLine(record.body); backend != "" {
+			entry["attributes"] = []map[string]interface{}{{"key": "mcp.backend", "value": otlpString(backend)}}
+		}
+		records = append(records, entry)
+	}
+	return map[string]interface{}{
+		"resourceLogs": []map[string]interface{}{{
+			"resource": map[string]interface{}{
+				"attributes": []map[string]interface{}{{"key": "service.name", "value": otlpString(s.serviceName)}},
+			},
+			"scopeLogs": []map[string]interface{}{{
+				"scope":      map[string]interface{}{"name": "mcp-aggregator"},
+				"logRecords": records,
+			}},
+		}},
+	}
+}
+
+func otlpString(value string) map[string]interface{} {
+	return map[string]interface{}{"stringValue": value}
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import "fmt"
+
+// syslogSupported reports that log sinks cannot write to syslog on this platform
+const syslogSupported = false
+
+// newSyslogSink fails, as syslog is not available on this platform
+func newSyslogSink(cfg LogSinkConfig) (logSink, error) {
+	return nil, fmt.Errorf("syslog log sinks are not supported on this platform")
+}
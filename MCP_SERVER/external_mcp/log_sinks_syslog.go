@@ -0,0 +1,45 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+// syslogSupported reports that log sinks can write to syslog on this platform
+const syslogSupported = true
+
+// syslogSink writes each line as a syslog message; the syslog writer reconnects by itself
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink(cfg LogSinkConfig) (*syslogSink, error) {
+	network, address := "", ""
+	if cfg.Address != "" {
+		var ok bool
+		if network, address, ok = strings.Cut(cfg.Address, "://"); !ok {
+			network, address = "udp", cfg.Address
+		}
+	}
+	tag := cfg.Tag
+	if tag == "" {
+		tag = "mcp-aggregator"
+	}
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Write(p []byte) (int, error) {
+	_ = s.writer.Info(trimLogPrefix(string(p)))
+	return len(p), nil
+}
+
+func (s *syslogSink) close() {
+	_ = s.writer.Close()
+}
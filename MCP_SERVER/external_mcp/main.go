@@ -1,25 +1,114 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strings"
 	"syscall"
 	"time"
 
 	mcp "github.com/metoro-io/mcp-golang"
-	"github.com/metoro-io/mcp-golang/transport/stdio"
+	"github.com/metoro-io/mcp-golang/transport"
 )
 
 // Config represents the configuration for the MCP clients and servers
 type Config struct {
-	MCPStdIOServers map[string]MCPStdIOConfig `json:"MCPStdIOServers"`
+	MCPStdIOServers  map[string]MCPStdIOConfig `json:"MCPStdIOServers"`
+	Profiles         map[string]Profile        `json:"Profiles,omitempty"`
+	DefaultProfile   string                    `json:"DefaultProfile,omitempty"`
+	Auth             *AuthConfig               `json:"Auth,omitempty"`
+	AuditLog         string                    `json:"AuditLog,omitempty"`
+	HMAC             *HMACConfig               `json:"HMAC,omitempty"`
+	ContextInjection []ContextInjection        `json:"ContextInjection,omitempty"`
+	// StatefulIdleTimeout tears down per-session instances of stateful servers after this much inactivity
+	StatefulIdleTimeout Duration         `json:"StatefulIdleTimeout,omitempty"`
+	Schedules           []ScheduleConfig `json:"Schedules,omitempty"`
+	Webhooks            []WebhookConfig  `json:"Webhooks,omitempty"`
+	Jobs                *JobsConfig      `json:"Jobs,omitempty"`
+	Artifacts           *ArtifactsConfig `json:"Artifacts,omitempty"`
+	// MaxFrameSize bounds a single stdio message in bytes, from the host or from a server; defaults to 64MB
+	MaxFrameSize  int                  `json:"MaxFrameSize,omitempty"`
+	SelfTest      *SelfTestConfig      `json:"SelfTest,omitempty"`
+	ToolSearch    *ToolSearchConfig    `json:"ToolSearch,omitempty"`
+	CatalogBudget *CatalogBudgetConfig `json:"CatalogBudget,omitempty"`
+	HostProfiles  []HostProfile        `json:"HostProfiles,omitempty"`
+	Localization  *LocalizationConfig  `json:"Localization,omitempty"`
+	LogSinks      []LogSinkConfig      `json:"LogSinks,omitempty"`
+	SlowCalls     *SlowCallConfig      `json:"SlowCalls,omitempty"`
+	// OutputExpectations declares, by tool name, what the tool's responses must look like
+	OutputExpectations map[string]OutputExpectation `json:"OutputExpectations,omitempty"`
+	// StrictRouting only forwards tools a backend advertises, rather than trying unknown names on every backend
+	StrictRouting bool `json:"StrictRouting,omitempty"`
+	// Sanitizers check path and URL arguments before they are forwarded
+	Sanitizers []ArgumentSanitizer `json:"Sanitizers,omitempty"`
+	Quotas     *QuotaConfig        `json:"Quotas,omitempty"`
+	Usage      *UsageConfig        `json:"Usage,omitempty"`
+	Middleware []MiddlewareConfig  `json:"Middleware,omitempty"`
+	Scripts    []ScriptConfig      `json:"Scripts,omitempty"`
+	Policy     *PolicyConfig       `json:"Policy,omitempty"`
+	Snapshots  *SnapshotConfig     `json:"Snapshots,omitempty"`
+	// ShadowLog receives a JSON line comparing the primary and shadow responses of every mirrored call
+	ShadowLog string `json:"ShadowLog,omitempty"`
+	// DeadlineReserve is kept back from the time budget a host passes in a call's _meta.budgetMs for
+	// the aggregator's own overhead; the rest is passed upstream. Defaults to 20ms.
+	DeadlineReserve Duration `json:"DeadlineReserve,omitempty"`
+	// MemoryWatchdog sheds load when memory use exceeds its limits
+	MemoryWatchdog *MemoryWatchdogConfig `json:"MemoryWatchdog,omitempty"`
+	// Notifications batches the change notifications sent to the host
+	Notifications *NotificationsConfig `json:"Notifications,omitempty"`
+	// SizeAnnotations adds the size and estimated token count of tool results to their _meta
+	SizeAnnotations *SizeAnnotationConfig `json:"SizeAnnotations,omitempty"`
+	// Summarizer condenses tool outputs above a token threshold, keeping the full output as a resource
+	Summarizer *SummarizerConfig `json:"Summarizer,omitempty"`
+	// Cache caches tool results and tool lists, in memory or shared by replicas on disk or in Redis
+	Cache *CacheConfig `json:"Cache,omitempty"`
+	// Cluster shares sessions, quota usage and jobs with the other instances behind a load balancer
+	Cluster *ClusterConfig `json:"Cluster,omitempty"`
+	// Bus bridges tool calls from a NATS subject
+	Bus *BusConfig `json:"Bus,omitempty"`
+	// ReverseListen is the address servers with a ReverseToken dial in to over WebSocket at /reverse
+	ReverseListen string `json:"ReverseListen,omitempty"`
+	// Include lists the paths or URLs of configs this one is merged over, see includeConfigs
+	Include []string `json:"Include,omitempty"`
+	// Templates are reusable server settings that servers extend with their own, see expandTemplates
+	Templates map[string]json.RawMessage `json:"Templates,omitempty"`
+	// ToolBudgets restricts expensive tools to hours of the day and daily call budgets
+	ToolBudgets *ToolBudgetConfig `json:"ToolBudgets,omitempty"`
+	// Spend prices the calls to paid tools and guards each identity's daily spend
+	Spend *SpendConfig `json:"Spend,omitempty"`
+	// Probes call tools on a schedule to check their upstreams still work
+	Probes []ProbeConfig `json:"Probes,omitempty"`
+	// Postmortem writes a bundle for bug reports when the aggregator panics or a backend crashes
+	Postmortem *PostmortemConfig `json:"Postmortem,omitempty"`
+	// TagPolicies are server settings, such as Concurrency or Required, applied by tag to the servers
+	// carrying it; a server's own settings take precedence
+	TagPolicies map[string]json.RawMessage `json:"TagPolicies,omitempty"`
+	// Endpoints is a JSON file mapping server names to URLs, such as a mounted ConfigMap, read on every reload
+	Endpoints string `json:"Endpoints,omitempty"`
+	// RemoteOnly never spawns servers locally: every server must be addressed by URL
+	RemoteOnly bool             `json:"RemoteOnly,omitempty"`
+	Discovery  *DiscoveryConfig `json:"Discovery,omitempty"`
+	// Supervision restarts servers that crash, giving up on those crash-looping
+	Supervision *SupervisionConfig `json:"Supervision,omitempty"`
+	// DrainTimeout is how long the calls in flight may take to finish on SIGTERM before the backends
+	// are shut down; calls arriving meanwhile are rejected as retriable. Defaults to 30s.
+	DrainTimeout Duration `json:"DrainTimeout,omitempty"`
+	// Exporters push audit and usage records into external pipelines: JSONL files, SQLite or HTTP
+	Exporters []ExporterConfig `json:"Exporters,omitempty"`
+	// DataHandling controls whether call arguments and responses are recorded and for how long
+	DataHandling *DataHandlingConfig `json:"DataHandling,omitempty"`
+	// Features turns experimental subsystems on or off: AsyncJobs, FuzzyMatching and ResultCache
+	Features FeatureFlags `json:"Features,omitempty"`
+
+	// skipped maps the servers left out on this machine, because their conditions do not hold, to why
+	skipped map[string]string
 }
 
 // MCPStdIOConfig represents the configuration for an MCP StdIO server
@@ -28,30 +117,504 @@ type MCPStdIOConfig struct {
 	Args       []string          `json:"Args"`
 	Env        map[string]string `json:"Env"`
 	WorkingDir string            `json:"WorkingDir"`
+	// Stateful servers get a dedicated instance per downstream session instead of one shared instance
+	Stateful bool `json:"Stateful,omitempty"`
+	// PerTenant servers get a dedicated instance per tenant of the caller, configured by Tenants; the
+	// shared instance only lists the tools. It takes precedence over Stateful.
+	PerTenant bool                    `json:"PerTenant,omitempty"`
+	Tenants   map[string]TenantConfig `json:"Tenants,omitempty"`
+	// MaxFrameSize bounds a single message from the server in bytes, overriding the global MaxFrameSize
+	MaxFrameSize int `json:"MaxFrameSize,omitempty"`
+	// StrictStdout closes the connection to the server, failing its calls until it is restarted, when
+	// it writes anything but protocol messages to stdout, instead of logging and skipping the output
+	StrictStdout bool `json:"StrictStdout,omitempty"`
+	// Normalize repairs the encoding of the text the server returns; absent leaves it as it is
+	Normalize *TextNormalization `json:"Normalize,omitempty"`
+	// ClientInfo is announced to the server instead of the default "mcp-service" identity
+	ClientInfo *ClientIdentity `json:"ClientInfo,omitempty"`
+	// SHA256 pins the checksum of the command binary; the server is not started if it differs
+	SHA256 string `json:"SHA256,omitempty"`
+	// PackageVersion pins the package version an npx or uvx launcher runs, e.g. "1.2.0"
+	PackageVersion string `json:"PackageVersion,omitempty"`
+	// Required servers must have initialized before the aggregator reports itself ready
+	Required bool `json:"Required,omitempty"`
+	// URL addresses a remote server instead of spawning Command: http(s) for SSE, ws(s) for WebSocket
+	URL string `json:"URL,omitempty"`
+	// Headers are sent with every request to a remote server, e.g. Authorization
+	Headers map[string]string `json:"Headers,omitempty"`
+	// Network sets the proxy and CA bundle for a remote server; absent uses the environment's proxy for
+	// SSE and connects WebSockets directly
+	Network *NetworkConfig `json:"Network,omitempty"`
+	// SSH runs Command on another machine over ssh instead of locally
+	SSH *SSHConfig `json:"SSH,omitempty"`
+	// ReverseToken makes the server dial in to the aggregator's ReverseListen endpoint, authenticating
+	// with this token, instead of being started or dialed. It cannot be Stateful or PerTenant.
+	ReverseToken string `json:"ReverseToken,omitempty"`
+	// Extends names the template in Templates this server's settings are merged over
+	Extends string `json:"Extends,omitempty"`
+	// Tags label the server, e.g. "prod" or "fs", to apply TagPolicies, enable or disable servers as a
+	// group and filter tools/list. Discovered backends carry the tags they registered with.
+	Tags []string `json:"Tags,omitempty"`
+	// ShadowOf makes this a shadow of the named server: it receives a copy of the calls routed there,
+	// and its responses are compared with the primary's but never returned. Its tools are neither
+	// advertised nor routed.
+	ShadowOf string `json:"ShadowOf,omitempty"`
+	// ShadowTools limits the mirrored calls to tools matching these patterns; empty mirrors every call
+	ShadowTools []string `json:"ShadowTools,omitempty"`
+	// Concurrency bounds the calls in flight to the server, fixed or adapting to its latency and errors
+	Concurrency *ConcurrencyConfig `json:"Concurrency,omitempty"`
+	// DependsOn names servers that must be running before this one starts, such as a local proxy it uses
+	DependsOn []string `json:"DependsOn,omitempty"`
+	// Phase groups servers into start-up phases, lower first; servers without one start in phase 0
+	Phase int `json:"Phase,omitempty"`
+	// When limits the server to machines meeting the condition; elsewhere it is skipped
+	When *ServerCondition `json:"When,omitempty"`
+	// Maintenance lists the windows in which the server is out of service
+	Maintenance []MaintenanceWindow `json:"Maintenance,omitempty"`
+}
+
+// ClientIdentity is the client identity announced to a server, overriding the aggregator's default
+type ClientIdentity struct {
+	Name    string `json:"Name,omitempty"`
+	Version string `json:"Version,omitempty"`
+	// Metadata adds arbitrary fields to the announced clientInfo
+	Metadata map[string]interface{} `json:"Metadata,omitempty"`
+}
+
+// Duration is a time.Duration written in config as a string such as "30s" or "5m"
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON formats the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
 func main() {
-	// Initialize the MCP server with stdio transport
-	server := mcp.NewServer(stdio.NewStdioServerTransport())
+	configPath := flag.String("config", "mcp.json", "Path to mcp.json or a Claude Desktop claude_desktop_config.json")
+	profile := flag.String("profile", os.Getenv("MCP_PROFILE"), "Named profile from the config selecting the servers and policies to start with; the admin /profile endpoint switches it")
+	listenAddr := flag.String("listen", "", "Serve MCP over HTTP on this address instead of stdio, e.g. :8080, unix:/run/mcp.sock or systemd:mcp")
+	compress := flag.Bool("compress", false, "Accept compressed HTTP requests and gzip or deflate large HTTP responses")
+	adminAddr := flag.String("admin", "", "Serve admin endpoints on this address, e.g. 127.0.0.1:9090, unix:/run/mcp-admin.sock or systemd:admin")
+	enablePprof := flag.Bool("pprof", false, "Expose runtime profiles under /debug/pprof/ on the admin listener")
+	configRefresh := flag.Duration("config-refresh", 0, "How often to re-read the config and re-resolve its secrets, 0 disables polling")
+	toolsRefresh := flag.Duration("tools-refresh", 0, "How often to re-list backend tools and notify the host of changes, 0 disables polling")
+	printVersion := flag.Bool("version", false, "Print the version and build information as JSON and exit")
+	flag.Parse()
+
+	if *printVersion {
+		infoJSON, _ := json.MarshalIndent(currentBuild(nil), "", "  ")
+		fmt.Println(string(infoJSON))
+		return
+	}
+
+	// Dispatch subcommands
+	switch flag.Arg(0) {
+	case "import-claude-config":
+		runImportClaudeConfig(flag.Args()[1:])
+		return
+	case "init":
+		runInit(flag.Args()[1:])
+		return
+	case "selftest":
+		runSelfTest(*configPath, *profile, flag.Args()[1:])
+		return
+	case "usage-export":
+		runUsageExport(*configPath, flag.Args()[1:])
+		return
+	case "top":
+		runTop(*adminAddr, flag.Args()[1:])
+		return
+	case "repl":
+		runREPL(*configPath, *profile, flag.Args()[1:])
+		return
+	case "add-backend":
+		runAddBackend(*configPath, flag.Args()[1:])
+		return
+	case "catalog-docs":
+		runCatalogDocs(*configPath, *profile, flag.Args()[1:])
+		return
+	case "snapshots":
+		runSnapshots(*configPath, flag.Args()[1:])
+		return
+	case "connect":
+		runConnect(flag.Args()[1:])
+		return
+	case "purge":
+		runPurge(*adminAddr, flag.Args()[1:])
+		return
+	}
 
 	// Load configuration
-	cfg := loadConfig("mcp.json")
+	cfg := loadConfig(*configPath)
+	cfg, err := applyProfile(cfg, *profile)
+	if err != nil {
+		log.Fatalf("Failed to apply profile: %v", err)
+	}
+	if err := cfg.Features.check(); err != nil {
+		log.Fatalf("Invalid feature flags: %v", err)
+	}
+
+	// Ship logs, including backend stderr, to the configured sinks as well as stderr
+	sinks, err := newLogSinks(cfg.LogSinks)
+	if err != nil {
+		log.Fatalf("Failed to set up log sinks: %v", err)
+	}
+	log.SetOutput(sinks.writer(os.Stderr))
+	defer sinks.close()
+
+	// Keep the recent logs for the postmortem bundles written on a panic or a backend crash
+	postmortem, err := newPostmortem(cfg.Postmortem)
+	if err != nil {
+		log.Fatalf("Failed to set up postmortem bundles: %v", err)
+	}
+	if postmortem != nil {
+		log.SetOutput(io.MultiWriter(sinks.writer(os.Stderr), postmortem))
+	}
+	defer postmortem.recoverPanic()
+	log.Printf("Starting %s", currentBuild(&cfg).banner())
+
+	// Set up authentication, authorization and auditing, exporting audit and usage records
+	exports, err := openExporters(cfg.Exporters)
+	if err != nil {
+		log.Fatalf("Failed to set up exporters: %v", err)
+	}
+	defer exports.close()
+	authz := newAuthorizer(cfg.Auth)
+	audit, err := newAuditLogger(cfg.AuditLog, exports)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer audit.close()
+
+	// HTTP middleware: forwarding to the instance serving the session in a cluster, body compression,
+	// and signature verification when a gateway fronts the transport
+	cluster, err := newCluster(cfg.Cluster)
+	if err != nil {
+		log.Fatalf("Invalid cluster config: %v", err)
+	}
+	var middleware []func(http.Handler) http.Handler
+	if cluster != nil {
+		middleware = append(middleware, cluster.middleware)
+	}
+	if *compress {
+		middleware = append(middleware, compressionMiddleware)
+	}
+	if cfg.HMAC != nil {
+		middleware = append(middleware, newHMACVerifier(cfg.HMAC).middleware)
+	}
+
+	// Initialize the MCP server with stdio transport, or HTTP when a listen address is given
+	// Hosts are told apart by the client they announce, so each gets the tools of its profile in its
+	// locale, and the _meta of their calls is forwarded upstream. Servers' elicitation requests are
+	// relayed to the host of the call waiting on them, which only stdio can push requests to. Results
+	// are annotated with their size once their raw form is known. A panic answering a request fails
+	// the request with an internal error rather than the process. Requests in flight are counted so
+	// shutdown can drain them.
+	raw := newRawResults()
+	hosts := newHostProfiles(cfg.HostProfiles)
+	locales := newLocalizer(cfg.Localization)
+	drain := newDrainTransport(newServerTransport(*listenAddr, cfg.MaxFrameSize, authz, middleware...))
+	relay := newHostRelay(&contextTransport{
+		Transport: newRecoveryTransport(drain),
+		decorate: func(ctx context.Context, message *transport.BaseJsonRpcMessage) context.Context {
+			return observeCorrelation(observeMeta(locales.observe(hosts.observe(ctx, message), message), message), message)
+		},
+	}, *listenAddr == "")
+	downstream := &passthroughTransport{
+		Transport: newSizeAnnotator(relay, cfg.SizeAnnotations),
+		results:   raw,
+	}
+
+	// The aggregated tools are also served as the server's own tools, next to the wrapper tools, and
+	// the requests the server library does not support are answered by the router
+	var server *mcp.Server
+	methods := newMethodTransport(downstream)
+	native := newNativeToolsTransport(methods, func(name string) bool { return server.CheckToolRegistered(name) })
+	server = mcp.NewServer(native, mcp.WithName(serverName), mcp.WithVersion(version))
+	metrics := newMetrics()
 
 	// Create the MCP client information
 	mcpClientInfo := mcp.ClientInfo{
 		Name:    "mcp-service",
-		Version: "1.0.0",
+		Version: version,
 	}
 
-	// Initialize MCP clients
-	mcpClients, stdIOCmds := initializeMCPClients(cfg, mcpClientInfo)
-	defer shutdownMCPClients(mcpClients, stdIOCmds)
+	// Report tool call outcomes and crash-looping servers to external systems
+	webhooks, err := newWebhookDispatcher(cfg.Webhooks)
+	if err != nil {
+		log.Fatalf("Failed to set up webhooks: %v", err)
+	}
 
-	// Initialize all clients and fetch their tools
-	initializeAndListTools(mcpClients)
+	// Start the configured servers, initialize their clients and fetch their tools. Their change
+	// notifications, like the aggregator's own, reach the host in batches. Servers that crash are
+	// restarted while within their restart budget.
+	notifier := newChangeNotifier(downstream, cfg.Notifications)
+	registry := newBackendRegistry(mcpClientInfo)
+	if postmortem != nil {
+		postmortem.registry = registry
+	}
+	supervisor := newSupervisor(cfg.Supervision, registry, metrics, webhooks, systemClock{})
+	registry.started = func(b *backend) {
+		notifier.relay(b)
+		go postmortem.watch(b)
+		go supervisor.watch(b)
+	}
+	if err := registry.apply(cfg); err != nil {
+		log.Fatalf("Failed to start MCP clients: %v", err)
+	}
+	defer registry.shutdown()
+	if cfg.ReverseListen != "" {
+		if err := serveReverse(cfg.ReverseListen, registry.reverse); err != nil {
+			log.Fatalf("Failed to serve the reverse endpoint: %v", err)
+		}
+	}
+	go registry.stateful.reapIdle(time.Duration(cfg.StatefulIdleTimeout))
+	go registry.tenants.reapIdle(time.Duration(cfg.StatefulIdleTimeout))
+
+	// Add and remove the backends registered with a service registry
+	discovery, err := newDiscoveryProvider(cfg.Discovery)
+	if err != nil {
+		log.Fatalf("Failed to set up discovery: %v", err)
+	}
+	if discovery != nil {
+		go watchDiscovery(discovery, time.Duration(cfg.Discovery.Interval), registry)
+	}
+
+	// Keep the tool catalog in line with the backends and track upstream drift, snapshotting it
+	// whenever it changes
+	snapshots, err := newSnapshotStore(cfg.Snapshots)
+	if err != nil {
+		log.Fatalf("Failed to set up catalog snapshots: %v", err)
+	}
+	if _, err := snapshots.capture(registry); err != nil {
+		log.Printf("Failed to snapshot tool catalog: %v", err)
+	}
+	catalog := newToolCatalog(registry, notifier, metrics)
+	catalog.snapshots = snapshots
+	if *toolsRefresh > 0 {
+		go catalog.watch(*toolsRefresh)
+	}
+
+	// Mirror calls to shadow servers to validate them against real traffic
+	shadows, err := newShadowMirror(cfg.ShadowLog, registry, metrics, cfg.DataHandling)
+	if err != nil {
+		log.Fatalf("Failed to open shadow log: %v", err)
+	}
+	defer shadows.close()
+
+	deadlineReserve := time.Duration(cfg.DeadlineReserve)
+	if deadlineReserve == 0 {
+		deadlineReserve = defaultDeadlineReserve
+	}
+
+	// Check path and URL arguments before they reach the backends
+	sanitizers, err := newArgumentSanitizers(cfg.Sanitizers)
+	if err != nil {
+		log.Fatalf("Invalid sanitizers: %v", err)
+	}
+
+	// Account calls against per-identity monthly quotas
+	quotas, err := openQuotaTracker(cfg.Quotas)
+	if err != nil {
+		log.Fatalf("Failed to open quota usage: %v", err)
+	}
+	defer quotas.close()
+	quotas.shareUsage(cluster)
+
+	// Restrict expensive tools to their hours and daily budgets
+	budgets, err := openToolBudgets(cfg.ToolBudgets)
+	if err != nil {
+		log.Fatalf("Invalid tool budgets: %v", err)
+	}
+	defer budgets.close()
+
+	// Record usage per identity, tool and backend for charge-back
+	ledger, err := openUsageLedger(cfg.Usage)
+	if err != nil {
+		log.Fatalf("Failed to open usage records: %v", err)
+	}
+	defer ledger.close()
+
+	// Load custom policy logic from plugins and WASM modules
+	plugins, err := loadMiddleware(cfg.Middleware)
+	if err != nil {
+		log.Fatalf("Failed to load middleware: %v", err)
+	}
+	defer plugins.close()
+
+	// Attach scripts to routing and transform events
+	scripts, err := loadScripts(cfg.Scripts)
+	if err != nil {
+		log.Fatalf("Failed to load scripts: %v", err)
+	}
+
+	// Authorize calls against the central policy, and guard the spend on paid tools. Both hold the
+	// calls they want approved in the same queue.
+	approvals := newApprovalQueue()
+	policy, err := newPolicyEngine(cfg.Policy, approvals)
+	if err != nil {
+		log.Fatalf("Invalid policy: %v", err)
+	}
+	// Reloads keep the profile an operator switched to, along with its policies
+	profiles := newProfileSwitch(*configPath, *profile, registry, approvals)
+
+	// Keep pulling centrally-managed configuration and rotated secrets
+	if *configRefresh > 0 {
+		go watchConfig(profiles, *configRefresh, cfg)
+	}
+	spend, err := openSpendGuard(cfg.Spend, approvals)
+	if err != nil {
+		log.Fatalf("Failed to open spend: %v", err)
+	}
+	defer spend.close()
+
+	// Shed load before running out of memory takes every server down
+	history := newCallHistory()
+	memory := newMemoryWatchdog(cfg.MemoryWatchdog, registry, history, metrics)
+	go memory.run()
+
+	// Capture slow calls with their arguments and timing breakdown
+	slow, err := newSlowCallLogger(cfg.SlowCalls, cfg.DataHandling)
+	if err != nil {
+		log.Fatalf("Failed to open slow call log: %v", err)
+	}
+
+	// Keep async jobs, on disk when configured so they survive restarts, without the payloads the
+	// data handling config keeps out of records
+	jobs, err := openJobStore(cfg.Jobs, cluster)
+	if err != nil {
+		log.Fatalf("Failed to open job store: %v", err)
+	}
+	jobs = filterJobPayloads(jobs, cfg.DataHandling)
+	cacheCfg := cfg.Cache
+	if cacheCfg != nil && !cfg.Features.enabled(featureResultCache) {
+		// Tool lists are still cached, but no results are
+		withoutResults := *cacheCfg
+		withoutResults.Results = nil
+		cacheCfg = &withoutResults
+	}
+	cache, err := newToolCache(filterResultCache(cacheCfg, cfg.DataHandling), systemClock{})
+	if err != nil {
+		log.Fatalf("Failed to open cache: %v", err)
+	}
+	go pruneJobs(jobs, cfg.DataHandling.retain(jobRetention(cfg.Jobs)))
+	data := newDataHandler(cfg.DataHandling, jobs, slow, shadows)
+	go data.run()
 
 	// Register tools with the server
-	registerTools(server, mcpClients)
+	rt := &router{
+		registry:   registry,
+		authz:      authz,
+		audit:      audit,
+		sessions:   newSessionStore(),
+		injections: cfg.ContextInjection,
+		webhooks:   webhooks,
+		jobs:       jobs,
+		artifacts:  newArtifactStore(server, cfg.Artifacts),
+		raw:        raw,
+		search:     newToolSearch(cfg.ToolSearch),
+		budget:     cfg.CatalogBudget,
+		usage:      newToolUsage(),
+		hosts:      hosts,
+		locales:    locales,
+		metrics:    metrics,
+		slow:       slow,
+		outputs:    newOutputValidator(cfg.OutputExpectations, metrics),
+		sanitizers: sanitizers,
+		quotas:     quotas,
+		ledger:     ledger,
+		middleware: plugins,
+		scripts:    scripts,
+		policy:     policy,
+		history:    history,
+		snapshots:  snapshots,
+		shadows:    shadows,
+		memory:     memory,
+		reserve:    deadlineReserve,
+		strict:     cfg.StrictRouting,
+		resources:  newResourceSubscriptions(notifier),
+		summarizer: newSummarizer(cfg.Summarizer, server, cfg.Artifacts),
+		cache:      cache,
+		instance:   cluster.instance(),
+		budgets:    budgets,
+		spend:      spend,
+		features:   cfg.Features,
+		exports:    exports,
+		profiles:   profiles,
+	}
+	native.rt = rt
+	methods.handle("completion/complete", "completions", rt.complete)
+	methods.handle("resources/templates/list", "", rt.resourceTemplates)
+	methods.handleIf("resources/read", rt.ownsResource, rt.readResource)
+	methods.handleIf("resources/subscribe", rt.ownsResource, rt.subscribeResource)
+	methods.handleIf("resources/unsubscribe", rt.ownsResource, rt.unsubscribeResource)
+	methods.declare("resources", map[string]interface{}{"subscribe": true})
+	registerTools(server, rt)
+	rt.resumeJobs()
+
+	// Run scheduled tool calls
+	if err := newScheduler(rt, systemClock{}).start(server, cfg.Schedules); err != nil {
+		log.Fatalf("Failed to start scheduler: %v", err)
+	}
+
+	// Probe the tools to catch upstreams breaking silently
+	if err := startProbes(rt, cfg.Probes); err != nil {
+		log.Fatalf("Invalid probes: %v", err)
+	}
+
+	// Serve tool calls from the message bus
+	bus, err := startBusBridge(rt, cfg.Bus)
+	if err != nil {
+		log.Fatalf("Failed to start bus bridge: %v", err)
+	}
+	defer bus.close()
+
+	// Serve admin endpoints
+	admin := newAdminServer(*adminAddr)
+	probes := newHealth(registry, systemClock{})
+	admin.handle("/metrics", metrics)
+	admin.handle("/healthz", http.HandlerFunc(probes.live))
+	admin.handle("/readyz", http.HandlerFunc(probes.ready))
+	admin.handle("/purge", data)
+	if ledger != nil {
+		admin.handle("/usage", ledger)
+	}
+	admin.handle("/profile", profiles)
+	if policy != nil || spend != nil || cfg.profilePolicies() {
+		admin.handle("/approvals", approvals)
+		admin.handle("/approvals/", approvals)
+	}
+	reloadConfig := profiles.reload
+	ui := &dashboard{registry: registry, history: rt.history, reload: reloadConfig}
+	admin.handle("/dashboard", ui)
+	admin.handle("/dashboard/", ui)
+	go probes.runWatchdog()
+	if *enablePprof {
+		if admin == nil {
+			log.Println("Warning: -pprof has no effect without -admin")
+		}
+		admin.enablePprof()
+	}
+	if err := admin.start(); err != nil {
+		log.Fatalf("Failed to start admin server: %v", err)
+	}
+
+	// Reload the config on SIGHUP and log diagnostics on SIGUSR1, for operators without the admin API
+	go watchSignals(reloadConfig, &diagnostics{registry: registry, drain: drain})
 
 	// Handle graceful shutdown
 	stop := make(chan os.Signal, 1)
@@ -63,26 +626,79 @@ func main() {
 		if err := server.Serve(); err != nil {
 			log.Printf("Server error: %v", err)
 			stop <- syscall.SIGTERM
+			return
 		}
+		probes.markServing()
+		sdNotify("READY=1")
 	}()
 
 	<-stop
 	log.Println("Server shutting down gracefully...")
+	sdNotify("STOPPING=1")
+
+	// Stop advertising readiness and let the calls in flight finish before the deferred shutdown of
+	// the backends; a second signal cuts the drain short
+	probes.markDraining()
+	drainTimeout := time.Duration(cfg.DrainTimeout)
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	go func() {
+		<-stop
+		cancel()
+	}()
+	if left := drain.drain(ctx); left > 0 {
+		log.Printf("Stopped draining with %d requests in flight", left)
+	} else {
+		log.Println("Drained the requests in flight")
+	}
+	cancel()
+}
+
+// newServerTransport returns the downstream transport: HTTP behind the given middleware and bearer tokens when addr is set,
+// otherwise stdio, where the caller authenticates once through the MCP_AUTH_TOKEN environment variable
+func newServerTransport(addr string, maxFrameSize int, authz *authorizer, middleware ...func(http.Handler) http.Handler) transport.Transport {
+	if addr != "" {
+		if authz != nil {
+			middleware = append(middleware, authz.middleware)
+		}
+		return newHTTPServerTransport(addr, middleware...)
+	}
+
+	id, ok := authz.authenticate(os.Getenv("MCP_AUTH_TOKEN"))
+	if !ok {
+		log.Fatalf("MCP_AUTH_TOKEN does not match any configured token")
+	}
+	return &contextTransport{
+		Transport: newStdioTransport("stdin", os.Stdin, os.Stdout, maxFrameSize),
+		decorate: func(ctx context.Context, _ *transport.BaseJsonRpcMessage) context.Context {
+			return contextWithIdentity(ctx, id)
+		},
+	}
 }
 
 // registerTools registers all the tools with the MCP server
-func registerTools(server *mcp.Server, mcpClients []*mcp.Client) {
+func registerTools(server *mcp.Server, rt *router) {
 	tools := []struct {
 		name        string
 		description string
 		handler     interface{}
 	}{
-		{"tools/list", "List all available tools", handleListTools(mcpClients)},
-		{"tools/call", "Call a specific tool", handleCallTool(mcpClients)},
+		{"tools/list", "List all available tools", handleListTools(rt)},
+		{"tools/call", "Call a specific tool", handleCallTool(rt)},
+		{"tools/search", "Find the tools best suited to a task described in natural language", handleSearchTools(rt)},
+		{"tools/call_batch", "Call several tools in one request, sequentially or in parallel", handleCallBatch(rt)},
+		{"tools/compare", "Call a tool on two servers with the same arguments and diff their responses and latencies", handleCompareBackends(rt)},
+		{"jobs/status", "Report the state of an async tool call", handleJobStatus(rt)},
+		{"jobs/result", "Retrieve the output of a finished async tool call", handleJobResult(rt)},
+		{"session/set_context", "Set session values injected into arguments of subsequent tool calls", handleSetContext(rt)},
+		{"session/end", "End the session, tearing down its stateful server instances", handleEndSession(rt)},
+		{"server/info", "Report the aggregator's version, commit, build date and enabled features", handleServerInfo(rt)},
 	}
 
 	for _, tool := range tools {
-		if err := server.RegisterTool(tool.name, tool.description, tool.handler); err != nil {
+		if err := server.RegisterTool(tool.name, tool.description, recoverHandler(tool.name, tool.handler)); err != nil {
 			log.Fatalf("Failed to register %s tool: %v", tool.name, err)
 		}
 		log.Printf("Registered tool: %s", tool.name)
@@ -92,30 +708,31 @@ func registerTools(server *mcp.Server, mcpClients []*mcp.Client) {
 // Tool handlers
 type ListToolsRequest struct {
 	Cursor string `json:"cursor"`
+	// Tags lists only the tools of servers tagged with any of them
+	Tags []string `json:"tags,omitempty"`
 }
 
 type CallToolRequest struct {
 	Name      string      `json:"name"`
 	Arguments interface{} `json:"arguments"`
+	// Async returns a job id immediately instead of waiting for the tool to finish
+	Async bool `json:"async,omitempty"`
+	// Meta is forwarded as the _meta of the upstream call, on top of the _meta of the wrapping request
+	Meta map[string]interface{} `json:"_meta,omitempty"`
 }
 
-func handleListTools(mcpClients []*mcp.Client) interface{} {
-	return func(args ListToolsRequest) (*mcp.ToolResponse, error) {
-		var allTools []interface{}
-		for _, client := range mcpClients {
-			tools, err := client.ListTools(context.Background(), &args.Cursor)
-			if err != nil {
-				continue
-			}
-			for _, tool := range tools.Tools {
-				allTools = append(allTools, tool)
-			}
+func handleListTools(rt *router) interface{} {
+	return func(ctx context.Context, args ListToolsRequest) (*mcp.ToolResponse, error) {
+		advertised, omitted := rt.catalog(contextWithTagFilter(ctx, args.Tags), args.Cursor)
+		listing := map[string]interface{}{
+			"tools": advertised,
+		}
+		if omitted > 0 {
+			listing["omitted"] = omitted
 		}
 
 		// Convert tools to JSON string
-		toolsJSON, err := json.Marshal(map[string]interface{}{
-			"tools": allTools,
-		})
+		toolsJSON, err := json.Marshal(listing)
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal tools: %v", err)
 		}
@@ -133,175 +750,325 @@ func handleListTools(mcpClients []*mcp.Client) interface{} {
 	}
 }
 
-func handleCallTool(mcpClients []*mcp.Client) interface{} {
-	return func(args CallToolRequest) (*mcp.ToolResponse, error) {
-		for _, client := range mcpClients {
-			resp, err := client.CallTool(context.Background(), args.Name, args.Arguments)
-			if err == nil {
-				return resp, nil
-			}
+func handleCallTool(rt *router) interface{} {
+	return func(ctx context.Context, args CallToolRequest) (*mcp.ToolResponse, error) {
+		ctx = contextWithMeta(ctx, args.Meta)
+		if !args.Async {
+			// The result goes straight back to the host, so relay it without decoding
+			ctx = contextWithPassthrough(ctx, rt.raw, rt.artifacts.limit())
+			return rt.call(ctx, args.Name, args.Arguments)
 		}
-		return &mcp.ToolResponse{
-			Content: []*mcp.Content{
-				{
-					Type: "text",
-					TextContent: &mcp.TextContent{
-						Text: "method not found",
-					},
-				},
-			},
-		}, nil
+
+		if !rt.features.enabled(featureAsyncJobs) {
+			return nil, fmt.Errorf("async calls are disabled by the %s feature flag", featureAsyncJobs)
+		}
+		j, err := rt.startJob(ctx, args.Name, args.Arguments)
+		if err != nil {
+			return nil, err
+		}
+		jobJSON, err := json.Marshal(map[string]interface{}{
+			"jobId": j.ID,
+			"state": j.State,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal job: %v", err)
+		}
+		return mcp.NewToolResponse(mcp.NewTextContent(string(jobJSON))), nil
 	}
 }
 
-// loadConfig reads and parses the configuration from the given file path
-func loadConfig(filePath string) Config {
-	file, err := os.Open(filePath)
+// loadConfig reads and parses the configuration from the given file path or URL
+func loadConfig(location string) Config {
+	cfg, err := resolveConfig(location)
 	if err != nil {
-		log.Fatalf("Failed to open config file: %v", err)
+		log.Fatalf("Failed to load config: %v", err)
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			return
+	return cfg
+}
+
+// resolveConfig reads and parses the configuration and resolves any environment variable
+// and secret placeholders in it
+func resolveConfig(location string) (Config, error) {
+	data, err := readConfig(location)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return Config{}, err
+	}
+
+	skipUnmetServers(&cfg)
+	if err := discoverEndpoints(&cfg); err != nil {
+		return Config{}, err
+	}
+
+	if err := resolveEnvVariables(&cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// readConfig returns the raw configuration from a local file, with the servers of its .d directory
+// merged in, or, for http(s) locations, from a remote source, composed with the configs it includes
+func readConfig(location string) ([]byte, error) {
+	data, err := readConfigFragment(location)
+	if err != nil {
+		return nil, err
+	}
+	if !isRemoteConfig(location) {
+		if data, err = mergeConfigDir(data, configDir(location)); err != nil {
+			return nil, err
 		}
-	}(file)
+	}
+	return includeConfigs(data, location, nil)
+}
 
+// readConfigFragment returns the raw contents of a local file or remote source
+func readConfigFragment(location string) ([]byte, error) {
+	if isRemoteConfig(location) {
+		return fetchRemoteConfig(location)
+	}
+	return os.ReadFile(location)
+}
+
+// parseConfig decodes either our own mcp.json format or a Claude Desktop configuration
+func parseConfig(data []byte) (Config, error) {
+	data, err := expandTemplates(data)
+	if err != nil {
+		return Config{}, err
+	}
 	var cfg Config
-	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, err
+	}
+	if len(cfg.MCPStdIOServers) > 0 {
+		return cfg, nil
 	}
 
-	// Resolve any environment variable placeholders in the configuration
-	resolveEnvVariables(&cfg)
-	return cfg
+	// Fall back to the Claude Desktop mcpServers layout
+	var claudeCfg ClaudeDesktopConfig
+	if err := json.Unmarshal(data, &claudeCfg); err != nil {
+		return Config{}, err
+	}
+	if len(claudeCfg.MCPServers) > 0 {
+		log.Println("Loaded Claude Desktop mcpServers configuration")
+		return claudeCfg.toConfig(), nil
+	}
+	return cfg, nil
 }
 
-// resolveEnvVariables replaces ${ENV_VAR} placeholders in the configuration with actual environment variables
-func resolveEnvVariables(cfg *Config) {
+// resolveEnvVariables replaces ${ENV_VAR} placeholders in the configuration with actual environment variables,
+// and ${secret:provider:ref} placeholders with values fetched from the named secret provider
+func resolveEnvVariables(cfg *Config) error {
+	servers := make(map[string]MCPStdIOConfig, len(cfg.MCPStdIOServers))
 	for name, server := range cfg.MCPStdIOServers {
+		env := make(map[string]string, len(server.Env))
 		for key, value := range server.Env {
-			if strings.HasPrefix(value, "${") && strings.HasSuffix(value, "}") {
-				envVar := strings.Trim(value, "${}")
-				if resolvedValue, found := os.LookupEnv(envVar); found {
-					server.Env[key] = resolvedValue
-				} else {
-					log.Fatalf("Environment variable '%s' is not set", envVar)
-				}
+			resolvedValue, err := resolvePlaceholder(value)
+			if err != nil {
+				return fmt.Errorf("failed to resolve '%s' in '%s': %v", key, name, err)
 			}
+			env[key] = resolvedValue
 		}
-		cfg.MCPStdIOServers[name] = server
-	}
-}
+		server.Env = env
 
-// initializeMCPClients sets up both SSE and StdIO clients based on the configuration
-func initializeMCPClients(cfg Config, clientInfo mcp.ClientInfo) ([]*mcp.Client, []*exec.Cmd) {
-	var mcpClients []*mcp.Client
-	var stdIOCmds []*exec.Cmd
+		resolvedURL, err := resolvePlaceholder(server.URL)
+		if err != nil {
+			return fmt.Errorf("failed to resolve URL of '%s': %v", name, err)
+		}
+		server.URL = resolvedURL
 
-	// Set up StdIO clients
-	for name, config := range cfg.MCPStdIOServers {
-		log.Printf("Initializing StdIO client '%s' with command: %s", name, config.Command)
+		if server.Headers != nil {
+			headers := make(map[string]string, len(server.Headers))
+			for key, value := range server.Headers {
+				resolvedValue, err := resolvePlaceholder(value)
+				if err != nil {
+					return fmt.Errorf("failed to resolve header '%s' in '%s': %v", key, name, err)
+				}
+				headers[key] = resolvedValue
+			}
+			server.Headers = headers
+		}
+		if server.Network != nil {
+			network := *server.Network
+			if network.Proxy, err = resolvePlaceholder(network.Proxy); err != nil {
+				return fmt.Errorf("failed to resolve proxy of '%s': %v", name, err)
+			}
+			server.Network = &network
+		}
+		if server.Tenants != nil {
+			tenants := make(map[string]TenantConfig, len(server.Tenants))
+			for tenant, tenantCfg := range server.Tenants {
+				env := make(map[string]string, len(tenantCfg.Env))
+				for key, value := range tenantCfg.Env {
+					resolvedValue, err := resolvePlaceholder(value)
+					if err != nil {
+						return fmt.Errorf("failed to resolve '%s' for tenant '%s' in '%s': %v", key, tenant, name, err)
+					}
+					env[key] = resolvedValue
+				}
+				tenantCfg.Env = env
+				tenants[tenant] = tenantCfg
+			}
+			server.Tenants = tenants
+		}
+		servers[name] = server
+	}
+	cfg.MCPStdIOServers = servers
 
-		// Start the external process
-		cmd := exec.Command(config.Command, config.Args...)
-		for key, value := range config.Env {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	if cfg.Auth != nil {
+		auth := *cfg.Auth
+		auth.Tokens = make([]TokenConfig, len(cfg.Auth.Tokens))
+		for i, token := range cfg.Auth.Tokens {
+			resolvedValue, err := resolvePlaceholder(token.Token)
+			if err != nil {
+				return fmt.Errorf("failed to resolve token for '%s': %v", token.Identity, err)
+			}
+			token.Token = resolvedValue
+			auth.Tokens[i] = token
 		}
-		stdIOCmds = append(stdIOCmds, cmd)
+		cfg.Auth = &auth
+	}
 
-		// Set up pipes for communication
-		stdin, err := cmd.StdinPipe()
+	webhooks := make([]WebhookConfig, len(cfg.Webhooks))
+	for i, webhook := range cfg.Webhooks {
+		resolvedURL, err := resolvePlaceholder(webhook.URL)
 		if err != nil {
-			log.Fatalf("Failed to create stdin pipe for '%s': %v", name, err)
+			return fmt.Errorf("failed to resolve webhook URL: %v", err)
 		}
+		webhook.URL = resolvedURL
 
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			log.Fatalf("Failed to create stdout pipe for '%s': %v", name, err)
+		headers := make(map[string]string, len(webhook.Headers))
+		for key, value := range webhook.Headers {
+			resolvedValue, err := resolvePlaceholder(value)
+			if err != nil {
+				return fmt.Errorf("failed to resolve webhook header '%s': %v", key, err)
+			}
+			headers[key] = resolvedValue
 		}
+		webhook.Headers = headers
+		webhooks[i] = webhook
+	}
+	cfg.Webhooks = webhooks
 
-		stderr, err := cmd.StderrPipe()
+	exporters := make([]ExporterConfig, len(cfg.Exporters))
+	for i, exporter := range cfg.Exporters {
+		resolvedURL, err := resolvePlaceholder(exporter.URL)
 		if err != nil {
-			log.Fatalf("Failed to create stderr pipe for '%s': %v", name, err)
+			return fmt.Errorf("failed to resolve exporter URL: %v", err)
 		}
+		exporter.URL = resolvedURL
 
-		// Start the external command
-		if err := cmd.Start(); err != nil {
-			log.Fatalf("Failed to start command '%s': %v", name, err)
+		headers := make(map[string]string, len(exporter.Headers))
+		for key, value := range exporter.Headers {
+			resolvedValue, err := resolvePlaceholder(value)
+			if err != nil {
+				return fmt.Errorf("failed to resolve exporter header '%s': %v", key, err)
+			}
+			headers[key] = resolvedValue
 		}
+		exporter.Headers = headers
+		exporters[i] = exporter
+	}
+	cfg.Exporters = exporters
 
-		// Log any error output from the command
-		go func() {
-			scanner := bufio.NewScanner(stderr)
-			for scanner.Scan() {
-				log.Printf("StdIO client '%s' stderr: %s", name, scanner.Text())
+	if cfg.HMAC != nil {
+		hmacCfg := *cfg.HMAC
+		hmacCfg.Callers = make(map[string]string, len(cfg.HMAC.Callers))
+		for caller, secret := range cfg.HMAC.Callers {
+			resolvedValue, err := resolvePlaceholder(secret)
+			if err != nil {
+				return fmt.Errorf("failed to resolve HMAC secret for '%s': %v", caller, err)
 			}
-		}()
-
-		// Create an StdIO MCP client
-		stdIOClient := mcp.NewClientWithInfo(stdio.NewStdioServerTransportWithIO(stdout, stdin), clientInfo)
-		mcpClients = append(mcpClients, stdIOClient)
+			hmacCfg.Callers[caller] = resolvedValue
+		}
+		cfg.HMAC = &hmacCfg
 	}
 
-	return mcpClients, stdIOCmds
-}
-
-// initializeAndListTools initializes all clients and fetches available tools
-func initializeAndListTools(mcpClients []*mcp.Client) {
-	for i, client := range mcpClients {
-		log.Printf("Initializing MCP client %d...", i+1)
-
-		// Initialize the client
-		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-		_, err := client.Initialize(ctx)
-		cancel()
-
-		if err != nil {
-			log.Printf("Failed to initialize client %d: %v", i+1, err)
-			continue
+	sinks := make([]LogSinkConfig, len(cfg.LogSinks))
+	for i, sink := range cfg.LogSinks {
+		headers := make(map[string]string, len(sink.Headers))
+		for key, value := range sink.Headers {
+			resolvedValue, err := resolvePlaceholder(value)
+			if err != nil {
+				return fmt.Errorf("failed to resolve log sink header '%s': %v", key, err)
+			}
+			headers[key] = resolvedValue
 		}
+		sink.Headers = headers
+		sinks[i] = sink
+	}
+	cfg.LogSinks = sinks
 
-		// Fetch tools with empty string cursor instead of nil
-		log.Printf("Fetching tools for client %d...", i+1)
-		ctx, cancel = context.WithTimeout(context.Background(), 15*time.Second)
-		cursor := "" // Use empty string instead of nil
-		toolsResponse, err := client.ListTools(ctx, &cursor)
-		cancel()
-
+	if cfg.Discovery != nil {
+		discovery := *cfg.Discovery
+		resolvedValue, err := resolvePlaceholder(discovery.Token)
 		if err != nil {
-			log.Printf("Failed to fetch tools for client %d: %v", i+1, err)
-			continue
+			return fmt.Errorf("failed to resolve discovery token: %v", err)
 		}
+		discovery.Token = resolvedValue
+		cfg.Discovery = &discovery
+	}
 
-		// Print tools
-		log.Printf("Client %d Tools:", i+1)
-		for _, tool := range toolsResponse.Tools {
-			log.Printf("- %v", tool)
+	policy, err := resolvePolicy(cfg.Policy)
+	if err != nil {
+		return err
+	}
+	cfg.Policy = policy
+	if cfg.Profiles != nil {
+		profiles := make(map[string]Profile, len(cfg.Profiles))
+		for name, profile := range cfg.Profiles {
+			if profile.Policy, err = resolvePolicy(profile.Policy); err != nil {
+				return fmt.Errorf("profile '%s': %v", name, err)
+			}
+			profiles[name] = profile
 		}
+		cfg.Profiles = profiles
 	}
-}
 
-// shutdownMCPClients gracefully shuts down all MCP clients and StdIO commands
-func shutdownMCPClients(mcpClients []*mcp.Client, stdIOCmds []*exec.Cmd) {
-	log.Println("Shutting down MCP clients...")
-	for _, client := range mcpClients {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		err := client.Ping(ctx) // Only as an example of cleanup logic
-		cancel()
+	if cfg.ToolSearch != nil {
+		search := *cfg.ToolSearch
+		resolvedValue, err := resolvePlaceholder(search.APIKey)
 		if err != nil {
-			log.Printf("Failed to ping MCP client: %v", err)
+			return fmt.Errorf("failed to resolve tool search API key: %v", err)
 		}
+		search.APIKey = resolvedValue
+		cfg.ToolSearch = &search
 	}
+	return nil
+}
 
-	log.Println("Killing StdIO commands...")
-	for _, cmd := range stdIOCmds {
-		if err := cmd.Process.Kill(); err != nil {
-			log.Printf("Failed to kill StdIO command: %v", err)
-		}
-		err := cmd.Wait()
+// resolvePolicy returns a copy of the policy config with the placeholders of its headers resolved
+func resolvePolicy(cfg *PolicyConfig) (*PolicyConfig, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	policy := *cfg
+	policy.Headers = make(map[string]string, len(cfg.Headers))
+	for key, value := range cfg.Headers {
+		resolvedValue, err := resolvePlaceholder(value)
 		if err != nil {
-			return
+			return nil, fmt.Errorf("failed to resolve policy header '%s': %v", key, err)
 		}
+		policy.Headers[key] = resolvedValue
+	}
+	return &policy, nil
+}
+
+// resolvePlaceholder resolves a single ${ENV_VAR} or ${secret:provider:ref} value, returning other values unchanged
+func resolvePlaceholder(value string) (string, error) {
+	if !strings.HasPrefix(value, "${") || !strings.HasSuffix(value, "}") {
+		return value, nil
+	}
+
+	placeholder := value[2 : len(value)-1]
+	if strings.HasPrefix(placeholder, "secret:") {
+		return resolveSecret(strings.TrimPrefix(placeholder, "secret:"))
+	}
+	if resolvedValue, found := os.LookupEnv(placeholder); found {
+		return resolvedValue, nil
 	}
+	return "", fmt.Errorf("environment variable '%s' is not set", placeholder)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// MaintenanceWindow takes a server out of service for a while, either once from Start to End or
+// every time Cron fires for Duration. Its tools stay listed but marked unavailable, and calls fail
+// right away with a maintenance error naming the end of the window.
+type MaintenanceWindow struct {
+	// Start and End bound a one-off window, e.g. "2026-11-01T02:00:00Z"
+	Start time.Time `json:"Start,omitempty"`
+	End   time.Time `json:"End,omitempty"`
+	// Cron starts a recurring window lasting Duration, e.g. "0 2 * * 0" for Sundays at 2am
+	Cron     string   `json:"Cron,omitempty"`
+	Duration Duration `json:"Duration,omitempty"`
+	// TimeZone is the IANA time zone Cron is evaluated in; defaults to UTC
+	TimeZone string `json:"TimeZone,omitempty"`
+	// Reason is shown to callers, e.g. "database upgrade"
+	Reason string `json:"Reason,omitempty"`
+}
+
+// maintenanceError is returned for calls to a server in a maintenance window
+type maintenanceError struct {
+	server string
+	until  time.Time
+	reason string
+}
+
+func (e *maintenanceError) Error() string {
+	message := fmt.Sprintf("maintenance: '%s' is unavailable until %s", e.server, e.until.UTC().Format(time.RFC3339))
+	if e.reason != "" {
+		message += " (" + e.reason + ")"
+	}
+	return message
+}
+
+// checkMaintenance validates the maintenance windows of a server
+func checkMaintenance(windows []MaintenanceWindow) error {
+	for i, window := range windows {
+		switch {
+		case window.Cron != "":
+			if _, err := parseCron(window.Cron); err != nil {
+				return fmt.Errorf("maintenance window %d: %v", i+1, err)
+			}
+			if window.Duration <= 0 {
+				return fmt.Errorf("maintenance window %d: a recurring window needs a positive Duration", i+1)
+			}
+			if _, err := time.LoadLocation(window.TimeZone); err != nil {
+				return fmt.Errorf("maintenance window %d: %v", i+1, err)
+			}
+		case window.Start.IsZero() || !window.End.After(window.Start):
+			return fmt.Errorf("maintenance window %d: either Cron and Duration or a Start before End is required", i+1)
+		}
+	}
+	return nil
+}
+
+// inMaintenance returns the maintenance error for a server in one of its windows at now, ending
+// with the latest of the windows in progress, or nil if it is in service
+func inMaintenance(name string, windows []MaintenanceWindow, now time.Time) *maintenanceError {
+	var current *maintenanceError
+	for _, window := range windows {
+		start, end := window.Start, window.End
+		if window.Cron != "" {
+			cron, err := parseCron(window.Cron)
+			location, zoneErr := time.LoadLocation(window.TimeZone)
+			if err != nil || zoneErr != nil {
+				continue
+			}
+			// The latest start before now, if any, is the first one after a Duration ago
+			start = cron.next(now.In(location).Add(-time.Duration(window.Duration)))
+			end = start.Add(time.Duration(window.Duration))
+		}
+		if now.Before(start) || !now.Before(end) {
+			continue
+		}
+		if current == nil || end.After(current.until) {
+			current = &maintenanceError{server: name, until: end, reason: window.Reason}
+		}
+	}
+	return current
+}
+
+// maintenance returns the maintenance error for the named server if it is in a maintenance window
+func (r *backendRegistry) maintenance(name string) error {
+	config, ok := r.configured(name)
+	if !ok || len(config.Maintenance) == 0 {
+		return nil
+	}
+	if err := inMaintenance(name, config.Maintenance, time.Now()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// availableClients returns the clients of clients() whose servers are not in maintenance, or the
+// maintenance error of the first server left out when no other is left
+func (r *backendRegistry) availableClients() ([]*mcp.Client, error) {
+	var clients []*mcp.Client
+	var skipped error
+	for _, b := range r.list() {
+		if b.config.PerTenant || b.config.ShadowOf != "" {
+			continue
+		}
+		if err := r.maintenance(b.name); err != nil {
+			if skipped == nil {
+				skipped = err
+			}
+			continue
+		}
+		clients = append(clients, b.client)
+	}
+	if len(clients) == 0 && skipped != nil {
+		return nil, skipped
+	}
+	return clients, nil
+}
+
+// markUnavailable prefixes the description of the tools of servers in maintenance with when they return
+func (rt *router) markUnavailable(tools []catalogTool) {
+	for i, tool := range tools {
+		if err, ok := rt.registry.maintenance(tool.backend).(*maintenanceError); ok {
+			description := fmt.Sprintf("[Temporarily unavailable until %s for maintenance]", err.until.UTC().Format(time.RFC3339))
+			if tool.tool.Description != nil && *tool.tool.Description != "" {
+				description += " " + *tool.tool.Description
+			}
+			tools[i].tool.Description = &description
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryWatchdogConfig sheds load before the aggregator runs out of memory, since an OOM kill takes
+// every server down with it. While memory is over a limit, low-priority calls are refused and caches
+// dropped; if it stays over, the idle server using the most memory is restarted on each check.
+type MemoryWatchdogConfig struct {
+	// MaxRSSMB limits the resident memory of the aggregator and its server processes together, as a
+	// container's memory limit counts them
+	MaxRSSMB int `json:"MaxRSSMB,omitempty"`
+	// MaxHeapMB limits the aggregator's Go heap
+	MaxHeapMB int `json:"MaxHeapMB,omitempty"`
+	// LowPriorityTools are refused while memory is over a limit, e.g. "search_*"
+	LowPriorityTools []string `json:"LowPriorityTools,omitempty"`
+	// Interval is how often memory is checked; defaults to 10s
+	Interval Duration `json:"Interval,omitempty"`
+}
+
+// memoryUsage is a sample of the memory in use
+type memoryUsage struct {
+	rss, heap uint64
+	// servers is the resident memory of each running server process
+	servers map[string]uint64
+}
+
+// memoryWatchdog checks memory use against its limits and acts when it is over. A nil watchdog
+// never sheds.
+type memoryWatchdog struct {
+	cfg      MemoryWatchdogConfig
+	registry *backendRegistry
+	history  *callHistory
+	metrics  *metrics
+	// residentMemory returns the resident memory of a process, replaced in tests
+	residentMemory func(pid int) (uint64, error)
+
+	mu       sync.Mutex
+	shedding bool
+}
+
+// newMemoryWatchdog returns a watchdog for cfg, or nil when no limit is configured
+func newMemoryWatchdog(cfg *MemoryWatchdogConfig, registry *backendRegistry, history *callHistory, metrics *metrics) *memoryWatchdog {
+	if cfg == nil || (cfg.MaxRSSMB <= 0 && cfg.MaxHeapMB <= 0) {
+		return nil
+	}
+	w := &memoryWatchdog{cfg: *cfg, registry: registry, history: history, metrics: metrics, residentMemory: residentMemory}
+	if w.cfg.Interval <= 0 {
+		w.cfg.Interval = Duration(10 * time.Second)
+	}
+	return w
+}
+
+// run checks memory periodically until the process exits
+func (w *memoryWatchdog) run() {
+	if w == nil {
+		return
+	}
+	for range time.Tick(time.Duration(w.cfg.Interval)) {
+		w.check()
+	}
+}
+
+// check samples memory and escalates or relaxes shedding
+func (w *memoryWatchdog) check() {
+	usage := w.sample()
+	w.metrics.setGauge("mcp_memory_rss_bytes", "Resident memory of the aggregator and its server processes", float64(usage.rss))
+	w.metrics.setGauge("mcp_memory_heap_bytes", "Go heap of the aggregator", float64(usage.heap))
+	over := w.over(usage)
+
+	w.mu.Lock()
+	wasShedding := w.shedding
+	w.shedding = over != ""
+	w.mu.Unlock()
+
+	switch {
+	case over == "" && wasShedding:
+		log.Printf("Memory back under its limits, no longer shedding")
+	case over != "" && !wasShedding:
+		log.Printf("Memory over its limit (%s): refusing low-priority calls and dropping caches", over)
+		w.history.reset()
+		debug.FreeOSMemory()
+		w.metrics.addCounter("mcp_memory_actions_total", "Actions taken by the memory watchdog", 1, "action", "shed")
+	case over != "":
+		if name := w.heaviestIdle(usage); name != "" {
+			log.Printf("Memory still over its limit (%s): restarting idle server '%s' using %dMB", over, name, usage.servers[name]>>20)
+			if err := w.registry.restart(name); err != nil {
+				log.Printf("Failed to restart '%s': %v", name, err)
+			}
+			w.metrics.addCounter("mcp_memory_actions_total", "Actions taken by the memory watchdog", 1, "action", "restart")
+		}
+	}
+}
+
+// sample measures the memory in use; resident memory is 0 where it cannot be read
+func (w *memoryWatchdog) sample() memoryUsage {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	usage := memoryUsage{heap: stats.HeapAlloc, servers: make(map[string]uint64)}
+	usage.rss, _ = w.residentMemory(os.Getpid())
+	for _, b := range w.registry.list() {
+		if b.cmd == nil || b.cmd.Process == nil {
+			continue
+		}
+		if rss, err := w.residentMemory(b.cmd.Process.Pid); err == nil {
+			usage.servers[b.name] = rss
+			usage.rss += rss
+		}
+	}
+	return usage
+}
+
+// over describes the limit usage exceeds, or returns "" when it is within its limits
+func (w *memoryWatchdog) over(usage memoryUsage) string {
+	if limit := uint64(w.cfg.MaxRSSMB) << 20; limit > 0 && usage.rss > limit {
+		return fmt.Sprintf("resident %dMB of %dMB", usage.rss>>20, w.cfg.MaxRSSMB)
+	}
+	if limit := uint64(w.cfg.MaxHeapMB) << 20; limit > 0 && usage.heap > limit {
+		return fmt.Sprintf("heap %dMB of %dMB", usage.heap>>20, w.cfg.MaxHeapMB)
+	}
+	return ""
+}
+
+// heaviestIdle returns the server with no calls in flight using the most memory, or "" if none is idle
+func (w *memoryWatchdog) heaviestIdle(usage memoryUsage) string {
+	heaviest, most := "", uint64(0)
+	for _, b := range w.registry.list() {
+		if rss, ok := usage.servers[b.name]; ok && b.active.Load() == 0 && rss > most {
+			heaviest, most = b.name, rss
+		}
+	}
+	return heaviest
+}
+
+// admit refuses low-priority tools while memory is over a limit
+func (w *memoryWatchdog) admit(tool string) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	shedding := w.shedding
+	w.mu.Unlock()
+	if shedding && matchesAny(w.cfg.LowPriorityTools, tool, false) {
+		w.metrics.addCounter("mcp_memory_shed_calls_total", "Low-priority calls refused while memory was over its limit", 1, "tool", tool)
+		return fmt.Errorf("tool '%s' is unavailable while the server is low on memory", tool)
+	}
+	return nil
+}
+
+// residentMemory reads the resident memory of a process from /proc, which only Linux provides
+func residentMemory(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected statm format")
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * uint64(os.Getpagesize()), nil
+}
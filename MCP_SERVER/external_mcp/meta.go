@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+type metaKey struct{}
+
+// contextWithMeta returns a copy of ctx carrying the MCP _meta of the call being proxied. Keys in
+// meta override those already carried by ctx.
+func contextWithMeta(ctx context.Context, meta map[string]interface{}) context.Context {
+	if len(meta) == 0 {
+		return ctx
+	}
+	merged := make(map[string]interface{}, len(meta))
+	for key, value := range metaFromContext(ctx) {
+		merged[key] = value
+	}
+	for key, value := range meta {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, metaKey{}, merged)
+}
+
+// metaFromContext returns the _meta to forward with upstream calls, or nil if there is none
+func metaFromContext(ctx context.Context) map[string]interface{} {
+	meta, _ := ctx.Value(metaKey{}).(map[string]interface{})
+	return meta
+}
+
+// observeMeta attaches the _meta of incoming tools/call requests, such as progress tokens, trace
+// ids and time budgets, to their context; it decorates the downstream transport
+func observeMeta(ctx context.Context, message *transport.BaseJsonRpcMessage) context.Context {
+	if message.Type != transport.BaseMessageTypeJSONRPCRequestType || message.JsonRpcRequest.Method != "tools/call" {
+		return ctx
+	}
+	var params struct {
+		Meta map[string]interface{} `json:"_meta"`
+	}
+	if err := json.Unmarshal(message.JsonRpcRequest.Params, &params); err != nil {
+		return ctx
+	}
+	return contextWithBudget(contextWithMeta(ctx, params.Meta), params.Meta[budgetMetaKey])
+}
+
+// withMeta adds meta to the _meta of request params, keeping keys the params already set
+func withMeta(params json.RawMessage, meta map[string]interface{}) (json.RawMessage, error) {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(params, &decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode request params: %v", err)
+	}
+	merged, _ := decoded["_meta"].(map[string]interface{})
+	if merged == nil {
+		merged = make(map[string]interface{}, len(meta))
+	}
+	for key, value := range meta {
+		if _, ok := merged[key]; !ok {
+			merged[key] = value
+		}
+	}
+	decoded["_meta"] = merged
+	return json.Marshal(decoded)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// methodHandler answers a request with a result to encode, or fails it with an error
+type methodHandler func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// methodRoute answers the requests for a method that claims accepts, or every one if it is nil
+type methodRoute struct {
+	claims  func(params json.RawMessage) bool
+	handler methodHandler
+}
+
+// methodTransport answers the MCP requests the server library has no support for, such as
+// completion/complete, or can only answer for itself, such as reads of the servers' resources. It
+// declares the capabilities they belong to in the server's initialize response.
+type methodTransport struct {
+	transport.Transport
+
+	mu     sync.Mutex
+	routes map[string]methodRoute
+	// capabilities are added to the capabilities the server declares
+	capabilities map[string]map[string]interface{}
+	// initializing holds the ids of initialize requests waiting for the server's response
+	initializing map[transport.RequestId]bool
+}
+
+func newMethodTransport(inner transport.Transport) *methodTransport {
+	return &methodTransport{
+		Transport:    inner,
+		routes:       make(map[string]methodRoute),
+		capabilities: make(map[string]map[string]interface{}),
+		initializing: make(map[transport.RequestId]bool),
+	}
+}
+
+// handle answers requests for method with handler, declaring capability if it is not empty
+func (t *methodTransport) handle(method, capability string, handler methodHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes[method] = methodRoute{handler: handler}
+	if capability != "" {
+		t.capabilities[capability] = map[string]interface{}{}
+	}
+}
+
+// declare adds settings to a capability the server declares, e.g. subscribe to resources
+func (t *methodTransport) declare(capability string, settings map[string]interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.capabilities[capability] = settings
+}
+
+// handleIf answers the requests for method that claims accepts with handler, leaving the others to
+// the server
+func (t *methodTransport) handleIf(method string, claims func(params json.RawMessage) bool, handler methodHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes[method] = methodRoute{claims: claims, handler: handler}
+}
+
+// SetMessageHandler answers the requests claimed by the handled methods and remembers initialize
+// requests, handing every other message to handler
+func (t *methodTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.Transport.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		if message.Type == transport.BaseMessageTypeJSONRPCRequestType {
+			request := message.JsonRpcRequest
+			t.mu.Lock()
+			route, ok := t.routes[request.Method]
+			if request.Method == "initialize" {
+				t.initializing[request.Id] = true
+			}
+			t.mu.Unlock()
+			if ok && (route.claims == nil || route.claims(request.Params)) {
+				go t.answer(ctx, request, route.handler)
+				return
+			}
+		}
+		handler(ctx, message)
+	})
+}
+
+// answer runs method for a request and sends its result or error
+func (t *methodTransport) answer(ctx context.Context, request *transport.BaseJSONRPCRequest, method methodHandler) {
+	response := transport.NewBaseMessageError(&transport.BaseJSONRPCError{Jsonrpc: "2.0", Id: request.Id})
+	result, err := func() (result interface{}, err error) {
+		defer recoverPanic(ctx, request.Method, &err)
+		return method(ctx, request.Params)
+	}()
+	if err == nil {
+		var encoded []byte
+		if encoded, err = json.Marshal(result); err == nil {
+			response = transport.NewBaseMessageResponse(&transport.BaseJSONRPCResponse{Jsonrpc: "2.0", Id: request.Id, Result: encoded})
+		}
+	}
+	if err != nil {
+		response.JsonRpcError.Error = transport.BaseJSONRPCErrorInner{Code: internalErrorCode, Message: err.Error()}
+	}
+	if err := t.Transport.Send(ctx, response); err != nil {
+		logf(ctx, "Failed to answer %s: %v", request.Method, err)
+	}
+}
+
+// Send adds the capabilities of the handled methods to the server's initialize response
+func (t *methodTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	if message.Type != transport.BaseMessageTypeJSONRPCResponseType {
+		return t.Transport.Send(ctx, message)
+	}
+	t.mu.Lock()
+	initialize := t.initializing[message.JsonRpcResponse.Id]
+	delete(t.initializing, message.JsonRpcResponse.Id)
+	capabilities := t.capabilities
+	t.mu.Unlock()
+	if initialize && len(capabilities) > 0 {
+		message.JsonRpcResponse.Result = withCapabilities(message.JsonRpcResponse.Result, capabilities)
+	}
+	return t.Transport.Send(ctx, message)
+}
+
+// withCapabilities adds capabilities to those declared in an initialize result, merging the settings
+// of capabilities declared by both
+func withCapabilities(result json.RawMessage, capabilities map[string]map[string]interface{}) json.RawMessage {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(result, &decoded); err != nil {
+		return result
+	}
+	declared, _ := decoded["capabilities"].(map[string]interface{})
+	if declared == nil {
+		declared = make(map[string]interface{})
+	}
+	for name, capability := range capabilities {
+		settings, ok := declared[name].(map[string]interface{})
+		if !ok {
+			declared[name] = capability
+			continue
+		}
+		for key, value := range capability {
+			settings[key] = value
+		}
+	}
+	decoded["capabilities"] = declared
+
+	extended, err := json.Marshal(decoded)
+	if err != nil {
+		log.Printf("Failed to declare capabilities: %v", err)
+		return result
+	}
+	return extended
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metrics holds counters and gauges and serves them in the Prometheus text exposition format.
+// A nil metrics registry ignores updates.
+type metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+// metricFamily is a named metric with one value per label set
+type metricFamily struct {
+	help   string
+	kind   string
+	values map[string]float64
+	// exemplars holds the exemplar of the last update per label set, e.g. the call's correlation id
+	exemplars map[string]exemplar
+}
+
+// exemplar links a sample to the request that last updated it; only OpenMetrics scrapes show them
+type exemplar struct {
+	labels string
+	value  float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{families: make(map[string]*metricFamily)}
+}
+
+// setGauge sets a gauge; labels are given as name/value pairs
+func (m *metrics) setGauge(name, help string, value float64, labels ...string) {
+	m.update(name, help, "gauge", labels, func(float64) float64 { return value })
+}
+
+// addCounter increments a counter; labels are given as name/value pairs
+func (m *metrics) addCounter(name, help string, delta float64, labels ...string) {
+	m.update(name, help, "counter", labels, func(current float64) float64 { return current + delta })
+}
+
+// addCounterWithExemplar increments a counter and records the exemplar labels, given as name/value
+// pairs, of the increment
+func (m *metrics) addCounterWithExemplar(name, help string, delta float64, exemplarLabels []string, labels ...string) {
+	m.addCounter(name, help, delta, labels...)
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	family := m.families[name]
+	if family.exemplars == nil {
+		family.exemplars = make(map[string]exemplar)
+	}
+	family.exemplars[formatLabels(labels)] = exemplar{labels: formatLabels(exemplarLabels), value: delta}
+}
+
+func (m *metrics) update(name, help, kind string, labels []string, apply func(float64) float64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	family, ok := m.families[name]
+	if !ok {
+		family = &metricFamily{help: help, kind: kind, values: make(map[string]float64)}
+		m.families[name] = family
+	}
+	key := formatLabels(labels)
+	family.values[key] = apply(family.values[key])
+}
+
+// formatLabels renders name/value pairs as a Prometheus label set
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// ServeHTTP writes all metrics ordered by name and label set, in the OpenMetrics format with
+// exemplars when the scraper accepts it
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		defer fmt.Fprint(w, "# EOF\n")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	}
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := m.families[name]
+		familyName := name
+		if openMetrics && family.kind == "counter" {
+			// OpenMetrics names counter families without the _total suffix of their samples
+			familyName = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", familyName, family.help, familyName, family.kind)
+		keys := make([]string, 0, len(family.values))
+		for key := range family.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if ex, ok := family.exemplars[key]; ok && openMetrics {
+				fmt.Fprintf(w, "%s%s %v # %s %v\n", name, key, family.values[key], ex.labels, ex.value)
+				continue
+			}
+			fmt.Fprintf(w, "%s%s %v\n", name, key, family.values[key])
+		}
+	}
+}
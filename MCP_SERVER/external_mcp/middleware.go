@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// Middleware is custom policy logic loaded from a Go plugin or a WASM module. Its methods use only
+// standard library types, so a plugin implements it without importing the aggregator.
+type Middleware interface {
+	// OnCallStart sees every call before it is routed and returns the arguments to forward, which it
+	// may rewrite. An error vetoes the call. info holds the tool, identity, tenant and correlationId.
+	OnCallStart(ctx context.Context, info map[string]string, arguments map[string]interface{}) (map[string]interface{}, error)
+	// Transform returns the JSON tool result to send to the host, which it may rewrite
+	Transform(ctx context.Context, info map[string]string, result json.RawMessage) (json.RawMessage, error)
+	// OnCallEnd sees the outcome of every call that was not vetoed
+	OnCallEnd(ctx context.Context, info map[string]string, duration time.Duration, err error)
+}
+
+// MiddlewareConfig declares a middleware to load
+type MiddlewareConfig struct {
+	// Type is "plugin" for a Go plugin exporting a Middleware symbol, or "wasm" for a WASI module
+	Type string `json:"Type"`
+	Path string `json:"Path"`
+	// Runtime is the command running WASM modules, given the module path as its last argument;
+	// defaults to ["wasmtime", "run"]
+	Runtime []string `json:"Runtime,omitempty"`
+}
+
+// middlewareChain runs the loaded middleware in configuration order. A nil chain does nothing.
+type middlewareChain []Middleware
+
+// loadMiddleware loads the configured middleware
+func loadMiddleware(configs []MiddlewareConfig) (middlewareChain, error) {
+	var chain middlewareChain
+	for _, cfg := range configs {
+		var m Middleware
+		var err error
+		switch cfg.Type {
+		case "plugin":
+			m, err = loadPluginMiddleware(cfg.Path)
+		case "wasm":
+			m, err = startWASMMiddleware(cfg)
+		default:
+			err = fmt.Errorf("unknown middleware type '%s', expected plugin or wasm", cfg.Type)
+		}
+		if err != nil {
+			chain.close()
+			return nil, fmt.Errorf("failed to load middleware '%s': %v", cfg.Path, err)
+		}
+		chain = append(chain, m)
+	}
+	return chain, nil
+}
+
+// callInfo describes a call to middleware
+func callInfo(ctx context.Context, tool string) map[string]string {
+	caller := identityFromContext(ctx)
+	return map[string]string{
+		"tool":          tool,
+		"identity":      caller.Name,
+		"tenant":        caller.Tenant,
+		"correlationId": correlationIDFromContext(ctx),
+	}
+}
+
+// start runs OnCallStart of every middleware, each seeing the arguments the previous one returned.
+// Once ctx is done the call fails without consulting the remaining middleware.
+func (c middlewareChain) start(ctx context.Context, info map[string]string, arguments interface{}) (interface{}, error) {
+	if len(c) == 0 {
+		return arguments, nil
+	}
+	args, err := argumentMap(arguments)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range c {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("call to '%s' abandoned: %v", info["tool"], err)
+		}
+		if args, err = m.OnCallStart(ctx, info, args); err != nil {
+			return nil, fmt.Errorf("call to '%s' vetoed: %v", info["tool"], err)
+		}
+	}
+	return args, nil
+}
+
+// transform runs Transform of every middleware over the response, failing once ctx is done
+func (c middlewareChain) transform(ctx context.Context, info map[string]string, resp *mcp.ToolResponse) (*mcp.ToolResponse, error) {
+	if len(c) == 0 || resp == nil {
+		return resp, nil
+	}
+	result, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range c {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("failed to transform result of '%s': %v", info["tool"], err)
+		}
+		if result, err = m.Transform(ctx, info, result); err != nil {
+			return nil, fmt.Errorf("failed to transform result of '%s': %v", info["tool"], err)
+		}
+	}
+	var transformed mcp.ToolResponse
+	if err := json.Unmarshal(result, &transformed); err != nil {
+		return nil, fmt.Errorf("middleware returned an invalid result for '%s': %v", info["tool"], err)
+	}
+	return &transformed, nil
+}
+
+// end runs OnCallEnd of every middleware
+func (c middlewareChain) end(ctx context.Context, info map[string]string, duration time.Duration, err error) {
+	for _, m := range c {
+		m.OnCallEnd(ctx, info, duration, err)
+	}
+}
+
+// close stops the middleware running in separate processes
+func (c middlewareChain) close() {
+	for _, m := range c {
+		if closer, ok := m.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+}
+
+// wasmMiddleware runs a WASI module under a WASM runtime and exchanges one JSON line per hook with it
+// over stdio. Requests are {"hook": "start"|"transform"|"end", "info": ..., ...} and responses are
+// {"arguments": ...}, {"result": ...} or {}, with "error" set to veto or fail. A module that stopped
+// responding fails every call rather than letting it through unchecked.
+type wasmMiddleware struct {
+	cmd *exec.Cmd
+
+	mu     sync.Mutex
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+type wasmRequest struct {
+	Hook      string                 `json:"hook"`
+	Info      map[string]string      `json:"info"`
+	Arguments map[string]interface{} `json:"arguments,omitempty"`
+	Result    json.RawMessage        `json:"result,omitempty"`
+	Duration  string                 `json:"duration,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+type wasmResponse struct {
+	Arguments map[string]interface{} `json:"arguments,omitempty"`
+	Result    json.RawMessage        `json:"result,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+func startWASMMiddleware(cfg MiddlewareConfig) (*wasmMiddleware, error) {
+	runtime := cfg.Runtime
+	if len(runtime) == 0 {
+		runtime = []string{"wasmtime", "run"}
+	}
+	cmd := exec.Command(runtime[0], append(runtime[1:], cfg.Path)...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	log.Printf("Started WASM middleware '%s'", cfg.Path)
+	return &wasmMiddleware{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// exchange sends a request and waits for the module's response, or until ctx is done. A response
+// arriving after that is still read, keeping later exchanges in step, and discarded.
+func (w *wasmMiddleware) exchange(ctx context.Context, request wasmRequest) (wasmResponse, error) {
+	type outcome struct {
+		response wasmResponse
+		err      error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		response, err := w.roundTrip(request)
+		done <- outcome{response, err}
+	}()
+	select {
+	case o := <-done:
+		return o.response, o.err
+	case <-ctx.Done():
+		return wasmResponse{}, fmt.Errorf("middleware did not answer in time: %v", ctx.Err())
+	}
+}
+
+// roundTrip writes a request line and reads the response line, one exchange at a time
+func (w *wasmMiddleware) roundTrip(request wasmRequest) (wasmResponse, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return wasmResponse{}, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.stdin.Write(append(data, '\n')); err != nil {
+		return wasmResponse{}, fmt.Errorf("middleware is not running: %v", err)
+	}
+	line, err := w.stdout.ReadBytes('\n')
+	if err != nil {
+		return wasmResponse{}, fmt.Errorf("middleware is not running: %v", err)
+	}
+	var response wasmResponse
+	if err := json.Unmarshal(line, &response); err != nil {
+		return wasmResponse{}, fmt.Errorf("invalid middleware response: %v", err)
+	}
+	return response, nil
+}
+
+func (w *wasmMiddleware) OnCallStart(ctx context.Context, info map[string]string, arguments map[string]interface{}) (map[string]interface{}, error) {
+	response, err := w.exchange(ctx, wasmRequest{Hook: "start", Info: info, Arguments: arguments})
+	if err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("%s", response.Error)
+	}
+	if response.Arguments == nil {
+		return arguments, nil
+	}
+	return response.Arguments, nil
+}
+
+func (w *wasmMiddleware) Transform(ctx context.Context, info map[string]string, result json.RawMessage) (json.RawMessage, error) {
+	response, err := w.exchange(ctx, wasmRequest{Hook: "transform", Info: info, Result: result})
+	if err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("%s", response.Error)
+	}
+	if response.Result == nil {
+		return result, nil
+	}
+	return response.Result, nil
+}
+
+func (w *wasmMiddleware) OnCallEnd(ctx context.Context, info map[string]string, duration time.Duration, err error) {
+	request := wasmRequest{Hook: "end", Info: info, Duration: duration.String()}
+	if err != nil {
+		request.Error = err.Error()
+	}
+	if _, err := w.exchange(ctx, request); err != nil {
+		logf(ctx, "WASM middleware failed to observe the end of '%s': %v", info["tool"], err)
+	}
+}
+
+// Close stops the module
+func (w *wasmMiddleware) Close() error {
+	_ = w.stdin.Close()
+	done := make(chan error, 1)
+	go func() { done <- w.cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		_ = w.cmd.Process.Kill()
+		return <-done
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !cgo || !(linux || darwin || freebsd)
+
+package main
+
+import "fmt"
+
+// pluginsSupported reports that this build cannot load plugin middleware
+const pluginsSupported = false
+
+// loadPluginMiddleware reports that Go plugins are not supported by this build
+func loadPluginMiddleware(path string) (Middleware, error) {
+	return nil, fmt.Errorf("plugins require a cgo build on linux, darwin or freebsd")
+}
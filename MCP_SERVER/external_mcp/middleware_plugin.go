@@ -0,0 +1,35 @@
+//go:build cgo && (linux || darwin || freebsd)
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"plugin"
+)
+
+// pluginsSupported reports that this build can load plugin middleware
+const pluginsSupported = true
+
+// loadPluginMiddleware opens a Go plugin built with -buildmode=plugin against the same Go version
+// and looks up its exported Middleware variable
+func loadPluginMiddleware(path string) (Middleware, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	symbol, err := p.Lookup("Middleware")
+	if err != nil {
+		return nil, err
+	}
+	// Lookup returns a pointer to the variable, which implements the interface itself or holds a value that does
+	if m, ok := symbol.(Middleware); ok {
+		log.Printf("Loaded middleware plugin '%s'", path)
+		return m, nil
+	}
+	if m, ok := symbol.(*Middleware); ok && *m != nil {
+		log.Printf("Loaded middleware plugin '%s'", path)
+		return *m, nil
+	}
+	return nil, fmt.Errorf("symbol Middleware of type %T does not implement the Middleware interface", symbol)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	mcp "github.com/metoro-io/mcp-golang"
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// nativeToolsTransport advertises the aggregated tools as the server's own, so hosts and other
+// proxies can list and call them with standard MCP requests instead of the tools/list and
+// tools/call wrapper tools. Calls to the server's built-in tools are left to the server.
+type nativeToolsTransport struct {
+	transport.Transport
+	// builtin reports whether the server itself registered the named tool
+	builtin func(name string) bool
+	// rt is set once the router is built, before the server starts serving
+	rt *router
+
+	mu sync.Mutex
+	// listings holds the context of tools/list requests waiting for the server's response
+	listings map[transport.RequestId]context.Context
+}
+
+func newNativeToolsTransport(inner transport.Transport, builtin func(name string) bool) *nativeToolsTransport {
+	return &nativeToolsTransport{
+		Transport: inner,
+		builtin:   builtin,
+		listings:  make(map[transport.RequestId]context.Context),
+	}
+}
+
+// SetMessageHandler routes calls to aggregated tools and remembers tools/list requests, handing
+// every other message to handler
+func (t *nativeToolsTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.Transport.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		if message.Type == transport.BaseMessageTypeJSONRPCRequestType {
+			switch request := message.JsonRpcRequest; request.Method {
+			case "tools/list":
+				t.mu.Lock()
+				t.listings[request.Id] = ctx
+				t.mu.Unlock()
+			case "tools/call":
+				var params CallToolRequest
+				if err := json.Unmarshal(request.Params, &params); err == nil && !t.builtin(params.Name) {
+					go t.call(ctx, request.Id, params)
+					return
+				}
+			}
+		}
+		handler(ctx, message)
+	})
+}
+
+// Send appends the aggregated tools to the last page of the server's own tool list
+func (t *nativeToolsTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	var id transport.RequestId
+	switch message.Type {
+	case transport.BaseMessageTypeJSONRPCResponseType:
+		id = message.JsonRpcResponse.Id
+	case transport.BaseMessageTypeJSONRPCErrorType:
+		id = message.JsonRpcError.Id
+	default:
+		return t.Transport.Send(ctx, message)
+	}
+
+	t.mu.Lock()
+	listingCtx, ok := t.listings[id]
+	delete(t.listings, id)
+	t.mu.Unlock()
+	if ok && message.Type == transport.BaseMessageTypeJSONRPCResponseType {
+		message.JsonRpcResponse.Result = t.appendCatalog(listingCtx, message.JsonRpcResponse.Result)
+	}
+	return t.Transport.Send(ctx, message)
+}
+
+// appendCatalog adds the tools the caller may see to a tools/list result without a next page
+func (t *nativeToolsTransport) appendCatalog(ctx context.Context, result json.RawMessage) json.RawMessage {
+	var listing map[string]interface{}
+	if err := json.Unmarshal(result, &listing); err != nil || listing["nextCursor"] != nil {
+		return result
+	}
+	tools, _ := listing["tools"].([]interface{})
+	advertised, _ := t.rt.catalog(ctx, "")
+	for _, tool := range advertised {
+		if !t.builtin(tool.Name) {
+			tools = append(tools, tool)
+		}
+	}
+	listing["tools"] = tools
+
+	extended, err := json.Marshal(listing)
+	if err != nil {
+		log.Printf("Failed to list aggregated tools: %v", err)
+		return result
+	}
+	return extended
+}
+
+// call routes a standard tools/call request to the backend owning the tool and answers it
+func (t *nativeToolsTransport) call(ctx context.Context, id transport.RequestId, params CallToolRequest) {
+	// The result goes straight back to the host, so relay it without decoding
+	ctx = contextWithPassthrough(contextWithMeta(ctx, params.Meta), t.rt.raw, t.rt.artifacts.limit())
+	result := map[string]interface{}{}
+	resp, err := func() (resp *mcp.ToolResponse, err error) {
+		defer recoverPanic(ctx, "the call to '"+params.Name+"'", &err)
+		return t.rt.call(ctx, params.Name, params.Arguments)
+	}()
+	if err != nil {
+		result["content"] = []*mcp.Content{mcp.NewTextContent(err.Error())}
+		result["isError"] = true
+	} else {
+		result["content"] = contentOf(resp)
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		logf(ctx, "Failed to marshal result of '%s': %v", params.Name, err)
+		return
+	}
+	response := transport.NewBaseMessageResponse(&transport.BaseJSONRPCResponse{Jsonrpc: "2.0", Id: id, Result: encoded})
+	if err := t.Transport.Send(ctx, response); err != nil {
+		logf(ctx, "Failed to send result of '%s': %v", params.Name, err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// byteOrderMark is the BOM some servers put at the start of text they read from files
+const byteOrderMark = "\ufeff"
+
+// TextNormalization repairs the text content of a server's responses before it reaches the host:
+// invalid UTF-8 is replaced, byte order marks are stripped and control characters, such as
+// terminal color codes, are escaped so they show as text
+type TextNormalization struct {
+	// KeepBOM leaves byte order marks at the start of texts
+	KeepBOM bool `json:"KeepBOM,omitempty"`
+	// KeepControlCharacters leaves control characters other than tabs and line breaks as they are
+	KeepControlCharacters bool `json:"KeepControlCharacters,omitempty"`
+}
+
+// apply normalizes the text and embedded text resources of resp in place
+func (n *TextNormalization) apply(resp *mcp.ToolResponse) {
+	if n == nil || resp == nil {
+		return
+	}
+	for _, content := range resp.Content {
+		if content == nil {
+			continue
+		}
+		if content.TextContent != nil {
+			content.TextContent.Text = n.normalize(content.TextContent.Text)
+		}
+		if content.EmbeddedResource != nil && content.EmbeddedResource.TextResourceContents != nil {
+			resource := content.EmbeddedResource.TextResourceContents
+			resource.Text = n.normalize(resource.Text)
+		}
+	}
+}
+
+// normalize returns text as valid UTF-8, without a leading byte order mark and with its control
+// characters escaped, as configured
+func (n *TextNormalization) normalize(text string) string {
+	if !utf8.ValidString(text) {
+		text = strings.ToValidUTF8(text, string(utf8.RuneError))
+	}
+	if !n.KeepBOM {
+		text = strings.TrimPrefix(text, byteOrderMark)
+	}
+	if n.KeepControlCharacters {
+		return text
+	}
+	return escapeControl(text)
+}
+
+// isEscapedControl reports whether r is a control character that is escaped; tabs and line breaks are kept
+func isEscapedControl(r rune) bool {
+	return (r < 0x20 && r != '\t' && r != '\n' && r != '\r') || r == 0x7f
+}
+
+// escapeControl spells out the control characters in text, so "\x1b[31m" becomes the text `\x1b[31m`
+func escapeControl(text string) string {
+	if strings.IndexFunc(text, isEscapedControl) < 0 {
+		return text
+	}
+	var escaped strings.Builder
+	for _, r := range text {
+		if isEscapedControl(r) {
+			fmt.Fprintf(&escaped, `\x%02x`, r)
+			continue
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
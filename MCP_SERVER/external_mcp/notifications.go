@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// defaultNotificationDebounce is how long change notifications wait for the burst they belong to to end
+const defaultNotificationDebounce = 250 * time.Millisecond
+
+// defaultNotificationMaxDelay bounds how long a notification is held back by a burst that never ends
+const defaultNotificationMaxDelay = 2 * time.Second
+
+// NotificationsConfig tunes how change notifications are batched before they reach the host
+type NotificationsConfig struct {
+	// Debounce holds change notifications until none has arrived for this long; defaults to 250ms.
+	// A negative value sends every notification at once.
+	Debounce Duration `json:"Debounce,omitempty"`
+	// MaxDelay sends held notifications after this long even if the burst goes on; defaults to 2s
+	MaxDelay Duration `json:"MaxDelay,omitempty"`
+}
+
+// changeNotifier decorates the downstream transport to debounce the list changed and resource
+// updated notifications sent to the host. A burst, such as a server restarting, is sent once it
+// ends, with each distinct notification sent once, so the host does not re-list over and over.
+type changeNotifier struct {
+	transport.Transport
+	debounce time.Duration
+	maxDelay time.Duration
+
+	mu sync.Mutex
+	// held are the distinct notifications of the burst in the order they first arrived
+	held []*transport.BaseJsonRpcMessage
+	seen map[string]bool
+	// since is when the burst began
+	since time.Time
+	timer *time.Timer
+}
+
+func newChangeNotifier(inner transport.Transport, cfg *NotificationsConfig) *changeNotifier {
+	n := &changeNotifier{
+		Transport: inner,
+		debounce:  defaultNotificationDebounce,
+		maxDelay:  defaultNotificationMaxDelay,
+		seen:      make(map[string]bool),
+	}
+	if cfg != nil {
+		if cfg.Debounce != 0 {
+			n.debounce = time.Duration(cfg.Debounce)
+		}
+		if cfg.MaxDelay > 0 {
+			n.maxDelay = time.Duration(cfg.MaxDelay)
+		}
+	}
+	return n
+}
+
+// coalesced reports whether a message is a change notification held back for its burst
+func coalesced(message *transport.BaseJsonRpcMessage) bool {
+	if message.Type != transport.BaseMessageTypeJSONRPCNotificationType {
+		return false
+	}
+	method := message.JsonRpcNotification.Method
+	return strings.HasSuffix(method, "/list_changed") || method == "notifications/resources/updated"
+}
+
+// Send holds change notifications until their burst ends and sends every other message at once
+func (n *changeNotifier) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	if n.debounce < 0 || !coalesced(message) {
+		return n.Transport.Send(ctx, message)
+	}
+	notification := message.JsonRpcNotification
+	key := notification.Method + " " + string(notification.Params)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.seen[key] {
+		n.seen[key] = true
+		n.held = append(n.held, message)
+	}
+	now := time.Now()
+	if n.timer == nil {
+		n.since = now
+		n.timer = time.AfterFunc(n.debounce, n.flush)
+		return nil
+	}
+	// Wait for the burst to end, but not past the maximum delay
+	wait := n.debounce
+	if remaining := n.since.Add(n.maxDelay).Sub(now); remaining < wait {
+		wait = remaining
+	}
+	n.timer.Reset(wait)
+	return nil
+}
+
+// flush sends the held notifications
+func (n *changeNotifier) flush() {
+	n.mu.Lock()
+	held := n.held
+	n.held, n.seen, n.timer = nil, make(map[string]bool), nil
+	n.mu.Unlock()
+
+	for _, message := range held {
+		if err := n.Transport.Send(context.Background(), message); err != nil {
+			log.Printf("Failed to send %s to the host: %v", message.JsonRpcNotification.Method, err)
+		}
+	}
+}
+
+// relay forwards a server's list changed notifications to the host, re-listing its tools first
+// so the host lists the new ones
+func (n *changeNotifier) relay(b *backend) {
+	if b.upstream == nil {
+		return
+	}
+	forward := func(method string) func(json.RawMessage) {
+		return func(json.RawMessage) {
+			notification := transport.NewBaseMessageNotification(&transport.BaseJSONRPCNotification{Jsonrpc: "2.0", Method: method})
+			if err := n.Send(context.Background(), notification); err != nil {
+				log.Printf("Failed to forward %s from '%s': %v", method, b.name, err)
+			}
+		}
+	}
+	tools := forward("notifications/tools/list_changed")
+	b.upstream.watch("notifications/tools/list_changed", func(params json.RawMessage) {
+		// The client would block reading its own responses if the tools were listed on its reader
+		go func() {
+			if _, err := b.refreshTools(); err != nil {
+				log.Printf("Failed to refresh tools for client '%s': %v", b.name, err)
+			}
+			tools(params)
+		}()
+	})
+	b.upstream.watch("notifications/resources/list_changed", forward("notifications/resources/list_changed"))
+}
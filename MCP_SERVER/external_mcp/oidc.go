@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWKSRefresh = time.Hour
+	// minJWKSRefresh spaces the refreshes triggered by tokens signed with unknown keys
+	minJWKSRefresh   = time.Minute
+	defaultClockSkew = time.Minute
+)
+
+// OIDCConfig accepts the ID and access tokens an OpenID Connect provider issues as bearer tokens,
+// next to the static tokens
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL, which tokens must name and whose discovery document gives the JWKS
+	Issuer string `json:"Issuer"`
+	// Audience must be one of the token's audiences
+	Audience string `json:"Audience"`
+	// JWKSURL overrides the jwks_uri of the discovery document
+	JWKSURL string `json:"JWKSURL,omitempty"`
+	// JWKSRefresh is how often the signing keys are fetched again; defaults to 1h. Tokens signed with an
+	// unknown key also fetch them, at most once a minute.
+	JWKSRefresh Duration `json:"JWKSRefresh,omitempty"`
+	// IdentityClaim names the caller; defaults to sub
+	IdentityClaim string `json:"IdentityClaim,omitempty"`
+	// RolesClaim holds the caller's groups or roles, e.g. "groups" or "realm_access.roles"
+	RolesClaim string `json:"RolesClaim,omitempty"`
+	// RoleMappings maps values of the roles claim to roles; without mappings the values are the roles
+	RoleMappings map[string][]string `json:"RoleMappings,omitempty"`
+	// TenantClaim holds the tenant the caller belongs to
+	TenantClaim string `json:"TenantClaim,omitempty"`
+	// ClockSkew is the leeway given to the expiry and not-before times; defaults to 1m
+	ClockSkew Duration `json:"ClockSkew,omitempty"`
+}
+
+// oidcVerifier validates the tokens of an OIDC provider against its published keys. The keys are
+// fetched on first use, so the aggregator starts while the provider is unreachable.
+type oidcVerifier struct {
+	cfg    OIDCConfig
+	client *http.Client
+	clock  clock
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newOIDCVerifier(cfg *OIDCConfig, clock clock) *oidcVerifier {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		log.Printf("Warning: OIDC needs an Issuer and an Audience; OIDC tokens are rejected")
+	}
+	return &oidcVerifier{cfg: *cfg, client: &http.Client{Timeout: 10 * time.Second}, clock: clock}
+}
+
+// oidcClaims are the registered claims checked on every token, next to all claims by name
+type oidcClaims struct {
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	Expiry    *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	all       map[string]interface{}
+}
+
+// verify returns the identity of a valid token
+func (v *oidcVerifier) verify(token string) (identity, error) {
+	if v.cfg.Issuer == "" || v.cfg.Audience == "" {
+		return identity{}, fmt.Errorf("OIDC is not configured")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return identity{}, fmt.Errorf("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return identity{}, fmt.Errorf("invalid header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return identity{}, fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return identity{}, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return identity{}, err
+	}
+
+	var claims oidcClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return identity{}, fmt.Errorf("invalid claims: %v", err)
+	}
+	if err := decodeSegment(parts[1], &claims.all); err != nil {
+		return identity{}, fmt.Errorf("invalid claims: %v", err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return identity{}, err
+	}
+	return v.identity(claims.all)
+}
+
+// checkClaims checks the issuer, audience and validity period of a token
+func (v *oidcVerifier) checkClaims(claims oidcClaims) error {
+	if strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(v.cfg.Issuer, "/") {
+		return fmt.Errorf("issued by '%s'", claims.Issuer)
+	}
+	var audiences []string
+	var single string
+	if json.Unmarshal(claims.Audience, &single) == nil {
+		audiences = []string{single}
+	} else if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+		return fmt.Errorf("invalid audience")
+	}
+	if !containsString(audiences, v.cfg.Audience) {
+		return fmt.Errorf("not issued for audience '%s'", v.cfg.Audience)
+	}
+	skew := time.Duration(v.cfg.ClockSkew)
+	if skew <= 0 {
+		skew = defaultClockSkew
+	}
+	now := v.clock.Now()
+	if claims.Expiry == nil {
+		return fmt.Errorf("no expiry")
+	}
+	if now.Add(-skew).After(time.Unix(int64(*claims.Expiry), 0)) {
+		return fmt.Errorf("expired")
+	}
+	if claims.NotBefore != nil && now.Add(skew).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return fmt.Errorf("not valid yet")
+	}
+	return nil
+}
+
+// identity maps the claims of a valid token to the caller's identity and roles
+func (v *oidcVerifier) identity(claims map[string]interface{}) (identity, error) {
+	identityClaim := v.cfg.IdentityClaim
+	if identityClaim == "" {
+		identityClaim = "sub"
+	}
+	name, _ := claimValue(claims, identityClaim).(string)
+	if name == "" {
+		return identity{}, fmt.Errorf("no '%s' claim", identityClaim)
+	}
+	id := identity{Name: name}
+	if v.cfg.TenantClaim != "" {
+		id.Tenant, _ = claimValue(claims, v.cfg.TenantClaim).(string)
+	}
+	if v.cfg.RolesClaim == "" {
+		return id, nil
+	}
+	var values []string
+	switch value := claimValue(claims, v.cfg.RolesClaim).(type) {
+	case string:
+		// Some providers put space-separated values in a single string, like the scope claim
+		values = strings.Fields(value)
+	case []interface{}:
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	for _, value := range values {
+		if v.cfg.RoleMappings == nil {
+			id.Roles = append(id.Roles, value)
+			continue
+		}
+		for _, role := range v.cfg.RoleMappings[value] {
+			if !containsString(id.Roles, role) {
+				id.Roles = append(id.Roles, role)
+			}
+		}
+	}
+	return id, nil
+}
+
+// claimValue looks up a claim by a dotted path into nested objects, e.g. "realm_access.roles"
+func claimValue(claims map[string]interface{}, path string) interface{} {
+	// Claim names may contain dots themselves, like the URL-shaped names of namespaced claims
+	if value, ok := claims[path]; ok {
+		return value
+	}
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// key returns the signing key named kid, fetching the keys when they are stale or kid is new to them
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	refresh := time.Duration(v.cfg.JWKSRefresh)
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	age := v.clock.Now().Sub(v.fetched)
+	_, known := v.keys[kid]
+	if v.fetched.IsZero() || age >= refresh || (!known && age >= minJWKSRefresh) {
+		keys, err := v.fetchKeys()
+		// A failed fetch is retried after minJWKSRefresh rather than on every request
+		v.fetched = v.clock.Now()
+		if err != nil && v.keys == nil {
+			return nil, fmt.Errorf("failed to fetch the provider's keys: %v", err)
+		}
+		if err != nil {
+			log.Printf("Failed to refresh the keys of OIDC provider '%s', keeping the previous ones: %v", v.cfg.Issuer, err)
+		} else {
+			v.keys = keys
+		}
+	}
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, nil
+		}
+	}
+	key, ok := v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key '%s'", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys reads the provider's JSON Web Key Set, locating it through the discovery document
+// unless its URL is configured
+func (v *oidcVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	jwksURL := v.cfg.JWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(strings.TrimSuffix(v.cfg.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("the discovery document names no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(jwksURL, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Keys of unsupported types are skipped so the others stay usable
+			log.Printf("Skipping key '%s' of OIDC provider '%s': %v", jwk.Kid, v.cfg.Issuer, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (v *oidcVerifier) getJSON(url string, value interface{}) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+// jsonWebKey is a public key of a JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// N and E are the modulus and exponent of RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// Crv, X and Y are the curve and point of EC and OKP keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("invalid point")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point not on curve %s", k.Crv)
+		}
+		return key, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+	}
+}
+
+// verifySignature checks a JWS signature made with one of the asymmetric algorithms. Symmetric and
+// unsigned tokens are refused, as anyone knowing the audience could forge them.
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var h hash.Hash
+	var hashID crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		h, hashID = sha256.New(), crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		h, hashID = sha512.New(), crypto.SHA512
+	case "EdDSA":
+		if key, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(key, signed, signature) {
+			return nil
+		}
+		return fmt.Errorf("invalid signature")
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		if strings.HasPrefix(alg, "RS") {
+			err = rsa.VerifyPKCS1v15(key, hashID, digest, signature)
+		} else if strings.HasPrefix(alg, "PS") {
+			err = rsa.VerifyPSS(key, hashID, digest, signature, nil)
+		} else {
+			err = fmt.Errorf("%s does not use an RSA key", alg)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		bits := key.Curve.Params().BitSize
+		size := (bits + 7) / 8
+		curves := map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+		if curves[alg] != bits || len(signature) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s does not match the key type", alg)
+	}
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a JWT
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
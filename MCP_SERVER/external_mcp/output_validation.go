@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// OutputExpectation declares what the responses of a tool must look like
+type OutputExpectation struct {
+	// ContentTypes lists the content types the tool may return: "text", "image" or "resource". Empty allows any.
+	ContentTypes []string `json:"ContentTypes,omitempty"`
+	// Schema is a JSON schema the tool's text output, parsed as JSON, must satisfy
+	Schema map[string]interface{} `json:"Schema,omitempty"`
+	// AllowEmpty accepts responses without content, which are otherwise a violation
+	AllowEmpty bool `json:"AllowEmpty,omitempty"`
+	// Repair drops content of unexpected types and replaces an empty response with a text block
+	// explaining it, instead of failing the call. Schema violations always fail the call.
+	Repair bool `json:"Repair,omitempty"`
+}
+
+// outputValidator checks tool responses against their declared expectations. A nil validator accepts everything.
+type outputValidator struct {
+	expectations map[string]OutputExpectation
+	metrics      *metrics
+}
+
+// newOutputValidator returns a validator for the expectations, or nil when none are declared
+func newOutputValidator(expectations map[string]OutputExpectation, metrics *metrics) *outputValidator {
+	if len(expectations) == 0 {
+		return nil
+	}
+	return &outputValidator{expectations: expectations, metrics: metrics}
+}
+
+// expects reports whether responses of the tool are validated. Such responses must be decoded, so
+// they are never relayed raw.
+func (v *outputValidator) expects(name string) bool {
+	if v == nil {
+		return false
+	}
+	_, ok := v.expectations[name]
+	return ok
+}
+
+// check validates a successful response of the tool. It returns the response, repaired if the tool
+// allows it, or an error describing every violation.
+func (v *outputValidator) check(ctx context.Context, name string, resp *mcp.ToolResponse) (*mcp.ToolResponse, error) {
+	if !v.expects(name) {
+		return resp, nil
+	}
+	expectation := v.expectations[name]
+	var content []*mcp.Content
+	if resp != nil {
+		content = resp.Content
+	}
+
+	var violations []string
+	if len(expectation.ContentTypes) > 0 {
+		var kept []*mcp.Content
+		for _, item := range content {
+			if item != nil && !containsString(expectation.ContentTypes, string(item.Type)) {
+				violations = append(violations, fmt.Sprintf("unexpected %s content", item.Type))
+				continue
+			}
+			kept = append(kept, item)
+		}
+		if expectation.Repair {
+			content = kept
+		}
+	}
+	empty := isEmptyContent(content)
+	if empty && !expectation.AllowEmpty {
+		violations = append(violations, "no content")
+	}
+	schemaViolations := 0
+	if expectation.Schema != nil && !empty {
+		var output interface{}
+		if err := json.Unmarshal([]byte(textOf(content)), &output); err != nil {
+			violations = append(violations, "output is not JSON: "+err.Error())
+			schemaViolations++
+		} else {
+			for _, violation := range validateSchema(expectation.Schema, output, "$") {
+				violations = append(violations, violation)
+				schemaViolations++
+			}
+		}
+	}
+	if len(violations) == 0 {
+		return resp, nil
+	}
+
+	v.metrics.addCounter("mcp_output_violations_total", "Tool responses violating their declared output expectations", 1, "tool", name)
+	logf(ctx, "Tool '%s' returned a response violating its expectations: %s", name, strings.Join(violations, "; "))
+	if !expectation.Repair || schemaViolations > 0 {
+		return nil, fmt.Errorf("tool '%s' returned an invalid response: %s", name, strings.Join(violations, "; "))
+	}
+	if isEmptyContent(content) && !expectation.AllowEmpty {
+		content = []*mcp.Content{mcp.NewTextContent(fmt.Sprintf("tool '%s' returned no content", name))}
+	}
+	return mcp.NewToolResponse(content...), nil
+}
+
+// isEmptyContent reports whether content carries nothing: no items, or only blank text
+func isEmptyContent(content []*mcp.Content) bool {
+	for _, item := range content {
+		if item == nil {
+			continue
+		}
+		if item.TextContent == nil || strings.TrimSpace(item.TextContent.Text) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// textOf joins the text items of content
+func textOf(content []*mcp.Content) string {
+	var texts []string
+	for _, item := range content {
+		if item != nil && item.TextContent != nil {
+			texts = append(texts, item.TextContent.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// validateSchema checks value against the commonly used subset of JSON schema: type, enum, const,
+// required, properties, additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// minimum and maximum. It returns a violation per mismatch, located by a path starting at path.
+func validateSchema(schema map[string]interface{}, value interface{}, path string) []string {
+	var violations []string
+	if expected, ok := schema["type"]; ok && !matchesSchemaType(expected, value) {
+		return []string{fmt.Sprintf("%s: expected %v, got %s", path, expected, jsonType(value))}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if jsonEqual(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, fmt.Sprintf("%s: %s is not one of the allowed values", path, compactJSON(value)))
+		}
+	}
+	if constant, ok := schema["const"]; ok && !jsonEqual(constant, value) {
+		violations = append(violations, fmt.Sprintf("%s: expected %s", path, compactJSON(constant)))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, field := range required {
+				if name, ok := field.(string); ok {
+					if _, present := v[name]; !present {
+						violations = append(violations, fmt.Sprintf("%s: missing required property '%s'", path, name))
+					}
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if property, ok := properties[key].(map[string]interface{}); ok {
+				violations = append(violations, validateSchema(property, v[key], path+"."+key)...)
+			} else if allowed, ok := schema["additionalProperties"].(bool); ok && !allowed {
+				violations = append(violations, fmt.Sprintf("%s: unexpected property '%s'", path, key))
+			}
+		}
+	case []interface{}:
+		if minItems, ok := schema["minItems"].(float64); ok && float64(len(v)) < minItems {
+			violations = append(violations, fmt.Sprintf("%s: expected at least %v items, got %d", path, minItems, len(v)))
+		}
+		if maxItems, ok := schema["maxItems"].(float64); ok && float64(len(v)) > maxItems {
+			violations = append(violations, fmt.Sprintf("%s: expected at most %v items, got %d", path, maxItems, len(v)))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				violations = append(violations, validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case string:
+		length := float64(len([]rune(v)))
+		if minLength, ok := schema["minLength"].(float64); ok && length < minLength {
+			violations = append(violations, fmt.Sprintf("%s: expected at least %v characters", path, minLength))
+		}
+		if maxLength, ok := schema["maxLength"].(float64); ok && length > maxLength {
+			violations = append(violations, fmt.Sprintf("%s: expected at most %v characters", path, maxLength))
+		}
+	case float64:
+		if minimum, ok := schema["minimum"].(float64); ok && v < minimum {
+			violations = append(violations, fmt.Sprintf("%s: %v is less than %v", path, v, minimum))
+		}
+		if maximum, ok := schema["maximum"].(float64); ok && v > maximum {
+			violations = append(violations, fmt.Sprintf("%s: %v is greater than %v", path, v, maximum))
+		}
+	}
+	return violations
+}
+
+// matchesSchemaType reports whether value has the schema type, or one of the types when a list is given
+func matchesSchemaType(expected interface{}, value interface{}) bool {
+	if types, ok := expected.([]interface{}); ok {
+		for _, t := range types {
+			if matchesSchemaType(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+	actual := jsonType(value)
+	switch expected {
+	case actual:
+		return true
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	}
+	return false
+}
+
+// jsonType names the JSON schema type of a decoded JSON value
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func jsonEqual(a, b interface{}) bool {
+	return compactJSON(a) == compactJSON(b)
+}
+
+func compactJSON(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
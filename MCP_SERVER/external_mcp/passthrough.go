@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	mcp "github.com/metoro-io/mcp-golang"
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// passthroughMarker prefixes the placeholder text that stands in for a relayed raw result
+const passthroughMarker = "mcp-passthrough:"
+
+// maxPlaceholderSize bounds the encoded results that are inspected for a placeholder
+const maxPlaceholderSize = 256
+
+// rawResults holds upstream tool results that are relayed downstream byte for byte instead of being
+// decoded and re-encoded. The router returns a placeholder response for such a call, and the
+// downstream transport swaps the raw result back in when the response is sent.
+type rawResults struct {
+	mu      sync.Mutex
+	results map[string]json.RawMessage
+}
+
+func newRawResults() *rawResults {
+	return &rawResults{results: make(map[string]json.RawMessage)}
+}
+
+type passthroughKey struct{}
+
+// passthroughRequest marks a call whose result goes straight back to the host
+type passthroughRequest struct {
+	results *rawResults
+	maxSize int
+}
+
+// contextWithPassthrough marks ctx so that a successful upstream result of at most maxSize bytes
+// (0 for any size) is relayed without decoding
+func contextWithPassthrough(ctx context.Context, results *rawResults, maxSize int) context.Context {
+	if results == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, passthroughKey{}, passthroughRequest{results: results, maxSize: maxSize})
+}
+
+// withoutPassthrough returns a copy of ctx whose call result is always decoded
+func withoutPassthrough(ctx context.Context) context.Context {
+	return context.WithValue(ctx, passthroughKey{}, nil)
+}
+
+// placeholder stores raw and returns the response standing in for it
+func (r *rawResults) placeholder(raw json.RawMessage) *mcp.ToolResponse {
+	id, err := randomID()
+	if err != nil {
+		log.Printf("Failed to relay raw result: %v", err)
+		return mcp.NewToolResponse(mcp.NewTextContent("failed to relay result"))
+	}
+
+	r.mu.Lock()
+	r.results[id] = raw
+	r.mu.Unlock()
+	return mcp.NewToolResponse(mcp.NewTextContent(passthroughMarker + id))
+}
+
+// take returns and forgets the raw result a placeholder result refers to
+func (r *rawResults) take(result json.RawMessage) (json.RawMessage, bool) {
+	if len(result) > maxPlaceholderSize || !bytes.Contains(result, []byte(passthroughMarker)) {
+		return nil, false
+	}
+
+	var placeholder mcp.ToolResponse
+	if err := json.Unmarshal(result, &placeholder); err != nil || len(placeholder.Content) != 1 || placeholder.Content[0].TextContent == nil {
+		return nil, false
+	}
+	id, ok := bytes.CutPrefix([]byte(placeholder.Content[0].TextContent.Text), []byte(passthroughMarker))
+	if !ok {
+		return nil, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	raw, ok := r.results[string(id)]
+	delete(r.results, string(id))
+	return raw, ok
+}
+
+// passthroughTransport swaps placeholders in outgoing responses for the raw results they refer to
+type passthroughTransport struct {
+	transport.Transport
+	results *rawResults
+}
+
+// Send relays raw results in place of their placeholders
+func (t *passthroughTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	if message.Type == transport.BaseMessageTypeJSONRPCResponseType {
+		if raw, ok := t.results.take(message.JsonRpcResponse.Result); ok {
+			message.JsonRpcResponse.Result = raw
+		}
+	}
+	return t.Transport.Send(ctx, message)
+}
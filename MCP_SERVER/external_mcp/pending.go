@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// pendingIDBase keeps the ids of the proxy's own requests clear of those of the library's client and
+// server sharing the transport, which count up from zero
+const pendingIDBase transport.RequestId = 1 << 40
+
+// pendingRequests sends requests of the proxy's own over a transport the library also uses, and
+// picks their responses out of the incoming messages
+type pendingRequests struct {
+	mu      sync.Mutex
+	nextID  transport.RequestId
+	pending map[transport.RequestId]chan *transport.BaseJsonRpcMessage
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{nextID: pendingIDBase, pending: make(map[transport.RequestId]chan *transport.BaseJsonRpcMessage)}
+}
+
+// send sends a request over tr and waits for its result until ctx is done. A JSON-RPC error response
+// is returned as an error with its message.
+func (p *pendingRequests) send(ctx context.Context, tr transport.Transport, method string, params json.RawMessage) (json.RawMessage, error) {
+	answer := make(chan *transport.BaseJsonRpcMessage, 1)
+	p.mu.Lock()
+	id := p.nextID
+	p.nextID++
+	p.pending[id] = answer
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}()
+
+	request := transport.NewBaseMessageRequest(&transport.BaseJSONRPCRequest{Jsonrpc: "2.0", Id: id, Method: method, Params: params})
+	if err := tr.Send(ctx, request); err != nil {
+		return nil, err
+	}
+	select {
+	case message := <-answer:
+		if message.Type == transport.BaseMessageTypeJSONRPCErrorType {
+			return nil, &rpcError{message.JsonRpcError.Error}
+		}
+		return message.JsonRpcResponse.Result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// rpcError is the error response to a request of the proxy's own
+type rpcError struct {
+	transport.BaseJSONRPCErrorInner
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// unsupported reports whether a request failed because the other party does not implement its
+// method. Servers built on the Go library report it without the JSON-RPC code.
+func unsupported(err error) bool {
+	var rpcErr *rpcError
+	return errors.As(err, &rpcErr) && (rpcErr.Code == -32601 || strings.HasPrefix(rpcErr.Message, "method not found"))
+}
+
+// answer delivers a response to a request in flight, reporting whether the message was one
+func (p *pendingRequests) answer(message *transport.BaseJsonRpcMessage) bool {
+	var id transport.RequestId
+	switch message.Type {
+	case transport.BaseMessageTypeJSONRPCResponseType:
+		id = message.JsonRpcResponse.Id
+	case transport.BaseMessageTypeJSONRPCErrorType:
+		id = message.JsonRpcError.Id
+	default:
+		return false
+	}
+	p.mu.Lock()
+	answer, ok := p.pending[id]
+	delete(p.pending, id)
+	p.mu.Unlock()
+	if ok {
+		answer <- message
+	}
+	return ok
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// PolicyConfig delegates call authorization to an Open Policy Agent, so security policy lives in
+// one rego bundle instead of allowlists spread across the config
+type PolicyConfig struct {
+	// URL is the OPA decision endpoint, e.g. http://opa:8181/v1/data/mcp/decision. The rule returns
+	// true or false, or an object with "decision" ("allow", "deny" or "approve") and "reason".
+	URL     string            `json:"URL"`
+	Headers map[string]string `json:"Headers,omitempty"`
+	// Timeout bounds a policy query; defaults to 5s. Calls are denied when OPA cannot be queried.
+	Timeout Duration `json:"Timeout,omitempty"`
+	// ApprovalTimeout is how long a call needing approval waits for an operator before it is denied; defaults to 5m
+	ApprovalTimeout Duration `json:"ApprovalTimeout,omitempty"`
+}
+
+// policyInput is the input document a policy is evaluated against
+type policyInput struct {
+	Identity      string      `json:"identity"`
+	Roles         []string    `json:"roles"`
+	Tenant        string      `json:"tenant,omitempty"`
+	Tool          string      `json:"tool"`
+	Arguments     interface{} `json:"arguments"`
+	Time          time.Time   `json:"time"`
+	CorrelationID string      `json:"correlationId,omitempty"`
+}
+
+// policyDecision is the outcome of a policy query
+type policyDecision struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// policyEngine queries OPA for every call. A nil engine allows everything.
+type policyEngine struct {
+	cfg             PolicyConfig
+	client          *http.Client
+	approvalTimeout time.Duration
+	// approvalQueue holds the calls the policy wants an operator to approve
+	*approvalQueue
+}
+
+// newPolicyEngine returns an engine for cfg holding calls for approval in approvals, or nil when no policy is configured
+func newPolicyEngine(cfg *PolicyConfig, approvals *approvalQueue) (*policyEngine, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("policy requires a URL")
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	approvalTimeout := time.Duration(cfg.ApprovalTimeout)
+	if approvalTimeout <= 0 {
+		approvalTimeout = 5 * time.Minute
+	}
+	return &policyEngine{
+		cfg:             *cfg,
+		client:          &http.Client{Timeout: timeout},
+		approvalTimeout: approvalTimeout,
+		approvalQueue:   approvals,
+	}, nil
+}
+
+// authorize evaluates the policy for a call and returns a permission-denied error unless it is
+// allowed. Calls needing approval wait until an operator decides through the admin endpoint.
+func (p *policyEngine) authorize(ctx context.Context, tool string, arguments interface{}) error {
+	if p == nil {
+		return nil
+	}
+	caller := identityFromContext(ctx)
+	input := policyInput{
+		Identity:      caller.Name,
+		Roles:         caller.Roles,
+		Tenant:        caller.Tenant,
+		Tool:          tool,
+		Arguments:     arguments,
+		Time:          time.Now().UTC(),
+		CorrelationID: correlationIDFromContext(ctx),
+	}
+	decision, err := p.query(ctx, input)
+	if err != nil {
+		logf(ctx, "Policy query for '%s' by '%s' failed, denying: %v", tool, caller.Name, err)
+		return fmt.Errorf("permission denied: policy could not be evaluated")
+	}
+	logf(ctx, "Policy decision for '%s' by '%s': %s %s", tool, caller.Name, decision.Decision, decision.Reason)
+
+	switch decision.Decision {
+	case "allow":
+		return nil
+	case "approve":
+		return p.await(ctx, input, decision.Reason, p.approvalTimeout)
+	}
+	if decision.Reason != "" {
+		return fmt.Errorf("permission denied by policy: %s", decision.Reason)
+	}
+	return fmt.Errorf("permission denied by policy")
+}
+
+// query asks OPA for the decision on input
+func (p *policyEngine) query(ctx context.Context, input policyInput) (policyDecision, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return policyDecision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return policyDecision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range p.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return policyDecision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return policyDecision{}, fmt.Errorf("OPA returned %s", resp.Status)
+	}
+
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return policyDecision{}, err
+	}
+	// An undefined rule has no result, which denies
+	var allowed bool
+	if len(result.Result) == 0 {
+		return policyDecision{Decision: "deny", Reason: "no policy decision"}, nil
+	}
+	if err := json.Unmarshal(result.Result, &allowed); err == nil {
+		if allowed {
+			return policyDecision{Decision: "allow"}, nil
+		}
+		return policyDecision{Decision: "deny"}, nil
+	}
+	var decision policyDecision
+	if err := json.Unmarshal(result.Result, &decision); err != nil {
+		return policyDecision{}, fmt.Errorf("unexpected policy result %s", result.Result)
+	}
+	switch decision.Decision {
+	case "allow", "deny", "approve":
+		return decision, nil
+	}
+	return policyDecision{}, fmt.Errorf("unknown policy decision '%s'", decision.Decision)
+}
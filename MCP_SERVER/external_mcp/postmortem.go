@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPostmortemLogLines is how many recent log lines a bundle holds when none is configured
+	defaultPostmortemLogLines = 1000
+	// postmortemCrashInterval is the least time between bundles written for crashed backends, so a
+	// backend crashing in a loop does not fill the disk
+	postmortemCrashInterval = time.Minute
+)
+
+// postmortemSecretFields are config keys, matched as substrings ignoring case, whose values are
+// redacted from bundles; every value of Env and Headers is redacted too
+var postmortemSecretFields = []string{"token", "secret", "password", "key", "authorization", "credential"}
+
+// PostmortemConfig writes a postmortem bundle, holding the recent logs, the routing table, the
+// config with its secrets redacted and a goroutine dump, when the aggregator panics or a backend
+// crashes, so bug reports against the aggregator can be acted on
+type PostmortemConfig struct {
+	// Dir is the directory bundles are written to, one subdirectory each
+	Dir string `json:"Dir"`
+	// LogLines is how many recent log lines a bundle holds; defaults to 1000
+	LogLines int `json:"LogLines,omitempty"`
+}
+
+// postmortem keeps the recent logs and writes postmortem bundles. A nil value writes nothing.
+type postmortem struct {
+	cfg      PostmortemConfig
+	registry *backendRegistry
+
+	mu sync.Mutex
+	// lines holds the recent log lines in a ring starting at next once full
+	lines     []string
+	next      int
+	lastCrash time.Time
+}
+
+// newPostmortem returns the bundle writer for cfg, or nil when no bundles are configured
+func newPostmortem(cfg *PostmortemConfig) (*postmortem, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("postmortem bundles need a Dir")
+	}
+	p := &postmortem{cfg: *cfg}
+	if p.cfg.LogLines <= 0 {
+		p.cfg.LogLines = defaultPostmortemLogLines
+	}
+	return p, nil
+}
+
+// Write keeps a log line for the next bundle
+func (p *postmortem) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	line := string(data)
+	if len(p.lines) < p.cfg.LogLines {
+		p.lines = append(p.lines, line)
+	} else {
+		p.lines[p.next] = line
+		p.next = (p.next + 1) % len(p.lines)
+	}
+	return len(data), nil
+}
+
+// recentLogs returns the kept log lines, oldest first
+func (p *postmortem) recentLogs() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var logs strings.Builder
+	for i := range p.lines {
+		logs.WriteString(p.lines[(p.next+i)%len(p.lines)])
+	}
+	return logs.String()
+}
+
+// recoverPanic writes a bundle for a panic in progress and panics again, so the process still
+// crashes with its usual trace. It must be deferred directly.
+func (p *postmortem) recoverPanic() {
+	if p == nil {
+		return
+	}
+	if value := recover(); value != nil {
+		p.report(fmt.Sprintf("panic: %v\n\n%s", value, debug.Stack()))
+		panic(value)
+	}
+}
+
+// watch writes a bundle once the backend's process exits while it is still in service; a backend
+// no longer registered when it exits was stopped on purpose
+func (p *postmortem) watch(b *backend) {
+	if p == nil || b.exited == nil {
+		return
+	}
+	<-b.exited
+	if p.registry.named(b.name) != b {
+		return
+	}
+	p.mu.Lock()
+	if time.Since(p.lastCrash) < postmortemCrashInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.lastCrash = time.Now()
+	p.mu.Unlock()
+	p.report(fmt.Sprintf("backend '%s' exited unexpectedly", b.name))
+}
+
+// report writes a bundle and logs where it is
+func (p *postmortem) report(reason string) {
+	dir, err := p.write(reason, time.Now())
+	if err != nil {
+		log.Printf("Failed to write postmortem bundle: %v", err)
+		return
+	}
+	log.Printf("Wrote postmortem bundle to %s", dir)
+}
+
+// write writes a bundle for the reason to a new subdirectory of Dir and returns its path
+func (p *postmortem) write(reason string, now time.Time) (string, error) {
+	if err := os.MkdirAll(p.cfg.Dir, 0o700); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(p.cfg.Dir, "postmortem-"+now.UTC().Format("20060102T150405Z")+"-")
+	if err != nil {
+		return "", err
+	}
+
+	routes, err := json.MarshalIndent(p.routes(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	config, err := json.MarshalIndent(redactConfig(p.config()), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	files := map[string][]byte{
+		"reason.txt":  []byte(fmt.Sprintf("%s\n\nat %s, pid %d\n", reason, now.UTC().Format(time.RFC3339), os.Getpid())),
+		"logs.txt":    []byte(p.recentLogs()),
+		"routes.json": routes,
+		"config.json": config,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			return "", err
+		}
+	}
+
+	goroutines, err := os.OpenFile(filepath.Join(dir, "goroutines.txt"), os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer goroutines.Close()
+	if err := pprof.Lookup("goroutine").WriteTo(goroutines, 2); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// postmortemRoutes is the routing table in a bundle
+type postmortemRoutes struct {
+	Backends []backendStatus `json:"backends"`
+	// Tools maps each tool to the backend its calls are routed to
+	Tools map[string]string `json:"tools"`
+}
+
+// routes returns the servers' states and which backend each tool is routed to
+func (p *postmortem) routes() postmortemRoutes {
+	routes := postmortemRoutes{Tools: make(map[string]string)}
+	if p.registry == nil {
+		return routes
+	}
+	routes.Backends = p.registry.status()
+	routes.Tools = p.registry.routes()
+	return routes
+}
+
+// config returns the config applied last
+func (p *postmortem) config() Config {
+	if p.registry == nil {
+		return Config{}
+	}
+	p.registry.mu.RLock()
+	defer p.registry.mu.RUnlock()
+	return p.registry.config
+}
+
+// redactConfig returns the config as JSON values with its secrets replaced
+func redactConfig(cfg Config) interface{} {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil
+	}
+	return redactSecrets(decoded)
+}
+
+func redactSecrets(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			switch {
+			case isSecretField(key):
+				v[key] = "[REDACTED]"
+			case key == "Env" || key == "Headers":
+				if values, ok := field.(map[string]interface{}); ok {
+					for name := range values {
+						values[name] = "[REDACTED]"
+					}
+				}
+			default:
+				v[key] = redactSecrets(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactSecrets(item)
+		}
+	}
+	return value
+}
+
+// isSecretField reports whether a config key names a secret
+func isSecretField(key string) bool {
+	key = strings.ToLower(key)
+	for _, field := range postmortemSecretFields {
+		if strings.Contains(key, field) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+)
+
+// Preflight checks of a remote server, in the order they run
+const (
+	preflightDNS        = "dns"
+	preflightConnect    = "connect"
+	preflightTLS        = "tls"
+	preflightInitialize = "initialize"
+)
+
+// preflightError says which preflight check a remote server failed and why
+type preflightError struct {
+	check string
+	err   error
+}
+
+func (e *preflightError) Error() string {
+	return e.check + ": " + e.err.Error()
+}
+
+func (e *preflightError) Unwrap() error {
+	return e.err
+}
+
+// preflightRemote checks that the remote server at config.URL can be reached before a client is
+// connected to it: its host, or the proxy it is reached through, resolves and accepts a connection,
+// and for https and wss its certificate verifies. Initializing the client is the last check.
+func preflightRemote(ctx context.Context, config MCPStdIOConfig) error {
+	target, err := url.Parse(config.URL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	network, err := newUpstreamNetwork(config.Network)
+	if err != nil {
+		return fmt.Errorf("invalid network: %v", err)
+	}
+	// Through a proxy, the proxy resolves the server's host
+	hop, via := target, ""
+	proxy, err := network.proxyFor(target)
+	if err != nil {
+		return &preflightError{preflightDNS, fmt.Errorf("failed to select a proxy: %v", err)}
+	}
+	if proxy != nil {
+		hop, via = proxy, " (proxy)"
+	}
+	if net.ParseIP(hop.Hostname()) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, hop.Hostname()); err != nil {
+			return &preflightError{preflightDNS, fmt.Errorf("cannot resolve '%s'%s: %v", hop.Hostname(), via, err)}
+		}
+	}
+
+	conn, err := network.dial(ctx, target)
+	if err != nil {
+		return &preflightError{preflightConnect, fmt.Errorf("cannot connect to %s: %v", target.Host, err)}
+	}
+	defer conn.Close()
+	if target.Scheme == "https" || target.Scheme == "wss" {
+		tlsConn := tls.Client(conn, network.tlsConfig(target.Hostname()))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return &preflightError{preflightTLS, fmt.Errorf("cannot verify %s: %v", target.Hostname(), err)}
+		}
+	}
+	return nil
+}
+
+// markUnreachable records why the named remote server failed its preflight, until it is started
+func (r *backendRegistry) markUnreachable(name string, err error) {
+	log.Printf("Remote client '%s' failed its preflight, %v", name, err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.unreachable == nil {
+		r.unreachable = make(map[string]string)
+	}
+	r.unreachable[name] = err.Error()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Defaults for synthetic probes
+const (
+	defaultProbeInterval = time.Minute
+	defaultProbeTimeout  = 30 * time.Second
+)
+
+// ProbeConfig calls a tool with safe arguments on a schedule and checks its result, so an upstream
+// that breaks silently is caught before users run into it. A failing probe marks the backend owning
+// the tool degraded until the probe passes again.
+type ProbeConfig struct {
+	Name      string                 `json:"Name"`
+	Tool      string                 `json:"Tool"`
+	Arguments map[string]interface{} `json:"Arguments,omitempty"`
+	// Interval is the time between probes; defaults to 1m
+	Interval Duration `json:"Interval,omitempty"`
+	// Timeout bounds a probe call; defaults to 30s
+	Timeout Duration `json:"Timeout,omitempty"`
+	// Expect is text the result must contain
+	Expect string `json:"Expect,omitempty"`
+	// Schema is a JSON schema the result's text, parsed as JSON, must satisfy
+	Schema map[string]interface{} `json:"Schema,omitempty"`
+	// Failures is how many probes in a row must fail before the backend is marked degraded; defaults to 1
+	Failures int `json:"Failures,omitempty"`
+}
+
+// startProbes validates the probes and runs each in the background
+func startProbes(rt *router, probes []ProbeConfig) error {
+	for _, probe := range probes {
+		if probe.Name == "" || probe.Tool == "" {
+			return fmt.Errorf("probes need a Name and a Tool")
+		}
+		if probe.Interval <= 0 {
+			probe.Interval = Duration(defaultProbeInterval)
+		}
+		if probe.Timeout <= 0 {
+			probe.Timeout = Duration(defaultProbeTimeout)
+		}
+		if probe.Failures <= 0 {
+			probe.Failures = 1
+		}
+		log.Printf("Probing '%s' every %s", probe.Tool, time.Duration(probe.Interval))
+		go runProbe(rt, probe)
+	}
+	return nil
+}
+
+// runProbe probes the tool every interval, marking its backend degraded after enough failures in a row
+func runProbe(rt *router, probe ProbeConfig) {
+	failures := 0
+	ticker := time.NewTicker(time.Duration(probe.Interval))
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		backend, err := checkProbe(rt, probe)
+		outcome := "success"
+		if err != nil {
+			outcome = "failure"
+			failures++
+			log.Printf("Probe '%s' failed (%d in a row): %v", probe.Name, failures, err)
+			rt.metrics.addCounter("mcp_probe_failures_total", "Synthetic probes that failed", 1, "probe", probe.Name, "backend", backend)
+		} else {
+			failures = 0
+		}
+		rt.metrics.addCounter("mcp_probes_total", "Synthetic probes run by outcome", 1, "probe", probe.Name, "outcome", outcome)
+		up := 1.0
+		if failures >= probe.Failures {
+			up = 0
+		}
+		rt.metrics.setGauge("mcp_probe_up", "Whether a synthetic probe passes", up, "probe", probe.Name)
+		if backend == "" {
+			continue
+		}
+		reason := ""
+		if failures >= probe.Failures {
+			reason = err.Error()
+		}
+		rt.registry.setProbe(backend, probe.Name, reason)
+	}
+}
+
+// checkProbe calls the probe's tool and checks the result, returning the backend owning the tool
+func checkProbe(rt *router, probe ProbeConfig) (string, error) {
+	backend := ""
+	if owner := rt.registry.owner(probe.Tool); owner != nil {
+		backend = owner.name
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(probe.Timeout))
+	defer cancel()
+	ctx = contextWithIdentity(ctx, identity{Name: "probe:" + probe.Name})
+	arguments := probe.Arguments
+	if arguments == nil {
+		arguments = map[string]interface{}{}
+	}
+	resp, err := rt.call(ctx, probe.Tool, arguments)
+	if err != nil {
+		return backend, err
+	}
+
+	text := responseText(resp)
+	if probe.Expect != "" && !strings.Contains(text, probe.Expect) {
+		return backend, fmt.Errorf("the result does not contain %q", probe.Expect)
+	}
+	if probe.Schema != nil {
+		var value interface{}
+		if err := json.Unmarshal([]byte(text), &value); err != nil {
+			return backend, fmt.Errorf("the result is not JSON: %v", err)
+		}
+		if violations := validateSchema(probe.Schema, value, "$"); len(violations) > 0 {
+			return backend, fmt.Errorf("the result violates the schema: %s", strings.Join(violations, "; "))
+		}
+	}
+	return backend, nil
+}
+
+// setProbe records the outcome of a probe of the named backend: a reason marks it degraded by the
+// probe, and an empty reason clears the mark
+func (r *backendRegistry) setProbe(name, probe, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reason == "" {
+		delete(r.degraded[name], probe)
+		return
+	}
+	if r.degraded == nil {
+		r.degraded = make(map[string]map[string]string)
+	}
+	if r.degraded[name] == nil {
+		r.degraded[name] = make(map[string]string)
+	}
+	r.degraded[name][probe] = reason
+}
+
+// degradedLocked returns why the probes failing on the named backend failed, ordered by probe, while
+// the caller holds mu
+func (r *backendRegistry) degradedLocked(name string) []string {
+	var reasons []string
+	for probe, reason := range r.degraded[name] {
+		reasons = append(reasons, probe+": "+reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Profile represents a named selection of servers, e.g. "dev", "prod" or "minimal", along with the
+// policies that apply while it is selected
+type Profile struct {
+	Servers []string `json:"Servers"`
+	// Policy replaces the config's Policy while the profile is selected
+	Policy *PolicyConfig `json:"Policy,omitempty"`
+	// StrictRouting replaces the config's StrictRouting while the profile is selected
+	StrictRouting *bool `json:"StrictRouting,omitempty"`
+}
+
+// applyProfile narrows the configured servers down to those selected by the named profile and
+// applies the policies it overrides. An empty name falls back to the config's DefaultProfile, and
+// no profile at all keeps every server.
+func applyProfile(cfg Config, name string) (Config, error) {
+	if name == "" {
+		name = cfg.DefaultProfile
+	}
+	if name == "" {
+		return cfg, nil
+	}
+
+	profile, ok := cfg.Profiles[name]
+	if !ok {
+		return cfg, fmt.Errorf("profile '%s' is not defined", name)
+	}
+
+	servers := make(map[string]MCPStdIOConfig, len(profile.Servers))
+	for _, server := range profile.Servers {
+		serverCfg, ok := cfg.MCPStdIOServers[server]
+		if _, skipped := cfg.skipped[server]; skipped {
+			continue
+		}
+		if !ok {
+			return cfg, fmt.Errorf("profile '%s' references unknown server '%s'", name, server)
+		}
+		servers[server] = serverCfg
+	}
+	cfg.MCPStdIOServers = servers
+	if profile.Policy != nil {
+		cfg.Policy = profile.Policy
+	}
+	if profile.StrictRouting != nil {
+		cfg.StrictRouting = *profile.StrictRouting
+	}
+
+	log.Printf("Using profile '%s' with %d servers", name, len(servers))
+	return cfg, nil
+}
+
+// profilePolicies reports whether any profile overrides the Policy
+func (c Config) profilePolicies() bool {
+	for _, profile := range c.Profiles {
+		if profile.Policy != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// profileHeader must be set on requests switching the profile. Cross-site forms cannot set custom
+// headers, so a page open in an operator's browser cannot switch it through the admin listener.
+const profileHeader = "X-MCP-Profile"
+
+// profileSwitch reloads the config with the selected profile, on a config reload or when an operator
+// switches to another profile through the admin API. Once it has reloaded, the policies of the
+// profile replace those the router started with. A nil switch keeps the profile selected at startup.
+type profileSwitch struct {
+	location  string
+	registry  *backendRegistry
+	approvals *approvalQueue
+	// switching serializes loading and applying configs, so a config loaded for one profile is
+	// never applied after another was switched to
+	switching sync.Mutex
+
+	mu       sync.RWMutex
+	name     string
+	policy   *policyEngine
+	strict   bool
+	reloaded bool
+}
+
+// newProfileSwitch returns a switch reloading the config at location, starting from the named profile
+func newProfileSwitch(location, name string, registry *backendRegistry, approvals *approvalQueue) *profileSwitch {
+	return &profileSwitch{location: location, name: name, registry: registry, approvals: approvals}
+}
+
+// current returns the name of the selected profile, empty for the config's DefaultProfile
+func (s *profileSwitch) current() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.name
+}
+
+// reload re-reads the config and applies it with the selected profile
+func (s *profileSwitch) reload() error {
+	return s.use(s.current())
+}
+
+// use re-reads the config and applies it with the named profile
+func (s *profileSwitch) use(name string) error {
+	s.switching.Lock()
+	defer s.switching.Unlock()
+	cfg, err := loadProfileConfig(s.location, name)
+	if err != nil {
+		s.registry.recordReload(fmt.Errorf("invalid config: %v", err))
+		return err
+	}
+	return s.applyLocked(name, cfg)
+}
+
+// apply applies cfg, loaded with the named profile, unless another profile was switched to since
+func (s *profileSwitch) apply(name string, cfg Config) error {
+	s.switching.Lock()
+	defer s.switching.Unlock()
+	if name != s.current() {
+		return nil
+	}
+	return s.applyLocked(name, cfg)
+}
+
+// applyLocked applies cfg with the policies of the named profile while the caller holds switching,
+// through the registry's reload so a profile whose servers fail to start leaves the previous one
+// selected
+func (s *profileSwitch) applyLocked(name string, cfg Config) error {
+	policy, err := newPolicyEngine(cfg.Policy, s.approvals)
+	if err != nil {
+		s.registry.recordReload(fmt.Errorf("invalid policy: %v", err))
+		return err
+	}
+	if err := s.registry.reload(cfg); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.name, s.policy, s.strict, s.reloaded = name, policy, cfg.StrictRouting, true
+	s.mu.Unlock()
+	return nil
+}
+
+// policies returns the policy engine and strict routing of the selected profile, and false until
+// the switch has reloaded the config
+func (s *profileSwitch) policies() (*policyEngine, bool, bool) {
+	if s == nil {
+		return nil, false, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.policy, s.strict, s.reloaded
+}
+
+// profileStatus is the selected profile and the ones that can be switched to
+type profileStatus struct {
+	Profile  string   `json:"profile"`
+	Profiles []string `json:"profiles"`
+}
+
+// ServeHTTP reports the selected profile on GET /profile and switches to the profile named by the
+// name query parameter on POST /profile
+func (s *profileSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		cfg := s.registry.applied()
+		status := profileStatus{Profile: s.current(), Profiles: make([]string, 0, len(cfg.Profiles))}
+		if status.Profile == "" {
+			status.Profile = cfg.DefaultProfile
+		}
+		for name := range cfg.Profiles {
+			status.Profiles = append(status.Profiles, name)
+		}
+		sort.Strings(status.Profiles)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	case http.MethodPost:
+		if r.Header.Get(profileHeader) == "" {
+			http.Error(w, "profile switches must set the "+profileHeader+" header", http.StatusForbidden)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "a profile name is required", http.StatusBadRequest)
+			return
+		}
+		if err := s.use(name); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Switched to profile '%s'", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// quotaFlushInterval is how often changed usage is written to the quota file
+const quotaFlushInterval = 5 * time.Second
+
+// QuotaConfig accounts the tool calls of each authenticated identity against monthly quotas
+type QuotaConfig struct {
+	// File persists usage across restarts; empty keeps it in memory
+	File string `json:"File,omitempty"`
+	// Weights is the cost of a call to the tools matching each pattern, e.g. {"browser_*": 10};
+	// the most specific matching pattern wins and calls to other tools cost 1
+	Weights map[string]float64 `json:"Weights,omitempty"`
+	// Monthly is the cost each identity may spend per calendar month (UTC), by identity name;
+	// "*" applies to identities not listed, and identities without a quota are unlimited
+	Monthly map[string]float64 `json:"Monthly,omitempty"`
+}
+
+// quotaUsage is what an identity spent in a month
+type quotaUsage struct {
+	Calls map[string]int `json:"calls"`
+	Cost  float64        `json:"cost"`
+}
+
+// quotaTracker charges calls to their caller's monthly usage. A nil tracker charges nothing.
+type quotaTracker struct {
+	cfg QuotaConfig
+	now func() time.Time
+	// shared holds the usage of the instances of a cluster, which the limits apply to
+	shared *cluster
+
+	mu sync.Mutex
+	// months maps "2006-01" to the usage of each identity in that month
+	months map[string]map[string]*quotaUsage
+	dirty  bool
+	done   chan struct{}
+	closed sync.WaitGroup
+}
+
+// openQuotaTracker returns a tracker for cfg, loading earlier usage from its file, or nil when no quotas are configured
+func openQuotaTracker(cfg *QuotaConfig) (*quotaTracker, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	q := &quotaTracker{
+		cfg:    *cfg,
+		now:    time.Now,
+		months: make(map[string]map[string]*quotaUsage),
+		done:   make(chan struct{}),
+	}
+	if cfg.File != "" {
+		data, err := os.ReadFile(cfg.File)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &q.months); err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %v", cfg.File, err)
+			}
+		}
+		q.closed.Add(1)
+		go q.run()
+	}
+	return q, nil
+}
+
+// weight returns the cost of one call to the named tool
+func (q *quotaTracker) weight(tool string) float64 {
+	if weight, ok := q.cfg.Weights[tool]; ok {
+		return weight
+	}
+	best, weight := -1, 1.0
+	for pattern, w := range q.cfg.Weights {
+		if matched, _ := path.Match(pattern, tool); matched && len(pattern) > best {
+			best, weight = len(pattern), w
+		}
+	}
+	return weight
+}
+
+// limit returns the monthly quota of the identity, and false when it is unlimited
+func (q *quotaTracker) limit(identity string) (float64, bool) {
+	if limit, ok := q.cfg.Monthly[identity]; ok {
+		return limit, true
+	}
+	limit, ok := q.cfg.Monthly["*"]
+	return limit, ok
+}
+
+// charge charges a call to the tool to the identity's usage this month, or returns a quota-exceeded
+// error when the call would take the identity over its quota. Calls are charged when they are
+// forwarded, whatever their outcome; the returned refund takes back the charge of a call refused
+// by a later check.
+func (q *quotaTracker) charge(identity, tool string) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	cost := q.weight(tool)
+	month := q.now().UTC().Format("2006-01")
+	limit, limited := q.limit(identity)
+	var shared bool
+	if q.shared != nil {
+		charged, err := q.shared.spend(month, identity, cost, limit, limited)
+		if err != nil {
+			return nil, err
+		}
+		// The usage kept here is only this instance's share, which the limit does not apply to
+		limited = limited && !charged
+		shared = charged
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := q.months[month][identity]
+	spent := 0.0
+	if usage != nil {
+		spent = usage.Cost
+	}
+	if limited && spent+cost > limit {
+		return nil, fmt.Errorf("quota exceeded: '%s' has used %g of its monthly quota of %g", identity, spent, limit)
+	}
+	if usage == nil {
+		if q.months[month] == nil {
+			q.months[month] = make(map[string]*quotaUsage)
+		}
+		usage = &quotaUsage{Calls: make(map[string]int)}
+		q.months[month][identity] = usage
+	}
+	usage.Calls[tool]++
+	usage.Cost += cost
+	q.dirty = true
+	return func() { q.refund(month, identity, tool, cost, shared) }, nil
+}
+
+// refund takes back a charge of cost for a call to the tool, also from the cluster's usage if it was shared
+func (q *quotaTracker) refund(month, identity, tool string, cost float64, shared bool) {
+	if shared {
+		q.shared.refund(month, identity, cost)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := q.months[month][identity]
+	if usage == nil {
+		return
+	}
+	if usage.Calls[tool]--; usage.Calls[tool] <= 0 {
+		delete(usage.Calls, tool)
+	}
+	usage.Cost -= cost
+	q.dirty = true
+}
+
+// shareUsage applies the limits to the usage of every instance of the cluster
+func (q *quotaTracker) shareUsage(c *cluster) {
+	if q != nil {
+		q.shared = c
+	}
+}
+
+// usage returns a copy of what the identity spent in the month, formatted "2006-01"
+func (q *quotaTracker) usage(month, identity string) quotaUsage {
+	if q == nil {
+		return quotaUsage{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := q.months[month][identity]
+	if usage == nil {
+		return quotaUsage{}
+	}
+	calls := make(map[string]int, len(usage.Calls))
+	for tool, count := range usage.Calls {
+		calls[tool] = count
+	}
+	return quotaUsage{Calls: calls, Cost: usage.Cost}
+}
+
+func (q *quotaTracker) run() {
+	defer q.closed.Done()
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.flush()
+		case <-q.done:
+			q.flush()
+			return
+		}
+	}
+}
+
+// flush writes changed usage to the quota file
+func (q *quotaTracker) flush() {
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(q.months)
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to encode quota usage: %v", err)
+		return
+	}
+
+	if err := writeFileAtomic(q.cfg.File, data); err != nil {
+		log.Printf("Failed to save quota usage: %v", err)
+		// Retry on the next flush
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+	}
+}
+
+// close saves the usage not yet written
+func (q *quotaTracker) close() {
+	if q == nil || q.cfg.File == "" {
+		return
+	}
+	close(q.done)
+	q.closed.Wait()
+}
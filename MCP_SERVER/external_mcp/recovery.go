@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"sync"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// internalErrorCode is the JSON-RPC code of the internal error answering a request whose handler panicked
+const internalErrorCode = -32603
+
+type panicSlotKey struct{}
+
+// panicSlot records that a panic was recovered while answering a request
+type panicSlot struct {
+	mu      sync.Mutex
+	message string
+}
+
+// recoverPanic recovers a panic in the handling of a request, logging its stack trace, marking the
+// request as failed with an internal error and setting err to say so. It must be deferred directly.
+func recoverPanic(ctx context.Context, what string, err *error) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	logf(ctx, "Recovered from a panic in %s: %v\n%s", what, value, debug.Stack())
+	message := fmt.Sprintf("internal error: %s panicked", what)
+	if slot, ok := ctx.Value(panicSlotKey{}).(*panicSlot); ok {
+		slot.mu.Lock()
+		slot.message = message
+		slot.mu.Unlock()
+	}
+	if err != nil {
+		*err = errors.New(message)
+	}
+}
+
+// recoverHandler wraps a tool handler of the server, a func taking an optional context and its
+// arguments and returning a result and an error, so a panic fails the call instead of the process
+func recoverHandler(name string, handler interface{}) interface{} {
+	value := reflect.ValueOf(handler)
+	kind := value.Type()
+	return reflect.MakeFunc(kind, func(args []reflect.Value) (results []reflect.Value) {
+		ctx := context.Background()
+		if len(args) == 2 {
+			if c, ok := args[0].Interface().(context.Context); ok {
+				ctx = c
+			}
+		}
+		var err error
+		defer func() {
+			if err != nil {
+				results = []reflect.Value{reflect.Zero(kind.Out(0)), reflect.ValueOf(&err).Elem()}
+			}
+		}()
+		defer recoverPanic(ctx, "the "+name+" tool", &err)
+		return value.Call(args)
+	}).Interface()
+}
+
+// recoveryTransport decorates the downstream transport so a panic while answering a request fails
+// the request with an internal error instead of killing the process: panics in the message handlers
+// are recovered right away, and the result of a request whose handler recovered from a panic, such
+// as the error result of a tool call, is replaced by the internal error.
+type recoveryTransport struct {
+	transport.Transport
+
+	mu sync.Mutex
+	// requests holds the slots of the requests waiting for their response
+	requests map[transport.RequestId]*panicSlot
+}
+
+func newRecoveryTransport(inner transport.Transport) *recoveryTransport {
+	return &recoveryTransport{Transport: inner, requests: make(map[transport.RequestId]*panicSlot)}
+}
+
+// SetMessageHandler hands every message to handler, giving requests a slot for recovered panics
+func (t *recoveryTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.Transport.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		if message.Type != transport.BaseMessageTypeJSONRPCRequestType {
+			defer recoverPanic(ctx, string(message.Type)+" handler", nil)
+			handler(ctx, message)
+			return
+		}
+
+		request := message.JsonRpcRequest
+		slot := &panicSlot{}
+		t.mu.Lock()
+		t.requests[request.Id] = slot
+		t.mu.Unlock()
+		ctx = context.WithValue(ctx, panicSlotKey{}, slot)
+		defer func() {
+			if slot.failed() != "" && t.take(request.Id) != nil {
+				t.fail(ctx, request.Id, slot.failed())
+			}
+		}()
+		defer recoverPanic(ctx, request.Method, nil)
+		handler(ctx, message)
+	})
+}
+
+// Send replaces the response to a request whose handler panicked with an internal error
+func (t *recoveryTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	var id transport.RequestId
+	switch message.Type {
+	case transport.BaseMessageTypeJSONRPCResponseType:
+		id = message.JsonRpcResponse.Id
+	case transport.BaseMessageTypeJSONRPCErrorType:
+		id = message.JsonRpcError.Id
+	default:
+		return t.Transport.Send(ctx, message)
+	}
+	slot := t.take(id)
+	if slot == nil || slot.failed() == "" || message.Type == transport.BaseMessageTypeJSONRPCErrorType {
+		return t.Transport.Send(ctx, message)
+	}
+	return t.Transport.Send(ctx, internalError(id, slot.failed()))
+}
+
+// take removes and returns the slot of a request waiting for its response
+func (t *recoveryTransport) take(id transport.RequestId) *panicSlot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slot := t.requests[id]
+	delete(t.requests, id)
+	return slot
+}
+
+// fail answers a request with an internal error
+func (t *recoveryTransport) fail(ctx context.Context, id transport.RequestId, message string) {
+	if err := t.Transport.Send(ctx, internalError(id, message)); err != nil {
+		logf(ctx, "Failed to answer request %d: %v", id, err)
+	}
+}
+
+// failed returns the internal error of the request, or "" if its handler did not panic
+func (s *panicSlot) failed() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.message
+}
+
+func internalError(id transport.RequestId, message string) *transport.BaseJsonRpcMessage {
+	return transport.NewBaseMessageError(&transport.BaseJSONRPCError{
+		Jsonrpc: "2.0",
+		Id:      id,
+		Error:   transport.BaseJSONRPCErrorInner{Code: internalErrorCode, Message: message},
+	})
+}
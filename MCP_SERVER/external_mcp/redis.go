@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisTimeout bounds connecting to Redis and each command, so a slow server never holds up a call
+const redisTimeout = 2 * time.Second
+
+// RedisConfig points at a Redis server shared by the replicas
+type RedisConfig struct {
+	// Address is the host:port of the server
+	Address  string `json:"Address"`
+	Password string `json:"Password,omitempty"`
+	DB       int    `json:"DB,omitempty"`
+	// Prefix is put before every key, so several deployments can share a server; defaults to "mcp:"
+	Prefix string `json:"Prefix,omitempty"`
+}
+
+// redisClient speaks the Redis protocol over a single connection that is reopened after a failure
+type redisClient struct {
+	cfg RedisConfig
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisClient(cfg RedisConfig) *redisClient {
+	if cfg.Prefix == "" {
+		cfg.Prefix = "mcp:"
+	}
+	return &redisClient{cfg: cfg}
+}
+
+// key returns name under the configured prefix
+func (c *redisClient) key(name string) string {
+	return c.cfg.Prefix + name
+}
+
+// value sends a command replying with a string and returns it, nil for a null reply
+func (c *redisClient) value(args ...string) ([]byte, error) {
+	reply, err := c.do(args...)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := reply.([]byte)
+	if reply != nil && !ok {
+		return nil, fmt.Errorf("unexpected reply to %s", args[0])
+	}
+	return value, nil
+}
+
+// values sends a command replying with an array of strings and returns it
+func (c *redisClient) values(args ...string) ([][]byte, error) {
+	reply, err := c.do(args...)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if reply != nil && !ok {
+		return nil, fmt.Errorf("unexpected reply to %s", args[0])
+	}
+	values := make([][]byte, len(items))
+	for i, item := range items {
+		values[i], _ = item.([]byte)
+	}
+	return values, nil
+}
+
+// do sends a command and returns its reply: []byte for strings and integers, []interface{} for
+// arrays and nil for null replies
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, fmt.Errorf("failed to connect to redis at %s: %v", c.cfg.Address, err)
+		}
+	}
+	reply, err := c.command(args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// The connection may be out of step with its replies, so it is not used again
+			_ = c.conn.Close()
+			c.conn = nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// connect opens the connection, authenticates and selects the database
+func (c *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.cfg.Address, redisTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+	if c.cfg.Password != "" {
+		_, err = c.command("AUTH", c.cfg.Password)
+	}
+	if err == nil && c.cfg.DB != 0 {
+		_, err = c.command("SELECT", strconv.Itoa(c.cfg.DB))
+	}
+	if err != nil {
+		_ = conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// command writes a command as an array of bulk strings and reads its reply
+func (c *redisClient) command(args ...string) (interface{}, error) {
+	_ = c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	request := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		request = append(request, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	if _, err := c.conn.Write(request); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+// reply reads a reply; error replies are returned as a redisError
+func (c *redisClient) reply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$', '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis reply %q", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		if line[0] == '*' {
+			items := make([]interface{}, size)
+			for i := range items {
+				if items[i], err = c.reply(); err != nil {
+					return nil, err
+				}
+			}
+			return items, nil
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, value); err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
+
+// redisCache keeps cache entries in Redis
+type redisCache struct {
+	client *redisClient
+}
+
+func (c *redisCache) get(key string) ([]byte, bool, error) {
+	value, err := c.client.value("GET", c.client.key(key))
+	if err != nil {
+		return nil, false, err
+	}
+	return value, value != nil, nil
+}
+
+func (c *redisCache) set(key string, value []byte, ttl time.Duration) error {
+	_, err := c.client.do("SET", c.client.key(key), string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
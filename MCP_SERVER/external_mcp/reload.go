@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reloadStatus is the outcome of the last config reload
+type reloadStatus struct {
+	Time time.Time `json:"time"`
+	// Applied is false when the new config was rejected and the previous one kept
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// stagedConfig is a config whose new and changed servers were started, ready to take over from the
+// running ones
+type stagedConfig struct {
+	cfg     Config
+	servers map[string]MCPStdIOConfig
+	// backends are the servers' backends: the unchanged running ones and the started ones
+	backends map[string]*backend
+	// started are the backends started for the config, in start order
+	started []*backend
+	// carried names the connected reverse servers whose backends took over the running ones' connections
+	carried map[string]bool
+}
+
+// reload applies a changed config entirely or not at all. Its new and changed servers start
+// alongside the running ones, which keep serving until every one of them has started; if any fails
+// to, the previous config stays in place and the failure is recorded for the admin API.
+func (r *backendRegistry) reload(cfg Config) error {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	staged, err := r.stageLocked(cfg)
+	if err != nil {
+		log.Printf("Keeping the previous config after a failed reload: %v", err)
+		r.recordReload(err)
+		return err
+	}
+
+	// The started backends take over before the ones they replace stop
+	r.mu.Lock()
+	r.config, r.servers = staged.cfg, staged.servers
+	var stale []*backend
+	for name, b := range r.backends {
+		if staged.backends[name] == b {
+			continue
+		}
+		delete(r.backends, name)
+		if !staged.carried[name] {
+			stale = append(stale, b)
+		}
+	}
+	for name := range staged.carried {
+		r.backends[name] = staged.backends[name]
+	}
+	r.mu.Unlock()
+	for _, b := range staged.started {
+		r.addBackend(b)
+	}
+	for _, b := range stale {
+		log.Printf("Stopping StdIO client '%s'", b.name)
+		r.stopInstances(b)
+	}
+	r.recordReload(nil)
+	return nil
+}
+
+// stageLocked starts the servers cfg adds or changes without touching the running ones, while the
+// caller holds applyMu. If any of them fails to start, the ones started are stopped again.
+func (r *backendRegistry) stageLocked(cfg Config) (*stagedConfig, error) {
+	servers, order, errs, err := r.planLocked(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	previous := r.servers
+	running := make(map[string]*backend, len(r.backends))
+	for name, b := range r.backends {
+		running[name] = b
+	}
+	r.mu.RUnlock()
+
+	staged := &stagedConfig{cfg: cfg, servers: servers, backends: make(map[string]*backend), carried: make(map[string]bool)}
+	var missing []string
+	for _, name := range order {
+		config, ok := servers[name]
+		if !ok {
+			continue
+		}
+		if b, ok := running[name]; ok && reflect.DeepEqual(b.config, config) {
+			staged.backends[name] = b
+			continue
+		}
+		var down []string
+		for _, dependency := range config.DependsOn {
+			if _, up := staged.backends[dependency]; !up {
+				down = append(down, dependency)
+			}
+		}
+		if len(down) > 0 {
+			errs = append(errs, fmt.Errorf("not starting '%s': its dependencies %s are not running", name, strings.Join(down, ", ")))
+			continue
+		}
+		// Only a server dialing in can open its connection, so a connected one keeps it
+		if b, ok := running[name]; ok && config.ReverseToken != "" && b.config.ReverseToken != "" && !b.hasExited(0) {
+			staged.backends[name] = b.withConfig(config)
+			staged.carried[name] = true
+			continue
+		}
+		b, err := r.startServer(name, config)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if b == nil {
+			// Servers already down before the reload, and servers yet to dial in, do not hold it back
+			if old, ok := previous[name]; config.ReverseToken == "" && (!ok || !reflect.DeepEqual(old, config)) {
+				missing = append(missing, name)
+			}
+			continue
+		}
+		staged.backends[name] = b
+		staged.started = append(staged.started, b)
+	}
+
+	err = errors.Join(errs...)
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		err = fmt.Errorf("servers failed to start: %s", strings.Join(missing, ", "))
+	}
+	if err != nil {
+		for _, b := range staged.started {
+			stopBackend(b)
+		}
+		return nil, err
+	}
+	return staged, nil
+}
+
+// recordReload notes the outcome of a reload; err is nil when the new config was applied
+func (r *backendRegistry) recordReload(err error) {
+	status := &reloadStatus{Time: time.Now().UTC(), Applied: err == nil}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	r.mu.Lock()
+	r.lastReload = status
+	r.mu.Unlock()
+}
+
+// reloadStatus returns the outcome of the last reload, or nil if the config was never reloaded
+func (r *backendRegistry) reloadStatus() *reloadStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lastReload
+}
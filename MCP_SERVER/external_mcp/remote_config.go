@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// isRemoteConfig reports whether the config location is a URL rather than a local path.
+// Any HTTP(S) endpoint serving the raw JSON works, e.g. a presigned S3 URL or Consul's
+// /v1/kv/<key>?raw endpoint.
+func isRemoteConfig(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// fetchRemoteConfig downloads the configuration from the given URL. Credentials embedded in the URL
+// are sent as basic auth, and MCP_CONFIG_TOKEN, when set, is sent as a bearer token.
+func fetchRemoteConfig(location string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("MCP_CONFIG_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching config: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// loadProfileConfig reads the config from a path or URL, re-resolving its secrets, and applies the profile
+func loadProfileConfig(location string, profile string) (Config, error) {
+	cfg, err := resolveConfig(location)
+	if err != nil {
+		return Config{}, err
+	}
+	return applyProfile(cfg, profile)
+}
+
+// watchConfig re-reads the config every interval with the selected profile, re-resolving its
+// secrets, and applies it with the profile's policies whenever the resolved configuration differs
+// from the current one
+func watchConfig(profiles *profileSwitch, interval time.Duration, current Config) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		current = refreshConfig(profiles, current)
+	}
+}
+
+// refreshConfig re-reads the config once and applies it if it differs from current, returning the
+// config to compare the next one against
+func refreshConfig(profiles *profileSwitch, current Config) Config {
+	name := profiles.current()
+	cfg, err := loadProfileConfig(profiles.location, name)
+	if err != nil {
+		log.Printf("Ignoring invalid config: %v", err)
+		profiles.registry.recordReload(fmt.Errorf("invalid config: %v", err))
+		return current
+	}
+	if reflect.DeepEqual(cfg, current) {
+		return current
+	}
+
+	log.Printf("Config changed, applying %d servers", len(cfg.MCPStdIOServers))
+	if err := profiles.apply(name, cfg); err != nil {
+		log.Printf("Failed to apply config: %v", err)
+	}
+	return cfg
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// remoteDialTimeout bounds connecting to a remote server, including the SSE endpoint handshake
+const remoteDialTimeout = 15 * time.Second
+
+// remoteConn is an established, message-oriented connection to a remote MCP server
+type remoteConn interface {
+	// read returns the next JSON-RPC message
+	read() ([]byte, error)
+	write(ctx context.Context, data []byte) error
+	close() error
+}
+
+// remoteTransport exchanges JSON-RPC messages with an MCP server reached over the network instead
+// of a local process. The connection is dialed when the client starts the transport; the host name
+// is resolved through DNS at that point, so a Kubernetes Service name addresses its pods.
+type remoteTransport struct {
+	name string
+	dial func(ctx context.Context) (remoteConn, error)
+	// done is closed once the connection is closed or lost
+	done chan struct{}
+
+	mu        sync.Mutex
+	conn      remoteConn
+	started   bool
+	closed    bool
+	onClose   func()
+	onError   func(error)
+	onMessage func(ctx context.Context, message *transport.BaseJsonRpcMessage)
+}
+
+// newRemoteTransport connects to the server at rawURL: http(s) URLs are MCP SSE endpoints and
+// ws(s) URLs are WebSocket endpoints. Headers are sent with every HTTP request and the handshake, and
+// network, when given, routes the connections through its proxy and trusts its CAs.
+func newRemoteTransport(name, rawURL string, headers map[string]string, network *NetworkConfig, maxFrameSize int) (*remoteTransport, error) {
+	if maxFrameSize <= 0 {
+		maxFrameSize = defaultMaxFrameSize
+	}
+	endpoint, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL for '%s': %v", name, err)
+	}
+	upstream, err := newUpstreamNetwork(network)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network for '%s': %v", name, err)
+	}
+
+	t := &remoteTransport{name: name, done: make(chan struct{})}
+	switch endpoint.Scheme {
+	case "http", "https":
+		t.dial = func(ctx context.Context) (remoteConn, error) {
+			return dialSSE(ctx, upstream, endpoint, headers, maxFrameSize)
+		}
+	case "ws", "wss":
+		t.dial = func(ctx context.Context) (remoteConn, error) {
+			return dialWebSocket(ctx, upstream, endpoint, headers, maxFrameSize)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme '%s' for '%s', expected http, https, ws or wss", endpoint.Scheme, name)
+	}
+	return t, nil
+}
+
+// Start dials the server and begins reading messages
+func (t *remoteTransport) Start(ctx context.Context) error {
+	t.mu.Lock()
+	if t.started || t.closed {
+		t.mu.Unlock()
+		return fmt.Errorf("remote transport for %s already started", t.name)
+	}
+	t.started = true
+	t.mu.Unlock()
+
+	dialCtx, cancel := context.WithTimeout(ctx, remoteDialTimeout)
+	conn, err := t.dial(dialCtx)
+	cancel()
+	if err != nil {
+		_ = t.Close()
+		return fmt.Errorf("failed to connect to %s: %w", t.name, err)
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		_ = conn.close()
+		return fmt.Errorf("remote transport for %s closed while connecting", t.name)
+	}
+	t.conn = conn
+	t.mu.Unlock()
+
+	go t.readLoop(conn)
+	return nil
+}
+
+// Send writes a single message to the server
+func (t *remoteTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("remote transport for %s is not connected", t.name)
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return conn.write(ctx, data)
+}
+
+// Close drops the connection and fails the requests still waiting for a response. Closing more
+// than once has no effect.
+func (t *remoteTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	conn, handler := t.conn, t.onClose
+	t.mu.Unlock()
+
+	if conn != nil {
+		_ = conn.close()
+	}
+	close(t.done)
+	if handler != nil {
+		handler()
+	}
+	return nil
+}
+
+// SetCloseHandler sets the handler for close events
+func (t *remoteTransport) SetCloseHandler(handler func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onClose = handler
+}
+
+// SetErrorHandler sets the handler for error events
+func (t *remoteTransport) SetErrorHandler(handler func(error)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onError = handler
+}
+
+// SetMessageHandler sets the handler for incoming messages
+func (t *remoteTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onMessage = handler
+}
+
+func (t *remoteTransport) readLoop(conn remoteConn) {
+	for {
+		data, err := conn.read()
+		if err != nil {
+			t.mu.Lock()
+			closed := t.closed
+			t.mu.Unlock()
+			if !closed && err != io.EOF {
+				t.handleError(fmt.Errorf("read error: %w", err))
+			}
+			// The server is gone, so nothing waiting for a response will get one
+			_ = t.Close()
+			return
+		}
+
+		message, err := decodeMessage(data)
+		if err != nil {
+			t.handleError(err)
+			continue
+		}
+		t.mu.Lock()
+		handler := t.onMessage
+		t.mu.Unlock()
+		if handler != nil {
+			handler(context.Background(), message)
+		}
+	}
+}
+
+func (t *remoteTransport) handleError(err error) {
+	t.mu.Lock()
+	handler := t.onError
+	t.mu.Unlock()
+
+	if handler != nil {
+		handler(err)
+	}
+}
+
+// sseConn speaks the MCP SSE transport: server messages arrive as "message" events on a long-lived
+// GET stream, and client messages are POSTed to the endpoint announced by the first event
+type sseConn struct {
+	client   *http.Client
+	headers  map[string]string
+	endpoint string
+	events   *bufio.Scanner
+	stream   io.Closer
+	cancel   context.CancelFunc
+}
+
+// dialSSE opens the event stream and waits for the server to announce its message endpoint
+func dialSSE(ctx context.Context, network *upstreamNetwork, streamURL *url.URL, headers map[string]string, maxFrameSize int) (*sseConn, error) {
+	// The stream outlives the dial, so it gets its own context and only the handshake is bounded by ctx
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, streamURL.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	client := network.httpClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected status opening event stream: %s", resp.Status)
+	}
+
+	events := bufio.NewScanner(resp.Body)
+	events.Buffer(make([]byte, 0, 64*1024), maxFrameSize)
+	c := &sseConn{client: client, headers: headers, events: events, stream: resp.Body, cancel: cancel}
+
+	event, data, err := c.next()
+	if err == nil && event != "endpoint" {
+		err = fmt.Errorf("expected an endpoint event, got '%s'", event)
+	}
+	if err == nil {
+		var endpoint *url.URL
+		if endpoint, err = streamURL.Parse(strings.TrimSpace(string(data))); err == nil {
+			c.endpoint = endpoint.String()
+		}
+	}
+	if err != nil {
+		_ = c.close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// next returns the type and data of the next event on the stream
+func (c *sseConn) next() (string, []byte, error) {
+	event := "message"
+	var data [][]byte
+	for c.events.Scan() {
+		line := c.events.Bytes()
+		if len(line) == 0 {
+			if data == nil {
+				continue
+			}
+			return event, bytes.Join(data, []byte("\n")), nil
+		}
+
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(field) {
+		case "event":
+			event = string(value)
+		case "data":
+			data = append(data, append([]byte(nil), value...))
+		}
+	}
+	if err := c.events.Err(); err != nil {
+		return "", nil, err
+	}
+	return "", nil, io.EOF
+}
+
+func (c *sseConn) read() ([]byte, error) {
+	for {
+		event, data, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		if event == "message" {
+			return data, nil
+		}
+	}
+}
+
+func (c *sseConn) write(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status posting message: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *sseConn) close() error {
+	c.cancel()
+	return c.stream.Close()
+}
+
+// WebSocket opcodes, see RFC 6455 section 5.2
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// wsAcceptGUID is appended to the handshake key to derive the expected Sec-WebSocket-Accept
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsConn carries one JSON-RPC message per WebSocket text message. Clients mask the frames they send,
+// servers do not.
+type wsConn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	masked         bool
+	maxMessageSize int
+	writeMu        sync.Mutex
+}
+
+// dialWebSocket connects and performs the opening handshake, negotiating the "mcp" subprotocol
+// over a connection opened by network
+func dialWebSocket(ctx context.Context, network *upstreamNetwork, endpoint *url.URL, headers map[string]string, maxFrameSize int) (*wsConn, error) {
+	conn, err := network.dial(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "wss" {
+		tlsConn := tls.Client(conn, network.tlsConfig(endpoint.Hostname()))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        endpoint,
+		Host:       endpoint.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "mcp")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected status upgrading to WebSocket: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, errors.New("invalid Sec-WebSocket-Accept in WebSocket handshake")
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return &wsConn{conn: conn, reader: reader, masked: true, maxMessageSize: maxFrameSize}, nil
+}
+
+// wsAccept returns the Sec-WebSocket-Accept value for a handshake key
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// read returns the next data message, answering pings and reassembling fragments along the way
+func (c *wsConn) read() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			return nil, io.EOF
+		}
+
+		message = append(message, payload...)
+		if len(message) > c.maxMessageSize {
+			return nil, fmt.Errorf("message exceeds %d bytes", c.maxMessageSize)
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0F
+	masked, length := header[1]&0x80 != 0, uint64(header[1]&0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > uint64(c.maxMessageSize) {
+		err = fmt.Errorf("frame of %d bytes exceeds %d bytes", length, c.maxMessageSize)
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+func (c *wsConn) write(ctx context.Context, data []byte) error {
+	return c.writeFrame(wsText, data)
+}
+
+// writeFrame sends payload as a single final frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	maskBit := byte(0)
+	if c.masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.masked {
+		var mask [4]byte
+		_, _ = rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		offset := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[offset+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) close() error {
+	_ = c.writeFrame(wsClose, nil)
+	return c.conn.Close()
+}
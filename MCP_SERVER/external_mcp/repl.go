@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+	"github.com/metoro-io/mcp-golang/transport"
+	"golang.org/x/term"
+)
+
+const replHelp = `Commands:
+  <tool> [arguments]    call a tool, prompting for its arguments unless they are given as JSON
+  tools [filter]        list the tools, optionally only those containing filter
+  describe <tool>       show a tool's description and input schema
+  reload                re-read the tool list
+  help                  show this help
+  quit                  leave the REPL
+Tab completes commands and tool names.`
+
+// replCommands are the built-in commands, completed along with the tool names
+var replCommands = []string{"tools", "describe", "reload", "help", "quit"}
+
+// repl is an interactive session calling the aggregator's tools through its tools/list and
+// tools/call tools
+type repl struct {
+	client  *mcp.Client
+	term    *term.Terminal
+	timeout time.Duration
+	tools   []mcp.ToolRetType
+}
+
+// runREPL implements the repl command, connecting to a running aggregator with -connect or
+// starting one from the config otherwise
+func runREPL(configPath string, profile string, args []string) {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	connect := fs.String("connect", "", "Address of a running aggregator's -listen endpoint, e.g. 127.0.0.1:8080 or unix:/run/mcp.sock; empty starts one from -config")
+	token := fs.String("token", os.Getenv("MCP_TOKEN"), "Bearer token for the running aggregator")
+	timeout := fs.Duration("timeout", 2*time.Minute, "How long to wait for each tool call")
+	verbose := fs.Bool("verbose", false, "Show the log of the aggregator started by the REPL")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	var client *mcp.Client
+	if *connect != "" {
+		httpClient, base, err := listenerClient(*connect)
+		if err != nil {
+			log.Fatalf("Failed to connect: %v", err)
+		}
+		// Tool calls are bounded by -timeout instead
+		httpClient.Timeout = 0
+		client = mcp.NewClientWithInfo(&httpClientTransport{client: httpClient, url: base + "/", token: *token}, mcp.ClientInfo{Name: "mcp-repl", Version: "1.0.0"})
+	} else {
+		cmd, stdio, err := startAggregator(configPath, profile, *verbose)
+		if err != nil {
+			log.Fatalf("Failed to start the aggregator: %v", err)
+		}
+		defer func() {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}()
+		client = mcp.NewClientWithInfo(stdio, mcp.ClientInfo{Name: "mcp-repl", Version: "1.0.0"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	_, err := client.Initialize(ctx)
+	cancel()
+	if err != nil {
+		log.Fatalf("Failed to initialize the connection: %v", err)
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		log.Fatalf("repl needs an interactive terminal")
+	}
+	state, err := term.MakeRaw(stdin)
+	if err != nil {
+		log.Fatalf("Failed to set up the terminal: %v", err)
+	}
+	defer term.Restore(stdin, state)
+
+	r := newREPL(client, struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, *timeout)
+	if width, height, err := term.GetSize(stdin); err == nil {
+		_ = r.term.SetSize(width, height)
+	}
+	r.run()
+}
+
+// startAggregator runs this binary as a stdio aggregator for the config and returns the
+// transport connected to it
+func startAggregator(configPath string, profile string, verbose bool) (*exec.Cmd, *stdioTransport, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.Command(executable, "-config", configPath, "-profile", profile)
+	if verbose {
+		cmd.Stderr = os.Stderr
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	return cmd, newStdioTransport("aggregator", stdout, stdin, 0), nil
+}
+
+// httpClientTransport talks to an aggregator serving MCP over plain HTTP, one POST per message
+// with the response in the HTTP response
+type httpClientTransport struct {
+	client    *http.Client
+	url       string
+	token     string
+	onMessage func(ctx context.Context, message *transport.BaseJsonRpcMessage)
+}
+
+func (t *httpClientTransport) Start(ctx context.Context) error {
+	return nil
+}
+
+// Send posts the message and hands the response, if any, to the message handler
+func (t *httpClientTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("aggregator returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	reply, err := decodeMessage(body)
+	if err != nil {
+		return err
+	}
+	if t.onMessage != nil {
+		t.onMessage(ctx, reply)
+	}
+	return nil
+}
+
+func (t *httpClientTransport) Close() error {
+	return nil
+}
+
+func (t *httpClientTransport) SetCloseHandler(handler func()) {}
+
+func (t *httpClientTransport) SetErrorHandler(handler func(error)) {}
+
+func (t *httpClientTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.onMessage = handler
+}
+
+func newREPL(client *mcp.Client, rw io.ReadWriter, timeout time.Duration) *repl {
+	r := &repl{client: client, term: term.NewTerminal(rw, "mcp> "), timeout: timeout}
+	r.term.AutoCompleteCallback = r.complete
+	return r
+}
+
+// run reads and handles commands until quit or end of input
+func (r *repl) run() {
+	if err := r.reload(); err != nil {
+		r.printf("Failed to list tools: %v\n", err)
+	} else {
+		r.printf("%d tools available; type help for commands\n", len(r.tools))
+	}
+	for {
+		r.term.SetPrompt("mcp> ")
+		line, err := r.term.ReadLine()
+		if err != nil {
+			return
+		}
+		if r.handle(strings.TrimSpace(line)) {
+			return
+		}
+	}
+}
+
+// handle runs one command line and reports whether to quit
+func (r *repl) handle(line string) bool {
+	command, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+	switch command {
+	case "":
+	case "quit", "exit":
+		return true
+	case "help":
+		r.printf("%s\n", replHelp)
+	case "reload":
+		if err := r.reload(); err != nil {
+			r.printf("Failed to list tools: %v\n", err)
+		} else {
+			r.printf("%d tools available\n", len(r.tools))
+		}
+	case "tools":
+		for _, tool := range r.tools {
+			if strings.Contains(tool.Name, rest) {
+				r.printf("%-32s %s\n", tool.Name, firstLine(description(tool)))
+			}
+		}
+	case "describe":
+		tool, ok := r.tool(rest)
+		if !ok {
+			r.printf("Unknown tool '%s'\n", rest)
+			break
+		}
+		schema, _ := json.MarshalIndent(tool.InputSchema, "", "  ")
+		r.printf("%s\n%s\n%s\n", tool.Name, description(tool), schema)
+	default:
+		tool, ok := r.tool(command)
+		if !ok {
+			r.printf("Unknown tool or command '%s'; type help for commands\n", command)
+			break
+		}
+		arguments, err := r.arguments(tool, rest)
+		if err != nil {
+			r.printf("%v\n", err)
+			break
+		}
+		r.call(tool.Name, arguments)
+	}
+	return false
+}
+
+// reload fetches the tool list from the aggregator
+func (r *repl) reload() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	resp, err := r.client.CallTool(ctx, "tools/list", ListToolsRequest{})
+	if err != nil {
+		return err
+	}
+	var listing struct {
+		Tools []mcp.ToolRetType `json:"tools"`
+	}
+	text, err := firstText(resp)
+	if err != nil {
+		return fmt.Errorf("empty tool list: %v", err)
+	}
+	if err := json.Unmarshal([]byte(text), &listing); err != nil {
+		return fmt.Errorf("invalid tool list: %v", err)
+	}
+	sort.Slice(listing.Tools, func(i, j int) bool { return listing.Tools[i].Name < listing.Tools[j].Name })
+	r.tools = listing.Tools
+	return nil
+}
+
+func (r *repl) tool(name string) (mcp.ToolRetType, bool) {
+	for _, tool := range r.tools {
+		if tool.Name == name {
+			return tool, true
+		}
+	}
+	return mcp.ToolRetType{}, false
+}
+
+// arguments parses arguments given as JSON, or prompts for each property of the tool's input
+// schema, required ones first. Values are read as JSON unless the property is a string.
+func (r *repl) arguments(tool mcp.ToolRetType, given string) (map[string]interface{}, error) {
+	arguments := make(map[string]interface{})
+	if given != "" {
+		if err := json.Unmarshal([]byte(given), &arguments); err != nil {
+			return nil, fmt.Errorf("arguments must be a JSON object: %v", err)
+		}
+		return arguments, nil
+	}
+
+	schema, _ := tool.InputSchema.(map[string]interface{})
+	properties, _ := schema["properties"].(map[string]interface{})
+	required := make(map[string]bool)
+	if names, ok := schema["required"].([]interface{}); ok {
+		for _, name := range names {
+			if name, ok := name.(string); ok {
+				required[name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if required[names[i]] != required[names[j]] {
+			return required[names[i]]
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		property, _ := properties[name].(map[string]interface{})
+		kind, _ := property["type"].(string)
+		label := name
+		if kind != "" {
+			label += " (" + kind + ")"
+		}
+		if !required[name] {
+			label += " [optional]"
+		}
+		if desc, ok := property["description"].(string); ok && desc != "" {
+			r.printf("  %s\n", firstLine(desc))
+		}
+		r.term.SetPrompt(label + ": ")
+		value, err := r.term.ReadLine()
+		if err != nil {
+			return nil, fmt.Errorf("call canceled")
+		}
+		if value == "" && !required[name] {
+			continue
+		}
+		arguments[name] = value
+		if kind != "string" {
+			var decoded interface{}
+			if err := json.Unmarshal([]byte(value), &decoded); err == nil {
+				arguments[name] = decoded
+			}
+		}
+	}
+	return arguments, nil
+}
+
+// call calls a tool through the aggregator and pretty-prints the result
+func (r *repl) call(name string, arguments map[string]interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	start := time.Now()
+	resp, err := r.client.CallTool(ctx, "tools/call", CallToolRequest{Name: name, Arguments: arguments})
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		r.printf("Error after %s: %v\n", elapsed, err)
+		return
+	}
+	for _, content := range contentOf(resp) {
+		r.printf("%s\n", formatContent(content))
+	}
+	r.printf("(%s)\n", elapsed)
+}
+
+// formatContent renders a content item for the terminal, indenting JSON text
+func formatContent(content *mcp.Content) string {
+	switch {
+	case content.TextContent != nil:
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, []byte(content.TextContent.Text), "", "  "); err == nil {
+			return indented.String()
+		}
+		return content.TextContent.Text
+	case content.ImageContent != nil:
+		return fmt.Sprintf("[%s image, %d bytes base64]", content.ImageContent.MimeType, len(content.ImageContent.Data))
+	case content.EmbeddedResource != nil:
+		data, _ := json.MarshalIndent(content.EmbeddedResource, "", "  ")
+		return string(data)
+	}
+	return fmt.Sprintf("[%s content]", content.Type)
+}
+
+// complete is the terminal's tab completion: the first word completes to commands and tools,
+// the word after describe to tools
+func (r *repl) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' || pos != len(line) {
+		return "", 0, false
+	}
+	var candidates []string
+	prefix := line
+	if command, word, ok := strings.Cut(line, " "); ok {
+		if command != "describe" || strings.Contains(word, " ") {
+			return "", 0, false
+		}
+		prefix = word
+	} else {
+		candidates = append(candidates, replCommands...)
+	}
+	var matches []string
+	for _, tool := range r.tools {
+		candidates = append(candidates, tool.Name)
+	}
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+
+	completed := commonPrefix(matches)
+	if len(matches) == 1 {
+		completed += " "
+	} else if completed == prefix {
+		r.printf("%s\n", strings.Join(matches, "  "))
+	}
+	line = strings.TrimSuffix(line, prefix) + completed
+	return line, len(line), true
+}
+
+func (r *repl) printf(format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(r.term, format, args...)
+}
+
+// commonPrefix returns the longest prefix shared by all values
+func commonPrefix(values []string) string {
+	prefix := values[0]
+	for _, value := range values[1:] {
+		for !strings.HasPrefix(value, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+func description(tool mcp.ToolRetType) string {
+	if tool.Description == nil {
+		return ""
+	}
+	return *tool.Description
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
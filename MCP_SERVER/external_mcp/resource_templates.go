@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// templateListTimeout bounds how long listing resource templates waits for a server
+const templateListTimeout = 10 * time.Second
+
+// maxTemplatePages bounds the pages of resource templates read from a server
+const maxTemplatePages = 20
+
+// resourceSeparator joins a server's name to the URIs of its resource templates, so "file:///{path}"
+// of server "fs" is advertised as "fs+file:///{path}" and reads of its resources are routed to "fs"
+const resourceSeparator = "+"
+
+// resourceTemplate is a resource template as listed by resources/templates/list
+type resourceTemplate struct {
+	URITemplate string  `json:"uriTemplate"`
+	Name        string  `json:"name"`
+	Description *string `json:"description,omitempty"`
+	MimeType    *string `json:"mimeType,omitempty"`
+}
+
+// resourceOwner returns the server a namespaced resource URI belongs to and the URI as the server
+// knows it, or nil if the URI does not name a server
+func (rt *router) resourceOwner(uri string) (*backend, string) {
+	name, rest, ok := strings.Cut(uri, resourceSeparator)
+	if !ok {
+		return nil, ""
+	}
+	for _, b := range rt.registry.shared() {
+		if b.name == name {
+			return b, rest
+		}
+	}
+	return nil, ""
+}
+
+// requestedResource returns the server owning the resource named in request params, such as those
+// of resources/read, and the resource's URI as the server knows it
+func (rt *router) requestedResource(params json.RawMessage) (*backend, string, error) {
+	var request struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal(params, &request); err != nil {
+		return nil, "", fmt.Errorf("invalid resource request: %v", err)
+	}
+	b, uri := rt.resourceOwner(request.URI)
+	if b == nil {
+		return nil, "", fmt.Errorf("unknown resource '%s'", request.URI)
+	}
+	return b, uri, nil
+}
+
+// ownsResource reports whether request params name a resource of a server
+func (rt *router) ownsResource(params json.RawMessage) bool {
+	b, _, err := rt.requestedResource(params)
+	return b != nil && err == nil
+}
+
+// resourceTemplates answers resources/templates/list with the templates of every server, their URIs
+// and names prefixed with the server's name. Servers without templates are left out.
+func (rt *router) resourceTemplates(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, templateListTimeout)
+	defer cancel()
+	servers := rt.registry.shared()
+	listed := make([][]resourceTemplate, len(servers))
+	var wg sync.WaitGroup
+	for i, b := range servers {
+		wg.Add(1)
+		go func(i int, b *backend) {
+			defer wg.Done()
+			templates, err := listResourceTemplates(ctx, b)
+			if err != nil {
+				log.Printf("Failed to list resource templates of '%s': %v", b.name, err)
+			}
+			for j := range templates {
+				templates[j].URITemplate = b.name + resourceSeparator + templates[j].URITemplate
+				templates[j].Name = b.name + "/" + templates[j].Name
+			}
+			listed[i] = templates
+		}(i, b)
+	}
+	wg.Wait()
+
+	templates := []resourceTemplate{}
+	for _, page := range listed {
+		templates = append(templates, page...)
+	}
+	return map[string]interface{}{"resourceTemplates": templates}, nil
+}
+
+// listResourceTemplates reads every page of a server's resource templates. A server without
+// resources has none.
+func listResourceTemplates(ctx context.Context, b *backend) ([]resourceTemplate, error) {
+	var templates []resourceTemplate
+	params := map[string]interface{}{}
+	for page := 0; page < maxTemplatePages; page++ {
+		raw, err := b.upstream.request(ctx, "resources/templates/list", params)
+		if err != nil {
+			if unsupported(err) {
+				return templates, nil
+			}
+			return templates, err
+		}
+		var result struct {
+			ResourceTemplates []resourceTemplate `json:"resourceTemplates"`
+			NextCursor        string             `json:"nextCursor"`
+		}
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return templates, fmt.Errorf("invalid resource templates: %v", err)
+		}
+		templates = append(templates, result.ResourceTemplates...)
+		if result.NextCursor == "" {
+			break
+		}
+		params["cursor"] = result.NextCursor
+	}
+	return templates, nil
+}
+
+// readResource answers resources/read for a resource of a server by reading it from the server,
+// namespacing the URIs of the contents it returns
+func (rt *router) readResource(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	b, uri, err := rt.requestedResource(params)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := b.upstream.request(ctx, "resources/read", map[string]string{"uri": uri})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s' from '%s': %v", uri, b.name, err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, fmt.Errorf("invalid resource from '%s': %v", b.name, err)
+	}
+	contents, _ := result["contents"].([]interface{})
+	for _, content := range contents {
+		if content, ok := content.(map[string]interface{}); ok {
+			if uri, ok := content["uri"].(string); ok {
+				content["uri"] = b.name + resourceSeparator + uri
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// maxConnectRetryDelay bounds the wait between attempts of the connect command to dial in
+const maxConnectRetryDelay = time.Minute
+
+// reverseHub accepts the connections of servers that dial in to the aggregator because they cannot
+// be dialed, such as servers behind NAT. A server connecting starts its backend over the connection;
+// once the connection is lost, the backend is gone until the server dials in again.
+type reverseHub struct {
+	registry *backendRegistry
+
+	mu sync.Mutex
+	// parked holds connections waiting for their backend to start
+	parked map[string]remoteConn
+	// live holds the servers whose backend has taken their connection
+	live map[string]bool
+}
+
+func newReverseHub(registry *backendRegistry) *reverseHub {
+	return &reverseHub{registry: registry, parked: make(map[string]remoteConn), live: make(map[string]bool)}
+}
+
+// ServeHTTP upgrades the request of a server dialing in, named by the server query parameter and
+// authenticated by its bearer token, to a WebSocket and starts its backend over it
+func (h *reverseHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("server")
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	config, ok := h.registry.configured(name)
+	if !ok || config.ReverseToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.ReverseToken)) != 1 {
+		http.Error(w, "Unknown server or invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	live := h.live[name]
+	h.mu.Unlock()
+	if live {
+		http.Error(w, fmt.Sprintf("Server '%s' is already connected", name), http.StatusConflict)
+		return
+	}
+
+	conn, buffered, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\nSec-WebSocket-Protocol: mcp\r\n\r\n",
+		wsAccept(r.Header.Get("Sec-WebSocket-Key")))
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	maxFrameSize := config.MaxFrameSize
+	if maxFrameSize <= 0 {
+		maxFrameSize = defaultMaxFrameSize
+	}
+	log.Printf("Server '%s' dialed in from %s", name, r.RemoteAddr)
+	h.arrive(name, &wsConn{conn: conn, reader: buffered.Reader, maxMessageSize: maxFrameSize})
+}
+
+// arrive parks the connection of a server and restarts its backend to take it
+func (h *reverseHub) arrive(name string, conn remoteConn) {
+	h.mu.Lock()
+	if old := h.parked[name]; old != nil {
+		_ = old.close()
+	}
+	h.parked[name] = conn
+	h.mu.Unlock()
+
+	go func() {
+		if err := h.registry.restart(name); err != nil {
+			log.Printf("Failed to start '%s' over its connection: %v", name, err)
+		}
+	}()
+}
+
+// take returns the parked connection of a server, marking it live until the connection is closed
+func (h *reverseHub) take(name string) (remoteConn, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	conn := h.parked[name]
+	if conn == nil {
+		return nil, fmt.Errorf("'%s' has not dialed in", name)
+	}
+	delete(h.parked, name)
+	h.live[name] = true
+	return &reverseConn{remoteConn: conn, release: func() {
+		h.mu.Lock()
+		delete(h.live, name)
+		h.mu.Unlock()
+	}}, nil
+}
+
+// reverseConn releases its server once the connection is closed, so the server can dial in again
+type reverseConn struct {
+	remoteConn
+	once    sync.Once
+	release func()
+}
+
+func (c *reverseConn) close() error {
+	err := c.remoteConn.close()
+	c.once.Do(c.release)
+	return err
+}
+
+// withConfig returns a backend configured by config over the connection of b, for a connected
+// server whose config changed. The client keeps the settings it was created with until the server
+// dials in again.
+func (b *backend) withConfig(config MCPStdIOConfig) *backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return &backend{
+		name:        b.name,
+		config:      config,
+		client:      b.client,
+		transport:   b.transport,
+		upstream:    b.upstream,
+		exited:      b.exited,
+		tools:       b.tools,
+		initialized: b.initialized,
+	}
+}
+
+// accept creates the backend of a server that has dialed in, taking its connection when the client
+// initializes, or returns nil if the server has not dialed in
+func (h *reverseHub) accept(name string, config MCPStdIOConfig, clientInfo mcp.ClientInfo) *backend {
+	h.mu.Lock()
+	_, parked := h.parked[name]
+	h.mu.Unlock()
+	if !parked {
+		return nil
+	}
+	log.Printf("Initializing reverse client '%s'", name)
+	tr := &remoteTransport{name: name, done: make(chan struct{})}
+	tr.dial = func(context.Context) (remoteConn, error) { return h.take(name) }
+	client, upstream := newBackendClient(tr, config, clientInfo)
+	return &backend{
+		name:      name,
+		config:    config,
+		client:    client,
+		transport: tr,
+		upstream:  upstream,
+		exited:    tr.done,
+	}
+}
+
+// serveReverse serves the endpoint servers dial in to on addr
+func serveReverse(addr string, hub *reverseHub) error {
+	listener, err := listen(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/reverse", hub)
+	go func() {
+		log.Printf("Accepting servers dialing in on %s", listener.Addr())
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Reverse endpoint failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// runConnect implements the connect subcommand: it runs a stdio server next to it and connects it to
+// an aggregator that cannot reach it, dialing in again whenever the connection is lost
+func runConnect(args []string) {
+	fs := flag.NewFlagSet("connect", flag.ExitOnError)
+	endpoint := fs.String("url", "", "Reverse endpoint of the aggregator, e.g. wss://aggregator.example.com:9443/reverse")
+	name := fs.String("server", "", "Name of the server in the aggregator's config")
+	token := fs.String("token", os.Getenv("MCP_REVERSE_TOKEN"), "ReverseToken of the server; defaults to $MCP_REVERSE_TOKEN")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: connect -url <endpoint> -server <name> [-token <token>] <command> [args...]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if *endpoint == "" || *name == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	target, err := url.Parse(*endpoint)
+	if err != nil || (target.Scheme != "ws" && target.Scheme != "wss") {
+		log.Fatalf("Invalid endpoint '%s': expected a ws or wss URL", *endpoint)
+	}
+	query := target.Query()
+	query.Set("server", *name)
+	target.RawQuery = query.Encode()
+
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := connectOnce(target, *token, fs.Args())
+		if time.Since(start) > maxConnectRetryDelay {
+			delay = time.Second
+		}
+		log.Printf("Disconnected from %s, dialing in again in %s: %v", target.Host, delay, err)
+		time.Sleep(delay)
+		delay = min(2*delay, maxConnectRetryDelay)
+	}
+}
+
+// connectOnce dials in and relays messages between the aggregator and a fresh server process until
+// either side goes away; each connection gets its own process, as the aggregator initializes it anew
+func connectOnce(target *url.URL, token string, command []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteDialTimeout)
+	conn, err := dialWebSocket(ctx, nil, target, map[string]string{"Authorization": "Bearer " + token}, defaultMaxFrameSize)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("Connected '%s' to %s", command[0], target.Host)
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	failed := make(chan error, 2)
+	go func() {
+		for {
+			message, err := conn.read()
+			if err == nil {
+				_, err = stdin.Write(append(message, '\n'))
+			}
+			if err != nil {
+				failed <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		lines := bufio.NewScanner(stdout)
+		lines.Buffer(make([]byte, 64*1024), defaultMaxFrameSize)
+		for lines.Scan() {
+			if err := conn.write(context.Background(), lines.Bytes()); err != nil {
+				failed <- err
+				return
+			}
+		}
+		failed <- fmt.Errorf("the server exited: %v", lines.Err())
+	}()
+	return <-failed
+}
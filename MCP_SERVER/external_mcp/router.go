@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// router forwards tool calls from the downstream host to the backends
+type router struct {
+	registry   *backendRegistry
+	authz      *authorizer
+	audit      *auditLogger
+	sessions   *sessionStore
+	injections []ContextInjection
+	webhooks   *webhookDispatcher
+	jobs       jobStore
+	artifacts  *artifactStore
+	raw        *rawResults
+	search     *toolSearch
+	budget     *CatalogBudgetConfig
+	usage      *toolUsage
+	hosts      *hostProfiles
+	locales    *localizer
+	metrics    *metrics
+	slow       *slowCallLogger
+	outputs    *outputValidator
+	sanitizers argumentSanitizers
+	quotas     *quotaTracker
+	ledger     *usageLedger
+	middleware middlewareChain
+	scripts    scriptHooks
+	policy     *policyEngine
+	history    *callHistory
+	snapshots  *snapshotStore
+	shadows    *shadowMirror
+	memory     *memoryWatchdog
+	// reserve is kept back from the budget callers give their calls, for relaying the response
+	reserve time.Duration
+	// strict rejects tools no backend advertises instead of trying them on every backend
+	strict bool
+	// resources holds the sessions' subscriptions to the servers' resources
+	resources *resourceSubscriptions
+	// summarizer condenses oversized outputs
+	summarizer *summarizer
+	// cache holds the results of cached tools and the servers' tool lists
+	cache *toolCache
+	// instance is the URL of this instance in a cluster, recorded on the jobs it runs
+	instance string
+	// budgets restricts expensive tools to hours of the day and daily call budgets
+	budgets *toolBudgets
+	// spend prices the calls to paid tools and guards the daily spend of their callers
+	spend *spendGuard
+	// features gates the experimental subsystems
+	features FeatureFlags
+	// exports pushes the usage of every call to the configured exporters
+	exports *recordExports
+	// profiles switches the selected profile, whose policies then replace policy and strict
+	profiles *profileSwitch
+}
+
+// policies returns the policy engine and strict routing in effect: those of the selected profile
+// once the profile switch has reloaded the config, or those the router started with
+func (rt *router) policies() (*policyEngine, bool) {
+	if policy, strict, ok := rt.profiles.policies(); ok {
+		return policy, strict
+	}
+	return rt.policy, rt.strict
+}
+
+// call routes a tool call and reports its outcome to the webhooks
+func (rt *router) call(ctx context.Context, name string, arguments interface{}) (*mcp.ToolResponse, error) {
+	start := time.Now()
+	name = rt.resolveTool(ctx, name)
+	rt.usage.record(name)
+	timing := &callTiming{}
+	routeCtx, cancel := withBudgetDeadline(contextWithCallTiming(ctx, timing), rt.reserve)
+	defer cancel()
+	var info map[string]string
+	if len(rt.middleware) > 0 {
+		info = callInfo(ctx, name)
+	}
+	if rt.outputs.expects(name) || len(rt.middleware) > 0 || rt.shadows.mirrors(name) || rt.summarizer.summarizes(name) {
+		routeCtx = withoutPassthrough(routeCtx)
+	}
+	var resp *mcp.ToolResponse
+	forwarded, err := rt.middleware.start(routeCtx, info, arguments)
+	if err == nil {
+		resp, err = rt.route(routeCtx, name, forwarded)
+		if err == nil {
+			resp, err = rt.outputs.check(ctx, name, resp)
+		}
+		if err == nil {
+			resp, err = rt.middleware.transform(routeCtx, info, resp)
+		}
+		if err == nil {
+			resp = rt.summarizer.summarize(ctx, name, resp)
+		}
+		rt.middleware.end(ctx, info, time.Since(start), err)
+	}
+	rt.slow.observe(ctx, name, arguments, resp, err, start, timing)
+	timing.mu.Lock()
+	backend := timing.backend
+	timing.mu.Unlock()
+	if backend != "" {
+		rt.ledger.record(identityFromContext(ctx).Name, name, backend, start, time.Since(start))
+		rt.exports.usage(identityFromContext(ctx).Name, name, backend, correlationIDFromContext(ctx), start, time.Since(start))
+	}
+
+	event := toolCallEvent{
+		Event:         "success",
+		Time:          start.UTC(),
+		Identity:      identityFromContext(ctx).Name,
+		Tool:          name,
+		Backend:       backend,
+		Duration:      time.Since(start).String(),
+		CorrelationID: correlationIDFromContext(ctx),
+	}
+	if err != nil {
+		event.Event = "failure"
+		event.Error = err.Error()
+		logf(ctx, "Tool '%s' failed after %s: %v", name, event.Duration, err)
+	} else {
+		logf(ctx, "Tool '%s' succeeded in %s", name, event.Duration)
+	}
+	var exemplarLabels []string
+	if event.CorrelationID != "" {
+		exemplarLabels = []string{"correlation_id", event.CorrelationID}
+	}
+	rt.metrics.addCounterWithExemplar("mcp_tool_calls_total", "Tool calls routed to backends by outcome", 1, exemplarLabels, "tool", name, "outcome", event.Event)
+	rt.webhooks.fire(event)
+	rt.history.add(event)
+	return rt.artifacts.offload(name, resp), err
+}
+
+// route authorizes a tool call, applies session context and forwards it to the backend owning the tool
+func (rt *router) route(ctx context.Context, name string, arguments interface{}) (*mcp.ToolResponse, error) {
+	caller := identityFromContext(ctx)
+	correlationID := correlationIDFromContext(ctx)
+	err := rt.authz.authorize(ctx, name)
+	if err == nil {
+		err = rt.authorizeHost(ctx, name)
+	}
+	if err != nil {
+		rt.audit.record(auditRecord{CorrelationID: correlationID, Identity: caller.Name, Tool: name, Decision: "denied", Error: err.Error()})
+		return nil, err
+	}
+	policy, strict := rt.policies()
+	sessionID := sessionScope(ctx)
+	call := newScriptCall(ctx, name, rt.sessions.inject(sessionID, name, arguments, rt.injections))
+	err = rt.scripts.preRoute(ctx, call)
+	if err == nil {
+		call.arguments, err = rt.sanitizers.sanitize(name, call.arguments)
+	}
+	if err == nil {
+		err = policy.authorize(ctx, name, call.arguments)
+	}
+	if err == nil {
+		err = rt.memory.admit(name)
+	}
+	if err != nil {
+		rt.audit.record(auditRecord{CorrelationID: correlationID, Identity: caller.Name, Tool: name, Decision: "denied", Error: err.Error()})
+		return nil, err
+	}
+
+	// Route to the backend a script chose or the one advertising the tool, or try every backend if none is known to have it
+	owner := rt.registry.owner(name)
+	if call.backend != "" {
+		if owner = rt.registry.named(call.backend); owner == nil {
+			return nil, fmt.Errorf("script routed tool '%s' to unknown server '%s'", name, call.backend)
+		}
+	}
+	// Every check that can refuse the call runs before anything is charged to it
+	var fallback []*mcp.Client
+	if owner != nil {
+		recordBackend(ctx, owner.name)
+		call.backend = owner.name
+		err = rt.registry.maintenance(owner.name)
+	} else if strict {
+		err = fmt.Errorf("unknown tool '%s'", name)
+	} else {
+		// Tools no backend is known to have are tried on every backend that is not in maintenance
+		fallback, err = rt.registry.availableClients()
+	}
+	if err == nil {
+		err = rt.scripts.preForward(ctx, call)
+	}
+	// A call refused by a later check gets its earlier charges back
+	var refundQuota, refundBudgets func()
+	if err == nil {
+		refundQuota, err = rt.quotas.charge(caller.Name, name)
+	}
+	if err == nil {
+		if refundBudgets, err = rt.budgets.charge(name); err != nil {
+			refundQuota()
+		}
+	}
+	if err == nil {
+		if err = rt.spend.charge(ctx, name, call.arguments); err != nil {
+			refundBudgets()
+			refundQuota()
+		}
+	}
+	if err != nil {
+		rt.audit.record(auditRecord{CorrelationID: correlationID, Identity: caller.Name, Tool: name, Decision: "denied", Error: err.Error()})
+		return nil, err
+	}
+
+	if owner != nil {
+		if resp := rt.cache.result(ctx, owner.name, name, call.arguments); resp != nil {
+			rt.audit.record(auditRecord{CorrelationID: correlationID, Identity: caller.Name, Tool: name, Decision: "allowed"})
+			return rt.scripts.postResponse(ctx, call, resp)
+		}
+		client, err := rt.registry.clientFor(caller, sessionID, owner)
+		var release func(time.Duration, error)
+		if err == nil {
+			release, err = owner.concurrency().acquire(ctx)
+		}
+		if err == nil {
+			// A result whose text is normalized or that is cached cannot be relayed undecoded
+			callCtx := ctx
+			if owner.config.Normalize != nil || rt.cache.caches(name) {
+				callCtx = withoutPassthrough(ctx)
+			}
+			var resp *mcp.ToolResponse
+			start := time.Now()
+			owner.active.Add(1)
+			resp, err = callTool(callCtx, client, name, call.arguments)
+			owner.active.Add(-1)
+			owner.config.Normalize.apply(resp)
+			release(time.Since(start), err)
+			rt.observeConcurrency(owner)
+			rt.shadows.mirror(ctx, owner.name, name, call.arguments, resp, err, time.Since(start))
+			if err == nil {
+				rt.cache.storeResult(ctx, owner.name, name, call.arguments, resp)
+				rt.audit.record(auditRecord{CorrelationID: correlationID, Identity: caller.Name, Tool: name, Decision: "allowed"})
+				return rt.scripts.postResponse(ctx, call, resp)
+			}
+		}
+		rt.audit.record(auditRecord{CorrelationID: correlationID, Identity: caller.Name, Tool: name, Decision: "allowed", Error: err.Error()})
+		return nil, fmt.Errorf("tool '%s' failed on '%s': %v", name, owner.name, err)
+	}
+
+	for _, client := range fallback {
+		resp, err := callTool(ctx, client, name, call.arguments)
+		if err == nil {
+			rt.audit.record(auditRecord{CorrelationID: correlationID, Identity: caller.Name, Tool: name, Decision: "allowed"})
+			return rt.scripts.postResponse(ctx, call, resp)
+		}
+	}
+	rt.audit.record(auditRecord{CorrelationID: correlationID, Identity: caller.Name, Tool: name, Decision: "allowed", Error: "method not found"})
+	return &mcp.ToolResponse{
+		Content: []*mcp.Content{
+			{
+				Type: "text",
+				TextContent: &mcp.TextContent{
+					Text: "method not found",
+				},
+			},
+		},
+	}, nil
+}
+
+// catalog lists the backends' tools that the caller in ctx may see, capped by the catalog budget,
+// along with the number of tools left out
+func (rt *router) catalog(ctx context.Context, cursor string) ([]mcp.ToolRetType, int) {
+	var allTools []catalogTool
+	if pinned := rt.snapshots.pinnedCatalog(); pinned != nil {
+		for _, tool := range pinned {
+			config, _ := rt.registry.configured(tool.backend)
+			if rt.exposed(ctx, tool.tool.Name) && listsServer(ctx, config.Tags) {
+				allTools = append(allTools, tool)
+			}
+		}
+	} else {
+		for _, b := range rt.registry.list() {
+			if b.config.ShadowOf != "" || !listsServer(ctx, b.config.Tags) {
+				continue
+			}
+			tools, err := rt.cache.listTools(ctx, b, cursor)
+			if err != nil {
+				continue
+			}
+			for _, tool := range tools.Tools {
+				if !rt.exposed(ctx, tool.Name) {
+					continue
+				}
+				allTools = append(allTools, catalogTool{backend: b.name, tool: tool})
+			}
+		}
+	}
+
+	rt.markUnavailable(allTools)
+	rt.spend.annotate(allTools)
+	// Advertise only as many tools as the host can take, in its language; the others stay callable by name
+	advertised, omitted := applyBudget(allTools, rt.catalogBudget(ctx), rt.usage)
+	return rt.locales.localize(ctx, advertised), omitted
+}
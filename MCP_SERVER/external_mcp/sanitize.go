@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ArgumentSanitizer checks path or URL arguments before they are forwarded, as a second line of
+// defense for filesystem and browser servers that do not check them themselves
+type ArgumentSanitizer struct {
+	// Tools limits the rule to tools matching these patterns; empty applies it to every tool
+	Tools []string `json:"Tools,omitempty"`
+	// Arguments names the arguments holding paths or URLs, as a string or a list of strings
+	Arguments []string `json:"Arguments"`
+	// Type is "path" or "url"
+	Type string `json:"Type"`
+	// Roots are the directories path arguments must stay within; empty allows any path without ".."
+	Roots []string `json:"Roots,omitempty"`
+	// Schemes are the URL schemes allowed; defaults to http and https
+	Schemes []string `json:"Schemes,omitempty"`
+	// Hosts are patterns such as "*.example.com" the URL host must match; empty allows any host
+	Hosts []string `json:"Hosts,omitempty"`
+}
+
+// argumentSanitizers are the configured rules. A nil value forwards arguments unchecked.
+type argumentSanitizers []ArgumentSanitizer
+
+// newArgumentSanitizers validates the rules
+func newArgumentSanitizers(rules []ArgumentSanitizer) (argumentSanitizers, error) {
+	for i, rule := range rules {
+		switch rule.Type {
+		case "path", "url":
+		default:
+			return nil, fmt.Errorf("sanitizer %d has unknown type '%s', expected path or url", i, rule.Type)
+		}
+		if len(rule.Arguments) == 0 {
+			return nil, fmt.Errorf("sanitizer %d names no arguments", i)
+		}
+		for _, root := range rule.Roots {
+			if !filepath.IsAbs(root) {
+				return nil, fmt.Errorf("sanitizer %d root '%s' is not an absolute path", i, root)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// sanitize checks the arguments of a call to tool against every matching rule. It returns the
+// arguments with checked paths cleaned, so the backend receives exactly what was checked.
+func (s argumentSanitizers) sanitize(tool string, arguments interface{}) (interface{}, error) {
+	var args map[string]interface{}
+	for _, rule := range s {
+		if !matchesAny(rule.Tools, tool, true) {
+			continue
+		}
+		if args == nil {
+			var err error
+			if args, err = argumentMap(arguments); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range rule.Arguments {
+			value, ok := args[name]
+			if !ok || value == nil {
+				continue
+			}
+			checked, err := rule.check(value)
+			if err != nil {
+				return nil, fmt.Errorf("argument '%s' of tool '%s' rejected: %v", name, tool, err)
+			}
+			args[name] = checked
+		}
+	}
+	if args == nil {
+		return arguments, nil
+	}
+	return args, nil
+}
+
+// argumentMap returns a copy of the call's arguments as a map
+func argumentMap(arguments interface{}) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	if m, ok := arguments.(map[string]interface{}); ok {
+		for key, value := range m {
+			args[key] = value
+		}
+		return args, nil
+	}
+	if arguments == nil {
+		return args, nil
+	}
+	data, err := json.Marshal(arguments)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &args); err != nil {
+		return nil, fmt.Errorf("arguments are not an object")
+	}
+	return args, nil
+}
+
+// check checks a string or list of strings against the rule
+func (rule ArgumentSanitizer) check(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return rule.checkOne(v)
+	case []interface{}:
+		checked := make([]interface{}, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string")
+			}
+			var err error
+			if checked[i], err = rule.checkOne(s); err != nil {
+				return nil, err
+			}
+		}
+		return checked, nil
+	}
+	return nil, fmt.Errorf("expected a string")
+}
+
+func (rule ArgumentSanitizer) checkOne(value string) (string, error) {
+	if rule.Type == "url" {
+		return value, rule.checkURL(value)
+	}
+	return rule.checkPath(value)
+}
+
+// checkPath rejects paths climbing out with ".." and paths outside the roots, and returns the cleaned path
+func (rule ArgumentSanitizer) checkPath(value string) (string, error) {
+	if strings.ContainsRune(value, 0) {
+		return "", fmt.Errorf("path contains a NUL byte")
+	}
+	for _, segment := range strings.FieldsFunc(value, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return "", fmt.Errorf("path '%s' contains '..'", value)
+		}
+	}
+	cleaned := filepath.Clean(value)
+	if len(rule.Roots) == 0 {
+		return cleaned, nil
+	}
+	if !filepath.IsAbs(cleaned) {
+		return "", fmt.Errorf("path '%s' is not absolute", value)
+	}
+	for _, root := range rule.Roots {
+		root = filepath.Clean(root)
+		if cleaned == root || strings.HasPrefix(cleaned, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return cleaned, nil
+		}
+	}
+	return "", fmt.Errorf("path '%s' is outside the allowed roots", value)
+}
+
+// checkURL rejects URLs with a scheme or host that is not allowed
+func (rule ArgumentSanitizer) checkURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	schemes := rule.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	if !containsString(schemes, strings.ToLower(u.Scheme)) {
+		return fmt.Errorf("URL scheme '%s' is not allowed", u.Scheme)
+	}
+	if len(rule.Hosts) == 0 {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range rule.Hosts {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched && host != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("URL host '%s' is not allowed", u.Hostname())
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// ScheduleConfig calls a tool periodically, either on a cron expression or at a fixed interval.
+// The latest result is readable as the resource schedule://<name>/latest.
+type ScheduleConfig struct {
+	Name      string                 `json:"Name"`
+	Tool      string                 `json:"Tool"`
+	Arguments map[string]interface{} `json:"Arguments,omitempty"`
+	// Cron is a five-field "minute hour day-of-month month day-of-week" expression, e.g. "0 * * * *"
+	Cron     string   `json:"Cron,omitempty"`
+	Interval Duration `json:"Interval,omitempty"`
+	// Roles are held by the scheduled calls when Auth is configured
+	Roles []string `json:"Roles,omitempty"`
+}
+
+// scheduleResult is the outcome of the latest run of a schedule
+type scheduleResult struct {
+	Time    time.Time      `json:"time"`
+	Tool    string         `json:"tool"`
+	Content []*mcp.Content `json:"content,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// scheduler runs the configured schedules through the router and keeps their latest results
+type scheduler struct {
+	rt    *router
+	clock clock
+
+	mu      sync.RWMutex
+	results map[string]scheduleResult
+}
+
+func newScheduler(rt *router, clock clock) *scheduler {
+	return &scheduler{rt: rt, clock: clock, results: make(map[string]scheduleResult)}
+}
+
+// start validates the schedules, registers a resource for each and runs them in the background
+func (s *scheduler) start(server *mcp.Server, schedules []ScheduleConfig) error {
+	for _, schedule := range schedules {
+		next, err := scheduleFunc(schedule)
+		if err != nil {
+			return fmt.Errorf("invalid schedule '%s': %v", schedule.Name, err)
+		}
+
+		uri := fmt.Sprintf("schedule://%s/latest", schedule.Name)
+		description := fmt.Sprintf("Latest result of the scheduled call to %s", schedule.Tool)
+		if err := server.RegisterResource(uri, schedule.Name, description, "application/json", s.handleResult(uri, schedule.Name)); err != nil {
+			return fmt.Errorf("failed to register resource for schedule '%s': %v", schedule.Name, err)
+		}
+
+		log.Printf("Scheduled '%s' calling tool '%s'", schedule.Name, schedule.Tool)
+		go s.run(schedule, next)
+	}
+	return nil
+}
+
+// run calls the schedule's tool every time next says so, one run at a time
+func (s *scheduler) run(schedule ScheduleConfig, next func(time.Time) time.Time) {
+	ctx := contextWithIdentity(context.Background(), identity{Name: "schedule:" + schedule.Name, Roles: schedule.Roles})
+	arguments := schedule.Arguments
+	if arguments == nil {
+		arguments = map[string]interface{}{}
+	}
+	for {
+		now := s.clock.Now()
+		<-s.clock.After(next(now).Sub(now))
+
+		result := scheduleResult{Time: s.clock.Now().UTC(), Tool: schedule.Tool}
+		resp, err := s.rt.call(ctx, schedule.Tool, arguments)
+		if err != nil {
+			log.Printf("Scheduled call '%s' failed: %v", schedule.Name, err)
+			result.Error = err.Error()
+		} else {
+			result.Content = contentOf(resp)
+		}
+
+		s.mu.Lock()
+		s.results[schedule.Name] = result
+		s.mu.Unlock()
+	}
+}
+
+func (s *scheduler) handleResult(uri string, name string) interface{} {
+	return func(ctx context.Context) (*mcp.ResourceResponse, error) {
+		s.mu.RLock()
+		result, ok := s.results[name]
+		s.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("schedule '%s' has not run yet", name)
+		}
+
+		resultJSON, err := json.Marshal(result)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal schedule result: %v", err)
+		}
+		return mcp.NewResourceResponse(mcp.NewTextEmbeddedResource(uri, string(resultJSON), "application/json")), nil
+	}
+}
+
+// scheduleFunc returns a function yielding the schedule's next run time after a given time
+func scheduleFunc(schedule ScheduleConfig) (func(time.Time) time.Time, error) {
+	if schedule.Name == "" || schedule.Tool == "" {
+		return nil, fmt.Errorf("Name and Tool are required")
+	}
+	switch {
+	case schedule.Cron != "" && schedule.Interval != 0:
+		return nil, fmt.Errorf("only one of Cron and Interval may be set")
+	case schedule.Cron != "":
+		cron, err := parseCron(schedule.Cron)
+		if err != nil {
+			return nil, err
+		}
+		return cron.next, nil
+	case schedule.Interval > 0:
+		interval := time.Duration(schedule.Interval)
+		return func(t time.Time) time.Time { return t.Add(interval) }, nil
+	default:
+		return nil, fmt.Errorf("either Cron or a positive Interval is required")
+	}
+}
+
+// cronSchedule is a parsed five-field cron expression; each field is a bit set of the allowed values
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar record unrestricted day fields, which decide how the two day fields combine
+	domStar, dowStar bool
+}
+
+// cronFields lists the bounds of each cron field in order
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day-of-month", 1, 31},
+	{"month", 1, 12},
+	{"day-of-week", 0, 6},
+}
+
+// parseCron parses an expression of five space-separated fields, each a comma-separated list of
+// "*", values, ranges "a-b" and steps "*/n" or "a-b/n"
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression '%s' must have %d fields", expr, len(cronFields))
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s field '%s': %v", cronFields[i].name, field, err)
+		}
+		sets[i] = set
+	}
+	return &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step '%s'", part[i+1:])
+			}
+			rangePart = part[:i]
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", bounds[0])
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value '%s'", bounds[1])
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("'%s' is outside %d-%d", rangePart, min, max)
+		}
+
+		for value := low; value <= high; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+	return set, nil
+}
+
+// next returns the first whole minute after t matching the schedule, searching up to five years ahead
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return limit
+}
+
+// dayMatches applies the cron rule that restricted day-of-month and day-of-week fields match either day
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	mcp "github.com/metoro-io/mcp-golang"
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// maxScriptSteps bounds the work a single hook may do, so a runaway script cannot stall calls
+const maxScriptSteps = 1000000
+
+// ScriptConfig attaches a Starlark script to tool call events. The script defines any of:
+//
+//	pre_route(call)             may return {"arguments": ..., "backend": ...} to rewrite the arguments or pick the backend
+//	pre_forward(call)           may return {"arguments": ...} once call["backend"] is known
+//	post_response(call, result) may return a replacement result
+//
+// call is a dict with tool, identity, tenant, correlation_id, backend and arguments. A hook vetoes
+// the call with fail("reason"), and the json module is available for encoding values.
+type ScriptConfig struct {
+	Path string `json:"Path"`
+	// Tools limits the script to tools matching these patterns; empty applies it to every tool
+	Tools []string `json:"Tools,omitempty"`
+}
+
+// script is a loaded script together with the hooks it defines
+type script struct {
+	path    string
+	tools   []string
+	globals starlark.StringDict
+}
+
+// scriptHooks are the loaded scripts, run in configuration order. A nil value runs nothing.
+type scriptHooks []*script
+
+// scriptCall is the state of a call that scripts see and may change
+type scriptCall struct {
+	tool, identity, tenant, correlationID string
+	// backend is the backend the call goes to, "" while it is not chosen
+	backend   string
+	arguments interface{}
+}
+
+// loadScripts loads the configured scripts
+func loadScripts(configs []ScriptConfig) (scriptHooks, error) {
+	var hooks scriptHooks
+	for _, cfg := range configs {
+		thread := &starlark.Thread{Name: cfg.Path, Print: scriptPrint}
+		globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, cfg.Path, nil, starlark.StringDict{"json": starlarkjson.Module})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load script '%s': %v", cfg.Path, err)
+		}
+		for _, hook := range []string{"pre_route", "pre_forward", "post_response"} {
+			if fn, ok := globals[hook]; ok {
+				if _, callable := fn.(starlark.Callable); !callable {
+					return nil, fmt.Errorf("script '%s' defines %s but it is not a function", cfg.Path, hook)
+				}
+			}
+		}
+		hooks = append(hooks, &script{path: cfg.Path, tools: cfg.Tools, globals: globals})
+	}
+	return hooks, nil
+}
+
+func scriptPrint(thread *starlark.Thread, msg string) {
+	log.Printf("Script '%s': %s", thread.Name, msg)
+}
+
+// newScriptCall describes a call to the tool by the caller in ctx
+func newScriptCall(ctx context.Context, tool string, arguments interface{}) *scriptCall {
+	caller := identityFromContext(ctx)
+	return &scriptCall{tool: tool, identity: caller.Name, tenant: caller.Tenant, correlationID: correlationIDFromContext(ctx), arguments: arguments}
+}
+
+// preRoute runs the pre_route hooks, which may rewrite the arguments and choose the backend
+func (h scriptHooks) preRoute(ctx context.Context, call *scriptCall) error {
+	return h.runCallHook(ctx, "pre_route", call, true)
+}
+
+// preForward runs the pre_forward hooks once the backend is chosen, which may rewrite the arguments
+func (h scriptHooks) preForward(ctx context.Context, call *scriptCall) error {
+	return h.runCallHook(ctx, "pre_forward", call, false)
+}
+
+func (h scriptHooks) runCallHook(ctx context.Context, hook string, call *scriptCall, mayRoute bool) error {
+	for _, s := range h {
+		fn := s.hook(hook, call.tool)
+		if fn == nil {
+			continue
+		}
+		value, err := s.call(ctx, fn, call, nil)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			continue
+		}
+		update, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("script '%s': %s must return a dict or None", s.path, hook)
+		}
+		if arguments, ok := update["arguments"]; ok {
+			call.arguments = arguments
+		}
+		if backend, ok := update["backend"].(string); ok {
+			if !mayRoute {
+				return fmt.Errorf("script '%s': %s cannot choose the backend", s.path, hook)
+			}
+			call.backend = backend
+		}
+	}
+	return nil
+}
+
+// postResponse runs the post_response hooks, which may replace the result
+func (h scriptHooks) postResponse(ctx context.Context, call *scriptCall, resp *mcp.ToolResponse) (*mcp.ToolResponse, error) {
+	for _, s := range h {
+		fn := s.hook("post_response", call.tool)
+		if fn == nil || resp == nil {
+			continue
+		}
+		value, err := s.call(ctx, fn, call, resp)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		var replaced mcp.ToolResponse
+		if err := json.Unmarshal(data, &replaced); err != nil {
+			return nil, fmt.Errorf("script '%s': post_response returned an invalid result: %v", s.path, err)
+		}
+		resp = &replaced
+	}
+	return resp, nil
+}
+
+// hook returns the named hook if the script defines it and applies to the tool
+func (s *script) hook(name, tool string) starlark.Value {
+	if !matchesAny(s.tools, tool, true) {
+		return nil
+	}
+	return s.globals[name]
+}
+
+// call calls a hook with the call and, for post_response, the result, and returns its decoded
+// return value, or nil for None. A fail() in the script vetoes the call.
+func (s *script) call(ctx context.Context, fn starlark.Value, call *scriptCall, resp *mcp.ToolResponse) (interface{}, error) {
+	thread := &starlark.Thread{Name: s.path, Print: scriptPrint}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	stop := context.AfterFunc(ctx, func() { thread.Cancel("call canceled") })
+	defer stop()
+
+	args := starlark.Tuple{}
+	callValue, err := toStarlark(thread, map[string]interface{}{
+		"tool":           call.tool,
+		"identity":       call.identity,
+		"tenant":         call.tenant,
+		"correlation_id": call.correlationID,
+		"backend":        call.backend,
+		"arguments":      call.arguments,
+	})
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, callValue)
+	if resp != nil {
+		result, err := toStarlark(thread, resp)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, result)
+	}
+
+	value, err := starlark.Call(thread, fn, args, nil)
+	if err != nil {
+		var evalErr *starlark.EvalError
+		if errors.As(err, &evalErr) {
+			if reason, ok := strings.CutPrefix(evalErr.Msg, "fail: "); ok {
+				return nil, fmt.Errorf("call to '%s' vetoed by script '%s': %s", call.tool, s.path, reason)
+			}
+		}
+		return nil, fmt.Errorf("script '%s' failed: %v", s.path, err)
+	}
+	if value == starlark.None {
+		return nil, nil
+	}
+	return fromStarlark(thread, value)
+}
+
+// toStarlark converts a Go value to Starlark through JSON
+func toStarlark(thread *starlark.Thread, value interface{}) (starlark.Value, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.Call(thread, starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(data)}, nil)
+}
+
+// fromStarlark converts a Starlark value to Go through JSON
+func fromStarlark(thread *starlark.Thread, value starlark.Value) (interface{}, error) {
+	encoded, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], starlark.Tuple{value}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(encoded.(starlark.String)), &decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
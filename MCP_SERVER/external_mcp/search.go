@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// defaultSearchLimit is the number of tools tools/search returns when no limit is given
+const defaultSearchLimit = 10
+
+// ToolSearchConfig ranks tools for tools/search by embedding similarity instead of keywords
+type ToolSearchConfig struct {
+	// EmbeddingsURL is an OpenAI-compatible embeddings endpoint, e.g. https://api.openai.com/v1/embeddings
+	EmbeddingsURL string `json:"EmbeddingsURL"`
+	Model         string `json:"Model"`
+	APIKey        string `json:"APIKey,omitempty"`
+}
+
+// SearchToolsRequest asks for the tools best suited to a task
+type SearchToolsRequest struct {
+	Query string `json:"query" jsonschema:"required,description=Natural-language description of the task to find tools for"`
+	Limit int    `json:"limit" jsonschema:"description=Maximum number of tools to return, 10 by default"`
+}
+
+// searchHit is a tool ranked for a query
+type searchHit struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Score       float64     `json:"score"`
+	InputSchema interface{} `json:"inputSchema"`
+}
+
+// toolSearch ranks tools by cosine similarity of embeddings, caching the embedding of every tool
+// definition. Without an embeddings endpoint, or when it fails, tools are ranked by keywords.
+// A nil tool search always ranks by keywords.
+type toolSearch struct {
+	config ToolSearchConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	vectors map[string][]float64
+}
+
+func newToolSearch(cfg *ToolSearchConfig) *toolSearch {
+	if cfg == nil || cfg.EmbeddingsURL == "" {
+		return nil
+	}
+	return &toolSearch{
+		config:  *cfg,
+		client:  &http.Client{Timeout: 15 * time.Second},
+		vectors: make(map[string][]float64),
+	}
+}
+
+// rank orders tools by relevance to query, best first
+func (s *toolSearch) rank(ctx context.Context, query string, tools []mcp.ToolRetType) []searchHit {
+	documents := make([]string, len(tools))
+	for i, tool := range tools {
+		documents[i] = toolDocument(tool)
+	}
+
+	var scores []float64
+	if s != nil {
+		var err error
+		if scores, err = s.similarities(ctx, query, documents); err != nil {
+			log.Printf("Falling back to keyword tool search: %v", err)
+		}
+	}
+	if scores == nil {
+		scores = keywordScores(query, documents)
+	}
+
+	hits := make([]searchHit, 0, len(tools))
+	for i, tool := range tools {
+		if scores[i] <= 0 {
+			continue
+		}
+		hit := searchHit{Name: tool.Name, Score: math.Round(scores[i]*1000) / 1000, InputSchema: tool.InputSchema}
+		if tool.Description != nil {
+			hit.Description = *tool.Description
+		}
+		hits = append(hits, hit)
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	return hits
+}
+
+// toolDocument is the text a tool is matched on; the name is repeated to weigh it above the description
+func toolDocument(tool mcp.ToolRetType) string {
+	document := tool.Name + " " + tool.Name
+	if tool.Description != nil {
+		document += " " + *tool.Description
+	}
+	return document
+}
+
+// similarities returns the cosine similarity between the query and every document
+func (s *toolSearch) similarities(ctx context.Context, query string, documents []string) ([]float64, error) {
+	s.mu.Lock()
+	var missing []string
+	for _, document := range documents {
+		if _, ok := s.vectors[document]; !ok {
+			missing = append(missing, document)
+		}
+	}
+	s.mu.Unlock()
+
+	vectors, err := s.embed(ctx, append([]string{query}, missing...))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, document := range missing {
+		s.vectors[document] = vectors[i+1]
+	}
+	scores := make([]float64, len(documents))
+	for i, document := range documents {
+		scores[i] = cosine(vectors[0], s.vectors[document])
+	}
+	return scores, nil
+}
+
+// embed fetches the embeddings of texts, in order
+func (s *toolSearch) embed(ctx context.Context, texts []string) ([][]float64, error) {
+	body, err := json.Marshal(map[string]interface{}{"model": s.config.Model, "input": texts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.EmbeddingsURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.APIKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from embeddings endpoint: %s", resp.Status)
+	}
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode embeddings: %v", err)
+	}
+	vectors := make([][]float64, len(texts))
+	for _, item := range result.Data {
+		if item.Index >= 0 && item.Index < len(vectors) {
+			vectors[item.Index] = item.Embedding
+		}
+	}
+	for _, vector := range vectors {
+		if vector == nil {
+			return nil, fmt.Errorf("embeddings endpoint returned %d of %d embeddings", len(result.Data), len(texts))
+		}
+	}
+	return vectors, nil
+}
+
+func cosine(a, b []float64) float64 {
+	var dot, normA, normB float64
+	for i := 0; i < len(a) && i < len(b); i++ {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// keywordScores ranks documents against the query with BM25
+func keywordScores(query string, documents []string) []float64 {
+	const k1, b = 1.2, 0.75
+
+	terms := make([]map[string]int, len(documents))
+	frequency := make(map[string]int)
+	totalLength := 0
+	for i, document := range documents {
+		terms[i] = make(map[string]int)
+		for _, term := range searchTerms(document) {
+			if terms[i][term] == 0 {
+				frequency[term]++
+			}
+			terms[i][term]++
+			totalLength++
+		}
+	}
+	averageLength := float64(totalLength) / math.Max(float64(len(documents)), 1)
+
+	scores := make([]float64, len(documents))
+	for _, term := range searchTerms(query) {
+		if frequency[term] == 0 {
+			continue
+		}
+		idf := math.Log(1 + (float64(len(documents))-float64(frequency[term])+0.5)/(float64(frequency[term])+0.5))
+		for i := range documents {
+			count := float64(terms[i][term])
+			if count == 0 {
+				continue
+			}
+			length := 0
+			for _, n := range terms[i] {
+				length += n
+			}
+			scores[i] += idf * count * (k1 + 1) / (count + k1*(1-b+b*float64(length)/averageLength))
+		}
+	}
+	return scores
+}
+
+// stopWords are too common to tell tools apart
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"for": true, "from": true, "i": true, "in": true, "is": true, "it": true, "me": true, "my": true,
+	"of": true, "on": true, "or": true, "the": true, "this": true, "to": true, "what": true, "with": true,
+}
+
+// searchTerms splits text into lowercase words without stop words, breaking snake_case and camelCase
+// names apart and dropping a plural "s" so that "files" matches "read_file"
+func searchTerms(text string) []string {
+	var words []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			term := strings.ToLower(string(word))
+			if stopWords[term] {
+				word = word[:0]
+				return
+			}
+			if len(term) > 3 && strings.HasSuffix(term, "s") && !strings.HasSuffix(term, "ss") {
+				term = term[:len(term)-1]
+			}
+			words = append(words, term)
+			word = word[:0]
+		}
+	}
+	for _, r := range text {
+		switch {
+		case unicode.IsUpper(r) && len(word) > 0 && unicode.IsLower(word[len(word)-1]):
+			flush()
+			word = append(word, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return words
+}
+
+// handleSearchTools ranks the aggregated tools the caller may use against a task description
+func handleSearchTools(rt *router) interface{} {
+	return func(ctx context.Context, args SearchToolsRequest) (*mcp.ToolResponse, error) {
+		var tools []mcp.ToolRetType
+		for _, b := range rt.registry.list() {
+			for _, tool := range b.listedTools() {
+				if rt.exposed(ctx, tool.Name) {
+					tools = append(tools, tool)
+				}
+			}
+		}
+
+		limit := args.Limit
+		if limit <= 0 {
+			limit = defaultSearchLimit
+		}
+		hits := rt.search.rank(ctx, args.Query, tools)
+		if len(hits) > limit {
+			hits = hits[:limit]
+		}
+
+		hitsJSON, err := json.Marshal(map[string]interface{}{"tools": hits})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal tools: %v", err)
+		}
+		return mcp.NewToolResponse(mcp.NewTextContent(string(hitsJSON))), nil
+	}
+}
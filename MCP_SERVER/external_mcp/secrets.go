@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// secretProvider fetches secret values referenced from the config as ${secret:<provider>:<ref>}
+type secretProvider interface {
+	resolve(ref string) (string, error)
+}
+
+// secretProviders holds the supported providers keyed by the name used in placeholders
+var secretProviders = map[string]secretProvider{
+	"file":   fileSecretProvider{},
+	"vault":  vaultSecretProvider{},
+	"aws-sm": awsSecretsManagerProvider{},
+}
+
+var secretHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// resolveSecret resolves a "<provider>:<ref>" secret reference
+func resolveSecret(reference string) (string, error) {
+	providerName, ref, ok := strings.Cut(reference, ":")
+	if !ok || ref == "" {
+		return "", fmt.Errorf("invalid secret reference '%s', expected <provider>:<ref>", reference)
+	}
+	provider, ok := secretProviders[providerName]
+	if !ok {
+		return "", fmt.Errorf("unknown secret provider '%s'", providerName)
+	}
+	return provider.resolve(ref)
+}
+
+// selectSecretField picks a field from a secret holding several key/value pairs. Without an explicit
+// field the secret must hold exactly one value.
+func selectSecretField(values map[string]interface{}, field string) (string, error) {
+	if field == "" {
+		if len(values) != 1 {
+			return "", fmt.Errorf("secret holds %d values, select one with #field", len(values))
+		}
+		for _, value := range values {
+			return fmt.Sprint(value), nil
+		}
+	}
+	value, ok := values[field]
+	if !ok {
+		return "", fmt.Errorf("secret has no field '%s'", field)
+	}
+	return fmt.Sprint(value), nil
+}
+
+// fileSecretProvider reads a secret from a file, e.g. ${secret:file:/run/secrets/api_key}
+type fileSecretProvider struct{}
+
+func (fileSecretProvider) resolve(ref string) (string, error) {
+	data, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// vaultSecretProvider reads a secret from HashiCorp Vault using VAULT_ADDR and VAULT_TOKEN,
+// e.g. ${secret:vault:secret/data/mcp#api_key}. Both KV v1 and v2 responses are understood.
+type vaultSecretProvider struct{}
+
+func (vaultSecretProvider) resolve(ref string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	token := os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	path, field, _ := strings.Cut(ref, "#")
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := secretHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for '%s'", resp.Status, path)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("failed to decode vault response: %v", err)
+	}
+
+	// KV v2 nests the values under data.data
+	values := secret.Data
+	if nested, ok := values["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := values["metadata"]; hasMetadata {
+			values = nested
+		}
+	}
+	return selectSecretField(values, field)
+}
+
+// awsSecretsManagerProvider reads a secret from AWS Secrets Manager using the standard AWS_* environment
+// credentials, e.g. ${secret:aws-sm:prod/mcp#api_key}. JSON secrets can be narrowed with #field.
+type awsSecretsManagerProvider struct{}
+
+func (awsSecretsManagerProvider) resolve(ref string) (string, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if region == "" || accessKey == "" || secretKey == "" {
+		return "", fmt.Errorf("AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	name, field, _ := strings.Cut(ref, "#")
+
+	body, err := json.Marshal(map[string]string{"SecretId": name})
+	if err != nil {
+		return "", err
+	}
+	host := "secretsmanager." + region + ".amazonaws.com"
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWSRequest(req, body, region, "secretsmanager", accessKey, secretKey, time.Now().UTC())
+
+	resp, err := secretHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("secrets manager returned %s: %s", resp.Status, message)
+	}
+
+	var secret struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("failed to decode secrets manager response: %v", err)
+	}
+	if field == "" {
+		return secret.SecretString, nil
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(secret.SecretString), &values); err != nil {
+		return "", fmt.Errorf("secret '%s' is not a JSON object: %v", name, err)
+	}
+	return selectSecretField(values, field)
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header to req
+func signAWSRequest(req *http.Request, body []byte, region, service, accessKey, secretKey string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	// Sign the host and every content-type/x-amz-* header
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		lower := strings.ToLower(key)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(values[0])
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
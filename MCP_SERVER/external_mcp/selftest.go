@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// SelfTestConfig controls how the selftest command exercises the aggregated tools
+type SelfTestConfig struct {
+	// Fixtures are the arguments to call a tool with, keyed by tool name, instead of synthetic ones
+	Fixtures map[string]interface{} `json:"Fixtures,omitempty"`
+	// Skip lists tools that must never be called by the self-test, e.g. ones with side effects
+	Skip []string `json:"Skip,omitempty"`
+}
+
+// selfTestResult is the outcome of calling one tool
+type selfTestResult struct {
+	backend  string
+	tool     string
+	status   string
+	duration time.Duration
+	err      error
+}
+
+// runSelfTest implements the selftest command, calling every aggregated tool once and reporting
+// pass or fail per tool. It exits with status 1 when any tool fails.
+func runSelfTest(configPath string, profile string, args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 30*time.Second, "How long to wait for each tool call")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	cfg := loadConfig(configPath)
+	cfg, err := applyProfile(cfg, profile)
+	if err != nil {
+		log.Fatalf("Failed to apply profile: %v", err)
+	}
+
+	// Backend logging would drown the report
+	log.SetOutput(io.Discard)
+	registry := newBackendRegistry(mcp.ClientInfo{Name: "mcp-service", Version: "1.0.0"})
+	applyErr := registry.apply(cfg)
+	results := selfTest(registry, cfg.SelfTest, *timeout)
+	registry.shutdown()
+	log.SetOutput(os.Stderr)
+
+	if applyErr != nil {
+		fmt.Printf("Some servers failed to start: %v\n", applyErr)
+	}
+	failed := 0
+	for _, result := range results {
+		line := fmt.Sprintf("%-4s %s/%s", result.status, result.backend, result.tool)
+		if result.status != "SKIP" {
+			line += fmt.Sprintf(" (%s)", result.duration.Round(time.Millisecond))
+		}
+		if result.err != nil {
+			line += ": " + result.err.Error()
+			failed++
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("%d tools, %d failed\n", len(results), failed)
+	if failed > 0 || applyErr != nil {
+		os.Exit(1)
+	}
+}
+
+// selfTest calls every tool of every backend with its fixture or with synthetic arguments
+func selfTest(registry *backendRegistry, cfg *SelfTestConfig, timeout time.Duration) []selfTestResult {
+	if cfg == nil {
+		cfg = &SelfTestConfig{}
+	}
+	skip := make(map[string]bool, len(cfg.Skip))
+	for _, name := range cfg.Skip {
+		skip[name] = true
+	}
+
+	var results []selfTestResult
+	for _, b := range registry.list() {
+		tools := b.listedTools()
+		sort.Slice(tools, func(i, j int) bool { return tools[i].Name < tools[j].Name })
+		for _, tool := range tools {
+			result := selfTestResult{backend: b.name, tool: tool.Name, status: "SKIP"}
+			if skip[tool.Name] {
+				results = append(results, result)
+				continue
+			}
+
+			arguments, ok := cfg.Fixtures[tool.Name]
+			if !ok {
+				arguments = syntheticArguments(tool.InputSchema)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			start := time.Now()
+			_, result.err = callTool(ctx, b.client, tool.Name, arguments)
+			result.duration = time.Since(start)
+			cancel()
+
+			result.status = "PASS"
+			if result.err != nil {
+				result.status = "FAIL"
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// syntheticArguments builds harmless arguments satisfying an object schema: only required
+// properties are set, to their default, first enum value or smallest valid value
+func syntheticArguments(schema interface{}) map[string]interface{} {
+	arguments := make(map[string]interface{})
+	object, _ := schema.(map[string]interface{})
+	properties, _ := object["properties"].(map[string]interface{})
+	required, _ := object["required"].([]interface{})
+	for _, name := range required {
+		key, ok := name.(string)
+		if !ok {
+			continue
+		}
+		arguments[key] = syntheticValue(properties[key])
+	}
+	return arguments
+}
+
+// syntheticValue returns the smallest value a property schema accepts
+func syntheticValue(schema interface{}) interface{} {
+	property, _ := schema.(map[string]interface{})
+	if value, ok := property["default"]; ok {
+		return value
+	}
+	if value, ok := property["const"]; ok {
+		return value
+	}
+	if values, ok := property["enum"].([]interface{}); ok && len(values) > 0 {
+		return values[0]
+	}
+
+	kind, _ := property["type"].(string)
+	if kinds, ok := property["type"].([]interface{}); ok && len(kinds) > 0 {
+		kind, _ = kinds[0].(string)
+	}
+	switch kind {
+	case "string":
+		length := 4
+		if minLength, ok := property["minLength"].(float64); ok && int(minLength) > length {
+			length = int(minLength)
+		}
+		if maxLength, ok := property["maxLength"].(float64); ok && int(maxLength) < length {
+			length = int(maxLength)
+		}
+		return strings.Repeat("t", length)
+	case "integer", "number":
+		if minimum, ok := property["minimum"].(float64); ok {
+			return minimum
+		}
+		return 0
+	case "boolean":
+		return false
+	case "array":
+		return []interface{}{}
+	case "object":
+		return syntheticArguments(property)
+	default:
+		return nil
+	}
+}
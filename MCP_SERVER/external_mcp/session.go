@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// ContextInjection fills arguments of proxied calls from the calling session's context
+type ContextInjection struct {
+	// Tools limits the injection to tools matching these patterns; empty applies it to every tool
+	Tools []string `json:"Tools,omitempty"`
+	// Fields maps argument names to the session context keys they are filled from
+	Fields map[string]string `json:"Fields"`
+	// Override replaces arguments the caller did provide instead of only filling missing ones
+	Override bool `json:"Override,omitempty"`
+}
+
+type sessionKey struct{}
+
+// contextWithSession returns a copy of ctx carrying the downstream session id
+func contextWithSession(ctx context.Context, sessionID string) context.Context {
+	if sessionID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, sessionKey{}, sessionID)
+}
+
+// sessionIDFromContext returns the downstream session id, falling back to the caller's identity
+// for transports without explicit sessions (stdio has exactly one)
+func sessionIDFromContext(ctx context.Context) string {
+	if sessionID, ok := ctx.Value(sessionKey{}).(string); ok {
+		return sessionID
+	}
+	return identityFromContext(ctx).Name
+}
+
+// sessionScope returns the key per-session state of the caller is kept under: the downstream session
+// id within the authenticated identity. A session id is only ever looked up among the sessions of the
+// identity presenting it, so neither another caller's session id nor an identity name sent as the
+// session id reaches someone else's state.
+func sessionScope(ctx context.Context) string {
+	scope := strconv.Quote(identityFromContext(ctx).Name)
+	if sessionID, ok := ctx.Value(sessionKey{}).(string); ok {
+		scope += "/" + sessionID
+	}
+	return scope
+}
+
+// sessionStore keeps the context set by each downstream session, by session scope
+type sessionStore struct {
+	mu       sync.RWMutex
+	contexts map[string]map[string]string
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{contexts: make(map[string]map[string]string)}
+}
+
+// set merges values into the session's context; empty values remove keys
+func (s *sessionStore) set(sessionID string, values map[string]string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.contexts[sessionID]
+	if current == nil {
+		current = make(map[string]string)
+		s.contexts[sessionID] = current
+	}
+	for key, value := range values {
+		if value == "" {
+			delete(current, key)
+			continue
+		}
+		current[key] = value
+	}
+
+	snapshot := make(map[string]string, len(current))
+	for key, value := range current {
+		snapshot[key] = value
+	}
+	return snapshot
+}
+
+// clear forgets the session's context
+func (s *sessionStore) clear(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.contexts, sessionID)
+}
+
+// inject fills the configured argument fields of a call to tool from the session's context
+func (s *sessionStore) inject(sessionID string, tool string, arguments interface{}, injections []ContextInjection) interface{} {
+	if len(injections) == 0 {
+		return arguments
+	}
+
+	s.mu.RLock()
+	values := s.contexts[sessionID]
+	s.mu.RUnlock()
+	if len(values) == 0 {
+		return arguments
+	}
+
+	args, ok := arguments.(map[string]interface{})
+	if !ok {
+		if arguments != nil {
+			return arguments
+		}
+		args = make(map[string]interface{})
+	}
+
+	injected := make(map[string]interface{}, len(args))
+	for key, value := range args {
+		injected[key] = value
+	}
+	for _, injection := range injections {
+		if !matchesAny(injection.Tools, tool, true) {
+			continue
+		}
+		for field, key := range injection.Fields {
+			value, ok := values[key]
+			if !ok {
+				continue
+			}
+			if _, provided := injected[field]; provided && !injection.Override {
+				continue
+			}
+			injected[field] = value
+		}
+	}
+	return injected
+}
+
+// matchesAny reports whether name matches one of the patterns, or whether no patterns were given at all
+func matchesAny(patterns []string, name string, emptyMatches bool) bool {
+	if len(patterns) == 0 {
+		return emptyMatches
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+type SetContextRequest struct {
+	Context map[string]string `json:"context" jsonschema:"required,description=Session values such as user_id or workspace_root; an empty value removes the key"`
+}
+
+func handleSetContext(rt *router) interface{} {
+	return func(ctx context.Context, args SetContextRequest) (*mcp.ToolResponse, error) {
+		current := rt.sessions.set(sessionScope(ctx), args.Context)
+
+		keys := make([]string, 0, len(current))
+		for key := range current {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return mcp.NewToolResponse(mcp.NewTextContent(fmt.Sprintf("Session context keys: %s", strings.Join(keys, ", ")))), nil
+	}
+}
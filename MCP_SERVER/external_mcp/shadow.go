@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// shadowTimeout bounds a mirrored call, which no caller is waiting for
+const shadowTimeout = time.Minute
+
+// shadowRecord compares a call's response from its primary server with the response from a shadow
+type shadowRecord struct {
+	Time          time.Time `json:"time"`
+	Tool          string    `json:"tool"`
+	Primary       string    `json:"primary"`
+	Shadow        string    `json:"shadow"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	Identity      string    `json:"identity,omitempty"`
+	Session       string    `json:"session,omitempty"`
+	// Outcome is "match" when both servers returned the same result or both failed, "mismatch" otherwise
+	Outcome         string          `json:"outcome"`
+	PrimaryDuration string          `json:"primaryDuration"`
+	ShadowDuration  string          `json:"shadowDuration"`
+	PrimaryResult   json.RawMessage `json:"primaryResult,omitempty"`
+	ShadowResult    json.RawMessage `json:"shadowResult,omitempty"`
+	PrimaryError    string          `json:"primaryError,omitempty"`
+	ShadowError     string          `json:"shadowError,omitempty"`
+}
+
+// shadowMirror copies calls to the shadows of their server and records how the responses compare.
+// A nil mirror copies nothing.
+type shadowMirror struct {
+	registry *backendRegistry
+	metrics  *metrics
+	wg       sync.WaitGroup
+	// data decides whether the compared responses are recorded
+	data *DataHandlingConfig
+	log  *recordLog
+}
+
+// newShadowMirror returns a mirror for the registry's shadow servers, appending its records to
+// path, or logging mismatches only when path is empty
+func newShadowMirror(path string, registry *backendRegistry, metrics *metrics, data *DataHandlingConfig) (*shadowMirror, error) {
+	m := &shadowMirror{registry: registry, metrics: metrics, data: data}
+	if path != "" {
+		records, err := openRecordLog(path)
+		if err != nil {
+			return nil, err
+		}
+		m.log = records
+	}
+	return m, nil
+}
+
+// shadows returns the running shadows of the primary server that mirror the tool
+func (m *shadowMirror) shadows(primary, tool string) []*backend {
+	if m == nil {
+		return nil
+	}
+	var shadows []*backend
+	for _, b := range m.registry.list() {
+		if b.config.ShadowOf != "" && (primary == "" || b.config.ShadowOf == primary) && matchesAny(b.config.ShadowTools, tool, true) {
+			shadows = append(shadows, b)
+		}
+	}
+	return shadows
+}
+
+// mirrors reports whether calls to the tool may be mirrored, in which case their results must be
+// decoded rather than relayed raw so they can be compared
+func (m *shadowMirror) mirrors(tool string) bool {
+	return len(m.shadows("", tool)) > 0
+}
+
+// mirror calls the tool on every shadow of the primary server in the background and records how
+// their responses compare with the primary's
+func (m *shadowMirror) mirror(ctx context.Context, primary, tool string, arguments interface{}, resp *mcp.ToolResponse, err error, duration time.Duration) {
+	for _, shadow := range m.shadows(primary, tool) {
+		record := shadowRecord{
+			Time:            time.Now().UTC(),
+			Tool:            tool,
+			Primary:         primary,
+			Shadow:          shadow.name,
+			CorrelationID:   correlationIDFromContext(ctx),
+			Identity:        identityFromContext(ctx).Name,
+			Session:         sessionIDFromContext(ctx),
+			PrimaryDuration: duration.String(),
+		}
+		record.PrimaryResult, record.PrimaryError = shadowResult(resp, err)
+
+		m.wg.Add(1)
+		go func(shadow *backend, record shadowRecord) {
+			defer m.wg.Done()
+			// The shadow must not hold up or be canceled with the caller's request
+			shadowCtx, cancel := context.WithTimeout(withoutBudget(withoutPassthrough(context.WithoutCancel(ctx))), shadowTimeout)
+			defer cancel()
+			start := time.Now()
+			shadowResp, shadowErr := callTool(shadowCtx, shadow.client, tool, arguments)
+			record.ShadowDuration = time.Since(start).String()
+			record.ShadowResult, record.ShadowError = shadowResult(shadowResp, shadowErr)
+			m.record(record)
+		}(shadow, record)
+	}
+}
+
+// shadowResult encodes a call's result, or the result of a failed call, for comparison
+func shadowResult(resp *mcp.ToolResponse, err error) (json.RawMessage, string) {
+	var toolErr *toolError
+	if errors.As(err, &toolErr) {
+		resp = toolErr.response
+	}
+	var encoded json.RawMessage
+	if resp != nil {
+		encoded, _ = json.Marshal(resp)
+	}
+	if err != nil {
+		return encoded, err.Error()
+	}
+	return encoded, ""
+}
+
+// record compares the responses, counts the outcome and writes the record
+func (m *shadowMirror) record(record shadowRecord) {
+	record.Outcome = "mismatch"
+	bothFailed := record.PrimaryError != "" && record.ShadowError != ""
+	if bothFailed || (record.PrimaryError == "" && record.ShadowError == "" && string(record.PrimaryResult) == string(record.ShadowResult)) {
+		record.Outcome = "match"
+	}
+	m.metrics.addCounter("mcp_shadow_calls_total", "Calls mirrored to shadow servers by whether the shadow's response matched", 1, "tool", record.Tool, "shadow", record.Shadow, "outcome", record.Outcome)
+	if record.Outcome == "mismatch" {
+		log.Printf("Shadow '%s' of '%s' disagreed on '%s' (correlation %s)", record.Shadow, record.Primary, record.Tool, record.CorrelationID)
+	}
+
+	if m.log == nil {
+		return
+	}
+	if m.data.dropsResponses() {
+		record.PrimaryResult, record.ShadowResult = nil, nil
+	}
+	if err := m.log.write(record); err != nil {
+		log.Printf("Failed to write shadow record: %v", err)
+	}
+}
+
+// records returns the file the shadow records are written to, or nil when there is none
+func (m *shadowMirror) records() *recordLog {
+	if m == nil {
+		return nil
+	}
+	return m.log
+}
+
+// close waits for mirrored calls in flight and closes the log
+func (m *shadowMirror) close() {
+	if m == nil {
+		return
+	}
+	m.wg.Wait()
+	if m.log != nil {
+		m.log.close()
+	}
+}
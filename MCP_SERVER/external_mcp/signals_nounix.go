@@ -0,0 +1,7 @@
+//go:build windows || plan9
+
+package main
+
+// watchSignals does nothing, as SIGHUP and SIGUSR1 are not available on this platform; the config
+// is reloaded and the state inspected through the admin API instead
+func watchSignals(reload func() error, diag *diagnostics) {}
@@ -0,0 +1,24 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchSignals reloads the config on SIGHUP and logs diagnostics on SIGUSR1
+func watchSignals(reload func() error, diag *diagnostics) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			reloadOnSignal(reload)
+		case syscall.SIGUSR1:
+			log.Print(diag.dump())
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// defaultRedactedFields are redacted from captured arguments when no fields are configured
+var defaultRedactedFields = []string{"password", "secret", "token", "apiKey", "api_key", "authorization"}
+
+// SlowCallConfig captures calls slower than Threshold, with their arguments and response, in a slow-call log
+type SlowCallConfig struct {
+	Threshold Duration `json:"Threshold"`
+	// Log is the file slow calls are appended to as JSON lines; empty writes them to the standard log
+	Log string `json:"Log,omitempty"`
+	// Redact lists argument fields, at any depth, whose values are not captured; matching ignores case
+	Redact []string `json:"Redact,omitempty"`
+}
+
+type callTimingKey struct{}
+
+// callTiming breaks down where a forwarded call spent its time
+type callTiming struct {
+	mu      sync.Mutex
+	backend string
+	// sending is when the request was handed to the backend's transport, sent when it was written
+	// and received when the response arrived
+	sending, sent, received time.Time
+}
+
+// contextWithCallTiming returns a copy of ctx through which the call's timing is recorded
+func contextWithCallTiming(ctx context.Context, timing *callTiming) context.Context {
+	return context.WithValue(ctx, callTimingKey{}, timing)
+}
+
+// recordBackend notes the backend serving the call traced by ctx, if it is traced
+func recordBackend(ctx context.Context, backend string) {
+	if timing, ok := ctx.Value(callTimingKey{}).(*callTiming); ok {
+		timing.mu.Lock()
+		timing.backend = backend
+		timing.mu.Unlock()
+	}
+}
+
+// recordTransport notes the transport timestamps of the call's last attempt, if it is traced
+func recordTransport(ctx context.Context, outcome *callOutcome) {
+	if timing, ok := ctx.Value(callTimingKey{}).(*callTiming); ok {
+		timing.mu.Lock()
+		timing.sending, timing.sent, timing.received = outcome.sending, outcome.sent, outcome.received
+		timing.mu.Unlock()
+	}
+}
+
+// breakdown splits a call that started at start and ended at end into the time spent queued before
+// reaching the backend's transport, in the transport and in the backend itself
+func (t *callTiming) breakdown(start, end time.Time) (queue, transport, upstream time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sending.IsZero() {
+		return end.Sub(start), 0, 0
+	}
+	queue = t.sending.Sub(start)
+	if t.received.IsZero() {
+		return queue, t.sent.Sub(t.sending), end.Sub(t.sent)
+	}
+	return queue, t.sent.Sub(t.sending) + end.Sub(t.received), t.received.Sub(t.sent)
+}
+
+// slowCallRecord is a captured slow call
+type slowCallRecord struct {
+	Time          time.Time      `json:"time"`
+	CorrelationID string         `json:"correlationId,omitempty"`
+	Identity      string         `json:"identity,omitempty"`
+	Session       string         `json:"session,omitempty"`
+	Tool          string         `json:"tool"`
+	Backend       string         `json:"backend,omitempty"`
+	Duration      string         `json:"duration"`
+	Timing        slowCallTimes  `json:"timing"`
+	Arguments     interface{}    `json:"arguments,omitempty"`
+	Response      []*mcp.Content `json:"response,omitempty"`
+	Error         string         `json:"error,omitempty"`
+}
+
+type slowCallTimes struct {
+	Queue     string `json:"queue"`
+	Transport string `json:"transport"`
+	Upstream  string `json:"upstream"`
+}
+
+// slowCallLogger captures calls exceeding the threshold. A nil logger captures nothing.
+type slowCallLogger struct {
+	threshold time.Duration
+	redact    map[string]bool
+	// data decides whether arguments and responses are captured
+	data *DataHandlingConfig
+	// log holds the captured calls when they go to a file
+	log *recordLog
+}
+
+// newSlowCallLogger returns a logger for cfg, or nil when slow calls are not captured
+func newSlowCallLogger(cfg *SlowCallConfig, data *DataHandlingConfig) (*slowCallLogger, error) {
+	if cfg == nil || cfg.Threshold <= 0 {
+		return nil, nil
+	}
+	fields := cfg.Redact
+	if len(fields) == 0 {
+		fields = defaultRedactedFields
+	}
+	l := &slowCallLogger{threshold: time.Duration(cfg.Threshold), redact: make(map[string]bool, len(fields)), data: data}
+	for _, field := range fields {
+		l.redact[strings.ToLower(field)] = true
+	}
+	if cfg.Log != "" {
+		records, err := openRecordLog(cfg.Log)
+		if err != nil {
+			return nil, err
+		}
+		l.log = records
+	}
+	return l, nil
+}
+
+// observe captures the call if it took longer than the threshold
+func (l *slowCallLogger) observe(ctx context.Context, name string, arguments interface{}, resp *mcp.ToolResponse, err error, start time.Time, timing *callTiming) {
+	if l == nil {
+		return
+	}
+	end := time.Now()
+	if end.Sub(start) < l.threshold {
+		return
+	}
+
+	queue, transport, upstream := timing.breakdown(start, end)
+	timing.mu.Lock()
+	backend := timing.backend
+	timing.mu.Unlock()
+	record := slowCallRecord{
+		Time:          start.UTC(),
+		CorrelationID: correlationIDFromContext(ctx),
+		Tool:          name,
+		Backend:       backend,
+		Duration:      end.Sub(start).String(),
+		Timing:        slowCallTimes{Queue: queue.String(), Transport: transport.String(), Upstream: upstream.String()},
+		Identity:      identityFromContext(ctx).Name,
+		Session:       sessionIDFromContext(ctx),
+	}
+	if !l.data.dropsArguments() {
+		record.Arguments = l.redacted(arguments)
+	}
+	if resp != nil && !l.data.dropsResponses() {
+		record.Response = resp.Content
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	if l.log != nil {
+		if err := l.log.write(record); err != nil {
+			log.Printf("Failed to write slow call: %v", err)
+		}
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to marshal slow call: %v", err)
+		return
+	}
+	logf(ctx, "slow call: %s", data)
+}
+
+// records returns the file the slow calls are captured in, or nil when they are logged
+func (l *slowCallLogger) records() *recordLog {
+	if l == nil {
+		return nil
+	}
+	return l.log
+}
+
+// redacted returns a copy of arguments with the values of redacted fields replaced
+func (l *slowCallLogger) redacted(arguments interface{}) interface{} {
+	// Round-trip through JSON so arguments of any type can be walked as maps and slices
+	data, err := json.Marshal(arguments)
+	if err != nil {
+		return nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil
+	}
+	return l.redactValue(decoded)
+}
+
+func (l *slowCallLogger) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if l.redact[strings.ToLower(key)] {
+				v[key] = "[REDACTED]"
+			} else {
+				v[key] = l.redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = l.redactValue(item)
+		}
+	}
+	return value
+}
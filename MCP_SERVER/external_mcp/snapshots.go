@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// snapshotIDFormat names snapshots by the UTC time they were taken, so they sort chronologically
+const snapshotIDFormat = "20060102T150405Z"
+
+// SnapshotConfig keeps dated snapshots of the merged tool catalog and routing config, taken at
+// start-up and whenever the catalog changes
+type SnapshotConfig struct {
+	Dir string `json:"Dir"`
+	// Keep bounds how many snapshots are kept, dropping the oldest; 0 keeps them all
+	Keep int `json:"Keep,omitempty"`
+	// Pin advertises the catalog of this snapshot, e.g. "20250601T120000Z", instead of the live one,
+	// to hold agents on known tool definitions while an upstream update is investigated
+	Pin string `json:"Pin,omitempty"`
+}
+
+// catalogSnapshot is the catalog and routing config at one point in time
+type catalogSnapshot struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Tools are the tools of each backend
+	Tools map[string][]mcp.ToolRetType `json:"tools"`
+	// Servers are the configured servers without their environment and headers, which may hold secrets
+	Servers map[string]MCPStdIOConfig `json:"servers"`
+}
+
+// snapshotStore writes snapshots to a directory and holds the pinned one. A nil store keeps nothing.
+type snapshotStore struct {
+	dir    string
+	keep   int
+	pinned *catalogSnapshot
+	now    func() time.Time
+
+	mu sync.Mutex
+}
+
+// newSnapshotStore returns a store for cfg, or nil when snapshots are not configured
+func newSnapshotStore(cfg *SnapshotConfig) (*snapshotStore, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("snapshots require a Dir")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &snapshotStore{dir: cfg.Dir, keep: cfg.Keep, now: time.Now}
+	if cfg.Pin != "" {
+		pinned, err := s.load(cfg.Pin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load pinned snapshot: %v", err)
+		}
+		s.pinned = pinned
+		log.Printf("Advertising the tool catalog of snapshot %s", cfg.Pin)
+	}
+	return s, nil
+}
+
+// capture snapshots the registry's catalog and servers unless they match the latest snapshot,
+// returning the new snapshot's id or "" when nothing changed
+func (s *snapshotStore) capture(registry *backendRegistry) (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	snapshot := &catalogSnapshot{Tools: make(map[string][]mcp.ToolRetType), Servers: make(map[string]MCPStdIOConfig)}
+	for _, b := range registry.list() {
+		snapshot.Tools[b.name] = b.listedTools()
+	}
+	registry.mu.RLock()
+	for name, server := range registry.servers {
+		server.Env, server.Headers, server.Tenants = nil, nil, nil
+		snapshot.Servers[name] = server
+	}
+	registry.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.list()
+	if err != nil {
+		return "", err
+	}
+	if len(ids) > 0 {
+		if latest, err := s.load(ids[len(ids)-1]); err == nil && sameSnapshot(latest, snapshot) {
+			return "", nil
+		}
+	}
+
+	snapshot.Time = s.now().UTC()
+	snapshot.ID = snapshot.Time.Format(snapshotIDFormat)
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, snapshot.ID+".json"), data); err != nil {
+		return "", err
+	}
+	log.Printf("Saved catalog snapshot %s", snapshot.ID)
+
+	ids = append(ids, snapshot.ID)
+	for s.keep > 0 && len(ids) > s.keep {
+		if err := os.Remove(filepath.Join(s.dir, ids[0]+".json")); err != nil {
+			log.Printf("Failed to remove old snapshot %s: %v", ids[0], err)
+		}
+		ids = ids[1:]
+	}
+	return snapshot.ID, nil
+}
+
+// list returns the ids of the stored snapshots, oldest first
+func (s *snapshotStore) list() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".json"); ok && !entry.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *snapshotStore) load(id string) (*catalogSnapshot, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, filepath.Base(id)+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var snapshot catalogSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %v", id, err)
+	}
+	return &snapshot, nil
+}
+
+// pinnedCatalog returns the tools of the pinned snapshot, or nil when the live catalog is advertised
+func (s *snapshotStore) pinnedCatalog() []catalogTool {
+	if s == nil || s.pinned == nil {
+		return nil
+	}
+	var tools []catalogTool
+	for backend, backendTools := range s.pinned.Tools {
+		for _, tool := range backendTools {
+			tools = append(tools, catalogTool{backend: backend, tool: tool})
+		}
+	}
+	sort.Slice(tools, func(i, j int) bool {
+		if tools[i].backend != tools[j].backend {
+			return tools[i].backend < tools[j].backend
+		}
+		return tools[i].tool.Name < tools[j].tool.Name
+	})
+	return tools
+}
+
+// sameSnapshot reports whether two snapshots hold the same tools and servers
+func sameSnapshot(a, b *catalogSnapshot) bool {
+	return reflect.DeepEqual(encodeSnapshotTools(a), encodeSnapshotTools(b)) && reflect.DeepEqual(encodeServers(a), encodeServers(b))
+}
+
+func encodeSnapshotTools(snapshot *catalogSnapshot) map[string]map[string]string {
+	encoded := make(map[string]map[string]string, len(snapshot.Tools))
+	for backend, tools := range snapshot.Tools {
+		encoded[backend] = encodeTools(tools)
+	}
+	return encoded
+}
+
+func encodeServers(snapshot *catalogSnapshot) map[string]string {
+	encoded := make(map[string]string, len(snapshot.Servers))
+	for name, server := range snapshot.Servers {
+		definition, _ := json.Marshal(server)
+		encoded[name] = string(definition)
+	}
+	return encoded
+}
+
+// writeSnapshotDiff describes how the catalog and servers changed from one snapshot to another
+func writeSnapshotDiff(w io.Writer, from, to *catalogSnapshot) {
+	fmt.Fprintf(w, "From %s to %s\n", from.ID, to.ID)
+	changes := diffCatalogs(encodeSnapshotTools(from), encodeSnapshotTools(to))
+	servers := diffCatalogs(map[string]map[string]string{"": encodeServers(from)}, map[string]map[string]string{"": encodeServers(to)})
+	if len(changes) == 0 && len(servers) == 0 {
+		fmt.Fprintln(w, "No changes")
+		return
+	}
+	for _, change := range servers {
+		writeChangeLines(w, "server", "", change)
+	}
+	for _, change := range changes {
+		writeChangeLines(w, "tool", change.Backend+"/", change)
+	}
+}
+
+func writeChangeLines(w io.Writer, kind, prefix string, change catalogChange) {
+	for _, name := range change.Added {
+		fmt.Fprintf(w, "+ %s %s%s\n", kind, prefix, name)
+	}
+	for _, name := range change.Removed {
+		fmt.Fprintf(w, "- %s %s%s\n", kind, prefix, name)
+	}
+	for _, name := range change.Changed {
+		fmt.Fprintf(w, "~ %s %s%s\n", kind, prefix, name)
+	}
+}
+
+// runSnapshots implements the snapshots command: "snapshots list" lists the stored snapshots and
+// "snapshots diff <from> [to]" compares two of them, to defaulting to the latest
+func runSnapshots(configPath string, args []string) {
+	fs := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	cfg := loadConfig(configPath)
+	if cfg.Snapshots == nil || cfg.Snapshots.Dir == "" {
+		log.Fatalf("No snapshot directory is configured under Snapshots.Dir")
+	}
+	s := &snapshotStore{dir: cfg.Snapshots.Dir}
+	ids, err := s.list()
+	if err != nil {
+		log.Fatalf("Failed to list snapshots: %v", err)
+	}
+
+	switch fs.Arg(0) {
+	case "list":
+		for _, id := range ids {
+			line := id
+			if id == cfg.Snapshots.Pin {
+				line += " (pinned)"
+			}
+			fmt.Println(line)
+		}
+	case "diff":
+		if fs.NArg() < 2 || len(ids) == 0 {
+			log.Fatalf("Usage: snapshots diff <from> [to]")
+		}
+		toID := ids[len(ids)-1]
+		if fs.NArg() > 2 {
+			toID = fs.Arg(2)
+		}
+		from, err := s.load(fs.Arg(1))
+		if err != nil {
+			log.Fatalf("Failed to load snapshot: %v", err)
+		}
+		to, err := s.load(toID)
+		if err != nil {
+			log.Fatalf("Failed to load snapshot: %v", err)
+		}
+		writeSnapshotDiff(os.Stdout, from, to)
+	default:
+		log.Fatalf("Usage: snapshots list | snapshots diff <from> [to]")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// defaultSpendApprovalTimeout is how long a call over an approval threshold waits for an operator
+const defaultSpendApprovalTimeout = 5 * time.Minute
+
+// SpendConfig prices the calls to tools backed by paid APIs and guards each identity's daily spend:
+// past a threshold calls wait for an operator's approval, and past a limit they are refused
+type SpendConfig struct {
+	// File persists the day's spend across restarts; empty keeps it in memory
+	File string `json:"File,omitempty"`
+	// Currency names the unit of Costs and Daily in messages; defaults to "USD"
+	Currency string `json:"Currency,omitempty"`
+	// Costs is the price of a call to the tools matching each pattern, e.g. {"search_*": 0.005};
+	// the most specific matching pattern wins and other tools are free
+	Costs map[string]float64 `json:"Costs"`
+	// Daily guards the spend of each identity per day (UTC), by identity name; "*" applies to
+	// identities not listed
+	Daily map[string]SpendLimit `json:"Daily,omitempty"`
+	// ApprovalTimeout is how long a call needing approval waits before it is refused; defaults to 5m
+	ApprovalTimeout Duration `json:"ApprovalTimeout,omitempty"`
+}
+
+// SpendLimit guards an identity's daily spend; zero disables either threshold
+type SpendLimit struct {
+	// Approve is the spend past which every call waits for an operator's approval
+	Approve float64 `json:"Approve,omitempty"`
+	// Block is the spend past which calls are refused
+	Block float64 `json:"Block,omitempty"`
+}
+
+// spendGuard prices calls and charges them to their caller's daily spend. A nil guard charges nothing.
+type spendGuard struct {
+	cfg       SpendConfig
+	approvals *approvalQueue
+	timeout   time.Duration
+	now       func() time.Time
+
+	mu sync.Mutex
+	// days maps "2006-01-02" to what each identity spent that day
+	days   map[string]map[string]float64
+	dirty  bool
+	done   chan struct{}
+	closed sync.WaitGroup
+}
+
+// openSpendGuard returns a guard for cfg holding calls for approval in approvals, loading the
+// day's spend from its file, or nil when no spend is configured
+func openSpendGuard(cfg *SpendConfig, approvals *approvalQueue) (*spendGuard, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	g := &spendGuard{
+		cfg:       *cfg,
+		approvals: approvals,
+		timeout:   time.Duration(cfg.ApprovalTimeout),
+		now:       time.Now,
+		days:      make(map[string]map[string]float64),
+		done:      make(chan struct{}),
+	}
+	if g.cfg.Currency == "" {
+		g.cfg.Currency = "USD"
+	}
+	if g.timeout <= 0 {
+		g.timeout = defaultSpendApprovalTimeout
+	}
+	if cfg.File != "" {
+		data, err := os.ReadFile(cfg.File)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &g.days); err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %v", cfg.File, err)
+			}
+		}
+		g.closed.Add(1)
+		go g.run()
+	}
+	return g, nil
+}
+
+// cost returns the price of one call to the named tool
+func (g *spendGuard) cost(tool string) float64 {
+	if g == nil {
+		return 0
+	}
+	if cost, ok := g.cfg.Costs[tool]; ok {
+		return cost
+	}
+	best, cost := -1, 0.0
+	for pattern, c := range g.cfg.Costs {
+		if matched, _ := path.Match(pattern, tool); matched && len(pattern) > best {
+			best, cost = len(pattern), c
+		}
+	}
+	return cost
+}
+
+// limit returns the daily spend limit of the identity
+func (g *spendGuard) limit(identity string) SpendLimit {
+	if limit, ok := g.cfg.Daily[identity]; ok {
+		return limit
+	}
+	return g.cfg.Daily["*"]
+}
+
+// charge adds the price of a call to the caller's spend today. A call taking the spend past the
+// identity's Block limit is refused, and one taking it past Approve waits for an operator first.
+func (g *spendGuard) charge(ctx context.Context, tool string, arguments interface{}) error {
+	cost := g.cost(tool)
+	if cost <= 0 {
+		return nil
+	}
+	caller := identityFromContext(ctx)
+	limit := g.limit(caller.Name)
+	now := g.now().UTC()
+	day := now.Format("2006-01-02")
+
+	spent := g.spent(day, caller.Name)
+	if limit.Block > 0 && spent+cost > limit.Block {
+		return fmt.Errorf("spend limit reached: '%s' has spent %.2f of its daily limit of %.2f %s", caller.Name, spent, limit.Block, g.cfg.Currency)
+	}
+	if limit.Approve > 0 && spent+cost > limit.Approve {
+		input := policyInput{
+			Identity:      caller.Name,
+			Roles:         caller.Roles,
+			Tenant:        caller.Tenant,
+			Tool:          tool,
+			Arguments:     arguments,
+			Time:          now,
+			CorrelationID: correlationIDFromContext(ctx),
+		}
+		reason := fmt.Sprintf("'%s' has spent %.2f %s today, over its approval threshold of %.2f; this call costs %.2f",
+			caller.Name, spent, g.cfg.Currency, limit.Approve, cost)
+		if err := g.approvals.await(ctx, input, reason, g.timeout); err != nil {
+			return err
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Calls approved in the meantime may have used up the rest of the limit
+	spent = g.days[day][caller.Name]
+	if limit.Block > 0 && spent+cost > limit.Block {
+		return fmt.Errorf("spend limit reached: '%s' has spent %.2f of its daily limit of %.2f %s", caller.Name, spent, limit.Block, g.cfg.Currency)
+	}
+	if g.days[day] == nil {
+		// Only today's spend is guarded, so earlier days are dropped
+		g.days = map[string]map[string]float64{day: {}}
+	}
+	g.days[day][caller.Name] = spent + cost
+	g.dirty = true
+	return nil
+}
+
+// spent returns what the identity spent on the day, formatted "2006-01-02"
+func (g *spendGuard) spent(day, identity string) float64 {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.days[day][identity]
+}
+
+// annotate appends the price of a call to the description of the priced tools
+func (g *spendGuard) annotate(tools []catalogTool) {
+	for i, tool := range tools {
+		cost := g.cost(tool.tool.Name)
+		if cost <= 0 {
+			continue
+		}
+		description := fmt.Sprintf("(Costs %g %s per call)", cost, g.cfg.Currency)
+		if tool.tool.Description != nil && *tool.tool.Description != "" {
+			description = *tool.tool.Description + " " + description
+		}
+		tools[i].tool.Description = &description
+	}
+}
+
+func (g *spendGuard) run() {
+	defer g.closed.Done()
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.flush()
+		case <-g.done:
+			g.flush()
+			return
+		}
+	}
+}
+
+// flush writes changed spend to the spend file
+func (g *spendGuard) flush() {
+	g.mu.Lock()
+	if !g.dirty {
+		g.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(g.days)
+	g.dirty = false
+	g.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to encode spend: %v", err)
+		return
+	}
+
+	if err := writeFileAtomic(g.cfg.File, data); err != nil {
+		log.Printf("Failed to save spend: %v", err)
+		// Retry on the next flush
+		g.mu.Lock()
+		g.dirty = true
+		g.mu.Unlock()
+	}
+}
+
+// close saves the spend not yet written
+func (g *spendGuard) close() {
+	if g == nil || g.cfg.File == "" {
+		return
+	}
+	close(g.done)
+	g.closed.Wait()
+}
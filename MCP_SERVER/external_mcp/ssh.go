@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for servers run over SSH
+const (
+	defaultSSHKeepAlive = 15 * time.Second
+	// sshKeepAliveCount is how many keepalives may go unanswered before the connection is dropped
+	sshKeepAliveCount    = 3
+	maxSSHReconnectDelay = time.Minute
+)
+
+// SSHConfig runs the server's Command on another machine through ssh, speaking stdio over the
+// connection. Env and WorkingDir apply on the remote machine. A lost connection is reconnected.
+type SSHConfig struct {
+	// Host is the machine to run the server on; a Host alias of ~/.ssh/config works too
+	Host string `json:"Host"`
+	User string `json:"User,omitempty"`
+	Port int    `json:"Port,omitempty"`
+	// IdentityFile is the private key to log in with; without one, ssh uses the agent at
+	// SSH_AUTH_SOCK and its default keys
+	IdentityFile string `json:"IdentityFile,omitempty"`
+	// JumpHost is connected to first to reach Host, as [user@]host[:port]
+	JumpHost string `json:"JumpHost,omitempty"`
+	// KeepAlive is how often the connection is checked; it is dropped after 3 unanswered checks.
+	// Defaults to 15s.
+	KeepAlive Duration `json:"KeepAlive,omitempty"`
+	// Options are passed to ssh as -o options, e.g. {"StrictHostKeyChecking": "accept-new"}
+	Options map[string]string `json:"Options,omitempty"`
+}
+
+// sshCommand returns the local command running the server of config on its SSH host
+func sshCommand(config MCPStdIOConfig) (string, []string) {
+	ssh := config.SSH
+	keepAlive := time.Duration(ssh.KeepAlive)
+	if keepAlive <= 0 {
+		keepAlive = defaultSSHKeepAlive
+	}
+	// Never prompt: there is no terminal to answer on, and stdin carries the protocol
+	args := []string{
+		"-T",
+		"-o", "BatchMode=yes",
+		"-o", "ServerAliveInterval=" + strconv.Itoa(int(keepAlive.Seconds())),
+		"-o", "ServerAliveCountMax=" + strconv.Itoa(sshKeepAliveCount),
+	}
+	if ssh.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(ssh.Port))
+	}
+	if ssh.IdentityFile != "" {
+		args = append(args, "-i", ssh.IdentityFile, "-o", "IdentitiesOnly=yes")
+	}
+	if ssh.JumpHost != "" {
+		args = append(args, "-J", ssh.JumpHost)
+	}
+	options := make([]string, 0, len(ssh.Options))
+	for option := range ssh.Options {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+	for _, option := range options {
+		args = append(args, "-o", option+"="+ssh.Options[option])
+	}
+	destination := ssh.Host
+	if ssh.User != "" {
+		destination = ssh.User + "@" + ssh.Host
+	}
+	return "ssh", append(args, destination, "--", remoteCommand(config))
+}
+
+// remoteCommand returns the shell command line starting the server on the remote machine
+func remoteCommand(config MCPStdIOConfig) string {
+	var words []string
+	if config.WorkingDir != "" {
+		words = append(words, "cd", shellQuote(config.WorkingDir), "&&")
+	}
+	words = append(words, "exec")
+	if len(config.Env) > 0 {
+		names := make([]string, 0, len(config.Env))
+		for name := range config.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		words = append(words, "env")
+		for _, name := range names {
+			words = append(words, shellQuote(name+"="+config.Env[name]))
+		}
+	}
+	words = append(words, shellQuote(config.Command))
+	for _, arg := range config.Args {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// shellQuote quotes s as a single word for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// reconnect starts a server run over SSH again once its connection is lost, waiting longer after
+// each failed attempt. It gives up once the server is stopped, reconfigured or back up.
+func (r *backendRegistry) reconnect(b *backend) {
+	<-b.exited
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		r.mu.RLock()
+		current, running := r.backends[b.name]
+		_, configured := r.servers[b.name]
+		r.mu.RUnlock()
+		// A backend no longer registered when it exits was stopped on purpose
+		if !configured || (running && current != b) || (!running && attempt == 0) {
+			return
+		}
+
+		log.Printf("Lost the connection to '%s' on %s, reconnecting in %s", b.name, b.config.SSH.Host, delay)
+		time.Sleep(delay)
+		delay = min(2*delay, maxSSHReconnectDelay)
+		if err := r.restart(b.name); err != nil {
+			log.Printf("Failed to reconnect to '%s': %v", b.name, err)
+		}
+	}
+}
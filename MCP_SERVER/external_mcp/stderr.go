@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	// maxStderrLine is the longest stderr line logged in full; longer lines are truncated
+	maxStderrLine = 4096
+	// maxStderrLinesPerSecond bounds how many stderr lines of one backend are logged per second
+	maxStderrLinesPerSecond = 100
+)
+
+// drainStderr logs a backend's stderr until the stream ends and then closes done. The stream is
+// always read to the end, so a chatty backend never blocks on a full pipe: overlong lines are
+// truncated and lines beyond the rate limit are counted instead of logged.
+func drainStderr(name string, stderr io.Reader, done chan<- struct{}) {
+	defer close(done)
+
+	reader := bufio.NewReaderSize(stderr, maxStderrLine)
+	window := time.Now()
+	logged, suppressed := 0, 0
+	for {
+		line, truncated, err := readStderrLine(reader)
+		if len(line) > 0 || truncated > 0 {
+			if now := time.Now(); now.Sub(window) >= time.Second {
+				if suppressed > 0 {
+					log.Printf("StdIO client '%s' stderr: suppressed %d lines", name, suppressed)
+				}
+				window, logged, suppressed = now, 0, 0
+			}
+
+			if logged < maxStderrLinesPerSecond {
+				logged++
+				if truncated > 0 {
+					log.Printf("StdIO client '%s' stderr: %s... [truncated %d bytes]", name, line, truncated)
+				} else {
+					log.Printf("StdIO client '%s' stderr: %s", name, line)
+				}
+			} else {
+				suppressed++
+			}
+		}
+		if err != nil {
+			if suppressed > 0 {
+				log.Printf("StdIO client '%s' stderr: suppressed %d lines", name, suppressed)
+			}
+			return
+		}
+	}
+}
+
+// readStderrLine returns the next line without its newline, cut to maxStderrLine bytes, along
+// with the number of bytes that were cut off
+func readStderrLine(reader *bufio.Reader) (string, int, error) {
+	var line []byte
+	truncated := 0
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if room := maxStderrLine - len(line); room > 0 {
+			line = append(line, chunk[:min(len(chunk), room)]...)
+			truncated += len(chunk) - min(len(chunk), room)
+		} else {
+			truncated += len(chunk)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if n := len(line); n > 0 && line[n-1] == '\n' {
+			line = line[:n-1]
+		} else if truncated > 0 && len(chunk) > 0 && chunk[len(chunk)-1] == '\n' {
+			truncated--
+		}
+		return string(line), truncated, err
+	}
+}
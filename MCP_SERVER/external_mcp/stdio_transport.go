@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// defaultMaxFrameSize bounds a single newline-delimited JSON-RPC message when none is configured
+const defaultMaxFrameSize = 64 << 20
+
+// maxLoggedNoise bounds how much of a line that is not a protocol message is logged
+const maxLoggedNoise = 200
+
+// stdioTransport exchanges newline-delimited JSON-RPC messages over a pair of streams. Unlike the
+// library's stdio transport it bounds the size of every incoming frame: an oversized request is
+// answered with an error, and an oversized response fails only the request it belongs to. Lines
+// that are not protocol messages, such as a server's stray prints, are logged and skipped.
+type stdioTransport struct {
+	name         string
+	in           io.Reader
+	out          io.Writer
+	maxFrameSize int
+	// strict closes the connection on the first line that is not a protocol message instead
+	strict bool
+
+	writeMu   sync.Mutex
+	mu        sync.Mutex
+	started   bool
+	closed    bool
+	onClose   func()
+	onError   func(error)
+	onMessage func(ctx context.Context, message *transport.BaseJsonRpcMessage)
+}
+
+// newStdioTransport reads messages from in and writes them to out; name identifies the peer in logs
+func newStdioTransport(name string, in io.Reader, out io.Writer, maxFrameSize int) *stdioTransport {
+	if maxFrameSize <= 0 {
+		maxFrameSize = defaultMaxFrameSize
+	}
+	return &stdioTransport{name: name, in: in, out: out, maxFrameSize: maxFrameSize}
+}
+
+// Start begins reading messages
+func (t *stdioTransport) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.started {
+		return fmt.Errorf("stdio transport for %s already started", t.name)
+	}
+	t.started = true
+
+	go t.readLoop()
+	return nil
+}
+
+// Send writes a message as a single line
+func (t *stdioTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_, err = t.out.Write(append(data, '\n'))
+	return err
+}
+
+// Close stops delivering messages, closes the input stream and fails the requests still waiting
+// for a response. Closing more than once has no effect.
+func (t *stdioTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.started, t.closed = false, true
+	handler := t.onClose
+	t.mu.Unlock()
+
+	if closer, ok := t.in.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	if handler != nil {
+		handler()
+	}
+	return nil
+}
+
+// SetCloseHandler sets the handler for close events
+func (t *stdioTransport) SetCloseHandler(handler func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onClose = handler
+}
+
+// SetErrorHandler sets the handler for error events
+func (t *stdioTransport) SetErrorHandler(handler func(error)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onError = handler
+}
+
+// SetMessageHandler sets the handler for incoming messages
+func (t *stdioTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onMessage = handler
+}
+
+func (t *stdioTransport) readLoop() {
+	reader := bufio.NewReader(t.in)
+	for {
+		frame, size, err := readFrame(reader, t.maxFrameSize)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, os.ErrClosed) {
+				t.handleError(fmt.Errorf("read error: %w", err))
+			}
+			// The peer is gone, so nothing waiting for a response will get one
+			_ = t.Close()
+			return
+		}
+
+		t.mu.Lock()
+		started, handler := t.started, t.onMessage
+		t.mu.Unlock()
+		if !started {
+			return
+		}
+
+		if size > t.maxFrameSize {
+			t.handleOversized(frame, size, handler)
+			continue
+		}
+		if len(bytes.TrimSpace(frame)) == 0 {
+			continue
+		}
+
+		message, err := t.decodeFrame(frame)
+		if err != nil {
+			t.handleError(err)
+			if t.strict {
+				_ = t.Close()
+				return
+			}
+			continue
+		}
+		if handler != nil {
+			handler(context.Background(), message)
+		}
+	}
+}
+
+// decodeFrame decodes the message in a line, recovering one printed right after noise on the same
+// line, and logs what is not part of a message. JSON without the protocol version, such as a
+// structured log line, is not a message.
+func (t *stdioTransport) decodeFrame(frame []byte) (*transport.BaseJsonRpcMessage, error) {
+	message, err := decodeProtocolMessage(frame)
+	if err == nil {
+		return message, nil
+	}
+	if start := bytes.IndexByte(frame, '{'); start > 0 && !t.strict {
+		if message, err := decodeProtocolMessage(frame[start:]); err == nil {
+			t.logNoise(frame[:start])
+			return message, nil
+		}
+	}
+	t.logNoise(frame)
+	return nil, err
+}
+
+// decodeProtocolMessage decodes a JSON-RPC 2.0 message
+func decodeProtocolMessage(data []byte) (*transport.BaseJsonRpcMessage, error) {
+	var version struct {
+		Jsonrpc string `json:"jsonrpc"`
+	}
+	if err := json.Unmarshal(data, &version); err != nil || version.Jsonrpc != "2.0" {
+		return nil, errors.New("not a JSON-RPC 2.0 message")
+	}
+	return decodeMessage(data)
+}
+
+// logNoise reports output of the peer that is not a protocol message
+func (t *stdioTransport) logNoise(noise []byte) {
+	if len(noise) > maxLoggedNoise {
+		noise = append(noise[:maxLoggedNoise:maxLoggedNoise], "..."...)
+	}
+	if t.strict {
+		log.Printf("Closing connection to %s, which wrote a line that is not a protocol message: %q", t.name, noise)
+		return
+	}
+	log.Printf("Ignored output of %s that is not a protocol message: %q", t.name, noise)
+}
+
+// readFrame reads the next line and returns it with its size. Lines longer than maxFrameSize are
+// consumed in full but only their first maxFrameSize bytes are kept.
+func readFrame(reader *bufio.Reader, maxFrameSize int) ([]byte, int, error) {
+	var frame []byte
+	size := 0
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		size += len(chunk)
+		if len(frame) < maxFrameSize {
+			frame = append(frame, chunk[:min(len(chunk), maxFrameSize-len(frame))]...)
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && size > 0:
+			return frame, size, nil
+		case err != nil:
+			return nil, 0, err
+		}
+		// The delimiter doesn't count towards the frame size
+		return bytes.TrimSuffix(frame, []byte("\n")), size - 1, nil
+	}
+}
+
+// handleOversized fails the message in an oversized frame: requests are answered with an error,
+// responses are replaced by an error response so that only the waiting call fails
+func (t *stdioTransport) handleOversized(header []byte, size int, handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	reason := fmt.Sprintf("message of %d bytes exceeds the maximum frame size of %d bytes", size, t.maxFrameSize)
+	id, method, ok := frameHeader(header)
+	if !ok {
+		log.Printf("Dropped message from %s: %s", t.name, reason)
+		return
+	}
+
+	errorMessage := transport.NewBaseMessageError(&transport.BaseJSONRPCError{
+		Jsonrpc: "2.0",
+		Id:      id,
+		Error: transport.BaseJSONRPCErrorInner{
+			Code:    -32600,
+			Message: reason,
+		},
+	})
+	if method != "" {
+		log.Printf("Rejected '%s' request from %s: %s", method, t.name, reason)
+		if err := t.Send(context.Background(), errorMessage); err != nil {
+			t.handleError(err)
+		}
+		return
+	}
+
+	log.Printf("Failed response from %s: %s", t.name, reason)
+	if handler != nil {
+		handler(context.Background(), errorMessage)
+	}
+}
+
+// frameHeader recovers the top-level id and method from the beginning of a possibly truncated message
+func frameHeader(header []byte) (transport.RequestId, string, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(header))
+	decoder.UseNumber()
+
+	var id transport.RequestId
+	var method string
+	found := false
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return id, method, found
+	}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return id, method, found
+		}
+		key, ok := token.(string)
+		if !ok {
+			return id, method, found
+		}
+
+		switch key {
+		case "id":
+			if number, ok := nextToken(decoder).(json.Number); ok {
+				if parsed, err := number.Int64(); err == nil {
+					id, found = transport.RequestId(parsed), true
+				}
+			}
+		case "method":
+			method, _ = nextToken(decoder).(string)
+		default:
+			skipValue(decoder)
+		}
+	}
+}
+
+func nextToken(decoder *json.Decoder) json.Token {
+	token, _ := decoder.Token()
+	return token
+}
+
+// skipValue consumes the next value, descending into objects and arrays
+func skipValue(decoder *json.Decoder) {
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+		if delim, ok := token.(json.Delim); ok {
+			if delim == '{' || delim == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			return
+		}
+	}
+}
+
+// decodeMessage decodes a single JSON-RPC request, notification, response or error
+func decodeMessage(data []byte) (*transport.BaseJsonRpcMessage, error) {
+	var request transport.BaseJSONRPCRequest
+	if err := json.Unmarshal(data, &request); err == nil {
+		return transport.NewBaseMessageRequest(&request), nil
+	}
+
+	var notification transport.BaseJSONRPCNotification
+	if err := json.Unmarshal(data, &notification); err == nil {
+		return transport.NewBaseMessageNotification(&notification), nil
+	}
+
+	var response transport.BaseJSONRPCResponse
+	if err := json.Unmarshal(data, &response); err == nil {
+		return transport.NewBaseMessageResponse(&response), nil
+	}
+
+	var errorResponse transport.BaseJSONRPCError
+	if err := json.Unmarshal(data, &errorResponse); err == nil {
+		return transport.NewBaseMessageError(&errorResponse), nil
+	}
+	return nil, errors.New("failed to unmarshal JSON-RPC message, unrecognized type")
+}
+
+func (t *stdioTransport) handleError(err error) {
+	t.mu.Lock()
+	handler := t.onError
+	t.mu.Unlock()
+
+	if handler != nil {
+		handler(err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// sessionInstance is a dedicated instance of a stateful backend serving a single downstream session
+type sessionInstance struct {
+	ready    chan struct{}
+	backend  *backend
+	err      error
+	lastUsed time.Time
+}
+
+// statefulInstances hands out per-session instances of stateful backends so that every call
+// within a session reaches the same process. The same bookkeeping keeps per-tenant instances,
+// keyed by tenant instead of session.
+type statefulInstances struct {
+	clientInfo mcp.ClientInfo
+	clock      clock
+	// kind names what instances are dedicated to in log lines: "session" or "tenant"
+	kind string
+
+	mu        sync.Mutex
+	instances map[string]map[string]*sessionInstance // session id -> backend name -> instance
+}
+
+func newStatefulInstances(clientInfo mcp.ClientInfo, kind string, clock clock) *statefulInstances {
+	return &statefulInstances{
+		clientInfo: clientInfo,
+		clock:      clock,
+		kind:       kind,
+		instances:  make(map[string]map[string]*sessionInstance),
+	}
+}
+
+// get returns the session's instance of b, starting one on first use
+func (s *statefulInstances) get(sessionID string, b *backend) (*mcp.Client, error) {
+	return s.getWith(sessionID, b, b.config)
+}
+
+// getWith returns the session's instance of b, starting one configured by config on first use
+func (s *statefulInstances) getWith(sessionID string, b *backend, config MCPStdIOConfig) (*mcp.Client, error) {
+	s.mu.Lock()
+	byBackend := s.instances[sessionID]
+	if byBackend == nil {
+		byBackend = make(map[string]*sessionInstance)
+		s.instances[sessionID] = byBackend
+	}
+	instance, ok := byBackend[b.name]
+	if !ok {
+		instance = &sessionInstance{ready: make(chan struct{})}
+		byBackend[b.name] = instance
+	}
+	instance.lastUsed = s.clock.Now()
+	s.mu.Unlock()
+
+	if !ok {
+		log.Printf("Starting instance of stateful server '%s' for %s '%s'", b.name, s.kind, sessionID)
+		instance.backend, instance.err = startBackend(b.name, config, s.clientInfo)
+		if instance.err == nil {
+			if instance.err = initializeBackend(instance.backend); instance.err != nil {
+				stopBackend(instance.backend)
+			}
+		}
+		if instance.err != nil {
+			s.mu.Lock()
+			delete(byBackend, b.name)
+			s.mu.Unlock()
+		}
+		close(instance.ready)
+	}
+
+	<-instance.ready
+	if instance.err != nil {
+		return nil, fmt.Errorf("failed to start %s instance of '%s': %v", s.kind, b.name, instance.err)
+	}
+	return instance.backend.client, nil
+}
+
+// endSession tears down all instances owned by the session
+func (s *statefulInstances) endSession(sessionID string) int {
+	s.mu.Lock()
+	byBackend := s.instances[sessionID]
+	delete(s.instances, sessionID)
+	s.mu.Unlock()
+
+	return s.stopInstances(sessionID, byBackend)
+}
+
+// stopBackend tears down every session's instance of the named backend
+func (s *statefulInstances) stopBackend(name string) {
+	s.mu.Lock()
+	stopping := make(map[string]*sessionInstance)
+	for sessionID, byBackend := range s.instances {
+		if instance, ok := byBackend[name]; ok {
+			stopping[sessionID] = instance
+			delete(byBackend, name)
+		}
+	}
+	s.mu.Unlock()
+
+	for sessionID, instance := range stopping {
+		s.stopInstances(sessionID, map[string]*sessionInstance{name: instance})
+	}
+}
+
+// stopAll tears down every session instance
+func (s *statefulInstances) stopAll() {
+	s.mu.Lock()
+	instances := s.instances
+	s.instances = make(map[string]map[string]*sessionInstance)
+	s.mu.Unlock()
+
+	for sessionID, byBackend := range instances {
+		s.stopInstances(sessionID, byBackend)
+	}
+}
+
+// reapIdle periodically ends sessions whose stateful instances have been idle for longer than timeout
+func (s *statefulInstances) reapIdle(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = 30 * time.Minute
+	}
+	for {
+		now := <-s.clock.After(timeout / 4)
+		s.mu.Lock()
+		var idle []string
+		for sessionID, byBackend := range s.instances {
+			expired := true
+			for _, instance := range byBackend {
+				if now.Sub(instance.lastUsed) < timeout {
+					expired = false
+				}
+			}
+			if expired {
+				idle = append(idle, sessionID)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, sessionID := range idle {
+			log.Printf("Stateful instances for %s '%s' idle for %s, tearing them down", s.kind, sessionID, timeout)
+			s.endSession(sessionID)
+		}
+	}
+}
+
+// stopInstances stops the given instances once they finished starting
+func (s *statefulInstances) stopInstances(sessionID string, byBackend map[string]*sessionInstance) int {
+	stopped := 0
+	for name, instance := range byBackend {
+		<-instance.ready
+		if instance.err != nil {
+			continue
+		}
+		log.Printf("Stopping instance of stateful server '%s' for %s '%s'", name, s.kind, sessionID)
+		stopBackend(instance.backend)
+		stopped++
+	}
+	return stopped
+}
+
+type EndSessionRequest struct{}
+
+func handleEndSession(rt *router) interface{} {
+	return func(ctx context.Context, args EndSessionRequest) (*mcp.ToolResponse, error) {
+		sessionID := sessionScope(ctx)
+		stopped := rt.registry.stateful.endSession(sessionID)
+		rt.sessions.clear(sessionID)
+		rt.hosts.forget(sessionID)
+		rt.locales.forget(sessionID)
+		rt.resources.forget(sessionID)
+		return mcp.NewToolResponse(mcp.NewTextContent(fmt.Sprintf("Session ended, stopped %d stateful instances", stopped))), nil
+	}
+}
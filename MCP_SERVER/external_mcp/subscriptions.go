@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// subscribedResource is a resource of a server instance; a restarted server starts without subscriptions
+type subscribedResource struct {
+	server *backend
+	uri    string
+}
+
+// resourceSubscriptions subscribes to the servers' resources on behalf of downstream sessions.
+// Each resource is subscribed to once however many sessions want it, its updates are forwarded to
+// the host, and the subscription is dropped once its last session unsubscribes or ends.
+type resourceSubscriptions struct {
+	notify transport.Transport
+
+	mu sync.Mutex
+	// sessions holds the sessions subscribed to each resource
+	sessions map[subscribedResource]map[string]bool
+	// watched holds the server instances whose updates and exit are watched
+	watched map[*backend]bool
+}
+
+func newResourceSubscriptions(notify transport.Transport) *resourceSubscriptions {
+	return &resourceSubscriptions{
+		notify:   notify,
+		sessions: make(map[subscribedResource]map[string]bool),
+		watched:  make(map[*backend]bool),
+	}
+}
+
+// subscribe subscribes the session to a resource of b, subscribing to it upstream if it is the first
+func (s *resourceSubscriptions) subscribe(ctx context.Context, b *backend, uri string) error {
+	resource := subscribedResource{server: b, uri: uri}
+	session := sessionScope(ctx)
+
+	s.mu.Lock()
+	if sessions, ok := s.sessions[resource]; ok {
+		sessions[session] = true
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	if _, err := b.upstream.request(ctx, "resources/subscribe", map[string]string{"uri": uri}); err != nil {
+		return fmt.Errorf("failed to subscribe to '%s' of '%s': %v", uri, b.name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[resource] == nil {
+		s.sessions[resource] = make(map[string]bool)
+	}
+	s.sessions[resource][session] = true
+	if !s.watched[b] {
+		s.watched[b] = true
+		b.upstream.watch("notifications/resources/updated", func(params json.RawMessage) { s.updated(b, params) })
+		if b.exited != nil {
+			go s.release(b)
+		}
+	}
+	return nil
+}
+
+// unsubscribe unsubscribes the session from a resource of b, unsubscribing upstream if it was the last
+func (s *resourceSubscriptions) unsubscribe(ctx context.Context, b *backend, uri string) error {
+	resource := subscribedResource{server: b, uri: uri}
+	s.mu.Lock()
+	sessions := s.sessions[resource]
+	delete(sessions, sessionScope(ctx))
+	last := sessions != nil && len(sessions) == 0
+	if last {
+		delete(s.sessions, resource)
+	}
+	s.mu.Unlock()
+
+	if !last {
+		return nil
+	}
+	if _, err := b.upstream.request(ctx, "resources/unsubscribe", map[string]string{"uri": uri}); err != nil {
+		return fmt.Errorf("failed to unsubscribe from '%s' of '%s': %v", uri, b.name, err)
+	}
+	return nil
+}
+
+// forget unsubscribes an ended session from every resource
+func (s *resourceSubscriptions) forget(sessionID string) {
+	if s == nil {
+		return
+	}
+	var abandoned []subscribedResource
+	s.mu.Lock()
+	for resource, sessions := range s.sessions {
+		if !sessions[sessionID] {
+			continue
+		}
+		delete(sessions, sessionID)
+		if len(sessions) == 0 {
+			delete(s.sessions, resource)
+			abandoned = append(abandoned, resource)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, resource := range abandoned {
+		go func(resource subscribedResource) {
+			if _, err := resource.server.upstream.request(context.Background(), "resources/unsubscribe", map[string]string{"uri": resource.uri}); err != nil {
+				log.Printf("Failed to unsubscribe from '%s' of '%s': %v", resource.uri, resource.server.name, err)
+			}
+		}(resource)
+	}
+}
+
+// updated forwards a server's update of a subscribed resource to the host, under its namespaced URI
+func (s *resourceSubscriptions) updated(b *backend, params json.RawMessage) {
+	var update struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal(params, &update); err != nil {
+		log.Printf("Invalid resource update from '%s': %v", b.name, err)
+		return
+	}
+	s.mu.Lock()
+	subscribed := len(s.sessions[subscribedResource{server: b, uri: update.URI}]) > 0
+	s.mu.Unlock()
+	if !subscribed {
+		return
+	}
+
+	forwarded, _ := json.Marshal(map[string]string{"uri": b.name + resourceSeparator + update.URI})
+	notification := transport.NewBaseMessageNotification(&transport.BaseJSONRPCNotification{
+		Jsonrpc: "2.0",
+		Method:  "notifications/resources/updated",
+		Params:  forwarded,
+	})
+	if err := s.notify.Send(context.Background(), notification); err != nil {
+		log.Printf("Failed to notify host of update to '%s': %v", update.URI, err)
+	}
+}
+
+// release drops the subscriptions to b's resources once its process exits, as the restarted server
+// knows nothing of them
+func (s *resourceSubscriptions) release(b *backend) {
+	<-b.exited
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for resource := range s.sessions {
+		if resource.server == b {
+			delete(s.sessions, resource)
+		}
+	}
+	delete(s.watched, b)
+}
+
+// subscribeResource answers resources/subscribe for a resource of a server
+func (rt *router) subscribeResource(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	b, uri, err := rt.requestedResource(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := rt.resources.subscribe(ctx, b, uri); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+// unsubscribeResource answers resources/unsubscribe for a resource of a server
+func (rt *router) unsubscribeResource(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	b, uri, err := rt.requestedResource(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := rt.resources.unsubscribe(ctx, b, uri); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// Defaults for the summarizer
+const (
+	defaultSummaryTimeout   = 30 * time.Second
+	defaultSummaryMaxTokens = 500
+	summaryPrompt           = "Summarize the following tool output for an AI agent. Keep identifiers, numbers, " +
+		"errors and anything the agent may act on; drop repetition and boilerplate.\n\n"
+)
+
+// SummarizerConfig condenses tool outputs above a token threshold before they reach the host. The
+// summary is written by Command if one is set, and otherwise by the host's model through a sampling
+// request. The full output is kept as an artifact resource the summary points to.
+type SummarizerConfig struct {
+	// Threshold is the estimated token count above which an output is summarized
+	Threshold int `json:"Threshold"`
+	// Command receives the output on stdin and writes the summary to stdout
+	Command string   `json:"Command,omitempty"`
+	Args    []string `json:"Args,omitempty"`
+	// Timeout bounds how long a summary may take; defaults to 30s. The full output is returned
+	// if it runs out.
+	Timeout Duration `json:"Timeout,omitempty"`
+	// MaxTokens caps the summary the host's model writes; defaults to 500
+	MaxTokens int `json:"MaxTokens,omitempty"`
+	// Tools limits summarizing to the tools matching these patterns; empty summarizes every tool
+	Tools []string `json:"Tools,omitempty"`
+}
+
+// summarizer replaces oversized tool outputs with a summary. A nil summarizer leaves them untouched.
+type summarizer struct {
+	cfg       SummarizerConfig
+	timeout   time.Duration
+	maxTokens int
+	artifacts *artifactStore
+}
+
+// newSummarizer returns a summarizer keeping full outputs as resources of server for the artifact
+// TTL, or nil if cfg is nil
+func newSummarizer(cfg *SummarizerConfig, server *mcp.Server, artifacts *ArtifactsConfig) *summarizer {
+	if cfg == nil || cfg.Threshold <= 0 {
+		return nil
+	}
+	store := &artifactStore{server: server, ttl: defaultArtifactTTL}
+	if artifacts != nil && artifacts.TTL > 0 {
+		store.ttl = time.Duration(artifacts.TTL)
+	}
+	s := &summarizer{cfg: *cfg, timeout: time.Duration(cfg.Timeout), maxTokens: cfg.MaxTokens, artifacts: store}
+	if s.timeout <= 0 {
+		s.timeout = defaultSummaryTimeout
+	}
+	if s.maxTokens <= 0 {
+		s.maxTokens = defaultSummaryMaxTokens
+	}
+	return s
+}
+
+// summarizes reports whether the outputs of tool are summarized when oversized
+func (s *summarizer) summarizes(tool string) bool {
+	return s != nil && matchesAny(s.cfg.Tools, tool, true)
+}
+
+// summarize returns resp with its text replaced by a summary if it exceeds the threshold. The
+// full output is stored as an artifact; resp is returned as it is if it cannot be summarized.
+func (s *summarizer) summarize(ctx context.Context, tool string, resp *mcp.ToolResponse) *mcp.ToolResponse {
+	if !s.summarizes(tool) || resp == nil {
+		return resp
+	}
+	text, _ := contentText(resp.Content)
+	tokens := int(math.Ceil(float64(utf8.RuneCountInString(text)) / defaultCharsPerToken))
+	if tokens <= s.cfg.Threshold {
+		return resp
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	var summary string
+	var err error
+	if s.cfg.Command != "" {
+		summary, err = s.run(ctx, text)
+	} else {
+		summary, err = s.sample(ctx, text)
+	}
+	if err == nil && strings.TrimSpace(summary) == "" {
+		err = fmt.Errorf("the summary is empty")
+	}
+	if err != nil {
+		log.Printf("Failed to summarize the output of '%s': %v", tool, err)
+		return resp
+	}
+	uri, _, err := s.artifacts.store(tool, resp.Content)
+	if err != nil {
+		log.Printf("Failed to store the output of '%s': %v", tool, err)
+		return resp
+	}
+	return mcp.NewToolResponse(mcp.NewTextContent(fmt.Sprintf(
+		"%s\n\n[Summarized: the full output of %s (~%d tokens) is available as resource %s for %s]",
+		strings.TrimSpace(summary), tool, tokens, uri, s.artifacts.ttl)))
+}
+
+// run has the configured command summarize text
+func (s *summarizer) run(ctx context.Context, text string) (string, error) {
+	cmd := exec.CommandContext(ctx, s.cfg.Command, s.cfg.Args...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = os.Stderr
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("summarizer command failed: %v", err)
+	}
+	return stdout.String(), nil
+}
+
+// sample has the model of the host of the call in ctx summarize text
+func (s *summarizer) sample(ctx context.Context, text string) (string, error) {
+	relay, _ := ctx.Value(hostRelayKey{}).(*hostRelay)
+	if relay == nil {
+		return "", fmt.Errorf("no host to sample from")
+	}
+	params, err := json.Marshal(map[string]interface{}{
+		"messages": []map[string]interface{}{{
+			"role":    "user",
+			"content": map[string]string{"type": "text", "text": summaryPrompt + text},
+		}},
+		"maxTokens":      s.maxTokens,
+		"includeContext": "none",
+	})
+	if err != nil {
+		return "", err
+	}
+	result, err := relay.ask(ctx, "sampling/createMessage", "sampling", params, s.timeout)
+	if err != nil {
+		return "", err
+	}
+	var message struct {
+		Content struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(result, &message); err != nil {
+		return "", fmt.Errorf("invalid sampling result: %v", err)
+	}
+	if message.Content.Type != "text" {
+		return "", fmt.Errorf("the host answered with %s content instead of text", message.Content.Type)
+	}
+	return message.Content.Text, nil
+}
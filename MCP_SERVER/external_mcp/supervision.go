@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxRestarts is how many restarts within the window make a crash loop when none is configured
+	defaultMaxRestarts = 5
+	// defaultRestartWindow is the window restarts are counted in when none is configured
+	defaultRestartWindow = 10 * time.Minute
+	// defaultRestartBackoff is the delay before the first restart when none is configured
+	defaultRestartBackoff = time.Second
+	// maxRestartBackoff bounds the delay between the restarts of a backend that fails to come back
+	maxRestartBackoff = time.Minute
+)
+
+// SupervisionConfig restarts backends whose process exits unexpectedly. A backend restarted
+// MaxRestarts times within Window is crash-looping: it is no longer restarted but marked failed,
+// reported through the mcp_backend_crash_looping metric and a "crashloop" webhook event, while the
+// other backends keep serving. Restarting it through the admin API or changing its config starts
+// it again. Servers reached over SSH reconnect by themselves and are left alone.
+type SupervisionConfig struct {
+	// MaxRestarts defaults to 5
+	MaxRestarts int `json:"MaxRestarts,omitempty"`
+	// Window defaults to 10m
+	Window Duration `json:"Window,omitempty"`
+	// Backoff is the delay before a restart, doubling while the backend fails to come back up to a
+	// minute; defaults to 1s
+	Backoff Duration `json:"Backoff,omitempty"`
+}
+
+// supervisor restarts crashed backends within their restart budget. A nil supervisor restarts nothing.
+type supervisor struct {
+	cfg      SupervisionConfig
+	registry *backendRegistry
+	metrics  *metrics
+	webhooks *webhookDispatcher
+	clock    clock
+
+	mu sync.Mutex
+	// restarts holds the times of each backend's restarts within the window
+	restarts map[string][]time.Time
+}
+
+// newSupervisor returns the supervisor described by cfg, or nil if cfg is nil
+func newSupervisor(cfg *SupervisionConfig, registry *backendRegistry, metrics *metrics, webhooks *webhookDispatcher, clock clock) *supervisor {
+	if cfg == nil {
+		return nil
+	}
+	s := &supervisor{cfg: *cfg, registry: registry, metrics: metrics, webhooks: webhooks, clock: clock, restarts: make(map[string][]time.Time)}
+	if s.cfg.MaxRestarts <= 0 {
+		s.cfg.MaxRestarts = defaultMaxRestarts
+	}
+	if s.cfg.Window <= 0 {
+		s.cfg.Window = Duration(defaultRestartWindow)
+	}
+	if s.cfg.Backoff <= 0 {
+		s.cfg.Backoff = Duration(defaultRestartBackoff)
+	}
+	return s
+}
+
+// watch restarts the backend once its process exits while it is still in service; a backend no
+// longer registered when it exits was stopped on purpose
+func (s *supervisor) watch(b *backend) {
+	if s == nil || b.exited == nil || b.config.SSH != nil || b.config.ReverseToken != "" {
+		return
+	}
+	s.metrics.setGauge("mcp_backend_crash_looping", "Whether a server was given up on for crash-looping", 0, "backend", b.name)
+	<-b.exited
+	if s.registry.named(b.name) != b {
+		return
+	}
+	s.restart(b.name)
+}
+
+// restart starts the named backend again, backing off while it fails to come back, until it runs
+// or its restart budget is spent
+func (s *supervisor) restart(name string) {
+	for delay := time.Duration(s.cfg.Backoff); ; delay = min(2*delay, maxRestartBackoff) {
+		if !s.charge(name) {
+			return
+		}
+		log.Printf("StdIO client '%s' exited unexpectedly, restarting it in %s", name, delay)
+		<-s.clock.After(delay)
+
+		// Leave the backend alone if it was removed or restarted otherwise meanwhile
+		if _, ok := s.registry.configured(name); !ok {
+			return
+		}
+		if current := s.registry.named(name); current != nil && !current.hasExited(0) {
+			return
+		}
+		s.metrics.addCounter("mcp_backend_restarts_total", "Restarts of servers whose process exited", 1, "backend", name)
+		err := s.registry.restart(name)
+		if current := s.registry.named(name); current != nil && !current.hasExited(0) {
+			return
+		}
+		log.Printf("Failed to restart '%s': %v", name, err)
+	}
+}
+
+// charge counts a restart of the named backend, reporting false and marking the backend failed
+// when its restart budget is spent
+func (s *supervisor) charge(name string) bool {
+	now := s.clock.Now()
+	s.mu.Lock()
+	var recent []time.Time
+	for _, restart := range s.restarts[name] {
+		if now.Sub(restart) < time.Duration(s.cfg.Window) {
+			recent = append(recent, restart)
+		}
+	}
+	if len(recent) < s.cfg.MaxRestarts {
+		s.restarts[name] = append(recent, now)
+		s.mu.Unlock()
+		return true
+	}
+	// A backend started again later gets a fresh budget
+	delete(s.restarts, name)
+	s.mu.Unlock()
+
+	reason := fmt.Sprintf("crash-looping: restarted %d times within %s", len(recent), time.Duration(s.cfg.Window))
+	log.Printf("Giving up on StdIO client '%s', %s", name, reason)
+	s.registry.markFailed(name, reason)
+	s.metrics.setGauge("mcp_backend_crash_looping", "Whether a server was given up on for crash-looping", 1, "backend", name)
+	s.webhooks.fire(toolCallEvent{Event: "crashloop", Time: now.UTC(), Backend: name, Error: reason})
+	return false
+}
+
+// markFailed records why the named backend was given up on, until it is started again
+func (r *backendRegistry) markFailed(name, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed == nil {
+		r.failed = make(map[string]string)
+	}
+	r.failed[name] = reason
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// listen opens the listener for addr: "systemd:<name>" takes the socket systemd passed with
+// FileDescriptorName=<name>, "unix:<path>" listens on a unix socket and anything else is a TCP address
+func listen(addr string) (net.Listener, error) {
+	if name, ok := strings.CutPrefix(addr, "systemd:"); ok {
+		return activatedListener(name)
+	}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// A socket left behind by an earlier run would make listening fail
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// activatedListener returns the socket systemd passed under the given name. Sockets are matched by
+// LISTEN_FDNAMES; without names, "mcp" is the first socket and "admin" the second.
+func activatedListener(name string) (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets were passed by systemd for '%s'", name)
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("no sockets were passed by systemd for '%s'", name)
+	}
+
+	index := -1
+	if names := os.Getenv("LISTEN_FDNAMES"); names != "" {
+		for i, fdName := range strings.Split(names, ":") {
+			if fdName == name {
+				index = i
+				break
+			}
+		}
+	} else if name == "mcp" {
+		index = 0
+	} else if name == "admin" {
+		index = 1
+	}
+	if index < 0 || index >= count {
+		return nil, fmt.Errorf("systemd passed no socket named '%s'", name)
+	}
+
+	file := os.NewFile(uintptr(listenFDsStart+index), "systemd:"+name)
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// sdNotify reports a state change such as READY=1 to the service manager. It does nothing when the
+// process was not started by systemd with Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// Abstract sockets are announced with a leading @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+}
+
+// watchdogInterval returns how often to ping the systemd watchdog, or 0 when it is not enabled
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	// Ping at half the timeout, as systemd recommends
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog pings the systemd watchdog for as long as the process passes its liveness check, so
+// systemd restarts a stalled aggregator
+func (h *health) runWatchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if h.alive() {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// tagFilterKey carries the tags a tools/list request is narrowed to
+type tagFilterKey struct{}
+
+// contextWithTagFilter returns a copy of ctx listing only the tools of servers tagged with any of tags
+func contextWithTagFilter(ctx context.Context, tags []string) context.Context {
+	if len(tags) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, tagFilterKey{}, tags)
+}
+
+// listsServer reports whether the tools of a server with the given tags are listed for ctx
+func listsServer(ctx context.Context, tags []string) bool {
+	filter, _ := ctx.Value(tagFilterKey{}).([]string)
+	if len(filter) == 0 {
+		return true
+	}
+	for _, wanted := range filter {
+		if hasTag(tags, wanted) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTag reports whether tags contains tag
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTagPolicies merges the TagPolicies of each tag an expanded server carries under its settings,
+// in the order of its tags
+func applyTagPolicies(server map[string]interface{}, policies map[string]map[string]interface{}) (map[string]interface{}, error) {
+	tags, ok := server["Tags"].([]interface{})
+	if !ok || len(policies) == 0 {
+		return server, nil
+	}
+	var merged interface{} = map[string]interface{}{}
+	for _, tag := range tags {
+		name, ok := tag.(string)
+		if !ok {
+			return nil, fmt.Errorf("Tags must be strings")
+		}
+		if policy, ok := policies[name]; ok {
+			merged = mergeJSON(merged, policy)
+		}
+	}
+	return mergeJSON(merged, server).(map[string]interface{}), nil
+}
+
+// disabledLocked reports whether a server carries a tag disabled through the admin API, while the caller holds mu
+func (r *backendRegistry) disabledLocked(config MCPStdIOConfig) bool {
+	for _, tag := range config.Tags {
+		if r.disabledTags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// setTagEnabled enables or disables every server tagged with tag and applies the change. Disabled
+// servers are stopped and stay stopped across reloads until their tag is enabled again.
+func (r *backendRegistry) setTagEnabled(tag string, enabled bool) error {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	r.mu.Lock()
+	if r.disabledTags[tag] == !enabled {
+		r.mu.Unlock()
+		return nil
+	}
+	if enabled {
+		delete(r.disabledTags, tag)
+	} else {
+		if r.disabledTags == nil {
+			r.disabledTags = make(map[string]bool)
+		}
+		r.disabledTags[tag] = true
+	}
+	cfg := r.config
+	r.mu.Unlock()
+
+	if enabled {
+		log.Printf("Enabling servers tagged '%s'", tag)
+	} else {
+		log.Printf("Disabling servers tagged '%s'", tag)
+	}
+	return r.applyLocked(cfg)
+}
+
+// disabledTagList returns the tags disabled through the admin API, ordered by name
+func (r *backendRegistry) disabledTagList() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tags := make([]string, 0, len(r.disabledTags))
+	for tag := range r.disabledTags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// expandTemplates merges the template each server Extends under the server's own settings, so many
+// similar servers can share their env, timeouts and policies. Objects such as Env are merged key by
+// key, anything else in the server replaces the template's value, and null removes it. Templates can
+// extend other templates. The TagPolicies of the server's tags are merged under the result.
+func expandTemplates(data []byte) ([]byte, error) {
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(data, &document); err != nil || (document["Templates"] == nil && document["TagPolicies"] == nil) {
+		// Not ours to expand; parseConfig reports malformed configs
+		return data, nil
+	}
+	var templates, policies, servers map[string]map[string]interface{}
+	if raw := document["Templates"]; raw != nil {
+		if err := decodeJSONNumbers(raw, &templates); err != nil {
+			return nil, fmt.Errorf("invalid Templates: %v", err)
+		}
+	}
+	if raw := document["TagPolicies"]; raw != nil {
+		if err := decodeJSONNumbers(raw, &policies); err != nil {
+			return nil, fmt.Errorf("invalid TagPolicies: %v", err)
+		}
+	}
+	if raw := document["MCPStdIOServers"]; raw != nil {
+		if err := decodeJSONNumbers(raw, &servers); err != nil {
+			return nil, fmt.Errorf("invalid MCPStdIOServers: %v", err)
+		}
+	}
+
+	for name, server := range servers {
+		expanded, err := extendTemplate(server, templates, nil)
+		if err == nil {
+			expanded, err = applyTagPolicies(expanded, policies)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("server '%s': %v", name, err)
+		}
+		servers[name] = expanded
+	}
+	if servers == nil {
+		return data, nil
+	}
+	expanded, err := json.Marshal(servers)
+	if err != nil {
+		return nil, err
+	}
+	document["MCPStdIOServers"] = expanded
+	return json.Marshal(document)
+}
+
+// extendTemplate returns entry merged over the template it extends, following the chain of templates
+// seen so far to refuse cycles
+func extendTemplate(entry map[string]interface{}, templates map[string]map[string]interface{}, seen []string) (map[string]interface{}, error) {
+	extends, ok := entry["Extends"]
+	if !ok || extends == nil {
+		return entry, nil
+	}
+	name, ok := extends.(string)
+	if !ok {
+		return nil, fmt.Errorf("Extends must name a template")
+	}
+	for _, ancestor := range seen {
+		if ancestor == name {
+			return nil, fmt.Errorf("templates extend each other in a cycle: %s -> %s", strings.Join(seen, " -> "), name)
+		}
+	}
+	template, ok := templates[name]
+	if !ok {
+		return nil, fmt.Errorf("extends unknown template '%s'", name)
+	}
+	base, err := extendTemplate(template, templates, append(seen, name))
+	if err != nil {
+		return nil, err
+	}
+	return mergeJSON(base, entry).(map[string]interface{}), nil
+}
+
+// mergeJSON returns override merged over base: objects are merged key by key, anything else is replaced
+func mergeJSON(base, override interface{}) interface{} {
+	baseObject, ok := base.(map[string]interface{})
+	overrideObject, overrides := override.(map[string]interface{})
+	if !ok || !overrides {
+		return override
+	}
+	merged := make(map[string]interface{}, len(baseObject)+len(overrideObject))
+	for key, value := range baseObject {
+		merged[key] = value
+	}
+	for key, value := range overrideObject {
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = mergeJSON(merged[key], value)
+	}
+	return merged
+}
+
+// decodeJSONNumbers decodes data keeping numbers as written, so large integers survive a round trip
+func decodeJSONNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,38 @@
+package main
+
+import "fmt"
+
+// TenantConfig customizes a tenant's own instance of a per-tenant server
+type TenantConfig struct {
+	// Env is merged over the server's Env, e.g. to give the tenant its own API key
+	Env map[string]string `json:"Env,omitempty"`
+	// WorkingDir replaces the server's WorkingDir
+	WorkingDir string `json:"WorkingDir,omitempty"`
+}
+
+// tenantServerConfig returns the configuration of the tenant's instance of a per-tenant server.
+// Tenants not listed in the server's Tenants get no instance, so a caller can never reach an
+// instance started for someone else or the shared instance that only lists the tools.
+func tenantServerConfig(name string, config MCPStdIOConfig, tenant string) (MCPStdIOConfig, error) {
+	if tenant == "" {
+		return MCPStdIOConfig{}, fmt.Errorf("server '%s' serves tenants only and the caller belongs to none", name)
+	}
+	override, ok := config.Tenants[tenant]
+	if !ok {
+		return MCPStdIOConfig{}, fmt.Errorf("server '%s' has no instance for tenant '%s'", name, tenant)
+	}
+
+	env := make(map[string]string, len(config.Env)+len(override.Env))
+	for key, value := range config.Env {
+		env[key] = value
+	}
+	for key, value := range override.Env {
+		env[key] = value
+	}
+	config.Env = env
+	if override.WorkingDir != "" {
+		config.WorkingDir = override.WorkingDir
+	}
+	config.Tenants = nil
+	return config, nil
+}
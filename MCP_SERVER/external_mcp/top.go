@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// topSparkWidth is how many recent calls a backend's latency sparkline covers
+const topSparkWidth = 20
+
+var sparkBars = []rune("▁▂▃▄▅▆▇█")
+
+// topModel is the state of the top monitor. Like a bubbletea model, it changes only in update
+// and is drawn by view, which keeps the terminal handling in runTop.
+type topModel struct {
+	status  dashboardStatus
+	err     error
+	updated time.Time
+	// scroll is the first error shown in the errors pane
+	scroll        int
+	width, height int
+	now           func() time.Time
+}
+
+// topKey is a key press in the monitor
+type topKey string
+
+// update applies a fetched status, a fetch error or a key press, and reports whether to quit
+func (m *topModel) update(msg interface{}) bool {
+	switch msg := msg.(type) {
+	case dashboardStatus:
+		m.status, m.err, m.updated = msg, nil, m.now()
+		m.scroll = min(m.scroll, max(len(m.status.Errors)-1, 0))
+	case error:
+		m.err = msg
+	case topKey:
+		switch msg {
+		case "q", "\x03":
+			return true
+		case "j", "\x1b[B":
+			m.scroll = min(m.scroll+1, max(len(m.status.Errors)-1, 0))
+		case "k", "\x1b[A":
+			m.scroll = max(m.scroll-1, 0)
+		case "g":
+			m.scroll = 0
+		}
+	}
+	return false
+}
+
+// view draws the monitor: a header, the backend table and as many errors as fit below it
+func (m *topModel) view() string {
+	var b strings.Builder
+	running := 0
+	for _, backend := range m.status.Backends {
+		if backend.State == "running" {
+			running++
+		}
+	}
+	b.WriteString(fmt.Sprintf("MCP aggregator: %d of %d backends running", running, len(m.status.Backends)))
+	if !m.updated.IsZero() {
+		b.WriteString(fmt.Sprintf(", updated %s", m.updated.Format("15:04:05")))
+	}
+	b.WriteString("    q quit, j/k scroll errors\n")
+	if m.err != nil {
+		b.WriteString(fmt.Sprintf("Failed to reach the aggregator: %v\n", m.err))
+	}
+	b.WriteString("\n")
+
+	rates, latencies := m.callStats()
+	b.WriteString(fmt.Sprintf("%-20s %-13s %5s %9s %9s  %s\n", "BACKEND", "STATE", "TOOLS", "CALLS/MIN", "LAST", "LATENCY"))
+	for _, backend := range m.status.Backends {
+		last := "-"
+		if recent := latencies[backend.Name]; len(recent) > 0 {
+			last = recent[len(recent)-1].Round(time.Millisecond).String()
+		}
+		b.WriteString(fmt.Sprintf("%-20s %-13s %5d %9d %9s  %s\n",
+			truncate(backend.Name, 20), backend.State, backend.Tools, rates[backend.Name], last, sparkline(latencies[backend.Name])))
+	}
+
+	// The errors pane takes the rest of the screen
+	lines := strings.Count(b.String(), "\n") + 2
+	rows := max(m.height-lines, 3)
+	b.WriteString(fmt.Sprintf("\nERRORS (%d)\n", len(m.status.Errors)))
+	for i := m.scroll; i < len(m.status.Errors) && i < m.scroll+rows; i++ {
+		call := m.status.Errors[i]
+		b.WriteString(fmt.Sprintf("%s %s %s %s: %s\n", call.Time.Local().Format("15:04:05"), call.Identity, call.Tool, call.Backend, call.Error))
+	}
+
+	if m.width <= 0 {
+		return b.String()
+	}
+	out := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	for i, line := range out {
+		out[i] = truncate(line, m.width)
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+// callStats returns each backend's calls in the last minute and the latencies of its recent
+// calls, oldest first
+func (m *topModel) callStats() (map[string]int, map[string][]time.Duration) {
+	rates := make(map[string]int)
+	latencies := make(map[string][]time.Duration)
+	since := m.now().Add(-time.Minute)
+	// Calls are newest first
+	for i := len(m.status.Calls) - 1; i >= 0; i-- {
+		call := m.status.Calls[i]
+		if call.Backend == "" {
+			continue
+		}
+		if call.Time.After(since) {
+			rates[call.Backend]++
+		}
+		if duration, err := time.ParseDuration(call.Duration); err == nil {
+			latencies[call.Backend] = append(latencies[call.Backend], duration)
+		}
+	}
+	for name, recent := range latencies {
+		if len(recent) > topSparkWidth {
+			latencies[name] = recent[len(recent)-topSparkWidth:]
+		}
+	}
+	return rates, latencies
+}
+
+// sparkline draws durations as bars scaled to the largest
+func sparkline(values []time.Duration) string {
+	var peak time.Duration
+	for _, value := range values {
+		peak = max(peak, value)
+	}
+	bars := make([]rune, len(values))
+	for i, value := range values {
+		index := 0
+		if peak > 0 {
+			index = int(value * time.Duration(len(sparkBars)-1) / peak)
+		}
+		bars[i] = sparkBars[index]
+	}
+	return string(bars)
+}
+
+// truncate shortens s to at most width runes
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	return string(runes[:width])
+}
+
+// listenerClient returns a client and base URL for an address in the syntax of -listen and -admin
+func listenerClient(addr string) (*http.Client, string, error) {
+	if addr == "" {
+		return nil, "", fmt.Errorf("no address given")
+	}
+	if strings.HasPrefix(addr, "systemd:") {
+		return nil, "", fmt.Errorf("cannot connect to a systemd socket name; pass its address instead")
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		client.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		}}
+		return client, "http://admin", nil
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return client, "http://" + addr, nil
+}
+
+// fetchStatus reads the dashboard status from the admin listener
+func fetchStatus(client *http.Client, base string) (dashboardStatus, error) {
+	var status dashboardStatus
+	resp, err := client.Get(base + "/dashboard/api/status")
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("admin listener returned %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+// runTop implements the top subcommand, a live terminal monitor of a running aggregator
+func runTop(adminAddr string, args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	addr := fs.String("admin", adminAddr, "Admin address of the running aggregator, e.g. 127.0.0.1:9090 or unix:/run/mcp-admin.sock")
+	interval := fs.Duration("interval", 2*time.Second, "How often to refresh")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	client, base, err := listenerClient(*addr)
+	if err != nil {
+		log.Fatalf("Failed to connect to the admin listener: %v", err)
+	}
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		log.Fatalf("top needs an interactive terminal")
+	}
+	state, err := term.MakeRaw(stdin)
+	if err != nil {
+		log.Fatalf("Failed to set up the terminal: %v", err)
+	}
+	defer term.Restore(stdin, state)
+	// Draw on the alternate screen with the cursor hidden, and put both back on exit
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan topKey)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- topKey(buf[:n])
+		}
+	}()
+
+	model := &topModel{now: time.Now}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	refresh := func() {
+		if status, err := fetchStatus(client, base); err != nil {
+			model.update(err)
+		} else {
+			model.update(status)
+		}
+	}
+	refresh()
+	for {
+		model.width, model.height, _ = term.GetSize(int(os.Stdout.Fd()))
+		// Raw mode needs explicit carriage returns
+		fmt.Print("\x1b[H\x1b[2J" + strings.ReplaceAll(model.view(), "\n", "\r\n"))
+		select {
+		case <-ticker.C:
+			refresh()
+		case key, ok := <-keys:
+			if !ok || model.update(key) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// maxHTTPBodySize bounds the size of a single JSON-RPC request accepted over HTTP
+const maxHTTPBodySize = 10 << 20
+
+// httpServerTransport serves MCP over plain HTTP: every POST carries one JSON-RPC message and
+// requests are answered in the HTTP response. Request ids are rewritten to unique internal ids so
+// that concurrent callers reusing the same ids don't collide inside the protocol layer.
+type httpServerTransport struct {
+	addr       string
+	middleware []func(http.Handler) http.Handler
+	server     *http.Server
+
+	mu        sync.Mutex
+	nextID    transport.RequestId
+	pending   map[transport.RequestId]*pendingHTTPRequest
+	onClose   func()
+	onError   func(error)
+	onMessage func(ctx context.Context, message *transport.BaseJsonRpcMessage)
+}
+
+// pendingHTTPRequest is a request waiting for the server to send its response
+type pendingHTTPRequest struct {
+	originalID transport.RequestId
+	response   chan *transport.BaseJsonRpcMessage
+}
+
+// newHTTPServerTransport creates a transport listening on addr; middleware wraps the JSON-RPC
+// handler in the given order, outermost first
+func newHTTPServerTransport(addr string, middleware ...func(http.Handler) http.Handler) *httpServerTransport {
+	return &httpServerTransport{
+		addr:       addr,
+		middleware: middleware,
+		pending:    make(map[transport.RequestId]*pendingHTTPRequest),
+	}
+}
+
+// Start begins listening for HTTP requests
+func (t *httpServerTransport) Start(ctx context.Context) error {
+	var handler http.Handler = http.HandlerFunc(t.handleRequest)
+	for i := len(t.middleware) - 1; i >= 0; i-- {
+		handler = t.middleware[i](handler)
+	}
+
+	listener, err := listen(t.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", t.addr, err)
+	}
+	t.server = &http.Server{Handler: handler}
+
+	go func() {
+		log.Printf("Serving MCP over HTTP on %s", listener.Addr())
+		if err := t.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.handleError(err)
+		}
+	}()
+	return nil
+}
+
+// Send delivers responses to the waiting HTTP request. Server-initiated messages cannot be pushed
+// over plain HTTP and are dropped.
+func (t *httpServerTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	var id transport.RequestId
+	switch message.Type {
+	case transport.BaseMessageTypeJSONRPCResponseType:
+		id = message.JsonRpcResponse.Id
+	case transport.BaseMessageTypeJSONRPCErrorType:
+		id = message.JsonRpcError.Id
+	default:
+		return nil
+	}
+
+	t.mu.Lock()
+	pending, ok := t.pending[id]
+	delete(t.pending, id)
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no pending HTTP request for id %d", id)
+	}
+
+	pending.response <- message
+	return nil
+}
+
+// Close shuts down the HTTP server
+func (t *httpServerTransport) Close() error {
+	var err error
+	if t.server != nil {
+		err = t.server.Close()
+	}
+
+	t.mu.Lock()
+	handler := t.onClose
+	t.mu.Unlock()
+	if handler != nil {
+		handler()
+	}
+	return err
+}
+
+// SetCloseHandler sets the handler for close events
+func (t *httpServerTransport) SetCloseHandler(handler func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onClose = handler
+}
+
+// SetErrorHandler sets the handler for error events
+func (t *httpServerTransport) SetErrorHandler(handler func(error)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onError = handler
+}
+
+// SetMessageHandler sets the handler for incoming messages
+func (t *httpServerTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onMessage = handler
+}
+
+func (t *httpServerTransport) handleError(err error) {
+	t.mu.Lock()
+	handler := t.onError
+	t.mu.Unlock()
+
+	if handler != nil {
+		handler(err)
+	}
+}
+
+func (t *httpServerTransport) handleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxHTTPBodySize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxHTTPBodySize {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	t.mu.Lock()
+	handler := t.onMessage
+	t.mu.Unlock()
+	if handler == nil {
+		http.Error(w, "Server not ready", http.StatusServiceUnavailable)
+		return
+	}
+	ctx := contextWithSession(r.Context(), r.Header.Get("Mcp-Session-Id"))
+
+	var request transport.BaseJSONRPCRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		// Notifications and responses don't get an answer
+		var notification transport.BaseJSONRPCNotification
+		if err := json.Unmarshal(body, &notification); err != nil {
+			http.Error(w, "Invalid JSON-RPC message", http.StatusBadRequest)
+			return
+		}
+		handler(ctx, transport.NewBaseMessageNotification(&notification))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// Swap in an internal id so concurrent callers can't collide
+	pending := &pendingHTTPRequest{
+		originalID: request.Id,
+		response:   make(chan *transport.BaseJsonRpcMessage, 1),
+	}
+	t.mu.Lock()
+	t.nextID++
+	request.Id = t.nextID
+	t.pending[request.Id] = pending
+	t.mu.Unlock()
+
+	handler(ctx, transport.NewBaseMessageRequest(&request))
+
+	var response *transport.BaseJsonRpcMessage
+	select {
+	case response = <-pending.response:
+	case <-r.Context().Done():
+		t.mu.Lock()
+		delete(t.pending, request.Id)
+		t.mu.Unlock()
+		return
+	}
+
+	switch response.Type {
+	case transport.BaseMessageTypeJSONRPCResponseType:
+		response.JsonRpcResponse.Id = pending.originalID
+	case transport.BaseMessageTypeJSONRPCErrorType:
+		response.JsonRpcError.Id = pending.originalID
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// contextTransport decorates the context of every incoming message before it reaches the server,
+// e.g. to attach the caller's identity on transports that have no per-request metadata of their own
+type contextTransport struct {
+	transport.Transport
+	decorate func(ctx context.Context, message *transport.BaseJsonRpcMessage) context.Context
+}
+
+// SetMessageHandler installs handler behind the context decorator
+func (t *contextTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.Transport.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		handler(t.decorate(ctx, message), message)
+	})
+}
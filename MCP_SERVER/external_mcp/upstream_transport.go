@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mcp "github.com/metoro-io/mcp-golang"
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// callOutcome receives details about a tool call's response that mcp.ToolResponse doesn't carry
+type callOutcome struct {
+	isError bool
+
+	// passthrough asks for a successful result of at most maxRaw bytes (0 for any size) to be kept
+	// undecoded in raw instead of being handed to the client
+	passthrough bool
+	maxRaw      int
+	raw         json.RawMessage
+
+	// sending is when the request was handed to the transport, sent when it was written and
+	// received when its response arrived
+	sending, sent, received time.Time
+}
+
+type callOutcomeKey struct{}
+
+// contextWithCallOutcome returns a copy of ctx through which the upstream transport reports the call's outcome
+func contextWithCallOutcome(ctx context.Context, outcome *callOutcome) context.Context {
+	return context.WithValue(ctx, callOutcomeKey{}, outcome)
+}
+
+// toolError is a tool call that reached the backend but was reported as failed
+type toolError struct {
+	response *mcp.ToolResponse
+}
+
+func (e *toolError) Error() string {
+	var texts []string
+	for _, content := range e.response.Content {
+		if content != nil && content.TextContent != nil {
+			texts = append(texts, content.TextContent.Text)
+		}
+	}
+	if len(texts) == 0 {
+		return "tool reported an error"
+	}
+	return strings.Join(texts, "\n")
+}
+
+// callTool calls a tool on client and turns responses flagged isError into a *toolError
+func callTool(ctx context.Context, client *mcp.Client, name string, arguments interface{}) (*mcp.ToolResponse, error) {
+	passthrough, relay := ctx.Value(passthroughKey{}).(passthroughRequest)
+	outcome := callOutcome{passthrough: relay, maxRaw: passthrough.maxSize}
+	resp, err := client.CallTool(contextWithCallOutcome(ctx, &outcome), name, arguments)
+	recordTransport(ctx, &outcome)
+	if err != nil {
+		return nil, err
+	}
+	if outcome.isError {
+		return nil, &toolError{response: resp}
+	}
+	if outcome.raw != nil {
+		return passthrough.results.placeholder(outcome.raw), nil
+	}
+	return resp, nil
+}
+
+// upstreamTransport wraps the transport of a client connected to a backend. It reports the isError flag
+// of tool call results back to the caller and turns JSON-RPC error responses into error results, which
+// the client library otherwise cannot handle.
+type upstreamTransport struct {
+	transport.Transport
+	// clientMetadata is added to the clientInfo announced in the initialize request
+	clientMetadata map[string]interface{}
+
+	mu       sync.Mutex
+	outcomes map[transport.RequestId]*callOutcome
+	// callers holds the downstream hosts of the tool calls in flight, which the server's
+	// elicitation requests are relayed to
+	callers map[transport.RequestId]*hostRelay
+	// requests are the proxy's own requests to the server, for methods the client library lacks
+	requests *pendingRequests
+	// watchers receive the server's notifications of the methods they watch
+	watchers map[string]func(params json.RawMessage)
+}
+
+func newUpstreamTransport(inner transport.Transport, clientMetadata map[string]interface{}) *upstreamTransport {
+	return &upstreamTransport{
+		Transport:      inner,
+		clientMetadata: clientMetadata,
+		outcomes:       make(map[transport.RequestId]*callOutcome),
+		callers:        make(map[transport.RequestId]*hostRelay),
+		requests:       newPendingRequests(),
+		watchers:       make(map[string]func(params json.RawMessage)),
+	}
+}
+
+// Send remembers which outgoing tool calls want their outcome reported, forwards the host's _meta
+// with them, updated to the budget they have left, and adds the client metadata to initialize
+func (t *upstreamTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	if message.Type == transport.BaseMessageTypeJSONRPCRequestType {
+		switch request := message.JsonRpcRequest; request.Method {
+		case "tools/call":
+			outcome, ok := ctx.Value(callOutcomeKey{}).(*callOutcome)
+			if ok {
+				t.mu.Lock()
+				t.outcomes[request.Id] = outcome
+				t.mu.Unlock()
+			}
+			if relay, ok := ctx.Value(hostRelayKey{}).(*hostRelay); ok {
+				t.mu.Lock()
+				t.callers[request.Id] = relay
+				t.mu.Unlock()
+			}
+			meta, err := forwardedMeta(ctx)
+			if err != nil {
+				return err
+			}
+			if len(meta) > 0 {
+				params, err := withMeta(request.Params, meta)
+				if err != nil {
+					return err
+				}
+				request.Params = params
+			}
+			if ok {
+				outcome.sending = time.Now()
+				err := t.Transport.Send(ctx, message)
+				outcome.sent = time.Now()
+				return err
+			}
+		case "initialize":
+			if len(t.clientMetadata) > 0 {
+				params, err := withClientMetadata(request.Params, t.clientMetadata)
+				if err != nil {
+					return err
+				}
+				request.Params = params
+			}
+			params, err := withElicitationCapability(request.Params)
+			if err != nil {
+				return err
+			}
+			request.Params = params
+		}
+	}
+	return t.Transport.Send(ctx, message)
+}
+
+// withClientMetadata merges metadata into the clientInfo of initialize params, keeping the name and version
+func withClientMetadata(params json.RawMessage, metadata map[string]interface{}) (json.RawMessage, error) {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(params, &decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode initialize params: %v", err)
+	}
+	clientInfo, _ := decoded["clientInfo"].(map[string]interface{})
+	if clientInfo == nil {
+		clientInfo = make(map[string]interface{})
+	}
+	for key, value := range metadata {
+		if _, ok := clientInfo[key]; !ok {
+			clientInfo[key] = value
+		}
+	}
+	decoded["clientInfo"] = clientInfo
+	return json.Marshal(decoded)
+}
+
+// SetMessageHandler installs handler behind the response inspection. The server's elicitation
+// requests are answered by the host, the responses to the proxy's own requests go to request and
+// watched notifications to their watchers, and none of them reaches handler.
+func (t *upstreamTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.Transport.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		if t.requests.answer(message) {
+			return
+		}
+		if message.Type == transport.BaseMessageTypeJSONRPCNotificationType {
+			t.mu.Lock()
+			watcher := t.watchers[message.JsonRpcNotification.Method]
+			t.mu.Unlock()
+			if watcher != nil {
+				watcher(message.JsonRpcNotification.Params)
+				return
+			}
+		}
+		if message.Type == transport.BaseMessageTypeJSONRPCRequestType && message.JsonRpcRequest.Method == "elicitation/create" {
+			go t.relayElicitation(message.JsonRpcRequest)
+			return
+		}
+		handler(ctx, t.inspect(message))
+	})
+}
+
+// inspect records the outcome of tool call responses and rewrites JSON-RPC errors into error results
+func (t *upstreamTransport) inspect(message *transport.BaseJsonRpcMessage) *transport.BaseJsonRpcMessage {
+	switch message.Type {
+	case transport.BaseMessageTypeJSONRPCErrorType:
+		rpcErr := message.JsonRpcError
+		t.forgetCaller(rpcErr.Id)
+		result, _ := json.Marshal(mcp.NewToolResponse(mcp.NewTextContent(rpcErr.Error.Message)))
+		if outcome := t.takeOutcome(rpcErr.Id); outcome != nil {
+			outcome.isError = true
+			outcome.received = time.Now()
+		}
+		return transport.NewBaseMessageResponse(&transport.BaseJSONRPCResponse{
+			Id:      rpcErr.Id,
+			Jsonrpc: rpcErr.Jsonrpc,
+			Result:  result,
+		})
+	case transport.BaseMessageTypeJSONRPCResponseType:
+		t.forgetCaller(message.JsonRpcResponse.Id)
+		outcome := t.takeOutcome(message.JsonRpcResponse.Id)
+		if outcome == nil {
+			break
+		}
+		outcome.received = time.Now()
+		var result struct {
+			IsError bool `json:"isError"`
+		}
+		_ = json.Unmarshal(message.JsonRpcResponse.Result, &result)
+		outcome.isError = result.IsError
+
+		// Keep the result for relaying and let the client decode an empty one in its place
+		raw := message.JsonRpcResponse.Result
+		if outcome.passthrough && !outcome.isError && (outcome.maxRaw <= 0 || len(raw) <= outcome.maxRaw) {
+			outcome.raw = raw
+			message.JsonRpcResponse.Result = json.RawMessage(`{"content":[]}`)
+		} else {
+			message.JsonRpcResponse.Result = repairToolResult(raw)
+		}
+	}
+	return message
+}
+
+// request sends the server a request the client library has no method for and returns its result
+func (t *upstreamTransport) request(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s params: %v", method, err)
+	}
+	return t.requests.send(ctx, t.Transport, method, encoded)
+}
+
+// watch passes the server's notifications of method to watcher instead of the client
+func (t *upstreamTransport) watch(method string, watcher func(params json.RawMessage)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.watchers[method] = watcher
+}
+
+// takeOutcome returns and forgets the outcome registered for the request id, if any
+func (t *upstreamTransport) takeOutcome(id transport.RequestId) *callOutcome {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	outcome := t.outcomes[id]
+	delete(t.outcomes, id)
+	return outcome
+}
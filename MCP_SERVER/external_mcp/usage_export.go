@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// usageFlushInterval is how often changed usage records are written to the usage file
+const usageFlushInterval = 5 * time.Second
+
+// UsageConfig records per-identity usage of every tool and backend for charge-back
+type UsageConfig struct {
+	// File persists usage records across restarts and is what the usage-export command reads; empty keeps them in memory
+	File string `json:"File,omitempty"`
+	// Bucket is the width of the time buckets calls are aggregated into; defaults to 1h
+	Bucket Duration `json:"Bucket,omitempty"`
+	// Retention drops buckets older than this; 0 keeps them forever
+	Retention Duration `json:"Retention,omitempty"`
+}
+
+// usageRecord aggregates the calls an identity made to a tool on a backend within one time bucket
+type usageRecord struct {
+	Bucket          time.Time `json:"bucket"`
+	Identity        string    `json:"identity"`
+	Tool            string    `json:"tool"`
+	Backend         string    `json:"backend"`
+	Count           int       `json:"count"`
+	DurationSeconds float64   `json:"durationSeconds"`
+}
+
+type usageKey struct {
+	bucket                  int64
+	identity, tool, backend string
+}
+
+// usageLedger aggregates calls into usage records. A nil ledger records nothing.
+type usageLedger struct {
+	cfg    UsageConfig
+	bucket time.Duration
+
+	mu      sync.Mutex
+	records map[usageKey]*usageRecord
+	dirty   bool
+	done    chan struct{}
+	closed  sync.WaitGroup
+}
+
+// openUsageLedger returns a ledger for cfg, loading earlier records from its file, or nil when usage is not recorded
+func openUsageLedger(cfg *UsageConfig) (*usageLedger, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	l := &usageLedger{cfg: *cfg, bucket: time.Duration(cfg.Bucket), records: make(map[usageKey]*usageRecord), done: make(chan struct{})}
+	if l.bucket <= 0 {
+		l.bucket = time.Hour
+	}
+	if cfg.File != "" {
+		records, err := readUsageFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			record := record
+			l.records[usageKey{record.Bucket.Unix(), record.Identity, record.Tool, record.Backend}] = &record
+		}
+		l.closed.Add(1)
+		go l.run()
+	}
+	return l, nil
+}
+
+// readUsageFile returns the records saved in a usage file, or none if it does not exist yet
+func readUsageFile(path string) ([]usageRecord, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []usageRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return records, nil
+}
+
+// record adds a call that started at start and took duration to its bucket
+func (l *usageLedger) record(identity, tool, backend string, start time.Time, duration time.Duration) {
+	if l == nil {
+		return
+	}
+	bucket := start.UTC().Truncate(l.bucket)
+	key := usageKey{bucket.Unix(), identity, tool, backend}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record := l.records[key]
+	if record == nil {
+		record = &usageRecord{Bucket: bucket, Identity: identity, Tool: tool, Backend: backend}
+		l.records[key] = record
+	}
+	record.Count++
+	record.DurationSeconds += duration.Seconds()
+	l.dirty = true
+}
+
+// between returns the records of the buckets starting in [from, to), oldest first. A zero bound is open.
+func (l *usageLedger) between(from, to time.Time) []usageRecord {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	records := make([]usageRecord, 0, len(l.records))
+	for _, record := range l.records {
+		records = append(records, *record)
+	}
+	l.mu.Unlock()
+	return filterUsage(records, from, to)
+}
+
+// filterUsage keeps the records of the buckets starting in [from, to) and sorts them by bucket,
+// identity, tool and backend
+func filterUsage(records []usageRecord, from, to time.Time) []usageRecord {
+	kept := records[:0]
+	for _, record := range records {
+		if (from.IsZero() || !record.Bucket.Before(from)) && (to.IsZero() || record.Bucket.Before(to)) {
+			kept = append(kept, record)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		a, b := kept[i], kept[j]
+		if !a.Bucket.Equal(b.Bucket) {
+			return a.Bucket.Before(b.Bucket)
+		}
+		if a.Identity != b.Identity {
+			return a.Identity < b.Identity
+		}
+		if a.Tool != b.Tool {
+			return a.Tool < b.Tool
+		}
+		return a.Backend < b.Backend
+	})
+	return kept
+}
+
+func (l *usageLedger) run() {
+	defer l.closed.Done()
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.flush()
+		case <-l.done:
+			l.flush()
+			return
+		}
+	}
+}
+
+// flush drops expired buckets and writes changed records to the usage file
+func (l *usageLedger) flush() {
+	l.mu.Lock()
+	if l.cfg.Retention > 0 {
+		cutoff := time.Now().Add(-time.Duration(l.cfg.Retention)).Unix()
+		for key := range l.records {
+			if key.bucket < cutoff {
+				delete(l.records, key)
+				l.dirty = true
+			}
+		}
+	}
+	if !l.dirty {
+		l.mu.Unlock()
+		return
+	}
+	records := make([]usageRecord, 0, len(l.records))
+	for _, record := range l.records {
+		records = append(records, *record)
+	}
+	l.dirty = false
+	l.mu.Unlock()
+
+	data, err := json.Marshal(filterUsage(records, time.Time{}, time.Time{}))
+	if err == nil {
+		err = writeFileAtomic(l.cfg.File, data)
+	}
+	if err != nil {
+		log.Printf("Failed to save usage records: %v", err)
+		// Retry on the next flush
+		l.mu.Lock()
+		l.dirty = true
+		l.mu.Unlock()
+	}
+}
+
+// close saves the records not yet written
+func (l *usageLedger) close() {
+	if l == nil || l.cfg.File == "" {
+		return
+	}
+	close(l.done)
+	l.closed.Wait()
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place, so a crash never
+// leaves the file partially written
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeUsage writes records as "csv" or "json"
+func writeUsage(w io.Writer, records []usageRecord, format string) error {
+	switch format {
+	case "", "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	case "csv":
+		out := csv.NewWriter(w)
+		_ = out.Write([]string{"bucket", "identity", "tool", "backend", "count", "duration_seconds"})
+		for _, record := range records {
+			_ = out.Write([]string{
+				record.Bucket.Format(time.RFC3339),
+				record.Identity,
+				record.Tool,
+				record.Backend,
+				strconv.Itoa(record.Count),
+				strconv.FormatFloat(record.DurationSeconds, 'f', 3, 64),
+			})
+		}
+		out.Flush()
+		return out.Error()
+	}
+	return fmt.Errorf("unknown format '%s', expected csv or json", format)
+}
+
+// parseUsageTime parses a range bound given as RFC 3339 or a date; empty is an open bound
+func parseUsageTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s', expected RFC 3339 or YYYY-MM-DD", value)
+	}
+	return t, nil
+}
+
+// ServeHTTP exports the records in the range given by the from and to query parameters in the
+// requested format, e.g. /usage?from=2026-10-01&to=2026-11-01&format=csv
+func (l *usageLedger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := parseUsageTime(query.Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseUsageTime(query.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		http.Error(w, fmt.Sprintf("unknown format '%s', expected csv or json", format), http.StatusBadRequest)
+		return
+	}
+	_ = writeUsage(w, l.between(from, to), format)
+}
+
+// runUsageExport prints the usage records saved in the configured usage file
+func runUsageExport(configPath string, args []string) {
+	fs := flag.NewFlagSet("usage-export", flag.ExitOnError)
+	fromFlag := fs.String("from", "", "Start of the range, RFC 3339 or YYYY-MM-DD; empty exports from the first record")
+	toFlag := fs.String("to", "", "End of the range (exclusive), RFC 3339 or YYYY-MM-DD; empty exports up to the last record")
+	format := fs.String("format", "csv", "Output format, csv or json")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	from, err := parseUsageTime(*fromFlag)
+	if err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	to, err := parseUsageTime(*toFlag)
+	if err != nil {
+		log.Fatalf("Invalid -to: %v", err)
+	}
+
+	cfg := loadConfig(configPath)
+	if cfg.Usage == nil || cfg.Usage.File == "" {
+		log.Fatalf("No usage file is configured under Usage.File")
+	}
+	records, err := readUsageFile(cfg.Usage.File)
+	if err != nil {
+		log.Fatalf("Failed to read usage records: %v", err)
+	}
+	if err := writeUsage(os.Stdout, filterUsage(records, from, to), *format); err != nil {
+		log.Fatalf("Failed to export usage: %v", err)
+	}
+}
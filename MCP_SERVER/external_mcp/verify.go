@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// verifyBackend checks a server's pinned binary checksum and package version before it is launched,
+// so a tampered or unexpectedly updated server is never started
+func verifyBackend(name string, config MCPStdIOConfig) error {
+	if config.SHA256 != "" && config.SSH != nil {
+		return fmt.Errorf("refusing to start '%s': the checksum of a command run over SSH cannot be verified", name)
+	}
+	if config.SHA256 != "" {
+		path, err := exec.LookPath(config.Command)
+		if err != nil {
+			return fmt.Errorf("refusing to start '%s': failed to locate command: %v", name, err)
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return fmt.Errorf("refusing to start '%s': failed to checksum %s: %v", name, path, err)
+		}
+		if !strings.EqualFold(sum, config.SHA256) {
+			return fmt.Errorf("refusing to start '%s': %s has SHA-256 %s, expected %s", name, path, sum, config.SHA256)
+		}
+	}
+
+	if config.PackageVersion != "" {
+		pkg, version, err := launcherPackage(config.Command, config.Args)
+		if err != nil {
+			return fmt.Errorf("refusing to start '%s': %v", name, err)
+		}
+		if version != config.PackageVersion {
+			return fmt.Errorf("refusing to start '%s': package %s is pinned to '%s', expected '%s'", name, pkg, version, config.PackageVersion)
+		}
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 of a file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// launcherPackage returns the package an npx or uvx launcher runs and the version it is pinned to,
+// e.g. "@scope/server@1.2.0" for npx or "server==1.2.0" and "server@1.2.0" for uvx
+func launcherPackage(command string, args []string) (string, string, error) {
+	launcher := strings.TrimSuffix(strings.ToLower(filepath.Base(command)), filepath.Ext(command))
+	var packageFlags []string
+	switch launcher {
+	case "npx":
+		packageFlags = []string{"-p", "--package"}
+	case "uvx":
+		packageFlags = []string{"--from"}
+	default:
+		return "", "", fmt.Errorf("PackageVersion is only supported for npx and uvx launchers, not '%s'", command)
+	}
+
+	spec := ""
+	for i := 0; i < len(args) && spec == ""; i++ {
+		arg := args[i]
+		for _, flag := range packageFlags {
+			if value, ok := strings.CutPrefix(arg, flag+"="); ok {
+				spec = value
+			} else if arg == flag && i+1 < len(args) {
+				spec = args[i+1]
+			}
+		}
+		if spec == "" && !strings.HasPrefix(arg, "-") {
+			spec = arg
+		}
+	}
+	if spec == "" {
+		return "", "", fmt.Errorf("no package found in the arguments of '%s'", command)
+	}
+
+	if launcher == "uvx" {
+		if pkg, version, ok := strings.Cut(spec, "=="); ok {
+			return pkg, version, nil
+		}
+	}
+	// The leading @ of a scoped npm package is not a version separator
+	if at := strings.LastIndex(spec, "@"); at > 0 {
+		return spec[:at], spec[at+1:], nil
+	}
+	return spec, "", nil
+}
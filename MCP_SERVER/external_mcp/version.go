@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// serverName is the name the aggregator announces to hosts and backends
+const serverName = "mcp-aggregator"
+
+// version, commit and buildDate are set at build time, e.g.
+// go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)".
+// Builds without them fall back to the VCS information Go stamps into the binary.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo identifies the aggregator build and what it has been configured to do
+type buildInfo struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+	// Capabilities are the optional features compiled into this build
+	Capabilities []string `json:"capabilities"`
+	// Features are the subsystems enabled by the applied config
+	Features []string `json:"features,omitempty"`
+}
+
+// currentBuild describes this binary, along with the features enabled by cfg when it is given
+func currentBuild(cfg *Config) buildInfo {
+	info := buildInfo{
+		Name:         serverName,
+		Version:      version,
+		Commit:       commit,
+		BuildDate:    buildDate,
+		GoVersion:    runtime.Version(),
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		Capabilities: []string{},
+	}
+	if stamped, ok := debug.ReadBuildInfo(); ok {
+		var modified bool
+		for _, setting := range stamped.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if modified && commit == "" && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+	if pluginsSupported {
+		info.Capabilities = append(info.Capabilities, "plugin-middleware")
+	}
+	if syslogSupported {
+		info.Capabilities = append(info.Capabilities, "syslog")
+	}
+	if cfg != nil {
+		info.Features = enabledFeatures(*cfg)
+	}
+	return info
+}
+
+// enabledFeatures names the optional subsystems cfg turns on, in alphabetical order
+func enabledFeatures(cfg Config) []string {
+	enabled := map[string]bool{
+		"artifacts":          cfg.Artifacts != nil,
+		"async-jobs":         cfg.Features.enabled(featureAsyncJobs),
+		"audit-log":          cfg.AuditLog != "",
+		"auth":               cfg.Auth != nil,
+		"bus":                cfg.Bus != nil,
+		"cache":              cfg.Cache != nil,
+		"catalog-budget":     cfg.CatalogBudget != nil,
+		"cluster":            cfg.Cluster != nil,
+		"context-injection":  len(cfg.ContextInjection) > 0,
+		"data-handling":      cfg.DataHandling != nil,
+		"discovery":          cfg.Discovery != nil,
+		"exporters":          len(cfg.Exporters) > 0,
+		"fuzzy-matching":     cfg.Features.enabled(featureFuzzyMatching),
+		"hmac":               cfg.HMAC != nil,
+		"host-profiles":      len(cfg.HostProfiles) > 0,
+		"jobs":               cfg.Jobs != nil,
+		"localization":       cfg.Localization != nil,
+		"log-sinks":          len(cfg.LogSinks) > 0,
+		"memory-watchdog":    cfg.MemoryWatchdog != nil,
+		"middleware":         len(cfg.Middleware) > 0,
+		"oidc":               cfg.Auth != nil && cfg.Auth.OIDC != nil,
+		"output-validation":  len(cfg.OutputExpectations) > 0,
+		"policy":             cfg.Policy != nil,
+		"postmortem":         cfg.Postmortem != nil,
+		"probes":             len(cfg.Probes) > 0,
+		"quotas":             cfg.Quotas != nil,
+		"remote-only":        cfg.RemoteOnly,
+		"result-cache":       cfg.Cache != nil && len(cfg.Cache.Results) > 0 && cfg.Features.enabled(featureResultCache),
+		"reverse-listen":     cfg.ReverseListen != "",
+		"sanitizers":         len(cfg.Sanitizers) > 0,
+		"schedules":          len(cfg.Schedules) > 0,
+		"scripts":            len(cfg.Scripts) > 0,
+		"shadow-log":         cfg.ShadowLog != "",
+		"size-annotations":   cfg.SizeAnnotations != nil,
+		"slow-calls":         cfg.SlowCalls != nil,
+		"snapshots":          cfg.Snapshots != nil,
+		"spend":              cfg.Spend != nil,
+		"strict-routing":     cfg.StrictRouting,
+		"summarizer":         cfg.Summarizer != nil,
+		"supervision":        cfg.Supervision != nil,
+		"tool-budgets":       cfg.ToolBudgets != nil,
+		"tool-search":        cfg.ToolSearch != nil,
+		"usage":              cfg.Usage != nil,
+		"webhooks":           len(cfg.Webhooks) > 0,
+		"stateful-instances": cfg.StatefulIdleTimeout > 0,
+	}
+	features := []string{}
+	for name, on := range enabled {
+		if on {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// banner is the line logged at startup naming the build
+func (info buildInfo) banner() string {
+	banner := fmt.Sprintf("%s %s", info.Name, info.Version)
+	if info.Commit != "" {
+		banner += ", commit " + info.Commit
+	}
+	if info.BuildDate != "" {
+		banner += ", built " + info.BuildDate
+	}
+	banner += fmt.Sprintf(", %s %s", info.GoVersion, info.Platform)
+	if len(info.Features) > 0 {
+		banner += ", features: " + strings.Join(info.Features, " ")
+	}
+	return banner
+}
+
+// ServerInfoRequest takes no arguments
+type ServerInfoRequest struct{}
+
+// handleServerInfo reports the build and the features enabled by the config applied last
+func handleServerInfo(rt *router) interface{} {
+	return func(ctx context.Context, args ServerInfoRequest) (*mcp.ToolResponse, error) {
+		cfg := rt.registry.applied()
+		infoJSON, err := json.Marshal(currentBuild(&cfg))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal server info: %v", err)
+		}
+		return mcp.NewToolResponse(mcp.NewTextContent(string(infoJSON))), nil
+	}
+}
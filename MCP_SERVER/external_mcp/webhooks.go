@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// WebhookConfig posts an event to URL whenever a matching tool call completes or fails, or a
+// supervised server is given up on for crash-looping
+type WebhookConfig struct {
+	URL string `json:"URL"`
+	// Tools are name patterns selecting the calls reported, e.g. "write_*"; empty reports every call
+	Tools []string `json:"Tools,omitempty"`
+	// Events selects "success" and "failure" outcomes and "crashloop" events; empty reports all of them
+	Events  []string          `json:"Events,omitempty"`
+	Headers map[string]string `json:"Headers,omitempty"`
+	// Template renders the request body from the event, e.g. {"text": {{json .Tool}}}; the event is sent as JSON by default
+	Template string   `json:"Template,omitempty"`
+	Retries  int      `json:"Retries,omitempty"`
+	Timeout  Duration `json:"Timeout,omitempty"`
+}
+
+// toolCallEvent describes a finished tool call as reported to webhooks. A crashloop event names the
+// server given up on in Backend, with the reason in Error.
+type toolCallEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity"`
+	Tool     string    `json:"tool"`
+	Backend  string    `json:"backend,omitempty"`
+	Duration string    `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+	// CorrelationID ties the event to the log lines of the same call
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+// webhookQueueSize bounds the number of events waiting for delivery; further events are dropped
+const webhookQueueSize = 256
+
+// webhook is a configured endpoint with its parsed body template
+type webhook struct {
+	config   WebhookConfig
+	template *template.Template
+	client   *http.Client
+}
+
+// webhookDispatcher delivers tool call events to the configured webhooks in the background.
+// A nil dispatcher fires nothing.
+type webhookDispatcher struct {
+	hooks []*webhook
+	queue chan toolCallEvent
+}
+
+func newWebhookDispatcher(configs []WebhookConfig) (*webhookDispatcher, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	d := &webhookDispatcher{queue: make(chan toolCallEvent, webhookQueueSize)}
+	for _, config := range configs {
+		hook := &webhook{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+		if config.Timeout > 0 {
+			hook.client.Timeout = time.Duration(config.Timeout)
+		}
+		if config.Template != "" {
+			tmpl, err := template.New(config.URL).Funcs(template.FuncMap{"json": templateJSON}).Parse(config.Template)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template for webhook '%s': %v", config.URL, err)
+			}
+			hook.template = tmpl
+		}
+		d.hooks = append(d.hooks, hook)
+	}
+
+	go d.deliver()
+	return d, nil
+}
+
+// fire queues the event for delivery without blocking the tool call
+func (d *webhookDispatcher) fire(event toolCallEvent) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.queue <- event:
+	default:
+		log.Printf("Webhook queue full, dropping %s event for tool '%s'", event.Event, event.Tool)
+	}
+}
+
+func (d *webhookDispatcher) deliver() {
+	for event := range d.queue {
+		for _, hook := range d.hooks {
+			if !hook.matches(event) {
+				continue
+			}
+			if err := hook.post(event); err != nil {
+				log.Printf("Failed to deliver webhook to '%s': %v", hook.config.URL, err)
+			}
+		}
+	}
+}
+
+// matches reports whether the webhook subscribes to the event's tool and outcome
+func (h *webhook) matches(event toolCallEvent) bool {
+	return matchesAny(h.config.Tools, event.Tool, true) && matchesAny(h.config.Events, event.Event, true)
+}
+
+// post sends the event, retrying with exponential backoff on transport errors and non-2xx responses
+func (h *webhook) post(event toolCallEvent) error {
+	body, err := h.render(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = h.send(body)
+		if err == nil || attempt >= h.config.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (h *webhook) render(event toolCallEvent) ([]byte, error) {
+	if h.template == nil {
+		return json.Marshal(event)
+	}
+	var buf bytes.Buffer
+	if err := h.template.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("failed to render template: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *webhook) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range h.config.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// templateJSON lets templates embed values as JSON literals, e.g. {{json .Error}}
+func templateJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
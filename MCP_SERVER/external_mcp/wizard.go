@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	mcp "github.com/metoro-io/mcp-golang"
+)
+
+// knownServer is a well-known MCP server offered by the init wizard
+type knownServer struct {
+	name        string
+	description string
+	runtime     string
+	command     string
+	args        []string
+	// prompt asks for a value appended to args, with fallback as the default answer
+	prompt   string
+	fallback string
+}
+
+// knownServers are offered by the init wizard in this order
+var knownServers = []knownServer{
+	{name: "filesystem", description: "Read and write files in a directory", runtime: "npx", command: "npx", args: []string{"-y", "@modelcontextprotocol/server-filesystem"}, prompt: "Directory to expose", fallback: "."},
+	{name: "fetch", description: "Fetch web pages as markdown", runtime: "uvx", command: "uvx", args: []string{"mcp-server-fetch"}},
+	{name: "browser", description: "Automate a headless browser with Puppeteer", runtime: "npx", command: "npx", args: []string{"-y", "@modelcontextprotocol/server-puppeteer"}},
+	{name: "memory", description: "Keep a knowledge graph across sessions", runtime: "npx", command: "npx", args: []string{"-y", "@modelcontextprotocol/server-memory"}},
+	{name: "git", description: "Inspect and edit a git repository", runtime: "uvx", command: "uvx", args: []string{"mcp-server-git", "--repository"}, prompt: "Repository path", fallback: "."},
+	{name: "time", description: "Current time and timezone conversion", runtime: "uvx", command: "uvx", args: []string{"mcp-server-time"}},
+}
+
+// runtimeHints tell the user how to get a missing launcher
+var runtimeHints = map[string]string{
+	"npx": "install Node.js from https://nodejs.org",
+	"uvx": "install uv from https://docs.astral.sh/uv/",
+}
+
+// wizard asks which well-known servers to enable and builds a config from the answers
+type wizard struct {
+	in       *bufio.Reader
+	out      io.Writer
+	lookPath func(file string) (string, error)
+}
+
+// run checks the available runtimes and asks about every known server they can launch
+func (w *wizard) run() (Config, error) {
+	available := make(map[string]bool)
+	for _, server := range knownServers {
+		if _, checked := available[server.runtime]; checked {
+			continue
+		}
+		_, err := w.lookPath(server.runtime)
+		available[server.runtime] = err == nil
+		if err != nil {
+			fmt.Fprintf(w.out, "%s not found, servers needing it are skipped (%s)\n", server.runtime, runtimeHints[server.runtime])
+		}
+	}
+
+	cfg := Config{MCPStdIOServers: make(map[string]MCPStdIOConfig)}
+	for _, server := range knownServers {
+		if !available[server.runtime] {
+			continue
+		}
+		enable, err := w.ask(fmt.Sprintf("Enable %s (%s)? [y/N]", server.name, server.description), "n")
+		if err != nil {
+			return Config{}, err
+		}
+		if !strings.HasPrefix(strings.ToLower(enable), "y") {
+			continue
+		}
+
+		args := append([]string(nil), server.args...)
+		if server.prompt != "" {
+			value, err := w.ask(fmt.Sprintf("%s [%s]:", server.prompt, server.fallback), server.fallback)
+			if err != nil {
+				return Config{}, err
+			}
+			args = append(args, value)
+		}
+		cfg.MCPStdIOServers[server.name] = MCPStdIOConfig{
+			Command:    server.command,
+			Args:       args,
+			Env:        map[string]string{},
+			WorkingDir: ".",
+		}
+	}
+	return cfg, nil
+}
+
+// ask prints a question and returns the trimmed answer, or fallback for an empty answer
+func (w *wizard) ask(question string, fallback string) (string, error) {
+	fmt.Fprintf(w.out, "%s ", question)
+	answer, err := w.in.ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		return "", fmt.Errorf("failed to read answer: %v", err)
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return fallback, nil
+	}
+	return answer, nil
+}
+
+// testConnectivity starts each configured server, lists its tools and stops it again
+func testConnectivity(cfg Config, out io.Writer) bool {
+	clientInfo := mcp.ClientInfo{Name: "mcp-service", Version: "1.0.0"}
+	ok := true
+	for name, config := range serverConfigs(cfg) {
+		fmt.Fprintf(out, "Testing %s... ", name)
+		b, err := startBackend(name, config, clientInfo)
+		if err == nil {
+			err = initializeBackend(b)
+			stopBackend(b)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "failed: %v\n", err)
+			ok = false
+			continue
+		}
+		fmt.Fprintf(out, "ok, %d tools\n", len(b.listedTools()))
+	}
+	return ok
+}
+
+// runInit implements the init command, interactively writing an mcp.json for well-known servers
+func runInit(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	dst := fs.String("to", "mcp.json", "Path of the mcp.json to write")
+	force := fs.Bool("force", false, "Overwrite the destination if it already exists")
+	skipTest := fs.Bool("skip-test", false, "Don't start the chosen servers to test them")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	if _, err := os.Stat(*dst); err == nil && !*force {
+		log.Fatalf("%s already exists, use -force to overwrite it", *dst)
+	}
+
+	w := &wizard{in: bufio.NewReader(os.Stdin), out: os.Stdout, lookPath: exec.LookPath}
+	cfg, err := w.run()
+	if err != nil {
+		log.Fatalf("Init aborted: %v", err)
+	}
+	if len(cfg.MCPStdIOServers) == 0 {
+		log.Fatalf("No servers chosen, nothing written")
+	}
+
+	out, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to marshal config: %v", err)
+	}
+	if err := os.WriteFile(*dst, out, 0o644); err != nil {
+		log.Fatalf("Failed to write config: %v", err)
+	}
+	fmt.Printf("Wrote %d servers to %s\n", len(cfg.MCPStdIOServers), *dst)
+
+	if *skipTest {
+		return
+	}
+	// Backend start-up logging would drown the test report
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	if !testConnectivity(cfg, os.Stdout) {
+		fmt.Println("Some servers failed to start; fix them in the config or rerun init")
+	}
+}
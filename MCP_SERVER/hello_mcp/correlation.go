@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// correlationTransport logs the correlation id proxies pass in the _meta of tool calls, so a call
+// can be followed from the host through every proxy down to this server
+type correlationTransport struct {
+	transport.Transport
+}
+
+func (t *correlationTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.Transport.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		if message.Type == transport.BaseMessageTypeJSONRPCRequestType && message.JsonRpcRequest.Method == "tools/call" {
+			var params struct {
+				Name string `json:"name"`
+				Meta struct {
+					CorrelationID string `json:"correlationId"`
+				} `json:"_meta"`
+			}
+			if err := json.Unmarshal(message.JsonRpcRequest.Params, &params); err == nil && params.Meta.CorrelationID != "" {
+				log.Printf("[%s] Received tool call: %s", params.Meta.CorrelationID, params.Name)
+			}
+		}
+		handler(ctx, message)
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// budgetMetaKey is the _meta field through which a caller, such as the aggregator, gives a tool call
+// a time budget in milliseconds
+const budgetMetaKey = "budgetMs"
+
+// deadlineTransport bounds the context of a tool call by the budget its caller passed, so handlers
+// give up on calls the caller no longer waits for. The context is released once the call is answered.
+type deadlineTransport struct {
+	transport.Transport
+
+	mu      sync.Mutex
+	cancels map[transport.RequestId]context.CancelFunc
+}
+
+func newDeadlineTransport(inner transport.Transport) *deadlineTransport {
+	return &deadlineTransport{Transport: inner, cancels: make(map[transport.RequestId]context.CancelFunc)}
+}
+
+func (t *deadlineTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.Transport.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		if message.Type == transport.BaseMessageTypeJSONRPCRequestType && message.JsonRpcRequest.Method == "tools/call" {
+			var params struct {
+				Meta map[string]interface{} `json:"_meta"`
+			}
+			if err := json.Unmarshal(message.JsonRpcRequest.Params, &params); err == nil {
+				if ms, ok := params.Meta[budgetMetaKey].(float64); ok && ms > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, time.Duration(ms*float64(time.Millisecond)))
+					t.mu.Lock()
+					t.cancels[message.JsonRpcRequest.Id] = cancel
+					t.mu.Unlock()
+				}
+			}
+		}
+		handler(ctx, message)
+	})
+}
+
+// Send releases the context of the call a response answers
+func (t *deadlineTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	var id transport.RequestId
+	switch message.Type {
+	case transport.BaseMessageTypeJSONRPCResponseType:
+		id = message.JsonRpcResponse.Id
+	case transport.BaseMessageTypeJSONRPCErrorType:
+		id = message.JsonRpcError.Id
+	default:
+		return t.Transport.Send(ctx, message)
+	}
+	t.mu.Lock()
+	cancel := t.cancels[id]
+	delete(t.cancels, id)
+	t.mu.Unlock()
+	if cancel != nil {
+		defer cancel()
+	}
+	return t.Transport.Send(ctx, message)
+}
@@ -12,6 +12,31 @@ import (
 	"github.com/metoro-io/mcp-golang/transport/stdio"
 )
 
+func TestTimestamp(t *testing.T) {
+	fixed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	resp, err := timestampHandler(func() time.Time { return fixed })(context.Background(), BasicInput{})
+	if err != nil {
+		t.Fatalf("Timestamp failed: %v", err)
+	}
+	if text := firstText(resp); text != "Current time: 2024-01-02T03:04:05Z\nUnix: 1704164645" {
+		t.Errorf("Expected the fixed time, got %q", text)
+	}
+}
+
+func TestHandlersHonorCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := echoHandler(ctx, StringInput{Text: "hi"}); err != context.Canceled {
+		t.Errorf("Expected echo to give up on a cancelled call, got %v", err)
+	}
+	if _, err := calculateHandler(ctx, CalcInput{Numbers: []float64{1, 2}}); err != context.Canceled {
+		t.Errorf("Expected calculate to give up on a cancelled call, got %v", err)
+	}
+	if resp, err := reverseHandler(context.Background(), StringInput{Text: "abc"}); err != nil || firstText(resp) != "cba" {
+		t.Errorf("Expected reverse to answer a live call, got %v", err)
+	}
+}
+
 func TestCallTools(t *testing.T) {
 	// Start the server process
 	cmd := exec.Command("./hellomcp") // assuming the binary is in the same directory
@@ -61,7 +86,7 @@ func TestCallTools(t *testing.T) {
 	if err != nil {
 		t.Logf("Echo tool error: %v", err)
 	} else {
-		fmt.Printf("Echo response: %v\n", echoResp.Content[0].TextContent.Text)
+		fmt.Printf("Echo response: %v\n", firstText(echoResp))
 	}
 
 	// Reverse tool
@@ -71,7 +96,7 @@ func TestCallTools(t *testing.T) {
 	if err != nil {
 		t.Logf("Reverse tool error: %v", err)
 	} else {
-		fmt.Printf("Reverse response: %v\n", reverseResp.Content[0].TextContent.Text)
+		fmt.Printf("Reverse response: %v\n", firstText(reverseResp))
 	}
 
 	// Calculate tool
@@ -81,7 +106,7 @@ func TestCallTools(t *testing.T) {
 	if err != nil {
 		t.Logf("Calculate tool error: %v", err)
 	} else {
-		fmt.Printf("Calculate response: %v\n", calcResp.Content[0].TextContent.Text)
+		fmt.Printf("Calculate response: %v\n", firstText(calcResp))
 	}
 
 	// Timestamp tool
@@ -91,6 +116,17 @@ func TestCallTools(t *testing.T) {
 	if err != nil {
 		t.Logf("Timestamp tool error: %v", err)
 	} else {
-		fmt.Printf("Timestamp response: %v\n", timeResp.Content[0].TextContent.Text)
+		fmt.Printf("Timestamp response: %v\n", firstText(timeResp))
+	}
+}
+
+// firstText returns the text of the response's first content item, or says why it has none
+func firstText(resp *mcp.ToolResponse) string {
+	if resp == nil || len(resp.Content) == 0 || resp.Content[0] == nil {
+		return "<no content>"
+	}
+	if resp.Content[0].TextContent == nil {
+		return fmt.Sprintf("<%s content>", resp.Content[0].Type)
 	}
+	return resp.Content[0].TextContent.Text
 }
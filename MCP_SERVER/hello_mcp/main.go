@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -28,7 +29,7 @@ type CalcInput struct {
 
 func main() {
 	// Initialize the MCP server
-	server := mcp.NewServer(stdio.NewStdioServerTransport())
+	server := mcp.NewServer(&correlationTransport{Transport: newDeadlineTransport(stdio.NewStdioServerTransport())})
 
 	// Register tools
 	tools := []struct {
@@ -39,7 +40,7 @@ func main() {
 		{"echo", "Echo the input text", echoHandler},
 		{"reverse", "Reverse the input text", reverseHandler},
 		{"calculate", "Perform calculations", calculateHandler},
-		{"timestamp", "Get current timestamp", timestampHandler},
+		{"timestamp", "Get current timestamp", timestampHandler(time.Now)},
 	}
 
 	for _, tool := range tools {
@@ -66,12 +67,18 @@ func main() {
 	log.Println("Server shutting down gracefully...")
 }
 
-func echoHandler(args StringInput) (*mcp.ToolResponse, error) {
+func echoHandler(ctx context.Context, args StringInput) (*mcp.ToolResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	result := strings.TrimSpace(args.Text)
 	return mcp.NewToolResponse(mcp.NewTextContent(result)), nil
 }
 
-func reverseHandler(args StringInput) (*mcp.ToolResponse, error) {
+func reverseHandler(ctx context.Context, args StringInput) (*mcp.ToolResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	runes := []rune(args.Text)
 	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
 		runes[i], runes[j] = runes[j], runes[i]
@@ -79,13 +86,16 @@ func reverseHandler(args StringInput) (*mcp.ToolResponse, error) {
 	return mcp.NewToolResponse(mcp.NewTextContent(string(runes))), nil
 }
 
-func calculateHandler(args CalcInput) (*mcp.ToolResponse, error) {
+func calculateHandler(ctx context.Context, args CalcInput) (*mcp.ToolResponse, error) {
 	if len(args.Numbers) == 0 {
 		return nil, fmt.Errorf("no numbers provided")
 	}
 
 	sum := 0.0
 	for _, n := range args.Numbers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		sum += n
 	}
 	avg := sum / float64(len(args.Numbers))
@@ -94,10 +104,16 @@ func calculateHandler(args CalcInput) (*mcp.ToolResponse, error) {
 	return mcp.NewToolResponse(mcp.NewTextContent(result)), nil
 }
 
-func timestampHandler(args BasicInput) (*mcp.ToolResponse, error) {
-	now := time.Now()
-	result := fmt.Sprintf("Current time: %s\nUnix: %d",
-		now.Format(time.RFC3339),
-		now.Unix())
-	return mcp.NewToolResponse(mcp.NewTextContent(result)), nil
+// timestampHandler reports the time told by now, which tests replace with a fixed clock
+func timestampHandler(now func() time.Time) func(ctx context.Context, args BasicInput) (*mcp.ToolResponse, error) {
+	return func(ctx context.Context, args BasicInput) (*mcp.ToolResponse, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		current := now()
+		result := fmt.Sprintf("Current time: %s\nUnix: %d",
+			current.Format(time.RFC3339),
+			current.Unix())
+		return mcp.NewToolResponse(mcp.NewTextContent(result)), nil
+	}
 }
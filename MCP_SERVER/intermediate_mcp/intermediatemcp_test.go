@@ -60,59 +60,58 @@ func TestIntermediateServer(t *testing.T) {
 
 	// Test HelloMCP tools
 	t.Run("Echo", func(t *testing.T) {
-		resp, err := client.CallTool(context.Background(), "tools/call", map[string]interface{}{
-			"name": "echo",
-			"arguments": map[string]interface{}{
-				"text": "Hello, World!",
-			},
+		resp, err := client.CallTool(context.Background(), "echo", map[string]interface{}{
+			"text": "Hello, World!",
 		})
 		if err != nil {
 			t.Errorf("Echo failed: %v", err)
 		} else {
-			fmt.Printf("Echo response: %v\n", resp.Content[0].TextContent.Text)
+			fmt.Printf("Echo response: %v\n", firstText(resp))
 		}
 	})
 
 	t.Run("Calculate", func(t *testing.T) {
-		resp, err := client.CallTool(context.Background(), "tools/call", map[string]interface{}{
-			"name": "calculate",
-			"arguments": map[string]interface{}{
-				"numbers": []float64{1, 2, 3, 4, 5},
-			},
+		resp, err := client.CallTool(context.Background(), "calculate", map[string]interface{}{
+			"numbers": []float64{1, 2, 3, 4, 5},
 		})
 		if err != nil {
 			t.Errorf("Calculate failed: %v", err)
 		} else {
-			fmt.Printf("Calculate response: %v\n", resp.Content[0].TextContent.Text)
+			fmt.Printf("Calculate response: %v\n", firstText(resp))
 		}
 	})
 
 	// Test ExternalMCP tools
 	t.Run("ListDirectory", func(t *testing.T) {
-		resp, err := client.CallTool(context.Background(), "tools/call", map[string]interface{}{
-			"name": "list_directory",
-			"arguments": map[string]interface{}{
-				"path": ".",
-			},
+		resp, err := client.CallTool(context.Background(), "list_directory", map[string]interface{}{
+			"path": ".",
 		})
 		if err != nil {
 			t.Errorf("List directory failed: %v", err)
 		} else {
-			fmt.Printf("Directory listing: %v\n", resp.Content[0].TextContent.Text)
+			fmt.Printf("Directory listing: %v\n", firstText(resp))
 		}
 	})
 
 	t.Run("DirectoryTree", func(t *testing.T) {
-		resp, err := client.CallTool(context.Background(), "tools/call", map[string]interface{}{
-			"name": "directory_tree",
-			"arguments": map[string]interface{}{
-				"path": ".",
-			},
+		resp, err := client.CallTool(context.Background(), "directory_tree", map[string]interface{}{
+			"path": ".",
 		})
 		if err != nil {
 			t.Errorf("Directory tree failed: %v", err)
 		} else {
-			fmt.Printf("Directory tree: %v\n", resp.Content[0].TextContent.Text)
+			fmt.Printf("Directory tree: %v\n", firstText(resp))
 		}
 	})
 }
+
+// firstText returns the text of the response's first content item, or says why it has none
+func firstText(resp *mcp.ToolResponse) string {
+	if resp == nil || len(resp.Content) == 0 || resp.Content[0] == nil {
+		return "<no content>"
+	}
+	if resp.Content[0].TextContent == nil {
+		return fmt.Sprintf("<%s content>", resp.Content[0].Type)
+	}
+	return resp.Content[0].TextContent.Text
+}
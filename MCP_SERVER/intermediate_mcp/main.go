@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"os"
 	"os/exec"
@@ -14,27 +13,15 @@ import (
 	"github.com/metoro-io/mcp-golang/transport/stdio"
 )
 
-type ToolRequest struct {
-	Name      string      `json:"name"`
-	Arguments interface{} `json:"arguments"`
-}
-
-var (
-	helloClient    *mcp.Client
-	externalClient *mcp.Client
-)
-
 func main() {
-	// Initialize the intermediate server
-	server := mcp.NewServer(stdio.NewStdioServerTransport())
-
 	// Start and initialize clients for both MCPs
-	setupClients()
+	upstreams := setupClients()
 
-	// Register the tools
-	if err := server.RegisterTool("tools/call", "Tool wrapper", handleToolCall); err != nil {
-		log.Fatalf("Failed to register tool wrapper: %v", err)
-	}
+	// Initialize the intermediate server, serving the tools of both MCPs as its own
+	server := mcp.NewServer(&proxyTransport{
+		Transport: stdio.NewStdioServerTransport(),
+		upstreams: upstreams,
+	})
 
 	// Handle shutdown
 	stop := make(chan os.Signal, 1)
@@ -52,7 +39,7 @@ func main() {
 	<-stop
 }
 
-func setupClients() {
+func setupClients() []*upstream {
 	// Start HelloMCP
 	helloCmd := exec.Command("../hello_mcp/hellomcp")
 	helloStdin, err := helloCmd.StdinPipe()
@@ -87,12 +74,12 @@ func setupClients() {
 	time.Sleep(2 * time.Second)
 
 	// Create and initialize clients
-	helloClient = mcp.NewClientWithInfo(
-		stdio.NewStdioServerTransportWithIO(helloStdout, helloStdin),
+	helloClient := mcp.NewClientWithInfo(
+		&metaTransport{Transport: stdio.NewStdioServerTransportWithIO(helloStdout, helloStdin)},
 		mcp.ClientInfo{Name: "hello-client", Version: "1.0.0"},
 	)
-	externalClient = mcp.NewClientWithInfo(
-		stdio.NewStdioServerTransportWithIO(externalStdout, externalStdin),
+	externalClient := mcp.NewClientWithInfo(
+		&metaTransport{Transport: stdio.NewStdioServerTransportWithIO(externalStdout, externalStdin)},
 		mcp.ClientInfo{Name: "external-client", Version: "1.0.0"},
 	)
 
@@ -109,54 +96,10 @@ func setupClients() {
 	}
 
 	log.Println("Both clients initialized successfully")
-}
-
-func handleToolCall(req ToolRequest) (*mcp.ToolResponse, error) {
-	log.Printf("Received tool call request: %s", req.Name)
-	ctx := context.Background()
-
-	// First, check if the tool exists in HelloMCP by listing its tools
-	cursor := ""
-	toolsList, err := helloClient.ListTools(ctx, &cursor)
-	if err == nil {
-		// Check if the requested tool is in HelloMCP
-		toolExists := false
-		for _, tool := range toolsList.Tools {
-			if name := tool.Name; name == req.Name {
-				toolExists = true
-				break
-			}
-		}
 
-		// If tool exists in HelloMCP, try to call it
-		if toolExists {
-			resp, err := helloClient.CallTool(ctx, req.Name, req.Arguments)
-			if err == nil {
-				log.Printf("HelloMCP successfully handled tool: %s", req.Name)
-				return resp, nil
-			}
-			log.Printf("HelloMCP failed to handle existing tool %s: %v", req.Name, err)
-		}
-	}
-
-	// List available tools from ExternalMCP
-	tools, err := externalClient.ListTools(ctx, &cursor)
-	if err != nil {
-		log.Fatalf("Failed to list ExternalMCP tools: %v", err)
+	// HelloMCP is asked first, as it was before ExternalMCP
+	return []*upstream{
+		{name: "HelloMCP", client: helloClient},
+		{name: "ExternalMCP", client: externalClient},
 	}
-	log.Printf("Available ExternalMCP tools: %+v", tools.Tools)
-
-	// If the tool wasn't found in HelloMCP or failed, pass to ExternalMCP through its tools/call wrapper
-	log.Printf("Forwarding request to ExternalMCP: %s", req.Name)
-	resp, err := externalClient.CallTool(ctx, "tools/call", map[string]interface{}{
-		"name":      req.Name,
-		"arguments": req.Arguments,
-	})
-	if err == nil {
-		log.Printf("ExternalMCP successfully handled tool: %s", req.Name)
-		return resp, nil
-	}
-	log.Printf("ExternalMCP failed to handle tool %s: %v", req.Name, err)
-
-	return nil, fmt.Errorf("no server could handle the tool %s", req.Name)
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	mcp "github.com/metoro-io/mcp-golang"
+	"github.com/metoro-io/mcp-golang/transport"
+)
+
+// upstream is an MCP server whose tools the intermediary serves as its own
+type upstream struct {
+	name   string
+	client *mcp.Client
+}
+
+// proxyTransport answers tools/list and tools/call from the upstream servers using standard MCP
+// requests, so any compliant server can sit behind the intermediary. Every other message, such as
+// initialize and ping, is handled by the server.
+type proxyTransport struct {
+	transport.Transport
+	upstreams []*upstream
+}
+
+// toolCallParams are the params of a standard tools/call request
+type toolCallParams struct {
+	Name      string                 `json:"name"`
+	Arguments interface{}            `json:"arguments"`
+	Meta      map[string]interface{} `json:"_meta,omitempty"`
+}
+
+// SetMessageHandler serves tool requests from the upstreams and hands everything else to handler
+func (t *proxyTransport) SetMessageHandler(handler func(ctx context.Context, message *transport.BaseJsonRpcMessage)) {
+	t.Transport.SetMessageHandler(func(ctx context.Context, message *transport.BaseJsonRpcMessage) {
+		if message.Type == transport.BaseMessageTypeJSONRPCRequestType {
+			switch request := message.JsonRpcRequest; request.Method {
+			case "tools/list":
+				go t.respond(ctx, request.Id, t.listTools(ctx))
+				return
+			case "tools/call":
+				go t.respond(ctx, request.Id, t.callTool(ctx, request.Params))
+				return
+			}
+		}
+		handler(ctx, message)
+	})
+}
+
+// listTools merges the tools of all upstreams; a tool offered by several upstreams goes to the first
+func (t *proxyTransport) listTools(ctx context.Context) interface{} {
+	tools := []mcp.ToolRetType{}
+	seen := make(map[string]bool)
+	for _, u := range t.upstreams {
+		for _, tool := range u.tools(ctx) {
+			if !seen[tool.Name] {
+				seen[tool.Name] = true
+				tools = append(tools, tool)
+			}
+		}
+	}
+	return map[string]interface{}{"tools": tools}
+}
+
+// callTool forwards a tool call to the first upstream offering the tool
+func (t *proxyTransport) callTool(ctx context.Context, raw json.RawMessage) interface{} {
+	var params toolCallParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return toolError(fmt.Errorf("invalid tools/call params: %v", err))
+	}
+	// Keep the host's correlation id, or start one, so the upstream logs the call under the same id
+	id, _ := params.Meta[correlationMetaKey].(string)
+	if id == "" {
+		id = newCorrelationID()
+		if params.Meta == nil {
+			params.Meta = make(map[string]interface{})
+		}
+		params.Meta[correlationMetaKey] = id
+	}
+	log.Printf("[%s] Received tool call request: %s", id, params.Name)
+
+	for _, u := range t.upstreams {
+		if !u.hasTool(ctx, params.Name) {
+			continue
+		}
+		resp, err := u.client.CallTool(contextWithMeta(ctx, params.Meta), params.Name, params.Arguments)
+		if err != nil {
+			log.Printf("[%s] %s failed to handle tool %s: %v", id, u.name, params.Name, err)
+			return toolError(err)
+		}
+		log.Printf("[%s] %s successfully handled tool: %s", id, u.name, params.Name)
+		return resp
+	}
+	return toolError(fmt.Errorf("no server could handle the tool %s", params.Name))
+}
+
+// correlationMetaKey is the _meta key carrying the correlation id of a tool call
+const correlationMetaKey = "correlationId"
+
+// newCorrelationID returns a random correlation id
+func newCorrelationID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// respond sends the result of a request back to the host
+func (t *proxyTransport) respond(ctx context.Context, id transport.RequestId, result interface{}) {
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Failed to marshal result: %v", err)
+		return
+	}
+	response := transport.NewBaseMessageResponse(&transport.BaseJSONRPCResponse{Jsonrpc: "2.0", Id: id, Result: encoded})
+	if err := t.Transport.Send(ctx, response); err != nil {
+		log.Printf("Failed to send response: %v", err)
+	}
+}
+
+// toolError is a tool result reporting err to the host
+func toolError(err error) interface{} {
+	return map[string]interface{}{
+		"content": []*mcp.Content{mcp.NewTextContent(err.Error())},
+		"isError": true,
+	}
+}
+
+// tools lists every page of the upstream's tools
+func (u *upstream) tools(ctx context.Context) []mcp.ToolRetType {
+	var tools []mcp.ToolRetType
+	cursor := ""
+	for {
+		page, err := u.client.ListTools(ctx, &cursor)
+		if err != nil {
+			log.Printf("Failed to list %s tools: %v", u.name, err)
+			return tools
+		}
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == nil || *page.NextCursor == "" {
+			return tools
+		}
+		cursor = *page.NextCursor
+	}
+}
+
+// hasTool reports whether the upstream currently offers the named tool
+func (u *upstream) hasTool(ctx context.Context, name string) bool {
+	for _, tool := range u.tools(ctx) {
+		if tool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type metaKey struct{}
+
+// contextWithMeta returns a copy of ctx carrying the _meta to forward with an upstream call
+func contextWithMeta(ctx context.Context, meta map[string]interface{}) context.Context {
+	if len(meta) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, metaKey{}, meta)
+}
+
+// metaTransport adds the _meta carried by the context to outgoing tools/call requests
+type metaTransport struct {
+	transport.Transport
+}
+
+func (t *metaTransport) Send(ctx context.Context, message *transport.BaseJsonRpcMessage) error {
+	meta, _ := ctx.Value(metaKey{}).(map[string]interface{})
+	if len(meta) > 0 && message.Type == transport.BaseMessageTypeJSONRPCRequestType && message.JsonRpcRequest.Method == "tools/call" {
+		var params map[string]interface{}
+		if err := json.Unmarshal(message.JsonRpcRequest.Params, &params); err != nil {
+			return fmt.Errorf("failed to decode tools/call params: %v", err)
+		}
+		params["_meta"] = meta
+		encoded, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		message.JsonRpcRequest.Params = encoded
+	}
+	return t.Transport.Send(ctx, message)
+}